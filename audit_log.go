@@ -0,0 +1,154 @@
+package dastard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry describes one RPC control call, so that operators sharing a Dastard can
+// reconstruct who changed what during a run.
+type AuditEntry struct {
+	Time       time.Time
+	Method     string
+	ArgsDigest string // the first 16 hex digits of the SHA-256 of the JSON argument
+	Client     string // the client's address, prefixed by "http:" for the HTTP gateway
+	DurationMs float64
+	OK         bool
+	Error      string `json:",omitempty"`
+}
+
+// auditLog appends an AuditEntry for each RPC control call to a file of JSON lines,
+// and optionally broadcasts each as an AUDIT message.
+type auditLog struct {
+	file    *os.File
+	updates chan<- ClientUpdate // if not nil, entries are broadcast here
+	skipped map[string]bool     // services and methods whose calls are not audited
+	sync.Mutex
+}
+
+// audit is the audit log of the JSON-RPC control port and the HTTP gateway.
+var audit = auditLog{skipped: map[string]bool{"StatusQuery": true, "SourceControl.Ping": true}}
+
+// open starts appending entries to filename ("" for no file), and broadcasting them to
+// updates if that is not nil.
+func (a *auditLog) open(filename string, updates chan<- ClientUpdate) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	a.updates = updates
+	if filename == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	return nil
+}
+
+// record writes entry to the file and broadcasts it. The broadcast may block, so it is
+// sent after the lock is released.
+func (a *auditLog) record(entry AuditEntry) {
+	a.Lock()
+	if a.file != nil {
+		line, err := json.Marshal(entry)
+		if err == nil {
+			_, err = a.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			logWarningf("Could not write the RPC audit log: %v", err)
+		}
+	}
+	updates := a.updates
+	a.Unlock()
+	if updates != nil {
+		updates <- ClientUpdate{"AUDIT", entry}
+	}
+}
+
+// audited returns whether calls of method are audited.
+func (a *auditLog) audited(method string) bool {
+	service := strings.SplitN(method, ".", 2)[0]
+	return !a.skipped[service] && !a.skipped[method]
+}
+
+// argsDigest returns a short digest of an RPC argument, so that the audit log shows
+// whether two calls had the same argument without storing large ones (such as projectors).
+func argsDigest(body interface{}) string {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Sprintf("unmarshalable %T", body)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditCodec wraps a ServerCodec, timing each call and recording it in the audit log.
+type auditCodec struct {
+	rpc.ServerCodec
+	client  string
+	log     *auditLog
+	current *AuditEntry            // the request whose body is read next
+	pending map[uint64]*AuditEntry // calls awaiting their response, by sequence number
+	sync.Mutex
+}
+
+// newAuditCodec returns a codec that audits the calls made through codec by client.
+func newAuditCodec(codec rpc.ServerCodec, client string, log *auditLog) *auditCodec {
+	return &auditCodec{ServerCodec: codec, client: client, log: log, pending: make(map[uint64]*AuditEntry)}
+}
+
+// ReadRequestHeader reads a request header and starts timing the call.
+func (c *auditCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.Lock()
+	defer c.Unlock()
+	c.current = nil
+	if err == nil && c.log.audited(r.ServiceMethod) {
+		c.current = &AuditEntry{Time: time.Now(), Method: r.ServiceMethod, Client: c.client}
+		c.pending[r.Seq] = c.current
+	}
+	return err
+}
+
+// ReadRequestBody reads a request's argument and notes its digest.
+func (c *auditCodec) ReadRequestBody(body interface{}) error {
+	err := c.ServerCodec.ReadRequestBody(body)
+	c.Lock()
+	defer c.Unlock()
+	if c.current != nil && body != nil {
+		c.current.ArgsDigest = argsDigest(body)
+	}
+	return err
+}
+
+// WriteResponse writes a response and records the finished call.
+func (c *auditCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	err := c.ServerCodec.WriteResponse(r, body)
+	c.Lock()
+	entry, ok := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.Unlock()
+	if ok {
+		entry.DurationMs = float64(time.Since(entry.Time)) / float64(time.Millisecond)
+		entry.OK = r.Error == ""
+		entry.Error = r.Error
+		c.log.record(*entry)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package dastard
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type AuditTestService struct{}
+
+func (a *AuditTestService) Double(x *int, reply *int) error {
+	if *x < 0 {
+		return fmt.Errorf("negative argument %d", *x)
+	}
+	*reply = 2 * *x
+	return nil
+}
+
+func TestAuditLog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	filename := filepath.Join(tmp, "sub", "audit.log")
+	updates := make(chan ClientUpdate, 10)
+	log := auditLog{skipped: map[string]bool{"StatusQuery": true, "SourceControl.Ping": true}}
+	if err := log.open(filename, updates); err != nil {
+		t.Fatal(err)
+	}
+	if log.audited("StatusQuery.Latest") || log.audited("SourceControl.Ping") || !log.audited("SourceControl.Start") {
+		t.Error("auditLog.audited() should skip only StatusQuery methods and Ping")
+	}
+
+	server := rpc.NewServer()
+	if err := server.Register(new(AuditTestService)); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(newAuditCodec(jsonrpc.NewServerCodec(serverConn), "client:1234", &log))
+	client := jsonrpc.NewClient(clientConn)
+	defer client.Close()
+
+	var reply int
+	for _, x := range []int{3, -1, 3} {
+		err := client.Call("AuditTestService.Double", &x, &reply)
+		if (x < 0) != (err != nil) {
+			t.Errorf("Double(%d) returned error %v", x, err)
+		}
+	}
+	var entries []AuditEntry
+	for i := 0; i < 3; i++ {
+		u := <-updates
+		if u.tag != "AUDIT" {
+			t.Errorf("audit update tag = %q, want AUDIT", u.tag)
+		}
+		entries = append(entries, u.state.(AuditEntry))
+	}
+	for i, e := range entries {
+		if e.Method != "AuditTestService.Double" || e.Client != "client:1234" || len(e.ArgsDigest) != 16 {
+			t.Errorf("audit entry %d = %+v, want method, client, and 16-digit digest", i, e)
+		}
+		if e.OK != (i != 1) || (e.Error == "") != e.OK {
+			t.Errorf("audit entry %d OK=%v Error=%q, want failure only for the negative argument", i, e.OK, e.Error)
+		}
+	}
+	if entries[0].ArgsDigest != entries[2].ArgsDigest || entries[0].ArgsDigest == entries[1].ArgsDigest {
+		t.Errorf("audit digests %q, %q, %q should match only for equal arguments",
+			entries[0].ArgsDigest, entries[1].ArgsDigest, entries[2].ArgsDigest)
+	}
+
+	// The file should hold the same entries, one per line.
+	log.open("", nil)
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	nlines := 0
+	for ; scanner.Scan(); nlines++ {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Errorf("audit log line %d is not an AuditEntry: %v", nlines, err)
+		} else if nlines < len(entries) && e.ArgsDigest != entries[nlines].ArgsDigest {
+			t.Errorf("audit log line %d digest %q, want %q", nlines, e.ArgsDigest, entries[nlines].ArgsDigest)
+		}
+	}
+	if nlines != len(entries) {
+		t.Errorf("audit log has %d lines, want %d", nlines, len(entries))
+	}
+}
@@ -0,0 +1,141 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// AutoTriggerLevelConfig is the RPC-usable structure for AutoSetTriggerLevels.
+type AutoTriggerLevelConfig struct {
+	ChannelIndices []int   // empty means all channels
+	NSigma         float64 // set thresholds this many noise sigmas from the baseline
+	WindowSamples  int     // measure the noise over this many samples (0 means use the default)
+	SetEdge        bool    // set EdgeLevel from the noise in the edge trigger's difference signal
+	SetLevel       bool    // set LevelLevel from the baseline and its noise
+}
+
+// defaultAutoLevelWindow is the number of samples measured if WindowSamples is 0.
+const defaultAutoLevelWindow = 4096
+
+// validate checks the config for errors and fills in the default window.
+func (config *AutoTriggerLevelConfig) validate() error {
+	if !(config.NSigma > 0) {
+		return fmt.Errorf("AutoTriggerLevelConfig NSigma=%v, need > 0", config.NSigma)
+	}
+	if config.WindowSamples < 0 {
+		return fmt.Errorf("AutoTriggerLevelConfig WindowSamples=%v, need >= 0", config.WindowSamples)
+	}
+	if config.WindowSamples == 0 {
+		config.WindowSamples = defaultAutoLevelWindow
+	}
+	if config.WindowSamples < 16 {
+		return fmt.Errorf("AutoTriggerLevelConfig WindowSamples=%v, need >= 16", config.WindowSamples)
+	}
+	if !(config.SetEdge || config.SetLevel) {
+		return fmt.Errorf("AutoTriggerLevelConfig has neither SetEdge nor SetLevel")
+	}
+	return nil
+}
+
+// autoLevelMeasurement holds a pending request to set trigger levels, and the
+// samples collected so far to measure the noise.
+type autoLevelMeasurement struct {
+	config  AutoTriggerLevelConfig
+	samples []float64
+}
+
+// StartAutoTriggerLevel makes this stream measure its noise over the next
+// config.WindowSamples samples, then set its trigger levels. The config must be valid.
+func (dsp *DataStreamProcessor) StartAutoTriggerLevel(config *AutoTriggerLevelConfig) {
+	dsp.autoLevel = &autoLevelMeasurement{config: *config,
+		samples: make([]float64, 0, config.WindowSamples)}
+}
+
+// autoLevelCollect adds the samples in segment to any pending noise measurement.
+// When enough samples have been collected, it sets the trigger levels and sets
+// dsp.autoLevelDone so the source knows to broadcast the new trigger state.
+func (dsp *DataStreamProcessor) autoLevelCollect(segment *DataSegment) {
+	m := dsp.autoLevel
+	if m == nil {
+		return
+	}
+	samples, signed := segment.triggerSamples()
+	for _, v := range samples {
+		if len(m.samples) >= m.config.WindowSamples {
+			break
+		}
+		if signed {
+			m.samples = append(m.samples, float64(int16(v)))
+		} else {
+			m.samples = append(m.samples, float64(v))
+		}
+	}
+	if len(m.samples) < m.config.WindowSamples {
+		return
+	}
+	dsp.setTriggerLevelsFromNoise(m.samples, &m.config)
+	dsp.autoLevel = nil
+	dsp.autoLevelDone = true
+}
+
+// setTriggerLevelsFromNoise sets the trigger thresholds from noise samples. The noise
+// is estimated robustly (from the median absolute deviation), so a few pulses in the
+// samples don't spoil the measurement.
+func (dsp *DataStreamProcessor) setTriggerLevelsFromNoise(samples []float64, config *AutoTriggerLevelConfig) {
+	if config.SetLevel {
+		baseline, sigma := robustMeanSigma(samples)
+		level := baseline + config.NSigma*sigma
+		if !dsp.LevelRising {
+			level = baseline - config.NSigma*sigma
+		}
+		if _, signed := dsp.stream.triggerSamples(); signed {
+			dsp.LevelLevel = RawType(int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(level)))))
+		} else {
+			dsp.LevelLevel = RawType(math.Max(0, math.Min(math.MaxUint16, math.Round(level))))
+		}
+	}
+	if config.SetEdge {
+		// The edge trigger looks at x[i]+x[i-1]-x[i-2]-x[i-3]; EdgeMulti looks at x[i]-x[i-1].
+		var diffs []float64
+		if dsp.EdgeMulti {
+			for i := 1; i < len(samples); i++ {
+				diffs = append(diffs, samples[i]-samples[i-1])
+			}
+		} else {
+			for i := 3; i < len(samples); i++ {
+				diffs = append(diffs, samples[i]+samples[i-1]-samples[i-2]-samples[i-3])
+			}
+		}
+		_, sigma := robustMeanSigma(diffs)
+		edge := int32(math.Max(1, math.Ceil(config.NSigma*sigma)))
+		if dsp.EdgeMulti && dsp.EdgeLevel < 0 {
+			edge = -edge // EdgeMulti looks for negative-going edges when EdgeLevel < 0
+		}
+		dsp.EdgeLevel = edge
+	}
+}
+
+// robustMeanSigma returns the median of x and the standard deviation estimated as
+// 1.4826 times the median absolute deviation, which equals sigma for Gaussian noise.
+func robustMeanSigma(x []float64) (center, sigma float64) {
+	if len(x) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	sorted := append([]float64{}, x...)
+	sort.Float64s(sorted)
+	center = sortedMedian(sorted)
+	for i, v := range x {
+		sorted[i] = math.Abs(v - center)
+	}
+	sort.Float64s(sorted)
+	return center, 1.4826 * sortedMedian(sorted)
+}
+
+func sortedMedian(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return 0.5 * (sorted[n/2-1] + sorted[n/2])
+}
@@ -0,0 +1,88 @@
+package dastard
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestAutoTriggerLevel(t *testing.T) {
+	const baseline, sigma = 1000.0, 10.0
+	const nsamp = 20000
+	rng := rand.New(rand.NewSource(1))
+	data := make([]RawType, nsamp)
+	for i := range data {
+		data[i] = RawType(baseline + sigma*rng.NormFloat64() + 0.5)
+	}
+	// Add a few big pulses, which must not spoil the noise measurement.
+	for _, start := range []int{1000, 7000, 15000} {
+		for j := 0; j < 200; j++ {
+			data[start+j] += RawType(5000 * math.Exp(-float64(j)/50))
+		}
+	}
+
+	dsp := NewDataStreamProcessor(0, nil, 100, 200)
+	dsp.LevelRising = true
+	config := AutoTriggerLevelConfig{NSigma: 5, WindowSamples: nsamp, SetEdge: true, SetLevel: true}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	dsp.StartAutoTriggerLevel(&config)
+	// Feed the data in 2 segments; the levels should be set only after the second.
+	half := nsamp / 2
+	seg1 := NewDataSegment(data[:half], 1, 0, time.Now(), time.Millisecond)
+	dsp.autoLevelCollect(seg1)
+	if dsp.autoLevelDone || dsp.LevelLevel != 0 || dsp.EdgeLevel != 0 {
+		t.Errorf("trigger levels were set before the window was complete")
+	}
+	seg2 := NewDataSegment(data[half:], 1, FrameIndex(half), time.Now(), time.Millisecond)
+	dsp.autoLevelCollect(seg2)
+	if !dsp.autoLevelDone || dsp.autoLevel != nil {
+		t.Fatalf("trigger levels were not set after the window was complete")
+	}
+	// Allow 10% errors in the measured sigma.
+	if level := float64(dsp.LevelLevel); math.Abs(level-(baseline+5*sigma)) > 0.1*5*sigma {
+		t.Errorf("LevelLevel=%v, want %v", level, baseline+5*sigma)
+	}
+	// The edge trigger difference x[i]+x[i-1]-x[i-2]-x[i-3] has noise 2*sigma.
+	if edge := float64(dsp.EdgeLevel); math.Abs(edge-5*2*sigma) > 0.1*5*2*sigma {
+		t.Errorf("EdgeLevel=%v, want %v", edge, 5*2*sigma)
+	}
+
+	// Falling level trigger and EdgeMulti with negative-going edges.
+	dsp.LevelRising = false
+	dsp.EdgeMulti = true
+	dsp.EdgeLevel = -1
+	config.NSigma = 4
+	dsp.setTriggerLevelsFromNoise(toFloats(data), &config)
+	if level := float64(dsp.LevelLevel); math.Abs(level-(baseline-4*sigma)) > 0.1*4*sigma {
+		t.Errorf("falling LevelLevel=%v, want %v", level, baseline-4*sigma)
+	}
+	if edge := float64(dsp.EdgeLevel); math.Abs(edge+4*math.Sqrt2*sigma) > 0.1*4*math.Sqrt2*sigma {
+		t.Errorf("EdgeMulti EdgeLevel=%v, want %v", edge, -4*math.Sqrt2*sigma)
+	}
+
+	for _, bad := range []AutoTriggerLevelConfig{
+		{NSigma: 0, SetEdge: true},
+		{NSigma: 5, WindowSamples: -1, SetEdge: true},
+		{NSigma: 5, WindowSamples: 10, SetEdge: true},
+		{NSigma: 5},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("AutoTriggerLevelConfig %+v should fail validation", bad)
+		}
+	}
+	good := AutoTriggerLevelConfig{NSigma: 5, SetLevel: true}
+	if err := good.validate(); err != nil || good.WindowSamples != defaultAutoLevelWindow {
+		t.Errorf("AutoTriggerLevelConfig validate gave err=%v, WindowSamples=%d", err, good.WindowSamples)
+	}
+}
+
+func toFloats(data []RawType) []float64 {
+	x := make([]float64, len(data))
+	for i, v := range data {
+		x[i] = float64(v)
+	}
+	return x
+}
@@ -0,0 +1,55 @@
+package dastard
+
+// autoTriggerPhase returns the phase of channel channelIndex's auto triggers, as a
+// fraction of the auto-trigger delay, so that the auto triggers of nchan channels with
+// the same AutoDelay are spread evenly over the delay instead of all coming at once.
+func autoTriggerPhase(channelIndex, nchan int) float64 {
+	if nchan <= 1 {
+		return 0
+	}
+	return float64(channelIndex%nchan) / float64(nchan)
+}
+
+// autoTriggerGrid returns the first segment index at or after i whose frame lies on the
+// channel's auto-trigger grid: frames spaced by period, offset by the channel's phase.
+// Without staggering, it returns i.
+func (dsp *DataStreamProcessor) autoTriggerGrid(i, firstFramenum, period FrameIndex) FrameIndex {
+	if !dsp.autoStagger || period <= 0 {
+		return i
+	}
+	phase := FrameIndex(dsp.autoPhase*float64(period) + 0.5)
+	r := (i + firstFramenum - phase) % period
+	if r < 0 {
+		r += period
+	}
+	if r == 0 {
+		return i
+	}
+	return i + period - r
+}
+
+// StaggerAutoTriggers turns on or off the per-channel phase offsets of auto triggers.
+func (ds *AnySource) StaggerAutoTriggers(enable bool) {
+	for i, dsp := range ds.processors {
+		dsp.autoStagger = enable
+		dsp.autoPhase = autoTriggerPhase(i, len(ds.processors))
+	}
+}
+
+// SetAutoTriggerStagger turns on or off the staggering of auto triggers: each channel's
+// auto triggers come at its own phase of the AutoDelay, so channels that share an
+// AutoDelay don't all trigger (and write) at once. It applies at once to an active
+// source. The setting is broadcast as AUTOTRIGGERSTAGGER, so the client updater saves it
+// in the config file, and it is used when each source starts.
+func (s *SourceControl) SetAutoTriggerStagger(enable *bool, reply *bool) error {
+	s.clientUpdates <- ClientUpdate{"AUTOTRIGGERSTAGGER", *enable}
+	*reply = true
+	if !s.isSourceActive {
+		return nil
+	}
+	f := func() {
+		s.ActiveSource.StaggerAutoTriggers(*enable)
+		s.queuedResults <- nil
+	}
+	return s.runLaterIfActive(f)
+}
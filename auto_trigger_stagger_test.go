@@ -0,0 +1,58 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoTriggerStagger(t *testing.T) {
+	const nchan = 4
+	broker := NewTriggerBroker(1)
+	go broker.Run()
+	defer broker.Stop()
+
+	const ndata, delay = 10000, 1000
+	autoTriggers := func(channelIndex int, stagger bool) []FrameIndex {
+		dsp := NewDataStreamProcessor(0, broker, 20, 100)
+		dsp.SampleRate = 1000.0
+		dsp.AutoTrigger = true
+		dsp.AutoDelay = delay * time.Millisecond
+		dsp.autoStagger = stagger
+		dsp.autoPhase = autoTriggerPhase(channelIndex, nchan)
+		segment := NewDataSegment(make([]RawType, ndata), 1, 0, time.Now(), time.Millisecond)
+		dsp.stream.AppendSegment(segment)
+		primaries, _ := dsp.TriggerData()
+		var autos []FrameIndex
+		for _, rec := range primaries {
+			autos = append(autos, rec.trigFrame)
+		}
+		return autos
+	}
+
+	for i := 0; i < nchan; i++ {
+		plain := autoTriggers(i, false)
+		if len(plain) == 0 || plain[0] != 20 {
+			t.Fatalf("channel %d auto triggers without staggering %v, want the first at 20", i, plain)
+		}
+		autos := autoTriggers(i, true)
+		if len(autos) < 2 {
+			t.Fatalf("channel %d made %d staggered auto triggers, want several", i, len(autos))
+		}
+		phase := FrameIndex(i * delay / nchan)
+		for j, f := range autos {
+			if f%delay != phase {
+				t.Errorf("channel %d auto trigger at %d, want phase %d of the delay %d", i, f, phase, delay)
+			}
+			if j > 0 && f-autos[j-1] != delay {
+				t.Errorf("channel %d auto triggers at %d and %d, want them %d apart", i, autos[j-1], f, delay)
+			}
+		}
+	}
+
+	if p := autoTriggerPhase(0, 1); p != 0 {
+		t.Errorf("autoTriggerPhase(0, 1) = %v, want 0", p)
+	}
+	if p := autoTriggerPhase(3, 4); p != 0.75 {
+		t.Errorf("autoTriggerPhase(3, 4) = %v, want 0.75", p)
+	}
+}
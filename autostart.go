@@ -0,0 +1,68 @@
+package dastard
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// sourceStartNames maps the ServerStatus.SourceName of each source to the name that
+// starts it.
+var sourceStartNames = map[string]string{
+	"SimPulses":     "SIMPULSESOURCE",
+	"Triangles":     "TRIANGLESOURCE",
+	"Lancero":       "LANCEROSOURCE",
+	"CaptureReplay": "CAPTUREREPLAYSOURCE",
+}
+
+// SetAutoStart turns on or off the automatic start of the last-used source when
+// Dastard launches. The setting is broadcast as AUTOSTART, so the client updater saves it
+// in the config file along with the rest of the state.
+func (s *SourceControl) SetAutoStart(enable *bool, reply *bool) error {
+	s.clientUpdates <- ClientUpdate{"AUTOSTART", *enable}
+	*reply = true
+	return nil
+}
+
+// autoStart starts the source that was last used (as saved in the STATUS), then
+// restores the saved trigger states. If resumeWriting, it also starts writing again
+// with the last WriteControl START settings, in a new run directory. Problems with the
+// triggers or writing are logged, and do not stop the source.
+func (s *SourceControl) autoStart(resumeWriting bool) error {
+	name, ok := sourceStartNames[s.status.SourceName]
+	if !ok {
+		return fmt.Errorf("cannot auto-start the last source %q", s.status.SourceName)
+	}
+	logInfof("Auto-starting data source %s", name)
+	var okay bool
+	if err := s.Start(&name, &okay); err != nil {
+		return err
+	}
+
+	var states []FullTriggerState
+	if err := viper.UnmarshalKey("trigger", &states); err != nil {
+		logWarningf("Could not read the saved trigger states: %v", err)
+	}
+	for i := range states {
+		if err := s.ConfigureTriggers(&states[i], &okay); err != nil {
+			logWarningf("Could not restore the trigger state of channels %v: %v", states[i].ChannelIndicies, err)
+		}
+	}
+
+	if !resumeWriting {
+		return nil
+	}
+	var config WriteControlConfig
+	if err := viper.UnmarshalKey("writecontrol", &config); err != nil || !strings.EqualFold(config.Request, "start") {
+		logWarningf("Writing was active, but there are no saved WriteControl settings to resume it")
+		return nil
+	}
+	var reply WriteControlReply
+	if err := s.WriteControl(&config, &reply); err != nil {
+		logWarningf("Could not resume writing: %v", err)
+	} else {
+		logInfof("Resumed writing in %s", reply.RunDirectory)
+	}
+	return nil
+}
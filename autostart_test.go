@@ -0,0 +1,111 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAutoStart(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_autostart_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	sc := NewSourceControl()
+	defer sc.lancero.Delete()
+	// Nothing else empties this SourceControl's heartbeats; a blocked source can't stop.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-sc.heartbeats:
+			case <-done:
+				return
+			}
+		}
+	}()
+	updates := make(chan ClientUpdate, 100)
+	sc.clientUpdates = updates
+	tags := make(chan string, 1000)
+	go func() {
+		for u := range updates {
+			tags <- u.tag
+		}
+	}()
+	defer close(updates)
+
+	var okay bool
+	if err := sc.ConfigureTriangleSource(&TriangleSourceConfig{Nchan: 2, SampleRate: 10000.0, Min: 100, Max: 200}, &okay); err != nil {
+		t.Fatal(err)
+	}
+	enable := true
+	if err := sc.SetAutoStart(&enable, &okay); err != nil || !okay {
+		t.Errorf("SetAutoStart(true) gives %t, %v", okay, err)
+	}
+
+	sc.status.SourceName = "NoSuchSource"
+	if err := sc.autoStart(false); err == nil {
+		t.Error("autoStart should fail when the last source is unknown")
+	}
+
+	// Saved state, as the client updater would leave it in the config file.
+	saved := FullTriggerState{ChannelIndicies: []int{1},
+		TriggerState: TriggerState{AutoTrigger: true, AutoDelay: 250 * time.Millisecond}}
+	viper.Set("trigger", []FullTriggerState{saved})
+	viper.Set("writecontrol", WriteControlConfig{Request: "Start", Path: tmp, WriteLJH3: true, Comment: "resumed"})
+	defer viper.Set("trigger", nil)
+	defer viper.Set("writecontrol", nil)
+
+	sc.status.SourceName = "Triangles"
+	sc.status.Npresamp = 20
+	sc.status.Nsamples = 100
+	if err := sc.autoStart(true); err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Stop(nil, &okay)
+	if !sc.isSourceActive || sc.ActiveSource != DataSource(sc.triangle) {
+		t.Fatal("autoStart did not start the TriangleSource")
+	}
+	restored := false
+	for _, state := range sc.ActiveSource.ComputeFullTriggerState() {
+		for _, ch := range state.ChannelIndicies {
+			if ch == 1 && state.AutoTrigger && state.AutoDelay == saved.AutoDelay {
+				restored = true
+			}
+		}
+	}
+	if !restored {
+		t.Errorf("autoStart did not restore trigger state %+v: have %+v", saved, sc.ActiveSource.ComputeFullTriggerState())
+	}
+	ws := sc.ActiveSource.ComputeWritingState()
+	if !ws.Active || !strings.HasPrefix(ws.RunDirectory, tmp) {
+		t.Errorf("autoStart did not resume writing under %s: %+v", tmp, ws)
+	}
+	stop := WriteControlConfig{Request: "Stop"}
+	var reply WriteControlReply
+	if err := sc.WriteControl(&stop, &reply); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Dir(ws.FilenamePattern)); err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	seen := make(map[string]bool)
+	for len(tags) > 0 {
+		seen[<-tags] = true
+	}
+	for _, tag := range []string{"AUTOSTART", "WRITECONTROL", "TRIGGER"} {
+		if !seen[tag] {
+			t.Errorf("no %s message was broadcast", tag)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package dastard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/usnistgov/dastard/ljh"
+)
+
+// BenchmarkConfig is the RPC-usable structure for RunBenchmark. Zero values get the defaults.
+type BenchmarkConfig struct {
+	Nchan       int       // default 64
+	SampleRate  float64   // frames per second (default 100000)
+	NSamples    int       // record length (default 512)
+	NPresamples int       // default NSamples/4
+	Rates       []float64 // records per second per channel, tried in increasing order (default 1, 3, 10, ... up to SampleRate/NSamples)
+	Seconds     float64   // of data processed at each rate (default 2)
+	Write       string    // BenchmarkWriteNone (default), BenchmarkWriteDisk, or BenchmarkWriteNull
+	Path        string    // directory of the temporary files of BenchmarkWriteDisk (default: the system's)
+	Publish     bool      // also publish records and summaries on the usual ports
+}
+
+// Allowed values of BenchmarkConfig.Write
+const (
+	BenchmarkWriteNone = "NONE" // write no files
+	BenchmarkWriteDisk = "DISK" // write LJH files to a temporary directory, removed afterwards
+	BenchmarkWriteNull = "NULL" // encode LJH files, but discard the bytes
+)
+
+// The stages of processing timed by a benchmark
+const (
+	BenchmarkStageTrigger = "TRIGGER" // decimating, filtering, and finding the primary triggers
+	BenchmarkStageAnalyze = "ANALYZE" // secondary triggers, analysis, energies, and vetoes
+	BenchmarkStagePublish = "PUBLISH" // publishing, and encoding the records for the files
+	BenchmarkStageWrite   = "WRITE"   // writing and flushing the files
+)
+
+// benchmarkMaxLoad is the largest ratio of processing time to data time that counts as
+// sustainable, leaving room for reading the data and for bursts.
+const benchmarkMaxLoad = 0.8
+
+// benchmarkBlockSeconds is the length of data in each block processed by a benchmark.
+const benchmarkBlockSeconds = 0.05
+
+// BenchmarkStep is the result of processing data at one rate.
+type BenchmarkStep struct {
+	Rate             float64 // records per second per channel asked for
+	RecordsPerSecond float64 // records made per second of data, all channels
+	DataSeconds      float64 // length of the data processed
+	ProcessSeconds   float64 // wall time spent processing them
+	Load             float64 // ProcessSeconds / DataSeconds
+	Sustainable      bool    // Load <= benchmarkMaxLoad
+	// Time in each stage, summed over all channels (so it can exceed ProcessSeconds
+	// when the processing workers run in parallel).
+	TriggerSeconds float64
+	AnalyzeSeconds float64
+	PublishSeconds float64
+	WriteSeconds   float64
+	Bottleneck     string // the stage that took the most time
+}
+
+// BenchmarkResult is the result of RunBenchmark, sent to clients as a "BENCHMARK" message.
+type BenchmarkResult struct {
+	Steps              []BenchmarkStep // one per rate, through the first that is not sustainable
+	MaxSustainableRate float64         // highest sustainable rate (records per second per channel), or 0
+	Bottleneck         string          // the bottleneck of the first unsustainable step, or the last step
+	Workers            int             // size of the processing worker pool
+	Error              string          `json:",omitempty"` // why the benchmark failed, if it did
+}
+
+// validate checks the config and fills in the defaults.
+func (config *BenchmarkConfig) validate() error {
+	if config.Nchan == 0 {
+		config.Nchan = 64
+	}
+	if config.SampleRate == 0 {
+		config.SampleRate = 100000
+	}
+	if config.NSamples == 0 {
+		config.NSamples = 512
+	}
+	if config.NPresamples == 0 {
+		config.NPresamples = config.NSamples / 4
+	}
+	if config.Seconds == 0 {
+		config.Seconds = 2
+	}
+	if config.Nchan < 1 {
+		return fmt.Errorf("BenchmarkConfig.Nchan=%d, need > 0", config.Nchan)
+	}
+	if !(config.SampleRate > 0) || math.IsInf(config.SampleRate, 1) {
+		return fmt.Errorf("BenchmarkConfig.SampleRate=%v, need > 0", config.SampleRate)
+	}
+	if config.NPresamples < 3 || config.NPresamples >= config.NSamples {
+		return fmt.Errorf("BenchmarkConfig has NPresamples=%d, NSamples=%d, need 3 <= NPresamples < NSamples",
+			config.NPresamples, config.NSamples)
+	}
+	if !(config.Seconds > 0) || config.Seconds > 60 {
+		return fmt.Errorf("BenchmarkConfig.Seconds=%v, need in (0, 60]", config.Seconds)
+	}
+	maxRate := config.SampleRate / float64(config.NSamples)
+	if len(config.Rates) == 0 {
+		for decade := 1.0; decade <= maxRate; decade *= 10 {
+			for _, r := range []float64{decade, 3 * decade} {
+				if r <= maxRate {
+					config.Rates = append(config.Rates, r)
+				}
+			}
+		}
+	}
+	for i, rate := range config.Rates {
+		if !(rate > 0) || rate > maxRate {
+			return fmt.Errorf("BenchmarkConfig.Rates[%d]=%v, need in (0, SampleRate/NSamples=%v]", i, rate, maxRate)
+		}
+		if i > 0 && rate <= config.Rates[i-1] {
+			return fmt.Errorf("BenchmarkConfig.Rates=%v, need increasing rates", config.Rates)
+		}
+	}
+	switch config.Write {
+	case "":
+		config.Write = BenchmarkWriteNone
+	case BenchmarkWriteNone, BenchmarkWriteDisk, BenchmarkWriteNull:
+	default:
+		return fmt.Errorf("BenchmarkConfig.Write=%q, need one of (%s, %s, %s)", config.Write,
+			BenchmarkWriteNone, BenchmarkWriteDisk, BenchmarkWriteNull)
+	}
+	return nil
+}
+
+// BenchmarkSource generates identical pulses in every channel, and pushes them through
+// the whole processing pipeline as fast as it can, to learn how much data this computer
+// can handle. It is not a DataSource: it never runs in real time, and its records go to
+// no files but its own (temporary) ones.
+type BenchmarkSource struct {
+	config       BenchmarkConfig
+	onecycle     []RawType // one pulse period of data
+	nextFrameNum FrameIndex
+	runStart     time.Time
+	tempDir      string
+	writeNanos   int64 // time spent in writes to the files (atomic)
+	AnySource
+}
+
+// NewBenchmarkSource creates a new BenchmarkSource.
+func NewBenchmarkSource() *BenchmarkSource {
+	bs := new(BenchmarkSource)
+	bs.name = "Benchmark"
+	return bs
+}
+
+// Configure checks the config and sets up the source.
+func (bs *BenchmarkSource) Configure(config *BenchmarkConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	bs.config = *config
+	bs.config.Rates = append([]float64{}, config.Rates...)
+	bs.nchan = config.Nchan
+	bs.sampleRate = config.SampleRate
+	bs.samplePeriod = time.Duration(roundint(1e9 / bs.sampleRate))
+	return nil
+}
+
+// Sample names the channels. Their names differ from those of the real sources, so no
+// stored calibrations, projectors, or dead channels apply.
+func (bs *BenchmarkSource) Sample() error {
+	bs.chanNames = make([]string, bs.nchan)
+	bs.chanNumbers = make([]int, bs.nchan)
+	bs.signed = make([]bool, bs.nchan)
+	bs.rowColCodes = make([]RowColCode, bs.nchan)
+	for i := 0; i < bs.nchan; i++ {
+		bs.chanNumbers[i] = i
+		bs.chanNames[i] = fmt.Sprintf("bench%d", i)
+		bs.rowColCodes[i] = rcCode(0, i, 1, bs.nchan)
+	}
+	return nil
+}
+
+// Run processes Seconds of data at each of the configured rates, stopping after the
+// first rate that is not sustainable.
+func (bs *BenchmarkSource) Run() (*BenchmarkResult, error) {
+	config := &bs.config
+	if err := bs.Sample(); err != nil {
+		return nil, err
+	}
+	if err := bs.PrepareRun(config.NPresamples, config.NSamples); err != nil {
+		return nil, err
+	}
+	defer bs.finish()
+	trigger := TriggerState{EdgeTrigger: true, EdgeRising: true, EdgeLevel: 1000}
+	for _, dsp := range bs.processors {
+		dsp.ConfigureTrigger(trigger)
+		dsp.ConfigureTriggerStorm(&TriggerStormConfig{Seconds: defaultTriggerStormSeconds})
+		dsp.ConfigureDeadChannelDetection(&DeadChannelDetectConfig{Seconds: defaultDeadChannelSeconds})
+		if !config.Publish {
+			dsp.RemovePubRecords()
+			dsp.RemovePubSummaries()
+			dsp.RemovePubEnergies()
+			dsp.RemoveKafka()
+			dsp.RemoveMulticast()
+		}
+	}
+	if err := bs.startFiles(); err != nil {
+		return nil, err
+	}
+
+	result := &BenchmarkResult{Workers: bs.pool.Size()}
+	bs.runStart = time.Now()
+	for _, rate := range config.Rates {
+		step := bs.runStep(rate)
+		logInfof("Benchmark at %v records/s/channel: load %.3f, bottleneck %s", rate, step.Load, step.Bottleneck)
+		result.Steps = append(result.Steps, step)
+		result.Bottleneck = step.Bottleneck
+		if !step.Sustainable {
+			break
+		}
+		result.MaxSustainableRate = rate
+	}
+	return result, nil
+}
+
+// startFiles starts an LJH file for each channel, unless the config writes none.
+func (bs *BenchmarkSource) startFiles() error {
+	config := &bs.config
+	if config.Write == BenchmarkWriteNone {
+		return nil
+	}
+	if config.Write == BenchmarkWriteDisk {
+		dir, err := ioutil.TempDir(config.Path, "dastard_benchmark")
+		if err != nil {
+			return err
+		}
+		bs.tempDir = dir
+	}
+	for i, dsp := range bs.processors {
+		filename := filepath.Join(bs.tempDir, fmt.Sprintf("%s.ljh", dsp.Name))
+		dsp.DataPublisher.SetLJH22(i, dsp.NPresamples, dsp.NSamples, 1, 1/dsp.SampleRate,
+			time.Now(), 1, bs.nchan, bs.nchan, 0, i, filename, bs.name, bs.chanNames[i], bs.chanNumbers[i])
+		dsp.DataPublisher.LJH22.Create = bs.createFile
+	}
+	return nil
+}
+
+// finish closes the files and stops the source's goroutines.
+func (bs *BenchmarkSource) finish() {
+	for _, dsp := range bs.processors {
+		dsp.RemoveLJH22()
+	}
+	if bs.tempDir != "" {
+		if err := os.RemoveAll(bs.tempDir); err != nil {
+			logWarningf("Could not remove the benchmark files: %v", err)
+		}
+		bs.tempDir = ""
+	}
+	bs.pool.Stop()
+	bs.pool = nil
+	bs.broker.Stop()
+}
+
+// setRate makes one period of data with a pulse every 1/rate seconds.
+func (bs *BenchmarkSource) setRate(rate float64) {
+	const pedestal, amplitude, riseSamples = 1000.0, 20000.0, 2.0
+	period := roundint(bs.sampleRate / rate)
+	fallSamples := float64(bs.config.NSamples) / 8
+	bs.onecycle = make([]RawType, period)
+	for i := range bs.onecycle {
+		t := float64(i)
+		v := pedestal + amplitude*(math.Exp(-t/fallSamples)-math.Exp(-t/riseSamples))
+		bs.onecycle[i] = RawType(roundint(v))
+	}
+}
+
+// makeBlock returns the next benchmarkBlockSeconds of data. Each channel's pulses come
+// at a different phase of the period.
+func (bs *BenchmarkSource) makeBlock() *dataBlock {
+	nframes := roundint(benchmarkBlockSeconds * bs.sampleRate)
+	period := len(bs.onecycle)
+	block := &dataBlock{nSamp: nframes, segments: make([]DataSegment, bs.nchan)}
+	firstTime := bs.runStart.Add(time.Duration(bs.nextFrameNum) * bs.samplePeriod)
+	for channelIndex := range block.segments {
+		data := make([]RawType, nframes)
+		phase := int(bs.nextFrameNum%FrameIndex(period)) + channelIndex*period/bs.nchan
+		for i := range data {
+			data[i] = bs.onecycle[(i+phase)%period]
+		}
+		block.segments[channelIndex] = DataSegment{rawData: data, framesPerSample: 1,
+			framePeriod: bs.samplePeriod, firstFramenum: bs.nextFrameNum, firstTime: firstTime}
+	}
+	bs.nextFrameNum += FrameIndex(nframes)
+	return block
+}
+
+// runStep processes Seconds of data at the given rate, then flushes the files. The time
+// to make the data is not counted.
+func (bs *BenchmarkSource) runStep(rate float64) BenchmarkStep {
+	bs.setRate(rate)
+	step := BenchmarkStep{Rate: rate}
+	nblocks := int(math.Ceil(bs.config.Seconds / benchmarkBlockSeconds))
+	nrecords := make([]uint64, bs.nchan)
+	publishStart := make([]time.Duration, bs.nchan)
+	for i, dsp := range bs.processors {
+		nrecords[i] = dsp.summarySeq
+		publishStart[i] = dsp.publishTime
+	}
+	primary := make([]time.Duration, bs.nchan)
+	secondary := make([]time.Duration, bs.nchan)
+	var wall, writeInPublish time.Duration
+	var nframes int
+	writeStart := atomic.LoadInt64(&bs.writeNanos)
+
+	for b := 0; b < nblocks; b++ {
+		block := bs.makeBlock()
+		nframes += block.nSamp
+		records := make([][]*DataRecord, bs.nchan)
+		w0 := atomic.LoadInt64(&bs.writeNanos)
+		tStart := time.Now()
+		bs.pool.run(bs.nchan, func(i int) {
+			t := time.Now()
+			records[i] = bs.processors[i].processSegmentPrimary(&block.segments[i])
+			primary[i] += time.Since(t)
+		})
+		bs.pool.run(bs.nchan, func(i int) {
+			t := time.Now()
+			bs.processors[i].processSegmentSecondary(records[i])
+			secondary[i] += time.Since(t)
+		})
+		writeInPublish += time.Duration(atomic.LoadInt64(&bs.writeNanos) - w0)
+		bs.flushFiles(time.Now())
+		bs.readCounter++
+		wall += time.Since(tStart)
+	}
+	tStart := time.Now()
+	for _, dsp := range bs.processors {
+		dsp.Flush()
+	}
+	wall += time.Since(tStart)
+	step.DataSeconds = float64(nframes) / bs.sampleRate
+
+	var trigger, analyze, publish time.Duration
+	var made uint64
+	for i, dsp := range bs.processors {
+		trigger += primary[i]
+		p := dsp.publishTime - publishStart[i]
+		analyze += secondary[i] - p
+		publish += p
+		made += dsp.summarySeq - nrecords[i]
+	}
+	publish -= writeInPublish
+	write := time.Duration(atomic.LoadInt64(&bs.writeNanos) - writeStart)
+
+	step.ProcessSeconds = wall.Seconds()
+	step.Load = step.ProcessSeconds / step.DataSeconds
+	step.Sustainable = step.Load <= benchmarkMaxLoad
+	step.RecordsPerSecond = float64(made) / step.DataSeconds
+	step.TriggerSeconds = trigger.Seconds()
+	step.AnalyzeSeconds = analyze.Seconds()
+	step.PublishSeconds = publish.Seconds()
+	step.WriteSeconds = write.Seconds()
+	step.Bottleneck = BenchmarkStageTrigger
+	longest := step.TriggerSeconds
+	for _, stage := range []struct {
+		name    string
+		seconds float64
+	}{{BenchmarkStageAnalyze, step.AnalyzeSeconds}, {BenchmarkStagePublish, step.PublishSeconds},
+		{BenchmarkStageWrite, step.WriteSeconds}} {
+		if stage.seconds > longest {
+			step.Bottleneck, longest = stage.name, stage.seconds
+		}
+	}
+	return step
+}
+
+// createFile creates a benchmark file that counts the time spent writing it.
+func (bs *BenchmarkSource) createFile(name string) (ljh.File, error) {
+	if bs.config.Write == BenchmarkWriteNull {
+		return &benchmarkFile{File: discardFile{}, nanos: &bs.writeNanos}, nil
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &benchmarkFile{File: f, nanos: &bs.writeNanos}, nil
+}
+
+// benchmarkFile adds the time spent in Write and Sync to *nanos.
+type benchmarkFile struct {
+	ljh.File
+	nanos *int64
+}
+
+func (f *benchmarkFile) Write(p []byte) (int, error) {
+	t := time.Now()
+	n, err := f.File.Write(p)
+	atomic.AddInt64(f.nanos, int64(time.Since(t)))
+	return n, err
+}
+
+func (f *benchmarkFile) Sync() error {
+	t := time.Now()
+	err := f.File.Sync()
+	atomic.AddInt64(f.nanos, int64(time.Since(t)))
+	return err
+}
+
+// discardFile is an ljh.File that throws away everything written to it.
+type discardFile struct{}
+
+func (discardFile) Write(p []byte) (int, error) { return len(p), nil }
+func (discardFile) Sync() error                 { return nil }
+func (discardFile) Close() error                { return nil }
@@ -0,0 +1,121 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkConfig(t *testing.T) {
+	var config BenchmarkConfig
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Nchan != 64 || config.NPresamples != config.NSamples/4 || config.Write != BenchmarkWriteNone {
+		t.Errorf("default config is %+v", config)
+	}
+	maxRate := config.SampleRate / float64(config.NSamples)
+	if n := len(config.Rates); n == 0 || config.Rates[0] != 1 || config.Rates[n-1] > maxRate {
+		t.Errorf("default rates %v, want from 1 to at most %v", config.Rates, maxRate)
+	}
+	for _, bad := range []BenchmarkConfig{{Nchan: -1}, {SampleRate: math.NaN()}, {NSamples: 100, NPresamples: 100},
+		{Seconds: -1}, {Seconds: 100}, {Rates: []float64{10, 5}}, {Rates: []float64{0}},
+		{SampleRate: 10000, NSamples: 100, Rates: []float64{101}}, {Write: "TAPE"}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("BenchmarkConfig%+v.validate() should fail", bad)
+		}
+	}
+}
+
+func TestRunBenchmark(t *testing.T) {
+	for _, write := range []string{BenchmarkWriteNone, BenchmarkWriteNull, BenchmarkWriteDisk} {
+		dir, err := ioutil.TempDir("", "dastard_benchmark_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		config := BenchmarkConfig{Nchan: 3, SampleRate: 10000, NSamples: 100, NPresamples: 20,
+			Rates: []float64{10, 50}, Seconds: 0.5, Write: write, Path: dir}
+		bs := NewBenchmarkSource()
+		if err := bs.Configure(&config); err != nil {
+			t.Fatal(err)
+		}
+		result, err := bs.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Steps) < 1 || len(result.Steps) > 2 || result.Workers < 1 {
+			t.Fatalf("write %s: benchmark result is %+v", write, result)
+		}
+		for _, step := range result.Steps {
+			want := step.Rate * float64(config.Nchan)
+			if step.RecordsPerSecond < 0.6*want || step.RecordsPerSecond > 1.1*want {
+				t.Errorf("write %s: step at rate %v made %v records per second, want about %v", write,
+					step.Rate, step.RecordsPerSecond, want)
+			}
+			if math.Abs(step.DataSeconds-config.Seconds) > 1e-9 || step.Load <= 0 || step.TriggerSeconds <= 0 {
+				t.Errorf("write %s: step is %+v", write, step)
+			}
+			switch step.Bottleneck {
+			case BenchmarkStageTrigger, BenchmarkStageAnalyze, BenchmarkStagePublish, BenchmarkStageWrite:
+			default:
+				t.Errorf("write %s: step has bottleneck %q", write, step.Bottleneck)
+			}
+			if (write == BenchmarkWriteNone) != (step.WriteSeconds == 0) {
+				t.Errorf("write %s: step has WriteSeconds %v", write, step.WriteSeconds)
+			}
+		}
+		if last := result.Steps[len(result.Steps)-1]; result.Bottleneck != last.Bottleneck ||
+			(last.Sustainable && result.MaxSustainableRate != last.Rate) {
+			t.Errorf("write %s: result is %+v", write, result)
+		}
+		// The temporary files are gone.
+		if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+			t.Errorf("write %s: benchmark left files %v, %v", write, files, err)
+		}
+	}
+}
+
+func TestRunBenchmarkRPC(t *testing.T) {
+	updates := make(chan ClientUpdate, 10)
+	sc := &SourceControl{clientUpdates: updates}
+	config := BenchmarkConfig{Nchan: 2, SampleRate: 10000, NSamples: 100, NPresamples: 20,
+		Rates: []float64{10}, Seconds: 0.5}
+	var started bool
+	if err := sc.RunBenchmark(&BenchmarkConfig{Nchan: -1}, &started); err == nil || started {
+		t.Error("RunBenchmark accepted an invalid config")
+	}
+	if err := sc.RunBenchmark(&config, &started); err != nil || !started {
+		t.Fatalf("RunBenchmark returned %v, started=%v", err, started)
+	}
+	// The RPC returns at once; until the benchmark ends, another benchmark or a source
+	// cannot start.
+	again := config
+	if err := sc.RunBenchmark(&again, &started); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("a second RunBenchmark returned %v, want refusal", err)
+	}
+	name := "SIMPULSESOURCE"
+	var ok bool
+	if err := sc.Start(&name, &ok); err == nil || ok {
+		t.Error("Start succeeded while a benchmark is running")
+	}
+
+	select {
+	case update := <-updates:
+		result, isResult := update.state.(*BenchmarkResult)
+		if update.tag != "BENCHMARK" || !isResult || len(result.Steps) != 1 || result.Error != "" {
+			t.Errorf("after RunBenchmark, client update %s %+v, want the BENCHMARK result", update.tag, update.state)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("RunBenchmark sent no BENCHMARK message")
+	}
+	sc.startLock.Lock()
+	benchmarking := sc.benchmarking
+	sc.startLock.Unlock()
+	if benchmarking {
+		t.Error("the benchmark is still marked as running after its BENCHMARK message")
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 	"testing"
 	"time"
+
+	"github.com/usnistgov/dastard/off"
 )
 
 // TestPublishRecord checks packet(DataRecord) makes a reasonable header and message.
 func TestPublishRecord(t *testing.T) {
 	data := []RawType{1, 2, 3, 4, 5, 4, 3, 2, 1}
-	rec := &DataRecord{data: data, trigTime: time.Now()}
+	rec := &DataRecord{data: data, trigTime: time.Now(), recordSeq: 1<<40 + 7}
 
 	fullMessage := messageRecords(rec)
 	header := fullMessage[0]
@@ -30,8 +33,96 @@ func TestPublishRecord(t *testing.T) {
 		t.Errorf("binary.Read should have failed, but did not")
 	}
 
+	if len(header) != 44 || header[2] != 1 {
+		t.Fatalf("record header has length %d and version %d, want 44 and 1", len(header), header[2])
+	}
+	if seq := binary.LittleEndian.Uint64(header[36:]); seq != rec.recordSeq {
+		t.Errorf("record header sequence number %d, want %d", seq, rec.recordSeq)
+	}
 	if len(message)/2 != len(data) {
 		t.Errorf("packet generated message of %d samples, want %d", len(message)/2, len(data))
 	}
 
 }
+
+// TestPublishSummaryAndEnergy checks the headers of summary and energy messages.
+func TestPublishSummaryAndEnergy(t *testing.T) {
+	rec := &DataRecord{channelIndex: 3, trigFrame: 12345, trigTime: time.Unix(0, 987654321),
+		modelCoefs: []float64{1, 2}, filtValue: 2.5, energy: 5898.75, pileup: true, summarySeq: 99}
+
+	summary := messageSummaries(rec)
+	if len(summary) != 2 || len(summary[0]) != 70 {
+		t.Fatalf("summary has %d frames, header of length %d, want 2 and 70", len(summary), len(summary[0]))
+	}
+	if v := summary[0][2]; v != 5 {
+		t.Errorf("summary header version %d, want 5", v)
+	}
+	if d := binary.LittleEndian.Uint16(summary[0][67:]); d != 0 {
+		t.Errorf("summary thumbnail decimation %d, want 0", d)
+	}
+	if seq := binary.LittleEndian.Uint64(summary[0][59:]); seq != 99 {
+		t.Errorf("summary sequence number %d, want 99", seq)
+	}
+	if flags := binary.LittleEndian.Uint32(summary[0][51:]); flags != off.FlagPileup {
+		t.Errorf("summary flags %x, want %x", flags, off.FlagPileup)
+	}
+	energy := math.Float32frombits(binary.LittleEndian.Uint32(summary[0][47:]))
+	if energy != float32(rec.energy) {
+		t.Errorf("summary energy %v, want %v", energy, rec.energy)
+	}
+	if filtValue := math.Float32frombits(binary.LittleEndian.Uint32(summary[0][55:])); filtValue != 2.5 {
+		t.Errorf("summary filtered pulse height %v, want 2.5", filtValue)
+	}
+
+	rec.data = []RawType{10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	rec.thumbDecimation = 4
+	rec.signed = true
+	summary = messageSummaries(rec)
+	if len(summary) != 3 {
+		t.Fatalf("summary with thumbnail has %d frames, want 3", len(summary))
+	}
+	if d, code := binary.LittleEndian.Uint16(summary[0][67:]), summary[0][69]; d != 4 || code != 2 {
+		t.Errorf("summary thumbnail decimation %d and data type %d, want 4 and 2", d, code)
+	}
+	thumbnail := bytesToRawType(summary[2])
+	if len(thumbnail) != 3 || thumbnail[0] != 10 || thumbnail[1] != 14 || thumbnail[2] != 18 {
+		t.Errorf("summary thumbnail %v, want [10 14 18]", thumbnail)
+	}
+
+	msg := messageEnergies(rec)
+	if len(msg) != 1 || len(msg[0]) != 23 {
+		t.Fatalf("energy message has %d frames, first of length %d, want 1 frame of length 23", len(msg), len(msg[0]))
+	}
+	var header struct {
+		Channel   uint16
+		Version   uint8
+		Energy    float32
+		TrigTime  int64
+		TrigFrame int64
+	}
+	if err := binary.Read(bytes.NewReader(msg[0]), binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Channel != 3 || header.Version != 0 || header.Energy != float32(rec.energy) ||
+		header.TrigTime != 987654321 || header.TrigFrame != 12345 {
+		t.Errorf("energy message header is %+v", header)
+	}
+}
+
+// TestPublishSummaryConditions checks that only records made by trigger conditions have
+// the version 6 summary header, with the mask of the conditions.
+func TestPublishSummaryConditions(t *testing.T) {
+	rec := &DataRecord{channelIndex: 3, modelCoefs: []float64{1, 2}, trigType: TriggerTypeCondition,
+		conditions: 5}
+	summary := messageSummaries(rec)
+	if len(summary[0]) != 74 || summary[0][2] != 6 {
+		t.Fatalf("summary header has length %d and version %d, want 74 and 6", len(summary[0]), summary[0][2])
+	}
+	if mask := binary.LittleEndian.Uint32(summary[0][70:]); mask != 5 {
+		t.Errorf("summary trigger condition mask %d, want 5", mask)
+	}
+	rec.trigType = TriggerTypeAuto
+	if summary := messageSummaries(rec); len(summary[0]) != 70 || summary[0][2] != 5 {
+		t.Errorf("summary header has length %d and version %d, want 70 and 5", len(summary[0]), summary[0][2])
+	}
+}
@@ -0,0 +1,129 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// ChannelCalibration converts the raw units of one channel to physical units:
+// volts = VoltsOffset + VoltsPerArb*raw. Calibrations are stored by channel name,
+// so they apply to any source whose channels have that name.
+type ChannelCalibration struct {
+	ChannelName string
+	VoltsPerArb float32
+	VoltsOffset float32
+}
+
+// validate checks the calibration for errors.
+func (cal *ChannelCalibration) validate() error {
+	if len(cal.ChannelName) == 0 {
+		return fmt.Errorf("ChannelCalibration needs a ChannelName")
+	}
+	vpa := float64(cal.VoltsPerArb)
+	if vpa == 0 || math.IsNaN(vpa) || math.IsInf(vpa, 0) {
+		return fmt.Errorf("channel %s has VoltsPerArb=%v, need finite and non-zero", cal.ChannelName, cal.VoltsPerArb)
+	}
+	offset := float64(cal.VoltsOffset)
+	if math.IsNaN(offset) || math.IsInf(offset, 0) {
+		return fmt.Errorf("channel %s has VoltsOffset=%v, need finite", cal.ChannelName, cal.VoltsOffset)
+	}
+	return nil
+}
+
+// calibrationRegistry holds the calibrations set by RPC SetCalibration or read from the
+// config file. Sources apply them in PrepareRun, overriding their default VoltsPerArb.
+type calibrationRegistry struct {
+	cals map[string]ChannelCalibration
+	sync.Mutex
+}
+
+// channelCalibrations is the one registry shared by the SourceControl and all sources.
+var channelCalibrations = newCalibrationRegistry()
+
+func newCalibrationRegistry() *calibrationRegistry {
+	return &calibrationRegistry{cals: make(map[string]ChannelCalibration)}
+}
+
+// set adds or replaces the calibration of one channel.
+func (r *calibrationRegistry) set(cal ChannelCalibration) error {
+	if err := cal.validate(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.cals[cal.ChannelName] = cal
+	return nil
+}
+
+// get returns the calibration of the named channel, if any.
+func (r *calibrationRegistry) get(name string) (ChannelCalibration, bool) {
+	r.Lock()
+	defer r.Unlock()
+	cal, ok := r.cals[name]
+	return cal, ok
+}
+
+// list returns all the calibrations, sorted by channel name.
+func (r *calibrationRegistry) list() []ChannelCalibration {
+	r.Lock()
+	defer r.Unlock()
+	result := make([]ChannelCalibration, 0, len(r.cals))
+	for _, cal := range r.cals {
+		result = append(result, cal)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ChannelName < result[j].ChannelName })
+	return result
+}
+
+// VoltsOffset returns a per-channel value, the physical value of raw 0.
+func (ds *AnySource) VoltsOffset() []float32 {
+	// Objects containing an AnySource can set this, but the default is zero.
+	if len(ds.voltsOffset) != ds.nchan {
+		ds.voltsOffset = make([]float32, ds.nchan)
+	}
+	return ds.voltsOffset
+}
+
+// applyStoredCalibrations overrides the VoltsPerArb and VoltsOffset of each channel
+// that has a calibration in the registry.
+func (ds *AnySource) applyStoredCalibrations() {
+	vpa := ds.VoltsPerArb()
+	offset := ds.VoltsOffset()
+	for i, name := range ds.chanNames {
+		if cal, ok := channelCalibrations.get(name); ok {
+			vpa[i] = cal.VoltsPerArb
+			offset[i] = cal.VoltsOffset
+		}
+	}
+}
+
+// SetCalibration sets the VoltsPerArb and VoltsOffset of the given channels. They are
+// used in records published from now on, and in the headers of files started later.
+func (ds *AnySource) SetCalibration(channelIndices []int, voltsPerArb, voltsOffset []float32) error {
+	if len(voltsPerArb) != len(channelIndices) || len(voltsOffset) != len(channelIndices) {
+		return fmt.Errorf("SetCalibration got %d channels, %d VoltsPerArb, and %d VoltsOffset, need equal numbers",
+			len(channelIndices), len(voltsPerArb), len(voltsOffset))
+	}
+	for i, channelIndex := range channelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+		cal := ChannelCalibration{ChannelName: ds.chanNames[channelIndex],
+			VoltsPerArb: voltsPerArb[i], VoltsOffset: voltsOffset[i]}
+		if err := cal.validate(); err != nil {
+			return err
+		}
+	}
+	vpa := ds.VoltsPerArb()
+	offset := ds.VoltsOffset()
+	for i, channelIndex := range channelIndices {
+		vpa[channelIndex] = voltsPerArb[i]
+		offset[channelIndex] = voltsOffset[i]
+		if channelIndex < len(ds.processors) {
+			ds.processors[channelIndex].stream.voltsPerArb = voltsPerArb[i]
+		}
+	}
+	return nil
+}
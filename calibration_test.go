@@ -0,0 +1,70 @@
+package dastard
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCalibration(t *testing.T) {
+	saved := channelCalibrations
+	defer func() { channelCalibrations = saved }()
+	channelCalibrations = newCalibrationRegistry()
+
+	for _, bad := range []ChannelCalibration{
+		{ChannelName: "", VoltsPerArb: 1},
+		{ChannelName: "chan1", VoltsPerArb: 0},
+		{ChannelName: "chan1", VoltsPerArb: float32(math.NaN())},
+		{ChannelName: "chan1", VoltsPerArb: 1, VoltsOffset: float32(math.Inf(1))},
+	} {
+		if err := channelCalibrations.set(bad); err == nil {
+			t.Errorf("calibration %+v should fail validation", bad)
+		}
+	}
+	if err := channelCalibrations.set(ChannelCalibration{ChannelName: "chan2", VoltsPerArb: 0.5, VoltsOffset: -1}); err != nil {
+		t.Error(err)
+	}
+	if err := channelCalibrations.set(ChannelCalibration{ChannelName: "chan0", VoltsPerArb: 2}); err != nil {
+		t.Error(err)
+	}
+	if cals := channelCalibrations.list(); len(cals) != 2 || cals[0].ChannelName != "chan0" || cals[1].ChannelName != "chan2" {
+		t.Errorf("calibration list is %v, want chan0 and chan2", cals)
+	}
+
+	// PrepareRun applies the stored calibrations by channel name.
+	ds := AnySource{nchan: 3}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(100, 200)
+	defer ds.broker.Stop()
+	expectVPA := []float32{2, 1. / 65535.0, 0.5}
+	expectOffset := []float32{0, 0, -1}
+	for i, dsp := range ds.processors {
+		if ds.voltsPerArb[i] != expectVPA[i] || dsp.stream.voltsPerArb != expectVPA[i] || ds.voltsOffset[i] != expectOffset[i] {
+			t.Errorf("channel %d has VoltsPerArb %v (stream %v) and VoltsOffset %v, want %v and %v", i,
+				ds.voltsPerArb[i], dsp.stream.voltsPerArb, ds.voltsOffset[i], expectVPA[i], expectOffset[i])
+		}
+	}
+
+	if err := ds.SetCalibration([]int{1}, []float32{0.25}, []float32{3}); err != nil {
+		t.Error(err)
+	}
+	if ds.voltsPerArb[1] != 0.25 || ds.processors[1].stream.voltsPerArb != 0.25 || ds.voltsOffset[1] != 3 {
+		t.Errorf("SetCalibration did not change channel 1")
+	}
+	ds.processors[1].manualTriggerPending = true
+	ds.processors[1].stream.AppendSegment(NewDataSegment(make([]RawType, 500), 1, 0, ds.lastread, ds.samplePeriod))
+	if records := ds.processors[1].manualTriggerComputeAppend(nil); len(records) != 1 || records[0].voltsPerArb != 0.25 {
+		t.Errorf("manual trigger record does not carry VoltsPerArb=0.25")
+	}
+	for _, bad := range []struct {
+		indices     []int
+		vpa, offset []float32
+	}{
+		{[]int{3}, []float32{1}, []float32{0}},
+		{[]int{0}, []float32{1, 2}, []float32{0}},
+		{[]int{0}, []float32{0}, []float32{0}},
+	} {
+		if err := ds.SetCalibration(bad.indices, bad.vpa, bad.offset); err == nil {
+			t.Errorf("SetCalibration(%v, %v, %v) should fail", bad.indices, bad.vpa, bad.offset)
+		}
+	}
+}
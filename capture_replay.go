@@ -0,0 +1,398 @@
+package dastard
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A capture file stores the raw data blocks of any source, exactly as the source
+// produced them (before resynchronization, the clock model, or any processing), so a
+// CaptureReplaySource can later feed identical data through the processing chain.
+// The file starts with a 1-line JSON header, followed by binary blocks. See
+// BINARY_FORMATS.md for the layout.
+
+const captureFileFormat = "DASTARD capture"
+const captureFileVersion = "1.0.0"
+const captureBlockMagic = uint32(0x50414344) // "DCAP" in little-endian byte order
+
+// captureHeader is the JSON header of a capture file: the facts that a source
+// determines in Sample(), which a replay source must reproduce.
+type captureHeader struct {
+	FileFormat        string
+	FileFormatVersion string
+	DastardVersion    string
+	GitHash           string
+	SourceName        string
+	CreationTime      time.Time
+	Nchan             int
+	SampleRate        float64
+	SamplePeriod      time.Duration
+	ChanNames         []string
+	ChanNumbers       []int
+	RowColCodes       []RowColCode
+	Signed            []bool
+	VoltsPerArb       []float32
+	FrameCounterBits  uint `json:",omitempty"` // width of the source's frame counter, if it rolls over
+}
+
+// captureBlockHeader is the fixed-size part of each block in a capture file.
+type captureBlockHeader struct {
+	Magic            uint32
+	Nchan            uint32
+	HardwareTime     int64
+	HasHardwareTime  uint8
+	NExternalTrigger uint32
+}
+
+// captureSegmentHeader precedes the raw data of each segment in a capture file.
+type captureSegmentHeader struct {
+	FirstFramenum   int64
+	FirstTime       int64 // nanoseconds since 1 Jan 1970
+	FramePeriod     int64 // nanoseconds
+	FramesPerSample uint32
+	Nsamples        uint32
+}
+
+// captureWriter writes data blocks to a capture file.
+type captureWriter struct {
+	Filename string
+	file     *os.File
+	writer   *bufio.Writer
+	nblocks  int
+}
+
+// newCaptureWriter creates the file and writes its header.
+func newCaptureWriter(filename string, header *captureHeader) (*captureWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	cw := &captureWriter{Filename: filename, file: file, writer: bufio.NewWriter(file)}
+	header.FileFormat = captureFileFormat
+	header.FileFormatVersion = captureFileVersion
+	hdr, err := json.Marshal(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := cw.writer.Write(append(hdr, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+// writeBlock appends one data block to the file.
+func (cw *captureWriter) writeBlock(block *dataBlock) error {
+	bh := captureBlockHeader{
+		Magic:            captureBlockMagic,
+		Nchan:            uint32(len(block.segments)),
+		HardwareTime:     int64(block.hardwareTime),
+		NExternalTrigger: uint32(len(block.externalTriggerRowcounts)),
+	}
+	if block.hasHardwareTime {
+		bh.HasHardwareTime = 1
+	}
+	if err := binary.Write(cw.writer, binary.LittleEndian, &bh); err != nil {
+		return err
+	}
+	if err := binary.Write(cw.writer, binary.LittleEndian, block.externalTriggerRowcounts); err != nil {
+		return err
+	}
+	for i := range block.segments {
+		seg := &block.segments[i]
+		sh := captureSegmentHeader{
+			FirstFramenum:   int64(seg.firstFramenum),
+			FirstTime:       seg.firstTime.UnixNano(),
+			FramePeriod:     int64(seg.framePeriod),
+			FramesPerSample: uint32(seg.framesPerSample),
+			Nsamples:        uint32(len(seg.rawData)),
+		}
+		if err := binary.Write(cw.writer, binary.LittleEndian, &sh); err != nil {
+			return err
+		}
+		if err := binary.Write(cw.writer, binary.LittleEndian, seg.rawData); err != nil {
+			return err
+		}
+	}
+	cw.nblocks++
+	return nil
+}
+
+// close flushes and closes the file.
+func (cw *captureWriter) close() error {
+	if err := cw.writer.Flush(); err != nil {
+		cw.file.Close()
+		return err
+	}
+	return cw.file.Close()
+}
+
+// captureReader reads data blocks from a capture file.
+type captureReader struct {
+	header captureHeader
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// openCaptureReader opens a capture file and reads its header.
+func openCaptureReader(filename string) (*captureReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	cr := &captureReader{file: file, reader: bufio.NewReader(file)}
+	line, err := cr.reader.ReadBytes('\n')
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not read capture file header: %v", err)
+	}
+	if err := json.Unmarshal(line, &cr.header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not parse capture file header: %v", err)
+	}
+	if cr.header.FileFormat != captureFileFormat {
+		file.Close()
+		return nil, fmt.Errorf("file %s has format %q, want %q", filename, cr.header.FileFormat, captureFileFormat)
+	}
+	if cr.header.Nchan < 1 || len(cr.header.ChanNames) != cr.header.Nchan ||
+		len(cr.header.ChanNumbers) != cr.header.Nchan || len(cr.header.RowColCodes) != cr.header.Nchan {
+		file.Close()
+		return nil, fmt.Errorf("capture file %s header has inconsistent channel lists for Nchan=%d", filename, cr.header.Nchan)
+	}
+	return cr, nil
+}
+
+// readBlock returns the next data block, or io.EOF at the end of the file.
+func (cr *captureReader) readBlock() (*dataBlock, error) {
+	var bh captureBlockHeader
+	if err := binary.Read(cr.reader, binary.LittleEndian, &bh); err != nil {
+		return nil, err // io.EOF here means a clean end of file
+	}
+	if bh.Magic != captureBlockMagic {
+		return nil, fmt.Errorf("capture block has magic number 0x%x, want 0x%x", bh.Magic, captureBlockMagic)
+	}
+	if int(bh.Nchan) != cr.header.Nchan {
+		return nil, fmt.Errorf("capture block has %d channels, want %d", bh.Nchan, cr.header.Nchan)
+	}
+	block := &dataBlock{
+		segments:        make([]DataSegment, bh.Nchan),
+		hardwareTime:    time.Duration(bh.HardwareTime),
+		hasHardwareTime: bh.HasHardwareTime != 0,
+	}
+	if bh.NExternalTrigger > 0 {
+		block.externalTriggerRowcounts = make([]int64, bh.NExternalTrigger)
+		if err := binary.Read(cr.reader, binary.LittleEndian, block.externalTriggerRowcounts); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	for i := range block.segments {
+		var sh captureSegmentHeader
+		if err := binary.Read(cr.reader, binary.LittleEndian, &sh); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		data := make([]RawType, sh.Nsamples)
+		if err := binary.Read(cr.reader, binary.LittleEndian, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		block.segments[i] = DataSegment{
+			rawData:         data,
+			framesPerSample: int(sh.FramesPerSample),
+			firstFramenum:   FrameIndex(sh.FirstFramenum),
+			firstTime:       time.Unix(0, sh.FirstTime),
+			framePeriod:     time.Duration(sh.FramePeriod),
+		}
+	}
+	if len(block.segments) > 0 {
+		block.nSamp = len(block.segments[0].rawData)
+	}
+	return block, nil
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF, for reads in the middle of a block.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (cr *captureReader) close() error {
+	return cr.file.Close()
+}
+
+// captureHeader returns the header describing this source, for a new capture file.
+func (ds *AnySource) captureHeader() *captureHeader {
+	return &captureHeader{
+		DastardVersion:   Build.Version,
+		GitHash:          Build.Githash,
+		SourceName:       ds.name,
+		CreationTime:     time.Now(),
+		Nchan:            ds.nchan,
+		SampleRate:       ds.sampleRate,
+		SamplePeriod:     ds.samplePeriod,
+		ChanNames:        ds.chanNames,
+		ChanNumbers:      ds.chanNumbers,
+		RowColCodes:      ds.rowColCodes,
+		Signed:           ds.Signed(),
+		VoltsPerArb:      ds.VoltsPerArb(),
+		FrameCounterBits: ds.frameSync.counterBits,
+	}
+}
+
+// writeCapture saves block to the capture file, if one is open. A failure to write
+// closes the capture file but doesn't stop the source.
+func (ds *AnySource) writeCapture(block *dataBlock) {
+	if ds.capture == nil {
+		return
+	}
+	if err := ds.capture.writeBlock(block); err != nil {
+		logErrorf("Could not write capture file %s; closing it: %v", ds.capture.Filename, err)
+		ds.closeCapture()
+	}
+}
+
+// closeCapture closes the capture file, if one is open.
+func (ds *AnySource) closeCapture() {
+	if ds.capture == nil {
+		return
+	}
+	if err := ds.capture.close(); err != nil {
+		logErrorf("Could not close capture file %s: %v", ds.capture.Filename, err)
+	} else {
+		logInfof("Closed capture file %s with %d blocks", ds.capture.Filename, ds.capture.nblocks)
+	}
+	ds.capture = nil
+	ds.writingState.CaptureFilename = ""
+}
+
+// CaptureReplaySource is a DataSource that replays a capture file, block by block,
+// with the original data and timing metadata. Processing a replay is thus
+// deterministic, which makes captures useful for integration tests.
+type CaptureReplaySource struct {
+	filename string
+	realtime bool
+	reader   *captureReader
+	AnySource
+}
+
+// NewCaptureReplaySource creates a new CaptureReplaySource.
+func NewCaptureReplaySource() *CaptureReplaySource {
+	rs := new(CaptureReplaySource)
+	rs.name = "CaptureReplay"
+	return rs
+}
+
+// CaptureReplaySourceConfig holds the arguments needed to call CaptureReplaySource.Configure by RPC
+type CaptureReplaySourceConfig struct {
+	Filename string
+	Realtime bool // replay at the original data rate (otherwise as fast as possible)
+}
+
+// Configure checks that the capture file can be read, and learns the number of channels.
+func (rs *CaptureReplaySource) Configure(config *CaptureReplaySourceConfig) error {
+	rs.sourceStateLock.Lock()
+	defer rs.sourceStateLock.Unlock()
+	if rs.sourceState != Inactive {
+		return fmt.Errorf("cannot Configure a CaptureReplaySource if it's not Inactive")
+	}
+	cr, err := openCaptureReader(config.Filename)
+	if err != nil {
+		return err
+	}
+	cr.close()
+	rs.filename = config.Filename
+	rs.realtime = config.Realtime
+	rs.nchan = cr.header.Nchan
+	rs.sampleRate = cr.header.SampleRate
+	rs.samplePeriod = cr.header.SamplePeriod
+	rs.sourceConfig = *config
+	return nil
+}
+
+// Sample opens the capture file and copies the channel facts from its header.
+func (rs *CaptureReplaySource) Sample() error {
+	if len(rs.filename) == 0 {
+		return fmt.Errorf("CaptureReplaySource has no capture file configured")
+	}
+	cr, err := openCaptureReader(rs.filename)
+	if err != nil {
+		return err
+	}
+	rs.reader = cr
+	h := &cr.header
+	rs.nchan = h.Nchan
+	rs.sampleRate = h.SampleRate
+	rs.samplePeriod = h.SamplePeriod
+	rs.chanNames = h.ChanNames
+	rs.chanNumbers = h.ChanNumbers
+	rs.rowColCodes = h.RowColCodes
+	rs.signed = nil
+	if len(h.Signed) == h.Nchan {
+		rs.signed = h.Signed
+	}
+	rs.voltsPerArb = nil
+	if len(h.VoltsPerArb) == h.Nchan {
+		rs.voltsPerArb = h.VoltsPerArb
+	}
+	rs.frameSync.counterBits = h.FrameCounterBits
+	return nil
+}
+
+// StartRun launches the loop that reads blocks from the capture file. At the end of
+// the file, the source stops itself.
+func (rs *CaptureReplaySource) StartRun() error {
+	reader := rs.reader
+	rs.reader = nil
+	if reader == nil {
+		return fmt.Errorf("CaptureReplaySource.StartRun called before Sample")
+	}
+	go func() {
+		defer reader.close()
+		rs.pinReader()
+		var firstTime, startTime time.Time
+		for {
+			block, err := reader.readBlock()
+			if err == io.EOF {
+				logInfof("Reached the end of capture file %s", rs.filename)
+				close(rs.nextBlock)
+				return
+			} else if err != nil {
+				block = &dataBlock{err: fmt.Errorf("reading capture file %s: %v", rs.filename, err)}
+			}
+
+			// In realtime mode, wait until the block's time relative to the first block.
+			var waittime time.Duration
+			if rs.realtime && err == nil && len(block.segments) > 0 {
+				t := block.segments[0].firstTime
+				if startTime.IsZero() {
+					firstTime, startTime = t, time.Now()
+				}
+				waittime = time.Until(startTime.Add(t.Sub(firstTime)))
+			}
+			select {
+			case <-rs.abortSelf:
+				close(rs.nextBlock)
+				return
+			case <-time.After(waittime):
+			}
+			if rs.heartbeats != nil && err == nil {
+				now := time.Now()
+				mb := float64(block.nSamp*2*len(block.segments)) / 1e6
+				rs.heartbeats <- Heartbeat{Running: true, Time: now.Sub(rs.lastread).Seconds(), DataMB: mb,
+					Frames: block.nSamp}
+				rs.lastread = now
+			}
+			rs.nextBlock <- block
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,226 @@
+package dastard
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	const nchan, nsamp, nblocks = 3, 50, 4
+	ds := new(AnySource)
+	ds.name = "Test"
+	ds.nchan = nchan
+	ds.sampleRate = 100000
+	ds.samplePeriod = 10 * time.Microsecond
+	ds.setDefaultChannelNames()
+	ds.rowColCodes = make([]RowColCode, nchan)
+	for i := range ds.rowColCodes {
+		ds.rowColCodes[i] = rcCode(i, 0, nchan, 1)
+	}
+
+	// Make blocks with distinct data and timing in every segment.
+	t0 := time.Unix(0, 1500000000123456789)
+	blocks := make([]*dataBlock, nblocks)
+	for b := range blocks {
+		block := &dataBlock{segments: make([]DataSegment, nchan), nSamp: nsamp}
+		if b == 2 {
+			block.externalTriggerRowcounts = []int64{12345, 67890}
+			block.hardwareTime = 987654321 * time.Nanosecond
+			block.hasHardwareTime = true
+		}
+		for i := range block.segments {
+			data := make([]RawType, nsamp)
+			for j := range data {
+				data[j] = RawType(1000*b + 100*i + j)
+			}
+			frame := FrameIndex(b * nsamp)
+			block.segments[i] = *NewDataSegment(data, 1, frame, t0.Add(time.Duration(frame)*ds.samplePeriod), ds.samplePeriod)
+		}
+		blocks[b] = block
+	}
+
+	tmp, err := ioutil.TempDir("", "dastard_capture_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	filename := filepath.Join(tmp, "test_capture.dcap")
+	cw, err := newCaptureWriter(filename, ds.captureHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		if err := cw.writeBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	compare := func(name string, b int, block *dataBlock) {
+		want := blocks[b]
+		if block.hasHardwareTime != want.hasHardwareTime || block.hardwareTime != want.hardwareTime ||
+			block.nSamp != want.nSamp || len(block.externalTriggerRowcounts) != len(want.externalTriggerRowcounts) {
+			t.Errorf("%s block %d is %+v, want %+v", name, b, block, want)
+			return
+		}
+		for i, v := range want.externalTriggerRowcounts {
+			if block.externalTriggerRowcounts[i] != v {
+				t.Errorf("%s block %d externalTriggerRowcounts[%d]=%d, want %d", name, b, i, block.externalTriggerRowcounts[i], v)
+			}
+		}
+		for i := range want.segments {
+			seg, wseg := &block.segments[i], &want.segments[i]
+			if seg.firstFramenum != wseg.firstFramenum || !seg.firstTime.Equal(wseg.firstTime) ||
+				seg.framePeriod != wseg.framePeriod || seg.framesPerSample != wseg.framesPerSample ||
+				len(seg.rawData) != len(wseg.rawData) {
+				t.Errorf("%s block %d segment %d has wrong metadata", name, b, i)
+				continue
+			}
+			for j, v := range wseg.rawData {
+				if seg.rawData[j] != v {
+					t.Errorf("%s block %d segment %d rawData[%d]=%d, want %d", name, b, i, j, seg.rawData[j], v)
+					break
+				}
+			}
+		}
+	}
+
+	cr, err := openCaptureReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.header.Nchan != nchan || cr.header.SourceName != "Test" || cr.header.ChanNames[2] != "chan2" ||
+		cr.header.RowColCodes[1] != ds.rowColCodes[1] || cr.header.SamplePeriod != ds.samplePeriod {
+		t.Errorf("capture header is %+v", cr.header)
+	}
+	for b := 0; b < nblocks; b++ {
+		block, err := cr.readBlock()
+		if err != nil {
+			t.Fatalf("readBlock %d failed: %v", b, err)
+		}
+		compare("read", b, block)
+	}
+	if _, err := cr.readBlock(); err != io.EOF {
+		t.Errorf("readBlock at end of file returned err=%v, want io.EOF", err)
+	}
+	cr.close()
+
+	// Replay the capture through a source, as fast as possible.
+	rs := NewCaptureReplaySource()
+	if err := rs.Configure(&CaptureReplaySourceConfig{Filename: filename}); err != nil {
+		t.Fatal(err)
+	}
+	if rs.nchan != nchan {
+		t.Errorf("CaptureReplaySource.nchan=%d, want %d", rs.nchan, nchan)
+	}
+	if err := rs.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.PrepareRun(10, 20); err != nil {
+		t.Fatal(err)
+	}
+	defer rs.broker.Stop()
+	if err := rs.StartRun(); err != nil {
+		t.Fatal(err)
+	}
+	nread := 0
+	for block := range rs.nextBlock {
+		if block.err != nil {
+			t.Fatalf("replay block %d has error %v", nread, block.err)
+		}
+		compare("replay", nread, block)
+		nread++
+	}
+	if nread != nblocks {
+		t.Errorf("replay produced %d blocks, want %d", nread, nblocks)
+	}
+
+	// Errors: a missing file, and a truncated file.
+	if err := rs.Configure(&CaptureReplaySourceConfig{Filename: filename + ".missing"}); err == nil {
+		t.Errorf("CaptureReplaySource.Configure should fail with a missing file")
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, contents[:len(contents)-10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cr, err = openCaptureReader(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer cr.close()
+	for b := 0; b < nblocks-1; b++ {
+		if _, err := cr.readBlock(); err != nil {
+			t.Fatalf("readBlock %d of truncated file failed: %v", b, err)
+		}
+	}
+	if _, err := cr.readBlock(); err != io.ErrUnexpectedEOF {
+		t.Errorf("readBlock of truncated block returned err=%v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// TestCaptureReplayFrameCounterWrap checks that the frame numbers of a replayed capture
+// stay continuous when the captured source's 32-bit frame counter rolled over.
+func TestCaptureReplayFrameCounterWrap(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_capture_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	filename := filepath.Join(tmp, "wrap.dcap")
+
+	ds := &AnySource{name: "Test", nchan: 1, sampleRate: 1000, samplePeriod: time.Millisecond}
+	ds.setDefaultChannelNames()
+	ds.rowColCodes = make([]RowColCode, 1)
+	ds.frameSync.counterBits = 32
+	cw, err := newCaptureWriter(filename, ds.captureHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const nframes = 100
+	start := FrameIndex(1)<<32 - 150
+	t0 := time.Now()
+	for i := 0; i < 3; i++ {
+		frame := start + FrameIndex(i*nframes)
+		seg := NewDataSegment(make([]RawType, nframes), 1, frame&(1<<32-1),
+			t0.Add(time.Duration(i*nframes)*time.Millisecond), time.Millisecond)
+		if err := cw.writeBlock(&dataBlock{segments: []DataSegment{*seg}, nSamp: nframes}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewCaptureReplaySource()
+	if err := rs.Configure(&CaptureReplaySourceConfig{Filename: filename}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	defer rs.reader.close()
+	if rs.frameSync.counterBits != 32 {
+		t.Errorf("replay source has a %d-bit frame counter, want 32", rs.frameSync.counterBits)
+	}
+	for i := 0; i < 3; i++ {
+		block, err := rs.reader.readBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.resynchronize(block)
+		if want := start + FrameIndex(i*nframes); block.segments[0].firstFramenum != want {
+			t.Errorf("block %d starts at frame %d, want %d", i, block.segments[0].firstFramenum, want)
+		}
+	}
+	if len(rs.frameSync.events) != 1 || rs.frameSync.events[0].Kind != ResyncWrap {
+		t.Errorf("frame synchronizer found events %v, want one %s", rs.frameSync.events, ResyncWrap)
+	}
+}
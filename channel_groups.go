@@ -0,0 +1,96 @@
+package dastard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ChannelGroup is a named set of channel indices, such as "column3" or "error-channels".
+// Groups can be used instead of (or in addition to) lists of channel indices when
+// configuring triggers, writing, mixing, and projectors.
+type ChannelGroup struct {
+	Name           string
+	ChannelIndices []int
+}
+
+// channelGroupRegistry holds all the defined channel groups. Groups come from the RPC
+// DefineChannelGroup and from map files, so access is guarded by a lock.
+type channelGroupRegistry struct {
+	groups map[string][]int
+	sync.Mutex
+}
+
+// channelGroups is the one registry shared by the SourceControl and MapServer.
+var channelGroups = newChannelGroupRegistry()
+
+func newChannelGroupRegistry() *channelGroupRegistry {
+	return &channelGroupRegistry{groups: make(map[string][]int)}
+}
+
+// define adds or replaces a group. A group with no ChannelIndices is deleted.
+func (r *channelGroupRegistry) define(group ChannelGroup) error {
+	name := strings.TrimSpace(group.Name)
+	if len(name) == 0 || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("channel group name %q must be non-empty with no spaces", group.Name)
+	}
+	for _, idx := range group.ChannelIndices {
+		if idx < 0 {
+			return fmt.Errorf("channel group %q has channelIndex %v, need >= 0", name, idx)
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	if len(group.ChannelIndices) == 0 {
+		delete(r.groups, name)
+		return nil
+	}
+	r.groups[name] = uniqueSorted(group.ChannelIndices)
+	return nil
+}
+
+// list returns all the groups, sorted by name.
+func (r *channelGroupRegistry) list() []ChannelGroup {
+	r.Lock()
+	defer r.Unlock()
+	result := make([]ChannelGroup, 0, len(r.groups))
+	for name, indices := range r.groups {
+		result = append(result, ChannelGroup{Name: name, ChannelIndices: append([]int{}, indices...)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// resolve returns the sorted union of channelIndices and the channels in the named
+// groups. If no groups are named, channelIndices is returned unchanged (so an empty
+// list can still mean "all channels"). Returns an error if any group is unknown.
+func (r *channelGroupRegistry) resolve(channelIndices []int, groupNames []string) ([]int, error) {
+	if len(groupNames) == 0 {
+		return channelIndices, nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	result := append([]int{}, channelIndices...)
+	for _, name := range groupNames {
+		indices, ok := r.groups[name]
+		if !ok {
+			return nil, fmt.Errorf("channel group %q is not defined", name)
+		}
+		result = append(result, indices...)
+	}
+	return uniqueSorted(result), nil
+}
+
+// uniqueSorted returns a sorted copy of x with duplicates removed.
+func uniqueSorted(x []int) []int {
+	sorted := append([]int{}, x...)
+	sort.Ints(sorted)
+	result := sorted[:0]
+	for _, v := range sorted {
+		if len(result) == 0 || v != result[len(result)-1] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,80 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestChannelGroups(t *testing.T) {
+	r := newChannelGroupRegistry()
+	if err := r.define(ChannelGroup{Name: "column3", ChannelIndices: []int{7, 5, 5, 1}}); err != nil {
+		t.Error(err)
+	}
+	if err := r.define(ChannelGroup{Name: "errors", ChannelIndices: []int{0, 2}}); err != nil {
+		t.Error(err)
+	}
+	for _, bad := range []ChannelGroup{
+		{Name: "", ChannelIndices: []int{1}},
+		{Name: "two words", ChannelIndices: []int{1}},
+		{Name: "negative", ChannelIndices: []int{-1}},
+	} {
+		if err := r.define(bad); err == nil {
+			t.Errorf("define(%+v) should fail", bad)
+		}
+	}
+	groups := r.list()
+	if len(groups) != 2 || groups[0].Name != "column3" || groups[1].Name != "errors" {
+		t.Errorf("list() returns %v, want groups column3 and errors", groups)
+	}
+
+	indices, err := r.resolve([]int{2, 3}, []string{"column3", "errors"})
+	if err != nil {
+		t.Error(err)
+	}
+	if want := []int{0, 1, 2, 3, 5, 7}; !reflect.DeepEqual(indices, want) {
+		t.Errorf("resolve() returns %v, want %v", indices, want)
+	}
+	if indices, err = r.resolve([]int{}, nil); err != nil || len(indices) != 0 {
+		t.Errorf("resolve() with no groups returns %v, %v, want an empty list", indices, err)
+	}
+	if _, err = r.resolve(nil, []string{"nosuchgroup"}); err == nil {
+		t.Error("resolve() with an undefined group should fail")
+	}
+
+	// A group with no channels is deleted.
+	if err = r.define(ChannelGroup{Name: "errors"}); err != nil {
+		t.Error(err)
+	}
+	if _, err = r.resolve(nil, []string{"errors"}); err == nil {
+		t.Error("resolve() with a deleted group should fail")
+	}
+}
+
+func TestMapGroups(t *testing.T) {
+	f, err := ioutil.TempFile("", "dastard_map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("spacing: 520\n1 290 -3470 c0r0\ngroup: col0 1 3\n\n3 290 -4510 c0r1\n")
+	f.Close()
+	m, err := readMap(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Pixels) != 2 {
+		t.Errorf("map has %d pixels, want 2", len(m.Pixels))
+	}
+	want := []ChannelGroup{{Name: "col0", ChannelIndices: []int{1, 3}}}
+	if !reflect.DeepEqual(m.Groups, want) {
+		t.Errorf("map has groups %v, want %v", m.Groups, want)
+	}
+	if _, err = parseMapGroup("group: lonely"); err == nil {
+		t.Error("parseMapGroup should fail for a group with no channels")
+	}
+	if _, err = parseMapGroup("group: bad 1 x"); err == nil {
+		t.Error("parseMapGroup should fail for a non-integer channel index")
+	}
+}
@@ -0,0 +1,78 @@
+package dastard
+
+import "fmt"
+
+// ChannelNaming configures how a data source names its channels in Sample(). Names
+// appear in output file names and client displays, so they should be stable across runs.
+// The zero value gives the usual names "chan1", "chan2", ..., with "err1", "err2", ...
+// for the error channels of a Lancero source.
+type ChannelNaming struct {
+	Prefix      string // prefix of the (feedback) channel names, or "" for "chan"
+	ErrorPrefix string // prefix of the error channel names, or "" for "err"
+	CardOffsets []int  // if set, channel numbers on card i start at CardOffsets[i]+1
+	Digits      int    // zero-pad channel numbers to at least this many digits
+}
+
+// Default channel name prefixes
+const (
+	defaultChannelPrefix = "chan"
+	defaultErrorPrefix   = "err"
+)
+
+// validate checks that the naming scheme can give distinct, sensible names.
+func (cn ChannelNaming) validate() error {
+	if cn.Digits < 0 || cn.Digits > 9 {
+		return fmt.Errorf("ChannelNaming.Digits=%d, should be in [0,9]", cn.Digits)
+	}
+	for i, offset := range cn.CardOffsets {
+		if offset < 0 {
+			return fmt.Errorf("ChannelNaming.CardOffsets[%d]=%d, should be >= 0", i, offset)
+		}
+	}
+	if cn.prefix(false) == cn.prefix(true) {
+		return fmt.Errorf("ChannelNaming uses the prefix %q for both error and feedback channels", cn.prefix(false))
+	}
+	return nil
+}
+
+// prefix returns the name prefix of error channels (if isError) or of other channels.
+func (cn ChannelNaming) prefix(isError bool) string {
+	if isError {
+		if cn.ErrorPrefix == "" {
+			return defaultErrorPrefix
+		}
+		return cn.ErrorPrefix
+	}
+	if cn.Prefix == "" {
+		return defaultChannelPrefix
+	}
+	return cn.Prefix
+}
+
+// firstNumber returns the channel number of the first channel on the given card.
+// Without a CardOffsets entry for that card, it's nextNumber, so channels are
+// numbered continuously across cards.
+func (cn ChannelNaming) firstNumber(card, nextNumber int) int {
+	if card < len(cn.CardOffsets) {
+		return cn.CardOffsets[card] + 1
+	}
+	return nextNumber
+}
+
+// name returns the name of the channel with the given number.
+func (cn ChannelNaming) name(number int, isError bool) string {
+	return fmt.Sprintf("%s%0*d", cn.prefix(isError), cn.Digits, number)
+}
+
+// checkChannelNames returns an error if any two channels have the same name, as
+// overlapping CardOffsets could cause.
+func (ds *AnySource) checkChannelNames() error {
+	seen := make(map[string]int)
+	for i, name := range ds.chanNames {
+		if j, ok := seen[name]; ok {
+			return fmt.Errorf("channels %d and %d are both named %s (check the ChannelNaming)", j, i, name)
+		}
+		seen[name] = i
+	}
+	return nil
+}
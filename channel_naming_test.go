@@ -0,0 +1,82 @@
+package dastard
+
+import "testing"
+
+func TestChannelNaming(t *testing.T) {
+	var standard ChannelNaming
+	if err := standard.validate(); err != nil {
+		t.Errorf("zero-value ChannelNaming.validate() fails: %v", err)
+	}
+	naming := ChannelNaming{Prefix: "tes", ErrorPrefix: "e", CardOffsets: []int{100, 200}, Digits: 3}
+	tests := []struct {
+		naming  ChannelNaming
+		number  int
+		isError bool
+		want    string
+	}{
+		{standard, 3, false, "chan3"},
+		{standard, 3, true, "err3"},
+		{naming, 7, false, "tes007"},
+		{naming, 7, true, "e007"},
+		{naming, 1234, false, "tes1234"},
+	}
+	for _, test := range tests {
+		if got := test.naming.name(test.number, test.isError); got != test.want {
+			t.Errorf("%+v.name(%d, %t) = %q, want %q", test.naming, test.number, test.isError, got, test.want)
+		}
+	}
+	for card, want := range []int{101, 201, 17} {
+		if got := naming.firstNumber(card, 17); got != want {
+			t.Errorf("firstNumber(%d, 17) = %d, want %d", card, got, want)
+		}
+	}
+	for _, bad := range []ChannelNaming{{Digits: -1}, {Digits: 10}, {CardOffsets: []int{0, -5}},
+		{Prefix: "x", ErrorPrefix: "x"}, {Prefix: "err"}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("%+v.validate() should fail", bad)
+		}
+	}
+
+	// Sources name their channels with the configured scheme.
+	ts := NewTriangleSource()
+	tconfig := TriangleSourceConfig{Nchan: 3, SampleRate: 10000.0, Min: 100, Max: 200,
+		Naming: ChannelNaming{Prefix: "tri", CardOffsets: []int{10}, Digits: 2}}
+	if err := ts.Configure(&tconfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"tri11", "tri12", "tri13"} {
+		if ts.chanNames[i] != want || ts.chanNumbers[i] != 11+i {
+			t.Errorf("TriangleSource channel %d is %s number %d, want %s number %d",
+				i, ts.chanNames[i], ts.chanNumbers[i], want, 11+i)
+		}
+	}
+	tconfig.Naming = ChannelNaming{Digits: -2}
+	if err := ts.Configure(&tconfig); err == nil {
+		t.Error("TriangleSource.Configure should fail with a bad ChannelNaming")
+	}
+
+	ps := NewSimPulseSource()
+	pconfig := SimPulseSourceConfig{Nchan: 2, SampleRate: 10000.0, Pedestal: 1000.0,
+		Amplitudes: []float64{5000.0}, Nsamp: 1000, Naming: ChannelNaming{Digits: 4}}
+	if err := ps.Configure(&pconfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if ps.chanNames[0] != "chan0001" || ps.chanNames[1] != "chan0002" {
+		t.Errorf("SimPulseSource channel names %v, want [chan0001 chan0002]", ps.chanNames)
+	}
+
+	ds := AnySource{chanNames: []string{"chan1", "err1", "chan2"}}
+	if err := ds.checkChannelNames(); err != nil {
+		t.Errorf("checkChannelNames() fails with distinct names: %v", err)
+	}
+	ds.chanNames = append(ds.chanNames, "err1")
+	if err := ds.checkChannelNames(); err == nil {
+		t.Error("checkChannelNames() should fail with a repeated name")
+	}
+}
@@ -5,8 +5,6 @@ package dastard
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
 	"os"
 	"reflect"
 	"strings"
@@ -25,13 +23,44 @@ type ClientUpdate struct {
 func publish(pubSocket *czmq.Sock, update ClientUpdate, message []byte) {
 	updateType := reflect.TypeOf(update.state).String()
 	tag := update.tag
-	if tag != "TRIGGERRATE" && tag != "CHANNELNAMES" && tag != "ALIVE" && tag != "NUMBERWRITTEN" && tag != "EXTERNALTRIGGER" {
-		log.Printf("SEND %v %v\n%v\n", tag, updateType, string(message))
+	if tag != "TRIGGERRATE" && tag != "CHANNELNAMES" && tag != "ALIVE" && tag != "NUMBERWRITTEN" && tag != "EXTERNALTRIGGER" && tag != "LOG" &&
+		tag != "WRITESTATS" && tag != "VETOCOUNTS" && tag != "DEADTIME" {
+		logDebugf("SEND %v %v\n%v", tag, updateType, string(message))
 	}
 	pubSocket.SendFrame([]byte(update.tag), czmq.FlagMore)
 	pubSocket.SendFrame(message, czmq.FlagNone)
 }
 
+// binaryEncoding is a serialization of status messages other than JSON. Each one is
+// published on its own ZMQ PUB port, so a client chooses the encoding by its choice of port.
+type binaryEncoding struct {
+	name    string
+	port    int
+	marshal func(interface{}) ([]byte, error)
+	socket  *czmq.Sock
+}
+
+// binaryEncodings returns the status message encodings that are not JSON.
+func binaryEncodings() []*binaryEncoding {
+	return []*binaryEncoding{
+		{name: "CBOR", port: Ports.StatusCBOR, marshal: marshalCBOR},
+		{name: "MessagePack", port: Ports.StatusMsgPack, marshal: marshalMsgPack},
+	}
+}
+
+// publishBinary publishes the update on the port of each binary encoding.
+func publishBinary(encodings []*binaryEncoding, update ClientUpdate) {
+	for _, enc := range encodings {
+		message, err := enc.marshal(update.state)
+		if err != nil {
+			logDebugf("Could not encode %s message as %s: %v", update.tag, enc.name, err)
+			continue
+		}
+		enc.socket.SendFrame([]byte(update.tag), czmq.FlagMore)
+		enc.socket.SendFrame(message, czmq.FlagNone)
+	}
+}
+
 var clientMessageChan chan ClientUpdate
 
 func init() {
@@ -41,12 +70,21 @@ func init() {
 // RunClientUpdater forwards any message from its input channel to the ZMQ publisher socket
 // to publish any information that clients need to know.
 func RunClientUpdater(statusport int, abort <-chan struct{}) {
-	hostname := fmt.Sprintf("tcp://*:%d", statusport)
-	pubSocket, err := czmq.NewPub(hostname)
+	pubSocket, err := newPubSocket(statusport)
 	if err != nil {
+		logErrorf("Could not publish status messages on port %d: %v", statusport, err)
 		return
 	}
 	defer pubSocket.Destroy()
+	encodings := make([]*binaryEncoding, 0)
+	for _, enc := range binaryEncodings() {
+		if enc.socket, err = newPubSocket(enc.port); err != nil {
+			logWarningf("Could not publish %s status messages on port %d: %v", enc.name, enc.port, err)
+			continue
+		}
+		defer enc.socket.Destroy()
+		encodings = append(encodings, enc)
+	}
 
 	// The ZMQ middleware will need some time for existing SUBscribers (and their
 	// subscription topics) to be hooked up to this new PUBlisher.
@@ -55,7 +93,10 @@ func RunClientUpdater(statusport int, abort <-chan struct{}) {
 	// dropped-message problem most of the time (though there's no guarantee).
 	time.Sleep(250 * time.Millisecond)
 
-	// Save the state to the standard saved-state file this often.
+	// Unless AutoSave is false, save the state to the standard saved-state file this often.
+	// Otherwise, only CommitConfig saves it.
+	autoSave := viper.GetBool("autosave")
+	savedKeys := configFileKeys()
 	savePeriod := time.Minute
 	saveStateRegularlyTicker := time.NewTicker(savePeriod)
 	defer saveStateRegularlyTicker.Stop()
@@ -77,6 +118,7 @@ func RunClientUpdater(statusport int, abort <-chan struct{}) {
 			if update.tag == "SENDALL" {
 				for k, v := range lastMessages {
 					publish(pubSocket, ClientUpdate{tag: k, state: v}, []byte(lastMessageStrings[k]))
+					publishBinary(encodings, ClientUpdate{tag: k, state: v})
 				}
 				continue
 			}
@@ -85,7 +127,12 @@ func RunClientUpdater(statusport int, abort <-chan struct{}) {
 			message, err := json.Marshal(update.state)
 			if err == nil {
 				publish(pubSocket, update, message)
+				if update.tag != "NEWDASTARD" {
+					latestStatus.set(update.tag, message)
+				}
+				statusSubscribers.deliver(update.tag, message)
 			}
+			publishBinary(encodings, update)
 
 			// Don't save NEWDASTARD messages--they don't contain state
 			if update.tag == "NEWDASTARD" {
@@ -101,18 +148,30 @@ func RunClientUpdater(statusport int, abort <-chan struct{}) {
 			if lastMessageStrings[update.tag] != updateString {
 				lastMessages[update.tag] = update.state
 				lastMessageStrings[update.tag] = updateString
+				_, inConfig := savedKeys[strings.ToLower(update.tag)]
+				configChanges.update(update.tag, updateString, inConfig)
 
-				if _, ok := nosaveMessages[strings.ToLower((update.tag))]; !ok {
+				if _, ok := nosaveMessages[strings.ToLower((update.tag))]; !ok && autoSave {
 					saveStateOnceTimer.Stop()
 					saveStateOnceTimer = time.NewTimer(saveDelayAfterChange)
 				}
 			}
 
 		case <-saveStateRegularlyTicker.C:
-			saveState(lastMessages)
+			if autoSave {
+				saveState(lastMessages)
+			}
 
 		case <-saveStateOnceTimer.C:
-			saveState(lastMessages)
+			if autoSave {
+				saveState(lastMessages)
+			}
+
+		case done := <-configCommitRequests:
+			done <- saveState(lastMessages)
+
+		case req := <-configRereadRequests:
+			req.done <- rereadConfig(req.filename)
 		}
 	}
 }
@@ -127,10 +186,28 @@ var nosaveMessages = map[string]struct{}{
 	"newdastard":      {},
 	"tesmap":          {},
 	"externaltrigger": {},
+	"log":             {},
+	"resync":          {},
+	"writestats":      {},
+	"vetocounts":      {},
+	"deadtime":        {},
+	"gapstats":        {},
+	"runsummary":      {},
+	"configreload":    {},
+	"triggerstorm":    {},
+	"audit":           {},
+
+	"deadchanneldetect": {},
+	"stimulus":          {},
+	"writingtransition": {},
+	"benchmark":         {},
+	"clientlost":        {},
 }
 
 // saveState stores server configuration to the standard config file.
-func saveState(lastMessages map[string]interface{}) {
+func saveState(lastMessages map[string]interface{}) error {
+	configFile.Lock()
+	defer configFile.Unlock()
 
 	lastMessages["CURRENTTIME"] = time.Now().Format(time.UnixDate)
 	// Note that the nosaveMessages don't get into the lastMessages map.
@@ -145,24 +222,30 @@ func saveState(lastMessages map[string]interface{}) {
 	bakname := mainname + ".bak"
 	err := viper.WriteConfigAs(tmpname)
 	if err != nil {
-		log.Println("Could not store config file ", tmpname, ": ", err)
-		return
+		logWarningf("Could not store config file %s: %v", tmpname, err)
+		return err
 	}
 
 	// Move old config file to backup and new file to standard config name.
 	err = os.Remove(bakname)
 	if err != nil && !os.IsNotExist(err) {
-		log.Println("Could not remove backup file ", bakname, " even though it exists: ", err)
-		return
+		logWarningf("Could not remove backup file %s even though it exists: %v", bakname, err)
+		return err
 	}
 	err = os.Rename(mainname, bakname)
 	if err != nil && !os.IsNotExist(err) {
-		log.Println("Could not save backup file: ", err)
-		return
+		logWarningf("Could not save backup file: %v", err)
+		return err
 	}
 	err = os.Rename(tmpname, mainname)
 	if err != nil {
-		log.Printf("Could not update dastard config file %s", mainname)
+		logWarningf("Could not update dastard config file %s", mainname)
+		return err
 	}
-
+	// Remember what was saved, so that this save is not mistaken for an edit.
+	if _, snapshot, err := readConfigSnapshot(mainname); err == nil {
+		configFile.snapshot = snapshot
+	}
+	configChanges.markSaved()
+	return nil
 }
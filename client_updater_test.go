@@ -0,0 +1,30 @@
+package dastard
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBinaryEncodings(t *testing.T) {
+	status := ServerStatus{Running: true, SourceName: "SimPulses", Nchannels: 4, Nsamples: 1024,
+		Npresamp: 256, Ncol: []int{2}, Nrow: []int{2}, DisabledChannels: []int{3}}
+	encodings := binaryEncodings()
+	if len(encodings) != 2 || encodings[0].name != "CBOR" || encodings[1].name != "MessagePack" {
+		t.Fatalf("binaryEncodings() returns %d encodings, want CBOR and MessagePack", len(encodings))
+	}
+	for _, enc := range encodings {
+		message, err := enc.marshal(status)
+		if err != nil {
+			t.Fatalf("%s marshal failed: %v", enc.name, err)
+		}
+		for _, key := range []string{"Running", "SourceName", "SimPulses", "Nchannels", "DisabledChannels"} {
+			if !bytes.Contains(message, []byte(key)) {
+				t.Errorf("%s message does not contain %q", enc.name, key)
+			}
+		}
+	}
+	if encodings[0].port == encodings[1].port || encodings[0].port == Ports.Status {
+		t.Errorf("binary encodings use ports %d and %d, want distinct ports other than %d",
+			encodings[0].port, encodings[1].port, Ports.Status)
+	}
+}
@@ -0,0 +1,136 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientWatchdogConfig is the RPC-usable structure for ConfigureClientWatchdog. The
+// watchdog is a dead man's switch: if no control client calls Ping for TimeoutSeconds
+// while data are being written, it marks the experiment state and can pause writing,
+// so that a run doesn't silently continue after the controlling GUI has crashed.
+type ClientWatchdogConfig struct {
+	TimeoutSeconds float64 // 0 turns the watchdog off
+	StateLabel     string  // experiment state label set when the watchdog trips ("" for none)
+	PauseWriting   bool    // also pause writing when the watchdog trips
+}
+
+// validate checks the config.
+func (config *ClientWatchdogConfig) validate() error {
+	if !(config.TimeoutSeconds >= 0) || math.IsInf(config.TimeoutSeconds, 1) {
+		return fmt.Errorf("ClientWatchdogConfig.TimeoutSeconds=%v, need >= 0", config.TimeoutSeconds)
+	}
+	if strings.ContainsAny(config.StateLabel, ",\n") {
+		return fmt.Errorf("ClientWatchdogConfig.StateLabel=%q, cannot contain a comma or newline", config.StateLabel)
+	}
+	return nil
+}
+
+// ClientWatchdogEvent describes one trip of the client watchdog. It is sent to clients
+// (those still listening) as a "CLIENTLOST" message.
+type ClientWatchdogEvent struct {
+	Time           time.Time
+	TimeoutSeconds float64
+	LastPing       time.Time // zero if no client has pinged since the watchdog was configured
+	LastClient     string    // the name given by the last client to ping
+	StateLabel     string    // the experiment state label set, if any
+	Paused         bool      // writing was paused
+	Error          string    // why the label could not be set or writing paused
+}
+
+// clientWatchdog holds the config of the client watchdog and the last ping. It trips
+// at most once per silence: after a trip, it waits for the next ping.
+type clientWatchdog struct {
+	config     ClientWatchdogConfig
+	configured time.Time // when the config was last set
+	lastPing   time.Time
+	lastClient string
+	tripped    bool
+	sync.Mutex
+}
+
+// watchdog is the one client watchdog shared by the SourceControl and all sources.
+var watchdog clientWatchdog
+
+// configure sets the watchdog's config, and restarts its countdown.
+func (w *clientWatchdog) configure(config ClientWatchdogConfig, now time.Time) {
+	w.Lock()
+	defer w.Unlock()
+	w.config = config
+	w.configured = now
+	w.tripped = false
+}
+
+// ping records that the named client is alive, and returns the watchdog's config.
+func (w *clientWatchdog) ping(client string, now time.Time) ClientWatchdogConfig {
+	w.Lock()
+	defer w.Unlock()
+	w.lastPing = now
+	w.lastClient = client
+	w.tripped = false
+	return w.config
+}
+
+// expired returns the event of a trip, and whether to pause writing, if the watchdog is
+// on and has heard from no client since watching began. Otherwise it returns nil.
+func (w *clientWatchdog) expired(now, watching time.Time) (*ClientWatchdogEvent, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if w.config.TimeoutSeconds <= 0 || w.tripped {
+		return nil, false
+	}
+	last := watching
+	for _, t := range []time.Time{w.configured, w.lastPing} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	if now.Sub(last).Seconds() < w.config.TimeoutSeconds {
+		return nil, false
+	}
+	w.tripped = true
+	event := ClientWatchdogEvent{Time: now, TimeoutSeconds: w.config.TimeoutSeconds,
+		LastClient: w.lastClient, StateLabel: w.config.StateLabel}
+	if w.lastPing.After(w.configured) {
+		event.LastPing = w.lastPing
+	}
+	return &event, w.config.PauseWriting
+}
+
+// checkClientWatchdog trips the client watchdog if no client has pinged for too long
+// while writing is active (and not paused). It runs after each block is processed.
+func (ds *AnySource) checkClientWatchdog(now time.Time) {
+	if ds.writingState.mode() != WritingActive {
+		ds.watchdogSince = time.Time{}
+		return
+	}
+	if ds.watchdogSince.IsZero() {
+		ds.watchdogSince = now
+	}
+	event, pause := watchdog.expired(now, ds.watchdogSince)
+	if event == nil {
+		return
+	}
+	logWarningf("No control client has pinged Dastard for %v s while writing (last ping %v from %q)",
+		event.TimeoutSeconds, event.LastPing, event.LastClient)
+	var errs []string
+	if event.StateLabel != "" {
+		if err := ds.SetExperimentStateLabel(now, event.StateLabel); err != nil {
+			errs = append(errs, err.Error())
+			event.StateLabel = ""
+		}
+	}
+	if pause {
+		if err := ds.WriteControl(&WriteControlConfig{Request: writePause}); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			event.Paused = true
+			clientMessageChan <- ClientUpdate{"WRITING", ds.writingState}
+		}
+	}
+	event.Error = strings.Join(errs, "; ")
+	clientMessageChan <- ClientUpdate{"CLIENTLOST", *event}
+}
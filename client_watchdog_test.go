@@ -0,0 +1,106 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientWatchdog(t *testing.T) {
+	for _, bad := range []ClientWatchdogConfig{{TimeoutSeconds: -1}, {TimeoutSeconds: math.NaN()},
+		{TimeoutSeconds: math.Inf(1)}, {TimeoutSeconds: 5, StateLabel: "A,B"}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("ClientWatchdogConfig%+v.validate() should fail", bad)
+		}
+	}
+
+	var w clientWatchdog
+	t0 := time.Now()
+	if e, _ := w.expired(t0.Add(time.Hour), t0); e != nil {
+		t.Error("watchdog that is off expired")
+	}
+	w.configure(ClientWatchdogConfig{TimeoutSeconds: 10, StateLabel: "LOST", PauseWriting: true}, t0)
+	at := func(s float64) time.Time { return t0.Add(time.Duration(s * float64(time.Second))) }
+	if e, _ := w.expired(at(9), t0); e != nil {
+		t.Error("watchdog expired before its timeout")
+	}
+	e, pause := w.expired(at(11), t0)
+	if e == nil || !pause || e.StateLabel != "LOST" || !e.LastPing.IsZero() {
+		t.Errorf("watchdog expired with %+v, pause %t", e, pause)
+	}
+	if e, _ := w.expired(at(30), t0); e != nil {
+		t.Error("watchdog expired twice in one silence")
+	}
+
+	// A ping re-arms the watchdog, and restarts its countdown.
+	if config := w.ping("gui", at(31)); config.TimeoutSeconds != 10 {
+		t.Errorf("ping replied %+v", config)
+	}
+	if e, _ := w.expired(at(40), t0); e != nil {
+		t.Error("watchdog expired too soon after a ping")
+	}
+	if e, _ := w.expired(at(42), t0); e == nil || e.LastClient != "gui" || !e.LastPing.Equal(at(31)) {
+		t.Errorf("watchdog expired with %+v after a ping", e)
+	}
+
+	// The countdown starts no sooner than watching began.
+	w.ping("gui", at(50))
+	if e, _ := w.expired(at(65), at(60)); e != nil {
+		t.Error("watchdog expired before its timeout after watching began")
+	}
+	if e, _ := w.expired(at(71), at(60)); e == nil {
+		t.Error("watchdog did not expire after watching began")
+	}
+}
+
+func TestCheckClientWatchdog(t *testing.T) {
+	ds := AnySource{nchan: 2}
+	if err := ds.PrepareRun(20, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+	tmp, err := ioutil.TempDir("", "dastard_watchdog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds.writingState.ExperimentStateFilename = filepath.Join(tmp, "experiment_state.txt")
+	defer func() {
+		if ds.writingState.experimentStateFile != nil {
+			ds.writingState.experimentStateFile.Close()
+		}
+	}()
+	watchdog.configure(ClientWatchdogConfig{TimeoutSeconds: 5, StateLabel: "CLIENT_LOST", PauseWriting: true}, time.Now())
+	defer watchdog.configure(ClientWatchdogConfig{}, time.Now())
+
+	// Not writing: nothing to watch.
+	now := time.Now()
+	ds.checkClientWatchdog(now.Add(time.Minute))
+	if !ds.watchdogSince.IsZero() || ds.writingState.ExperimentStateLabel != "" {
+		t.Errorf("watchdog watched while not writing")
+	}
+
+	ds.setWritingMode(WritingActive, writeStart, nil)
+	ds.checkClientWatchdog(now.Add(time.Minute))
+	ds.checkClientWatchdog(now.Add(time.Minute + 4*time.Second))
+	if ds.writingState.Paused || ds.writingState.ExperimentStateLabel != "" {
+		t.Error("watchdog tripped before its timeout after writing began")
+	}
+	ds.checkClientWatchdog(now.Add(time.Minute + 6*time.Second))
+	if ds.writingState.mode() != WritingPaused || ds.writingState.ExperimentStateLabel != "CLIENT_LOST" {
+		t.Errorf("after the watchdog tripped, writing is %s with state %q, want %s and CLIENT_LOST",
+			ds.writingState.mode(), ds.writingState.ExperimentStateLabel, WritingPaused)
+	}
+	for i, dsp := range ds.processors {
+		if !dsp.DataPublisher.WritingPaused {
+			t.Errorf("channel %d is not paused after the watchdog tripped", i)
+		}
+	}
+	ds.checkClientWatchdog(now.Add(2 * time.Minute))
+	if !ds.watchdogSince.IsZero() {
+		t.Error("watchdog still watching paused writing")
+	}
+}
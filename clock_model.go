@@ -0,0 +1,63 @@
+package dastard
+
+import (
+	"time"
+)
+
+// clockModel maps a source's hardware clock onto the system clock. Each segment's
+// system time is only approximate (it's measured when the data are read, so it
+// carries the read latency and scheduling jitter), while the hardware clock is
+// precise but has an arbitrary zero. The model keeps a smoothed offset between them:
+// modeled time = epoch + hardware time, with the epoch nudged toward each new
+// observation by 1/tau of the difference. The modeled times are thus as regular as
+// the hardware clock, yet they follow the system clock over long times.
+type clockModel struct {
+	tau     float64       // smoothing length, in observations
+	maxStep time.Duration // re-seed if an observation differs from the model by more than this
+	epoch   time.Time     // system time when the hardware clock read zero
+	started bool
+}
+
+// Defaults for the clockModel of each source.
+const (
+	clockModelTau     = 100.0
+	clockModelMaxStep = 250 * time.Millisecond
+)
+
+// observe updates the model with one pair of simultaneous hardware and system times,
+// and returns the modeled system time of that hardware time.
+func (cm *clockModel) observe(hardwareTime time.Duration, systemTime time.Time) time.Time {
+	if !cm.started {
+		cm.epoch = systemTime.Add(-hardwareTime)
+		cm.started = true
+		return systemTime
+	}
+	diff := systemTime.Sub(cm.epoch.Add(hardwareTime))
+	if diff > cm.maxStep || diff < -cm.maxStep {
+		logFieldsf(LogWarning, LogFields{"difference": diff}, "system and hardware clocks disagree; resetting the clock model")
+		cm.epoch = cm.epoch.Add(diff)
+	} else if cm.tau > 1 {
+		cm.epoch = cm.epoch.Add(time.Duration(float64(diff) / cm.tau))
+	} else {
+		cm.epoch = cm.epoch.Add(diff)
+	}
+	return cm.epoch.Add(hardwareTime)
+}
+
+// applyClockModel replaces the (system) firstTime of each segment in a block with
+// the time modeled from the hardware clock. If the source provided a hardware
+// timestamp, that is the hardware clock; otherwise the frame counter is.
+func (ds *AnySource) applyClockModel(block *dataBlock) {
+	if len(block.segments) == 0 {
+		return
+	}
+	seg := &block.segments[0]
+	hardwareTime := time.Duration(seg.firstFramenum) * seg.framePeriod
+	if block.hasHardwareTime {
+		hardwareTime = block.hardwareTime
+	}
+	t := ds.clock.observe(hardwareTime, seg.firstTime)
+	for i := range block.segments {
+		block.segments[i].firstTime = t
+	}
+}
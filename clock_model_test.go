@@ -0,0 +1,40 @@
+package dastard
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestClockModel(t *testing.T) {
+	cm := clockModel{tau: 20, maxStep: 100 * time.Millisecond}
+	rng := rand.New(rand.NewSource(2))
+	t0 := time.Now()
+	const latency = 5 * time.Millisecond
+	step := 50 * time.Millisecond
+
+	// System times carry a 5 ms latency plus up to 2 ms of jitter. After the model
+	// settles, modeled times should be regularly spaced and near the true times + latency.
+	var last time.Time
+	for i := 0; i < 200; i++ {
+		hw := time.Duration(i) * step
+		jitter := time.Duration(rng.Int63n(int64(2 * time.Millisecond)))
+		modeled := cm.observe(hw, t0.Add(hw+latency+jitter))
+		if i >= 100 {
+			if d := modeled.Sub(last) - step; d > 200*time.Microsecond || d < -200*time.Microsecond {
+				t.Errorf("step %d: modeled times spaced by %v, want %v", i, modeled.Sub(last), step)
+			}
+			if d := modeled.Sub(t0.Add(hw + latency + time.Millisecond)); d > time.Millisecond || d < -time.Millisecond {
+				t.Errorf("step %d: modeled time is off by %v", i, d)
+			}
+		}
+		last = modeled
+	}
+
+	// A big disagreement re-seeds the model at once.
+	hw := 200 * step
+	sys := t0.Add(hw + time.Second)
+	if modeled := cm.observe(hw, sys); !modeled.Equal(sys) {
+		t.Errorf("after a clock step, modeled time is %v, want %v", modeled, sys)
+	}
+}
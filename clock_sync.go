@@ -0,0 +1,51 @@
+package dastard
+
+import "time"
+
+// ClockSyncStatus describes how well the host clock is synchronized to an external
+// reference (by NTP or PTP), as reported by the operating system. Runs on several
+// machines can be correlated by time only if each machine's clock was synchronized.
+type ClockSyncStatus struct {
+	Time         time.Time
+	Available    bool    // whether the OS reports the synchronization status at all
+	Synchronized bool    // whether the kernel considers the clock synchronized
+	Source       string  // the time-sync daemon(s) found running, e.g. "chronyd" or "ptp4l+phc2sys"
+	Offset       float64 // last measured offset from the reference (seconds)
+	MaxError     float64 // maximum error of the clock (seconds)
+	EstError     float64 // estimated error of the clock (seconds)
+}
+
+// clockSyncPeriod is how often the clock synchronization is checked while writing.
+const clockSyncPeriod = time.Minute
+
+// readClockSync returns the host clock's synchronization status. It's a variable so
+// that tests can replace it.
+var readClockSync = hostClockSync
+
+// recordClockSync appends the host clock's synchronization status to the metadata of
+// the run being written, and warns clients when synchronization is lost or regained.
+func (ds *AnySource) recordClockSync() {
+	md := ds.writingState.metadata
+	if md == nil {
+		return
+	}
+	status := readClockSync()
+	var previous *ClockSyncStatus
+	if n := len(md.ClockSync); n > 0 {
+		previous = &md.ClockSync[n-1]
+	}
+	md.ClockSync = append(md.ClockSync, status)
+	switch {
+	case !status.Available:
+		if previous == nil {
+			logInfof("Cannot check the host clock synchronization on this system")
+		}
+	case !status.Synchronized:
+		if previous == nil || previous.Synchronized {
+			logWarningf("Host clock is not synchronized (source %q, max error %.3g s): "+
+				"times may not agree with other machines", status.Source, status.MaxError)
+		}
+	case previous != nil && !previous.Synchronized:
+		logInfof("Host clock is synchronized again (source %q, offset %.3g s)", status.Source, status.Offset)
+	}
+}
@@ -0,0 +1,69 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kernel time-discipline flags and states, from <sys/timex.h>
+const (
+	staUnsync = 0x0040 // clock unsynchronized
+	staNano   = 0x2000 // offset is in ns, not µs
+	timeError = 5      // clock not synchronized
+)
+
+// timeSyncDaemons are the programs that can keep the host clock synchronized, named
+// as in /proc/PID/comm (which truncates names to 15 characters).
+var timeSyncDaemons = map[string]bool{
+	"chronyd": true, "ntpd": true, "openntpd": true, "systemd-timesyn": true,
+	"ptp4l": true, "phc2sys": true, "timemaster": true,
+}
+
+// hostClockSync asks the kernel (by adjtimex) for the state of its clock discipline,
+// which NTP and PTP daemons keep up to date.
+func hostClockSync() ClockSyncStatus {
+	status := ClockSyncStatus{Time: time.Now(), Source: timeSyncSource()}
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return status
+	}
+	status.Available = true
+	status.Synchronized = state != timeError && tx.Status&staUnsync == 0
+	status.Offset = float64(tx.Offset) * 1e-6
+	if tx.Status&staNano != 0 {
+		status.Offset = float64(tx.Offset) * 1e-9
+	}
+	status.MaxError = float64(tx.Maxerror) * 1e-6
+	status.EstError = float64(tx.Esterror) * 1e-6
+	return status
+}
+
+// timeSyncSource returns the names of any time-sync daemons running, joined by "+",
+// or "none".
+func timeSyncSource() string {
+	commFiles, _ := filepath.Glob("/proc/[0-9]*/comm")
+	found := make(map[string]bool)
+	for _, name := range commFiles {
+		comm, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if c := strings.TrimSpace(string(comm)); timeSyncDaemons[c] {
+			found[c] = true
+		}
+	}
+	if len(found) == 0 {
+		return "none"
+	}
+	daemons := make([]string, 0, len(found))
+	for d := range found {
+		daemons = append(daemons, d)
+	}
+	sort.Strings(daemons)
+	return strings.Join(daemons, "+")
+}
@@ -0,0 +1,76 @@
+package dastard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClockSync(t *testing.T) {
+	if status := hostClockSync(); status.Time.IsZero() || status.Source == "" {
+		t.Errorf("hostClockSync() = %+v, want a Time and a Source", status)
+	}
+
+	// Replace the host clock with a sequence of fake states.
+	states := []ClockSyncStatus{
+		{Available: true, Synchronized: true, Source: "chronyd"},
+		{Available: true, Synchronized: false, Source: "chronyd", MaxError: 0.5},
+		{Available: true, Synchronized: false, Source: "chronyd", MaxError: 0.6},
+		{Available: true, Synchronized: true, Source: "chronyd"},
+	}
+	next := 0
+	readClockSync = func() ClockSyncStatus {
+		status := states[next]
+		status.Time = time.Now()
+		next++
+		return status
+	}
+	defer func() { readClockSync = hostClockSync }()
+
+	// Read the warnings from a run log file: a client updater might take the broadcasts.
+	dir, err := ioutil.TempDir("", "dastard_clocksync_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	record := func(ds *AnySource, i int) (warnings []string) {
+		filename := filepath.Join(dir, fmt.Sprintf("dastard%d.log", i))
+		if err := dlog.setRunFile(filename); err != nil {
+			t.Fatal(err)
+		}
+		ds.recordClockSync()
+		dlog.closeRunFile()
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			if strings.Contains(line, "WARNING") && strings.Contains(line, "Host clock") {
+				warnings = append(warnings, line)
+			}
+		}
+		return
+	}
+
+	ds := AnySource{}
+	ds.recordClockSync() // no run is being written
+	if next != 0 {
+		t.Errorf("recordClockSync() read the clock with no metadata")
+	}
+	ds.writingState.metadata = &RunMetadata{}
+	for i := range states {
+		warnings := record(&ds, i)
+		// Warn only when synchronization is lost, not while it stays lost.
+		wantWarning := i == 1
+		if gotWarning := len(warnings) == 1 && strings.Contains(warnings[0], "not synchronized"); gotWarning != wantWarning {
+			t.Errorf("after clock state %d, warnings are %v, want warning %t", i, warnings, wantWarning)
+		}
+	}
+	if cs := ds.writingState.metadata.ClockSync; len(cs) != len(states) || cs[2].MaxError != 0.6 {
+		t.Errorf("metadata ClockSync = %+v, want the %d states", cs, len(states))
+	}
+}
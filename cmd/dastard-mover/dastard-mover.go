@@ -0,0 +1,49 @@
+// dastard-mover receives the LJH and OFF files that Dastard sends with the data mover
+// (WriteControlConfig.MoverAddress), and writes them under a directory of this host.
+// Only senders that know the key in the -keyfile (Dastard's config key MoverKeyFile) are
+// accepted. Give -tlscert and -tlskey to also encrypt the connections.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/usnistgov/dastard/mover"
+)
+
+var listenAddress = flag.String("listen", "localhost:5520", "TCP address to listen on for Dastard")
+var directory = flag.String("dir", ".", "directory to write the files under")
+var keyFile = flag.String("keyfile", "", "file holding the key shared with Dastard (required)")
+var tlsCertFile = flag.String("tlscert", "", "PEM certificate file, to use TLS")
+var tlsKeyFile = flag.String("tlskey", "", "PEM private key file, to use TLS")
+
+func main() {
+	flag.Parse()
+	if info, err := os.Stat(*directory); err != nil || !info.IsDir() {
+		log.Fatalf("%s is not a directory", *directory)
+	}
+	if *keyFile == "" {
+		log.Fatal("-keyfile is required")
+	}
+	key, err := mover.ReadKeyFile(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			log.Fatalf("could not load TLS certificate: %v", err)
+		}
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	}
+	log.Printf("Receiving files on %s, writing them under %s", l.Addr(), *directory)
+	r := &mover.Receiver{Dir: *directory, Key: key}
+	log.Fatal(r.Serve(l))
+}
@@ -52,6 +52,29 @@ func verifyConfigFile(path, filename string) error {
 // files and the filename and suffix. Sets some defaults.
 func setupViper() error {
 	viper.SetDefault("Verbose", false)
+	viper.SetDefault("ProcessWorkers", 0)      // 0 means use GOMAXPROCS workers
+	viper.SetDefault("PubSendHWM", 0)          // 0 means use the default ZMQ send high-water mark
+	viper.SetDefault("PubRecordsBatch", false) // publish each channel's records from a segment as one message
+	viper.SetDefault("SummaryDecimation", 0)   // if >0, summaries carry every Nth sample of the record
+	viper.SetDefault("PublishEnergies", false)
+	viper.SetDefault("WriteQueueLength", 100) // batches of records per channel; 0 means write without a queue
+	viper.SetDefault("WriteQueuePolicy", "block")
+	viper.SetDefault("RunHookURL", "")           // POST run START/STOP events here, if set
+	viper.SetDefault("RunCatalog", "")           // record runs in this SQLite file, if set
+	viper.SetDefault("LJH3Checksums", false)     // add record CRCs and an integrity footer to LJH3 files
+	viper.SetDefault("AutoStart", false)         // start the last-used source when Dastard launches
+	viper.SetDefault("AutoSave", true)           // save settings as they change; if false, only by CommitConfig
+	viper.SetDefault("AutoTriggerStagger", true) // spread the channels' auto triggers over the AutoDelay
+	viper.SetDefault("TriggerPreviewSeconds", 0) // data kept per channel for PreviewTriggers; 0 for none
+	viper.SetDefault("RawSnapshotSeconds", 0)    // keep more data for FetchRawSnapshot, if longer than the above
+	viper.SetDefault("SubframeTiming", true)     // offset record times of each TDM row by its place in the frame
+
+	// Log each RPC control call to AuditLogFile ("" for none), and also broadcast each as AUDIT if AuditBroadcast
+	viper.SetDefault("AuditLogFile", "")
+	viper.SetDefault("AuditBroadcast", false)
+
+	// Warn when a Lancero card's ring buffer is fuller than this fraction (0 for never)
+	viper.SetDefault("LanceroBufferWarning", 0.5)
 
 	const path string = "$HOME/.dastard"
 	const filename string = "config"
@@ -0,0 +1,98 @@
+package dastard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configChangeTracker tracks which saved status messages (the runtime settings that
+// saveState stores in the config file) differ from the config file as last saved.
+// The client updater fills it; ReportUnsavedChanges reads it.
+type configChangeTracker struct {
+	saved     map[string]string // JSON of each tag when the config file was last saved
+	current   map[string]string // latest JSON of each tag
+	lastSaved time.Time
+	sync.Mutex
+}
+
+var configChanges = newConfigChangeTracker()
+
+func newConfigChangeTracker() *configChangeTracker {
+	return &configChangeTracker{saved: make(map[string]string), current: make(map[string]string)}
+}
+
+// update notes the latest JSON message of the tag. The first message of a tag already
+// in the config file counts as saved, as it is normally the setting restored from it.
+func (ct *configChangeTracker) update(tag, message string, inConfig bool) {
+	if _, ok := nosaveMessages[strings.ToLower(tag)]; ok {
+		return
+	}
+	ct.Lock()
+	defer ct.Unlock()
+	if _, seen := ct.current[tag]; !seen && inConfig {
+		ct.saved[tag] = message
+	}
+	ct.current[tag] = message
+}
+
+// markSaved notes that the config file now holds the current message of every tag.
+func (ct *configChangeTracker) markSaved() {
+	ct.Lock()
+	defer ct.Unlock()
+	for tag, message := range ct.current {
+		ct.saved[tag] = message
+	}
+	ct.lastSaved = time.Now()
+}
+
+// unsaved returns the sorted tags whose current message differs from the saved one.
+func (ct *configChangeTracker) unsaved() []string {
+	ct.Lock()
+	defer ct.Unlock()
+	tags := make([]string, 0)
+	for tag, message := range ct.current {
+		if saved, ok := ct.saved[tag]; !ok || saved != message {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// UnsavedChanges is the reply of ReportUnsavedChanges.
+type UnsavedChanges struct {
+	AutoSave  bool      // config key AutoSave: are changes saved as they happen?
+	Tags      []string  // status messages whose settings differ from the config file
+	LastSaved time.Time // zero if Dastard has not saved the config file since it started
+}
+
+// configCommitRequests asks the client updater to save the config file now. It answers
+// on the given channel when the save is done.
+var configCommitRequests = make(chan chan error)
+
+// configCommitTimeout is how long CommitConfig waits for the client updater.
+const configCommitTimeout = 10 * time.Second
+
+// commitConfig saves the current settings to the config file, through the client updater.
+func commitConfig() error {
+	return requestConfigCommit(configCommitRequests)
+}
+
+// requestConfigCommit sends one save request on requests and waits for its answer.
+func requestConfigCommit(requests chan chan error) error {
+	done := make(chan error, 1)
+	select {
+	case requests <- done:
+	case <-time.After(configCommitTimeout):
+		return fmt.Errorf("the client updater did not take the request to save the config file")
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(configCommitTimeout):
+		return fmt.Errorf("timed out waiting for the config file to be saved")
+	}
+}
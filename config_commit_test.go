@@ -0,0 +1,49 @@
+package dastard
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestConfigChangeTracker(t *testing.T) {
+	ct := newConfigChangeTracker()
+	ct.update("TRIGGER", `{"a":1}`, true)      // restored from the config file
+	ct.update("MIX", `[0]`, false)             // never saved
+	ct.update("TRIGGERRATE", `{"r":1}`, false) // a no-save message
+	if got := ct.unsaved(); !reflect.DeepEqual(got, []string{"MIX"}) {
+		t.Errorf("unsaved()=%v, want [MIX]", got)
+	}
+	ct.update("TRIGGER", `{"a":2}`, true)
+	if got := ct.unsaved(); !reflect.DeepEqual(got, []string{"MIX", "TRIGGER"}) {
+		t.Errorf("unsaved()=%v, want [MIX TRIGGER]", got)
+	}
+	ct.markSaved()
+	if got := ct.unsaved(); len(got) != 0 || ct.lastSaved.IsZero() {
+		t.Errorf("after markSaved, unsaved()=%v and lastSaved=%v, want none and a time", got, ct.lastSaved)
+	}
+	ct.update("TRIGGER", `{"a":3}`, true)
+	ct.update("TRIGGER", `{"a":2}`, true) // back to the saved setting
+	if got := ct.unsaved(); len(got) != 0 {
+		t.Errorf("a setting changed back to its saved value is unsaved: %v", got)
+	}
+}
+
+func TestCommitConfig(t *testing.T) {
+	// Stand in for the client updater, which answers the commit requests. Use a channel
+	// of our own, as the real client updater (started by TestMain) also listens.
+	requests := make(chan chan error)
+	results := []error{nil, fmt.Errorf("disk full")}
+	go func() {
+		for _, result := range results {
+			done := <-requests
+			done <- result
+		}
+	}()
+	if err := requestConfigCommit(requests); err != nil {
+		t.Errorf("requestConfigCommit()=%v, want nil", err)
+	}
+	if err := requestConfigCommit(requests); err == nil {
+		t.Error("requestConfigCommit() should return the error of the save")
+	}
+}
@@ -0,0 +1,343 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// ConfigReloadMessage reports what changed when the config file was edited while Dastard
+// runs. It is sent to clients as a "CONFIGRELOAD" message. Each list holds config keys.
+type ConfigReloadMessage struct {
+	Filename     string
+	Applied      []string // already in use
+	NextStart    []string // used when the next source starts (or the next run, for RunHookURL and RunCatalog)
+	NeedsRestart []string // read only when Dastard launches
+	Ignored      []string // state that Dastard saves itself; change it by RPC, as the next save overwrites it
+	Errors       []string // why an Applied key's new value could not be used
+}
+
+// configReloadApplied are the keys applied as soon as the config file changes.
+var configReloadApplied = map[string]struct{}{
+	"trigger":     {},
+	"writingpath": {},
+}
+
+// configReloadNextStart are the keys read each time a source (or a run) starts.
+var configReloadNextStart = map[string]struct{}{
+	"processworkers":   {},
+	"publishenergies":  {},
+	"writequeuelength": {},
+	"writequeuepolicy": {},
+	"gaps":             {},
+	"triggerstorm":     {},
+	"kafka":            {},
+	"moverkeyfile":     {},
+	"movertlscafile":   {},
+	"multicast":        {},
+	"runhookurl":       {},
+	"runcatalog":       {},
+	"ljh3checksums":    {},
+	"cpu":              {},
+
+	"autotriggerstagger":    {},
+	"triggerpreviewseconds": {},
+	"rawsnapshotseconds":    {},
+	"summarydecimation":     {},
+	"lancerobufferwarning":  {},
+	"deadchanneldetect":     {},
+	"subframetiming":        {},
+}
+
+// configReloadRestart are the keys read only when Dastard launches. (The port numbers
+// are not in the config file; they are fixed when Dastard launches.)
+var configReloadRestart = map[string]struct{}{
+	"verbose":         {},
+	"autostart":       {},
+	"autosave":        {},
+	"pubsendhwm":      {},
+	"pubrecordsbatch": {},
+	"epics":           {},
+	"tlscertfile":     {},
+	"tlskeyfile":      {},
+	"tlsclientcafile": {},
+
+	"zmqcurvesecretkey":      {},
+	"zmqcurvecertfile":       {},
+	"zmqcurveclientcertsdir": {},
+	"auditlogfile":           {},
+	"auditbroadcast":         {},
+}
+
+// configReloadDelay is how long the config file must be quiet before it is re-read, so
+// that an editor's several writes cause only one reload.
+const configReloadDelay = 200 * time.Millisecond
+
+// configSnapshot holds each top-level key of a config file, with its value as JSON so
+// that changes can be found.
+type configSnapshot map[string]string
+
+// readConfigSnapshot reads the named config file into a new Viper (leaving the global
+// one alone), and returns it with the snapshot of its contents.
+func readConfigSnapshot(filename string) (*viper.Viper, configSnapshot, error) {
+	v := viper.New()
+	v.SetConfigFile(filename)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, nil, err
+	}
+	snapshot := make(configSnapshot)
+	for key, value := range v.AllSettings() {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("config key %s: %v", key, err)
+		}
+		snapshot[key] = string(b)
+	}
+	return v, snapshot, nil
+}
+
+// changedKeys returns the keys added, removed, or changed in after, in sorted order.
+// The time stamp that Dastard saves is not a change.
+func (before configSnapshot) changedKeys(after configSnapshot) []string {
+	var keys []string
+	for key, value := range after {
+		if old, ok := before[key]; !ok || old != value {
+			keys = append(keys, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if key == "currenttime" {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	return keys
+}
+
+// configFileKeys returns the top-level keys of the config file that Dastard launched with.
+// Only a message's first update asks whether it is in the config file, and every save
+// keeps the launch file's keys, so the client updater reads them only once.
+func configFileKeys() configSnapshot {
+	filename := viper.ConfigFileUsed()
+	if filename == "" {
+		return nil
+	}
+	_, snapshot, err := readConfigSnapshot(filename)
+	if err != nil {
+		return nil
+	}
+	return snapshot
+}
+
+// configFile holds the last-known contents of the config file. saveState and the
+// reloads both hold its lock, so Dastard's own saves are never seen as edits.
+var configFile struct {
+	snapshot configSnapshot
+	sync.Mutex
+}
+
+// watchConfigFile starts to watch the config file for edits, which are applied (as far
+// as possible) and reported to clients.
+func (s *SourceControl) watchConfigFile() {
+	filename := viper.ConfigFileUsed()
+	if filename == "" {
+		return
+	}
+	filename = filepath.Clean(filename)
+	_, snapshot, err := readConfigSnapshot(filename)
+	if err != nil {
+		logWarningf("Could not read config file %s, so it will not be reloaded when changed: %v", filename, err)
+		return
+	}
+	configFile.Lock()
+	configFile.snapshot = snapshot
+	configFile.Unlock()
+
+	// Watch the directory, not the file: saves by Dastard and many editors replace the file.
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(filename)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		logWarningf("Could not watch config file %s for changes: %v", filename, err)
+		return
+	}
+	go func() {
+		defer watcher.Close()
+		var pending <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filename && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					pending = time.After(configReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logWarningf("Error watching config file %s: %v", filename, err)
+			case <-pending:
+				pending = nil
+				s.configFileChanged(filename)
+			}
+		}
+	}()
+}
+
+// configReread is the result of re-reading the config file: the file alone, read into
+// its own Viper, and the keys changed since it was last read or saved.
+type configReread struct {
+	file *viper.Viper
+	keys []string
+	err  error
+}
+
+// configRereadRequest asks the client updater to re-read the named config file.
+type configRereadRequest struct {
+	filename string
+	done     chan configReread
+}
+
+// configRereadRequests carries config file re-reads to the client updater, which is the
+// only goroutine that changes the global Viper.
+var configRereadRequests = make(chan configRereadRequest)
+
+// requestConfigReread sends one re-read request on requests and waits for its answer.
+func requestConfigReread(requests chan configRereadRequest, filename string) configReread {
+	req := configRereadRequest{filename: filename, done: make(chan configReread, 1)}
+	select {
+	case requests <- req:
+	case <-time.After(configCommitTimeout):
+		return configReread{err: fmt.Errorf("the client updater did not take the request to re-read the file")}
+	}
+	select {
+	case result := <-req.done:
+		return result
+	case <-time.After(configCommitTimeout):
+		return configReread{err: fmt.Errorf("timed out waiting for the file to be re-read")}
+	}
+}
+
+// rereadConfig re-reads the config file and, if it was edited, loads it into the global
+// Viper. Only the client updater calls it.
+func rereadConfig(filename string) configReread {
+	configFile.Lock()
+	defer configFile.Unlock()
+	v, snapshot, err := readConfigSnapshot(filename)
+	if err != nil {
+		return configReread{err: err}
+	}
+	keys := configFile.snapshot.changedKeys(snapshot)
+	configFile.snapshot = snapshot
+	if len(keys) == 0 {
+		return configReread{file: v}
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		return configReread{err: err}
+	}
+	// Saved state overrides the file in Viper, so override it with the file's new values.
+	for _, key := range keys {
+		if _, ok := configReloadApplied[key]; ok {
+			viper.Set(key, v.Get(key))
+		}
+	}
+	return configReread{file: v, keys: keys}
+}
+
+// configFileChanged has the client updater re-read the config file and, if it was
+// edited, applies and reports the changes.
+func (s *SourceControl) configFileChanged(filename string) {
+	reread := requestConfigReread(configRereadRequests, filename)
+	if reread.err != nil {
+		logWarningf("Could not reload config file %s: %v", filename, reread.err)
+		return
+	}
+	keys := reread.keys
+	if len(keys) == 0 {
+		return
+	}
+	m := s.reloadConfig(reread.file, keys)
+	m.Filename = filename
+	logInfof("Config file %s changed: applied %v; next source start %v; needs restart %v; ignored %v",
+		filename, m.Applied, m.NextStart, m.NeedsRestart, m.Ignored)
+	for _, e := range m.Errors {
+		logWarningf("Could not apply config file change: %s", e)
+	}
+	s.clientUpdates <- ClientUpdate{"CONFIGRELOAD", m}
+}
+
+// reloadConfig applies the changed keys of the config file read into v that can be
+// applied immediately, and says what happens to each changed key.
+func (s *SourceControl) reloadConfig(v *viper.Viper, keys []string) ConfigReloadMessage {
+	var m ConfigReloadMessage
+	for _, key := range keys {
+		if _, ok := configReloadNextStart[key]; ok {
+			m.NextStart = append(m.NextStart, key)
+			continue
+		}
+		if _, ok := configReloadRestart[key]; ok {
+			m.NeedsRestart = append(m.NeedsRestart, key)
+			continue
+		}
+		if _, ok := configReloadApplied[key]; !ok {
+			m.Ignored = append(m.Ignored, key)
+			continue
+		}
+		var err error
+		switch key {
+		case "trigger":
+			err = s.reloadTriggers(v)
+		case "writingpath":
+			var wpc WritingPathConfig
+			var okay bool
+			if err = v.UnmarshalKey(key, &wpc); err == nil {
+				err = s.SetWritingPath(&wpc, &okay)
+			}
+		}
+		if err != nil {
+			m.Errors = append(m.Errors, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		m.Applied = append(m.Applied, key)
+	}
+	return m
+}
+
+// reloadTriggers applies the trigger states of the config file read into v to the
+// active source. With no active source, they are broadcast, so that they are kept in
+// the next save and used when the next source starts.
+func (s *SourceControl) reloadTriggers(v *viper.Viper) error {
+	var fts []FullTriggerState
+	if err := v.UnmarshalKey("trigger", &fts); err != nil {
+		return err
+	}
+	if !s.isSourceActive {
+		s.clientUpdates <- ClientUpdate{"TRIGGER", fts}
+		return nil
+	}
+	var reply BulkTriggerReply
+	if err := s.ConfigureTriggersBulk(&fts, &reply); err != nil {
+		return err
+	}
+	if !reply.Applied {
+		return fmt.Errorf("invalid trigger states for channels %v", reply.Errors)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigReload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_reload_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	filename := filepath.Join(tmp, "config.yaml")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("currenttime: Mon\nwritequeuelength: 100\npubsendhwm: 0\nsimpulse:\n  nchan: 4\nverbose: false\n")
+	_, before, err := readConfigSnapshot(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(`currenttime: Tue
+writequeuelength: 50
+pubsendhwm: 1000
+simpulse:
+  nchan: 8
+writingpath:
+  basepath: ` + tmp + `
+  naming:
+    prefix: y
+trigger:
+- channelindicies: [0, 1]
+  triggerstate:
+    autotrigger: true
+    autodelay: 10000000
+`)
+	v, after, err := readConfigSnapshot(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := before.changedKeys(after)
+	want := []string{"pubsendhwm", "simpulse", "trigger", "verbose", "writequeuelength", "writingpath"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("changedKeys gives %v, want %v", keys, want)
+	}
+	if keys := after.changedKeys(after); len(keys) != 0 {
+		t.Errorf("changedKeys of an unchanged file gives %v", keys)
+	}
+
+	saved := writingPaths
+	defer func() { writingPaths = saved }()
+	writingPaths = &writingPathRegistry{}
+	updates := make(chan ClientUpdate, 10)
+	s := &SourceControl{clientUpdates: updates}
+	m := s.reloadConfig(v, keys)
+	if !reflect.DeepEqual(m.Applied, []string{"trigger", "writingpath"}) ||
+		!reflect.DeepEqual(m.NextStart, []string{"writequeuelength"}) ||
+		!reflect.DeepEqual(m.NeedsRestart, []string{"pubsendhwm", "verbose"}) ||
+		!reflect.DeepEqual(m.Ignored, []string{"simpulse"}) || len(m.Errors) > 0 {
+		t.Errorf("reloadConfig gives %+v", m)
+	}
+	if wpc := writingPaths.get(); wpc.BasePath != tmp || wpc.Naming.Prefix != "y" {
+		t.Errorf("writing path is %+v after reload, want BasePath %s and Prefix y", wpc, tmp)
+	}
+	close(updates)
+	tags := make(map[string]interface{})
+	for update := range updates {
+		tags[update.tag] = update.state
+	}
+	if fts, ok := tags["TRIGGER"].([]FullTriggerState); !ok || len(fts) != 1 || !fts[0].AutoTrigger ||
+		len(fts[0].ChannelIndicies) != 2 {
+		t.Errorf("reload broadcast TRIGGER %v, want the file's trigger state", tags["TRIGGER"])
+	}
+	if _, ok := tags["WRITINGPATH"]; !ok {
+		t.Error("reload did not broadcast WRITINGPATH")
+	}
+
+	// An invalid writing path is an error, and changes nothing.
+	write("writingpath:\n  naming:\n    rundigits: 9\n")
+	v, _, err = readConfigSnapshot(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.clientUpdates = make(chan ClientUpdate, 10)
+	if m := s.reloadConfig(v, []string{"writingpath"}); len(m.Applied) != 0 || len(m.Errors) != 1 {
+		t.Errorf("reloadConfig of an invalid writing path gives %+v", m)
+	}
+	if wpc := writingPaths.get(); wpc.Naming.Prefix != "y" {
+		t.Errorf("invalid reload changed the writing path to %+v", wpc)
+	}
+}
+
+func TestConfigRereadRequest(t *testing.T) {
+	// Stand in for the client updater, which answers the re-read requests.
+	requests := make(chan configRereadRequest)
+	go func() {
+		req := <-requests
+		req.done <- configReread{keys: []string{req.filename}}
+	}()
+	if reread := requestConfigReread(requests, "x.yaml"); reread.err != nil ||
+		!reflect.DeepEqual(reread.keys, []string{"x.yaml"}) {
+		t.Errorf("requestConfigReread gives %+v, want the stand-in's answer", reread)
+	}
+}
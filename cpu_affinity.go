@@ -0,0 +1,94 @@
+package dastard
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/viper"
+)
+
+// ThreadPlacement says where and how urgently a group of Dastard's goroutines should
+// run. Pinning them to CPUs that other programs on a shared DAQ machine don't use, and
+// raising their priority, reduces the scheduling jitter that can overflow the hardware
+// FIFOs.
+type ThreadPlacement struct {
+	CPUs []int // the CPUs the threads may run on; empty means any CPU
+	Nice int   // the threads' nice value (-20 to 19, lower is more urgent); 0 leaves it alone
+}
+
+// CPUConfig is the "cpu" section of the config file, read when a source starts.
+type CPUConfig struct {
+	Readers ThreadPlacement // the goroutines that read data from the hardware (or generate it)
+	Workers ThreadPlacement // the goroutines of the processing worker pool
+}
+
+// maxCPUs is the highest CPU number (plus 1) that a ThreadPlacement can use.
+const maxCPUs = 1024
+
+// validate checks the placement for errors.
+func (p *ThreadPlacement) validate() error {
+	for _, cpu := range p.CPUs {
+		if cpu < 0 || cpu >= maxCPUs {
+			return fmt.Errorf("CPU %d is out of range [0,%d)", cpu, maxCPUs)
+		}
+	}
+	if p.Nice < -20 || p.Nice > 19 {
+		return fmt.Errorf("Nice=%d, need -20 to 19", p.Nice)
+	}
+	return nil
+}
+
+// validate checks the config for errors.
+func (config *CPUConfig) validate() error {
+	if err := config.Readers.validate(); err != nil {
+		return fmt.Errorf("readers: %v", err)
+	}
+	if err := config.Workers.validate(); err != nil {
+		return fmt.Errorf("workers: %v", err)
+	}
+	return nil
+}
+
+// loadCPUConfig returns the CPU placement of the config file, or none if there is none
+// or it is invalid.
+func loadCPUConfig() CPUConfig {
+	var config CPUConfig
+	err := viper.UnmarshalKey("cpu", &config)
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		logWarningf("Invalid cpu config, so threads will not be pinned to CPUs: %v", err)
+		config = CPUConfig{}
+	}
+	return config
+}
+
+// pin applies the placement to the calling goroutine, which is locked to its OS thread
+// for the rest of its life (so that the thread exits with it, rather than carrying the
+// placement to other goroutines). An empty placement does nothing.
+func (p *ThreadPlacement) pin() error {
+	if len(p.CPUs) == 0 && p.Nice == 0 {
+		return nil
+	}
+	runtime.LockOSThread()
+	if len(p.CPUs) > 0 {
+		if err := setThreadAffinity(p.CPUs); err != nil {
+			return fmt.Errorf("could not pin thread to CPUs %v: %v", p.CPUs, err)
+		}
+	}
+	if p.Nice != 0 {
+		if err := setThreadNice(p.Nice); err != nil {
+			return fmt.Errorf("could not set thread nice value to %d: %v", p.Nice, err)
+		}
+	}
+	return nil
+}
+
+// pinReader applies the config's reader placement to the calling goroutine, which
+// reads data for the source. A failure is only a warning.
+func (ds *AnySource) pinReader() {
+	if err := ds.cpuConfig.Readers.pin(); err != nil {
+		logWarningf("Data reader for %s source: %v", ds.name, err)
+	}
+}
@@ -0,0 +1,28 @@
+package dastard
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// setThreadAffinity restricts the calling OS thread to the given CPUs (by
+// sched_setaffinity).
+func setThreadAffinity(cpus []int) error {
+	var mask [maxCPUs / 64]uint64
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+	// A pid of 0 means the calling thread.
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask),
+		uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setThreadNice sets the nice value of the calling OS thread. On Linux, the priority
+// of a thread ID affects only that thread. Negative values need CAP_SYS_NICE.
+func setThreadNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), nice)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package dastard
+
+import "fmt"
+
+// setThreadAffinity fails, because only Linux is supported for now.
+func setThreadAffinity(cpus []int) error {
+	return fmt.Errorf("CPU affinity is supported only on Linux")
+}
+
+// setThreadNice fails, because only Linux is supported for now.
+func setThreadNice(nice int) error {
+	return fmt.Errorf("thread priority is supported only on Linux")
+}
@@ -0,0 +1,45 @@
+package dastard
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCPUConfig(t *testing.T) {
+	for _, bad := range []CPUConfig{{Readers: ThreadPlacement{CPUs: []int{-1}}},
+		{Workers: ThreadPlacement{CPUs: []int{0, maxCPUs}}}, {Readers: ThreadPlacement{Nice: -21}},
+		{Workers: ThreadPlacement{Nice: 20}}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("CPUConfig%+v.validate() should fail", bad)
+		}
+	}
+	config := CPUConfig{Readers: ThreadPlacement{CPUs: []int{0, 1}, Nice: -5}, Workers: ThreadPlacement{Nice: 19}}
+	if err := config.validate(); err != nil {
+		t.Error(err)
+	}
+
+	// Pin a goroutine (which ends, so its thread ends too) to CPU 0 at the current priority.
+	pin := func(p ThreadPlacement) error {
+		errs := make(chan error)
+		go func() { errs <- p.pin() }()
+		return <-errs
+	}
+	if err := pin(ThreadPlacement{}); err != nil {
+		t.Errorf("empty ThreadPlacement.pin() gives %v", err)
+	}
+	err := pin(ThreadPlacement{CPUs: []int{0}})
+	if runtime.GOOS != "linux" && err == nil {
+		t.Error("ThreadPlacement.pin() should fail except on Linux")
+	} else if runtime.GOOS == "linux" && err != nil {
+		t.Skipf("cannot pin a thread to CPU 0 on this host: %v", err)
+	}
+
+	// The pool works even if its workers cannot be placed.
+	pool := newProcessPool(2, ThreadPlacement{CPUs: []int{maxCPUs - 1}})
+	defer pool.Stop()
+	n := 0
+	pool.run(1, func(int) { n++ })
+	if n != 1 {
+		t.Errorf("pool with unusable CPUs ran %d calls, want 1", n)
+	}
+}
@@ -0,0 +1,136 @@
+package dastard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	"github.com/usnistgov/dastard/ljh"
+	"github.com/usnistgov/dastard/mover"
+	"github.com/usnistgov/dastard/off"
+)
+
+// validateMoverAddress checks WriteControlConfig.MoverAddress, if set.
+func validateMoverAddress(address string, extraPaths []string) error {
+	if address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("MoverAddress=%q, need host:port: %v", address, err)
+	}
+	if len(extraPaths) > 0 {
+		return fmt.Errorf("MoverAddress and ExtraPaths cannot be used together")
+	}
+	return nil
+}
+
+// moverFiles creates a run's LJH and OFF files on a data mover receiver, naming each by
+// its path relative to the run's base path.
+type moverFiles struct {
+	sender   *mover.Sender
+	basePath string
+}
+
+func (m *moverFiles) create(name string) (*mover.File, error) {
+	rel, err := filepath.Rel(m.basePath, name)
+	if err != nil {
+		return nil, err
+	}
+	return m.sender.Create(filepath.ToSlash(rel))
+}
+
+func (m *moverFiles) createLJH(name string) (ljh.File, error) {
+	f, err := m.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (m *moverFiles) createOFF(name string) (off.File, error) {
+	f, err := m.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// useDataMover makes the channel's writers create their files with m.
+func (dp *DataPublisher) useDataMover(m *moverFiles) {
+	if dp.LJH22 != nil {
+		dp.LJH22.Create = m.createLJH
+	}
+	if dp.LJH3 != nil {
+		dp.LJH3.Create = m.createLJH
+	}
+	if dp.OFF != nil {
+		dp.OFF.Create = m.createOFF
+	}
+}
+
+// moverSenderConfig returns the configuration of a data mover sender to address. The
+// config file must set MoverKeyFile, the file holding the key shared with the receiver.
+// Also set MoverTLSCAFile (PEM) to use TLS, checking the receiver's certificate against
+// the CAs in that file.
+func moverSenderConfig(address string) (mover.SenderConfig, error) {
+	config := mover.SenderConfig{Addr: address, Logf: logWarningf}
+	keyFile := viper.GetString("moverkeyfile")
+	if keyFile == "" {
+		return config, fmt.Errorf("MoverAddress needs the config key MoverKeyFile")
+	}
+	var err error
+	if config.Key, err = mover.ReadKeyFile(keyFile); err != nil {
+		return config, err
+	}
+	if caFile := viper.GetString("movertlscafile"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return config, fmt.Errorf("could not read MoverTLSCAFile: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return config, fmt.Errorf("MoverTLSCAFile %s has no PEM certificates", caFile)
+		}
+		config.TLS = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return config, nil
+}
+
+// startDataMover connects to the data mover receiver at address, if not empty, for a
+// run whose files are under basePath. It returns nil if the files are written locally.
+func (ds *AnySource) startDataMover(address, basePath string) (*moverFiles, error) {
+	ds.writingState.MoverAddress = ""
+	ds.writingState.dataMover = nil
+	if address == "" {
+		return nil, nil
+	}
+	config, err := moverSenderConfig(address)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := mover.NewSender(config)
+	if err != nil {
+		return nil, err
+	}
+	ds.writingState.MoverAddress = address
+	ds.writingState.dataMover = sender
+	logInfof("Sending the LJH and OFF files to the data mover receiver at %s", address)
+	return &moverFiles{sender: sender, basePath: basePath}, nil
+}
+
+// stopDataMover waits for the data mover receiver, if any, to acknowledge all of the
+// run's files (which must be closed already), and disconnects.
+func (ds *AnySource) stopDataMover() {
+	if ds.writingState.dataMover == nil {
+		return
+	}
+	if err := ds.writingState.dataMover.Close(); err != nil {
+		logWarningf("The run's files may be incomplete on the data mover receiver: %v", err)
+	}
+	ds.writingState.dataMover = nil
+	ds.writingState.MoverAddress = ""
+}
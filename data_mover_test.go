@@ -0,0 +1,105 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/usnistgov/dastard/ljh"
+	"github.com/usnistgov/dastard/mover"
+)
+
+func TestValidateMoverAddress(t *testing.T) {
+	if err := validateMoverAddress("", []string{"/disk2"}); err != nil {
+		t.Errorf("validateMoverAddress of no address returned %v", err)
+	}
+	if err := validateMoverAddress("storage.example.org:5520", nil); err != nil {
+		t.Errorf("validateMoverAddress of a host:port returned %v", err)
+	}
+	if err := validateMoverAddress("storage.example.org", nil); err == nil {
+		t.Error("validateMoverAddress accepted an address without a port")
+	}
+	if err := validateMoverAddress("storage.example.org:5520", []string{"/disk2"}); err == nil {
+		t.Error("validateMoverAddress accepted MoverAddress with ExtraPaths")
+	}
+}
+
+func TestDataMoverLJH(t *testing.T) {
+	remote, err := ioutil.TempDir("", "dastard_mover_remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remote)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	key := []byte("the data mover test key")
+	go (&mover.Receiver{Dir: remote, Key: key, Logf: func(string, ...interface{}) {}}).Serve(l)
+
+	var ds AnySource
+	kf, err := ioutil.TempFile("", "dastard_mover_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(kf.Name())
+	kf.Write(key)
+	kf.Close()
+	if _, err := ds.startDataMover(l.Addr().String(), remote); err == nil {
+		t.Error("startDataMover succeeded without MoverKeyFile")
+	}
+	viper.Set("moverkeyfile", kf.Name())
+	defer viper.Set("moverkeyfile", "")
+	base, err := ioutil.TempDir("", "dastard_mover_base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	files, err := ds.startDataMover(l.Addr().String(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.writingState.MoverAddress != l.Addr().String() {
+		t.Errorf("WritingState.MoverAddress=%q, want %q", ds.writingState.MoverAddress, l.Addr().String())
+	}
+	name := filepath.Join(base, "20261016", "0001", "20261016_run0001_chan1.ljh")
+	dp := DataPublisher{}
+	d := []RawType{10, 10, 10, 10, 15, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10}
+	rec := &DataRecord{data: d, presamples: 4, modelCoefs: make([]float64, 3)}
+	dp.SetLJH22(1, 4, len(d), 1, 1, time.Now(), 8, 1, 16, 3, 0, name, "testSource", "chan1", 1)
+	dp.useDataMover(files)
+	if err := dp.PublishData([]*DataRecord{rec, rec, rec}); err != nil {
+		t.Fatal(err)
+	}
+	dp.RemoveLJH22()
+	ds.stopDataMover()
+	if ds.writingState.MoverAddress != "" || ds.writingState.dataMover != nil {
+		t.Errorf("stopDataMover left WritingState %+v", ds.writingState)
+	}
+
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("LJH file was written locally (Stat error %v)", err)
+	}
+	r, err := ljh.OpenReader(filepath.Join(remote, "20261016", "0001", "20261016_run0001_chan1.ljh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 3; i++ {
+		pr, err := r.NextPulse()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if len(pr.Pulse) != len(d) || pr.Pulse[5] != 20 {
+			t.Errorf("record %d has samples %v, want %v", i, pr.Pulse, d)
+		}
+	}
+	if _, err := r.NextPulse(); err == nil {
+		t.Error("received LJH file has more than 3 records")
+	}
+}
@@ -2,14 +2,17 @@ package dastard
 
 import (
 	"bufio"
+	"encoding/base64"
 	"fmt"
-	"log"
+	"math"
 	"os"
-	"strings"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/usnistgov/dastard/getbytes"
+	"github.com/usnistgov/dastard/mover"
 
 	"github.com/spf13/viper"
 	"gonum.org/v1/gonum/mat"
@@ -45,17 +48,47 @@ type DataSource interface {
 	Nchan() int
 	Signed() []bool
 	VoltsPerArb() []float32
+	VoltsOffset() []float32
+	SetCalibration([]int, []float32, []float32) error
 	ComputeFullTriggerState() []FullTriggerState
 	ComputeWritingState() WritingState
+	ComputeWritingStats() []ChannelWritingStats
 	ChannelNames() []string
 	ConfigurePulseLengths(int, int) error
-	ConfigureProjectorsBases(int, mat.Dense, mat.Dense, string) error
+	ConfigurePulseDurations(float64, float64) (int, int, error)
+	ConfigureProjectorsBases(int, mat.Dense, mat.Dense, string, mat.Dense) error
 	ChangeTriggerState(*FullTriggerState) error
+	ChangeTriggerStates([]FullTriggerState) (map[int]string, error)
+	ManualTrigger([]int) error
+	ConfigureDriftCorrection(*DriftCorrectionConfig) error
+	ConfigureEnergyCalibration(*EnergyCalibrationConfig) error
+	ConfigurePublishFilter(*PublishFilterConfig) error
+	ResetDriftReference([]int) error
+	EnableChannels([]int, bool) error
+	DisabledChannels() []int
+	ApplyDeadChannels() []int
+	ConfigureRecordVeto(*RecordVetoConfig) error
+	ComputeVetoCounts() []int
+	ComputeDeadTime() DeadTimeMessage
+	ConfigurePileupFlag(*PileupFlagConfig) error
+	ConfigureTriggerStorm(*TriggerStormConfig) error
+	ConfigureDeadChannelDetection(*DeadChannelDetectConfig) error
+	BeginStimulus(*StimulusConfig, time.Time) (*StimulusWindow, error)
+	StaggerAutoTriggers(bool)
+	ConfigureTriggerFilter(*TriggerFilterConfig) error
+	AutoSetTriggerLevels(*AutoTriggerLevelConfig) error
+	PreviewTriggers(*TriggerPreviewConfig) (*TriggerPreview, error)
+	RawSnapshot(*RawSnapshotConfig) (*RawSnapshotInfo, error)
 	ConfigureMixFraction(*MixFractionObject) ([]float64, error)
 	WriteControl(*WriteControlConfig) error
 	SetCoupling(CouplingStatus) error
+	ConfigureGroupTrigger(*GroupTriggerConfig) error
+	CoupleTDMLine(*TDMLineCoupling, bool) (*GroupTriggerConfig, error)
 	SetExperimentStateLabel(time.Time, string) error
 	ChannelsWithProjectors() []int
+	ReportProjectorsBasis(int) (*ProjectorsBasisObject, error)
+	SaveProjectors() error
+	ProjectorsRestored() []int
 	ProcessSegments(*dataBlock) error
 	RunDoneActivate()
 	RunDoneDeactivate()
@@ -75,6 +108,15 @@ func (ds *AnySource) RunDoneActivate() {
 func (ds *AnySource) RunDoneDeactivate() {
 	ds.sourceStateLock.Lock()
 	ds.sourceState = Inactive
+	ds.closeCapture()
+	detectedDeadChannels.set(nil)
+	for _, dsp := range ds.processors {
+		dsp.DataPublisher.stopWriteQueue()
+	}
+	if ds.pool != nil {
+		ds.pool.Stop()
+		ds.pool = nil
+	}
 	ds.runDone.Done()
 	ds.sourceStateLock.Unlock()
 }
@@ -151,16 +193,16 @@ func CoreLoop(ds DataSource, queuedRequests chan func()) {
 		case block, ok := <-nextBlock:
 			if !ok {
 				// nextBlock was closed in the data production loop when abortSelf was closed
-				log.Println("nextBlock channel was closed; stopping the source normally")
+				logInfof("nextBlock channel was closed; stopping the source normally")
 				return
 
 			} else if block.err != nil {
 				// errors in block indicate a problem with source: need to close down
-				log.Printf("nextBlock receives Error; stopping source: %s\n", block.err.Error())
+				logErrorf("nextBlock receives Error; stopping source: %v", block.err)
 				return
 			}
 			if err := ds.ProcessSegments(block); err != nil {
-				log.Printf("AnySource.ProcessSegments returns Error; stopping source: %s\n", err.Error())
+				logErrorf("AnySource.ProcessSegments returns Error; stopping source: %v", err)
 				panic("panic stops source when processSegments fails")
 			}
 			// In some sources, ds.getNextBlock has to be called again to initiate the next
@@ -179,7 +221,7 @@ func (ds *AnySource) Stop() error {
 		return fmt.Errorf("AnySource not active, cannot stop")
 
 	case Starting:
-		fmt.Println("deleteme: called Stop on a Starting source; how to handle this??")
+		logWarningf("called Stop on a Starting source; how to handle this??")
 
 	case Active:
 		// This is the normal case: Stop on an Active source
@@ -200,7 +242,7 @@ func (ds *AnySource) Stop() error {
 func closeIfOpen(c chan struct{}) {
 	select {
 	case <-c:
-		log.Println("warning: you tried to close a channel twice, but Dastard outsmarted you")
+		logWarningf("you tried to close a channel twice, but Dastard outsmarted you")
 	default:
 		close(c)
 	}
@@ -234,6 +276,8 @@ type dataBlock struct {
 	segments                 []DataSegment
 	externalTriggerRowcounts []int64
 	nSamp                    int
+	hardwareTime             time.Duration // source's timestamp of the first frame, if hasHardwareTime
+	hasHardwareTime          bool          // set by sources whose packets carry hardware timestamps
 	err                      error
 }
 
@@ -244,14 +288,23 @@ type AnySource struct {
 	name         string        // what kind of source is this?
 	chanNames    []string      // one name per channel
 	chanNumbers  []int         // names have format "prefixNumber", this is the number
+	naming       ChannelNaming // how Sample() names the channels
+	sourceConfig interface{}   // a copy of the last successful Configure argument
 	rowColCodes  []RowColCode  // one RowColCode per channel
 	signed       []bool        // is the raw data signed, one per channel
 	voltsPerArb  []float32     // the physical units per arb, one per channel
+	voltsOffset  []float32     // the physical value of raw 0, one per channel
 	sampleRate   float64       // samples per second
 	samplePeriod time.Duration // time per sample
 	lastread     time.Time
-	nextFrameNum FrameIndex // frame number for the next frame we will receive
+	nextFrameNum FrameIndex         // frame number for the next frame we will receive
+	frameSync    frameSynchronizer  // keeps frame numbers continuous across segments
+	gapConfig    GapConfig          // what to do with frames missing from the data
+	stormConfig  TriggerStormConfig // the trigger storm breaker of each channel when the source starts
+	cpuConfig    CPUConfig          // where the reader and worker threads run
+	clock        clockModel         // maps hardware time or frame numbers onto the system clock
 	processors   []*DataStreamProcessor
+	pool         *processPool    // workers that share the per-channel processing
 	abortSelf    chan struct{}   // Signal to the core loop of active sources to stop
 	nextBlock    chan *dataBlock // Signal from the core loop that a block is ready to process
 	broker       *TriggerBroker
@@ -261,10 +314,20 @@ type AnySource struct {
 	heartbeats          chan Heartbeat
 	writingState        WritingState
 	numberWrittenTicker *time.Ticker
+	writeStatsTicker    *time.Ticker
+	vetoCountsTicker    *time.Ticker
+	deadTimeTicker      *time.Ticker
+	clockSyncTicker     *time.Ticker
 	sourceState         SourceState
 	sourceStateLock     sync.Mutex // guards sourceState
 	runDone             sync.WaitGroup
 	readCounter         int
+	mixFractions        []float64      // latest mix fractions, for sources that mix
+	mixLock             sync.Mutex     // guards mixFractions
+	capture             *captureWriter // raw data blocks are saved here, if non-nil
+	projectorsRestored  []int          // channels whose saved projectors PrepareRun reloaded
+	stimulus            *stimulusState // the stimulus window in progress, if any
+	watchdogSince       time.Time      // when the client watchdog began to watch the writing, or zero
 }
 
 // getPulseLengths returns (NPresamples, NSamples, err)
@@ -283,38 +346,76 @@ func (ds *AnySource) getPulseLengths() (int, int, error) {
 }
 
 // ProcessSegments processes a single outstanding segment for each of ds.processors
-// Returns when all segments have been processed
-// It's a more synchronous version of each dsp launching its own goroutine
+// Returns when all segments have been processed.
+// The work is shared by the fixed-size ds.pool of workers in two passes: first, all
+// channels find their primary triggers; second, all channels receive their secondary
+// triggers from the broker, then analyze and publish. The broker needs primaries from
+// every channel before it can answer any one, so the passes cannot be combined.
 func (ds *AnySource) ProcessSegments(block *dataBlock) error {
-	var wg sync.WaitGroup
-	for i, dsp := range ds.processors {
-		segment := block.segments[i]
-		wg.Add(1)
-		go func(dsp *DataStreamProcessor) {
-			defer wg.Done()
-			dsp.processSegment(&segment)
-		}(dsp)
-	}
-	wg.Wait()
-	tStart := time.Now()
-	for i, dsp := range ds.processors {
-		if (i+ds.readCounter)%20 == 0 { // flush each dsp once per 20 reads, but not all at once
-			dsp.Flush()
+	if ds.pool == nil {
+		ds.pool = newProcessPool(viper.GetInt("processworkers"), ds.cpuConfig.Workers)
+	}
+	ds.writeCapture(block)
+	ds.resynchronize(block)
+	ds.applyClockModel(block)
+	records := make([][]*DataRecord, len(ds.processors))
+	ds.pool.run(len(ds.processors), func(i int) {
+		if ds.processors[i].disabled {
+			ds.processors[i].skipSegmentPrimary(&block.segments[i])
+			return
+		}
+		records[i] = ds.processors[i].processSegmentPrimary(&block.segments[i])
+	})
+	ds.pool.run(len(ds.processors), func(i int) {
+		if ds.processors[i].disabled {
+			ds.processors[i].skipSegmentSecondary()
+			return
 		}
+		ds.processors[i].processSegmentSecondary(records[i])
+		block.segments[i].processed = true
+	})
+	levelsChanged := ds.reportTriggerStorms()
+	ds.reportDeadChannels()
+	ds.reportWriteFailures()
+	ds.finishStimulus()
+	for _, dsp := range ds.processors {
+		if dsp.autoLevelDone {
+			dsp.autoLevelDone = false
+			levelsChanged = true
+		}
+	}
+	if levelsChanged {
+		clientMessageChan <- ClientUpdate{"TRIGGER", ds.ComputeFullTriggerState()}
 	}
+	tStart := time.Now()
+	ds.flushFiles(tStart)
 	ds.readCounter++
 	flushDuration := time.Now().Sub(tStart)
 	if flushDuration > 50*time.Millisecond {
-		log.Println("flushDuration", flushDuration)
+		logDebugf("flushDuration %v", flushDuration)
 	}
 	numberWritten := make([]int, ds.nchan)
 	for i, dsp := range ds.processors {
-		numberWritten[i] = dsp.numberWritten
+		numberWritten[i] = dsp.countWritten()
 	}
+	ds.checkClientWatchdog(time.Now())
 	err := ds.HandleExternalTriggers(block.externalTriggerRowcounts)
 	if err != nil {
 		return err
 	}
+	select {
+	case <-ds.vetoCountsTicker.C:
+		if ds.anyVetoEnabled() {
+			clientMessageChan <- ClientUpdate{tag: "VETOCOUNTS",
+				state: struct{ VetoCounts []int }{VetoCounts: ds.ComputeVetoCounts()}}
+		}
+	default:
+	}
+	select {
+	case <-ds.deadTimeTicker.C:
+		clientMessageChan <- ClientUpdate{tag: "DEADTIME", state: ds.ComputeDeadTime()}
+	default:
+	}
 	if ds.writingState.Active && !ds.writingState.Paused {
 		select {
 		case <-ds.numberWrittenTicker.C:
@@ -322,6 +423,19 @@ func (ds *AnySource) ProcessSegments(block *dataBlock) error {
 				state: struct{ NumberWritten []int }{NumberWritten: numberWritten}} // only exported fields are serialized
 		default:
 		}
+		select {
+		case <-ds.writeStatsTicker.C:
+			clientMessageChan <- ClientUpdate{tag: "WRITESTATS", state: ds.ComputeWritingStats()}
+		default:
+		}
+		select {
+		case <-ds.clockSyncTicker.C:
+			ds.recordClockSync()
+			if err := ds.writingState.writeMetadata(); err != nil {
+				logWarningf("Could not update metadata file %s: %v", ds.writingState.MetadataFilename, err)
+			}
+		default:
+		}
 	}
 	return nil
 }
@@ -348,9 +462,23 @@ func (ds *AnySource) SetExperimentStateLabel(timestamp time.Time, stateLabel str
 	if err != nil {
 		return err
 	}
+	if stateLabel != "STOP" {
+		ds.requestStateTriggers()
+	}
 	return nil
 }
 
+// requestStateTriggers asks each channel with the StateTrigger option for one record at
+// the next frame to be processed, the frame of an experiment state transition.
+func (ds *AnySource) requestStateTriggers() {
+	frame := ds.frameSync.nextFrame
+	for _, dsp := range ds.processors {
+		if dsp.StateTrigger {
+			dsp.stateTriggerFrames = append(dsp.stateTriggerFrames, frame)
+		}
+	}
+}
+
 //HandleExternalTriggers writes external trigger to a file, creates that file if neccesary, and sends out messages
 //with the number of external triggers observed
 func (ds *AnySource) HandleExternalTriggers(externalTriggerRowcounts []int64) error {
@@ -395,43 +523,61 @@ func (ds *AnySource) HandleExternalTriggers(externalTriggerRowcounts []int64) er
 	return nil
 }
 
-// makeDirectory creates directory of the form basepath/20060102/000 where
-// the 3-digit subdirectory counts separate file-writing occasions.
-// It also returns the formatting code for use in an Sprintf call
-// basepath/20060102/000/20060102_run000_%s.%s and an error, if any.
+// makeDirectory creates the next run directory in basepath, named as set by RPC
+// SetWritingPath, by default basepath/20060102/0000 where the 4-digit subdirectory
+// counts separate file-writing occasions. It also returns the formatting code for use
+// in an Sprintf call basepath/20060102/0000/20060102_run0000_%s.%s and an error, if any.
+// With run coordination on, the run number is shared with the other coordinated instances.
 func makeDirectory(basepath string) (string, error) {
-	if len(basepath) == 0 {
-		return "", fmt.Errorf("BasePath is the empty string")
-	}
-	today := time.Now().Format("20060102")
-	todayDir := fmt.Sprintf("%s/%s", basepath, today)
-	if err := os.MkdirAll(todayDir, 0755); err != nil {
-		return "", err
-	}
-	for i := 0; i < 10000; i++ {
-		thisDir := fmt.Sprintf("%s/%4.4d", todayDir, i)
-		_, err := os.Stat(thisDir)
-		if os.IsNotExist(err) {
-			if err2 := os.MkdirAll(thisDir, 0755); err2 != nil {
-				return "", err
-			}
-			return fmt.Sprintf("%s/%s_run%4.4d_%%s.%%s", thisDir, today, i), nil
-		}
+	wpc := writingPaths.get()
+	if wpc.Coordination.Enabled {
+		return wpc.Coordination.makeDirectory(&wpc.Naming, basepath, time.Now())
 	}
-	return "", fmt.Errorf("out of 4-digit ID numbers for today in %s", todayDir)
+	return wpc.Naming.makeDirectory(basepath, time.Now())
 }
 
 // WriteControl changes the data writing start/stop/pause/unpause state
 // For WriteLJH22 == true and/or WriteLJH3 == true all channels will have writing enabled
 // For WriteOFF == true, only chanels with projectors set will have writing enabled
+// If config.ChannelIndices is not empty, only those channels will have writing enabled
+// A malformed request returns a *WriteRequestError, and a request not allowed in the
+// current writing mode (see writingTransitions) a *WriteTransitionError.
 func (ds *AnySource) WriteControl(config *WriteControlConfig) error {
-	request := strings.ToUpper(config.Request)
-	var filenamePattern, path string
+	req, err := parseWriteControlRequest(config.Request)
+	if err != nil {
+		return err
+	}
+	nextMode, err := ds.writingState.nextWritingMode(req)
+	if err != nil {
+		return err
+	}
+	var filenamePattern, path, queuePolicy string
+	var patterns []string // the run's filename pattern on each output disk
+	var disks []int       // the output disk of each channel
+	queueLength := viper.GetInt("writequeuelength")
+	writeChannel := make([]bool, len(ds.processors))
 
 	// first check for possible errors, then take the lock and do the work
-	if strings.HasPrefix(request, "START") {
-		if !(config.WriteLJH22 || config.WriteOFF || config.WriteLJH3) {
-			return fmt.Errorf("WriteLJH22 and WriteOFF and WriteLJH3 all false")
+	switch req.command {
+	case writeStart:
+		if !(config.WriteLJH22 || config.WriteOFF || config.WriteLJH3 || config.WriteCapture) {
+			return fmt.Errorf("WriteLJH22 and WriteOFF and WriteLJH3 and WriteCapture all false")
+		}
+		if config.BufferKB < 0 || config.BufferKB > maxWriteBufferKB || config.FlushIntervalMs < 0 || config.SyncIntervalMs < 0 {
+			return fmt.Errorf("BufferKB=%d, FlushIntervalMs=%d, SyncIntervalMs=%d, need BufferKB in [0,%d] and intervals >= 0",
+				config.BufferKB, config.FlushIntervalMs, config.SyncIntervalMs, maxWriteBufferKB)
+		}
+		if config.WriteOFF && config.OFFModelVersions > maxOFFModelVersions {
+			return fmt.Errorf("OFFModelVersions=%d, need at most %d", config.OFFModelVersions, maxOFFModelVersions)
+		}
+		for i := range writeChannel {
+			writeChannel[i] = len(config.ChannelIndices) == 0
+		}
+		for _, channelIndex := range config.ChannelIndices {
+			if channelIndex < 0 || channelIndex >= len(ds.processors) {
+				return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, len(ds.processors))
+			}
+			writeChannel[channelIndex] = true
 		}
 
 		for _, dsp := range ds.processors {
@@ -441,22 +587,47 @@ func (ds *AnySource) WriteControl(config *WriteControlConfig) error {
 					dsp.DataPublisher.HasLJH22(), dsp.DataPublisher.HasOFF(), dsp.DataPublisher.HasLJH3())
 			}
 		}
+		if ds.capture != nil {
+			return fmt.Errorf("Writing already in progress, stop writing before starting again. Currently: capture file %s",
+				ds.capture.Filename)
+		}
+
+		if queueLength > 0 {
+			var err error
+			if queuePolicy, err = validateWriteQueuePolicy(viper.GetString("writequeuepolicy")); err != nil {
+				return err
+			}
+		}
+		var err error
+		if disks, err = channelDisks(config.DiskAssignment, config.ChannelDisks, 1+len(config.ExtraPaths),
+			len(ds.processors), ds.rowColCodes); err != nil {
+			return err
+		}
+		if err = validateMoverAddress(config.MoverAddress, config.ExtraPaths); err != nil {
+			return err
+		}
 
 		path = ds.writingState.BasePath
+		if basePath := writingPaths.get().BasePath; len(basePath) > 0 {
+			path = basePath
+		}
 		if len(config.Path) > 0 {
 			path = config.Path
 		}
-		var err error
 		filenamePattern, err = makeDirectory(path)
 		if err != nil {
 			return fmt.Errorf("Could not make directory: %s", err.Error())
 		}
+		if patterns, err = diskPatterns(filenamePattern, path, config.ExtraPaths); err != nil {
+			os.Remove(filepath.Dir(filenamePattern)) // the run directory is still empty
+			return err
+		}
 		if config.WriteOFF {
 			// throw an error if no channels have projectors set
 			// only channels with projectors set will have OFF files enabled
 			anyProjectorsSet := false
-			for _, dsp := range ds.processors {
-				if !(dsp.projectors.IsZero() || dsp.basis.IsZero()) {
+			for i, dsp := range ds.processors {
+				if writeChannel[i] && !(dsp.projectors.IsZero() || dsp.basis.IsZero()) {
 					anyProjectorsSet = true
 					break
 				}
@@ -465,72 +636,51 @@ func (ds *AnySource) WriteControl(config *WriteControlConfig) error {
 				return fmt.Errorf("no projectors are loaded, OFF files require projectors")
 			}
 		}
-	} else if strings.HasPrefix(request, "UNPAUSE") && len(config.Request) > 7 {
-		// validate format of command "UNPAUSE label"
-		if config.Request[7:8] != " " || len(config.Request) == 8 {
-			return fmt.Errorf("request format invalid. got::\n%v\nwant someting like: \"UNPAUSE label\"", config.Request)
-		}
-		if len(config.Request) > 7 { // "UNPAUSE label" format already validated
-			stateLabel := config.Request[8:]
-			if err := ds.SetExperimentStateLabel(time.Now(), stateLabel); err != nil {
+	case writeUnpause:
+		if req.label != "" {
+			if err := ds.SetExperimentStateLabel(time.Now(), req.label); err != nil {
 				return err
 			}
 		}
 	}
-	if !(strings.HasPrefix(request, "START") || strings.HasPrefix(request, "STOP") ||
-		strings.HasPrefix(request, "PAUSE") || strings.HasPrefix(request, "UNPAUSE")) {
-		return fmt.Errorf("WriteControl config.Request=%q, need one of (START,STOP,PAUSE,UNPAUSE). Not case sensitive. \"UNPAUSE label\" is also ok",
-			config.Request)
-	}
 
 	// Hold the lock before doing actual changes
-	if strings.HasPrefix(request, "PAUSE") {
+	switch req.command {
+	case writePause:
+		if err := ds.markPause("PAUSE"); err != nil {
+			logWarningf("Could not record pause in %s: %v", ds.writingState.PausesFilename, err)
+		}
 		for _, dsp := range ds.processors {
 			dsp.DataPublisher.SetPause(true)
 		}
-		ds.writingState.Paused = true
 
-	} else if strings.HasPrefix(request, "UNPAUSE") {
+	case writeUnpause:
+		if err := ds.markPause("UNPAUSE"); err != nil {
+			logWarningf("Could not record pause in %s: %v", ds.writingState.PausesFilename, err)
+		}
 		for _, dsp := range ds.processors {
 			dsp.DataPublisher.SetPause(false)
 		}
 
-		ds.writingState.Paused = false
-
-	} else if strings.HasPrefix(request, "STOP") {
-		for _, dsp := range ds.processors {
-			dsp.DataPublisher.RemoveLJH22()
-			dsp.DataPublisher.RemoveOFF()
-			dsp.DataPublisher.RemoveLJH3()
-		}
-		ds.writingState.Active = false
-		ds.writingState.Paused = false
-		ds.writingState.FilenamePattern = ""
-		ds.SetExperimentStateLabel(time.Now(), "STOP")
-		if ds.writingState.experimentStateFile != nil {
-			if err := ds.writingState.experimentStateFile.Close(); err != nil {
-				return fmt.Errorf("failed to close experimentStatefile, err: %v", err)
-			}
-		}
-		ds.writingState.experimentStateFile = nil
-		ds.writingState.ExperimentStateFilename = ""
-		ds.writingState.ExperimentStateLabel = ""
-		ds.writingState.ExperimentStateLabelUnixNano = 0
-		if ds.writingState.externalTriggerFile != nil {
-			if err := ds.writingState.externalTriggerFileBufferedWriter.Flush(); err != nil {
-				return fmt.Errorf("failed to flush externalTriggerFileBufferedWriter, err: %v", err)
-			}
-			if err := ds.writingState.externalTriggerFile.Close(); err != nil {
-				return fmt.Errorf("failed to close externalTriggerFileWriter, err: %v", err)
-			}
-			ds.writingState.externalTriggerFileBufferedWriter = nil
+	case writeStop:
+		if err := ds.stopWriting(); err != nil {
+			ds.setWritingMode(WritingError, req.command, err)
+			return err
 		}
-		ds.writingState.externalTriggerNumberObserved = 0
-		ds.writingState.ExternalTriggerFilename = ""
 
-	} else if strings.HasPrefix(request, "START") {
+	case writeStart:
+		files, err := ds.startDataMover(config.MoverAddress, path)
+		if err != nil {
+			return ds.abortStart(patterns, err)
+		}
 		channelsWithOff := 0
+		vpa := ds.VoltsPerArb()
+		offset := ds.VoltsOffset()
+		signed := ds.Signed()
 		for i, dsp := range ds.processors {
+			if !writeChannel[i] {
+				continue
+			}
 			timebase := 1.0 / dsp.SampleRate
 			rccode := ds.rowColCodes[i]
 			nrows := rccode.rows()
@@ -541,6 +691,7 @@ func (ds *AnySource) WriteControl(config *WriteControlConfig) error {
 			if dsp.Decimate {
 				fps = dsp.DecimateLevel
 			}
+			filenamePattern := patterns[disks[i]]
 			if config.WriteLJH22 {
 				filename := fmt.Sprintf(filenamePattern, dsp.Name, "ljh")
 				dsp.DataPublisher.SetLJH22(i, dsp.NPresamples, dsp.NSamples, fps,
@@ -552,31 +703,215 @@ func (ds *AnySource) WriteControl(config *WriteControlConfig) error {
 				dsp.DataPublisher.SetOFF(i, dsp.NPresamples, dsp.NSamples, fps,
 					timebase, Build.RunStart, nrows, ncols, ds.nchan, rowNum, colNum, filename,
 					ds.name, ds.chanNames[i], ds.chanNumbers[i], &dsp.projectors, &dsp.basis,
-					dsp.modelDescription)
+					dsp.modelDescription, &dsp.noiseWhitener)
+				dsp.DataPublisher.OFF.SetRawSamplesThreshold(config.OFFRawThreshold)
+				if dsp.DriftCorrect {
+					dsp.DataPublisher.OFF.EnableDriftCorrection()
+				}
+				if dsp.PileupThreshold > 0 {
+					dsp.DataPublisher.OFF.EnableRecordFlags()
+				}
+				if err := dsp.DataPublisher.SetOFFModelVersions(config.OFFModelVersions, dsp.modelVersion); err != nil {
+					return ds.abortStart(patterns, fmt.Errorf("channel %d OFF file cannot reserve room for models: %v", i, err))
+				}
 				channelsWithOff++
 			}
 			if config.WriteLJH3 {
 				filename := fmt.Sprintf(filenamePattern, dsp.Name, "ljh3")
 				dsp.DataPublisher.SetLJH3(i, timebase, nrows, ncols, filename)
+				dsp.DataPublisher.LJH3.Checksums = viper.GetBool("ljh3checksums")
 			}
+			dsp.DataPublisher.SetCalibration(vpa[i], offset[i])
+			dsp.DataPublisher.SetSigned(signed[i])
+			dsp.DataPublisher.SetBufferSize(config.BufferKB * 1024)
+			if files != nil {
+				dsp.DataPublisher.useDataMover(files)
+			}
+			dsp.DataPublisher.startWriteQueue(i, queueLength, queuePolicy)
 		}
-		ds.writingState.Active = true
-		ds.writingState.Paused = false
+		if config.WriteCapture {
+			// The capture file ignores PAUSE, so that replays have no gaps.
+			filename := fmt.Sprintf(filenamePattern, "capture", "dcap")
+			cw, err := newCaptureWriter(filename, ds.captureHeader())
+			if err != nil {
+				logWarningf("Could not create capture file %s: %v", filename, err)
+			} else {
+				ds.capture = cw
+				ds.writingState.CaptureFilename = filename
+			}
+		}
+		ds.writingState.BufferKB = config.BufferKB
+		ds.writingState.FlushIntervalMs = config.FlushIntervalMs
+		ds.writingState.SyncIntervalMs = config.SyncIntervalMs
+		ds.writingState.lastFlush = time.Now()
+		ds.writingState.lastSync = time.Now()
 		ds.writingState.BasePath = path
+		writingPaths.setBasePath(path)
 		ds.writingState.FilenamePattern = filenamePattern
+		ds.writingState.RunDirectory = filepath.Dir(filenamePattern)
+		ds.writingState.DiskPatterns = nil
+		ds.writingState.channelDisks = nil
+		ds.writingState.FailedChannels = nil
+		ds.writingState.WriteFailures = nil
+		if len(patterns) > 1 {
+			ds.writingState.DiskPatterns = patterns
+			ds.writingState.channelDisks = disks
+		}
 		ds.writingState.ExperimentStateFilename = fmt.Sprintf(filenamePattern, "experiment_state", "txt")
 		ds.writingState.ExternalTriggerFilename = fmt.Sprintf(filenamePattern, "external_trigger", "bin")
+		ds.writingState.LogFilename = fmt.Sprintf(filenamePattern, "dastard", "log")
+		if err := dlog.setRunFile(ds.writingState.LogFilename); err != nil {
+			logWarningf("Could not create log file %s: %v", ds.writingState.LogFilename, err)
+			ds.writingState.LogFilename = ""
+		}
+		if err := ds.startRunMetadata(config, filenamePattern); err != nil {
+			logWarningf("Could not write metadata file %s: %v", ds.writingState.MetadataFilename, err)
+		}
+		ds.writingState.ConfigFilename = fmt.Sprintf(filenamePattern, "dastard_config", "yaml")
+		if err := ds.writeRunConfig(ds.writingState.ConfigFilename); err != nil {
+			logWarningf("Could not write config file %s: %v", ds.writingState.ConfigFilename, err)
+			ds.writingState.ConfigFilename = ""
+		}
+		ds.startRunQuality()
+		ds.startRunPauses(filenamePattern)
+		logInfof("Started writing files with pattern %s", filenamePattern)
 		ds.SetExperimentStateLabel(time.Now(), "START")
 	}
+	ds.setWritingMode(nextMode, req.command, nil)
 	return nil
 }
 
+// abortStart undoes a START that failed after its run directories were made: it stops
+// the write queues, removes the writers and the run directories (no record has been
+// written yet), and reports err to clients. It returns err.
+func (ds *AnySource) abortStart(patterns []string, err error) error {
+	for _, dsp := range ds.processors {
+		dsp.DataPublisher.stopWriteQueue()
+		dsp.DataPublisher.RemoveLJH22()
+		dsp.DataPublisher.RemoveOFF()
+		dsp.DataPublisher.RemoveLJH3()
+	}
+	ds.stopDataMover()
+	for _, pattern := range patterns {
+		if rmErr := os.RemoveAll(filepath.Dir(pattern)); rmErr != nil {
+			logWarningf("Could not remove run directory %s: %v", filepath.Dir(pattern), rmErr)
+		}
+	}
+	ds.setWritingMode(WritingIdle, writeStart, err)
+	return err
+}
+
+// stopWriting closes the run's files and clears the run from the writing state. It
+// goes on after an error, so that no file is left open, and returns the first error.
+func (ds *AnySource) stopWriting() error {
+	var firstErr error
+	failed := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := ds.markPause("STOP"); err != nil {
+		logWarningf("Could not record pause in %s: %v", ds.writingState.PausesFilename, err)
+	}
+	recordsWritten := make([]int, len(ds.processors))
+	for i, dsp := range ds.processors {
+		dsp.DataPublisher.stopWriteQueue()
+		recordsWritten[i] = dsp.numberWritten
+	}
+	if err := ds.stopRunQuality(recordsWritten); err != nil {
+		logWarningf("Could not write run summary: %v", err)
+	}
+	for _, dsp := range ds.processors {
+		dsp.DataPublisher.RemoveLJH22()
+		dsp.DataPublisher.RemoveOFF()
+		dsp.DataPublisher.RemoveLJH3()
+	}
+	ds.closeCapture()
+	ds.stopDataMover()
+	ds.writingState.FilenamePattern = ""
+	ds.writingState.RunDirectory = ""
+	ds.writingState.DiskPatterns = nil
+	ds.writingState.channelDisks = nil
+	ds.writingState.FailedChannels = nil
+	ds.writingState.WriteFailures = nil
+	if ds.writingState.experimentStateFile != nil {
+		ds.SetExperimentStateLabel(time.Now(), "STOP")
+		if err := ds.writingState.experimentStateFile.Close(); err != nil {
+			failed(fmt.Errorf("failed to close experimentStatefile, err: %v", err))
+		}
+	}
+	ds.writingState.experimentStateFile = nil
+	ds.writingState.ExperimentStateFilename = ""
+	ds.writingState.ExperimentStateLabel = ""
+	ds.writingState.ExperimentStateLabelUnixNano = 0
+	if ds.writingState.externalTriggerFile != nil {
+		if err := ds.writingState.externalTriggerFileBufferedWriter.Flush(); err != nil {
+			failed(fmt.Errorf("failed to flush externalTriggerFileBufferedWriter, err: %v", err))
+		}
+		if err := ds.writingState.externalTriggerFile.Close(); err != nil {
+			failed(fmt.Errorf("failed to close externalTriggerFileWriter, err: %v", err))
+		}
+		ds.writingState.externalTriggerFileBufferedWriter = nil
+		ds.writingState.externalTriggerFile = nil
+	}
+	ds.writingState.externalTriggerNumberObserved = 0
+	ds.writingState.ExternalTriggerFilename = ""
+	if err := ds.stopRunMetadata(recordsWritten); err != nil {
+		failed(fmt.Errorf("failed to update metadata file, err: %v", err))
+	}
+	logInfof("Stopped writing files")
+	if err := dlog.closeRunFile(); err != nil {
+		failed(fmt.Errorf("failed to close log file, err: %v", err))
+	}
+	ds.writingState.LogFilename = ""
+	ds.writingState.ConfigFilename = ""
+	ds.writingState.PausesFilename = ""
+	return firstErr
+}
+
+// maxWriteBufferKB is the largest allowed WriteControlConfig.BufferKB (64 MB per file).
+const maxWriteBufferKB = 65536
+
+// flushFiles flushes the channels' file buffers: each channel once per 20 reads, but
+// not all at once, or all of them every FlushIntervalMs, if that is set. It also
+// commits the files to stable storage every SyncIntervalMs, if that is set.
+func (ds *AnySource) flushFiles(now time.Time) {
+	ws := &ds.writingState
+	if ws.Active && ws.FlushIntervalMs > 0 {
+		if now.Sub(ws.lastFlush) >= time.Duration(ws.FlushIntervalMs)*time.Millisecond {
+			for _, dsp := range ds.processors {
+				dsp.Flush()
+			}
+			ws.lastFlush = now
+		}
+	} else {
+		for i, dsp := range ds.processors {
+			if (i+ds.readCounter)%20 == 0 {
+				dsp.Flush()
+			}
+		}
+	}
+	if ws.Active && ws.SyncIntervalMs > 0 && now.Sub(ws.lastSync) >= time.Duration(ws.SyncIntervalMs)*time.Millisecond {
+		for _, dsp := range ds.processors {
+			dsp.SyncFiles()
+		}
+		ws.lastSync = now
+	}
+}
+
 // WritingState monitors the state of file writing.
 type WritingState struct {
 	Active                            bool
 	Paused                            bool
+	Mode                              WritingMode // Active and Paused follow it
+	ModeError                         string      // why Mode is WritingError
 	BasePath                          string
 	FilenamePattern                   string
+	RunDirectory                      string   // directory of the current run's files
+	DiskPatterns                      []string // FilenamePattern on each output disk, if the run has several
+	channelDisks                      []int    // index in DiskPatterns of each channel's disk
+	FailedChannels                    []int    // channels whose writing stopped because a file write failed
+	WriteFailures                     []string // the error that stopped writing each of the FailedChannels
 	experimentStateFile               *os.File
 	ExperimentStateFilename           string
 	ExperimentStateLabel              string
@@ -586,6 +921,24 @@ type WritingState struct {
 	externalTriggerFileBufferedWriter *bufio.Writer
 	externalTriggerTicker             *time.Ticker
 	externalTriggerFile               *os.File
+	LogFilename                       string // copy of all log messages while writing
+	MetadataFilename                  string
+	ConfigFilename                    string    // copy of the configuration when writing started
+	CaptureFilename                   string    // raw data blocks for a CaptureReplaySource, if any
+	PausesFilename                    string    // pause intervals of the run (created at the first pause)
+	PauseCount                        int       // times writing was paused during the run
+	PausedSeconds                     float64   // total time paused during the run, not counting any current pause
+	BufferKB                          int       // size of each LJH and OFF file's write buffer (0 means 32 kB)
+	FlushIntervalMs                   int       // if > 0, flush all files this often
+	SyncIntervalMs                    int       // if > 0, commit all files to stable storage this often
+	MoverAddress                      string    // data mover receiver of the LJH and OFF files, if any
+	lastFlush                         time.Time // when files were last flushed, if FlushIntervalMs > 0
+	lastSync                          time.Time // when files were last committed, if SyncIntervalMs > 0
+	metadata                          *RunMetadata
+	dataMover                         *mover.Sender
+	qualityStart                      time.Time // when the run's quality statistics started
+	resyncsBefore                     int       // number of frameSync.events before the run
+	pauses                            []PauseInterval
 }
 
 // ComputeWritingState doesn't need to compute, but just returns the writingState
@@ -593,13 +946,115 @@ func (ds *AnySource) ComputeWritingState() WritingState {
 	return ds.writingState
 }
 
-// ConfigureProjectorsBases calls SetProjectorsBasis on ds.processors[channelIndex]
-func (ds *AnySource) ConfigureProjectorsBases(channelIndex int, projectors mat.Dense, basis mat.Dense, modelDescription string) error {
+// reportWriteFailures adds each channel whose writing stopped since the last call, because
+// a file write failed, to the writing state, and broadcasts the state if any were added.
+func (ds *AnySource) reportWriteFailures() {
+	if !ds.writingState.Active {
+		return
+	}
+	added := false
+	for i, dsp := range ds.processors {
+		err := dsp.DataPublisher.writingFailure()
+		if err == nil {
+			continue
+		}
+		known := false
+		for _, c := range ds.writingState.FailedChannels {
+			known = known || c == i
+		}
+		if !known {
+			ds.writingState.FailedChannels = append(ds.writingState.FailedChannels, i)
+			ds.writingState.WriteFailures = append(ds.writingState.WriteFailures, err.Error())
+			added = true
+		}
+	}
+	if added {
+		clientMessageChan <- ClientUpdate{"WRITING", ds.writingState}
+	}
+}
+
+// ComputeWritingStats returns the writing statistics of each channel.
+func (ds *AnySource) ComputeWritingStats() []ChannelWritingStats {
+	stats := make([]ChannelWritingStats, len(ds.processors))
+	for i, dsp := range ds.processors {
+		stats[i] = dsp.DataPublisher.WritingStats(i)
+	}
+	return stats
+}
+
+// ConfigureProjectorsBases calls SetProjectorsBasis and SetNoiseWhitener on ds.processors[channelIndex].
+// An empty whitener means the channel has no noise whitener.
+func (ds *AnySource) ConfigureProjectorsBases(channelIndex int, projectors mat.Dense, basis mat.Dense,
+	modelDescription string, whitener mat.Dense) error {
 	if channelIndex >= len(ds.processors) || channelIndex < 0 {
 		return fmt.Errorf("channelIndex out of range, channelIndex=%v, len(ds.processors)=%v", channelIndex, len(ds.processors))
 	}
 	dsp := ds.processors[channelIndex]
-	return dsp.SetProjectorsBasis(projectors, basis, modelDescription)
+	if !dsp.DataPublisher.HasOFF() {
+		if err := dsp.SetProjectorsBasis(projectors, basis, modelDescription); err != nil {
+			return err
+		}
+		return dsp.SetNoiseWhitener(whitener)
+	}
+
+	// The channel is writing an OFF file, so its header must also get the new model. If
+	// it can't, the channel keeps the old model, so the records match the file.
+	nbases, _ := projectors.Dims()
+	if err := dsp.DataPublisher.checkOFFModel(nbases); err != nil {
+		return fmt.Errorf("channel %d: %v", channelIndex, err)
+	}
+	oldProjectors, oldBasis, oldWhitener := dsp.projectors, dsp.basis, dsp.noiseWhitener
+	oldDescription, oldVersion := dsp.modelDescription, dsp.modelVersion
+	restore := func() {
+		dsp.projectors, dsp.basis, dsp.noiseWhitener = oldProjectors, oldBasis, oldWhitener
+		dsp.modelDescription, dsp.modelVersion = oldDescription, oldVersion
+	}
+	if err := dsp.SetProjectorsBasis(projectors, basis, modelDescription); err != nil {
+		return err
+	}
+	if err := dsp.SetNoiseWhitener(whitener); err != nil {
+		restore()
+		return err
+	}
+	if err := dsp.DataPublisher.addOFFModel(dsp.modelVersion, &dsp.projectors, &dsp.basis,
+		dsp.modelDescription, &dsp.noiseWhitener); err != nil {
+		restore()
+		return fmt.Errorf("channel %d: %v", channelIndex, err)
+	}
+	return nil
+}
+
+// ReportProjectorsBasis returns the projectors, basis, and noise whitener (if any) loaded
+// in one channel, base64-encoded as for ConfigureProjectorsBasis.
+func (ds *AnySource) ReportProjectorsBasis(channelIndex int) (*ProjectorsBasisObject, error) {
+	if channelIndex >= len(ds.processors) || channelIndex < 0 {
+		return nil, fmt.Errorf("channelIndex out of range, channelIndex=%v, len(ds.processors)=%v", channelIndex, len(ds.processors))
+	}
+	dsp := ds.processors[channelIndex]
+	if !dsp.HasProjectors() {
+		return nil, fmt.Errorf("channel %d has no projectors loaded", channelIndex)
+	}
+	encode := func(m *mat.Dense) (string, error) {
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	}
+	pbo := &ProjectorsBasisObject{ChannelIndex: channelIndex, ModelDescription: dsp.modelDescription}
+	var err error
+	if pbo.ProjectorsBase64, err = encode(&dsp.projectors); err != nil {
+		return nil, err
+	}
+	if pbo.BasisBase64, err = encode(&dsp.basis); err != nil {
+		return nil, err
+	}
+	if !dsp.noiseWhitener.IsZero() {
+		if pbo.WhitenerBase64, err = encode(&dsp.noiseWhitener); err != nil {
+			return nil, err
+		}
+	}
+	return pbo, nil
 }
 
 // ChannelsWithProjectors returns a list of the ChannelIndicies of channels that have projectors loaded
@@ -687,17 +1142,30 @@ func (ds *AnySource) PrepareRun(Npresamples int, Nsamples int) error {
 	ds.setDefaultChannelNames() // should be overwritten in ds.Sample()
 	ds.abortSelf = make(chan struct{})
 	ds.nextBlock = make(chan *dataBlock)
+	ds.frameSync.reset()
+	ds.stimulus = nil
+	ds.gapConfig = loadGapConfig()
+	ds.stormConfig = loadTriggerStormConfig()
+	deadDetectConfig := loadDeadChannelDetectConfig()
+	detectedDeadChannels.set(nil)
+	ds.cpuConfig = loadCPUConfig()
+	ds.clock = clockModel{tau: clockModelTau, maxStep: clockModelMaxStep}
 
 	// Start a TriggerBroker to handle secondary triggering
 	ds.broker = NewTriggerBroker(ds.nchan)
 	go ds.broker.Run()
 
 	ds.numberWrittenTicker = time.NewTicker(1 * time.Second)
+	ds.writeStatsTicker = time.NewTicker(5 * time.Second)
+	ds.vetoCountsTicker = time.NewTicker(2 * time.Second)
+	ds.deadTimeTicker = time.NewTicker(5 * time.Second)
+	ds.clockSyncTicker = time.NewTicker(clockSyncPeriod)
 	ds.writingState.externalTriggerTicker = time.NewTicker(time.Second * 1)
 
 	// Launch goroutines to drain the data produced by this source
 	ds.processors = make([]*DataStreamProcessor, ds.nchan)
 	signed := ds.Signed()
+	ds.applyStoredCalibrations()
 	vpa := ds.VoltsPerArb()
 
 	// Load last trigger state from config file
@@ -727,6 +1195,27 @@ func (ds *AnySource) PrepareRun(Npresamples int, Nsamples int) error {
 		LevelLevel:   4000,
 	}
 
+	// Publish to Kafka only if the config file asks for it.
+	var kafkaConfig KafkaConfig
+	useKafka := false
+	if err := viper.UnmarshalKey("kafka", &kafkaConfig); err == nil && kafkaConfig.Enabled {
+		if err := configureKafkaProducer(kafkaConfig); err != nil {
+			logErrorf("Could not start Kafka publisher: %v", err)
+		} else {
+			useKafka = true
+		}
+	}
+	// Multicast summaries only if the config file asks for it.
+	var multicastConfig MulticastConfig
+	useMulticast := false
+	if err := viper.UnmarshalKey("multicast", &multicastConfig); err == nil && multicastConfig.Enabled {
+		if err := configureMulticastPublisher(multicastConfig); err != nil {
+			logErrorf("Could not start multicast publisher: %v", err)
+		} else {
+			useMulticast = true
+		}
+	}
+
 	for channelIndex := range ds.processors {
 		dsp := NewDataStreamProcessor(channelIndex, ds.broker, Npresamples, Nsamples)
 		dsp.Name = ds.chanNames[channelIndex]
@@ -740,11 +1229,40 @@ func (ds *AnySource) PrepareRun(Npresamples int, Nsamples int) error {
 			ts = &defaultTS
 		}
 		dsp.TriggerState = *ts
+		dsp.ConfigureTriggerStorm(&ds.stormConfig)
+		dsp.ConfigureDeadChannelDetection(&deadDetectConfig)
+		dsp.autoStagger = viper.GetBool("autotriggerstagger")
+		dsp.autoPhase = autoTriggerPhase(channelIndex, ds.nchan)
+		dsp.recentData.seconds = math.Max(viper.GetFloat64("triggerpreviewseconds"),
+			viper.GetFloat64("rawsnapshotseconds"))
+		dsp.undecimatedData.seconds = dsp.recentData.seconds
 
 		// Publish Records and Summaries over ZMQ. Not optional at this time.
 		dsp.SetPubRecords()
 		dsp.SetPubSummaries()
+		if d := viper.GetInt("summarydecimation"); d > 0 && d <= math.MaxUint16 {
+			dsp.thumbDecimation = d
+		}
+		if viper.GetBool("publishenergies") {
+			dsp.SetPubEnergies()
+		}
+		if useKafka {
+			dsp.SetKafka()
+		}
+		if useMulticast {
+			dsp.SetMulticast()
+		}
+	}
+	ds.setRowTimeOffsets(viper.GetBool("subframetiming"))
+	ds.restoreProjectors()
+	if dead := ds.ApplyDeadChannels(); len(dead) > 0 {
+		logInfof("Dead channels %v will never trigger", dead)
 	}
+	// Size of the processing worker pool. Zero (the default) means GOMAXPROCS.
+	if ds.pool != nil {
+		ds.pool.Stop()
+	}
+	ds.pool = newProcessPool(viper.GetInt("processworkers"), ds.cpuConfig.Workers)
 	ds.lastread = time.Now()
 	return nil
 }
@@ -752,27 +1270,27 @@ func (ds *AnySource) PrepareRun(Npresamples int, Nsamples int) error {
 // FullTriggerState used to collect channels that share the same TriggerState
 type FullTriggerState struct {
 	ChannelIndicies []int
+	ChannelGroups   []string // names of channel groups to configure, in addition to ChannelIndicies
 	TriggerState
 }
 
-// ComputeFullTriggerState uses a map to collect channels with identical TriggerStates, so they
-// can be sent all together as one unit.
+// ComputeFullTriggerState collects channels with identical TriggerStates, so they
+// can be sent all together as one unit. (TriggerState holds a slice of Conditions, so
+// it can't be a map key.)
 func (ds *AnySource) ComputeFullTriggerState() []FullTriggerState {
-
-	result := make(map[TriggerState][]int)
+	fts := []FullTriggerState{}
 	for _, dsp := range ds.processors {
-		chans, ok := result[dsp.TriggerState]
-		if ok {
-			result[dsp.TriggerState] = append(chans, dsp.channelIndex)
-		} else {
-			result[dsp.TriggerState] = []int{dsp.channelIndex}
+		found := false
+		for i := range fts {
+			if reflect.DeepEqual(fts[i].TriggerState, dsp.TriggerState) {
+				fts[i].ChannelIndicies = append(fts[i].ChannelIndicies, dsp.channelIndex)
+				found = true
+				break
+			}
+		}
+		if !found {
+			fts = append(fts, FullTriggerState{ChannelIndicies: []int{dsp.channelIndex}, TriggerState: dsp.TriggerState})
 		}
-	}
-
-	// Now "unroll" that map into a vector of FullTriggerState objects
-	fts := []FullTriggerState{}
-	for k, v := range result {
-		fts = append(fts, FullTriggerState{ChannelIndicies: v, TriggerState: k})
 	}
 	return fts
 }
@@ -786,6 +1304,9 @@ func (ds *AnySource) ChangeTriggerState(state *FullTriggerState) error {
 		if channelIndex >= ds.nchan {
 			return fmt.Errorf("channelIndex %v is >= ds.nchan %v", channelIndex, ds.nchan)
 		}
+		if err := ds.processors[channelIndex].validateTriggerConditions(&state.TriggerState); err != nil {
+			return fmt.Errorf("channel %d: %v", channelIndex, err)
+		}
 	}
 	for _, channelIndex := range state.ChannelIndicies {
 		dsp := ds.processors[channelIndex]
@@ -794,29 +1315,370 @@ func (ds *AnySource) ChangeTriggerState(state *FullTriggerState) error {
 	return nil
 }
 
+// ChangeTriggerStates validates every entry of states, then changes the trigger states
+// of all their channels together, or of none if any channel's new state is invalid.
+// It returns a problem description for each invalid channel, keyed by channel index.
+// The error is non-nil if nothing was changed.
+func (ds *AnySource) ChangeTriggerStates(states []FullTriggerState) (map[int]string, error) {
+	problems := make(map[int]string)
+	if len(states) == 0 {
+		return problems, fmt.Errorf("got bulk trigger configuration with no entries")
+	}
+	newStates := make(map[int]TriggerState)
+	for i, state := range states {
+		if len(state.ChannelIndicies) == 0 {
+			return problems, fmt.Errorf("trigger configuration entry %d has no channels", i)
+		}
+		for _, channelIndex := range state.ChannelIndicies {
+			if channelIndex < 0 || channelIndex >= ds.nchan {
+				problems[channelIndex] = fmt.Sprintf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+				continue
+			}
+			if _, ok := newStates[channelIndex]; ok {
+				problems[channelIndex] = fmt.Sprintf("channel %d appears in more than one entry", channelIndex)
+				continue
+			}
+			if err := ds.processors[channelIndex].validateTriggerState(&state.TriggerState); err != nil {
+				problems[channelIndex] = err.Error()
+				continue
+			}
+			newStates[channelIndex] = state.TriggerState
+		}
+	}
+	if len(problems) > 0 {
+		return problems, fmt.Errorf("%d channels have invalid trigger states, so no trigger states were changed",
+			len(problems))
+	}
+	for channelIndex, state := range newStates {
+		ds.processors[channelIndex].ConfigureTrigger(state)
+	}
+	return problems, nil
+}
+
+// AutoSetTriggerLevels starts a measurement of the noise in the given channels (or in
+// all channels, if config.ChannelIndices is empty). When each channel has seen enough
+// data, its trigger levels are set and the new trigger state is broadcast.
+func (ds *AnySource) AutoSetTriggerLevels(config *AutoTriggerLevelConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	if len(config.ChannelIndices) == 0 {
+		for _, dsp := range ds.processors {
+			dsp.StartAutoTriggerLevel(config)
+		}
+		return nil
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].StartAutoTriggerLevel(config)
+	}
+	return nil
+}
+
+// ManualTrigger requests one software-forced trigger at the current frame in each of
+// the given channels, or in all channels if channelIndices is empty.
+func (ds *AnySource) ManualTrigger(channelIndices []int) error {
+	for _, channelIndex := range channelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	if len(channelIndices) == 0 {
+		for _, dsp := range ds.processors {
+			dsp.manualTriggerPending = true
+		}
+		return nil
+	}
+	for _, channelIndex := range channelIndices {
+		ds.processors[channelIndex].manualTriggerPending = true
+	}
+	return nil
+}
+
+// ConfigureDriftCorrection changes the drift tracking state for 1 or more channels.
+func (ds *AnySource) ConfigureDriftCorrection(config *DriftCorrectionConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].ConfigureDriftCorrection(config)
+	}
+	return nil
+}
+
+// ConfigureEnergyCalibration sets the energy calibration curve for 1 or more channels.
+func (ds *AnySource) ConfigureEnergyCalibration(config *EnergyCalibrationConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].ConfigureEnergyCalibration(config)
+	}
+	return nil
+}
+
+// ResetDriftReference resets the drift reference for the given channels, or for
+// all channels if channelIndices is empty.
+func (ds *AnySource) ResetDriftReference(channelIndices []int) error {
+	for _, channelIndex := range channelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	if len(channelIndices) == 0 {
+		for _, dsp := range ds.processors {
+			dsp.ResetDriftReference()
+		}
+		return nil
+	}
+	for _, channelIndex := range channelIndices {
+		ds.processors[channelIndex].ResetDriftReference()
+	}
+	return nil
+}
+
+// EnableChannels enables or disables all processing (triggering, publishing, and
+// writing) of the given channels, while the source keeps running.
+func (ds *AnySource) EnableChannels(channelIndices []int, enable bool) error {
+	for _, channelIndex := range channelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	for _, channelIndex := range channelIndices {
+		ds.processors[channelIndex].setDisabled(!enable)
+	}
+	return nil
+}
+
+// DisabledChannels returns the indices of all channels whose processing is disabled.
+func (ds *AnySource) DisabledChannels() []int {
+	result := make([]int, 0)
+	for i, dsp := range ds.processors {
+		if dsp.disabled {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// ConfigureRecordVeto sets the pretrigger-quality veto cuts for 1 or more channels.
+func (ds *AnySource) ConfigureRecordVeto(config *RecordVetoConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].ConfigureRecordVeto(config)
+	}
+	return nil
+}
+
+// ConfigurePileupFlag sets the residualStdDev threshold that flags records as pileup
+// in 1 or more channels.
+func (ds *AnySource) ConfigurePileupFlag(config *PileupFlagConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].ConfigurePileupFlag(config)
+	}
+	return nil
+}
+
+// ConfigureTriggerFilter sets (or turns off) the filter applied to the trigger samples
+// of 1 or more channels. No channel changes unless the filter suits all of them.
+func (ds *AnySource) ConfigureTriggerFilter(config *TriggerFilterConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	kernel := config.kernel()
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+		if post := ds.processors[channelIndex].NSamples - ds.processors[channelIndex].NPresamples; len(kernel)/2 > post {
+			return fmt.Errorf("trigger filter of %d samples is too long for channel %d records with %d samples after the trigger",
+				len(kernel), channelIndex, post)
+		}
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if err := ds.processors[channelIndex].ConfigureTriggerFilter(kernel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anyVetoEnabled returns whether any channel has its record veto enabled.
+func (ds *AnySource) anyVetoEnabled() bool {
+	for _, dsp := range ds.processors {
+		if dsp.VetoEnabled {
+			return true
+		}
+	}
+	return false
+}
+
+// ComputeVetoCounts returns the number of records vetoed in each channel.
+func (ds *AnySource) ComputeVetoCounts() []int {
+	counts := make([]int, len(ds.processors))
+	for i, dsp := range ds.processors {
+		counts[i] = dsp.vetoCount
+	}
+	return counts
+}
+
 // ChannelNames returns a slice of the channel names
 func (ds *AnySource) ChannelNames() []string {
 	return ds.chanNames
 }
 
-// ConfigurePulseLengths set the pulse record length and pre-samples.
+// ConfigurePulseLengths set the pulse record length and pre-samples. No channel changes
+// unless all can take the new lengths. Call it only between segments (from the core
+// loop), so that all channels change at the same segment boundary.
 func (ds *AnySource) ConfigurePulseLengths(nsamp, npre int) error {
-	if npre < 3 || // edgeTrigger looks at npre-3
-		nsamp < 1 || // require at least 1 sample
-		nsamp < npre+1 { // require at least one post trigger sample
+	if !validPulseLengths(nsamp, npre) {
 		return fmt.Errorf("ConfigurePulseLengths nsamp %v, npre %v are invalid", nsamp, npre)
 	}
+	for i, dsp := range ds.processors {
+		if err := dsp.checkPulseLengths(nsamp, npre); err != nil {
+			return fmt.Errorf("ConfigurePulseLengths channel %d: %v", i, err)
+		}
+	}
 	for _, dsp := range ds.processors {
 		dsp.ConfigurePulseLengths(nsamp, npre)
 	}
 	return nil
 }
 
+// ConfigurePulseDurations sets the pulse record length and pre-trigger length as
+// durations (in ms). Each channel converts them to samples at its own sample rate,
+// after any decimation. No channel changes unless all have valid lengths. It returns
+// the lengths in samples of the first channel.
+func (ds *AnySource) ConfigurePulseDurations(nsampMs, npreMs float64) (int, int, error) {
+	if len(ds.processors) == 0 {
+		return 0, 0, fmt.Errorf("ConfigurePulseDurations: no channels")
+	}
+	nsamp := make([]int, len(ds.processors))
+	npre := make([]int, len(ds.processors))
+	for i, dsp := range ds.processors {
+		nsamp[i] = dsp.samplesIn(nsampMs)
+		npre[i] = dsp.samplesIn(npreMs)
+		if err := dsp.checkPulseLengths(nsamp[i], npre[i]); err != nil {
+			return 0, 0, fmt.Errorf("ConfigurePulseDurations %v ms (%v ms pre) for channel %d sampled at %v Hz: %v",
+				nsampMs, npreMs, i, dsp.decimatedSampleRate(), err)
+		}
+	}
+	for i, dsp := range ds.processors {
+		dsp.ConfigurePulseLengths(nsamp[i], npre[i])
+	}
+	return nsamp[0], npre[0], nil
+}
+
+// validPulseLengths returns whether records of nsamp samples, npre of them before the
+// trigger, are allowed.
+func validPulseLengths(nsamp, npre int) bool {
+	return npre >= 3 && // edgeTrigger looks at npre-3
+		nsamp >= 1 && // require at least 1 sample
+		nsamp >= npre+1 // require at least one post trigger sample
+}
+
 // SetCoupling is not allowed for generic data sources
 func (ds *AnySource) SetCoupling(status CouplingStatus) error {
 	return fmt.Errorf("Generic data sources do not support FB/error coupling")
 }
 
+// ConfigureGroupTrigger adds or removes group trigger connections from each source
+// channel to each receiver channel. No connection changes unless all are valid.
+func (ds *AnySource) ConfigureGroupTrigger(config *GroupTriggerConfig) error {
+	if ds.broker == nil {
+		return fmt.Errorf("no group trigger broker exists")
+	}
+	if len(config.Sources) == 0 || len(config.Receivers) == 0 {
+		return fmt.Errorf("GroupTriggerConfig needs at least one source and one receiver")
+	}
+	if config.Offset < -maxGroupTriggerOffset || config.Offset > maxGroupTriggerOffset {
+		return fmt.Errorf("group trigger offset %d frames is too large (maximum size %d)",
+			config.Offset, maxGroupTriggerOffset)
+	}
+	for _, channels := range [][]int{config.Sources, config.Receivers} {
+		for _, channelIndex := range channels {
+			if channelIndex < 0 || channelIndex >= ds.nchan {
+				return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+			}
+		}
+	}
+	for _, source := range config.Sources {
+		for _, receiver := range config.Receivers {
+			if source == receiver {
+				continue
+			}
+			var err error
+			if config.Disconnect {
+				err = ds.broker.DeleteConnection(source, receiver)
+			} else {
+				err = ds.broker.AddConnectionWithOffset(source, receiver, config.Offset)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CoupleTDMLine adds or removes group trigger connections among all channels that share
+// one TDM column (if column) or row, as found in the source's RowColCodes. It returns the
+// GroupTriggerConfig it applied.
+func (ds *AnySource) CoupleTDMLine(config *TDMLineCoupling, column bool) (*GroupTriggerConfig, error) {
+	line := "row"
+	if column {
+		line = "column"
+	}
+	if len(ds.rowColCodes) != ds.nchan {
+		return nil, fmt.Errorf("this source has no row and column codes for its channels")
+	}
+	channels := make([]int, 0)
+	for channelIndex, code := range ds.rowColCodes {
+		if (column && code.col() == config.Index) || (!column && code.row() == config.Index) {
+			channels = append(channels, channelIndex)
+		}
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("no channel is in %s %d", line, config.Index)
+	}
+	gtc := &GroupTriggerConfig{Sources: channels, Receivers: channels, Offset: config.Offset,
+		Disconnect: config.Disconnect}
+	if err := ds.ConfigureGroupTrigger(gtc); err != nil {
+		return nil, err
+	}
+	return gtc, nil
+}
+
 // DataSegment is a continuous, single-channel raw data buffer, plus info about (e.g.)
 // raw-physical units, first sample’s frame number and sample time. Not yet triggered.
 type DataSegment struct {
@@ -828,6 +1690,9 @@ type DataSegment struct {
 	framePeriod     time.Duration
 	voltsPerArb     float32
 	processed       bool
+	triggerData     []RawType // if not nil, edge and level triggers are found here instead of in rawData
+	triggerSigned   bool      // are the triggerData signed?
+	filteredData    []RawType // if not nil, the trigger samples after the trigger filter (streams only)
 	// facts about the data source?
 }
 
@@ -839,6 +1704,26 @@ func NewDataSegment(data []RawType, framesPerSample int, firstFrame FrameIndex,
 	return &seg
 }
 
+// triggerSamples returns the samples in which to look for edge and level triggers, and
+// whether they are signed: the filteredData if there are any, otherwise the
+// unfilteredTriggerSamples.
+func (seg *DataSegment) triggerSamples() ([]RawType, bool) {
+	samples, signed := seg.unfilteredTriggerSamples()
+	if seg.filteredData != nil {
+		return seg.filteredData, signed
+	}
+	return samples, signed
+}
+
+// unfilteredTriggerSamples returns the samples that the trigger filter (if any) filters,
+// and whether they are signed: the triggerData if there are any, otherwise the rawData.
+func (seg *DataSegment) unfilteredTriggerSamples() ([]RawType, bool) {
+	if seg.triggerData != nil {
+		return seg.triggerData, seg.triggerSigned
+	}
+	return seg.rawData, seg.signed
+}
+
 // TimeOf returns the absolute time of sample # sampleNum within the segment.
 func (seg *DataSegment) TimeOf(sampleNum int) time.Time {
 	return seg.firstTime.Add(time.Duration(sampleNum*seg.framesPerSample) * seg.framePeriod)
@@ -847,19 +1732,56 @@ func (seg *DataSegment) TimeOf(sampleNum int) time.Time {
 // DataStream models a continuous stream of data, though we have only a finite
 // amount at any time. For now, it's semantically different from a DataSegment,
 // yet they need the same information.
+//
+// The rawData are a window into a preallocated buffer. Appending fills the buffer after
+// the window. Trimming copies the kept samples to the start of the buffer, or, if records
+// still refer to the samples, moves the start of the window instead. A new buffer is
+// allocated only when the window reaches the end of the buffer while records refer to
+// it, not for every segment.
 type DataStream struct {
 	DataSegment
 	samplesSeen int
+	shared      bool // records refer to samples in rawData, so they must not be overwritten
+	capacity    int  // the size of the buffer that holds rawData
 }
 
 // NewDataStream generates a pointer to a new, initialized DataStream object.
 func NewDataStream(data []RawType, framesPerSample int, firstFrame FrameIndex,
 	firstTime time.Time, period time.Duration) *DataStream {
 	seg := NewDataSegment(data, framesPerSample, firstFrame, firstTime, period)
-	ds := DataStream{DataSegment: *seg, samplesSeen: len(data)}
+	ds := DataStream{DataSegment: *seg, samplesSeen: len(data), capacity: cap(data)}
 	return &ds
 }
 
+// reserve makes the stream's buffer hold at least n samples.
+func (stream *DataStream) reserve(n int) {
+	if n <= stream.capacity {
+		return
+	}
+	buffer := make([]RawType, len(stream.rawData), n)
+	copy(buffer, stream.rawData)
+	stream.rawData = buffer
+	stream.capacity = n
+	stream.shared = false
+}
+
+// appendRaw appends samples to the rawData. If they don't fit after the window, the
+// window moves to a new buffer, big enough that this happens only every few segments.
+func (stream *DataStream) appendRaw(samples []RawType) {
+	if n := len(stream.rawData) + len(samples); n > cap(stream.rawData) {
+		size := stream.capacity
+		if size < 4*n {
+			size = 4 * n
+		}
+		buffer := make([]RawType, len(stream.rawData), size)
+		copy(buffer, stream.rawData)
+		stream.rawData = buffer
+		stream.capacity = size
+		stream.shared = false
+	}
+	stream.rawData = append(stream.rawData, samples...)
+}
+
 // AppendSegment will append the data in segment to the DataStream.
 // It will update the frame/time counters to be consistent with the appended
 // segment, not necessarily with the previous values.
@@ -870,19 +1792,49 @@ func (stream *DataStream) AppendSegment(segment *DataSegment) {
 	stream.framePeriod = segment.framePeriod
 	stream.firstFramenum = segment.firstFramenum - framesNowInStream
 	stream.firstTime = segment.firstTime.Add(-timeNowInStream)
-	stream.rawData = append(stream.rawData, segment.rawData...)
+	if segment.triggerData == nil {
+		stream.triggerData = nil
+	} else {
+		if len(stream.triggerData) != len(stream.rawData) && len(segment.triggerData) > 0 {
+			// The trigger data start now. Pad them with a flat signal, so the start
+			// doesn't look like a trigger.
+			stream.triggerData = stream.triggerData[:0]
+			for range stream.rawData {
+				stream.triggerData = append(stream.triggerData, segment.triggerData[0])
+			}
+		}
+		stream.triggerData = append(stream.triggerData, segment.triggerData...)
+		stream.triggerSigned = segment.triggerSigned
+	}
+	stream.appendRaw(segment.rawData)
 	stream.samplesSeen += len(segment.rawData)
 }
 
 // TrimKeepingN will trim (discard) all but the last N values in the DataStream.
 // Returns the number of values in the stream after trimming (should be <= N).
+// If records refer to the stream's samples, the kept values stay where they are,
+// and the window of rawData starts at them.
 func (stream *DataStream) TrimKeepingN(N int) int {
 	L := len(stream.rawData)
 	if N >= L {
 		return L
 	}
-	copy(stream.rawData[:N], stream.rawData[L-N:L])
-	stream.rawData = stream.rawData[:N]
+	if stream.shared {
+		stream.rawData = stream.rawData[L-N : L]
+	} else {
+		copy(stream.rawData[:N], stream.rawData[L-N:L])
+		stream.rawData = stream.rawData[:N]
+	}
+	if len(stream.triggerData) == L {
+		copy(stream.triggerData[:N], stream.triggerData[L-N:L])
+		stream.triggerData = stream.triggerData[:N]
+	}
+	if len(stream.filteredData) == L {
+		copy(stream.filteredData[:N], stream.filteredData[L-N:L])
+		stream.filteredData = stream.filteredData[:N]
+	} else {
+		stream.filteredData = nil
+	}
 	deltaFrames := (L - N) * stream.framesPerSample
 	stream.firstFramenum += FrameIndex(deltaFrames)
 	stream.firstTime = stream.firstTime.Add(time.Duration(deltaFrames) * stream.framePeriod)
@@ -899,16 +1851,28 @@ type DataRecord struct {
 	presamples   int
 	voltsPerArb  float32 // "volts" or other physical unit per raw unit
 	sampPeriod   float32
-
-	// trigger type?
+	trigType     string // one of the TriggerType* values
+	conditions   uint32 // for TriggerTypeCondition, bit i is set if TriggerState.Conditions[i] fired
 
 	// Analyzed quantities
 	pretrigMean  float64
+	pretrigRMS   float64
+	pretrigSlope float64 // arbs per sample
 	pulseAverage float64
 	pulseRMS     float64
 	peakValue    float64
 
 	// Real time Analysis quantities
-	modelCoefs     []float64
-	residualStdDev float64
+	modelCoefs      []float64
+	residualStdDev  float64
+	driftCorrection float64 // multiply pulse heights by this to correct gain drift
+	filtValue       float64 // drift-corrected pulse height from the model coefficients, or NaN without projectors
+	energy          float64 // calibrated energy, or NaN if not calibrated
+	pileup          bool    // residualStdDev exceeds the channel's PileupThreshold
+	modelVersion    int     // the channel's model (see DataStreamProcessor.modelVersion) that made modelCoefs
+
+	// Publication sequence numbers, per channel, and options (see DataPublisher.PublishData)
+	recordSeq       uint64
+	summarySeq      uint64
+	thumbDecimation int // if >0, the summary carries every thumbDecimation'th sample of data
 }
@@ -3,8 +3,11 @@ package dastard
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"gonum.org/v1/gonum/mat"
 )
@@ -80,9 +83,11 @@ func TestWritingFiles(t *testing.T) {
 			t.Errorf("WriteControl request %s failed on a non-writing file: %v", request, err)
 		}
 	}
-	config.Request = "notvalid"
-	if err := ds.WriteControl(config); err == nil {
-		t.Errorf("WriteControl request %s should fail, but didn't", config.Request)
+	for _, request := range []string{"notvalid", "STOPGAP", "Start now", "Pause AQ7", ""} {
+		config.Request = request
+		if _, ok := ds.WriteControl(config).(*WriteRequestError); !ok {
+			t.Errorf("WriteControl request %q should fail with a WriteRequestError", request)
+		}
 	}
 	config.Request = "Start"
 	config.WriteLJH22 = false
@@ -93,6 +98,9 @@ func TestWritingFiles(t *testing.T) {
 	config.Path = "/notvalid/because/permissions"
 	if err := ds.WriteControl(config); err == nil {
 		t.Errorf("WriteControl request Start with nonvalid path should fail, but didn't")
+		config.Request = "Stop"
+		ds.WriteControl(config)
+		config.Request = "Start"
 	}
 
 	config.Path = tmp
@@ -105,6 +113,25 @@ func TestWritingFiles(t *testing.T) {
 			t.Errorf("WriteControl request %s failed on a writing file: %v", request, err)
 		}
 	}
+	// write only a subset of channels
+	config.Request = "Start"
+	config.ChannelIndices = []int{1}
+	if err := ds.WriteControl(config); err != nil {
+		t.Errorf("WriteControl request Start with ChannelIndices failed: %v", err)
+	}
+	if ds.processors[0].DataPublisher.HasLJH22() || !ds.processors[1].DataPublisher.HasLJH22() {
+		t.Error("WriteControl with ChannelIndices=[1] should write channel 1 only")
+	}
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Errorf("WriteControl request Stop failed: %v", err)
+	}
+	config.Request = "Start"
+	config.ChannelIndices = []int{9}
+	if err := ds.WriteControl(config); err == nil {
+		t.Error("WriteControl request Start with channel out of range should fail, but didn't")
+	}
+	config.ChannelIndices = nil
 	// set projectors so that we can use WriterOFF = true
 	config.WriteOFF = true
 	config.Request = "start"
@@ -183,3 +210,280 @@ func TestWritingFiles(t *testing.T) {
 		}
 	}
 }
+
+func TestOFFModelHotSwap(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastardTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds := AnySource{nchan: 2, sampleRate: 100000}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	model := func(nbases int, value float64) (mat.Dense, mat.Dense) {
+		p := make([]float64, nbases*1024)
+		for i := range p {
+			p[i] = value
+		}
+		return *mat.NewDense(nbases, 1024, p), *mat.NewDense(1024, nbases, p)
+	}
+	projectors, basis := model(1, 1)
+	if err := ds.ConfigureProjectorsBases(0, projectors, basis, "first", mat.Dense{}); err != nil {
+		t.Fatal(err)
+	}
+	config := &WriteControlConfig{Request: "Start", Path: tmp, WriteOFF: true, OFFModelVersions: 1}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatal(err)
+	}
+	dsp := ds.processors[0]
+	record := func() *DataRecord {
+		return &DataRecord{data: make([]RawType, 1024), presamples: 256, modelCoefs: []float64{1},
+			modelVersion: dsp.modelVersion}
+	}
+	dsp.DataPublisher.PublishData([]*DataRecord{record()})
+
+	projectors2, basis2 := model(2, 0.5)
+	if err := ds.ConfigureProjectorsBases(0, projectors2, basis2, "wrong size", mat.Dense{}); err == nil {
+		t.Error("ConfigureProjectorsBases should fail for a model with a different number of bases while writing OFF")
+	}
+	projectors2, basis2 = model(1, 0.5)
+	if err := ds.ConfigureProjectorsBases(0, projectors2, basis2, "second", mat.Dense{}); err != nil {
+		t.Errorf("ConfigureProjectorsBases while writing OFF failed: %v", err)
+	}
+	dsp.DataPublisher.PublishData([]*DataRecord{record()})
+	if err := ds.ConfigureProjectorsBases(0, projectors, basis, "third", mat.Dense{}); err == nil {
+		t.Error("ConfigureProjectorsBases should fail when the OFF file has no room for another model")
+	}
+	if dsp.modelDescription != "second" || dsp.projectors.At(0, 0) != 0.5 {
+		t.Errorf("channel has model %q after a failed change, want to keep %q", dsp.modelDescription, "second")
+	}
+	filename := dsp.DataPublisher.OFF.FileName()
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), `"Description": "second"`) ||
+		!strings.Contains(string(contents), `"FileFormatVersion": "0.5.0"`) {
+		t.Error("OFF header does not list the second model")
+	}
+
+	// By default there is room for some models; with OFFModelVersions < 0, for none.
+	for _, nmodels := range []int{0, -1} {
+		config = &WriteControlConfig{Request: "Start", Path: tmp, WriteOFF: true, OFFModelVersions: nmodels}
+		if err := ds.WriteControl(config); err != nil {
+			t.Fatal(err)
+		}
+		err := ds.ConfigureProjectorsBases(0, projectors, basis, "changed", mat.Dense{})
+		if nmodels == 0 && err != nil {
+			t.Errorf("ConfigureProjectorsBases while writing OFF with the default OFFModelVersions failed: %v", err)
+		} else if nmodels < 0 && err == nil {
+			t.Error("ConfigureProjectorsBases should fail while writing OFF with OFFModelVersions < 0")
+		}
+		config.Request = "Stop"
+		if err := ds.WriteControl(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failed START leaves no run directory and no writers behind.
+	runs, _ := filepath.Glob(filepath.Join(tmp, "*", "*"))
+	config = &WriteControlConfig{Request: "Start", Path: tmp, WriteOFF: true, OFFModelVersions: maxOFFModelVersions + 1}
+	if err := ds.WriteControl(config); err == nil {
+		t.Error("WriteControl START should fail with too large an OFFModelVersions")
+	}
+	config = &WriteControlConfig{Request: "Start", Path: tmp, WriteOFF: true, MoverAddress: "localhost:5520"}
+	if err := ds.WriteControl(config); err == nil {
+		t.Error("WriteControl START should fail with a MoverAddress but no MoverKeyFile")
+	}
+	if after, _ := filepath.Glob(filepath.Join(tmp, "*", "*")); len(after) != len(runs) {
+		t.Errorf("failed STARTs left run directories %v, want only %v", after, runs)
+	}
+	if ds.writingState.mode() != WritingIdle || dsp.DataPublisher.HasOFF() {
+		t.Errorf("after failed STARTs writing is %s with OFF=%t, want IDLE without OFF",
+			ds.writingState.mode(), dsp.DataPublisher.HasOFF())
+	}
+}
+
+func TestEnableChannels(t *testing.T) {
+	ds := AnySource{nchan: 3}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(100, 200)
+	defer ds.broker.Stop()
+	if disabled := ds.DisabledChannels(); len(disabled) != 0 {
+		t.Errorf("DisabledChannels()=%v at start, want []", disabled)
+	}
+	if err := ds.EnableChannels([]int{1, 3}, false); err == nil {
+		t.Errorf("EnableChannels should fail with channelIndex out of range")
+	}
+	if err := ds.EnableChannels([]int{1}, false); err != nil {
+		t.Error(err)
+	}
+	if disabled := ds.DisabledChannels(); len(disabled) != 1 || disabled[0] != 1 {
+		t.Errorf("DisabledChannels()=%v, want [1]", disabled)
+	}
+
+	// A manual trigger should fire in the enabled channels only.
+	makeBlock := func(firstFrame FrameIndex) *dataBlock {
+		block := &dataBlock{segments: make([]DataSegment, ds.nchan)}
+		for i := range block.segments {
+			block.segments[i] = *NewDataSegment(make([]RawType, 1000), 1, firstFrame, time.Now(), time.Millisecond)
+		}
+		return block
+	}
+	ds.ManualTrigger([]int{})
+	block := makeBlock(0)
+	if err := ds.ProcessSegments(block); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.pool.Stop()
+	for i, dsp := range ds.processors {
+		enabled := i != 1
+		if block.segments[i].processed != enabled || dsp.manualTriggerPending == enabled {
+			t.Errorf("channel %d processed=%t, manualTriggerPending=%t, want %t, %t", i,
+				block.segments[i].processed, dsp.manualTriggerPending, enabled, !enabled)
+		}
+	}
+	if n := len(ds.processors[1].stream.rawData); n != 0 {
+		t.Errorf("disabled channel stream has %d samples, want 0", n)
+	}
+
+	// Re-enable, and the pending trigger fires.
+	if err := ds.EnableChannels([]int{1}, true); err != nil {
+		t.Error(err)
+	}
+	block = makeBlock(1000)
+	if err := ds.ProcessSegments(block); err != nil {
+		t.Fatal(err)
+	}
+	if !block.segments[1].processed || ds.processors[1].manualTriggerPending {
+		t.Errorf("re-enabled channel was not processed")
+	}
+	if disabled := ds.DisabledChannels(); len(disabled) != 0 {
+		t.Errorf("DisabledChannels()=%v after re-enabling, want []", disabled)
+	}
+}
+
+func TestConfigurePulseDurations(t *testing.T) {
+	ds := AnySource{nchan: 2}
+	ds.processors = make([]*DataStreamProcessor, ds.nchan)
+	for i := range ds.processors {
+		ds.processors[i] = NewDataStreamProcessor(i, nil, 100, 500)
+		ds.processors[i].SampleRate = 10000
+	}
+	ds.processors[1].Decimate = true
+	ds.processors[1].DecimateLevel = 2
+
+	nsamp, npre, err := ds.ConfigurePulseDurations(20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsamp != 200 || npre != 50 {
+		t.Errorf("ConfigurePulseDurations(20 ms, 5 ms) returns %d, %d samples, want 200, 50", nsamp, npre)
+	}
+	if dsp := ds.processors[1]; dsp.NSamples != 100 || dsp.NPresamples != 25 {
+		t.Errorf("decimated channel has %d samples (%d pre), want 100 (25)", dsp.NSamples, dsp.NPresamples)
+	}
+
+	// 0.4 ms before the trigger is 4 samples in channel 0 but too few (2) in channel 1,
+	// so neither channel may change.
+	if _, _, err := ds.ConfigurePulseDurations(20, 0.4); err == nil {
+		t.Error("ConfigurePulseDurations should fail when a channel would have npre < 3")
+	}
+	if ds.processors[0].NPresamples != 50 {
+		t.Errorf("failed ConfigurePulseDurations changed channel 0 to npre=%d", ds.processors[0].NPresamples)
+	}
+	if _, _, err := ds.ConfigurePulseDurations(5, 5); err == nil {
+		t.Error("ConfigurePulseDurations should fail with no post-trigger samples")
+	}
+}
+
+func TestConfigurePulseLengthsAllOrNone(t *testing.T) {
+	ds := AnySource{nchan: 2}
+	ds.processors = make([]*DataStreamProcessor, ds.nchan)
+	for i := range ds.processors {
+		ds.processors[i] = NewDataStreamProcessor(i, nil, 100, 500)
+	}
+	if err := ds.processors[1].ConfigureTriggerFilter(make([]float64, 41)); err != nil {
+		t.Fatal(err)
+	}
+	ds.processors[0].pendingSecondaries = []groupTrigger{{frame: 1000}, {frame: 2000}}
+
+	// Channel 1's trigger filter needs 20 samples after the trigger, so neither channel may change.
+	if err := ds.ConfigurePulseLengths(110, 100); err == nil {
+		t.Error("ConfigurePulseLengths should fail when a channel's trigger filter needs more post-trigger samples")
+	}
+	if dsp := ds.processors[0]; dsp.NSamples != 500 || len(dsp.pendingSecondaries) != 2 {
+		t.Errorf("failed ConfigurePulseLengths changed channel 0 to nsamp=%d, %d pending group triggers",
+			dsp.NSamples, len(dsp.pendingSecondaries))
+	}
+	if err := ds.ConfigurePulseLengths(120, 100); err != nil {
+		t.Fatal(err)
+	}
+	for i, dsp := range ds.processors {
+		if dsp.NSamples != 120 || dsp.NPresamples != 100 {
+			t.Errorf("channel %d has nsamp=%d, npre=%d, want 120, 100", i, dsp.NSamples, dsp.NPresamples)
+		}
+	}
+	if n := len(ds.processors[0].pendingSecondaries); n != 0 {
+		t.Errorf("%d pending group triggers remain after changing record lengths, want 0", n)
+	}
+}
+
+func TestCoupleTDMLine(t *testing.T) {
+	ds := AnySource{nchan: 6}
+	if err := ds.PrepareRun(20, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+	if _, err := ds.CoupleTDMLine(&TDMLineCoupling{Index: 0}, true); err == nil {
+		t.Error("CoupleTDMLine should fail for a source without row and column codes")
+	}
+	// 3 rows by 2 columns, in column-major order.
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	for i := range ds.rowColCodes {
+		ds.rowColCodes[i] = rcCode(i%3, i/3, 3, 2)
+	}
+	for _, bad := range []struct {
+		config TDMLineCoupling
+		column bool
+	}{{TDMLineCoupling{Index: 2}, true}, {TDMLineCoupling{Index: 3}, false},
+		{TDMLineCoupling{Index: 0, Offset: maxGroupTriggerOffset + 1}, true}} {
+		if _, err := ds.CoupleTDMLine(&bad.config, bad.column); err == nil {
+			t.Errorf("CoupleTDMLine(%+v, %t) should fail", bad.config, bad.column)
+		}
+	}
+
+	gtc, err := ds.CoupleTDMLine(&TDMLineCoupling{Index: 1, Offset: 2}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 4, 5}; !reflect.DeepEqual(gtc.Sources, want) || !reflect.DeepEqual(gtc.Receivers, want) {
+		t.Errorf("CoupleTDMLine(column 1) applied %+v, want sources and receivers %v", gtc, want)
+	}
+	if _, err := ds.CoupleTDMLine(&TDMLineCoupling{Index: 0}, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range []struct {
+		source, receiver int
+		connected        bool
+	}{{3, 4, true}, {5, 3, true}, {0, 3, true}, {3, 0, true}, {0, 1, false}, {1, 4, false}, {2, 5, false}} {
+		if got := ds.broker.isConnected(pair.source, pair.receiver); got != pair.connected {
+			t.Errorf("channels %d->%d connected=%t, want %t", pair.source, pair.receiver, got, pair.connected)
+		}
+	}
+	if offset := ds.broker.ConnectionOffset(4, 5); offset != 2 {
+		t.Errorf("channels 4->5 have offset %d, want 2", offset)
+	}
+
+	if _, err := ds.CoupleTDMLine(&TDMLineCoupling{Index: 1, Disconnect: true}, true); err != nil {
+		t.Fatal(err)
+	}
+	if ds.broker.isConnected(3, 4) || !ds.broker.isConnected(0, 3) {
+		t.Error("CoupleTDMLine with Disconnect did not remove only the column's connections")
+	}
+}
@@ -0,0 +1,276 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// DeadChannelDetectConfig is the RPC-usable structure for ConfigureDeadChannelDetection.
+// It sets dead-channel detection in 1 or more channels: a channel is flagged as dead if
+// the RMS of its raw data about their mean, measured over windows of about 1 second, stays
+// below MinRMS or above MaxRMS for more than Seconds. The flag is cleared once the RMS
+// stays within the bounds for Seconds. The "deadchanneldetect" section of the config file
+// (all but the channels) sets all channels when a source starts.
+type DeadChannelDetectConfig struct {
+	ChannelIndices  []int
+	ChannelGroups   []string // named channel groups, added to the ChannelIndices
+	MinRMS          float64  // raw units; 0 means no lower bound
+	MaxRMS          float64  // raw units; 0 means no upper bound (detection is off if both are 0)
+	Seconds         float64  // how long the RMS must stay out of (or back within) bounds; 0 means defaultDeadChannelSeconds
+	DisableTriggers bool     // a flagged channel finds no primary triggers until the flag is cleared
+}
+
+// defaultDeadChannelSeconds is how long the RMS must stay out of bounds, if Seconds is 0.
+const defaultDeadChannelSeconds = 30.0
+
+// validate checks the config for errors and fills in the default Seconds.
+func (config *DeadChannelDetectConfig) validate() error {
+	if !(config.MinRMS >= 0) || math.IsInf(config.MinRMS, 1) {
+		return fmt.Errorf("dead channel MinRMS=%v, need >= 0", config.MinRMS)
+	}
+	if !(config.MaxRMS >= 0) || math.IsInf(config.MaxRMS, 1) {
+		return fmt.Errorf("dead channel MaxRMS=%v, need >= 0", config.MaxRMS)
+	}
+	if config.MinRMS > 0 && config.MaxRMS > 0 && config.MinRMS >= config.MaxRMS {
+		return fmt.Errorf("dead channel MinRMS=%v and MaxRMS=%v, need MinRMS < MaxRMS", config.MinRMS, config.MaxRMS)
+	}
+	if !(config.Seconds >= 0) || math.IsInf(config.Seconds, 1) {
+		return fmt.Errorf("dead channel Seconds=%v, need >= 0", config.Seconds)
+	}
+	if config.Seconds == 0 {
+		config.Seconds = defaultDeadChannelSeconds
+	}
+	return nil
+}
+
+// enabled says whether the config sets any bound.
+func (config *DeadChannelDetectConfig) enabled() bool {
+	return config.MinRMS > 0 || config.MaxRMS > 0
+}
+
+// loadDeadChannelDetectConfig returns the dead-channel detection of the config file, or
+// none if there is none or it is invalid.
+func loadDeadChannelDetectConfig() DeadChannelDetectConfig {
+	var config DeadChannelDetectConfig
+	err := viper.UnmarshalKey("deadchanneldetect", &config)
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		logWarningf("Invalid deadchanneldetect config, so dead-channel detection is off: %v", err)
+		config = DeadChannelDetectConfig{}
+		config.validate()
+	}
+	config.ChannelIndices = nil
+	config.ChannelGroups = nil
+	return config
+}
+
+// DeadChannelEvent reports that dead-channel detection flagged a channel as dead, or
+// cleared the flag. It is sent to clients as a "DEADCHANNELDETECT" message.
+type DeadChannelEvent struct {
+	ChannelIndex     int
+	ChannelName      string
+	Time             time.Time
+	Dead             bool    // flagged (true) or cleared (false)
+	RMS              float64 // of the last window of data
+	MinRMS           float64
+	MaxRMS           float64
+	Seconds          float64
+	TriggersDisabled bool // the channel finds no primary triggers while flagged
+}
+
+// deadChannelDetector measures the RMS of one channel's raw data over windows of about 1
+// second of data. Only the channel's processing goroutine may use it, except between
+// segments.
+type deadChannelDetector struct {
+	config     DeadChannelDetectConfig
+	shift      float64 // subtracted from each sample, so the sums lose no precision
+	sum        float64
+	sumSq      float64
+	n          int
+	window     FrameIndex // frames in the current window
+	badFrames  FrameIndex // length of the consecutive windows out of bounds
+	goodFrames FrameIndex // length of the consecutive windows within bounds
+	rms        float64    // of the last complete window
+	flagged    bool
+}
+
+// configure sets the bounds, clears any flag, and restarts the measurement.
+func (d *deadChannelDetector) configure(config *DeadChannelDetectConfig) {
+	*d = deadChannelDetector{config: *config}
+}
+
+// triggersOff says whether the channel's primary triggers are turned off by the detector.
+func (d *deadChannelDetector) triggersOff() bool {
+	return d.flagged && d.config.DisableTriggers
+}
+
+// observe adds the samples to the measurement. It returns whether the channel was just
+// flagged or cleared.
+func (d *deadChannelDetector) observe(samples []RawType, signed bool, framesPerSample int,
+	sampleRate float64) bool {
+	if !d.config.enabled() || sampleRate <= 0 || len(samples) == 0 {
+		return false
+	}
+	for _, v := range samples {
+		x := float64(v)
+		if signed {
+			x = float64(int16(v))
+		}
+		if d.n == 0 {
+			d.shift = x
+		}
+		x -= d.shift
+		d.sum += x
+		d.sumSq += x * x
+		d.n++
+	}
+	d.window += FrameIndex(len(samples) * framesPerSample)
+	if float64(d.window) < sampleRate {
+		return false
+	}
+	mean := d.sum / float64(d.n)
+	d.rms = math.Sqrt(math.Max(0, d.sumSq/float64(d.n)-mean*mean))
+	if (d.config.MinRMS > 0 && d.rms < d.config.MinRMS) || (d.config.MaxRMS > 0 && d.rms > d.config.MaxRMS) {
+		d.badFrames += d.window
+		d.goodFrames = 0
+	} else {
+		d.goodFrames += d.window
+		d.badFrames = 0
+	}
+	d.sum, d.sumSq, d.n, d.window = 0, 0, 0, 0
+	limit := d.config.Seconds * sampleRate
+	if !d.flagged && float64(d.badFrames) > limit {
+		d.flagged = true
+		return true
+	}
+	if d.flagged && float64(d.goodFrames) > limit {
+		d.flagged = false
+		return true
+	}
+	return false
+}
+
+// ConfigureDeadChannelDetection sets this stream's dead-channel detection.
+func (dsp *DataStreamProcessor) ConfigureDeadChannelDetection(config *DeadChannelDetectConfig) {
+	dsp.deadDetect.configure(config)
+	dsp.deadEvent = nil
+}
+
+// checkDeadChannel feeds the segment's raw data to the dead-channel detector. If it
+// flags or clears the channel, dsp.deadEvent is set so the source knows to report it.
+func (dsp *DataStreamProcessor) checkDeadChannel(segment *DataSegment) {
+	d := &dsp.deadDetect
+	if !d.observe(segment.rawData, segment.signed, segment.framesPerSample, dsp.SampleRate) {
+		return
+	}
+	dsp.deadEvent = &DeadChannelEvent{ChannelIndex: dsp.channelIndex, ChannelName: dsp.Name,
+		Time: time.Now(), Dead: d.flagged, RMS: d.rms, MinRMS: d.config.MinRMS,
+		MaxRMS: d.config.MaxRMS, Seconds: d.config.Seconds, TriggersDisabled: d.config.DisableTriggers}
+}
+
+// ConfigureDeadChannelDetection sets the dead-channel detection of 1 or more channels.
+// It clears their flags.
+func (ds *AnySource) ConfigureDeadChannelDetection(config *DeadChannelDetectConfig) error {
+	if len(config.ChannelIndices) == 0 {
+		return fmt.Errorf("DeadChannelDetectConfig has no ChannelIndices")
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].ConfigureDeadChannelDetection(config)
+	}
+	detectedDeadChannels.set(ds.flaggedDeadChannels())
+	return nil
+}
+
+// flaggedDeadChannels returns the indices of the channels flagged as dead.
+func (ds *AnySource) flaggedDeadChannels() []int {
+	flagged := make([]int, 0)
+	for i, dsp := range ds.processors {
+		if dsp.deadDetect.flagged {
+			flagged = append(flagged, i)
+		}
+	}
+	return flagged
+}
+
+// reportDeadChannels alerts clients to each channel that dead-channel detection flagged
+// or cleared in the last segment.
+func (ds *AnySource) reportDeadChannels() {
+	var events []DeadChannelEvent
+	for _, dsp := range ds.processors {
+		if dsp.deadEvent != nil {
+			events = append(events, *dsp.deadEvent)
+			dsp.deadEvent = nil
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	for _, e := range events {
+		if e.Dead {
+			logWarningf("Channel %s looks dead: raw data RMS %.3g has been outside [%g, %g] for %.0f s (triggers off: %t)",
+				e.ChannelName, e.RMS, e.MinRMS, e.MaxRMS, e.Seconds, e.TriggersDisabled)
+		} else {
+			logInfof("Channel %s no longer looks dead: raw data RMS %.3g", e.ChannelName, e.RMS)
+		}
+		clientMessageChan <- ClientUpdate{"DEADCHANNELDETECT", e}
+	}
+	detectedDeadChannels.set(ds.flaggedDeadChannels())
+}
+
+// detectedDeadChannels holds the channels of the active source flagged by dead-channel
+// detection, for ServerStatus. The source sets it; the core loop takes changes into the
+// status when the heartbeat loop asks (see SourceControl.queueDeadChannels).
+var detectedDeadChannels deadChannelFlags
+
+type deadChannelFlags struct {
+	indices    []int
+	changed    bool
+	sync.Mutex // protects indices and changed
+}
+
+// set replaces the flagged channels, noting whether they changed.
+func (f *deadChannelFlags) set(indices []int) {
+	f.Lock()
+	defer f.Unlock()
+	if len(indices) == len(f.indices) {
+		same := true
+		for i := range indices {
+			same = same && indices[i] == f.indices[i]
+		}
+		if same {
+			return
+		}
+	}
+	f.indices = append([]int{}, indices...)
+	f.changed = true
+}
+
+// pending returns whether the flagged channels changed since the last take.
+func (f *deadChannelFlags) pending() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.changed
+}
+
+// take returns the flagged channels, and whether they changed since the last take.
+func (f *deadChannelFlags) take() ([]int, bool) {
+	f.Lock()
+	defer f.Unlock()
+	changed := f.changed
+	f.changed = false
+	return append([]int{}, f.indices...), changed
+}
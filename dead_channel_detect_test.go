@@ -0,0 +1,161 @@
+package dastard
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDeadChannelDetector(t *testing.T) {
+	for _, bad := range []DeadChannelDetectConfig{{MinRMS: -1}, {MaxRMS: math.NaN()}, {MinRMS: 5, MaxRMS: 5},
+		{MinRMS: 1, Seconds: -1}, {MaxRMS: math.Inf(1)}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("DeadChannelDetectConfig%+v.validate() should fail", bad)
+		}
+	}
+	config := DeadChannelDetectConfig{MinRMS: 2, MaxRMS: 100, Seconds: 2, DisableTriggers: true}
+	if err := config.validate(); err != nil {
+		t.Error(err)
+	}
+
+	// Seconds of 1000 samples, either flat, noisy (RMS 10), or wild (RMS 1000).
+	second := func(rms float64) []RawType {
+		data := make([]RawType, 1000)
+		for i := range data {
+			data[i] = RawType(30000 + rms*float64(1-2*(i%2)))
+		}
+		return data
+	}
+	flat, noisy, wild := second(0), second(10), second(1000)
+	var d deadChannelDetector
+	d.configure(&config)
+	// A good second restarts the count.
+	for i, data := range [][]RawType{flat, flat, noisy, flat, wild} {
+		if d.observe(data, false, 1, 1000) {
+			t.Errorf("detector changed in second %d, flagged=%t", i, d.flagged)
+		}
+	}
+	if !d.observe(flat, false, 1, 1000) || !d.flagged || !d.triggersOff() || d.rms != 0 {
+		t.Errorf("detector not flagged after 3 bad seconds: flagged=%t, rms=%v", d.flagged, d.rms)
+	}
+	for i := 0; i < 2; i++ {
+		if d.observe(noisy, false, 1, 1000) {
+			t.Errorf("detector cleared after %d good seconds", i+1)
+		}
+	}
+	if !d.observe(noisy, false, 1, 1000) || d.flagged || math.Abs(d.rms-10) > 1e-9 {
+		t.Errorf("detector not cleared after 3 good seconds: flagged=%t, rms=%v", d.flagged, d.rms)
+	}
+
+	// Half-second segments of signed data, each sample standing for 2 frames.
+	signed := make([]RawType, 250)
+	for i := range signed {
+		signed[i] = RawType(int16(-3 + 6*(i%2)))
+	}
+	d.configure(&DeadChannelDetectConfig{MinRMS: 5, Seconds: 1})
+	changed := false
+	for i := 0; i < 6; i++ {
+		changed = changed || d.observe(signed, true, 2, 1000)
+	}
+	if !changed || !d.flagged || math.Abs(d.rms-3) > 1e-9 || d.triggersOff() {
+		t.Errorf("signed data flagged=%t, rms=%v, triggersOff=%t, want true, 3, false", d.flagged, d.rms, d.triggersOff())
+	}
+
+	// No bounds means no detection.
+	d.configure(&DeadChannelDetectConfig{Seconds: 1})
+	for i := 0; i < 5; i++ {
+		if d.observe(flat, false, 1, 1000) {
+			t.Error("detector with no bounds changed")
+		}
+	}
+}
+
+func TestDeadChannelDetection(t *testing.T) {
+	ds := AnySource{nchan: 2}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	for _, bad := range []DeadChannelDetectConfig{{MinRMS: 10}, {ChannelIndices: []int{2}, MinRMS: 10},
+		{ChannelIndices: []int{0}, MinRMS: -1}} {
+		if err := ds.ConfigureDeadChannelDetection(&bad); err == nil {
+			t.Errorf("ConfigureDeadChannelDetection(%+v) should fail", bad)
+		}
+	}
+	config := DeadChannelDetectConfig{ChannelIndices: []int{0, 1}, MinRMS: 5, DisableTriggers: true}
+	if err := ds.ConfigureDeadChannelDetection(&config); err != nil {
+		t.Error(err)
+	}
+	dsp := ds.processors[1]
+	if c := dsp.deadDetect.config; c.MinRMS != 5 || c.Seconds != defaultDeadChannelSeconds {
+		t.Errorf("detector has MinRMS %v, Seconds %v, want 5, %v", c.MinRMS, c.Seconds, defaultDeadChannelSeconds)
+	}
+	detectedDeadChannels.take()
+
+	// A flat channel is flagged after Seconds, and its triggers turn off.
+	dsp.SampleRate = 1000
+	dsp.EdgeTrigger, dsp.EdgeRising, dsp.EdgeLevel = true, true, 100
+	flat := make([]RawType, 1000)
+	for i := 0; i <= int(defaultDeadChannelSeconds); i++ {
+		dsp.checkDeadChannel(&DataSegment{rawData: flat, framesPerSample: 1})
+	}
+	e := dsp.deadEvent
+	if e == nil || !e.Dead || e.ChannelIndex != 1 || !e.TriggersDisabled || !dsp.deadDetect.triggersOff() {
+		t.Errorf("dead channel event is %+v", e)
+	}
+	ds.reportDeadChannels()
+	if dsp.deadEvent != nil {
+		t.Error("reportDeadChannels did not report the event")
+	}
+	if dead, changed := detectedDeadChannels.take(); !changed || !reflect.DeepEqual(dead, []int{1}) {
+		t.Errorf("detected dead channels %v (changed %t), want [1]", dead, changed)
+	}
+	if _, changed := detectedDeadChannels.take(); changed {
+		t.Error("detected dead channels changed twice")
+	}
+
+	// Reconfiguring clears the flag.
+	config.DisableTriggers = false
+	if err := ds.ConfigureDeadChannelDetection(&config); err != nil {
+		t.Error(err)
+	}
+	if dead, changed := detectedDeadChannels.take(); !changed || len(dead) != 0 || dsp.deadDetect.flagged {
+		t.Errorf("detected dead channels %v (changed %t) after reconfiguring, want []", dead, changed)
+	}
+}
+
+func TestDeadChannelStatus(t *testing.T) {
+	updates := make(chan ClientUpdate, 2)
+	sc := &SourceControl{clientUpdates: updates, queuedRequests: make(chan func())}
+	defer detectedDeadChannels.set(nil)
+	detectedDeadChannels.set(nil)
+	detectedDeadChannels.take()
+
+	// With no core loop to take the request, the status is left alone until the next try.
+	detectedDeadChannels.set([]int{2, 5})
+	sc.queueDeadChannels()
+	if sc.status.DetectedDeadChannels != nil || !detectedDeadChannels.pending() {
+		t.Errorf("status has dead channels %v without a core loop", sc.status.DetectedDeadChannels)
+	}
+
+	// The core loop applies the change and broadcasts the status.
+	done := make(chan struct{})
+	go func() {
+		request := <-sc.queuedRequests
+		request()
+		close(done)
+	}()
+	sc.queueDeadChannels()
+	<-done
+	if !reflect.DeepEqual(sc.status.DetectedDeadChannels, []int{2, 5}) || detectedDeadChannels.pending() {
+		t.Errorf("status has dead channels %v, want [2 5]", sc.status.DetectedDeadChannels)
+	}
+	if u := <-updates; u.tag != "STATUS" {
+		t.Errorf("dead channel change sent a %s message, want STATUS", u.tag)
+	}
+
+	// Without a change, nothing is queued.
+	sc.queueDeadChannels()
+	if len(updates) != 0 {
+		t.Error("queueDeadChannels broadcast the status without a change")
+	}
+}
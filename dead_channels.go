@@ -0,0 +1,73 @@
+package dastard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// deadChannelRegistry holds the names of the channels that must never trigger, such
+// as known-bad pixels. The list is set by RPC SetDeadChannels or read from the config
+// file. It is kept by channel name, so it applies to any source whose channels have
+// those names, whatever trigger state is restored or configured.
+type deadChannelRegistry struct {
+	names map[string]bool
+	sync.Mutex
+}
+
+// deadChannels is the one registry shared by the SourceControl and all sources.
+var deadChannels = newDeadChannelRegistry()
+
+func newDeadChannelRegistry() *deadChannelRegistry {
+	return &deadChannelRegistry{names: make(map[string]bool)}
+}
+
+// set replaces the list of dead channels.
+func (r *deadChannelRegistry) set(names []string) error {
+	for _, name := range names {
+		if len(strings.TrimSpace(name)) == 0 {
+			return fmt.Errorf("dead channel names must be non-empty")
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.names = make(map[string]bool)
+	for _, name := range names {
+		r.names[strings.TrimSpace(name)] = true
+	}
+	return nil
+}
+
+// has returns whether the named channel is dead.
+func (r *deadChannelRegistry) has(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.names[name]
+}
+
+// list returns the names of all dead channels, sorted.
+func (r *deadChannelRegistry) list() []string {
+	r.Lock()
+	defer r.Unlock()
+	result := make([]string, 0, len(r.names))
+	for name := range r.names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ApplyDeadChannels stops the channels on the dead-channel list from triggering, and
+// lets all other channels trigger again. It returns the indices of the dead channels.
+// Sources apply it in PrepareRun; call it again after the list changes.
+func (ds *AnySource) ApplyDeadChannels() []int {
+	dead := make([]int, 0)
+	for i, dsp := range ds.processors {
+		dsp.neverTrigger = i < len(ds.chanNames) && deadChannels.has(ds.chanNames[i])
+		if dsp.neverTrigger {
+			dead = append(dead, i)
+		}
+	}
+	return dead
+}
@@ -0,0 +1,78 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadChannels(t *testing.T) {
+	saved := deadChannels
+	defer func() { deadChannels = saved }()
+	deadChannels = newDeadChannelRegistry()
+
+	if err := deadChannels.set([]string{"chan1", " "}); err == nil {
+		t.Error("dead channel names should not be blank")
+	}
+	if err := deadChannels.set([]string{"chan2", "chan0", "chan2"}); err != nil {
+		t.Error(err)
+	}
+	if names := deadChannels.list(); len(names) != 2 || names[0] != "chan0" || names[1] != "chan2" {
+		t.Errorf("dead channel list is %v, want [chan0 chan2]", names)
+	}
+
+	// PrepareRun applies the list by channel name.
+	ds := AnySource{nchan: 3}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(100, 200)
+	defer ds.broker.Stop()
+	for i, dsp := range ds.processors {
+		if want := i != 1; dsp.neverTrigger != want {
+			t.Errorf("channel %d neverTrigger=%t, want %t", i, dsp.neverTrigger, want)
+		}
+	}
+	deadChannels.set([]string{"chan1"})
+	if dead := ds.ApplyDeadChannels(); len(dead) != 1 || dead[0] != 1 {
+		t.Errorf("ApplyDeadChannels gives %v, want [1]", dead)
+	}
+
+	// A dead channel makes no primary records, and no secondary records either.
+	const NPresamples, NSamples, chunk = 100, 400, 500
+	for dead := 0; dead < 2; dead++ {
+		broker := NewTriggerBroker(2)
+		go broker.Run()
+		broker.AddConnection(0, 1)
+		dsps := []*DataStreamProcessor{
+			NewDataStreamProcessor(0, broker, NPresamples, NSamples),
+			NewDataStreamProcessor(1, broker, NPresamples, NSamples),
+		}
+		for _, dsp := range dsps {
+			dsp.SampleRate = 1000
+			dsp.EdgeTrigger, dsp.EdgeRising, dsp.EdgeLevel = true, true, 100
+		}
+		dsps[dead].neverTrigger = true
+		var primaries, secondaries [2]int
+		for first := 0; first < 3*chunk; first += chunk {
+			for _, dsp := range dsps {
+				data := make([]RawType, chunk)
+				for j := range data {
+					if first+j >= 700 {
+						data[j] = 5000
+					}
+				}
+				dsp.stream.AppendSegment(NewDataSegment(data, 1, FrameIndex(first), time.Now(), time.Millisecond))
+			}
+			for i, dsp := range dsps {
+				primaries[i] += len(dsp.TriggerDataPrimary())
+			}
+			for i, dsp := range dsps {
+				secondaries[i] += len(dsp.TriggerDataSecondary())
+			}
+		}
+		broker.Stop()
+		alive := 1 - dead
+		if primaries[dead] != 0 || secondaries[dead] != 0 || primaries[alive] != 1 || secondaries[alive] != 0 {
+			t.Errorf("dead channel %d: primary records %v and secondary records %v, want only 1 primary in channel %d",
+				dead, primaries, secondaries, alive)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package dastard
+
+import "sort"
+
+// deadTimeStats accounts for the live time and dead time of one channel's primary
+// triggering, in frames. After each primary trigger the channel is dead for one record
+// length (the holdoff before the next record can start); when records overlap, their
+// dead intervals are counted only once. Only the channel's processing goroutine may
+// use it, except between segments.
+type deadTimeStats struct {
+	started     bool
+	start       FrameIndex // the first frame examined for triggers
+	through     FrameIndex // frames before this have all been examined for triggers
+	deadUntil   FrameIndex // end of the latest dead interval
+	deadFrames  int64      // frames in all dead intervals, including any not yet examined
+	triggers    int        // primary triggers counted
+	lastTrigger FrameIndex // frame of the latest primary trigger
+}
+
+// observe counts the primary trigger frames found in data examined up to frame through.
+// Each trigger is followed by holdoff dead frames.
+func (dt *deadTimeStats) observe(frames []FrameIndex, first, through FrameIndex, holdoff int) {
+	if !dt.started {
+		dt.started = true
+		dt.start = first
+		dt.through = first
+		dt.deadUntil = first
+	}
+	if len(frames) > 0 {
+		// Manual triggers come last in the list, wherever they are.
+		frames = append([]FrameIndex{}, frames...)
+		sort.Sort(FrameIdxSlice(frames))
+	}
+	for _, f := range frames {
+		start := f
+		if start < dt.deadUntil {
+			start = dt.deadUntil
+		}
+		end := f + FrameIndex(holdoff)
+		if end > start {
+			dt.deadFrames += int64(end - start)
+			dt.deadUntil = end
+		}
+		if dt.triggers == 0 || f > dt.lastTrigger {
+			dt.lastTrigger = f
+		}
+		dt.triggers++
+	}
+	if through > dt.through {
+		dt.through = through
+	}
+}
+
+// skip moves the examined data up to frame through without counting it, as when the
+// channel is disabled.
+func (dt *deadTimeStats) skip(through FrameIndex) {
+	if dt.started && through > dt.through {
+		dt.start += through - dt.through
+		if dt.deadUntil > dt.through {
+			dt.deadFrames -= int64(dt.deadUntil - dt.through)
+		}
+		dt.through = through
+		dt.deadUntil = through
+	}
+}
+
+// totals returns the frames examined so far, and how many of them were dead.
+func (dt *deadTimeStats) totals() (elapsed, dead int64) {
+	elapsed = int64(dt.through - dt.start)
+	dead = dt.deadFrames
+	if dt.deadUntil > dt.through {
+		dead -= int64(dt.deadUntil - dt.through) // not yet examined
+	}
+	if dead < 0 {
+		dead = 0
+	}
+	return
+}
+
+// since returns the live and dead frames counted after the earlier state before.
+func (dt *deadTimeStats) since(before deadTimeStats) (live, dead int64) {
+	elapsed, dead := dt.totals()
+	elapsed0, dead0 := before.totals()
+	if before.started {
+		elapsed -= elapsed0
+		dead -= dead0
+	}
+	if dead < 0 {
+		dead = 0
+	}
+	if dead > elapsed {
+		dead = elapsed
+	}
+	return elapsed - dead, dead
+}
+
+// DeadTimeMessage reports the live and dead time of each channel's primary triggering
+// since its source started, for dead-time correction of absolute rates. Times are in
+// seconds of data.
+type DeadTimeMessage struct {
+	LiveTime             []float64 // time in which the channel could trigger
+	DeadTime             []float64 // time in the record-length holdoff after each trigger
+	TimeSinceLastTrigger []float64 // from the last primary trigger to the latest data examined; -1 if none
+}
+
+// ComputeDeadTime returns the live and dead time of each channel since the source started.
+func (ds *AnySource) ComputeDeadTime() DeadTimeMessage {
+	n := len(ds.processors)
+	m := DeadTimeMessage{LiveTime: make([]float64, n), DeadTime: make([]float64, n),
+		TimeSinceLastTrigger: make([]float64, n)}
+	for i, dsp := range ds.processors {
+		m.TimeSinceLastTrigger[i] = -1
+		if dsp.SampleRate <= 0 {
+			continue
+		}
+		live, dead := dsp.deadTime.since(deadTimeStats{})
+		m.LiveTime[i] = float64(live) / dsp.SampleRate
+		m.DeadTime[i] = float64(dead) / dsp.SampleRate
+		if dsp.deadTime.triggers > 0 {
+			m.TimeSinceLastTrigger[i] = float64(dsp.deadTime.through-dsp.deadTime.lastTrigger) / dsp.SampleRate
+		}
+	}
+	return m
+}
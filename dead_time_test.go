@@ -0,0 +1,74 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadTimeStats(t *testing.T) {
+	var dt deadTimeStats
+	dt.observe(nil, 100, 1000, 200)
+	if elapsed, dead := dt.totals(); elapsed != 900 || dead != 0 {
+		t.Errorf("totals() = %d, %d, want 900, 0", elapsed, dead)
+	}
+	// Overlapping dead intervals count once; the last one is not yet all examined.
+	dt.observe([]FrameIndex{1500, 1100, 1950}, 1000, 2000, 200)
+	if elapsed, dead := dt.totals(); elapsed != 1900 || dead != 450 {
+		t.Errorf("totals() = %d, %d, want 1900, 450", elapsed, dead)
+	}
+	if dt.triggers != 3 || dt.lastTrigger != 1950 {
+		t.Errorf("counted %d triggers, last at %d, want 3 and 1950", dt.triggers, dt.lastTrigger)
+	}
+	before := dt
+	dt.observe([]FrameIndex{2100}, 2000, 3000, 200)
+	if elapsed, dead := dt.totals(); elapsed != 2900 || dead != 750 {
+		t.Errorf("totals() = %d, %d, want 2900, 750", elapsed, dead)
+	}
+	if live, dead := dt.since(before); live != 700 || dead != 300 {
+		t.Errorf("since() = %d, %d, want 700, 300", live, dead)
+	}
+
+	// Skipped data (a disabled channel) are neither live nor dead, nor is the holdoff
+	// of a trigger just before them.
+	dt.observe([]FrameIndex{2950}, 3000, 3000, 200)
+	dt.skip(5000)
+	dt.observe(nil, 5000, 6000, 200)
+	if elapsed, dead := dt.totals(); elapsed != 3900 || dead != 800 {
+		t.Errorf("after skip, totals() = %d, %d, want 3900, 800", elapsed, dead)
+	}
+}
+
+func TestComputeDeadTime(t *testing.T) {
+	ds := AnySource{nchan: 2, sampleRate: 1000}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(100, 400)
+	defer ds.broker.Stop()
+	ds.processors[0].EdgeTrigger, ds.processors[0].EdgeRising, ds.processors[0].EdgeLevel = true, true, 100
+	for first := 0; first < 5000; first += 1000 {
+		for _, dsp := range ds.processors {
+			data := make([]RawType, 1000)
+			for j := range data {
+				if first+j >= 2000 {
+					data[j] = 5000
+				}
+			}
+			dsp.stream.AppendSegment(NewDataSegment(data, 1, FrameIndex(first), time.Now(), time.Millisecond))
+		}
+		for _, dsp := range ds.processors {
+			dsp.TriggerDataPrimary()
+		}
+		for _, dsp := range ds.processors {
+			dsp.TriggerDataSecondary()
+		}
+	}
+	m := ds.ComputeDeadTime()
+	// Data through frame 4700 were examined, starting at frame 100.
+	if m.LiveTime[0] != 4.2 || m.DeadTime[0] != 0.4 || m.TimeSinceLastTrigger[0] != 2.7 {
+		t.Errorf("channel 0 live %v, dead %v, since last trigger %v, want 4.2, 0.4, 2.7",
+			m.LiveTime[0], m.DeadTime[0], m.TimeSinceLastTrigger[0])
+	}
+	if m.LiveTime[1] != 4.6 || m.DeadTime[1] != 0 || m.TimeSinceLastTrigger[1] != -1 {
+		t.Errorf("channel 1 live %v, dead %v, since last trigger %v, want 4.6, 0, -1",
+			m.LiveTime[1], m.DeadTime[1], m.TimeSinceLastTrigger[1])
+	}
+}
@@ -0,0 +1,135 @@
+package dastard
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Allowed values of DriftTracker.DriftMode
+const (
+	DriftModePTM  = "PTM"  // track the pretrigger mean
+	DriftModeLine = "LINE" // track the peak value of pulses in a reference line
+)
+
+// DriftTracker contains all the state needed to track gain drift in one channel and
+// compute a per-record correction factor. Multiply a record's pulse height (or model
+// coefficients) by its correction factor to undo the drift.
+//
+// In PTM mode, the gain is assumed to vary linearly with the pretrigger mean:
+// correction = 1 + DriftSlope*(smoothedPTM - referencePTM).
+// In LINE mode, records whose peak value falls in [DriftLineLo, DriftLineHi] are
+// assumed to come from a single reference line: correction = referencePeak / smoothedPeak.
+// Either way, the reference is the first value seen after enabling or resetting.
+type DriftTracker struct {
+	DriftCorrect bool
+	DriftMode    string
+	DriftTau     float64 // number of records in the exponential smoothing
+	DriftSlope   float64 // fractional gain change per arb of pretrigger mean (PTM mode)
+	DriftLineLo  float64 // peak value range of the reference line (LINE mode)
+	DriftLineHi  float64
+
+	driftReference     float64
+	driftSmoothed      float64
+	driftHaveReference bool
+}
+
+// DriftCorrectionConfig is the RPC-usable structure for ConfigureDriftCorrection.
+type DriftCorrectionConfig struct {
+	ChannelIndices []int
+	Enable         bool
+	Mode           string
+	Tau            float64
+	Slope          float64
+	LineLo, LineHi float64
+}
+
+// validate checks the config for errors and normalizes its Mode.
+func (config *DriftCorrectionConfig) validate() error {
+	if len(config.ChannelIndices) == 0 {
+		return fmt.Errorf("DriftCorrectionConfig has no ChannelIndices")
+	}
+	if !config.Enable {
+		return nil
+	}
+	config.Mode = strings.ToUpper(config.Mode)
+	switch config.Mode {
+	case DriftModePTM:
+	case DriftModeLine:
+		if config.LineHi <= config.LineLo {
+			return fmt.Errorf("drift correction LineHi=%v must exceed LineLo=%v", config.LineHi, config.LineLo)
+		}
+	default:
+		return fmt.Errorf("drift correction Mode=%q, need one of (%s, %s)", config.Mode, DriftModePTM, DriftModeLine)
+	}
+	if config.Tau < 1 {
+		return fmt.Errorf("drift correction Tau=%v, need Tau >= 1", config.Tau)
+	}
+	return nil
+}
+
+// ConfigureDriftCorrection sets this stream's drift tracking state and resets its reference.
+func (dsp *DataStreamProcessor) ConfigureDriftCorrection(config *DriftCorrectionConfig) {
+	dsp.DriftCorrect = config.Enable
+	dsp.DriftMode = config.Mode
+	dsp.DriftTau = config.Tau
+	dsp.DriftSlope = config.Slope
+	dsp.DriftLineLo = config.LineLo
+	dsp.DriftLineHi = config.LineHi
+	dsp.ResetDriftReference()
+}
+
+// ResetDriftReference forgets the drift reference, so the next suitable record sets a new one.
+func (dsp *DataStreamProcessor) ResetDriftReference() {
+	dsp.driftHaveReference = false
+	dsp.driftReference = 0
+	dsp.driftSmoothed = 0
+}
+
+// trackDrift updates the drift tracker with an analyzed record and returns the
+// correction factor for that record. Returns 1 if drift correction is off.
+func (dt *DriftTracker) trackDrift(rec *DataRecord) float64 {
+	if !dt.DriftCorrect {
+		return 1.0
+	}
+	var value float64
+	switch dt.DriftMode {
+	case DriftModePTM:
+		value = rec.pretrigMean
+	case DriftModeLine:
+		value = rec.peakValue
+		if value < dt.DriftLineLo || value > dt.DriftLineHi {
+			return dt.driftCorrection()
+		}
+	default:
+		return 1.0
+	}
+	if !dt.driftHaveReference {
+		dt.driftReference = value
+		dt.driftSmoothed = value
+		dt.driftHaveReference = true
+		return 1.0
+	}
+	alpha := 1.0
+	if dt.DriftTau > 1 {
+		alpha = 1.0 / dt.DriftTau
+	}
+	dt.driftSmoothed += alpha * (value - dt.driftSmoothed)
+	return dt.driftCorrection()
+}
+
+// driftCorrection returns the current correction factor without updating anything.
+func (dt *DriftTracker) driftCorrection() float64 {
+	if !dt.DriftCorrect || !dt.driftHaveReference {
+		return 1.0
+	}
+	switch dt.DriftMode {
+	case DriftModePTM:
+		return 1.0 + dt.DriftSlope*(dt.driftSmoothed-dt.driftReference)
+	case DriftModeLine:
+		if dt.driftSmoothed == 0 {
+			return 1.0
+		}
+		return dt.driftReference / dt.driftSmoothed
+	}
+	return 1.0
+}
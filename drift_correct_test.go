@@ -0,0 +1,59 @@
+package dastard
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDriftTracker(t *testing.T) {
+	dsp := NewDataStreamProcessor(0, nil, 4, 16)
+	rec := &DataRecord{pretrigMean: 1000, peakValue: 500}
+	if c := dsp.trackDrift(rec); c != 1.0 {
+		t.Errorf("trackDrift with correction off returns %v, want 1", c)
+	}
+
+	config := DriftCorrectionConfig{ChannelIndices: []int{0}, Enable: true, Mode: "ptm", Tau: 1, Slope: 0.001}
+	if err := config.validate(); err != nil {
+		t.Fatalf("validate(%v) fails: %v", config, err)
+	}
+	dsp.ConfigureDriftCorrection(&config)
+	if c := dsp.trackDrift(rec); c != 1.0 {
+		t.Errorf("trackDrift on reference record returns %v, want 1", c)
+	}
+	rec.pretrigMean = 1010
+	if c := dsp.trackDrift(rec); math.Abs(c-1.01) > 1e-9 {
+		t.Errorf("trackDrift in PTM mode returns %v, want 1.01", c)
+	}
+	dsp.ResetDriftReference()
+	if c := dsp.trackDrift(rec); c != 1.0 {
+		t.Errorf("trackDrift after reset returns %v, want 1", c)
+	}
+
+	config = DriftCorrectionConfig{ChannelIndices: []int{0}, Enable: true, Mode: "Line", Tau: 1,
+		LineLo: 400, LineHi: 600}
+	if err := config.validate(); err != nil {
+		t.Fatalf("validate(%v) fails: %v", config, err)
+	}
+	dsp.ConfigureDriftCorrection(&config)
+	dsp.trackDrift(rec)
+	rec.peakValue = 550
+	if c := dsp.trackDrift(rec); math.Abs(c-500./550.) > 1e-9 {
+		t.Errorf("trackDrift in LINE mode returns %v, want %v", c, 500./550.)
+	}
+	rec.peakValue = 5000 // outside the line: correction should not change
+	if c := dsp.trackDrift(rec); math.Abs(c-500./550.) > 1e-9 {
+		t.Errorf("trackDrift in LINE mode outside line returns %v, want %v", c, 500./550.)
+	}
+
+	bad := []DriftCorrectionConfig{
+		{Enable: true, Mode: "PTM", Tau: 1},
+		{ChannelIndices: []int{0}, Enable: true, Mode: "nonsense", Tau: 1},
+		{ChannelIndices: []int{0}, Enable: true, Mode: "PTM", Tau: 0},
+		{ChannelIndices: []int{0}, Enable: true, Mode: "LINE", Tau: 1, LineLo: 5, LineHi: 4},
+	}
+	for _, c := range bad {
+		if err := c.validate(); err == nil {
+			t.Errorf("validate(%v) should fail", c)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Allowed values of EnergyCalibrationConfig.Kind
+const (
+	EnergyCalPoly   = "POLY"   // polynomial in the pulse height
+	EnergyCalSpline = "SPLINE" // natural cubic spline through (Heights, Energies) points
+)
+
+// Allowed values of EnergyCalibrationConfig.Input
+const (
+	EnergyInputCoef = "COEF" // the model coefficient number CoefIndex (needs projectors)
+	EnergyInputPeak = "PEAK" // the peak value minus the pretrigger mean
+)
+
+// EnergyCalibrationConfig is the RPC-usable structure for ConfigureEnergyCalibration.
+// The pulse height is taken from Input and multiplied by the drift correction factor,
+// then converted to energy (in keV, or any unit the curve uses) by the curve.
+type EnergyCalibrationConfig struct {
+	ChannelIndices []int
+	ChannelGroups  []string
+	Enable         bool
+	Kind           string    // POLY or SPLINE
+	Input          string    // COEF (the default) or PEAK
+	CoefIndex      int       // which model coefficient is the pulse height, for Input COEF and the summaries (even if not Enable)
+	Coefficients   []float64 // POLY: energy = Coefficients[0] + Coefficients[1]*h + Coefficients[2]*h^2...
+	Heights        []float64 // SPLINE: knots in pulse height, strictly increasing
+	Energies       []float64 // SPLINE: energy at each knot
+}
+
+// validate checks the config for errors and normalizes its Kind and Input.
+func (config *EnergyCalibrationConfig) validate() error {
+	if len(config.ChannelIndices) == 0 {
+		return fmt.Errorf("EnergyCalibrationConfig has no ChannelIndices")
+	}
+	if !config.Enable {
+		return nil
+	}
+	config.Input = strings.ToUpper(config.Input)
+	switch config.Input {
+	case "":
+		config.Input = EnergyInputCoef
+	case EnergyInputCoef, EnergyInputPeak:
+	default:
+		return fmt.Errorf("energy calibration Input=%q, need one of (%s, %s)", config.Input, EnergyInputCoef, EnergyInputPeak)
+	}
+	if config.CoefIndex < 0 {
+		return fmt.Errorf("energy calibration CoefIndex=%v, need >= 0", config.CoefIndex)
+	}
+	config.Kind = strings.ToUpper(config.Kind)
+	switch config.Kind {
+	case EnergyCalPoly:
+		if len(config.Coefficients) == 0 {
+			return fmt.Errorf("energy calibration of kind %s has no Coefficients", config.Kind)
+		}
+	case EnergyCalSpline:
+		if len(config.Heights) < 2 || len(config.Heights) != len(config.Energies) {
+			return fmt.Errorf("energy calibration has %d Heights and %d Energies, need equal numbers >= 2",
+				len(config.Heights), len(config.Energies))
+		}
+		for i := 1; i < len(config.Heights); i++ {
+			if !(config.Heights[i] > config.Heights[i-1]) {
+				return fmt.Errorf("energy calibration Heights must be strictly increasing")
+			}
+		}
+	default:
+		return fmt.Errorf("energy calibration Kind=%q, need one of (%s, %s)", config.Kind, EnergyCalPoly, EnergyCalSpline)
+	}
+	return nil
+}
+
+// energyCurve converts a drift-corrected pulse height to energy.
+type energyCurve interface {
+	energy(height float64) float64
+}
+
+// polyCurve is a polynomial, with coefficients in increasing order.
+type polyCurve []float64
+
+func (p polyCurve) energy(h float64) float64 {
+	e := 0.0
+	for i := len(p) - 1; i >= 0; i-- {
+		e = e*h + p[i]
+	}
+	return e
+}
+
+// splineCurve is a natural cubic spline, extrapolated linearly beyond its end knots.
+type splineCurve struct {
+	x, y []float64
+	y2   []float64 // second derivatives at the knots
+}
+
+// newSplineCurve computes the natural cubic spline through the points (x, y).
+// The x must be strictly increasing, with len(x) == len(y) >= 2.
+func newSplineCurve(x, y []float64) *splineCurve {
+	n := len(x)
+	s := &splineCurve{x: append([]float64{}, x...), y: append([]float64{}, y...), y2: make([]float64, n)}
+	// Solve the tridiagonal system for the second derivatives, with y2=0 at both ends.
+	u := make([]float64, n)
+	for i := 1; i < n-1; i++ {
+		sig := (x[i] - x[i-1]) / (x[i+1] - x[i-1])
+		p := sig*s.y2[i-1] + 2
+		s.y2[i] = (sig - 1) / p
+		slopeDiff := (y[i+1]-y[i])/(x[i+1]-x[i]) - (y[i]-y[i-1])/(x[i]-x[i-1])
+		u[i] = (6*slopeDiff/(x[i+1]-x[i-1]) - sig*u[i-1]) / p
+	}
+	s.y2[n-1] = 0
+	for k := n - 2; k >= 0; k-- {
+		s.y2[k] = s.y2[k]*s.y2[k+1] + u[k]
+	}
+	return s
+}
+
+func (s *splineCurve) energy(h float64) float64 {
+	n := len(s.x)
+	if h <= s.x[0] {
+		return s.y[0] + s.slope(0)*(h-s.x[0])
+	}
+	if h >= s.x[n-1] {
+		return s.y[n-1] + s.slope(n-1)*(h-s.x[n-1])
+	}
+	lo, hi := 0, n-1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if s.x[mid] > h {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	dx := s.x[hi] - s.x[lo]
+	a := (s.x[hi] - h) / dx
+	b := (h - s.x[lo]) / dx
+	return a*s.y[lo] + b*s.y[hi] + ((a*a*a-a)*s.y2[lo]+(b*b*b-b)*s.y2[hi])*dx*dx/6
+}
+
+// slope returns the spline's first derivative at knot i, which must be an end knot.
+func (s *splineCurve) slope(i int) float64 {
+	n := len(s.x)
+	if i == 0 {
+		dx := s.x[1] - s.x[0]
+		return (s.y[1]-s.y[0])/dx - dx*(2*s.y2[0]+s.y2[1])/6
+	}
+	dx := s.x[n-1] - s.x[n-2]
+	return (s.y[n-1]-s.y[n-2])/dx + dx*(s.y2[n-2]+2*s.y2[n-1])/6
+}
+
+// EnergyCalibrator contains the state needed to convert one channel's pulse heights to energy.
+type EnergyCalibrator struct {
+	EnergyCalibrate bool
+	EnergyInput     string
+	EnergyCoefIndex int
+	energyCurve     energyCurve
+}
+
+// ConfigureEnergyCalibration sets this stream's energy calibration. The config must be valid.
+func (dsp *DataStreamProcessor) ConfigureEnergyCalibration(config *EnergyCalibrationConfig) {
+	dsp.EnergyCalibrate = config.Enable
+	dsp.EnergyInput = config.Input
+	dsp.EnergyCoefIndex = config.CoefIndex
+	dsp.energyCurve = nil
+	if !config.Enable {
+		return
+	}
+	switch config.Kind {
+	case EnergyCalPoly:
+		dsp.energyCurve = polyCurve(append([]float64{}, config.Coefficients...))
+	case EnergyCalSpline:
+		dsp.energyCurve = newSplineCurve(config.Heights, config.Energies)
+	}
+}
+
+// calibrateEnergies sets the filtered pulse height and the energy of each analyzed record.
+// The filtered pulse height is model coefficient EnergyCoefIndex times the drift correction,
+// or NaN if the record has no model coefficients (the channel has no projectors). The
+// energy is NaN if calibration is off or the record lacks the input quantity.
+func (ec *EnergyCalibrator) calibrateEnergies(records []*DataRecord) {
+	for _, rec := range records {
+		rec.filtValue = math.NaN()
+		if ec.EnergyCoefIndex >= 0 && ec.EnergyCoefIndex < len(rec.modelCoefs) {
+			rec.filtValue = rec.modelCoefs[ec.EnergyCoefIndex] * rec.driftCorrection
+		}
+		rec.energy = math.NaN()
+		if !ec.EnergyCalibrate || ec.energyCurve == nil {
+			continue
+		}
+		height := rec.filtValue
+		if ec.EnergyInput == EnergyInputPeak {
+			height = (rec.peakValue - rec.pretrigMean) * rec.driftCorrection
+		}
+		if !math.IsNaN(height) {
+			rec.energy = ec.energyCurve.energy(height)
+		}
+	}
+}
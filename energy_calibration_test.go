@@ -0,0 +1,133 @@
+package dastard
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEnergyCurves(t *testing.T) {
+	poly := polyCurve{1, 2, 3}
+	for _, h := range []float64{-2, 0, 0.5, 10} {
+		want := 1 + 2*h + 3*h*h
+		if e := poly.energy(h); math.Abs(e-want) > 1e-9 {
+			t.Errorf("polyCurve.energy(%v)=%v, want %v", h, e, want)
+		}
+	}
+
+	// A spline must pass through its knots.
+	x := []float64{1000, 2000, 3500, 6000}
+	y := []float64{1.2, 2.5, 4.1, 6.9}
+	spline := newSplineCurve(x, y)
+	for i := range x {
+		if e := spline.energy(x[i]); math.Abs(e-y[i]) > 1e-9 {
+			t.Errorf("splineCurve.energy(%v)=%v, want %v", x[i], e, y[i])
+		}
+	}
+	// Between knots, it's monotonic for this data.
+	if e := spline.energy(2750); e <= y[1] || e >= y[2] {
+		t.Errorf("splineCurve.energy(2750)=%v, want in (%v, %v)", e, y[1], y[2])
+	}
+
+	// A spline through collinear points is that line, including in extrapolation.
+	line := newSplineCurve([]float64{0, 1, 3, 4}, []float64{5, 7, 11, 13})
+	for _, h := range []float64{-10, 0.5, 2, 3.9, 100} {
+		want := 5 + 2*h
+		if e := line.energy(h); math.Abs(e-want) > 1e-9 {
+			t.Errorf("linear splineCurve.energy(%v)=%v, want %v", h, e, want)
+		}
+	}
+}
+
+func TestEnergyCalibrationConfig(t *testing.T) {
+	good := []EnergyCalibrationConfig{
+		{ChannelIndices: []int{0}, Enable: false},
+		{ChannelIndices: []int{0}, Enable: true, Kind: "poly", Coefficients: []float64{0, 1}},
+		{ChannelIndices: []int{0}, Enable: true, Kind: "Spline", Input: "peak",
+			Heights: []float64{1, 2}, Energies: []float64{3, 4}},
+	}
+	for i := range good {
+		if err := good[i].validate(); err != nil {
+			t.Errorf("good config %d failed validate: %v", i, err)
+		}
+	}
+	if good[1].Kind != EnergyCalPoly || good[1].Input != EnergyInputCoef {
+		t.Errorf("validate did not normalize Kind=%q, Input=%q", good[1].Kind, good[1].Input)
+	}
+	if good[2].Kind != EnergyCalSpline || good[2].Input != EnergyInputPeak {
+		t.Errorf("validate did not normalize Kind=%q, Input=%q", good[2].Kind, good[2].Input)
+	}
+
+	bad := []EnergyCalibrationConfig{
+		{Enable: true, Kind: EnergyCalPoly, Coefficients: []float64{0, 1}},
+		{ChannelIndices: []int{0}, Enable: true, Kind: "table", Coefficients: []float64{0, 1}},
+		{ChannelIndices: []int{0}, Enable: true, Kind: EnergyCalPoly},
+		{ChannelIndices: []int{0}, Enable: true, Kind: EnergyCalPoly, Input: "area", Coefficients: []float64{1}},
+		{ChannelIndices: []int{0}, Enable: true, Kind: EnergyCalPoly, CoefIndex: -1, Coefficients: []float64{1}},
+		{ChannelIndices: []int{0}, Enable: true, Kind: EnergyCalSpline, Heights: []float64{1}, Energies: []float64{1}},
+		{ChannelIndices: []int{0}, Enable: true, Kind: EnergyCalSpline, Heights: []float64{1, 2}, Energies: []float64{1}},
+		{ChannelIndices: []int{0}, Enable: true, Kind: EnergyCalSpline, Heights: []float64{2, 2}, Energies: []float64{1, 2}},
+	}
+	for i, config := range bad {
+		if err := config.validate(); err == nil {
+			t.Errorf("bad config %d %+v passed validate", i, config)
+		}
+	}
+}
+
+func TestCalibrateEnergies(t *testing.T) {
+	dsp := &DataStreamProcessor{}
+	records := []*DataRecord{
+		{modelCoefs: []float64{100, 2000}, peakValue: 1500, pretrigMean: 500, driftCorrection: 1},
+		{modelCoefs: []float64{100, 4000}, peakValue: 3500, pretrigMean: 500, driftCorrection: 1.5},
+		{peakValue: 3500, pretrigMean: 500, driftCorrection: 1},
+	}
+
+	// Uncalibrated records have energy NaN, but a filtered pulse height if they have model coefficients.
+	dsp.calibrateEnergies(records)
+	for i, rec := range records {
+		if !math.IsNaN(rec.energy) {
+			t.Errorf("uncalibrated record %d has energy %v, want NaN", i, rec.energy)
+		}
+	}
+	if records[0].filtValue != 100 || records[1].filtValue != 150 || !math.IsNaN(records[2].filtValue) {
+		t.Errorf("filtered pulse heights are %v, %v, %v, want 100, 150, NaN",
+			records[0].filtValue, records[1].filtValue, records[2].filtValue)
+	}
+
+	config := &EnergyCalibrationConfig{ChannelIndices: []int{0}, Enable: true, Kind: EnergyCalPoly,
+		CoefIndex: 1, Coefficients: []float64{0, 0.002}}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	dsp.ConfigureEnergyCalibration(config)
+	dsp.calibrateEnergies(records)
+	expect := []float64{4, 12, math.NaN()}
+	for i, rec := range records {
+		if math.IsNaN(expect[i]) != math.IsNaN(rec.energy) || math.Abs(rec.energy-expect[i]) > 1e-9 {
+			t.Errorf("COEF calibrated record %d has energy %v, want %v", i, rec.energy, expect[i])
+		}
+	}
+	if records[0].filtValue != 2000 || records[1].filtValue != 6000 {
+		t.Errorf("filtered pulse heights are %v, %v, want 2000, 6000", records[0].filtValue, records[1].filtValue)
+	}
+
+	config.Input = EnergyInputPeak
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	dsp.ConfigureEnergyCalibration(config)
+	dsp.calibrateEnergies(records)
+	expect = []float64{2, 9, 6}
+	for i, rec := range records {
+		if math.Abs(rec.energy-expect[i]) > 1e-9 {
+			t.Errorf("PEAK calibrated record %d has energy %v, want %v", i, rec.energy, expect[i])
+		}
+	}
+
+	config.Enable = false
+	dsp.ConfigureEnergyCalibration(config)
+	dsp.calibrateEnergies(records)
+	if !math.IsNaN(records[0].energy) {
+		t.Errorf("record has energy %v after calibration turned off, want NaN", records[0].energy)
+	}
+}
@@ -0,0 +1,228 @@
+package epics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Channel Access value (DBR) types. Each plain type has status (STS), time-stamped
+// (TIME), graphic (GR), and control (CTRL) variants, numbered 7, 14, 21, and 28 higher.
+const (
+	DBRString = 0
+	DBRShort  = 1
+	DBRFloat  = 2
+	DBREnum   = 3
+	DBRChar   = 4
+	DBRLong   = 5
+	DBRDouble = 6
+
+	dbrClassSize = 7  // number of plain types in each variant
+	dbrLastType  = 34 // DBR_CTRL_DOUBLE
+	maxString    = 40 // length of a DBR_STRING, including the terminating NUL
+	maxUnits     = 8
+	maxEnumState = 16
+	maxEnumSize  = 26
+)
+
+// DBR variants, as dbrType / dbrClassSize.
+const (
+	classPlain = iota
+	classSTS
+	classTime
+	classGR
+	classCTRL
+)
+
+// epicsEpoch is the start of EPICS time stamps, 1 Jan 1990 UTC.
+var epicsEpoch = time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// elementSize returns the number of bytes in one element of a plain DBR type.
+func elementSize(base int) int {
+	return [...]int{maxString, 2, 4, 2, 1, 4, 8}[base]
+}
+
+// value is the content of a PV: a string, or one or more numbers.
+type value struct {
+	str     string
+	numbers []float64
+	native  int // DBRString, DBRLong, or DBRDouble
+}
+
+// count returns the PV's native element count.
+func (v *value) count() int {
+	if v.native == DBRString {
+		return 1
+	}
+	return len(v.numbers)
+}
+
+// number returns element i as a number.
+func (v *value) number(i int) float64 {
+	if v.native == DBRString {
+		x, _ := strconv.ParseFloat(strings.TrimSpace(v.str), 64)
+		return x
+	}
+	if i < len(v.numbers) {
+		return v.numbers[i]
+	}
+	return 0
+}
+
+// text returns element i as a string.
+func (v *value) text(i int) string {
+	if v.native == DBRString {
+		return v.str
+	}
+	x := v.number(i)
+	if v.native == DBRLong {
+		return strconv.FormatInt(int64(x), 10)
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+// encode returns the payload (unpadded) of the DBR type dbrType holding count elements
+// of v, updated at the given time.
+func (v *value) encode(dbrType, count int, units string, updated time.Time) ([]byte, error) {
+	if dbrType < 0 || dbrType > dbrLastType {
+		return nil, fmt.Errorf("DBR type %d is not supported", dbrType)
+	}
+	base, class := dbrType%dbrClassSize, dbrType/dbrClassSize
+	buf := new(bytes.Buffer)
+	put := func(data interface{}) { binary.Write(buf, binary.BigEndian, data) }
+	fixed := func(s string, n int) {
+		b := make([]byte, n)
+		copy(b[:n-1], s)
+		buf.Write(b)
+	}
+	pad := func(n int) { buf.Write(make([]byte, n)) }
+
+	if class != classPlain {
+		put([2]int16{0, 0}) // status and severity: no alarm
+	}
+	switch class {
+	case classSTS:
+		switch base {
+		case DBRChar:
+			pad(1)
+		case DBRDouble:
+			pad(4)
+		}
+	case classTime:
+		elapsed := updated.Sub(epicsEpoch)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		put(uint32(elapsed / time.Second))
+		put(uint32(elapsed % time.Second))
+		switch base {
+		case DBRShort, DBREnum:
+			pad(2)
+		case DBRChar:
+			pad(3)
+		case DBRDouble:
+			pad(4)
+		}
+	case classGR, classCTRL:
+		nlimits := 6 // display, alarm, and warning limits, all left at zero
+		if class == classCTRL {
+			nlimits = 8 // and control limits
+		}
+		switch base {
+		case DBRShort, DBRLong:
+			fixed(units, maxUnits)
+			pad(nlimits * elementSize(base))
+		case DBRFloat, DBRDouble:
+			put([2]int16{6, 0}) // display precision and padding
+			fixed(units, maxUnits)
+			pad(nlimits * elementSize(base))
+		case DBRChar:
+			fixed(units, maxUnits)
+			pad(nlimits + 1)
+		case DBREnum:
+			put(int16(0)) // no state strings
+			pad(maxEnumState * maxEnumSize)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		switch base {
+		case DBRString:
+			fixed(v.text(i), maxString)
+		case DBRShort, DBREnum:
+			put(int16(clamp(v.number(i), math.MinInt16, math.MaxInt16)))
+		case DBRFloat:
+			put(float32(v.number(i)))
+		case DBRChar:
+			put(uint8(clamp(v.number(i), 0, math.MaxUint8)))
+		case DBRLong:
+			put(int32(clamp(v.number(i), math.MinInt32, math.MaxInt32)))
+		case DBRDouble:
+			put(v.number(i))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// clamp rounds x to the nearest integer in [lo,hi].
+func clamp(x, lo, hi float64) float64 {
+	if math.IsNaN(x) {
+		return 0
+	}
+	return math.Max(lo, math.Min(hi, math.Floor(x+0.5)))
+}
+
+// decode converts the payload of a write of count elements of the plain DBR type
+// dbrType to a value of the native type.
+func decode(payload []byte, dbrType, count, native int) (*value, error) {
+	if dbrType < 0 || dbrType >= dbrClassSize {
+		return nil, fmt.Errorf("DBR type %d can't be written", dbrType)
+	}
+	size := elementSize(dbrType)
+	if count < 1 || len(payload) < count*size {
+		return nil, fmt.Errorf("write of %d elements of DBR type %d has only %d bytes", count, dbrType, len(payload))
+	}
+	v := &value{native: native}
+	if dbrType == DBRString {
+		text := string(payload[:maxString])
+		if i := strings.IndexByte(text, 0); i >= 0 {
+			text = text[:i]
+		}
+		if native == DBRString {
+			v.str = text
+			return v, nil
+		}
+		x, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("can't write %q to a numeric PV", text)
+		}
+		v.numbers = []float64{x}
+		return v, nil
+	}
+	numbers := make([]float64, count)
+	for i := range numbers {
+		b := payload[i*size : (i+1)*size]
+		switch dbrType {
+		case DBRShort, DBREnum:
+			numbers[i] = float64(int16(binary.BigEndian.Uint16(b)))
+		case DBRFloat:
+			numbers[i] = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		case DBRChar:
+			numbers[i] = float64(b[0])
+		case DBRLong:
+			numbers[i] = float64(int32(binary.BigEndian.Uint32(b)))
+		case DBRDouble:
+			numbers[i] = math.Float64frombits(binary.BigEndian.Uint64(b))
+		}
+	}
+	if native == DBRString {
+		v.str = strconv.FormatFloat(numbers[0], 'g', -1, 64)
+		return v, nil
+	}
+	v.numbers = numbers
+	return v, nil
+}
@@ -0,0 +1,594 @@
+// Package epics provides a minimal EPICS Channel Access server, so that process
+// variables (PVs) can be read, monitored, and written by EPICS clients (caget,
+// camonitor, caput, pyepics, or an IOC). It handles name searches over UDP and the
+// channel, read, write, and monitor requests of protocol version 4.13 over TCP. It
+// sends no beacons, and every client may read every PV (and write the writable ones).
+package epics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel Access commands used by the server.
+const (
+	cmdVersion      = 0
+	cmdEventAdd     = 1
+	cmdEventCancel  = 2
+	cmdWrite        = 4
+	cmdSearch       = 6
+	cmdEventsOff    = 8
+	cmdEventsOn     = 9
+	cmdReadSync     = 10
+	cmdClearChannel = 12
+	cmdReadNotify   = 15
+	cmdCreateChan   = 18
+	cmdWriteNotify  = 19
+	cmdClientName   = 20
+	cmdHostName     = 21
+	cmdAccessRights = 22
+	cmdEcho         = 23
+	cmdCreateChFail = 26
+)
+
+// Channel Access status codes used by the server.
+const (
+	ecaNormal     = 1
+	ecaBadType    = 114
+	ecaPutFail    = 160
+	ecaNoWtAccess = 328
+)
+
+// DefaultPort is the standard port of Channel Access servers, both UDP and TCP.
+const DefaultPort = 5064
+
+const (
+	minorVersion = 13      // protocol minor version of this server
+	headerSize   = 16      // bytes in a message header, unless extended
+	maxPayload   = 1 << 20 // largest payload accepted from a client
+	sendQueue    = 1000    // messages queued to each client before monitor updates are dropped
+)
+
+// header is a Channel Access message header.
+type header struct {
+	command  uint16
+	size     uint32 // payload bytes
+	dataType uint16
+	count    uint32
+	param1   uint32
+	param2   uint32
+}
+
+// message returns the bytes of a message with this header and the given payload,
+// padded to a multiple of 8 bytes. The extended header is used if needed.
+func (h header) message(payload []byte) []byte {
+	padded := (len(payload) + 7) &^ 7
+	buf := new(bytes.Buffer)
+	if padded < 0xffff && h.count < 0xffff {
+		binary.Write(buf, binary.BigEndian, []uint16{h.command, uint16(padded), h.dataType, uint16(h.count)})
+		binary.Write(buf, binary.BigEndian, []uint32{h.param1, h.param2})
+	} else {
+		binary.Write(buf, binary.BigEndian, []uint16{h.command, 0xffff, h.dataType, 0})
+		binary.Write(buf, binary.BigEndian, []uint32{h.param1, h.param2, uint32(padded), h.count})
+	}
+	buf.Write(payload)
+	buf.Write(make([]byte, padded-len(payload)))
+	return buf.Bytes()
+}
+
+// readMessage reads one message from r.
+func readMessage(r io.Reader) (header, []byte, error) {
+	var raw [headerSize]byte
+	if _, err := io.ReadFull(r, raw[:]); err != nil {
+		return header{}, nil, err
+	}
+	h := header{command: binary.BigEndian.Uint16(raw[0:]), size: uint32(binary.BigEndian.Uint16(raw[2:])),
+		dataType: binary.BigEndian.Uint16(raw[4:]), count: uint32(binary.BigEndian.Uint16(raw[6:])),
+		param1: binary.BigEndian.Uint32(raw[8:]), param2: binary.BigEndian.Uint32(raw[12:])}
+	if h.size == 0xffff {
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return header{}, nil, err
+		}
+		h.size, h.count = binary.BigEndian.Uint32(ext[0:]), binary.BigEndian.Uint32(ext[4:])
+	}
+	if h.size > maxPayload {
+		return header{}, nil, fmt.Errorf("Channel Access message of %d bytes is too long", h.size)
+	}
+	payload := make([]byte, h.size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return header{}, nil, err
+	}
+	return h, payload, nil
+}
+
+// pvName returns the NUL-terminated name at the start of a payload.
+func pvName(payload []byte) string {
+	if i := bytes.IndexByte(payload, 0); i >= 0 {
+		payload = payload[:i]
+	}
+	return string(payload)
+}
+
+// PV is one process variable served by a Server.
+type PV struct {
+	name     string
+	units    string
+	value    *value
+	updated  time.Time
+	onWrite  func(interface{}) error
+	monitors map[*monitor]bool
+	sync.Mutex
+}
+
+// Name returns the PV's name.
+func (pv *PV) Name() string {
+	return pv.name
+}
+
+// SetUnits sets the engineering units reported to clients that ask for them.
+func (pv *PV) SetUnits(units string) {
+	pv.Lock()
+	defer pv.Unlock()
+	pv.units = units
+}
+
+// OnWrite makes the PV writable by clients. When a client writes, f is called with the
+// new value (of the PV's type); the write changes the PV only if f returns nil.
+func (pv *PV) OnWrite(f func(interface{}) error) {
+	pv.Lock()
+	defer pv.Unlock()
+	pv.onWrite = f
+}
+
+// newValue converts a Go value to a PV value: a string, an integer (DBR_LONG), a
+// float64 (DBR_DOUBLE), or a slice of either type of number.
+func newValue(x interface{}) (*value, error) {
+	switch x := x.(type) {
+	case string:
+		return &value{native: DBRString, str: x}, nil
+	case bool:
+		if x {
+			return &value{native: DBRLong, numbers: []float64{1}}, nil
+		}
+		return &value{native: DBRLong, numbers: []float64{0}}, nil
+	case int:
+		return &value{native: DBRLong, numbers: []float64{float64(x)}}, nil
+	case int32:
+		return &value{native: DBRLong, numbers: []float64{float64(x)}}, nil
+	case int64:
+		return &value{native: DBRLong, numbers: []float64{float64(x)}}, nil
+	case float64:
+		return &value{native: DBRDouble, numbers: []float64{x}}, nil
+	case []int:
+		v := &value{native: DBRLong, numbers: make([]float64, len(x))}
+		for i := range x {
+			v.numbers[i] = float64(x[i])
+		}
+		return v, nil
+	case []float64:
+		return &value{native: DBRDouble, numbers: append([]float64{}, x...)}, nil
+	}
+	return nil, fmt.Errorf("PV values of type %T are not supported", x)
+}
+
+// goValue converts a PV value back to the Go value that Set would take.
+func (v *value) goValue() interface{} {
+	switch {
+	case v.native == DBRString:
+		return v.str
+	case v.native == DBRLong && len(v.numbers) == 1:
+		return int(v.numbers[0])
+	case v.native == DBRLong:
+		numbers := make([]int, len(v.numbers))
+		for i, x := range v.numbers {
+			numbers[i] = int(x)
+		}
+		return numbers
+	case len(v.numbers) == 1:
+		return v.numbers[0]
+	}
+	return append([]float64{}, v.numbers...)
+}
+
+// Set changes the PV's value and sends it to all clients monitoring the PV. The value
+// must have the same type as the PV was created with (or be a slice of that type).
+func (pv *PV) Set(x interface{}) error {
+	v, err := newValue(x)
+	if err != nil {
+		return err
+	}
+	return pv.set(v)
+}
+
+// Get returns the PV's value.
+func (pv *PV) Get() interface{} {
+	pv.Lock()
+	defer pv.Unlock()
+	return pv.value.goValue()
+}
+
+func (pv *PV) set(v *value) error {
+	pv.Lock()
+	if v.native != pv.value.native {
+		pv.Unlock()
+		return fmt.Errorf("PV %s can't change type", pv.name)
+	}
+	pv.value = v
+	pv.updated = time.Now()
+	monitors := make([]*monitor, 0, len(pv.monitors))
+	for m := range pv.monitors {
+		monitors = append(monitors, m)
+	}
+	pv.Unlock()
+	for _, m := range monitors {
+		m.send()
+	}
+	return nil
+}
+
+// encode returns the PV's value as count elements of the DBR type dbrType, or the
+// native count if count is 0. It also returns the element count.
+func (pv *PV) encode(dbrType, count int) ([]byte, int, error) {
+	pv.Lock()
+	defer pv.Unlock()
+	if count == 0 || count > pv.value.count() {
+		count = pv.value.count()
+	}
+	payload, err := pv.value.encode(dbrType, count, pv.units, pv.updated)
+	return payload, count, err
+}
+
+// write applies a client's write of count elements of type dbrType.
+func (pv *PV) write(payload []byte, dbrType, count int) uint32 {
+	pv.Lock()
+	onWrite, native := pv.onWrite, pv.value.native
+	pv.Unlock()
+	if onWrite == nil {
+		return ecaNoWtAccess
+	}
+	v, err := decode(payload, dbrType, count, native)
+	if err != nil {
+		return ecaBadType
+	}
+	if err := onWrite(v.goValue()); err != nil {
+		return ecaPutFail
+	}
+	pv.set(v)
+	return ecaNormal
+}
+
+// monitor is one client's subscription to a PV's changes.
+type monitor struct {
+	pv       *PV
+	conn     *conn
+	id       uint32
+	dataType int
+	count    int
+}
+
+// send sends the PV's current value to the monitoring client. If the client's queue is
+// full, the update is dropped; a later one will bring the client up to date.
+func (m *monitor) send() {
+	payload, count, err := m.pv.encode(m.dataType, m.count)
+	status := uint32(ecaNormal)
+	if err != nil {
+		payload, count, status = nil, 0, ecaBadType
+	}
+	h := header{command: cmdEventAdd, dataType: uint16(m.dataType), count: uint32(count), param1: status, param2: m.id}
+	select {
+	case m.conn.out <- h.message(payload):
+	case <-m.conn.done:
+	default:
+	}
+}
+
+// Server serves a set of PVs over Channel Access.
+type Server struct {
+	pvs   map[string]*PV
+	tcp   net.Listener
+	udp   *net.UDPConn
+	conns map[*conn]bool
+	sync.Mutex
+}
+
+// NewServer returns a Server with no PVs.
+func NewServer() *Server {
+	return &Server{pvs: make(map[string]*PV), conns: make(map[*conn]bool)}
+}
+
+// AddPV adds a PV with the given name and initial value, which sets its type: a
+// string, an integer, a float64, or a slice of integers or float64s.
+func (s *Server) AddPV(name string, initial interface{}) (*PV, error) {
+	v, err := newValue(initial)
+	if err != nil {
+		return nil, err
+	}
+	if len(name) == 0 || len(name) >= 256 || strings.ContainsAny(name, " \x00") {
+		return nil, fmt.Errorf("PV name %q is invalid", name)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.pvs[name]; ok {
+		return nil, fmt.Errorf("PV %s already exists", name)
+	}
+	pv := &PV{name: name, value: v, updated: time.Now(), monitors: make(map[*monitor]bool)}
+	s.pvs[name] = pv
+	return pv, nil
+}
+
+// lookup returns the named PV, or nil.
+func (s *Server) lookup(name string) *PV {
+	s.Lock()
+	defer s.Unlock()
+	return s.pvs[name]
+}
+
+// Listen starts serving on the given TCP port and on the same UDP port for name
+// searches. Port 0 picks any free TCP port and UDP port, as for tests.
+func (s *Server) Listen(port int) error {
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		tcp.Close()
+		return err
+	}
+	s.Lock()
+	s.tcp, s.udp = tcp, udp
+	s.Unlock()
+	go s.serveSearches(udp, uint16(tcp.Addr().(*net.TCPAddr).Port))
+	go s.serveConnections(tcp)
+	return nil
+}
+
+// TCPAddr returns the address of the TCP listener, or nil if not listening.
+func (s *Server) TCPAddr() net.Addr {
+	s.Lock()
+	defer s.Unlock()
+	if s.tcp == nil {
+		return nil
+	}
+	return s.tcp.Addr()
+}
+
+// UDPAddr returns the address where name searches are answered, or nil if not listening.
+func (s *Server) UDPAddr() net.Addr {
+	s.Lock()
+	defer s.Unlock()
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Close stops the server and closes all client connections.
+func (s *Server) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	var err error
+	if s.tcp != nil {
+		err = s.tcp.Close()
+		s.udp.Close()
+		s.tcp, s.udp = nil, nil
+	}
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+	return err
+}
+
+// serveSearches answers the UDP search requests for the server's PVs.
+func (s *Server) serveSearches(udp *net.UDPConn, tcpPort uint16) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(buf[:n])
+		var reply []byte
+		for r.Len() > 0 {
+			h, payload, err := readMessage(r)
+			if err != nil {
+				break
+			}
+			if h.command != cmdSearch || s.lookup(pvName(payload)) == nil {
+				continue
+			}
+			if reply == nil {
+				reply = header{command: cmdVersion, count: minorVersion}.message(nil)
+			}
+			// Server address 0xffffffff means "the address the reply came from".
+			found := header{command: cmdSearch, dataType: tcpPort, param1: 0xffffffff, param2: h.param1}
+			reply = append(reply, found.message([]byte{0, minorVersion})...)
+		}
+		if reply != nil {
+			udp.WriteToUDP(reply, addr)
+		}
+	}
+}
+
+// serveConnections accepts TCP connections from clients.
+func (s *Server) serveConnections(listener net.Listener) {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{server: s, netConn: netConn, out: make(chan []byte, sendQueue),
+			done: make(chan struct{}), channels: make(map[uint32]*channel)}
+		s.Lock()
+		s.conns[c] = true
+		s.Unlock()
+		go c.writeLoop()
+		go c.serve()
+	}
+}
+
+// channel is one client's connection to one PV.
+type channel struct {
+	pv       *PV
+	cid      uint32
+	monitors map[uint32]*monitor
+}
+
+// conn is one client's TCP connection.
+type conn struct {
+	server   *Server
+	netConn  net.Conn
+	out      chan []byte   // messages waiting to be sent
+	done     chan struct{} // closed when the client disconnects
+	channels map[uint32]*channel
+	nextSID  uint32
+}
+
+// writeLoop sends the queued messages until the client disconnects.
+func (c *conn) writeLoop() {
+	for {
+		select {
+		case message := <-c.out:
+			if _, err := c.netConn.Write(message); err != nil {
+				c.netConn.Close() // so that serve returns
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// serve handles the client's requests until it disconnects.
+func (c *conn) serve() {
+	defer func() {
+		for _, ch := range c.channels {
+			c.clearMonitors(ch)
+		}
+		c.server.Lock()
+		delete(c.server.conns, c)
+		c.server.Unlock()
+		c.netConn.Close()
+		close(c.done)
+	}()
+	for {
+		h, payload, err := readMessage(c.netConn)
+		if err != nil {
+			return
+		}
+		c.handle(h, payload)
+	}
+}
+
+// clearMonitors ends all of a channel's monitors.
+func (c *conn) clearMonitors(ch *channel) {
+	ch.pv.Lock()
+	defer ch.pv.Unlock()
+	for _, m := range ch.monitors {
+		delete(ch.pv.monitors, m)
+	}
+}
+
+// handle handles one request from the client.
+func (c *conn) handle(h header, payload []byte) {
+	send := func(h header, payload []byte) {
+		select {
+		case c.out <- h.message(payload):
+		case <-c.done:
+		}
+	}
+	switch h.command {
+	case cmdVersion:
+		send(header{command: cmdVersion, count: minorVersion}, nil)
+
+	case cmdEcho:
+		send(header{command: cmdEcho}, nil)
+
+	case cmdCreateChan:
+		cid := h.param1
+		pv := c.server.lookup(pvName(payload))
+		if pv == nil {
+			send(header{command: cmdCreateChFail, param1: cid}, nil)
+			return
+		}
+		c.nextSID++
+		sid := c.nextSID
+		c.channels[sid] = &channel{pv: pv, cid: cid, monitors: make(map[uint32]*monitor)}
+		pv.Lock()
+		rights := uint32(1) // read access
+		if pv.onWrite != nil {
+			rights |= 2 // write access
+		}
+		native, count := pv.value.native, pv.value.count()
+		pv.Unlock()
+		send(header{command: cmdAccessRights, param1: cid, param2: rights}, nil)
+		send(header{command: cmdCreateChan, dataType: uint16(native), count: uint32(count), param1: cid, param2: sid}, nil)
+
+	case cmdClearChannel:
+		if ch, ok := c.channels[h.param1]; ok {
+			c.clearMonitors(ch)
+			delete(c.channels, h.param1)
+		}
+		send(header{command: cmdClearChannel, param1: h.param1, param2: h.param2}, nil)
+
+	case cmdReadNotify:
+		ch, ok := c.channels[h.param1]
+		if !ok {
+			return
+		}
+		data, count, err := ch.pv.encode(int(h.dataType), int(h.count))
+		status := uint32(ecaNormal)
+		if err != nil {
+			data, count, status = nil, 0, ecaBadType
+		}
+		send(header{command: cmdReadNotify, dataType: h.dataType, count: uint32(count), param1: status, param2: h.param2}, data)
+
+	case cmdReadSync:
+		send(h, nil)
+
+	case cmdWrite, cmdWriteNotify:
+		ch, ok := c.channels[h.param1]
+		if !ok {
+			return
+		}
+		status := ch.pv.write(payload, int(h.dataType), int(h.count))
+		if h.command == cmdWriteNotify {
+			send(header{command: cmdWriteNotify, dataType: h.dataType, count: h.count, param1: status, param2: h.param2}, nil)
+		}
+
+	case cmdEventAdd:
+		ch, ok := c.channels[h.param1]
+		if !ok {
+			return
+		}
+		m := &monitor{pv: ch.pv, conn: c, id: h.param2, dataType: int(h.dataType), count: int(h.count)}
+		ch.monitors[m.id] = m
+		ch.pv.Lock()
+		ch.pv.monitors[m] = true
+		ch.pv.Unlock()
+		m.send()
+
+	case cmdEventCancel:
+		ch, ok := c.channels[h.param1]
+		if !ok {
+			return
+		}
+		if m, ok := ch.monitors[h.param2]; ok {
+			ch.pv.Lock()
+			delete(ch.pv.monitors, m)
+			ch.pv.Unlock()
+			delete(ch.monitors, h.param2)
+		}
+		send(header{command: cmdEventAdd, dataType: h.dataType, count: h.count, param1: h.param1, param2: h.param2}, nil)
+
+	case cmdClientName, cmdHostName, cmdEventsOff, cmdEventsOn:
+		// Every client has the same access, so names are not needed.
+	}
+}
@@ -0,0 +1,238 @@
+package epics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClient speaks just enough Channel Access to test the server.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (tc *testClient) send(h header, payload []byte) {
+	if _, err := tc.conn.Write(h.message(payload)); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// expect reads messages until one with the given command arrives.
+func (tc *testClient) expect(command uint16) (header, []byte) {
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		h, payload, err := readMessage(tc.conn)
+		if err != nil {
+			tc.t.Fatalf("waiting for command %d: %v", command, err)
+		}
+		if h.command == command {
+			return h, payload
+		}
+	}
+}
+
+func nameBytes(name string) []byte {
+	return append([]byte(name), 0)
+}
+
+func TestDBR(t *testing.T) {
+	v, _ := newValue(2.5)
+	updated := epicsEpoch.Add(100*time.Second + 7)
+	for _, test := range []struct {
+		dbrType int
+		want    []byte
+	}{
+		{DBRDouble, []byte{0x40, 0x04, 0, 0, 0, 0, 0, 0}},
+		{DBRLong, []byte{0, 0, 0, 3}},
+		{DBRShort + 7, []byte{0, 0, 0, 0, 0, 3}}, // STS
+		{DBRDouble + 14, []byte{0, 0, 0, 0, 0, 0, 0, 100, 0, 0, 0, 7, 0, 0, 0, 0, 0x40, 4, 0, 0, 0, 0, 0, 0}}, // TIME
+	} {
+		payload, err := v.encode(test.dbrType, 1, "", updated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, test.want) {
+			t.Errorf("DBR type %d encodes 2.5 as %v, want %v", test.dbrType, payload, test.want)
+		}
+	}
+	// The GR and CTRL types have fixed sizes before the value.
+	for dbrType, size := range map[int]int{DBRDouble + 21: 72, DBRDouble + 28: 88, DBRLong + 21: 40,
+		DBRLong + 28: 48, DBRString + 28: 44, DBREnum + 28: 424} {
+		payload, _ := v.encode(dbrType, 1, "MB/s", updated)
+		if len(payload) != size {
+			t.Errorf("DBR type %d has %d bytes, want %d", dbrType, len(payload), size)
+		}
+	}
+	if _, err := v.encode(35, 1, "", updated); err == nil {
+		t.Error("encoding DBR type 35 should fail")
+	}
+
+	s, _ := newValue("hello")
+	payload, _ := s.encode(DBRString, 1, "", updated)
+	if len(payload) != maxString || string(payload[:6]) != "hello\x00" {
+		t.Errorf("DBR_STRING encodes %q as %v", "hello", payload)
+	}
+	w, err := decode(payload, DBRString, 1, DBRString)
+	if err != nil || w.str != "hello" {
+		t.Errorf("decode gives %+v, %v, want hello", w, err)
+	}
+	w, err = decode([]byte{0, 0, 0, 42}, DBRLong, 1, DBRDouble)
+	if err != nil || w.numbers[0] != 42 {
+		t.Errorf("decode DBR_LONG 42 to double gives %+v, %v", w, err)
+	}
+	if _, err = decode(nameBytes("x"), DBRString, 1, DBRDouble); err == nil {
+		t.Error("decoding a non-numeric string into a double PV should fail")
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	rate, err := s.AddPV("TEST:RATE", 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate.SetUnits("Hz")
+	label, _ := s.AddPV("TEST:LABEL", "start")
+	var written []interface{}
+	label.OnWrite(func(x interface{}) error {
+		if x == "bad" {
+			return fmt.Errorf("bad label")
+		}
+		written = append(written, x)
+		return nil
+	})
+	s.AddPV("TEST:ARRAY", []float64{1, 2, 3})
+	if _, err := s.AddPV("TEST:RATE", 2.0); err == nil {
+		t.Error("adding a PV twice should fail")
+	}
+	if _, err := s.AddPV("TEST:BAD", struct{}{}); err == nil {
+		t.Error("adding a PV of an unsupported type should fail")
+	}
+	if err := s.Listen(0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Search over UDP.
+	udp, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.UDPAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	search := append(header{command: cmdVersion, count: minorVersion}.message(nil),
+		header{command: cmdSearch, dataType: 5, count: minorVersion, param1: 77, param2: 77}.message(nameBytes("TEST:NONE"))...)
+	search = append(search, header{command: cmdSearch, dataType: 5, count: minorVersion, param1: 78, param2: 78}.message(nameBytes("TEST:RATE"))...)
+	udp.Write(search)
+	udp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1000)
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buf[:n])
+	readMessage(r) // version
+	h, _, err := readMessage(r)
+	tcpPort := s.TCPAddr().(*net.TCPAddr).Port
+	if err != nil || h.command != cmdSearch || h.param2 != 78 || int(h.dataType) != tcpPort || r.Len() != 0 {
+		t.Errorf("search reply is %+v (err %v), want only the reply for search ID 78 and port %d", h, err, tcpPort)
+	}
+
+	// Connect over TCP and create channels.
+	netConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+	tc := &testClient{t: t, conn: netConn}
+	tc.send(header{command: cmdVersion, count: minorVersion}, nil)
+	tc.send(header{command: cmdClientName}, nameBytes("tester"))
+	tc.expect(cmdVersion)
+	create := func(name string, cid uint32) (header, uint32) {
+		tc.send(header{command: cmdCreateChan, param1: cid, param2: minorVersion}, nameBytes(name))
+		access, _ := tc.expect(cmdAccessRights)
+		h, _ := tc.expect(cmdCreateChan)
+		return h, access.param2
+	}
+	h, rights := create("TEST:RATE", 1)
+	rateSID := h.param2
+	if h.dataType != DBRDouble || h.count != 1 || h.param1 != 1 || rights != 1 {
+		t.Errorf("create TEST:RATE gives %+v with access %d", h, rights)
+	}
+	h, rights = create("TEST:LABEL", 2)
+	labelSID := h.param2
+	if h.dataType != DBRString || rights != 3 {
+		t.Errorf("create TEST:LABEL gives %+v with access %d, want DBR_STRING and read/write", h, rights)
+	}
+	tc.send(header{command: cmdCreateChan, param1: 3, param2: minorVersion}, nameBytes("TEST:NONE"))
+	if h, _ := tc.expect(cmdCreateChFail); h.param1 != 3 {
+		t.Errorf("create TEST:NONE fails with %+v", h)
+	}
+
+	// Read as a double and as a string.
+	tc.send(header{command: cmdReadNotify, dataType: DBRDouble, count: 1, param1: rateSID, param2: 11}, nil)
+	h, payload := tc.expect(cmdReadNotify)
+	if x := math.Float64frombits(binary.BigEndian.Uint64(payload)); h.param1 != ecaNormal || h.param2 != 11 || x != 1.5 {
+		t.Errorf("read TEST:RATE gives %+v, value %v", h, x)
+	}
+	tc.send(header{command: cmdReadNotify, dataType: DBRString, count: 1, param1: rateSID, param2: 12}, nil)
+	if _, payload = tc.expect(cmdReadNotify); pvName(payload) != "1.5" {
+		t.Errorf("read TEST:RATE as string gives %q", pvName(payload))
+	}
+
+	// Monitor, and see the initial value and a change.
+	tc.send(header{command: cmdEventAdd, dataType: DBRDouble + 14, count: 1, param1: rateSID, param2: 21}, make([]byte, 16))
+	h, payload = tc.expect(cmdEventAdd)
+	if h.param2 != 21 || len(payload) != 24 {
+		t.Errorf("monitor TEST:RATE gives %+v with %d bytes", h, len(payload))
+	}
+	rate.Set(4.0)
+	_, payload = tc.expect(cmdEventAdd)
+	if x := math.Float64frombits(binary.BigEndian.Uint64(payload[16:])); x != 4 {
+		t.Errorf("monitor TEST:RATE after Set(4) gives %v", x)
+	}
+	tc.send(header{command: cmdEventCancel, dataType: DBRDouble + 14, count: 1, param1: rateSID, param2: 21}, nil)
+	if h, payload = tc.expect(cmdEventAdd); h.param2 != 21 || len(payload) != 0 {
+		t.Errorf("cancel monitor gives %+v", h)
+	}
+
+	// Write to the writable PV, and fail to write to the read-only one.
+	write := func(sid uint32, text string) uint32 {
+		data := make([]byte, maxString)
+		copy(data, text)
+		tc.send(header{command: cmdWriteNotify, dataType: DBRString, count: 1, param1: sid, param2: 31}, data)
+		h, _ := tc.expect(cmdWriteNotify)
+		return h.param1
+	}
+	if status := write(labelSID, "calibration"); status != ecaNormal || label.Get() != "calibration" ||
+		len(written) != 1 || written[0] != "calibration" {
+		t.Errorf("write TEST:LABEL gives status %d, value %v, written %v", status, label.Get(), written)
+	}
+	if status := write(labelSID, "bad"); status != ecaPutFail || label.Get() != "calibration" {
+		t.Errorf("rejected write gives status %d, value %v", status, label.Get())
+	}
+	if status := write(rateSID, "7"); status != ecaNoWtAccess || rate.Get() != 4.0 {
+		t.Errorf("write to read-only PV gives status %d, value %v", status, rate.Get())
+	}
+
+	// Arrays, read whole (count 0) or in part.
+	h, _ = create("TEST:ARRAY", 4)
+	arraySID := h.param2
+	tc.send(header{command: cmdReadNotify, dataType: DBRLong, count: 0, param1: arraySID, param2: 41}, nil)
+	if h, payload = tc.expect(cmdReadNotify); h.count != 3 || binary.BigEndian.Uint32(payload[8:]) != 3 {
+		t.Errorf("read TEST:ARRAY gives %+v %v", h, payload)
+	}
+	tc.send(header{command: cmdReadNotify, dataType: DBRLong, count: 2, param1: arraySID, param2: 42}, nil)
+	if h, _ = tc.expect(cmdReadNotify); h.count != 2 {
+		t.Errorf("read 2 elements of TEST:ARRAY gives %d", h.count)
+	}
+
+	tc.send(header{command: cmdClearChannel, param1: rateSID, param2: 1}, nil)
+	if h, _ = tc.expect(cmdClearChannel); h.param1 != rateSID {
+		t.Errorf("clear channel gives %+v", h)
+	}
+}
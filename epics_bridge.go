@@ -0,0 +1,207 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/usnistgov/dastard/epics"
+)
+
+// EPICSConfig holds the configuration of the optional EPICS Channel Access server. It
+// is read from the "epics" key of the config file when Dastard starts.
+type EPICSConfig struct {
+	Enabled bool
+	Prefix  string // prepended to every PV name; empty means "DASTARD:"
+	Port    int    // TCP and UDP port of the server; 0 means the standard 5064
+}
+
+// epicsBridge serves Dastard's status as EPICS process variables (PVs), and passes
+// writes to its control PVs on to SourceControl. The PVs are, after the prefix:
+//
+//	RUNNING, SOURCE, NCHAN        whether a source is running, its name and channels
+//	DATA_RATE, FRAME_RATE         data read from the source (MB/s, frames/s)
+//	TRIG_RATE, TRIG_RATES         triggers per second, in total and per channel
+//	WRITING, PAUSED               whether files are being written (writable: 1 starts, 0 stops)
+//	                              and writing is paused (writable)
+//	RUN_DIR, NUM_WRITTEN          directory of the run being written, records written
+//	STATE_LABEL                   the experiment state label (writable while writing)
+type epicsBridge struct {
+	sc     *SourceControl
+	server *epics.Server
+	pvs    map[string]*epics.PV
+	subID  int
+	lock   sync.Mutex // one control request at a time
+}
+
+// epicsStatusTags are the status messages that the bridge turns into PVs.
+var epicsStatusTags = []string{"STATUS", "ALIVE", "TRIGGERRATE", "WRITING", "NUMBERWRITTEN"}
+
+// startEPICSBridge starts the Channel Access server and the goroutine that updates its
+// PVs from the published status messages.
+func startEPICSBridge(sc *SourceControl, config EPICSConfig) (*epicsBridge, error) {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = "DASTARD:"
+	}
+	port := config.Port
+	if port == 0 {
+		port = epics.DefaultPort
+	}
+	b := &epicsBridge{sc: sc, server: epics.NewServer(), pvs: make(map[string]*epics.PV)}
+	for _, pv := range []struct {
+		name    string
+		initial interface{}
+		units   string
+	}{
+		{"RUNNING", 0, ""}, {"SOURCE", "", ""}, {"NCHAN", 0, ""},
+		{"DATA_RATE", 0.0, "MB/s"}, {"FRAME_RATE", 0.0, "Hz"},
+		{"TRIG_RATE", 0.0, "Hz"}, {"TRIG_RATES", []float64{}, "Hz"},
+		{"WRITING", 0, ""}, {"PAUSED", 0, ""}, {"RUN_DIR", "", ""}, {"NUM_WRITTEN", 0, ""},
+		{"STATE_LABEL", "", ""},
+	} {
+		p, err := b.server.AddPV(prefix+pv.name, pv.initial)
+		if err != nil {
+			return nil, err
+		}
+		p.SetUnits(pv.units)
+		b.pvs[pv.name] = p
+	}
+	b.pvs["WRITING"].OnWrite(func(x interface{}) error { return b.setWriting(x.(int) != 0) })
+	b.pvs["PAUSED"].OnWrite(func(x interface{}) error { return b.setPaused(x.(int) != 0) })
+	b.pvs["STATE_LABEL"].OnWrite(func(x interface{}) error { return b.setStateLabel(x.(string)) })
+
+	id, err := statusSubscribers.add(&StatusSubscription{Tags: epicsStatusTags})
+	if err != nil {
+		return nil, err
+	}
+	b.subID = id
+	if err := b.server.Listen(port); err != nil {
+		statusSubscribers.remove(id)
+		return nil, fmt.Errorf("EPICS server could not listen on port %d: %v", port, err)
+	}
+	for _, tag := range epicsStatusTags {
+		if message, _, ok := latestStatus.get(tag); ok {
+			b.update(tag, message)
+		}
+	}
+	go b.run()
+	logInfof("EPICS Channel Access server is serving PVs %s* on port %d", prefix, port)
+	return b, nil
+}
+
+// run updates the PVs from the status messages, until the server closes.
+func (b *epicsBridge) run() {
+	for {
+		// Poll well within the statusSubscriptionTimeout.
+		messages, ready, _, err := statusSubscribers.take(b.subID)
+		if err != nil {
+			return
+		}
+		for _, msg := range messages {
+			b.update(msg.Tag, msg.State)
+		}
+		select {
+		case <-ready:
+		case <-time.After(statusSubscriptionTimeout / 4):
+		}
+	}
+}
+
+// close stops the server and the status subscription.
+func (b *epicsBridge) close() {
+	statusSubscribers.remove(b.subID)
+	b.server.Close()
+}
+
+// update sets the PVs that depend on one status message.
+func (b *epicsBridge) update(tag string, message []byte) {
+	boolInt := func(x bool) int {
+		if x {
+			return 1
+		}
+		return 0
+	}
+	switch tag {
+	case "STATUS":
+		var status ServerStatus
+		if json.Unmarshal(message, &status) == nil {
+			b.pvs["RUNNING"].Set(boolInt(status.Running))
+			b.pvs["SOURCE"].Set(status.SourceName)
+			b.pvs["NCHAN"].Set(status.Nchannels)
+		}
+	case "ALIVE":
+		var alive Heartbeat
+		if json.Unmarshal(message, &alive) == nil {
+			b.pvs["DATA_RATE"].Set(alive.DataMBps)
+			b.pvs["FRAME_RATE"].Set(alive.FramesPerSec)
+		}
+	case "TRIGGERRATE":
+		var trm TriggerRateMessage
+		if json.Unmarshal(message, &trm) == nil && trm.Duration > 0 {
+			rates := make([]float64, len(trm.CountsSeen))
+			total := 0.0
+			for i, counts := range trm.CountsSeen {
+				rates[i] = float64(counts) / trm.Duration.Seconds()
+				total += rates[i]
+			}
+			b.pvs["TRIG_RATES"].Set(rates)
+			b.pvs["TRIG_RATE"].Set(total)
+		}
+	case "WRITING":
+		var ws WritingState
+		if json.Unmarshal(message, &ws) == nil {
+			b.pvs["WRITING"].Set(boolInt(ws.Active))
+			b.pvs["PAUSED"].Set(boolInt(ws.Paused))
+			b.pvs["RUN_DIR"].Set(ws.RunDirectory)
+			b.pvs["STATE_LABEL"].Set(ws.ExperimentStateLabel)
+		}
+	case "NUMBERWRITTEN":
+		var nw struct{ NumberWritten []int }
+		if json.Unmarshal(message, &nw) == nil {
+			total := 0
+			for _, n := range nw.NumberWritten {
+				total += n
+			}
+			b.pvs["NUM_WRITTEN"].Set(total)
+		}
+	}
+}
+
+// setWriting starts or stops writing. Writing starts with the last WriteControl START
+// settings, or LJH 2.2 files in the current base path if there are none.
+func (b *epicsBridge) setWriting(start bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	config := WriteControlConfig{Request: "Stop"}
+	if start {
+		if err := viper.UnmarshalKey("writecontrol", &config); err != nil || !strings.EqualFold(config.Request, "start") {
+			config = WriteControlConfig{Request: "Start", WriteLJH22: true}
+		}
+	}
+	var reply WriteControlReply
+	return b.sc.WriteControl(&config, &reply)
+}
+
+// setPaused pauses or unpauses writing.
+func (b *epicsBridge) setPaused(pause bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	config := WriteControlConfig{Request: "Unpause"}
+	if pause {
+		config.Request = "Pause"
+	}
+	var reply WriteControlReply
+	return b.sc.WriteControl(&config, &reply)
+}
+
+// setStateLabel sets the experiment state label.
+func (b *epicsBridge) setStateLabel(label string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var okay bool
+	return b.sc.SetExperimentStateLabel(&StateLabelConfig{Label: label}, &okay)
+}
@@ -0,0 +1,116 @@
+package dastard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestEPICSBridge(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_epics_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	sc := NewSourceControl()
+	defer sc.lancero.Delete()
+	// Nothing else empties this SourceControl's heartbeats; a blocked source can't stop.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-sc.heartbeats:
+			case <-done:
+				return
+			}
+		}
+	}()
+	updates := make(chan ClientUpdate, 100)
+	sc.clientUpdates = updates
+	go func() {
+		for range updates {
+		}
+	}()
+	defer close(updates)
+
+	// Find a free port for the server.
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	b, err := startEPICSBridge(sc, EPICSConfig{Enabled: true, Prefix: "TEST:", Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	if addr := b.server.TCPAddr(); addr == nil || addr.(*net.TCPAddr).Port != port {
+		t.Errorf("EPICS server listens at %v, want port %d", addr, port)
+	}
+	if name := b.pvs["TRIG_RATE"].Name(); name != "TEST:TRIG_RATE" {
+		t.Errorf("PV name is %q, want TEST:TRIG_RATE", name)
+	}
+
+	message := func(x interface{}) []byte {
+		m, err := json.Marshal(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	b.update("STATUS", message(ServerStatus{Running: true, SourceName: "Triangles", Nchannels: 4}))
+	b.update("TRIGGERRATE", message(TriggerRateMessage{Duration: 2 * time.Second, CountsSeen: []int{2, 4, 0, 10}}))
+	b.update("NUMBERWRITTEN", message(struct{ NumberWritten []int }{[]int{1, 2, 3}}))
+	b.update("WRITING", message(WritingState{Active: true, RunDirectory: "/data/run", ExperimentStateLabel: "CAL"}))
+	for name, want := range map[string]interface{}{"RUNNING": 1, "SOURCE": "Triangles", "NCHAN": 4,
+		"TRIG_RATE": 8.0, "NUM_WRITTEN": 6, "WRITING": 1, "PAUSED": 0, "RUN_DIR": "/data/run", "STATE_LABEL": "CAL"} {
+		if got := b.pvs[name].Get(); got != want {
+			t.Errorf("PV %s is %v, want %v", name, got, want)
+		}
+	}
+	if rates, ok := b.pvs["TRIG_RATES"].Get().([]float64); !ok || len(rates) != 4 || rates[3] != 5 {
+		t.Errorf("PV TRIG_RATES is %v, want [1 2 0 5]", b.pvs["TRIG_RATES"].Get())
+	}
+
+	// Control requests go to the SourceControl.
+	if err := b.setWriting(true); err == nil {
+		t.Error("setWriting(true) should fail with no active source")
+	}
+	var okay bool
+	if err := sc.ConfigureTriangleSource(&TriangleSourceConfig{Nchan: 2, SampleRate: 10000.0, Min: 100, Max: 200}, &okay); err != nil {
+		t.Fatal(err)
+	}
+	sourceName := "TRIANGLESOURCE"
+	if err := sc.Start(&sourceName, &okay); err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Stop(nil, &okay)
+	viper.Set("writecontrol", WriteControlConfig{Request: "Start", Path: tmp, WriteLJH3: true})
+	defer viper.Set("writecontrol", nil)
+	if err := b.setWriting(true); err != nil {
+		t.Fatal(err)
+	}
+	if ws := sc.ActiveSource.ComputeWritingState(); !ws.Active {
+		t.Error("setWriting(true) did not start writing")
+	}
+	if err := b.setStateLabel("PULSES"); err != nil {
+		t.Error(err)
+	}
+	if err := b.setPaused(true); err != nil || !sc.ActiveSource.ComputeWritingState().Paused {
+		t.Errorf("setPaused(true) gives %v, paused=%t", err, sc.ActiveSource.ComputeWritingState().Paused)
+	}
+	if err := b.setWriting(false); err != nil {
+		t.Fatal(err)
+	}
+	if ws := sc.ActiveSource.ComputeWritingState(); ws.Active {
+		t.Error("setWriting(false) did not stop writing")
+	}
+}
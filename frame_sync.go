@@ -0,0 +1,141 @@
+package dastard
+
+import (
+	"time"
+)
+
+// Allowed values of ResyncEvent.Kind
+const (
+	ResyncWrap     = "WRAP"     // the hardware frame counter rolled over
+	ResyncBackward = "BACKWARD" // the frame counter went backwards (not a rollover)
+	ResyncGap      = "GAP"      // frames were skipped
+	ResyncTimeJump = "TIMEJUMP" // the clock and the frame counter disagree
+)
+
+// maxResyncTimeJump is the largest disagreement between a segment's clock time and
+// the time implied by its frame number that is accepted as ordinary timing jitter.
+var maxResyncTimeJump = time.Second
+
+// ResyncEvent describes one rollover or discontinuity in the frame numbers or times
+// of the data segments, and how it was corrected. It is logged and broadcast to clients
+// as a "RESYNC" message.
+type ResyncEvent struct {
+	Time      time.Time     // clock time of the first segment after the discontinuity
+	Kind      string        // one of ResyncWrap, ResyncBackward, ResyncGap, ResyncTimeJump
+	Expected  FrameIndex    // frame number expected for the first segment
+	Observed  FrameIndex    // frame number the source reported (including earlier corrections)
+	Corrected FrameIndex    // frame number assigned to the segment
+	TimeGap   time.Duration // clock time minus the time implied by the corrected frame number
+}
+
+// frameSynchronizer keeps frame numbers continuous and monotonic across data
+// segments. Sources with a hardware frame counter of limited width set counterBits;
+// the synchronizer then unwraps the counter into a 64-bit FrameIndex. It also
+// recognizes counters that jump backward, and reports when the clock disagrees with
+// the frame counter, though the frame numbers follow the counter even then.
+// All corrections are kept as an offset added to every later frame number.
+type frameSynchronizer struct {
+	counterBits uint          // width of the hardware frame counter; 0 means it never wraps
+	offset      FrameIndex    // add to each frame number the source reports
+	nextFrame   FrameIndex    // the (corrected) frame number expected next
+	nextTime    time.Time     // the time expected for nextFrame
+	started     bool          // have we seen any segments yet?
+	events      []ResyncEvent // all discontinuities found this run
+}
+
+// reset forgets all state from any earlier run, except counterBits.
+func (fs *frameSynchronizer) reset() {
+	*fs = frameSynchronizer{counterBits: fs.counterBits}
+}
+
+// synchronize corrects the frame number of a segment that the source reports
+// starts at firstFrame, at time firstTime, and contains nframes frames of length
+// period. Returns the corrected first frame number and a description of any
+// discontinuity (or nil if there was none).
+func (fs *frameSynchronizer) synchronize(firstFrame FrameIndex, firstTime time.Time,
+	nframes int, period time.Duration) (FrameIndex, *ResyncEvent) {
+	frame := firstFrame + fs.offset
+	var event *ResyncEvent
+	if fs.started {
+		expected := fs.nextFrame
+		observed := frame
+		kind := ""
+		if fs.counterBits > 0 && fs.counterBits < 63 {
+			modulus := FrameIndex(1) << fs.counterBits
+			for frame < expected-modulus/2 {
+				frame += modulus
+				kind = ResyncWrap
+			}
+		}
+		if frame < expected {
+			frame = expected
+			kind = ResyncBackward
+		} else if frame > expected {
+			kind = ResyncGap
+		}
+
+		impliedTime := fs.nextTime.Add(time.Duration(frame-expected) * period)
+		timeGap := firstTime.Sub(impliedTime)
+		if timeGap > maxResyncTimeJump || timeGap < -maxResyncTimeJump {
+			// The clock was stepped (e.g., by NTP) or the reader stalled. Only report it:
+			// the clock cannot say how many frames, if any, were lost.
+			kind = ResyncTimeJump
+		}
+
+		if kind != "" {
+			event = &ResyncEvent{Time: firstTime, Kind: kind, Expected: expected,
+				Observed: observed, Corrected: frame, TimeGap: timeGap}
+			fs.events = append(fs.events, *event)
+		}
+		fs.offset += frame - observed
+	}
+	fs.started = true
+	fs.nextFrame = frame + FrameIndex(nframes)
+	fs.nextTime = firstTime.Add(time.Duration(nframes) * period)
+	return frame, event
+}
+
+// resynchronize checks the frame numbers of a new block of data (all segments in a
+// block start with the same frame) and corrects them in place. When there is a
+// resync event, it is logged and broadcast. If frames were skipped, every channel's
+// processing is also reset so that no record or trigger spans the discontinuity, or
+// the missing frames are filled (see GapConfig). Otherwise (a counter rollover, a
+// counter that went backward, or a clock jump alone) no data were lost.
+func (ds *AnySource) resynchronize(block *dataBlock) {
+	if len(block.segments) == 0 {
+		return
+	}
+	seg := &block.segments[0]
+	nframes := len(seg.rawData) * seg.framesPerSample
+	frame, event := ds.frameSync.synchronize(seg.firstFramenum, seg.firstTime, nframes, seg.framePeriod)
+	delta := frame - seg.firstFramenum
+	if delta != 0 {
+		for i := range block.segments {
+			block.segments[i].firstFramenum += delta
+		}
+	}
+	if event == nil {
+		return
+	}
+	logFieldsf(LogWarning, LogFields{"kind": event.Kind, "expected": event.Expected,
+		"observed": event.Observed, "corrected": event.Corrected, "timegap": event.TimeGap},
+		"frame resynchronization")
+	select { // never stall data processing to report a resync
+	case clientMessageChan <- ClientUpdate{"RESYNC", *event}:
+	default:
+	}
+	if event.Corrected == event.Expected {
+		return
+	}
+	ds.handleGap(event)
+}
+
+// resetStream discards any data not yet triggered and restarts the edge multi
+// trigger search, as needed after a discontinuity in the data.
+func (dsp *DataStreamProcessor) resetStream() {
+	dsp.stream.TrimKeepingN(0)
+	if dsp.EdgeMulti {
+		dsp.edgeMultiSetInitialState()
+	}
+	dsp.conditionFired = nil
+}
@@ -0,0 +1,70 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameSynchronizer(t *testing.T) {
+	period := time.Microsecond
+	t0 := time.Now()
+	const nframes = 1000
+	fs := frameSynchronizer{counterBits: 12} // counter wraps every 4096 frames
+
+	// Report the frame counter (mod 4096) and the time of frame number f.
+	check := func(f FrameIndex, elapsed time.Duration, expectFrame FrameIndex, expectKind string) {
+		raw := f % 4096
+		frame, event := fs.synchronize(raw, t0.Add(elapsed), nframes, period)
+		if frame != expectFrame {
+			t.Errorf("synchronize(%d) frame=%d, want %d", raw, frame, expectFrame)
+		}
+		if expectKind == "" {
+			if event != nil {
+				t.Errorf("synchronize(%d) gave unexpected event %v", raw, event)
+			}
+		} else if event == nil || event.Kind != expectKind {
+			t.Errorf("synchronize(%d) event=%v, want kind %s", raw, event, expectKind)
+		}
+	}
+	for f := FrameIndex(0); f < 10000; f += nframes {
+		kind := ""
+		if f > 0 && f%4096 < (f-nframes)%4096 {
+			kind = ResyncWrap
+		}
+		check(f, time.Duration(f)*period, f, kind)
+	}
+	if len(fs.events) != 2 {
+		t.Errorf("frameSynchronizer found %d events, want 2 wraps", len(fs.events))
+	}
+
+	// Skip 500 frames, with the clock agreeing.
+	check(10500, 10500*period, 10500, ResyncGap)
+	// Counter goes back by 200 frames: keep going from the expected frame.
+	check(11300, 11500*period, 11500, ResyncBackward)
+	// Clock steps forward 3 seconds: report it, but number the frames by the counter
+	// (which is now 200 behind the frame numbers).
+	check(12300, 12500*period+3*time.Second, 12500, ResyncTimeJump)
+	check(13300, 13500*period+3*time.Second, 13500, "")
+	// Clock is set back 2 seconds: the same.
+	check(14300, 14500*period+time.Second, 14500, ResyncTimeJump)
+	check(15300, 15500*period+time.Second, 15500, "")
+	if len(fs.events) != 6 {
+		t.Errorf("frameSynchronizer found %d events, want 6", len(fs.events))
+	}
+
+	fs.reset()
+	if fs.counterBits != 12 || fs.started || fs.offset != 0 || len(fs.events) != 0 {
+		t.Errorf("frameSynchronizer.reset() left %+v", fs)
+	}
+	if frame, event := fs.synchronize(5, t0, nframes, period); frame != 5 || event != nil {
+		t.Errorf("first synchronize after reset gave frame=%d, event=%v, want 5, nil", frame, event)
+	}
+
+	// Without a counter width, a frame counter going backward is never a wrap.
+	fs = frameSynchronizer{}
+	fs.synchronize(0, t0, nframes, period)
+	if frame, event := fs.synchronize(0, t0.Add(nframes*period), nframes, period); frame != nframes ||
+		event == nil || event.Kind != ResyncBackward {
+		t.Errorf("synchronize of repeated frames gave frame=%d, event=%v", frame, event)
+	}
+}
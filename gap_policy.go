@@ -0,0 +1,145 @@
+package dastard
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Allowed values of GapConfig.Policy, which says what to do with the frames missing
+// from the data when the frame numbers skip ahead (a RESYNC of kind GAP or TIMEJUMP).
+const (
+	GapTruncate  = "TRUNCATE"  // discard the untriggered data before the gap, so no record spans it
+	GapFillLast  = "FILLLAST"  // fill the gap with copies of each channel's last sample
+	GapFillValue = "FILLVALUE" // fill the gap with the sentinel FillValue
+)
+
+// defaultMaxGapFillFrames is the longest gap that is filled, unless the config file
+// sets MaxFillFrames. Longer gaps are truncated instead.
+const defaultMaxGapFillFrames = 65536
+
+// GapConfig is the "gaps" section of the config file. It applies to all sources.
+type GapConfig struct {
+	Policy        string  // one of GapTruncate (the default), GapFillLast, GapFillValue
+	FillValue     RawType // the sentinel sample value, for policy GapFillValue
+	MaxFillFrames int     // longer gaps are truncated; 0 means defaultMaxGapFillFrames
+}
+
+// validate checks the config for errors and normalizes its Policy.
+func (config *GapConfig) validate() error {
+	config.Policy = strings.ToUpper(config.Policy)
+	switch config.Policy {
+	case "":
+		config.Policy = GapTruncate
+	case GapTruncate, GapFillLast, GapFillValue:
+	default:
+		return fmt.Errorf("gaps Policy=%q, need one of (%s, %s, %s)", config.Policy,
+			GapTruncate, GapFillLast, GapFillValue)
+	}
+	if config.MaxFillFrames < 0 {
+		return fmt.Errorf("gaps MaxFillFrames=%d, must not be negative", config.MaxFillFrames)
+	}
+	if config.MaxFillFrames == 0 {
+		config.MaxFillFrames = defaultMaxGapFillFrames
+	}
+	return nil
+}
+
+// loadGapConfig returns the gap policy of the config file, or the default (truncate)
+// if there is none or it is invalid.
+func loadGapConfig() GapConfig {
+	var config GapConfig
+	err := viper.UnmarshalKey("gaps", &config)
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		logWarningf("Invalid gaps config, so gaps will be truncated: %v", err)
+		config = GapConfig{}
+		config.validate()
+	}
+	return config
+}
+
+// gapStats counts the gaps in one channel's data since its source started.
+type gapStats struct {
+	gaps          int
+	missingFrames int64
+	filledSamples int64
+}
+
+// GapStatsMessage reports each channel's gaps since its source started. It is sent
+// to clients as a "GAPSTATS" message after each gap.
+type GapStatsMessage struct {
+	Policy        string
+	Gaps          []int   // the number of gaps
+	MissingFrames []int64 // frames lost in all the gaps
+	FilledSamples []int64 // samples filled in by the policy (0 for TRUNCATE, or for gaps too long to fill)
+}
+
+// ComputeGapStats returns the gap statistics of each channel since the source started.
+func (ds *AnySource) ComputeGapStats() GapStatsMessage {
+	n := len(ds.processors)
+	m := GapStatsMessage{Policy: ds.gapConfig.Policy, Gaps: make([]int, n),
+		MissingFrames: make([]int64, n), FilledSamples: make([]int64, n)}
+	for i, dsp := range ds.processors {
+		m.Gaps[i] = dsp.gaps.gaps
+		m.MissingFrames[i] = dsp.gaps.missingFrames
+		m.FilledSamples[i] = dsp.gaps.filledSamples
+	}
+	return m
+}
+
+// handleGap treats the missing frames (if any) of a resync event according to the gap
+// policy. Each channel either fills the gap in its stream, or discards its untriggered
+// data so that no record spans the discontinuity.
+func (ds *AnySource) handleGap(event *ResyncEvent) {
+	missing := event.Corrected - event.Expected
+	for _, dsp := range ds.processors {
+		if missing > 0 {
+			dsp.gaps.gaps++
+			dsp.gaps.missingFrames += int64(missing)
+		}
+		if missing <= 0 || dsp.disabled || !dsp.fillGap(missing, &ds.gapConfig) {
+			dsp.resetStream()
+		}
+	}
+	if missing > 0 {
+		select { // never stall data processing to report a gap
+		case clientMessageChan <- ClientUpdate{"GAPSTATS", ds.ComputeGapStats()}:
+		default:
+		}
+	}
+}
+
+// fillGap appends filler samples for the given number of missing frames to the stream,
+// as the config's policy says. It returns false if the policy doesn't fill this gap.
+func (dsp *DataStreamProcessor) fillGap(missing FrameIndex, config *GapConfig) bool {
+	stream := &dsp.stream
+	if config.Policy == GapTruncate || missing > FrameIndex(config.MaxFillFrames) || len(stream.rawData) == 0 {
+		return false
+	}
+	fps := stream.framesPerSample
+	if fps < 1 {
+		fps = 1
+	}
+	n := int(missing) / fps
+	fill := func(samples []RawType, last RawType) []RawType {
+		value := config.FillValue
+		if config.Policy == GapFillLast {
+			value = last
+		}
+		for i := 0; i < n; i++ {
+			samples = append(samples, value)
+		}
+		return samples
+	}
+	if len(stream.triggerData) > 0 && len(stream.triggerData) == len(stream.rawData) {
+		stream.triggerData = fill(stream.triggerData, stream.triggerData[len(stream.triggerData)-1])
+	}
+	stream.appendRaw(fill(make([]RawType, 0, n), stream.rawData[len(stream.rawData)-1]))
+	stream.samplesSeen += n
+	dsp.gaps.filledSamples += int64(n)
+	return true
+}
@@ -0,0 +1,117 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGapConfig(t *testing.T) {
+	config := GapConfig{Policy: "filllast"}
+	if err := config.validate(); err != nil || config.Policy != GapFillLast || config.MaxFillFrames != defaultMaxGapFillFrames {
+		t.Errorf("validate() gives %+v, error %v", config, err)
+	}
+	for _, bad := range []GapConfig{{Policy: "interpolate"}, {MaxFillFrames: -1}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("GapConfig%+v.validate() should fail", bad)
+		}
+	}
+}
+
+func TestGapPolicy(t *testing.T) {
+	ds := AnySource{nchan: 2}
+	if err := ds.PrepareRun(20, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+
+	// Make each channel's stream hold 100 samples, up to frame 200.
+	next := func(first FrameIndex) *dataBlock {
+		block := &dataBlock{segments: make([]DataSegment, ds.nchan)}
+		for i := range block.segments {
+			data := make([]RawType, 200)
+			for j := range data {
+				data[j] = RawType(100*i + j)
+			}
+			block.segments[i] = *NewDataSegment(data, 1, first, time.Unix(0, 0).Add(time.Duration(first)*time.Millisecond),
+				time.Millisecond)
+		}
+		return block
+	}
+	appendBlock := func(block *dataBlock) {
+		for i, dsp := range ds.processors {
+			dsp.stream.AppendSegment(&block.segments[i])
+			dsp.stream.TrimKeepingN(100)
+		}
+	}
+	block := next(0)
+	ds.resynchronize(block)
+	appendBlock(block)
+
+	// A gap of 100 frames, filled with the last value in FILLLAST, or a sentinel in FILLVALUE.
+	for _, test := range []struct {
+		config GapConfig
+		first  FrameIndex
+	}{
+		{GapConfig{Policy: GapFillLast}, 300},
+		{GapConfig{Policy: GapFillValue, FillValue: 65535}, 600},
+	} {
+		ds.gapConfig = test.config
+		ds.gapConfig.validate()
+		block = next(test.first)
+		ds.resynchronize(block)
+		for i, dsp := range ds.processors {
+			want := RawType(100*i + 199)
+			if test.config.Policy == GapFillValue {
+				want = 65535
+			}
+			raw := dsp.stream.rawData
+			if len(raw) != 200 || raw[99] != RawType(100*i+199) || raw[100] != want || raw[199] != want {
+				t.Errorf("%s channel %d stream has %d samples ending %v, want 200 ending with %v",
+					test.config.Policy, i, len(raw), raw[95:], want)
+			}
+		}
+		appendBlock(block)
+		for i, dsp := range ds.processors {
+			if dsp.stream.firstFramenum != test.first+100 || dsp.stream.rawData[0] != RawType(100*i+100) {
+				t.Errorf("%s channel %d stream starts at frame %d with %d, want %d and %d", test.config.Policy, i,
+					dsp.stream.firstFramenum, dsp.stream.rawData[0], test.first+100, 100*i+100)
+			}
+		}
+	}
+
+	// Gaps too long to fill, or with policy TRUNCATE, reset the streams.
+	for _, config := range []GapConfig{{Policy: GapFillLast, MaxFillFrames: 50}, {Policy: GapTruncate}} {
+		ds.gapConfig = config
+		ds.gapConfig.validate()
+		block = next(ds.frameSync.nextFrame + 100)
+		ds.resynchronize(block)
+		for i, dsp := range ds.processors {
+			if n := len(dsp.stream.rawData); n != 0 {
+				t.Errorf("%+v channel %d stream has %d samples after a gap, want 0", config, i, n)
+			}
+		}
+		appendBlock(block)
+	}
+
+	// A clock jump with no frames skipped changes no frame numbers and resets no streams.
+	block = next(ds.frameSync.nextFrame)
+	for i := range block.segments {
+		block.segments[i].firstTime = block.segments[i].firstTime.Add(3 * time.Second)
+	}
+	first := block.segments[0].firstFramenum
+	ds.resynchronize(block)
+	for i, dsp := range ds.processors {
+		if n := len(dsp.stream.rawData); n != 100 || block.segments[i].firstFramenum != first {
+			t.Errorf("channel %d has %d samples and a block at frame %d after a clock jump, want 100 and %d",
+				i, n, block.segments[i].firstFramenum, first)
+		}
+	}
+
+	m := ds.ComputeGapStats()
+	for i := range ds.processors {
+		if m.Gaps[i] != 4 || m.MissingFrames[i] != 400 || m.FilledSamples[i] != 200 {
+			t.Errorf("channel %d has %d gaps, %d missing frames, %d filled samples, want 4, 400, 200",
+				i, m.Gaps[i], m.MissingFrames[i], m.FilledSamples[i])
+		}
+	}
+}
@@ -9,6 +9,12 @@ type Portnumbers struct {
 	Trigs          int
 	SecondaryTrigs int
 	Summaries      int
+	HTTP           int
+	Energies       int
+	StatusCBOR     int
+	StatusMsgPack  int
+	StatusRPC      int
+	StatusREP      int
 }
 
 // Ports globally holds all TCP port numbers used by Dastard.
@@ -20,6 +26,12 @@ func setPortnumbers(base int) {
 	Ports.Trigs = base + 2
 	Ports.SecondaryTrigs = base + 3
 	Ports.Summaries = base + 4
+	Ports.HTTP = base + 5
+	Ports.Energies = base + 6
+	Ports.StatusCBOR = base + 7
+	Ports.StatusMsgPack = base + 8
+	Ports.StatusRPC = base + 9
+	Ports.StatusREP = base + 10
 }
 
 var githash = "githash not computed"
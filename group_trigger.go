@@ -2,7 +2,6 @@ package dastard
 
 import (
 	"fmt"
-	"log"
 	"sort"
 	"sync"
 	"time"
@@ -97,9 +96,10 @@ func (tc *TriggerCounter) observeTriggerList(tList *triggerList) error {
 type TriggerBroker struct {
 	nchannels       int
 	sources         []map[int]bool
+	offsets         []map[int]int // offsets[receiver][source] is the frames from a source trigger to its secondary
 	PrimaryTrigs    chan triggerList
-	SecondaryTrigs  []chan []FrameIndex
-	latestPrimaries [][]FrameIndex
+	SecondaryTrigs  []chan []groupTrigger
+	latestPrimaries []triggerList
 	triggerCounters []TriggerCounter
 	abort           chan struct{} // This can signal the Run() goroutine to stop
 	sync.RWMutex
@@ -114,12 +114,16 @@ func NewTriggerBroker(nchan int) *TriggerBroker {
 	for i := 0; i < nchan; i++ {
 		broker.sources[i] = make(map[int]bool)
 	}
+	broker.offsets = make([]map[int]int, nchan)
+	for i := 0; i < nchan; i++ {
+		broker.offsets[i] = make(map[int]int)
+	}
 	broker.PrimaryTrigs = make(chan triggerList, nchan)
-	broker.SecondaryTrigs = make([]chan []FrameIndex, nchan)
+	broker.SecondaryTrigs = make([]chan []groupTrigger, nchan)
 	for i := 0; i < nchan; i++ {
-		broker.SecondaryTrigs[i] = make(chan []FrameIndex, 1)
+		broker.SecondaryTrigs[i] = make(chan []groupTrigger, 1)
 	}
-	broker.latestPrimaries = make([][]FrameIndex, nchan)
+	broker.latestPrimaries = make([]triggerList, nchan)
 	broker.triggerCounters = make([]TriggerCounter, nchan)
 	for i := 0; i < nchan; i++ {
 		triggerReportRate := time.Second // could be programmable in future
@@ -128,15 +132,34 @@ func NewTriggerBroker(nchan int) *TriggerBroker {
 	return broker
 }
 
-// AddConnection connects source -> receiver for group triggers.
+// maxGroupTriggerOffset is the largest allowed size (in frames) of a group trigger offset.
+const maxGroupTriggerOffset = 1 << 16
+
+// AddConnection connects source -> receiver for group triggers, with no offset.
 // It is safe to add connections that already exist.
 func (broker *TriggerBroker) AddConnection(source, receiver int) error {
+	return broker.AddConnectionWithOffset(source, receiver, 0)
+}
+
+// AddConnectionWithOffset connects source -> receiver for group triggers, so that each
+// primary trigger at frame F in the source causes a secondary trigger at F+offset in the
+// receiver. Adding a connection that already exists changes its offset.
+func (broker *TriggerBroker) AddConnectionWithOffset(source, receiver, offset int) error {
 	if receiver < 0 || receiver >= broker.nchannels {
 		return fmt.Errorf("Could not add channel %d as a group receiver (nchannels=%d)",
 			receiver, broker.nchannels)
 	}
+	if offset < -maxGroupTriggerOffset || offset > maxGroupTriggerOffset {
+		return fmt.Errorf("Group trigger offset %d frames is too large (maximum size %d)",
+			offset, maxGroupTriggerOffset)
+	}
 	broker.Lock()
 	broker.sources[receiver][source] = true
+	if offset == 0 {
+		delete(broker.offsets[receiver], source)
+	} else {
+		broker.offsets[receiver][source] = offset
+	}
 	broker.Unlock()
 	return nil
 }
@@ -150,6 +173,7 @@ func (broker *TriggerBroker) DeleteConnection(source, receiver int) error {
 	}
 	broker.Lock()
 	delete(broker.sources[receiver], source)
+	delete(broker.offsets[receiver], source)
 	broker.Unlock()
 	return nil
 }
@@ -165,6 +189,35 @@ func (broker *TriggerBroker) isConnected(source, receiver int) bool {
 	return ok
 }
 
+// ConnectionOffset returns the offset (in frames) of the source->receiver connection,
+// which is 0 if they are not connected.
+func (broker *TriggerBroker) ConnectionOffset(source, receiver int) int {
+	if receiver < 0 || receiver >= broker.nchannels {
+		return 0
+	}
+	broker.RLock()
+	defer broker.RUnlock()
+	return broker.offsets[receiver][source]
+}
+
+// earliestOffset returns the size of the most negative offset of any connection to
+// the given receiver, or 0 if none is negative. That is how far before the primary
+// triggers the receiver's secondary triggers can be.
+func (broker *TriggerBroker) earliestOffset(receiver int) int {
+	if receiver < 0 || receiver >= broker.nchannels {
+		return 0
+	}
+	broker.RLock()
+	defer broker.RUnlock()
+	earliest := 0
+	for _, offset := range broker.offsets[receiver] {
+		if -offset > earliest {
+			earliest = -offset
+		}
+	}
+	return earliest
+}
+
 // Connections returns a set of all sources for the given receiver.
 func (broker *TriggerBroker) Connections(receiver int) map[int]bool {
 	if receiver < 0 || receiver >= broker.nchannels {
@@ -176,6 +229,59 @@ func (broker *TriggerBroker) Connections(receiver int) map[int]bool {
 	return sources
 }
 
+// GroupTriggerConfig is the RPC-usable structure for ConfigureGroupTrigger. It connects
+// (or disconnects) every one of the Sources to every one of the Receivers.
+type GroupTriggerConfig struct {
+	Sources    []int
+	Receivers  []int
+	Offset     int  // frames from each source trigger to the receivers' secondary triggers
+	Disconnect bool // remove the connections instead of adding them
+}
+
+// TDMLineCoupling is the RPC-usable structure for CoupleColumn and CoupleRow, which
+// connect (or disconnect) every pair of channels in one TDM column or row.
+type TDMLineCoupling struct {
+	Index      int  // the column (for CoupleColumn) or row (for CoupleRow)
+	Offset     int  // as in GroupTriggerConfig
+	Disconnect bool // remove the connections instead of adding them
+}
+
+// groupTrigger is one secondary trigger sent by the broker to a receiver: the frame and
+// absolute time of a source's primary trigger, shifted by the connection's offset, and the
+// source's frame period and decimation.
+type groupTrigger struct {
+	frame           FrameIndex
+	time            time.Time // zero if the source did not give the time
+	framePeriod     time.Duration
+	framesPerSample int
+}
+
+// appendGroupTriggers appends the secondary triggers caused by tlist's primaries in a
+// receiver connected with the given offset (in frames).
+func (tlist *triggerList) appendGroupTriggers(trigs []groupTrigger, offset int) []groupTrigger {
+	fps := tlist.framesPerSample
+	if fps < 1 {
+		fps = 1
+	}
+	shift := time.Duration(offset*fps) * tlist.framePeriod
+	for i, frame := range tlist.frames {
+		gt := groupTrigger{frame: frame + FrameIndex(offset), framePeriod: tlist.framePeriod,
+			framesPerSample: tlist.framesPerSample}
+		if i < len(tlist.times) {
+			gt.time = tlist.times[i].Add(shift)
+		}
+		trigs = append(trigs, gt)
+	}
+	return trigs
+}
+
+// groupTriggerSlice attaches the methods of sort.Interface to []groupTrigger, sorting by frame.
+type groupTriggerSlice []groupTrigger
+
+func (p groupTriggerSlice) Len() int           { return len(p) }
+func (p groupTriggerSlice) Less(i, j int) bool { return p[i].frame < p[j].frame }
+func (p groupTriggerSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 // FrameIdxSlice attaches the methods of sort.Interface to []FrameIndex, sorting in increasing order.
 type FrameIdxSlice []FrameIndex
 
@@ -195,10 +301,10 @@ func (broker *TriggerBroker) Run() {
 			case <-broker.abort:
 				return
 			case tlist := <-broker.PrimaryTrigs:
-				broker.latestPrimaries[tlist.channelIndex] = tlist.frames
+				broker.latestPrimaries[tlist.channelIndex] = tlist
 				err := broker.triggerCounters[tlist.channelIndex].observeTriggerList(&tlist)
 				if err != nil {
-					log.Printf("triggering assumptions broken!\n%v\n%v\n%v", err,
+					logErrorf("triggering assumptions broken!\n%v\n%v\n%v", err,
 						spew.Sdump(tlist), spew.Sdump(broker.triggerCounters[tlist.channelIndex]))
 				}
 			}
@@ -208,21 +314,28 @@ func (broker *TriggerBroker) Run() {
 		broker.RLock()
 		for idx, rxchan := range broker.SecondaryTrigs {
 			sources := broker.Connections(idx)
-			var trigs []FrameIndex
+			var trigs []groupTrigger
 			if len(sources) > 0 {
 				for source := range sources {
-					trigs = append(trigs, broker.latestPrimaries[source]...)
+					trigs = broker.latestPrimaries[source].appendGroupTriggers(trigs, broker.offsets[idx][source])
 				}
-				sort.Sort(FrameIdxSlice(trigs))
+				sort.Sort(groupTriggerSlice(trigs))
 			}
 			rxchan <- trigs
 		}
 		broker.RUnlock()
 
-		// generate combined trigger rate message
+		// generate combined trigger rate message for each step that all channels have
+		// finished. Channels that look ahead further (e.g., decimated ones) may finish a step
+		// one segment later than the rest, so their messages wait for the others.
 		var hiTime time.Time
 		var duration time.Duration
 		nMessages := len(broker.triggerCounters[0].messages)
+		for j := 1; j < broker.nchannels; j++ {
+			if n := len(broker.triggerCounters[j].messages); n < nMessages {
+				nMessages = n
+			}
+		}
 		for i := 0; i < nMessages; i++ {
 			// It's a data race if we don't make a new slice for each message:
 			countsSeen := make([]int, broker.nchannels)
@@ -241,7 +354,8 @@ func (broker *TriggerBroker) Run() {
 			clientMessageChan <- ClientUpdate{tag: "TRIGGERRATE", state: TriggerRateMessage{HiTime: hiTime, Duration: duration, CountsSeen: countsSeen}}
 		}
 		for j := 0; j < broker.nchannels; j++ {
-			broker.triggerCounters[j].messages = make([]triggerCounterMessage, 0) // release all memory
+			remaining := broker.triggerCounters[j].messages[nMessages:]
+			broker.triggerCounters[j].messages = append(make([]triggerCounterMessage, 0, len(remaining)), remaining...)
 		}
 
 	}
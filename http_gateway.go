@@ -0,0 +1,200 @@
+package dastard
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"sync"
+)
+
+// httpGateway serves an HTTP+JSON interface to the same RPC methods as the JSON-RPC
+// port, so that scripts (curl, LabVIEW, EPICS IOCs...) need no JSON-RPC client.
+// POST to /api/<name> with the method's argument as the JSON body. The name is either
+// a short alias from gatewayRoutes (e.g. "start", "triggers") or a full RPC method
+// name (e.g. "SourceControl.ConfigureTriggers"). The reply is returned as JSON with
+// status 200, or an RPC error as {"error": "..."} with status 400.
+type httpGateway struct {
+	server     *rpc.Server
+	sync.Mutex // requests are handled one at a time, like those of a single JSON-RPC connection
+}
+
+// gatewayRoutes maps short names in the /api/ path to RPC method names.
+var gatewayRoutes = map[string]string{
+	"start":             "SourceControl.Start",
+	"stop":              "SourceControl.Stop",
+	"autostart":         "SourceControl.SetAutoStart",
+	"autostagger":       "SourceControl.SetAutoTriggerStagger",
+	"status":            "SourceControl.SendAllStatus",
+	"methods":           "SourceControl.ListMethods",
+	"unsaved":           "SourceControl.ReportUnsavedChanges",
+	"commitconfig":      "SourceControl.CommitConfig",
+	"latest":            "StatusQuery.Latest",
+	"subscribe":         "StatusQuery.Subscribe",
+	"updates":           "StatusQuery.Next",
+	"triggers":          "SourceControl.ConfigureTriggers",
+	"bulktriggers":      "SourceControl.ConfigureTriggersBulk",
+	"manualtrigger":     "SourceControl.ManualTrigger",
+	"autotriggerlevels": "SourceControl.AutoSetTriggerLevels",
+	"previewtriggers":   "SourceControl.PreviewTriggers",
+	"rawsnapshot":       "SourceControl.FetchRawSnapshot",
+	"pulselengths":      "SourceControl.ConfigurePulseLengths",
+	"projectors":        "SourceControl.ConfigureProjectorsBasis",
+	"reportprojectors":  "SourceControl.ReportProjectorsBasis",
+	"mix":               "SourceControl.ConfigureMixFraction",
+	"drift":             "SourceControl.ConfigureDriftCorrection",
+	"driftreset":        "SourceControl.ResetDriftReference",
+	"energycal":         "SourceControl.ConfigureEnergyCalibration",
+	"veto":              "SourceControl.ConfigureRecordVeto",
+	"pileupflag":        "SourceControl.ConfigurePileupFlag",
+	"triggerfilter":     "SourceControl.ConfigureTriggerFilter",
+	"triggerstorm":      "SourceControl.ConfigureTriggerStorm",
+	"deadchanneldetect": "SourceControl.ConfigureDeadChannelDetection",
+	"grouptrigger":      "SourceControl.ConfigureGroupTrigger",
+	"couplecolumn":      "SourceControl.CoupleColumn",
+	"couplerow":         "SourceControl.CoupleRow",
+	"publishfilter":     "SourceControl.ConfigurePublishFilter",
+	"writing":           "SourceControl.WriteControl",
+	"writingpath":       "SourceControl.SetWritingPath",
+	"writingstats":      "SourceControl.ReportWritingStats",
+	"statelabel":        "SourceControl.SetExperimentStateLabel",
+	"stimulus":          "SourceControl.BeginStimulus",
+	"benchmark":         "SourceControl.RunBenchmark",
+	"clientwatchdog":    "SourceControl.ConfigureClientWatchdog",
+	"ping":              "SourceControl.Ping",
+	"comment":           "SourceControl.WriteComment",
+	"channelgroup":      "SourceControl.DefineChannelGroup",
+	"enablechannels":    "SourceControl.EnableChannels",
+	"calibration":       "SourceControl.SetCalibration",
+	"deadchannels":      "SourceControl.SetDeadChannels",
+	"lancerostatus":     "SourceControl.LanceroStatus",
+	"lancerofibers":     "SourceControl.ProbeLanceroFibers",
+	"lancerocapture":    "SourceControl.CaptureLanceroRaw",
+	"simpulse":          "SourceControl.ConfigureSimPulseSource",
+	"triangle":          "SourceControl.ConfigureTriangleSource",
+	"lancero":           "SourceControl.ConfigureLanceroSource",
+	"capturereplay":     "SourceControl.ConfigureCaptureReplaySource",
+	"map":               "MapServer.Load",
+}
+
+// gatewayMethod returns the RPC method named by an /api/ path.
+func gatewayMethod(path string) (string, error) {
+	name := strings.Trim(strings.TrimPrefix(path, "/api/"), "/")
+	if method, ok := gatewayRoutes[strings.ToLower(name)]; ok {
+		return method, nil
+	}
+	if strings.Count(name, ".") == 1 && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".") {
+		return name, nil
+	}
+	return "", fmt.Errorf("no RPC method for path %q", path)
+}
+
+// gatewayConn is an in-memory connection that holds one JSON-RPC request and
+// collects the response.
+type gatewayConn struct {
+	request  *bytes.Reader
+	response bytes.Buffer
+}
+
+func (c *gatewayConn) Read(p []byte) (int, error)  { return c.request.Read(p) }
+func (c *gatewayConn) Write(p []byte) (int, error) { return c.response.Write(p) }
+func (c *gatewayConn) Close() error                { return nil }
+
+// call makes one RPC call through the server on behalf of client, with params as the JSON argument.
+// It returns the JSON reply, or the RPC error message. The error is non-nil only
+// if the method could not be called at all.
+func (g *httpGateway) call(method string, params json.RawMessage, client string) (json.RawMessage, string, error) {
+	if len(bytes.TrimSpace(params)) == 0 {
+		params = json.RawMessage("null")
+	}
+	request, err := json.Marshal(struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+		ID     int               `json:"id"`
+	}{method, []json.RawMessage{params}, 1})
+	if err != nil {
+		return nil, "", err
+	}
+	conn := &gatewayConn{request: bytes.NewReader(request)}
+	g.Lock()
+	err = g.server.ServeRequest(newAuditCodec(jsonrpc.NewServerCodec(conn), client, &audit))
+	g.Unlock()
+	if err != nil {
+		return nil, "", err
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *string         `json:"error"`
+	}
+	if err := json.Unmarshal(conn.response.Bytes(), &response); err != nil {
+		return nil, "", err
+	}
+	if response.Error != nil {
+		return nil, *response.Error, nil
+	}
+	return response.Result, "", nil
+}
+
+// ServeHTTP handles one /api/ request.
+func (g *httpGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeError := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(http.StatusMethodNotAllowed, "use POST, with the RPC argument as the JSON body")
+		return
+	}
+	method, err := gatewayMethod(r.URL.Path)
+	if err != nil {
+		writeError(http.StatusNotFound, err.Error())
+		return
+	}
+	params, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(bytes.TrimSpace(params)) > 0 && !json.Valid(params) {
+		writeError(http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+	result, rpcError, err := g.call(method, params, "http:"+r.RemoteAddr)
+	if err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "can't find") {
+			status = http.StatusNotFound
+		}
+		writeError(status, err.Error())
+		return
+	}
+	if len(rpcError) > 0 {
+		writeError(http.StatusBadRequest, rpcError)
+		return
+	}
+	logFieldsf(LogDebug, LogFields{"method": method}, "HTTP gateway call")
+	w.Write(result)
+}
+
+// runHTTPGateway serves the HTTP gateway to server's methods on the given port,
+// as HTTPS if tlsConfig is not nil. It also serves raw snapshots to GET /snapshot/<id>.
+func runHTTPGateway(server *rpc.Server, port int, tlsConfig *tls.Config) {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", &httpGateway{server: server})
+	mux.Handle("/snapshot/", rawSnapshotHandler{})
+	listener, err := listenTCP(port, tlsConfig)
+	if err != nil {
+		logWarningf("HTTP gateway could not listen on port %d: %v", port, err)
+		return
+	}
+	if err := http.Serve(listener, mux); err != nil {
+		logWarningf("HTTP gateway on port %d stopped: %v", port, err)
+	}
+}
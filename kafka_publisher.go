@@ -0,0 +1,168 @@
+package dastard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// KafkaConfig holds the configuration of the optional Kafka publisher. It is read
+// from the "kafka" key of the config file when a source starts.
+// Summaries are published to SummaryTopic. If PublishRecords is true, full records
+// are also published to RecordTopic. Messages are keyed by channel index, so all
+// messages from one channel land in the same partition, in order. Kafka publishing needs
+// Dastard built with the kafka build tag (go build -tags kafka).
+type KafkaConfig struct {
+	Enabled        bool
+	Brokers        []string // host:port of one or more Kafka brokers
+	SummaryTopic   string
+	RecordTopic    string
+	PublishRecords bool
+}
+
+// kafkaProducer is the running Kafka producer, if any. Multiple DataPublishers publish
+// to it, in analogy to PubRecordsChan.
+var kafkaProducer struct {
+	sync.Mutex
+	records chan []*DataRecord // nil if no producer is running
+	config  KafkaConfig        // the configuration that records was started with
+}
+
+// kafkaMessage is one message to publish to Kafka.
+type kafkaMessage struct {
+	Key   []byte
+	Value []byte
+}
+
+// kafkaWriter publishes messages to one Kafka topic. The Kafka client library needs a
+// newer Go than Dastard otherwise does, so it is built only with the kafka build tag (see
+// newKafkaWriter).
+type kafkaWriter interface {
+	WriteMessages(msgs []kafkaMessage) error
+	Close() error
+}
+
+// configureKafkaProducer starts the Kafka producer goroutine if it's not already
+// running with the same configuration. A running producer with a different
+// configuration is stopped and replaced.
+func configureKafkaProducer(config KafkaConfig) error {
+	if !config.Enabled {
+		return fmt.Errorf("Kafka publishing is not enabled")
+	}
+	if len(config.Brokers) == 0 {
+		return fmt.Errorf("Kafka publishing requires at least one broker")
+	}
+	if config.SummaryTopic == "" {
+		return fmt.Errorf("Kafka publishing requires a SummaryTopic")
+	}
+	if config.PublishRecords && config.RecordTopic == "" {
+		return fmt.Errorf("Kafka PublishRecords requires a RecordTopic")
+	}
+	kafkaProducer.Lock()
+	defer kafkaProducer.Unlock()
+	if kafkaProducer.records != nil {
+		if kafkaConfigEqual(config, kafkaProducer.config) {
+			return nil
+		}
+		close(kafkaProducer.records)
+		kafkaProducer.records = nil
+	}
+	records, err := startKafkaProducer(config)
+	if err != nil {
+		return err
+	}
+	kafkaProducer.records = records
+	kafkaProducer.config = config
+	return nil
+}
+
+// kafkaRecordsChan returns the channel of the running Kafka producer, or nil if none.
+func kafkaRecordsChan() chan []*DataRecord {
+	kafkaProducer.Lock()
+	defer kafkaProducer.Unlock()
+	return kafkaProducer.records
+}
+
+func kafkaConfigEqual(a, b KafkaConfig) bool {
+	if a.Enabled != b.Enabled || a.SummaryTopic != b.SummaryTopic ||
+		a.RecordTopic != b.RecordTopic || a.PublishRecords != b.PublishRecords ||
+		len(a.Brokers) != len(b.Brokers) {
+		return false
+	}
+	for i := range a.Brokers {
+		if a.Brokers[i] != b.Brokers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// startKafkaProducer sets up the Kafka writers and starts a goroutine to publish
+// messages based on any records that appear on a new channel. Returns the
+// channel for other routines to fill. Close that channel to close the writers.
+func startKafkaProducer(config KafkaConfig) (chan []*DataRecord, error) {
+	const publishChannelDepth = 500
+	summaryWriter, err := newKafkaWriter(config.Brokers, config.SummaryTopic)
+	if err != nil {
+		return nil, err
+	}
+	var recordWriter kafkaWriter
+	if config.PublishRecords {
+		if recordWriter, err = newKafkaWriter(config.Brokers, config.RecordTopic); err != nil {
+			summaryWriter.Close()
+			return nil, err
+		}
+	}
+	kafkachan := make(chan []*DataRecord, publishChannelDepth)
+	go runKafkaProducer(kafkachan, summaryWriter, recordWriter)
+	return kafkachan, nil
+}
+
+// runKafkaProducer publishes the summary of each record on kafkachan with summaryWriter,
+// and the full record with recordWriter if it is not nil. It closes the writers when
+// kafkachan is closed and drained.
+func runKafkaProducer(kafkachan <-chan []*DataRecord, summaryWriter, recordWriter kafkaWriter) {
+	defer func() {
+		summaryWriter.Close()
+		if recordWriter != nil {
+			recordWriter.Close()
+		}
+	}()
+	for records := range kafkachan {
+		summaries := make([]kafkaMessage, len(records))
+		for i, record := range records {
+			key := kafkaKey(record)
+			summaries[i] = kafkaMessage{Key: key, Value: joinMessage(messageSummaries(record))}
+		}
+		if err := summaryWriter.WriteMessages(summaries); err != nil {
+			logErrorf("Kafka summary publishing error: %v", err)
+		}
+		if recordWriter == nil {
+			continue
+		}
+		full := make([]kafkaMessage, len(records))
+		for i, record := range records {
+			key := kafkaKey(record)
+			full[i] = kafkaMessage{Key: key, Value: joinMessage(messageRecords(record))}
+		}
+		if err := recordWriter.WriteMessages(full); err != nil {
+			logErrorf("Kafka record publishing error: %v", err)
+		}
+	}
+}
+
+// kafkaKey returns the key of the record's messages: its channel index, as a
+// little-endian uint16. Each key has its own bytes, because the writers keep them.
+func kafkaKey(record *DataRecord) []byte {
+	key := make([]byte, 2)
+	binary.LittleEndian.PutUint16(key, uint16(record.channelIndex))
+	return key
+}
+
+// joinMessage concatenates the parts of a multi-part ZMQ message into the single
+// byte slice that a Kafka message value needs. The header formats are those in
+// BINARY_FORMATS.md, so the header says how long the rest of the message is.
+func joinMessage(parts [][]byte) []byte {
+	return bytes.Join(parts, nil)
+}
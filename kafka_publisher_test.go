@@ -0,0 +1,106 @@
+package dastard
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestKafkaConfig(t *testing.T) {
+	bad := []KafkaConfig{
+		{Enabled: false, Brokers: []string{"localhost:9092"}, SummaryTopic: "s"},
+		{Enabled: true, SummaryTopic: "s"},
+		{Enabled: true, Brokers: []string{"localhost:9092"}},
+		{Enabled: true, Brokers: []string{"localhost:9092"}, SummaryTopic: "s", PublishRecords: true},
+	}
+	for _, kc := range bad {
+		if err := configureKafkaProducer(kc); err == nil {
+			t.Errorf("configureKafkaProducer(%v) should fail", kc)
+		}
+	}
+	a := KafkaConfig{Enabled: true, Brokers: []string{"a:1", "b:2"}, SummaryTopic: "s"}
+	b := a
+	if !kafkaConfigEqual(a, b) {
+		t.Errorf("kafkaConfigEqual(%v, %v) is false, want true", a, b)
+	}
+	b.Brokers = []string{"a:1", "c:2"}
+	if kafkaConfigEqual(a, b) {
+		t.Errorf("kafkaConfigEqual(%v, %v) is true, want false", a, b)
+	}
+}
+
+func TestJoinMessage(t *testing.T) {
+	rec := &DataRecord{data: []RawType{1, 2, 3, 4}, presamples: 1, channelIndex: 3}
+	parts := messageRecords(rec)
+	joined := joinMessage(parts)
+	if len(joined) != len(parts[0])+len(parts[1]) {
+		t.Errorf("joinMessage length %d, want %d", len(joined), len(parts[0])+len(parts[1]))
+	}
+	if !bytes.Equal(joined[:len(parts[0])], parts[0]) {
+		t.Error("joinMessage does not start with the message header")
+	}
+}
+
+// fakeKafkaWriter is a kafkaWriter that keeps the messages.
+type fakeKafkaWriter struct {
+	sync.Mutex
+	messages []kafkaMessage
+	closed   bool
+}
+
+func (fw *fakeKafkaWriter) WriteMessages(msgs []kafkaMessage) error {
+	fw.Lock()
+	defer fw.Unlock()
+	fw.messages = append(fw.messages, msgs...)
+	return nil
+}
+
+func (fw *fakeKafkaWriter) Close() error {
+	fw.Lock()
+	defer fw.Unlock()
+	fw.closed = true
+	return nil
+}
+
+func TestKafkaProducer(t *testing.T) {
+	summaries := new(fakeKafkaWriter)
+	records := new(fakeKafkaWriter)
+	kafkachan := make(chan []*DataRecord, 2)
+	done := make(chan struct{})
+	go func() {
+		runKafkaProducer(kafkachan, summaries, records)
+		close(done)
+	}()
+	recs := []*DataRecord{
+		{data: []RawType{1, 2, 3, 4}, presamples: 1, channelIndex: 3},
+		{data: []RawType{5, 6, 7, 8}, presamples: 1, channelIndex: 7},
+	}
+	kafkachan <- recs[:1]
+	kafkachan <- recs[1:]
+	close(kafkachan)
+	<-done
+
+	for _, fw := range []*fakeKafkaWriter{summaries, records} {
+		if !fw.closed {
+			t.Error("runKafkaProducer did not close a writer")
+		}
+		if len(fw.messages) != len(recs) {
+			t.Fatalf("writer got %d messages, want %d", len(fw.messages), len(recs))
+		}
+	}
+	for i, rec := range recs {
+		key := []byte{byte(rec.channelIndex), 0}
+		if !bytes.Equal(summaries.messages[i].Key, key) || !bytes.Equal(records.messages[i].Key, key) {
+			t.Errorf("message %d has keys %v, %v, want %v", i, summaries.messages[i].Key, records.messages[i].Key, key)
+		}
+		if want := joinMessage(messageSummaries(rec)); !bytes.Equal(summaries.messages[i].Value, want) {
+			t.Errorf("summary message %d differs from the record's summary", i)
+		}
+		if want := joinMessage(messageRecords(rec)); !bytes.Equal(records.messages[i].Value, want) {
+			t.Errorf("record message %d differs from the record", i)
+		}
+	}
+	if kafkaRecordsChan() != nil {
+		t.Error("kafkaRecordsChan() is not nil with no producer")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build kafka
+// +build kafka
+
+package dastard
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// segmentioWriter is a kafkaWriter using the segmentio/kafka-go client.
+type segmentioWriter struct {
+	w *kafka.Writer
+}
+
+// newKafkaWriter returns a writer to the topic on the given brokers.
+func newKafkaWriter(brokers []string, topic string) (kafkaWriter, error) {
+	return &segmentioWriter{w: &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.Hash{}, // partition by key, which is the channel index
+		Async:    true,          // never block data processing on the network
+		ErrorLogger: kafka.LoggerFunc(func(msg string, args ...interface{}) {
+			logErrorf("Kafka error: "+msg, args...)
+		}),
+	}}, nil
+}
+
+func (sw *segmentioWriter) WriteMessages(msgs []kafkaMessage) error {
+	km := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		km[i] = kafka.Message{Key: m.Key, Value: m.Value}
+	}
+	return sw.w.WriteMessages(context.Background(), km...)
+}
+
+func (sw *segmentioWriter) Close() error {
+	return sw.w.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !kafka
+// +build !kafka
+
+package dastard
+
+import "fmt"
+
+// newKafkaWriter fails: this Dastard was built without the Kafka client, which needs a
+// newer Go. Build with -tags kafka to use config key Kafka.
+func newKafkaWriter(brokers []string, topic string) (kafkaWriter, error) {
+	return nil, fmt.Errorf("this Dastard was built without Kafka support (build with -tags kafka)")
+}
@@ -32,6 +32,7 @@ type Lanceroer interface {
 	AvailableBuffer() ([]byte, time.Time, error)
 	ReleaseBytes(int) error
 	InspectAdapter() uint32
+	Diagnostics() (Diagnostics, error)
 }
 
 // Notes:
@@ -147,6 +148,56 @@ func (lan *Lancero) InspectAdapter() uint32 {
 	return lan.adapter.inspect()
 }
 
+// Diagnostics holds the register-level state of a Lancero card, to help tell hardware
+// problems from software problems.
+type Diagnostics struct {
+	AdapterIDVersion   uint32 // firmware ID and version of the ring buffer adapter
+	CollectorIDVersion uint32 // firmware ID and version of the fiber collector
+	AdapterStatus      uint32 // adapter status word
+	AdapterRunning     bool   // status bits, decoded
+	BufferFull         bool
+	BufferAlarm        bool
+	BufferLength       uint32 // ring buffer size (bytes)
+	BufferAvailable    uint32 // ring buffer fill level: data not yet read (bytes)
+	BufferMaxFill      uint32 // highest fill level since the adapter started (bytes)
+	CollectorRunning   bool
+	CollectorSimulated bool
+}
+
+// Diagnostics reads the adapter and collector registers and returns their state.
+func (lan *Lancero) Diagnostics() (Diagnostics, error) {
+	var d Diagnostics
+	var err error
+	if d.AdapterIDVersion, err = lan.adapter.idVersion(); err != nil {
+		return d, err
+	}
+	if d.CollectorIDVersion, err = lan.device.idVersion(); err != nil {
+		return d, err
+	}
+	if d.AdapterStatus, err = lan.adapter.status(); err != nil {
+		return d, err
+	}
+	d.AdapterRunning = d.AdapterStatus&bitsAdapterCtrlRun != 0
+	d.BufferFull = d.AdapterStatus&bitsAdapterCtrlIEFull != 0
+	d.BufferAlarm = d.AdapterStatus&bitsAdapterCtrlIEFlush != 0
+	if d.BufferLength, err = lan.device.readRegister(adapterRBS); err != nil {
+		return d, err
+	}
+	if d.BufferAvailable, err = lan.adapter.available(); err != nil {
+		return d, err
+	}
+	if d.BufferMaxFill, err = lan.device.readRegister(adapterFILL); err != nil {
+		return d, err
+	}
+	ctrl, err := lan.device.readRegister(colRegisterCtrl)
+	if err != nil {
+		return d, err
+	}
+	d.CollectorRunning = ctrl&bitsCtrlRun != 0
+	d.CollectorSimulated = ctrl&bitsCtrlSim != 0
+	return d, nil
+}
+
 // FindFrameBits returns q,p,n,err
 // q index of word with first frame bit following non-frame index
 // p index of word with next  frame bit following non-frame index
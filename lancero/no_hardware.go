@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"math/bits"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -24,6 +25,8 @@ type NoHardware struct {
 	minTimeBetweenReads time.Duration
 	rowCount            int
 	idNum               int
+	liveFibers          uint32 // if not 0, only these fibers carry data
+	channelMask         uint32 // the fibers the collector reads
 }
 
 // String implements Stringer for NoHardware, aka controls how Println output looks
@@ -77,9 +80,17 @@ func (lan *NoHardware) StopAdapter() error {
 	return nil
 }
 
-// CollectorConfigure returns nil
+// SetLiveFibers simulates the cabling of a card: only the fibers in mask carry data,
+// and the simulated data has one column per live fiber in the collector's channel mask.
+// The default, 0, ignores the channel mask and always gives ncols columns.
+func (lan *NoHardware) SetLiveFibers(mask uint32) {
+	lan.liveFibers = mask
+}
+
+// CollectorConfigure remembers the channel mask and returns nil
 func (lan *NoHardware) CollectorConfigure(linePeriod, dataDelay int, channelMask uint32,
 	frameLength int) error {
+	lan.channelMask = channelMask
 	return nil
 }
 
@@ -133,9 +144,13 @@ func (lan *NoHardware) AvailableBuffer() ([]byte, time.Time, error) {
 		return buf.Bytes(), now, fmt.Errorf("reads were %v apart, want < %v", sinceLastRead, 50*lan.minTimeBetweenReads)
 	}
 
+	ncols := lan.ncols
+	if lan.liveFibers != 0 {
+		ncols = bits.OnesCount32(lan.liveFibers & lan.channelMask)
+	}
 	for i := 0; i < frames; i++ { // i counts frames
 		for row := 0; row < lan.nrows; row++ {
-			for col := 0; col < lan.ncols; col++ {
+			for col := 0; col < ncols; col++ {
 				v := byte(uint8(lan.rowCount))
 				lan.rowCount++
 				if row == 0 {
@@ -163,3 +178,13 @@ func (lan *NoHardware) InspectAdapter() uint32 {
 	log.Println(spew.Sprint("NoHardware.InspectAdapter:", lan))
 	return uint32(0)
 }
+
+// Diagnostics returns a plausible state for a card, with no errors
+func (lan *NoHardware) Diagnostics() (Diagnostics, error) {
+	d := Diagnostics{AdapterRunning: lan.isStarted, CollectorRunning: lan.collectorStarted,
+		CollectorSimulated: lan.collectorStarted}
+	if lan.isStarted {
+		d.AdapterStatus = bitsAdapterCtrlRun
+	}
+	return d, nil
+}
@@ -0,0 +1,52 @@
+package dastard
+
+import (
+	"sync/atomic"
+)
+
+// resetBufferFill starts the monitoring of a ring buffer of size bytes, which warns
+// when the buffer is fuller than the warning fraction (0 for never).
+func (device *LanceroDevice) resetBufferFill(size int, warning float64) {
+	atomic.StoreInt64(&device.bufferSize, int64(size))
+	atomic.StoreInt64(&device.bufferFill, 0)
+	atomic.StoreInt64(&device.bufferPeak, 0)
+	device.bufferWarning = warning
+	device.bufferWarned = false
+}
+
+// noteBufferFill records that nbytes were waiting in the card's ring buffer at a read.
+// It warns once each time the fill rises past the warning fraction, so an overflow can
+// be seen coming before data are lost; the warning is re-armed once the fill falls
+// below half that fraction. Only the card's reader goroutine calls it.
+func (device *LanceroDevice) noteBufferFill(nbytes int) {
+	fill := int64(nbytes)
+	atomic.StoreInt64(&device.bufferFill, fill)
+	if fill > atomic.LoadInt64(&device.bufferPeak) {
+		atomic.StoreInt64(&device.bufferPeak, fill)
+	}
+	size := atomic.LoadInt64(&device.bufferSize)
+	if size <= 0 || device.bufferWarning <= 0 {
+		return
+	}
+	fraction := float64(fill) / float64(size)
+	if fraction >= device.bufferWarning && !device.bufferWarned {
+		device.bufferWarned = true
+		logFieldsf(LogWarning, LogFields{"devnum": device.devnum, "fill": fraction},
+			"lancero device %d ring buffer is %.0f%% full (warning level %.0f%%)", device.devnum,
+			100*fraction, 100*device.bufferWarning)
+	} else if fraction < device.bufferWarning/2 {
+		device.bufferWarned = false
+	}
+}
+
+// bufferStatus returns the size of the ring buffer, and its fill at the last read and
+// its highest fill since the source started (as fractions of the size).
+func (device *LanceroDevice) bufferStatus() (size int64, fill, peak float64) {
+	size = atomic.LoadInt64(&device.bufferSize)
+	if size <= 0 {
+		return 0, 0, 0
+	}
+	fill = float64(atomic.LoadInt64(&device.bufferFill)) / float64(size)
+	peak = float64(atomic.LoadInt64(&device.bufferPeak)) / float64(size)
+	return
+}
@@ -0,0 +1,43 @@
+package dastard
+
+import "testing"
+
+func TestLanceroBufferFill(t *testing.T) {
+	device := LanceroDevice{devnum: 1}
+	if size, fill, peak := device.bufferStatus(); size != 0 || fill != 0 || peak != 0 {
+		t.Errorf("bufferStatus() before the source starts = %d, %v, %v, want zeros", size, fill, peak)
+	}
+	device.resetBufferFill(1000, 0.5)
+	for _, test := range []struct {
+		nbytes int
+		warned bool
+	}{
+		{100, false},
+		{600, true},  // warn: past 50%
+		{700, true},  // no new warning
+		{300, true},  // not yet below 25%
+		{200, false}, // re-armed
+		{900, true},
+	} {
+		device.noteBufferFill(test.nbytes)
+		if device.bufferWarned != test.warned {
+			t.Errorf("after a read of %d bytes, bufferWarned=%v, want %v", test.nbytes, device.bufferWarned, test.warned)
+		}
+	}
+	if size, fill, peak := device.bufferStatus(); size != 1000 || fill != 0.9 || peak != 0.9 {
+		t.Errorf("bufferStatus() = %d, %v, %v, want 1000, 0.9, 0.9", size, fill, peak)
+	}
+	device.noteBufferFill(50)
+	if _, fill, peak := device.bufferStatus(); fill != 0.05 || peak != 0.9 {
+		t.Errorf("bufferStatus() fill, peak = %v, %v, want 0.05, 0.9", fill, peak)
+	}
+
+	device.resetBufferFill(1000, 0)
+	device.noteBufferFill(999)
+	if device.bufferWarned {
+		t.Error("noteBufferFill warned although the warning is off")
+	}
+	if _, _, peak := device.bufferStatus(); peak != 0.999 {
+		t.Errorf("bufferStatus() peak = %v after reset and a read, want 0.999", peak)
+	}
+}
@@ -0,0 +1,269 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lanceroMaxCaptureSeconds is the longest raw capture allowed, to bound its file size.
+const lanceroMaxCaptureSeconds = 60
+
+// lanceroRawCaptureQueue is how many reads may wait for the raw capture's writer. Reads
+// beyond it are dropped (and counted), so a slow disk never delays reading the card.
+const lanceroRawCaptureQueue = 64
+
+// LanceroRawCaptureConfig is the RPC-usable structure for CaptureLanceroRaw.
+type LanceroRawCaptureConfig struct {
+	Seconds   float64 // how long to capture, at most lanceroMaxCaptureSeconds
+	Directory string  // where to write the files; empty means the writing BasePath
+	Cards     []int   // device numbers of the cards to capture; empty means all active cards
+}
+
+// lanceroRawRead describes one read of the card's ring buffer in a raw capture: where
+// its bytes are in the raw file, and what FindFrameBits made of them. A read dropped
+// because the writer fell behind is not in the raw file; its Offset is where its bytes
+// would have been.
+type lanceroRawRead struct {
+	Offset         int64 // in the raw file, in bytes
+	Bytes          int
+	Time           time.Time // as reported by the driver
+	FrameBitsQ     int
+	FrameBitsP     int
+	FrameBitsN     int
+	FrameBitsError string `json:",omitempty"`
+	Dropped        bool   `json:",omitempty"`
+}
+
+// lanceroRawCaptureMeta is the content of the JSON file that goes with a raw capture:
+// the card's frame-sync configuration, and every read in the capture.
+type lanceroRawCaptureMeta struct {
+	DevNum    int
+	Nrows     int
+	Ncols     int
+	Lsync     int
+	CardDelay int
+	ClockMhz  int
+	FiberMask uint32
+	FrameSize int // bytes
+	FrameRate float64
+	RawFile   string
+	Started   time.Time
+	Ended     time.Time
+	EndReason string
+	Reads     []lanceroRawRead // in order, the dropped ones included
+	// Reads dropped because the writer fell behind. They are not in the raw file.
+	DroppedReads int
+	DroppedBytes int64
+}
+
+// lanceroRawCapture is a capture in progress of the unparsed stream of one card. The
+// reading goroutine queues each read; the capture's own goroutine writes them.
+type lanceroRawCapture struct {
+	file     *os.File
+	metaName string
+	until    time.Time
+	queue    chan lanceroRawChunk // closed when the capture ends
+	done     chan struct{}        // closed when the files are written
+	reason   string               // why the capture ended; set before queue is closed
+	dropped  int                  // reads not queued, under the device's rawCaptureLock
+	droppedB int64                // bytes in those reads
+	pending  []lanceroRawRead     // reads dropped since the last one queued, also under the lock
+
+	// Used only by the writing goroutine.
+	offset int64
+	meta   lanceroRawCaptureMeta
+}
+
+// lanceroRawChunk is one read waiting to be written to the raw capture.
+type lanceroRawChunk struct {
+	data    []byte
+	read    lanceroRawRead
+	dropped []lanceroRawRead // reads dropped just before this one
+}
+
+// startRawCapture starts writing the card's raw stream to a new file in dir, for the
+// given duration. It returns the name of the raw file.
+func (device *LanceroDevice) startRawCapture(dir string, duration time.Duration) (string, error) {
+	device.rawCaptureLock.Lock()
+	defer device.rawCaptureLock.Unlock()
+	if device.rawCapture != nil {
+		return "", fmt.Errorf("lancero device %d already has a raw capture in progress", device.devnum)
+	}
+	now := time.Now()
+	base := filepath.Join(dir, fmt.Sprintf("lancero%d_%s_raw", device.devnum, now.Format("20060102_150405")))
+	file, err := os.OpenFile(base+".bin", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	c := &lanceroRawCapture{file: file, metaName: base + ".json", until: now.Add(duration),
+		queue: make(chan lanceroRawChunk, lanceroRawCaptureQueue), done: make(chan struct{}),
+		meta: lanceroRawCaptureMeta{DevNum: device.devnum, Nrows: device.nrows, Ncols: device.ncols,
+			Lsync: device.lsync, CardDelay: device.cardDelay, ClockMhz: device.clockMhz,
+			FiberMask: device.fiberMask, FrameSize: device.frameSize, FrameRate: device.frameRate,
+			RawFile: filepath.Base(file.Name()), Started: now, Reads: make([]lanceroRawRead, 0)}}
+	device.rawCapture = c
+	go c.write(device.devnum)
+	return file.Name(), nil
+}
+
+// captureRaw queues the bytes of one read, and the frame bits found in them, for the raw
+// capture in progress (if any), or drops the bytes if the capture's writer is behind. A
+// dropped read is still listed in the metadata, passed on with the next read queued. The
+// capture ends once the read time passes its end.
+func (device *LanceroDevice) captureRaw(b []byte, timeFix time.Time, q, p, n int, frameErr error) {
+	device.rawCaptureLock.Lock()
+	defer device.rawCaptureLock.Unlock()
+	c := device.rawCapture
+	if c == nil {
+		return
+	}
+	chunk := lanceroRawChunk{data: make([]byte, len(b)), read: lanceroRawRead{Bytes: len(b), Time: timeFix,
+		FrameBitsQ: q, FrameBitsP: p, FrameBitsN: n}}
+	copy(chunk.data, b) // the card reuses its buffer
+	if frameErr != nil {
+		chunk.read.FrameBitsError = frameErr.Error()
+	}
+	chunk.dropped = c.pending
+	select {
+	case c.queue <- chunk:
+		c.pending = nil
+	default:
+		chunk.read.Dropped = true
+		c.pending = append(c.pending, chunk.read)
+		c.dropped++
+		c.droppedB += int64(len(b))
+	}
+	if timeFix.After(c.until) {
+		device.endRawCaptureLocked("done")
+	}
+}
+
+// endRawCapture ends the raw capture in progress (if any), giving the reason in its metadata.
+func (device *LanceroDevice) endRawCapture(reason string) {
+	device.rawCaptureLock.Lock()
+	defer device.rawCaptureLock.Unlock()
+	device.endRawCaptureLocked(reason)
+}
+
+func (device *LanceroDevice) endRawCaptureLocked(reason string) {
+	c := device.rawCapture
+	if c == nil {
+		return
+	}
+	device.rawCapture = nil
+	c.reason = reason
+	close(c.queue) // the writer finishes the capture
+}
+
+// write writes the queued reads to the raw file until the capture ends, then writes the
+// metadata file.
+func (c *lanceroRawCapture) write(devnum int) {
+	defer close(c.done)
+	var writeErr error
+	for chunk := range c.queue {
+		if writeErr != nil {
+			continue
+		}
+		c.addDropped(chunk.dropped)
+		if _, writeErr = c.file.Write(chunk.data); writeErr != nil {
+			logWarningf("lancero device %d raw capture stops writing: %v", devnum, writeErr)
+			continue
+		}
+		chunk.read.Offset = c.offset
+		c.offset += int64(len(chunk.data))
+		c.meta.Reads = append(c.meta.Reads, chunk.read)
+	}
+	if writeErr == nil {
+		// The queue is closed, so no more reads are dropped.
+		c.addDropped(c.pending)
+	}
+	c.meta.Ended = time.Now()
+	c.meta.EndReason = c.reason
+	c.meta.DroppedReads = c.dropped
+	c.meta.DroppedBytes = c.droppedB
+	if writeErr != nil {
+		c.meta.EndReason = fmt.Sprintf("write error: %v", writeErr)
+	}
+	if err := c.file.Close(); err != nil {
+		logWarningf("lancero device %d raw capture: %v", devnum, err)
+	}
+	meta, err := json.MarshalIndent(c.meta, "", "    ")
+	if err == nil {
+		err = ioutil.WriteFile(c.metaName, meta, 0644)
+	}
+	if err != nil {
+		logWarningf("lancero device %d raw capture could not write %s: %v", devnum, c.metaName, err)
+		return
+	}
+	if c.meta.DroppedReads > 0 {
+		logWarningf("lancero device %d raw capture dropped %d reads (%d bytes): the disk was too slow",
+			devnum, c.meta.DroppedReads, c.meta.DroppedBytes)
+	}
+	logInfof("lancero device %d raw capture of %d bytes ended (%s): %s", devnum, c.offset,
+		c.meta.EndReason, c.file.Name())
+}
+
+// addDropped lists dropped reads in the metadata, at the current offset of the raw file.
+func (c *lanceroRawCapture) addDropped(reads []lanceroRawRead) {
+	for _, read := range reads {
+		read.Offset = c.offset
+		c.meta.Reads = append(c.meta.Reads, read)
+	}
+}
+
+// CaptureRaw starts a raw capture of the chosen active cards: for config.Seconds, every
+// read of a card's ring buffer is written to a file exactly as the card delivered it,
+// before demultiplexing, with a JSON file giving the card's frame-sync configuration
+// and the frame bits found in each read. This shows framing errors that are invisible
+// after demultiplexing; if one stops the source, the capture ends with the read that had
+// it. If the disk falls behind, reads are dropped from the raw file, but are still
+// listed (marked Dropped) in the JSON file. It returns the names of the raw files.
+func (ls *LanceroSource) CaptureRaw(config *LanceroRawCaptureConfig) ([]string, error) {
+	if config.Seconds <= 0 || config.Seconds > lanceroMaxCaptureSeconds {
+		return nil, fmt.Errorf("LanceroRawCaptureConfig.Seconds=%v, need (0,%d]", config.Seconds, lanceroMaxCaptureSeconds)
+	}
+	dir := config.Directory
+	if dir == "" {
+		dir = writingPaths.get().BasePath
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("no Directory given for the raw capture, and no writing BasePath")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ls.sourceStateLock.Lock()
+	defer ls.sourceStateLock.Unlock()
+	if ls.sourceState != Active {
+		return nil, fmt.Errorf("cannot capture raw Lancero data unless the LanceroSource is running")
+	}
+	devices := ls.active
+	if len(config.Cards) > 0 {
+		devices = make([]*LanceroDevice, 0, len(config.Cards))
+		for _, devnum := range config.Cards {
+			device := ls.devices[devnum]
+			if device == nil || !contains(ls.active, device) {
+				return nil, fmt.Errorf("no active Lancero card with device number %d", devnum)
+			}
+			devices = append(devices, device)
+		}
+	}
+	duration := time.Duration(config.Seconds * float64(time.Second))
+	filenames := make([]string, 0, len(devices))
+	for _, device := range devices {
+		filename, err := device.startRawCapture(dir, duration)
+		if err != nil {
+			for _, started := range devices[:len(filenames)] {
+				started.endRawCapture("canceled")
+			}
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, nil
+}
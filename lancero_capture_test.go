@@ -0,0 +1,127 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLanceroRawCapture(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_rawcapture_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	device := &LanceroDevice{devnum: 3, nrows: 4, ncols: 1, lsync: 32, frameSize: 16}
+	device.captureRaw([]byte{1, 2}, time.Now(), 0, 0, 0, nil) // no capture: does nothing
+	filename, err := device.startRawCapture(tmp, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := device.startRawCapture(tmp, time.Second); err == nil {
+		t.Error("LanceroDevice.startRawCapture should fail with a capture in progress")
+	}
+	c := device.rawCapture
+	t0 := time.Now()
+	device.captureRaw([]byte("0123456789abcdef"), t0, 4, 8, 1, nil)
+	device.captureRaw([]byte("ghij"), t0.Add(50*time.Millisecond), 0, 0, 0, fmt.Errorf("no frame bits"))
+	device.captureRaw([]byte("klmnopqrstuvwxyz"), t0.Add(time.Second), 4, 8, 1, nil) // ends the capture
+	device.captureRaw([]byte("after"), t0.Add(2*time.Second), 4, 8, 1, nil)
+	if device.rawCapture != nil {
+		t.Error("raw capture should end after its duration")
+	}
+	<-c.done
+
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "0123456789abcdefghijklmnopqrstuvwxyz" {
+		t.Errorf("raw capture file has %q", raw)
+	}
+	metaFile := strings.TrimSuffix(filename, ".bin") + ".json"
+	contents, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta lanceroRawCaptureMeta
+	if err := json.Unmarshal(contents, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.DevNum != 3 || meta.Nrows != 4 || meta.FrameSize != 16 || meta.RawFile != filepath.Base(filename) ||
+		meta.EndReason != "done" {
+		t.Errorf("raw capture metadata = %+v", meta)
+	}
+	wantOffsets := []int64{0, 16, 20}
+	if len(meta.Reads) != len(wantOffsets) {
+		t.Fatalf("raw capture metadata has %d reads, want %d", len(meta.Reads), len(wantOffsets))
+	}
+	for i, read := range meta.Reads {
+		if read.Offset != wantOffsets[i] {
+			t.Errorf("raw capture read %d offset %d, want %d", i, read.Offset, wantOffsets[i])
+		}
+	}
+	if meta.Reads[0].FrameBitsP != 8 || meta.Reads[0].FrameBitsError != "" || meta.Reads[1].FrameBitsError != "no frame bits" {
+		t.Errorf("raw capture reads have frame bits %+v", meta.Reads)
+	}
+	if meta.DroppedReads != 0 {
+		t.Errorf("raw capture dropped %d reads", meta.DroppedReads)
+	}
+
+	// Reads beyond the writer's queue are dropped, not waited for, but still listed in
+	// order. Hold the writer back by queueing before it starts.
+	file, err := os.Create(filepath.Join(tmp, "dropped.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &lanceroRawCapture{file: file, metaName: filepath.Join(tmp, "dropped.json"), until: t0.Add(time.Hour),
+		queue: make(chan lanceroRawChunk, 2), done: make(chan struct{})}
+	device.rawCapture = c
+	device.captureRaw([]byte("A"), t0, 0, 0, 0, nil)
+	device.captureRaw([]byte("BB"), t0, 0, 0, 0, nil)
+	device.captureRaw([]byte("CCC"), t0, 0, 0, 0, nil) // dropped
+	<-c.queue                                          // as if A were written
+	device.captureRaw([]byte("DDDD"), t0, 0, 0, 0, nil)
+	device.captureRaw([]byte("EEEEE"), t0, 0, 0, 0, nil) // dropped
+	if c.dropped != 2 || c.droppedB != 8 || len(c.queue) != 2 {
+		t.Errorf("raw capture with a full queue dropped %d reads (%d bytes), queued %d; want 2 (8), 2",
+			c.dropped, c.droppedB, len(c.queue))
+	}
+	device.endRawCapture("test")
+	c.write(device.devnum)
+	if contents, err = ioutil.ReadFile(c.metaName); err != nil {
+		t.Fatal(err)
+	}
+	meta = lanceroRawCaptureMeta{}
+	if err := json.Unmarshal(contents, &meta); err != nil {
+		t.Fatal(err)
+	}
+	want := []lanceroRawRead{{Offset: 0, Bytes: 2}, {Offset: 2, Bytes: 3, Dropped: true},
+		{Offset: 2, Bytes: 4}, {Offset: 6, Bytes: 5, Dropped: true}}
+	if len(meta.Reads) != len(want) || meta.DroppedReads != 2 || meta.DroppedBytes != 8 {
+		t.Fatalf("raw capture metadata has reads %+v, %d (%d bytes) dropped, want %d reads, 2 (8) dropped",
+			meta.Reads, meta.DroppedReads, meta.DroppedBytes, len(want))
+	}
+	for i, read := range meta.Reads {
+		if read.Offset != want[i].Offset || read.Bytes != want[i].Bytes || read.Dropped != want[i].Dropped ||
+			!read.Time.Equal(t0) {
+			t.Errorf("raw capture read %d is %+v, want %+v at %v", i, read, want[i], t0)
+		}
+	}
+
+	source := new(LanceroSource)
+	for _, seconds := range []float64{0, -1, lanceroMaxCaptureSeconds + 1} {
+		if _, err := source.CaptureRaw(&LanceroRawCaptureConfig{Seconds: seconds, Directory: tmp}); err == nil {
+			t.Errorf("LanceroSource.CaptureRaw(Seconds=%v) should fail", seconds)
+		}
+	}
+	if _, err := source.CaptureRaw(&LanceroRawCaptureConfig{Seconds: 1, Directory: tmp}); err == nil {
+		t.Error("LanceroSource.CaptureRaw should fail when the source is not running")
+	}
+}
@@ -0,0 +1,114 @@
+package dastard
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// lanceroMaxFibers is the number of fibers a Lancero card can read (the width of a FiberMask).
+const lanceroMaxFibers = 16
+
+// lanceroProbeDuration is how long to read each fiber when probing for live fibers.
+// It need only be long enough to find two frame starts.
+const lanceroProbeDuration = 50 * time.Millisecond
+
+// LanceroFiberProbeConfig is the RPC-usable structure for ProbeLanceroFibers.
+type LanceroFiberProbeConfig struct {
+	Cards  []int // device numbers of the cards to probe; empty means all cards
+	Fibers int   // probe fibers 0 through Fibers-1; 0 means all 16
+}
+
+// LanceroFiber is one fiber found to carry live data.
+type LanceroFiber struct {
+	Fiber int
+	Nrows int // rows of the TDM readout on this fiber
+}
+
+// LanceroCardFibers lists the live fibers of one Lancero card.
+type LanceroCardFibers struct {
+	DevNum     int
+	LiveFibers []LanceroFiber
+	FiberMask  uint32 // the live fibers, as a FiberMask
+}
+
+// LanceroFiberReport is the result of ProbeLanceroFibers.
+type LanceroFiberReport struct {
+	Cards              []LanceroCardFibers
+	SuggestedFiberMask uint32   // the fibers that are live on any card
+	Warnings           []string // problems that a FiberMask alone can't fix
+}
+
+// ProbeFibers reads each fiber of the chosen cards alone, to find which ones carry
+// data and how many rows each has, then suggests a FiberMask. It takes a fraction of
+// a second per fiber. The source must be Inactive.
+func (ls *LanceroSource) ProbeFibers(config *LanceroFiberProbeConfig) (*LanceroFiberReport, error) {
+	ls.sourceStateLock.Lock()
+	defer ls.sourceStateLock.Unlock()
+	if ls.sourceState != Inactive {
+		return nil, fmt.Errorf("cannot probe Lancero fibers while the LanceroSource is running")
+	}
+	nfibers := config.Fibers
+	if nfibers == 0 {
+		nfibers = lanceroMaxFibers
+	}
+	if nfibers < 0 || nfibers > lanceroMaxFibers {
+		return nil, fmt.Errorf("LanceroFiberProbeConfig.Fibers=%d, need [0,%d]", nfibers, lanceroMaxFibers)
+	}
+	devnums := config.Cards
+	if len(devnums) == 0 {
+		for devnum, device := range ls.devices {
+			if device != nil && device.card != nil {
+				devnums = append(devnums, devnum)
+			}
+		}
+		sort.Ints(devnums)
+	}
+	if len(devnums) == 0 {
+		return nil, fmt.Errorf("no Lancero cards to probe")
+	}
+
+	report := &LanceroFiberReport{Cards: make([]LanceroCardFibers, 0, len(devnums)), Warnings: make([]string, 0)}
+	rows := make(map[int]bool) // the distinct row counts seen
+	for _, devnum := range devnums {
+		device := ls.devices[devnum]
+		if device == nil || device.card == nil {
+			return nil, fmt.Errorf("no Lancero card with device number %d", devnum)
+		}
+		cf := LanceroCardFibers{DevNum: devnum, LiveFibers: make([]LanceroFiber, 0)}
+		for fiber := 0; fiber < nfibers; fiber++ {
+			probe := LanceroDevice{devnum: devnum, card: device.card, fiberMask: 1 << uint(fiber),
+				cardDelay: device.cardDelay, clockMhz: device.clockMhz}
+			if err := probe.sampleCardFor(lanceroProbeDuration); err != nil {
+				logDebugf("Lancero card %d fiber %d has no live data: %v", devnum, fiber, err)
+				continue
+			}
+			if probe.ncols != 1 {
+				report.Warnings = append(report.Warnings, fmt.Sprintf(
+					"card %d fiber %d alone gave %d columns, want 1", devnum, fiber, probe.ncols))
+				continue
+			}
+			cf.LiveFibers = append(cf.LiveFibers, LanceroFiber{Fiber: fiber, Nrows: probe.nrows})
+			cf.FiberMask |= 1 << uint(fiber)
+			rows[probe.nrows] = true
+		}
+		if len(cf.LiveFibers) == 0 {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("card %d has no live fibers", devnum))
+		}
+		report.SuggestedFiberMask |= cf.FiberMask
+		report.Cards = append(report.Cards, cf)
+	}
+
+	if len(rows) > 1 {
+		report.Warnings = append(report.Warnings,
+			"live fibers have different numbers of rows; all fibers read together must have the same")
+	}
+	for _, cf := range report.Cards {
+		if cf.FiberMask != 0 && cf.FiberMask != report.SuggestedFiberMask {
+			report.Warnings = append(report.Warnings, fmt.Sprintf(
+				"card %d has live fibers 0x%04x, but the FiberMask of all cards must be the same (suggested 0x%04x)",
+				cf.DevNum, cf.FiberMask, report.SuggestedFiberMask))
+		}
+	}
+	return report, nil
+}
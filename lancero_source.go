@@ -2,14 +2,16 @@ package dastard
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"os"
 	"os/signal"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/spf13/viper"
 	"github.com/usnistgov/dastard/lancero"
 )
 
@@ -22,10 +24,25 @@ type LanceroDevice struct {
 	fiberMask   uint32
 	cardDelay   int
 	clockMhz    int
-	frameSize   int // frame size, in bytes
+	frameSize   int     // frame size, in bytes
+	frameRate   float64 // frames per second, as measured by sampleCard
 	adapRunning bool
 	collRunning bool
 	card        lancero.Lanceroer
+
+	// Counters for diagnostics, updated by the reader goroutine. Use sync/atomic to access them.
+	ringBufferErrors int64 // failures to release ring buffer bytes (e.g., overflow)
+	lateReads        int64 // reads that came more than 2 read periods after the previous one
+	lastGoodRead     int64 // UnixNano time of the last read with the expected frame bits
+	bufferSize       int64 // bytes in the ring buffer, as set by StartRun
+	bufferFill       int64 // bytes waiting in the ring buffer at the last read
+	bufferPeak       int64 // the most bytes waiting at any read since the source started
+
+	bufferWarning float64 // warn when the ring buffer is fuller than this fraction (0 for never)
+	bufferWarned  bool    // the reader has warned of the present high fill
+
+	rawCapture     *lanceroRawCapture // the raw capture in progress, if any
+	rawCaptureLock sync.Mutex
 }
 
 // BuffersChanType is an internal message type used to allow
@@ -35,6 +52,7 @@ type BuffersChanType struct {
 	lastSampleTime time.Time
 	timeDiff       time.Duration
 	totalBytes     int
+	err            error // if not nil, the cards' frames cannot be merged, and no more data will come
 }
 
 // LanceroSource is a DataSource that handles 1 or more lancero devices.
@@ -52,6 +70,7 @@ type LanceroSource struct {
 	mixRequests              chan *MixFractionObject
 	currentMix               chan []float64 // allows ConfigureMixFraction to return the currentMix race free
 	externalTriggerLastState bool
+	coupling                 CouplingStatus // FB / error coupling, restored each time the source starts
 	AnySource
 }
 
@@ -60,6 +79,7 @@ func NewLanceroSource() (*LanceroSource, error) {
 	source := new(LanceroSource)
 	source.name = "Lancero"
 	source.nsamp = 1
+	source.coupling = NoCoupling
 	source.devices = make(map[int]*LanceroDevice)
 
 	devnums, err := lancero.EnumerateLanceroDevices()
@@ -71,7 +91,7 @@ func NewLanceroSource() (*LanceroSource, error) {
 		ld := LanceroDevice{devnum: dnum}
 		lan, err := lancero.NewLancero(dnum)
 		if err != nil {
-			log.Printf("warning: failed to open /dev/lancero_user%d and companion devices", dnum)
+			logWarningf("failed to open /dev/lancero_user%d and companion devices", dnum)
 			continue
 		}
 		ld.card = lan
@@ -93,6 +113,49 @@ func (ls *LanceroSource) Delete() {
 	}
 }
 
+// LanceroCardStatus holds the diagnostics of one Lancero card, for the LanceroStatus RPC
+// and the heartbeat.
+type LanceroCardStatus struct {
+	DevNum int
+	Active bool
+	lancero.Diagnostics
+	DiagnosticsError string // non-empty if the registers could not be read
+	ClockLocked      bool   // inferred from the data: frames arrived with the expected frame bits in the last second
+	RingBufferErrors int64
+	LateReads        int64
+	BufferSize       int64   // bytes in the ring buffer
+	BufferFill       float64 // fraction of the ring buffer waiting to be read, at the last read
+	BufferPeak       float64 // highest BufferFill since the source started
+}
+
+// CardStatus returns the diagnostics of all Lancero cards, sorted by device number.
+func (ls *LanceroSource) CardStatus() []LanceroCardStatus {
+	devnums := make([]int, 0, len(ls.devices))
+	for devnum, device := range ls.devices {
+		if device != nil && device.card != nil {
+			devnums = append(devnums, devnum)
+		}
+	}
+	sort.Ints(devnums)
+	result := make([]LanceroCardStatus, 0, len(devnums))
+	for _, devnum := range devnums {
+		device := ls.devices[devnum]
+		status := LanceroCardStatus{DevNum: devnum, Active: contains(ls.active, device),
+			RingBufferErrors: atomic.LoadInt64(&device.ringBufferErrors),
+			LateReads:        atomic.LoadInt64(&device.lateReads)}
+		status.BufferSize, status.BufferFill, status.BufferPeak = device.bufferStatus()
+		d, err := device.card.Diagnostics()
+		if err != nil {
+			status.DiagnosticsError = err.Error()
+		}
+		status.Diagnostics = d
+		lastGood := time.Unix(0, atomic.LoadInt64(&device.lastGoodRead))
+		status.ClockLocked = status.Active && time.Since(lastGood) < time.Second
+		result = append(result, status)
+	}
+	return result
+}
+
 // used to make sure the same device isn't used twice
 func contains(s []*LanceroDevice, e *LanceroDevice) bool {
 	for _, a := range s {
@@ -114,6 +177,7 @@ type LanceroSourceConfig struct {
 	ActiveCards       []int
 	AvailableCards    []int
 	ShouldAutoRestart bool
+	Naming            ChannelNaming // CardOffsets apply in the order of ActiveCards
 }
 
 // Configure sets up the internal buffers with given size, speed, and min/max.
@@ -133,10 +197,14 @@ func (ls *LanceroSource) Configure(config *LanceroSourceConfig) (err error) {
 	if config.Nsamp > 16 || config.Nsamp < 1 {
 		return fmt.Errorf("LanceroSourceConfig.Nsamp=%d but requires 1<=NSAMP<=16", config.Nsamp)
 	}
+	if err := config.Naming.validate(); err != nil {
+		return err
+	}
 
 	ls.active = make([]*LanceroDevice, 0)
 	ls.clockMhz = config.ClockMhz
 	ls.shouldAutoRestart = config.ShouldAutoRestart
+	ls.naming = config.Naming
 	for i, c := range config.ActiveCards {
 		dev := ls.devices[c]
 		if dev == nil {
@@ -161,6 +229,9 @@ func (ls *LanceroSource) Configure(config *LanceroSourceConfig) (err error) {
 	sort.Ints(config.AvailableCards)
 
 	ls.nsamp = config.Nsamp
+	if err == nil {
+		ls.sourceConfig = *config
+	}
 	return err
 }
 
@@ -176,6 +247,7 @@ func (ls *LanceroSource) updateChanOrderMap() {
 	for i := 0; i < nChannelsAllCards; i++ {
 		ls.Mix[i] = &Mix{}
 	}
+	ls.setMixFractions(make([]float64, nChannelsAllCards))
 	ls.chan2readoutOrder = make([]int, nChannelsAllCards)
 	nchanPrevDevices := 0
 	for _, dev := range ls.active {
@@ -203,6 +275,7 @@ func (ls *LanceroSource) ConfigureMixFraction(mfo *MixFractionObject) ([]float64
 	}
 	ls.mixRequests <- mfo
 	current := <-ls.currentMix // retrieve current mix race-free
+	ls.setMixFractions(current)
 	return current, nil
 }
 
@@ -217,6 +290,12 @@ func (ls *LanceroSource) Sample() error {
 			return err
 		}
 		ls.nchan += device.ncols * device.nrows * 2
+	}
+	if err := checkCardTiming(ls.active); err != nil {
+		return err
+	}
+	if len(ls.active) > 0 {
+		device := ls.active[0]
 		ls.sampleRate = float64(device.clockMhz) * 1e6 / float64(device.lsync*device.nrows)
 	}
 
@@ -242,30 +321,68 @@ func (ls *LanceroSource) Sample() error {
 	ls.currentMix = make(chan []float64, MIXDEPTH)
 
 	ls.rowColCodes = make([]RowColCode, ls.nchan)
+	ls.chanNames = make([]string, ls.nchan)
+	ls.chanNumbers = make([]int, ls.nchan)
 	i := 0
-	for _, device := range ls.active {
+	number := 1
+	for card, device := range ls.active {
+		number = ls.naming.firstNumber(card, number)
 		cardNchan := device.ncols * device.nrows * 2
 		for j := 0; j < cardNchan; j += 2 {
 			col := j / (2 * device.nrows)
 			row := (j % (2 * device.nrows)) / 2
 			ls.rowColCodes[i+j] = rcCode(row, col, device.nrows, device.ncols)
 			ls.rowColCodes[i+j+1] = ls.rowColCodes[i+j]
+			ls.chanNames[i+j] = ls.naming.name(number, true)
+			ls.chanNames[i+j+1] = ls.naming.name(number, false)
+			ls.chanNumbers[i+j] = number
+			ls.chanNumbers[i+j+1] = number
+			number++
 		}
 		i += cardNchan
 	}
-	ls.chanNames = make([]string, ls.nchan)
-	ls.chanNumbers = make([]int, ls.nchan)
-	for i := 1; i < ls.nchan; i += 2 {
-		ls.chanNames[i-1] = fmt.Sprintf("err%d", 1+i/2)
-		ls.chanNames[i] = fmt.Sprintf("chan%d", 1+i/2)
-		ls.chanNumbers[i-1] = 1 + i/2
-		ls.chanNumbers[i] = 1 + i/2
-	}
+	return ls.checkChannelNames()
+}
 
+// cardLsyncTolerance is the largest fractional difference between the line syncs that
+// sampleCard measures on two cards for them to count as the same. The measurement
+// depends on the read timing, so it can be off by a unit or so.
+const cardLsyncTolerance = 0.01
+
+// checkCardTiming verifies that all the cards share one clock rate, line sync, and thus
+// frame rate, because their channels are read out and processed frame by frame together.
+// The error names the first card that differs from the first one.
+func checkCardTiming(devices []*LanceroDevice) error {
+	if len(devices) == 0 {
+		return nil
+	}
+	ref := devices[0]
+	for _, device := range devices[1:] {
+		if device.clockMhz != ref.clockMhz {
+			return fmt.Errorf("lancero card %d has a %d MHz clock, but card %d has %d MHz",
+				device.devnum, device.clockMhz, ref.devnum, ref.clockMhz)
+		}
+		if math.Abs(float64(device.lsync-ref.lsync)) > cardLsyncTolerance*float64(ref.lsync) {
+			return fmt.Errorf("lancero card %d has line sync %d (measured %.1f frames/s), but card %d has %d (%.1f frames/s)",
+				device.devnum, device.lsync, device.frameRate, ref.devnum, ref.lsync, ref.frameRate)
+		}
+		if device.nrows != ref.nrows {
+			return fmt.Errorf("lancero card %d has %d rows, but card %d has %d, so their frame rates differ",
+				device.devnum, device.nrows, ref.devnum, ref.nrows)
+		}
+	}
 	return nil
 }
 
 func (device *LanceroDevice) sampleCard() error {
+	// the NoHardware tests can fail if this is too long, since I test with multiple lancero devices,
+	// the first device has to wait for all other devices to finish
+	return device.sampleCardFor(200 * time.Millisecond)
+}
+
+// sampleCardFor reads the card for at least minDuration to learn ncols, nrows, and lsync.
+// Longer reads make lsync more reliable.
+func (device *LanceroDevice) sampleCardFor(minDuration time.Duration) error {
 	lan := device.card
 
 	if err := lan.ChangeRingBuffer(1200000, 400000); err != nil {
@@ -277,8 +394,7 @@ func (device *LanceroDevice) sampleCard() error {
 	}
 
 	defer lan.StopAdapter()
-	log.Println("sampling card:")
-	log.Println(spew.Sdump(lan))
+	logDebugf("sampling card:\n%s", spew.Sdump(lan))
 	lan.InspectAdapter()
 
 	linePeriod := 1 // use dummy values for things we will learn by sampling data
@@ -312,9 +428,9 @@ func (device *LanceroDevice) sampleCard() error {
 	}
 	timeFix = timeFix0
 	var buffer []byte
-	minDuration := 200 * time.Millisecond // the NoHardware tests can fail if this is too long, since I test with multiple lancero devices, the first device has to wait for all other devices to finish
 	var bytesReadSinceTimeFix0 int64
 	frameBitsHandled := false
+	var frameBitsErr error
 	for timeFix.Sub(timeFix0) < minDuration {
 		// notice above we called AvailableBuffer and discarded data, noted timeFix0
 		// here we read for at least minDuration, counting all bytes read (hopefully reading for this long will make lsync reliably correct)
@@ -336,7 +452,9 @@ func (device *LanceroDevice) sampleCard() error {
 			bytesReadSinceTimeFix0 += int64(len(b))
 			if !frameBitsHandled {
 				buffer = append(buffer, b...) // only append if framebits havent been handled, to reduce unneeded memory usage
-				log.Println(lancero.OdDashTX(buffer, 10))
+			}
+			if !frameBitsHandled && len(buffer) > 0 {
+				logDebugf("%s", lancero.OdDashTX(buffer, 10))
 				q, p, n, err3 := lancero.FindFrameBits(buffer)
 				if err3 == nil {
 					device.ncols = n
@@ -344,7 +462,7 @@ func (device *LanceroDevice) sampleCard() error {
 					device.frameSize = device.ncols * device.nrows * 4
 					frameBitsHandled = true
 				} else {
-					fmt.Printf("Error in findFrameBits: %v", err3)
+					frameBitsErr = err3 // later reads might find the frame bits
 				}
 			}
 			lan.ReleaseBytes(len(b))
@@ -353,11 +471,15 @@ func (device *LanceroDevice) sampleCard() error {
 	if frameBitsHandled {
 		periodNS := timeFix.Sub(timeFix0).Nanoseconds() / (bytesReadSinceTimeFix0 / int64(device.frameSize))
 		device.lsync = roundint((float64(periodNS) / 1000) * float64(device.clockMhz) / float64(device.nrows))
-		log.Printf("cols=%d  rows=%d  frame period %5d ns, lsync=%d\n", device.ncols,
+		device.frameRate = 1e9 / float64(periodNS)
+		logInfof("cols=%d  rows=%d  frame period %5d ns, lsync=%d", device.ncols,
 			device.nrows, periodNS, device.lsync)
 		return nil
 	}
-	return fmt.Errorf("failed to SampleCard")
+	if frameBitsErr == nil {
+		return fmt.Errorf("failed to SampleCard: no data")
+	}
+	return fmt.Errorf("failed to SampleCard: error in findFrameBits: %v", frameBitsErr)
 }
 
 // Imperfect round to nearest integer
@@ -370,6 +492,13 @@ func roundint(x float64) int {
 // a fraction of a frame.
 func (ls *LanceroSource) StartRun() error {
 
+	// Restore the FB / error coupling last set by SetCoupling.
+	if ls.coupling == FBToErr || ls.coupling == ErrToFB {
+		if err := ls.SetCoupling(ls.coupling); err != nil {
+			logWarningf("Could not restore the FB / error coupling: %v", err)
+		}
+	}
+
 	// Starting the source for all active cards has 3 steps per card.
 	for _, device := range ls.active {
 		// 1. Resize the ring buffer to hold up to 16,384 frames
@@ -390,6 +519,7 @@ func (ls *LanceroSource) StartRun() error {
 		if err := lan.ChangeRingBuffer(bufsize, thresh); err != nil {
 			return fmt.Errorf("failed to change ring buffer size (driver problem): %v", err)
 		}
+		device.resetBufferFill(bufsize, viper.GetFloat64("lancerobufferwarning"))
 		// 2. Start the adapter and collector components in firmware
 		const Timeout int = 2 // seconds
 		if err := lan.StartAdapter(Timeout); err != nil {
@@ -439,7 +569,7 @@ func (ls *LanceroSource) StartRun() error {
 			if err == nil {
 				if firstWord > 0 {
 					bytesToRelease := 4 * firstWord
-					log.Printf("First frame bit at word %d, so release %d of %d bytes\n", firstWord, bytesToRelease, len(bytes))
+					logDebugf("First frame bit at word %d, so release %d of %d bytes", firstWord, bytesToRelease, len(bytes))
 					lan.ReleaseBytes(bytesToRelease)
 				}
 				success = true
@@ -455,109 +585,237 @@ func (ls *LanceroSource) StartRun() error {
 	return nil
 }
 
-// launchLanceroReader launches a goroutine that reads from the Lancero card
-// whenever prompted by a ticker with a duration of ls.readPeriod.
-// It then demuxes the data and puts it on ls.BuffersChan. A second goroutine
-// receives data buffers on that channel. Because the channel is buffered with
-// a large capacity, the Lancero can read with minimum potential for overflowing
-// because of long latency in the analysis stages of Dastard.
+// lanceroChunk is the whole frames that one card's reader goroutine copied out of the
+// card's ring buffer, for the merging goroutine.
+type lanceroChunk struct {
+	ibuf     int       // index of the card in ls.active
+	data     []RawType // the frames, in the card's readout order
+	lastTime time.Time // time of the last frame, as reported by the driver
+}
 
+// launchLanceroReader launches one goroutine per active card that reads from the
+// card whenever prompted by a ticker with a duration of ls.readPeriod, plus one
+// goroutine that merges their frames and puts them on ls.buffersChan. Each card's
+// reader copies the whole frames out of its ring buffer and releases them at once, so
+// one card's latency doesn't stall reading the others. The readers run on the CPUs (and
+// at the priority) set by the Readers of the "cpu" config. The merger demuxes as many
+// frames as every card has supplied, keeping any extra frames for the next merge, so
+// the frames of all cards stay aligned. If one card lags so far behind that another's
+// frames waiting to be merged exceed lanceroMergerLimit, the merger gives up, and the
+// source stops with an error. A second goroutine receives data buffers on
+// ls.buffersChan. Because the channel is buffered with a large capacity, the Lancero
+// can read with minimum potential for overflowing because of long latency in the
+// analysis stages of Dastard.
 func (ls *LanceroSource) launchLanceroReader() {
 	ls.buffersChan = make(chan BuffersChanType, 100)
 	ls.readPeriod = 50 * time.Millisecond
+	chunks := make(chan lanceroChunk, 4*len(ls.active))
+	var readers sync.WaitGroup
+	for ibuf, dev := range ls.active {
+		readers.Add(1)
+		go func(ibuf int, dev *LanceroDevice) {
+			defer readers.Done()
+			ls.pinReader()
+			dev.readFrames(ibuf, ls.readPeriod, chunks, ls.abortSelf)
+		}(ibuf, dev)
+	}
+
 	go func() {
-		ticker := time.NewTicker(ls.readPeriod)
+		merger := newLanceroMerger(ls.active, int(lanceroMergerLimit.Seconds()*ls.sampleRate))
+		failed := false
 		for {
+			var chunk lanceroChunk
 			select {
 			case <-ls.abortSelf:
-				close(ls.buffersChan)
+				readers.Wait()
+				if !failed {
+					close(ls.buffersChan)
+				}
 				return
+			case chunk = <-chunks:
+			}
+			if failed {
+				continue // discard the readers' frames until the source stops
+			}
+			datacopies, lastSampleTime, totalBytes, err := merger.add(chunk)
+			if err != nil {
+				failed = true
+				select {
+				case ls.buffersChan <- BuffersChanType{err: err}:
+				case <-ls.abortSelf:
+				}
+				close(ls.buffersChan)
+				continue
+			}
+			if datacopies == nil {
+				continue
+			}
+			timeDiff := lastSampleTime.Sub(ls.lastread)
+			ls.lastread = lastSampleTime
+			if len(ls.buffersChan) == cap(ls.buffersChan) {
+				panic(fmt.Sprintf("internal buffersChan full, len %v, capacity %v", len(ls.buffersChan), cap(ls.buffersChan)))
+			}
+			ls.buffersChan <- BuffersChanType{datacopies: datacopies, lastSampleTime: lastSampleTime,
+				timeDiff: timeDiff, totalBytes: totalBytes}
+		}
+	}()
+}
 
-			case <-ticker.C:
-				var buffers [][]RawType
-				framesUsed := math.MaxInt64
-				var lastSampleTime time.Time
+// lanceroMergerLimit is the most data that the merger holds for any one card.
+const lanceroMergerLimit = 5 * time.Second
 
-				for _, dev := range ls.active {
+// lanceroMerger holds the frames read from each card until all cards have supplied them.
+type lanceroMerger struct {
+	devices   []*LanceroDevice
+	nchan     int         // data streams of all cards
+	maxFrames int         // the most frames queued for any card (0 for no limit)
+	queued    [][]RawType // frames read but not yet merged, per card
+	lastTimes []time.Time // time of each card's last queued frame
+	fresh     []bool      // card has delivered frames since the last merge
+}
 
-					b, timeFix, err := dev.card.AvailableBuffer()
-					if err != nil {
-						panic("Warning: AvailableBuffer failed")
-					}
-					buffers = append(buffers, bytesToRawType(b))
-					bframes := len(b) / dev.frameSize
-					if bframes < framesUsed {
-						framesUsed = bframes
-						lastSampleTime = timeFix
-					}
-				}
-				timeDiff := lastSampleTime.Sub(ls.lastread)
-				if timeDiff > 2*ls.readPeriod {
-					fmt.Println("timeDiff in lancero reader", timeDiff)
-				}
-				ls.lastread = lastSampleTime
-				// check for changes in nrow, ncol and lsync
-				for ibuf, dev := range ls.active {
-					buffer := buffers[ibuf]
-					q, p, n, err := lancero.FindFrameBits(rawTypeToBytes(buffer))
-					if err != nil {
-						panic(fmt.Sprintf("Error in findFrameBits: %v", err))
-					}
-					qExpect := dev.ncols * dev.nrows
-					// FindFrameBits q is the index of the first frame bit after a non frame bit
-					ncols := n
-					nrows := (p - q) / n
-					periodNS := timeDiff.Nanoseconds() / int64(framesUsed)
-					lsync := roundint((float64(periodNS) / 1000) * float64(dev.clockMhz) / float64(nrows))
-					if q != qExpect || ncols != dev.ncols || nrows != dev.nrows || framesUsed <= 0 {
-						fmt.Printf("(Not checking lsync) have ibuf %v, q %v, ncols %v, nrows %v, lsync %v, framesUsed %v\nwant q %v, ncols %v, nrows %v, lsync %v, dataBlockCount %v\n",
-							ibuf, q, ncols, nrows, lsync, framesUsed, qExpect, dev.ncols, dev.nrows, dev.lsync, ls.dataBlockCount)
-						panic("error reading from lancero, probably let buffer overfill")
-					}
-				}
-				// Consume framesUsed frames of data from each channel.
-				// Careful! This slice of slices will be in lancero READOUT order:
-				// r0c0, r0c1, r0c2, etc.
-				datacopies := make([][]RawType, ls.nchan)
-				for i := range ls.processors {
-					datacopies[i] = make([]RawType, framesUsed)
-				}
+func newLanceroMerger(devices []*LanceroDevice, maxFrames int) *lanceroMerger {
+	m := &lanceroMerger{devices: devices, maxFrames: maxFrames, queued: make([][]RawType, len(devices)),
+		lastTimes: make([]time.Time, len(devices)), fresh: make([]bool, len(devices))}
+	for _, dev := range devices {
+		m.nchan += dev.ncols * dev.nrows * 2
+	}
+	return m
+}
 
-				// NOTE: Galen reversed the inner loop order here, it was previously frames, then datastreams.
-				// This loop is the demultiplexing step. Loop over devices, data streams, then frames.
-				// For a single lancero 8x30 with linePeriod=20=160 ns this version handles:
-				// this loop handles 10938 frames in 20.5 ms on 687horton, aka aka 1.9 us/frame
-				// the previous loop handles 52000 frames in 253 ms, aka 4.8 us/frame
-				// when running more than 2 lancero cards, even this version may not keep up reliably
-				nchanPrevDevices := 0
-				for ibuf, dev := range ls.active {
-					buffer := buffers[ibuf]
-					nchan := dev.ncols * dev.nrows * 2
-					for i := 0; i < nchan; i++ {
-						dc := datacopies[i+nchanPrevDevices]
-						idx := i
-						for j := 0; j < framesUsed; j++ {
-							dc[j] = buffer[idx]
-							idx += nchan
-						}
-					}
-					nchanPrevDevices += nchan
-				}
-				// Inform the driver to release the data we just consumed
-				totalBytes := 0
-				for _, dev := range ls.active {
-					release := framesUsed * dev.frameSize
-					dev.card.ReleaseBytes(release)
-					totalBytes += release
-				}
-				if len(ls.buffersChan) == cap(ls.buffersChan) {
-					panic(fmt.Sprintf("internal buffersChan full, len %v, capacity %v", len(ls.buffersChan), cap(ls.buffersChan)))
-				}
-				ls.buffersChan <- BuffersChanType{datacopies: datacopies, lastSampleTime: lastSampleTime,
-					timeDiff: timeDiff, totalBytes: totalBytes}
+// add queues a chunk of frames. Once per round of reads (when every card has delivered
+// new frames), it demuxes the frames that all cards have. It returns them as one slice
+// per data stream in lancero READOUT order (r0c0, r0c1, r0c2, etc.), along with the time
+// of their last frame and the bytes they took in the cards' ring buffers. Otherwise it
+// returns nil. It returns an error if the chunk's card has more than maxFrames frames
+// queued, because another card lags too far behind.
+func (m *lanceroMerger) add(chunk lanceroChunk) (datacopies [][]RawType, lastSampleTime time.Time, totalBytes int,
+	err error) {
+	m.queued[chunk.ibuf] = append(m.queued[chunk.ibuf], chunk.data...)
+	m.lastTimes[chunk.ibuf] = chunk.lastTime
+	m.fresh[chunk.ibuf] = true
+
+	framesUsed := math.MaxInt64
+	allFresh := true
+	slowest := 0
+	for ibuf, dev := range m.devices {
+		allFresh = allFresh && m.fresh[ibuf]
+		if frames := len(m.queued[ibuf]) / (dev.ncols * dev.nrows * 2); frames < framesUsed {
+			framesUsed = frames
+			lastSampleTime = m.lastTimes[ibuf]
+			slowest = ibuf
+		}
+	}
+	dev := m.devices[chunk.ibuf]
+	if queued := len(m.queued[chunk.ibuf]) / (dev.ncols * dev.nrows * 2); m.maxFrames > 0 && queued > m.maxFrames {
+		return nil, time.Time{}, 0, fmt.Errorf("lancero device %d has %d frames waiting to be merged (limit %d), "+
+			"because device %d has delivered only %d", dev.devnum, queued, m.maxFrames,
+			m.devices[slowest].devnum, framesUsed)
+	}
+	if !allFresh || framesUsed <= 0 {
+		return nil, time.Time{}, 0, nil
+	}
+	for ibuf := range m.fresh {
+		m.fresh[ibuf] = false
+	}
+
+	// Consume framesUsed frames of data from each channel.
+	datacopies = make([][]RawType, m.nchan)
+	for i := range datacopies {
+		datacopies[i] = make([]RawType, framesUsed)
+	}
+
+	// NOTE: Galen reversed the inner loop order here, it was previously frames, then datastreams.
+	// This loop is the demultiplexing step. Loop over devices, data streams, then frames.
+	// For a single lancero 8x30 with linePeriod=20=160 ns this version handles:
+	// this loop handles 10938 frames in 20.5 ms on 687horton, aka aka 1.9 us/frame
+	// the previous loop handles 52000 frames in 253 ms, aka 4.8 us/frame
+	// when running more than 2 lancero cards, even this version may not keep up reliably
+	nchanPrevDevices := 0
+	for ibuf, dev := range m.devices {
+		buffer := m.queued[ibuf]
+		nchan := dev.ncols * dev.nrows * 2
+		for i := 0; i < nchan; i++ {
+			dc := datacopies[i+nchanPrevDevices]
+			idx := i
+			for j := 0; j < framesUsed; j++ {
+				dc[j] = buffer[idx]
+				idx += nchan
 			}
 		}
-	}()
+		nchanPrevDevices += nchan
+		// Keep the extra frames, without holding on to the merged ones.
+		m.queued[ibuf] = append([]RawType{}, buffer[framesUsed*nchan:]...)
+		totalBytes += framesUsed * dev.frameSize
+	}
+	return datacopies, lastSampleTime, totalBytes, nil
+}
+
+// readFrames reads the card whenever prompted by a ticker with a duration of
+// readPeriod, until abort is closed. Each read's whole frames are checked for changes
+// in nrow and ncol, copied, released from the ring buffer, and sent on chunks.
+func (device *LanceroDevice) readFrames(ibuf int, readPeriod time.Duration, chunks chan<- lanceroChunk,
+	abort <-chan struct{}) {
+	ticker := time.NewTicker(readPeriod)
+	defer ticker.Stop()
+	defer device.endRawCapture("source stopped")
+	var lastRead time.Time
+	for {
+		select {
+		case <-abort:
+			return
+		case <-ticker.C:
+		}
+		b, timeFix, err := device.card.AvailableBuffer()
+		if err != nil {
+			panic("Warning: AvailableBuffer failed")
+		}
+		device.noteBufferFill(len(b))
+		frames := len(b) / device.frameSize
+		if frames <= 0 {
+			continue
+		}
+		if !lastRead.IsZero() {
+			if timeDiff := timeFix.Sub(lastRead); timeDiff > 2*readPeriod {
+				logWarningf("timeDiff in lancero device %v reader %v", device.devnum, timeDiff)
+				atomic.AddInt64(&device.lateReads, 1)
+			}
+		}
+		lastRead = timeFix
+
+		// check for changes in nrow and ncol
+		nbytes := frames * device.frameSize
+		q, p, n, err := lancero.FindFrameBits(b[:nbytes])
+		device.captureRaw(b[:nbytes], timeFix, q, p, n, err)
+		if err != nil {
+			device.endRawCapture(fmt.Sprintf("frame bits error: %v", err))
+			panic(fmt.Sprintf("Error in findFrameBits: %v", err))
+		}
+		qExpect := device.ncols * device.nrows
+		// FindFrameBits q is the index of the first frame bit after a non frame bit
+		ncols := n
+		nrows := (p - q) / n
+		if q != qExpect || ncols != device.ncols || nrows != device.nrows {
+			logErrorf("(Not checking lsync) have device %v, q %v, ncols %v, nrows %v, frames %v\nwant q %v, ncols %v, nrows %v, lsync %v",
+				device.devnum, q, ncols, nrows, frames, qExpect, device.ncols, device.nrows, device.lsync)
+			device.endRawCapture("unexpected frame bits")
+			panic("error reading from lancero, probably let buffer overfill")
+		}
+		atomic.StoreInt64(&device.lastGoodRead, timeFix.UnixNano())
+
+		// Copy the frames, so the driver can release them right away.
+		data := make([]RawType, nbytes/2)
+		copy(data, bytesToRawType(b[:nbytes]))
+		if err := device.card.ReleaseBytes(nbytes); err != nil {
+			atomic.AddInt64(&device.ringBufferErrors, 1)
+			logWarningf("lancero device %v: %v", device.devnum, err)
+		}
+		select {
+		case chunks <- lanceroChunk{ibuf: ibuf, data: data, lastTime: timeFix}:
+		case <-abort:
+			return
+		}
+	}
 }
 
 // getNextBlock returns the channel on which data sources send data and any errors.
@@ -589,6 +847,12 @@ func (ls *LanceroSource) getNextBlock() chan *dataBlock {
 				ls.currentMix <- mixFrac
 
 			case buffersMsg, ok := <-ls.buffersChan:
+				if buffersMsg.err != nil {
+					ls.stop()
+					ls.nextBlock <- &dataBlock{err: buffersMsg.err}
+					close(ls.nextBlock)
+					return
+				}
 				//  Check is buffersChan closed? Recognize that by receiving zero values and/or being drained.
 				if buffersMsg.datacopies == nil || !ok {
 					block := new(dataBlock)
@@ -654,11 +918,16 @@ func (ls *LanceroSource) distributeData(buffersMsg BuffersChanType) *dataBlock {
 
 	for channelIndex := 0; channelIndex < nchan; channelIndex++ {
 		data := datacopies[ls.chan2readoutOrder[channelIndex]]
+		var triggerData []RawType
 		if channelIndex%2 == 1 { // feedback channel needs more processing
 			mix := ls.Mix[channelIndex]
 			errData := datacopies[ls.chan2readoutOrder[channelIndex-1]]
 			//	MixRetardFb alters data in place to mix some of errData in based on mix.errorScale
 			mix.MixRetardFb(&data, &errData)
+			// Copy the error signal, so this channel can trigger on it (TriggerOnError)
+			// while the error channel processes its own data.
+			triggerData = make([]RawType, len(errData))
+			copy(triggerData, errData)
 		}
 		seg := DataSegment{
 			rawData:         data,
@@ -666,6 +935,8 @@ func (ls *LanceroSource) distributeData(buffersMsg BuffersChanType) *dataBlock {
 			framePeriod:     ls.samplePeriod,
 			firstFramenum:   ls.nextFrameNum,
 			firstTime:       firstTime,
+			triggerData:     triggerData,
+			triggerSigned:   true, // error signals are signed
 		}
 		block.segments[channelIndex] = seg
 		block.nSamp = len(data)
@@ -673,12 +944,12 @@ func (ls *LanceroSource) distributeData(buffersMsg BuffersChanType) *dataBlock {
 	ls.nextFrameNum += FrameIndex(framesUsed)
 	if ls.heartbeats != nil {
 		ls.heartbeats <- Heartbeat{Running: true, DataMB: float64(totalBytes) / 1e6,
-			Time: timeDiff.Seconds()}
+			Time: timeDiff.Seconds(), Frames: framesUsed, Backlog: len(ls.buffersChan)}
 	}
 	now := time.Now()
 	delay := now.Sub(lastSampleTime)
 	if delay > 100*time.Millisecond {
-		log.Printf("Buffer %v/%v, now-firstTime %v\n", len(ls.buffersChan), cap(ls.buffersChan), now.Sub(firstTime))
+		logWarningf("Buffer %v/%v, now-firstTime %v", len(ls.buffersChan), cap(ls.buffersChan), now.Sub(firstTime))
 	}
 
 	return block
@@ -702,8 +973,36 @@ func (ls *LanceroSource) stop() error {
 	return nil
 }
 
-// SetCoupling set up the trigger broker to connect err->FB, FB->err, or neither
+// validateCoupling checks that status is a known coupling, and that (if it couples
+// anything) the channels come in pairs of the error and FB channels of one pixel.
+func (ls *LanceroSource) validateCoupling(status CouplingStatus) error {
+	switch status {
+	case NoCoupling:
+		return nil
+	case FBToErr, ErrToFB:
+	default:
+		return fmt.Errorf("CouplingStatus %d is not valid, need %d (none), %d (FB->error), or %d (error->FB)",
+			status, NoCoupling, FBToErr, ErrToFB)
+	}
+	if ls.nchan%2 != 0 {
+		return fmt.Errorf("Lancero source has %d channels, not pairs of error and FB channels", ls.nchan)
+	}
+	if len(ls.rowColCodes) == ls.nchan {
+		for i := 0; i < ls.nchan; i += 2 {
+			if ls.rowColCodes[i] != ls.rowColCodes[i+1] {
+				return fmt.Errorf("Lancero channels %d and %d are not the error and FB channels of one pixel", i, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// SetCoupling set up the trigger broker to connect err->FB, FB->err, or neither.
+// The coupling is kept, and restored each time the source starts.
 func (ls *LanceroSource) SetCoupling(status CouplingStatus) error {
+	if err := ls.validateCoupling(status); err != nil {
+		return err
+	}
 	// Notice that status == NoCoupling will visit both else clauses in this
 	// function and therefore delete the connections from either sort of coupling.
 	// It is safe to call DeleteConnection on pairs that are unconnected.
@@ -726,5 +1025,6 @@ func (ls *LanceroSource) SetCoupling(status CouplingStatus) error {
 			ls.broker.DeleteConnection(i+1, i)
 		}
 	}
+	ls.coupling = status
 	return nil
 }
@@ -1,6 +1,7 @@
 package dastard
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -116,6 +117,7 @@ func TestNoHardwareSource(t *testing.T) {
 	if err := source.Configure(&config); err != nil {
 		t.Error("LanceroSource.Configure fails:", err)
 	}
+	source.coupling = FBToErr // as if set before the source last stopped
 
 	if err := Start(source, nil, 256, 1024); err != nil {
 		source.Stop()
@@ -123,6 +125,11 @@ func TestNoHardwareSource(t *testing.T) {
 	}
 	defer source.Stop()
 
+	for _, device := range source.active {
+		if device.frameRate <= 0 {
+			t.Errorf("lancero card %d has measured frame rate %v, want > 0", device.devnum, device.frameRate)
+		}
+	}
 	if source.chanNumbers[3] != 2 {
 		t.Errorf("LanceroSource.chanNumbers[3] has %v, want 2", source.chanNumbers[3])
 	}
@@ -132,6 +139,36 @@ func TestNoHardwareSource(t *testing.T) {
 	if source.chanNames[2] != "err2" {
 		t.Errorf("LanceroSource.chanNames[2] %v, want err2", source.chanNames[3])
 	}
+	if !source.broker.isConnected(3, 2) || source.broker.isConnected(2, 3) {
+		t.Error("LanceroSource did not restore its FB->error coupling when started")
+	}
+	// Wait for the reader to get good data from every card
+	var cardStatus []LanceroCardStatus
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		cardStatus = source.CardStatus()
+		allLocked := true
+		for _, cs := range cardStatus {
+			allLocked = allLocked && cs.ClockLocked
+		}
+		if allLocked {
+			break
+		}
+	}
+	if len(cardStatus) != nLancero {
+		t.Fatalf("LanceroSource.CardStatus() has %d cards, want %d", len(cardStatus), nLancero)
+	}
+	for i, cs := range cardStatus {
+		if cs.DevNum != i || !cs.Active || !cs.AdapterRunning || !cs.CollectorRunning {
+			t.Errorf("LanceroSource.CardStatus()[%d]=%+v, want an active, running card %d", i, cs, i)
+		}
+		if cs.BufferSize <= 0 || cs.BufferPeak < cs.BufferFill {
+			t.Errorf("LanceroSource.CardStatus()[%d] has buffer size %d, fill %v, peak %v", i, cs.BufferSize,
+				cs.BufferFill, cs.BufferPeak)
+		}
+		if !cs.ClockLocked || cs.RingBufferErrors != 0 || len(cs.DiagnosticsError) > 0 {
+			t.Errorf("LanceroSource.CardStatus()[%d]=%+v, want a clock-locked card with no errors", i, cs)
+		}
+	}
 	mfo := MixFractionObject{ChannelIndices: []int{0}, MixFractions: []float64{1.0}}
 	if _, err := source.ConfigureMixFraction(&mfo); err == nil {
 		t.Error("expected error for mixing on even channel")
@@ -150,6 +187,45 @@ func TestNoHardwareSource(t *testing.T) {
 	// then Stop() will error but the err value is not checked so it doesn't cause a test failure
 }
 
+func TestProbeLanceroFibers(t *testing.T) {
+	source := new(LanceroSource)
+	source.devices = make(map[int]*LanceroDevice)
+	for i, live := range []uint32{0x5, 0x4} {
+		lan, err := lancero.NewNoHardware(1, 4, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lan.SetLiveFibers(live)
+		source.devices[i] = &LanceroDevice{card: lan, devnum: i, clockMhz: 125}
+		source.ncards++
+	}
+	report, err := source.ProbeFibers(&LanceroFiberProbeConfig{Fibers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SuggestedFiberMask != 0x5 {
+		t.Errorf("ProbeFibers suggests FiberMask 0x%x, want 0x5", report.SuggestedFiberMask)
+	}
+	if len(report.Cards) != 2 {
+		t.Fatalf("ProbeFibers reports %d cards, want 2", len(report.Cards))
+	}
+	card0 := report.Cards[0]
+	if card0.FiberMask != 0x5 || len(card0.LiveFibers) != 2 || card0.LiveFibers[0].Fiber != 0 ||
+		card0.LiveFibers[1].Fiber != 2 || card0.LiveFibers[1].Nrows != 4 {
+		t.Errorf("ProbeFibers card 0 report %+v, want live fibers 0 and 2 with 4 rows", card0)
+	}
+	if report.Cards[1].FiberMask != 0x4 || len(report.Warnings) != 1 {
+		t.Errorf("ProbeFibers reports card 1 mask 0x%x and warnings %v, want 0x4 and a mismatched-card warning",
+			report.Cards[1].FiberMask, report.Warnings)
+	}
+	if _, err := source.ProbeFibers(&LanceroFiberProbeConfig{Cards: []int{7}}); err == nil {
+		t.Error("ProbeFibers should fail for a card that doesn't exist")
+	}
+	if _, err := source.ProbeFibers(&LanceroFiberProbeConfig{Fibers: 17}); err == nil {
+		t.Error("ProbeFibers should fail with Fibers > 16")
+	}
+}
+
 func TestMix(t *testing.T) {
 	data := make([]RawType, 10)
 	errData := make([]RawType, len(data))
@@ -227,3 +303,115 @@ func TestMix(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckCardTiming(t *testing.T) {
+	card := func(devnum, clockMhz, lsync, nrows int) *LanceroDevice {
+		return &LanceroDevice{devnum: devnum, clockMhz: clockMhz, lsync: lsync, nrows: nrows}
+	}
+	if err := checkCardTiming(nil); err != nil {
+		t.Error(err)
+	}
+	if err := checkCardTiming([]*LanceroDevice{card(0, 125, 1000, 8), card(3, 125, 1002, 8)}); err != nil {
+		t.Errorf("cards whose measured line syncs differ slightly should pass: %v", err)
+	}
+	for _, test := range []struct {
+		devices []*LanceroDevice
+		want    string
+	}{
+		{[]*LanceroDevice{card(0, 125, 1000, 8), card(1, 125, 1000, 8), card(2, 50, 1000, 8)}, "card 2 has a 50 MHz clock"},
+		{[]*LanceroDevice{card(0, 125, 1000, 8), card(4, 125, 1200, 8)}, "card 4 has line sync 1200"},
+		{[]*LanceroDevice{card(1, 125, 1000, 8), card(2, 125, 1000, 4)}, "card 2 has 4 rows"},
+	} {
+		if err := checkCardTiming(test.devices); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("checkCardTiming gives %v, want an error with %q", err, test.want)
+		}
+	}
+}
+
+func TestLanceroMerger(t *testing.T) {
+	// Two cards of 1 column and 2 rows: 4 data streams per frame, each 8 bytes.
+	devices := []*LanceroDevice{{devnum: 0, ncols: 1, nrows: 2, frameSize: 8},
+		{devnum: 1, ncols: 1, nrows: 2, frameSize: 8}}
+	frames := func(card, first, n int) []RawType {
+		data := make([]RawType, 0, 4*n)
+		for f := first; f < first+n; f++ {
+			for stream := 0; stream < 4; stream++ {
+				data = append(data, RawType(1000*card+10*f+stream))
+			}
+		}
+		return data
+	}
+	t0 := time.Unix(1000, 0)
+	m := newLanceroMerger(devices, 10)
+	for _, test := range []struct {
+		chunk      lanceroChunk
+		wantFrames int // 0 means no merge yet
+		wantTime   time.Time
+	}{
+		{lanceroChunk{ibuf: 0, data: frames(0, 0, 3), lastTime: t0.Add(3)}, 0, time.Time{}},
+		{lanceroChunk{ibuf: 0, data: frames(0, 3, 2), lastTime: t0.Add(5)}, 0, time.Time{}},
+		{lanceroChunk{ibuf: 1, data: frames(1, 0, 4), lastTime: t0.Add(4)}, 4, t0.Add(4)},
+		{lanceroChunk{ibuf: 1, data: frames(1, 4, 3), lastTime: t0.Add(7)}, 0, time.Time{}},
+		{lanceroChunk{ibuf: 0, data: frames(0, 5, 1), lastTime: t0.Add(6)}, 2, t0.Add(6)},
+	} {
+		datacopies, lastTime, totalBytes, err := m.add(test.chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.wantFrames == 0 {
+			if datacopies != nil {
+				t.Errorf("merger merged %d frames too soon", len(datacopies[0]))
+			}
+			continue
+		}
+		if len(datacopies) != 8 || len(datacopies[0]) != test.wantFrames || !lastTime.Equal(test.wantTime) ||
+			totalBytes != 2*8*test.wantFrames {
+			t.Fatalf("merger gives %d streams of %v, time %v, %d bytes; want 8 streams of %d frames, time %v",
+				len(datacopies), datacopies, lastTime, totalBytes, test.wantFrames, test.wantTime)
+		}
+		// Frames of both cards stay aligned, even though they were read in different chunks.
+		for i, dc := range datacopies {
+			for j := 1; j < len(dc); j++ {
+				if dc[j] != dc[0]+RawType(10*j) {
+					t.Errorf("stream %d has frames %v, not consecutive", i, dc)
+				}
+			}
+			if first0, first1 := datacopies[i%4][0]%1000, datacopies[4+i%4][0]%1000; first0 != first1 {
+				t.Errorf("cards' first frames are %d and %d, want equal", first0, first1)
+			}
+		}
+	}
+	// A card can get no more than maxFrames frames ahead of the others.
+	if _, _, _, err := m.add(lanceroChunk{ibuf: 1, data: frames(1, 7, 10), lastTime: t0.Add(17)}); err == nil ||
+		!strings.Contains(err.Error(), "device 1 has 11 frames") {
+		t.Errorf("merger with a card 11 frames ahead returns %v, want an error", err)
+	}
+}
+
+// TestLanceroFrameNumbers checks that the frame numbers of a LanceroSource, counted in
+// software, run past 2^32 with no frame resynchronization.
+func TestLanceroFrameNumbers(t *testing.T) {
+	ls := &LanceroSource{devices: map[int]*LanceroDevice{0: {nrows: 1}}, chan2readoutOrder: []int{0, 1},
+		Mix: []*Mix{{}, {}}}
+	ls.sampleRate = 1000
+	ls.samplePeriod = time.Millisecond
+	const nframes = 100
+	start := FrameIndex(1)<<32 - 150
+	ls.nextFrameNum = start
+	t0 := time.Now()
+	for i := 0; i < 3; i++ {
+		msg := BuffersChanType{datacopies: [][]RawType{make([]RawType, nframes), make([]RawType, nframes)},
+			lastSampleTime: t0.Add(time.Duration((i+1)*nframes-1) * time.Millisecond)}
+		block := ls.distributeData(msg)
+		ls.resynchronize(block)
+		want := start + FrameIndex(i*nframes)
+		for j, seg := range block.segments {
+			if seg.firstFramenum != want {
+				t.Errorf("block %d segment %d starts at frame %d, want %d", i, j, seg.firstFramenum, want)
+			}
+		}
+	}
+	if len(ls.frameSync.events) != 0 {
+		t.Errorf("frame synchronizer found events %v, want none", ls.frameSync.events)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -41,6 +44,9 @@ type Reader struct {
 	WordSize        int
 	Timebase        float64
 	TimestampOffset float64
+	VoltsPerArb     float64
+	VoltsOffset     float64
+	Signed          bool // the samples are int16 values stored as uint16
 
 	recordLength int
 	headerLength int
@@ -69,11 +75,48 @@ type Writer struct {
 	ChannelNumberMatchingName int
 	ColumnNum                 int
 	RowNum                    int
+	VoltsPerArb               float64 // volts = VoltsOffset + VoltsPerArb*raw
+	VoltsOffset               float64
+	Signed                    bool       // the samples are int16 values, written as uint16
+	BufferSize                int        // bytes in the write buffer; 0 means DefaultBufferSize
+	Create                    CreateFunc // creates the file; nil means os.Create
 
-	file   *os.File
+	file   File
 	writer *bufio.Writer
 }
 
+// File is where a Writer or Writer3 writes: an *os.File, or a stand-in such as a file
+// sent over the network.
+type File interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// CreateFunc creates the named file for a Writer or Writer3. If the writer's Create is
+// nil, it uses os.Create.
+type CreateFunc func(name string) (File, error)
+
+// create creates the named file with f, or with os.Create if f is nil.
+func (f CreateFunc) create(name string) (File, error) {
+	if f == nil {
+		return os.Create(name)
+	}
+	return f(name)
+}
+
+// DefaultBufferSize is the size in bytes of the write buffer of Writer and Writer3,
+// unless their BufferSize is set.
+const DefaultBufferSize = 32768
+
+// bufferSize returns size, or DefaultBufferSize if size isn't positive.
+func bufferSize(size int) int {
+	if size <= 0 {
+		return DefaultBufferSize
+	}
+	return size
+}
+
 // OpenReader returns an active LJH file reader, or an error.
 func OpenReader(fileName string) (r *Reader, err error) {
 	f, err := os.Open(fileName)
@@ -133,7 +176,7 @@ func extractFloat(line, pattern string, f *float64) bool {
 // you can't write records without doing this
 func (w *Writer) CreateFile() error {
 	if w.file == nil {
-		file, err := os.Create(w.FileName)
+		file, err := w.Create.create(w.FileName)
 		if err != nil {
 			return err
 		}
@@ -141,7 +184,7 @@ func (w *Writer) CreateFile() error {
 	} else {
 		return errors.New("file already exists")
 	}
-	w.writer = bufio.NewWriterSize(w.file, 32768)
+	w.writer = bufio.NewWriterSize(w.file, bufferSize(w.BufferSize))
 	return nil
 }
 
@@ -177,10 +220,13 @@ Timestamp offset (s): %.6f
 Server Start Time: %s
 First Record Time: %s
 Timebase: %e
+Volts per arb: %e
+Volts offset: %e
+Signed samples: %t
 #End of Header
 `, w.DastardVersion, w.GitHash, w.SourceName, rowColText, w.NumberOfChans,
 		w.ChanName, w.ChannelNumberMatchingName, w.ChannelIndex, w.Presamples, w.Samples, w.FramesPerSample,
-		timestamp, starttime, firstrec, w.Timebase,
+		timestamp, starttime, firstrec, w.Timebase, w.VoltsPerArb, w.VoltsOffset, w.Signed,
 	)
 	_, err := w.writer.WriteString(s)
 	w.HeaderWritten = true
@@ -194,10 +240,23 @@ func (w Writer) Flush() {
 	}
 }
 
+// Sync flushes buffered data and commits the file to stable storage
+func (w Writer) Sync() error {
+	if w.writer == nil {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
 // Close closes the associated file, no more records can be written after this
 func (w Writer) Close() {
 	w.Flush()
-	w.file.Close()
+	if w.file != nil {
+		w.file.Close()
+	}
 }
 
 // WriteRecord writes a single record to the files
@@ -233,14 +292,34 @@ type Writer3 struct {
 	NumberOfColumns            int
 	Row                        int
 	Column                     int
+	VoltsPerArb                float64 // volts = VoltsOffset + VoltsPerArb*raw
+	VoltsOffset                float64
+	Signed                     bool // the samples are int16 values, written as uint16
 	HeaderWritten              bool
 	FileName                   string
 	RecordsWritten             int
-
-	file   *os.File
-	writer *bufio.Writer
+	BufferSize                 int // bytes in the write buffer; 0 means DefaultBufferSize
+	// Checksums adds a CRC32 after each record, and a footer with the number of records
+	// and a CRC32 of the whole file before it (see VerifyLJH3). Set before WriteHeader.
+	Checksums bool
+	Create    CreateFunc // creates the file; nil means os.Create
+
+	file    File
+	writer  *bufio.Writer
+	fileCRC hash.Hash32 // CRC32 of everything written, if Checksums
 }
 
+// ljh3FooterMagic begins the footer of an LJH3 file written with Checksums. The footer
+// is the magic, the number of records (int64), and the CRC32 (uint32) of the file
+// before the footer.
+const ljh3FooterMagic = "LJH3FOOT"
+
+// ljh3FooterSize is the size in bytes of the footer.
+const ljh3FooterSize = len(ljh3FooterMagic) + 8 + 4
+
+// ljh3RecordHeaderSize is the size in bytes of the fixed part of each LJH3 record.
+const ljh3RecordHeaderSize = 4 + 4 + 8 + 8
+
 // HeaderTDM contains info about TDM readout for placing in an LJH3 header
 type HeaderTDM struct {
 	NumberOfRows    int
@@ -255,6 +334,10 @@ type Header struct {
 	Format        string    `json:"File Format"`
 	FormatVersion string    `json:"File Format Version"`
 	TDM           HeaderTDM `json:"TDM"`
+	VoltsPerArb   float64   `json:"Volts per arb"`
+	VoltsOffset   float64   `json:"Volts offset"`
+	Signed        bool      `json:"Signed samples,omitempty"`
+	Checksums     bool      `json:"Checksums,omitempty"`
 }
 
 // WriteHeader writes a header to the LJH3 file, return error if header already written
@@ -264,17 +347,21 @@ func (w *Writer3) WriteHeader() error {
 	}
 	h := Header{Frameperiod: w.Timebase, Format: "LJH3", FormatVersion: "3.0.0",
 		TDM: HeaderTDM{NumberOfRows: w.NumberOfRows, NumberOfColumns: w.NumberOfColumns,
-			Row: w.Row, Column: w.Column}}
+			Row: w.Row, Column: w.Column},
+		VoltsPerArb: w.VoltsPerArb, VoltsOffset: w.VoltsOffset, Signed: w.Signed, Checksums: w.Checksums}
+	if w.Checksums {
+		h.FormatVersion = "3.1.0" // records end with a CRC32, and the file with a footer
+	}
 	s, err := json.MarshalIndent(h, "", "    ")
 	if err != nil {
 		panic("MarshallIndent error")
 	}
 
-	if _, err := w.writer.Write(s); err != nil {
+	if err := w.write(s); err != nil {
 		return err
 	}
 
-	if _, err := w.writer.WriteString("\n"); err != nil {
+	if err := w.write([]byte("\n")); err != nil {
 		return err
 	}
 	w.HeaderWritten = true
@@ -285,23 +372,51 @@ func (w *Writer3) WriteHeader() error {
 // firstRisingSample is the index in data of the sample after the pretrigger (zero or one indexed?)
 // timestamp is posix timestamp in microseconds since epoch
 // data can be variable length
+// With Checksums, the record ends with the CRC32 of all the above.
 func (w *Writer3) WriteRecord(firstRisingSample int32, framecount int64, timestamp int64, data []uint16) error {
-	if _, err := w.writer.Write(getbytes.FromInt32(int32(len(data)))); err != nil {
-		return err
+	crc := crc32.NewIEEE()
+	for _, b := range [][]byte{getbytes.FromInt32(int32(len(data))), getbytes.FromInt32(firstRisingSample),
+		getbytes.FromInt64(framecount), getbytes.FromInt64(timestamp), getbytes.FromSliceUint16(data)} {
+		if err := w.write(b); err != nil {
+			return err
+		}
+		if w.Checksums {
+			crc.Write(b)
+		}
 	}
-	if _, err := w.writer.Write(getbytes.FromInt32(firstRisingSample)); err != nil {
-		return err
+	if w.Checksums {
+		if err := w.write(getbytes.FromUint32(crc.Sum32())); err != nil {
+			return err
+		}
 	}
-	if _, err := w.writer.Write(getbytes.FromInt64(framecount)); err != nil {
-		return err
+	w.RecordsWritten++
+	return nil
+}
+
+// write writes b, adding it to the whole-file CRC if Checksums.
+func (w *Writer3) write(b []byte) error {
+	if w.Checksums {
+		if w.fileCRC == nil {
+			w.fileCRC = crc32.NewIEEE()
+		}
+		w.fileCRC.Write(b)
 	}
-	if _, err := w.writer.Write(getbytes.FromInt64(timestamp)); err != nil {
-		return err
+	_, err := w.writer.Write(b)
+	return err
+}
+
+// writeFooter writes the footer of a file with Checksums.
+func (w Writer3) writeFooter() error {
+	var crc uint32
+	if w.fileCRC != nil {
+		crc = w.fileCRC.Sum32()
 	}
-	if _, err := w.writer.Write(getbytes.FromSliceUint16(data)); err != nil {
-		return err
+	for _, b := range [][]byte{[]byte(ljh3FooterMagic), getbytes.FromInt64(int64(w.RecordsWritten)),
+		getbytes.FromUint32(crc)} {
+		if _, err := w.writer.Write(b); err != nil {
+			return err
+		}
 	}
-	w.RecordsWritten++
 	return nil
 }
 
@@ -312,10 +427,26 @@ func (w Writer3) Flush() {
 	}
 }
 
-// Close closes the LJH3 file
+// Sync flushes buffered data and commits the LJH3 file to stable storage
+func (w Writer3) Sync() error {
+	if w.writer == nil {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Close closes the LJH3 file, after writing the footer if Checksums
 func (w Writer3) Close() {
+	if w.Checksums && w.HeaderWritten && w.writer != nil {
+		w.writeFooter()
+	}
 	w.Flush()
-	w.file.Close()
+	if w.file != nil {
+		w.file.Close()
+	}
 }
 
 // CreateFile opens the LJH3 file for writing, must be called before wring RecordSlice
@@ -323,15 +454,95 @@ func (w *Writer3) CreateFile() error {
 	if w.file != nil {
 		return errors.New("file already exists")
 	}
-	file, err := os.Create(w.FileName)
+	file, err := w.Create.create(w.FileName)
 	if err != nil {
 		return err
 	}
 	w.file = file
-	w.writer = bufio.NewWriterSize(w.file, 32768)
+	w.writer = bufio.NewWriterSize(w.file, bufferSize(w.BufferSize))
 	return nil
 }
 
+// VerifyLJH3 checks an LJH3 file written with Checksums: the CRC32 of each record, and
+// the footer's number of records and whole-file CRC32. It returns the number of records,
+// or an error describing the first problem found.
+func VerifyLJH3(fileName string) (int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(f)
+	fileCRC := crc32.NewIEEE()
+
+	// The header is indented JSON, so it ends with a line "}".
+	var header []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return 0, fmt.Errorf("LJH3 file '%s': could not read the header: %v", fileName, err)
+		}
+		header = append(header, line...)
+		if string(line) == "}\n" {
+			break
+		}
+	}
+	fileCRC.Write(header)
+	var h Header
+	if err := json.Unmarshal(header, &h); err != nil {
+		return 0, fmt.Errorf("LJH3 file '%s': could not parse the header: %v", fileName, err)
+	}
+	if !h.Checksums {
+		return 0, fmt.Errorf("LJH3 file '%s' was written without checksums", fileName)
+	}
+
+	records := 0
+	offset := int64(len(header))
+	end := info.Size() - int64(ljh3FooterSize)
+	body := io.TeeReader(reader, fileCRC)
+	for offset < end {
+		fixed := make([]byte, ljh3RecordHeaderSize)
+		if _, err := io.ReadFull(body, fixed); err != nil {
+			return records, fmt.Errorf("LJH3 file '%s' record %d: %v", fileName, records, err)
+		}
+		nsamples := int64(int32(binary.LittleEndian.Uint32(fixed)))
+		size := int64(ljh3RecordHeaderSize) + 2*nsamples + 4
+		if nsamples < 0 || offset+size > end {
+			return records, fmt.Errorf("LJH3 file '%s' record %d has an impossible length %d samples",
+				fileName, records, nsamples)
+		}
+		rest := make([]byte, 2*nsamples+4)
+		if _, err := io.ReadFull(body, rest); err != nil {
+			return records, fmt.Errorf("LJH3 file '%s' record %d: %v", fileName, records, err)
+		}
+		crc := crc32.Update(crc32.ChecksumIEEE(fixed), crc32.IEEETable, rest[:2*nsamples])
+		if stored := binary.LittleEndian.Uint32(rest[2*nsamples:]); stored != crc {
+			return records, fmt.Errorf("LJH3 file '%s' record %d has CRC32 %08x, but its checksum says %08x",
+				fileName, records, crc, stored)
+		}
+		records++
+		offset += size
+	}
+
+	footer := make([]byte, ljh3FooterSize)
+	if _, err := io.ReadFull(reader, footer); err != nil || string(footer[:len(ljh3FooterMagic)]) != ljh3FooterMagic {
+		return records, fmt.Errorf("LJH3 file '%s' has no footer (was it closed?)", fileName)
+	}
+	n := len(ljh3FooterMagic)
+	if count := int64(binary.LittleEndian.Uint64(footer[n:])); count != int64(records) {
+		return records, fmt.Errorf("LJH3 file '%s' has %d records, but its footer says %d", fileName, records, count)
+	}
+	if stored := binary.LittleEndian.Uint32(footer[n+8:]); stored != fileCRC.Sum32() {
+		return records, fmt.Errorf("LJH3 file '%s' has CRC32 %08x, but its footer says %08x",
+			fileName, fileCRC.Sum32(), stored)
+	}
+	return records, nil
+}
+
 func (r *Reader) parseHeader() error {
 	scanner := bufio.NewScanner(r.file)
 	lnum := 0
@@ -362,6 +573,10 @@ header:
 		case extract(line, "Channel: %d", &r.ChannelIndex):
 		case extractFloat(line, "Timestamp offset (s): %f", &r.TimestampOffset):
 		case extractFloat(line, "Timebase: %f", &r.Timebase):
+		case extractFloat(line, "Volts per arb: %f", &r.VoltsPerArb):
+		case extractFloat(line, "Volts offset: %f", &r.VoltsOffset):
+		case strings.HasPrefix(line, "Signed samples: "):
+			r.Signed = strings.TrimPrefix(line, "Signed samples: ") == "true"
 
 		}
 		lnum++
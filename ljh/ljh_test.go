@@ -2,6 +2,7 @@ package ljh
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -111,7 +112,10 @@ func TestWriter(t *testing.T) {
 		Samples:      100,
 		Presamples:   50,
 		NumberOfRows: 2,
-		RowNum:       1}
+		RowNum:       1,
+		VoltsPerArb:  0.125,
+		VoltsOffset:  -2.5,
+		Signed:       true}
 	err := w.CreateFile()
 	if err != nil {
 		t.Errorf("file creation error: %v", err)
@@ -158,6 +162,12 @@ func TestWriter(t *testing.T) {
 	if err != nil {
 		t.Errorf("WriterTest, OpenReader Error: %v", err)
 	}
+	if r.VoltsPerArb != 0.125 || r.VoltsOffset != -2.5 {
+		t.Errorf("WriterTest, VoltsPerArb, VoltsOffset = %v, %v, want 0.125, -2.5", r.VoltsPerArb, r.VoltsOffset)
+	}
+	if !r.Signed {
+		t.Error("WriterTest, Signed = false, want true")
+	}
 	record, err := r.NextPulse()
 	if err != nil {
 		t.Errorf("WriterTest, NextPulse Error: %v", err)
@@ -238,6 +248,71 @@ func TestWriter3(t *testing.T) {
 	w.Close()
 }
 
+func TestWriter3Checksums(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ljh3_checksums_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fileName := filepath.Join(tmp, "checksums.ljh3")
+	w := Writer3{FileName: fileName, Checksums: true}
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		data := make([]uint16, 100+i)
+		for j := range data {
+			data[j] = uint16(1000*i + j)
+		}
+		if err := w.WriteRecord(int32(i), int64(1000*i), int64(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := VerifyLJH3(fileName); err == nil {
+		t.Errorf("VerifyLJH3 of an unclosed file gives %d records and no error", n)
+	}
+	w.Close()
+	if n, err := VerifyLJH3(fileName); n != 5 || err != nil {
+		t.Errorf("VerifyLJH3 gives %d records and error %v, want 5 and nil", n, err)
+	}
+
+	// Corrupt one sample, then the footer's record count.
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int{len(contents) - 400, len(contents) - 12} {
+		bad := append([]byte{}, contents...)
+		bad[offset]++
+		if err := ioutil.WriteFile(fileName, bad, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyLJH3(fileName); err == nil {
+			t.Errorf("VerifyLJH3 missed a corrupt byte at %d of %d", offset, len(contents))
+		}
+	}
+
+	// Files without checksums can't be verified, and are unchanged.
+	w = Writer3{FileName: filepath.Join(tmp, "plain.ljh3")}
+	w.CreateFile()
+	w.WriteHeader()
+	w.WriteRecord(0, 0, 0, make([]uint16, 10))
+	w.Close()
+	if _, err := VerifyLJH3(w.FileName); err == nil {
+		t.Error("VerifyLJH3 of a file without checksums should fail")
+	}
+	plain, err := ioutil.ReadFile(w.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := bytes.Index(plain, []byte("\n}\n")) + 3; len(plain) != header+24+20 {
+		t.Errorf("file without checksums has %d bytes after its header, want 44", len(plain)-header)
+	}
+}
+
 func BenchmarkLJH22(b *testing.B) {
 	w := Writer{FileName: "writertest.ljh",
 		Samples:    1000,
@@ -0,0 +1,169 @@
+package dastard
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel orders the severity of log messages.
+type LogLevel int
+
+// Allowed LogLevel values, from least to most severe.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarning:
+		return "WARNING"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL%d", int(level))
+}
+
+// LogFields holds the key-value context of a structured log message.
+type LogFields map[string]interface{}
+
+// LogMessage is one structured log message. It is also the state carried by a
+// "LOG" ClientUpdate, so clients can display why (for example) a source stopped.
+type LogMessage struct {
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  LogFields `json:",omitempty"`
+}
+
+// String formats the message as one line, with fields sorted by key.
+func (m LogMessage) String() string {
+	line := fmt.Sprintf("[%s] %s", m.Level, m.Message)
+	if len(m.Fields) == 0 {
+		return line
+	}
+	keys := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{line}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, m.Fields[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// dastardLogger sends each log message to up to 3 places: the standard log package
+// (the terminal or whatever log.SetOutput chose), the per-run log file while data
+// are being written, and the clients (for messages at or above clientLevel).
+type dastardLogger struct {
+	runFile     *os.File
+	clientLevel LogLevel
+	clients     chan ClientUpdate // where messages are broadcast; nil means clientMessageChan
+	sync.Mutex
+}
+
+var dlog = &dastardLogger{clientLevel: LogInfo}
+
+// log formats and distributes one message.
+func (l *dastardLogger) log(level LogLevel, fields LogFields, format string, args ...interface{}) {
+	m := LogMessage{
+		Time:    time.Now(),
+		Level:   level.String(),
+		Message: strings.TrimRight(fmt.Sprintf(format, args...), "\n"),
+		Fields:  fields,
+	}
+	line := m.String()
+	log.Println(line)
+
+	l.Lock()
+	if l.runFile != nil {
+		fmt.Fprintf(l.runFile, "%s %s\n", m.Time.Format(time.RFC3339Nano), line)
+	}
+	broadcast := level >= l.clientLevel
+	clients := l.clients
+	l.Unlock()
+	if clients == nil {
+		clients = clientMessageChan
+	}
+
+	// Never block on the client updater: it logs, too, so blocking could deadlock.
+	if broadcast {
+		select {
+		case clients <- ClientUpdate{"LOG", m}:
+		default:
+		}
+	}
+}
+
+// setRunFile starts copying all log messages to a new file with the given name.
+// Any previous run file is closed.
+func (l *dastardLogger) setRunFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.runFile != nil {
+		l.runFile.Close()
+	}
+	l.runFile = f
+	return nil
+}
+
+// closeRunFile stops copying log messages to the run file and closes it.
+func (l *dastardLogger) closeRunFile() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.runFile == nil {
+		return nil
+	}
+	err := l.runFile.Close()
+	l.runFile = nil
+	return err
+}
+
+// setClientLevel sets the minimum level of messages that are broadcast to clients.
+func (l *dastardLogger) setClientLevel(level LogLevel) {
+	l.Lock()
+	defer l.Unlock()
+	l.clientLevel = level
+}
+
+// logDebugf logs a message at level LogDebug.
+func logDebugf(format string, args ...interface{}) {
+	dlog.log(LogDebug, nil, format, args...)
+}
+
+// logInfof logs a message at level LogInfo.
+func logInfof(format string, args ...interface{}) {
+	dlog.log(LogInfo, nil, format, args...)
+}
+
+// logWarningf logs a message at level LogWarning.
+func logWarningf(format string, args ...interface{}) {
+	dlog.log(LogWarning, nil, format, args...)
+}
+
+// logErrorf logs a message at level LogError.
+func logErrorf(format string, args ...interface{}) {
+	dlog.log(LogError, nil, format, args...)
+}
+
+// logFieldsf logs a message at the given level with structured key-value context.
+func logFieldsf(level LogLevel, fields LogFields, format string, args ...interface{}) {
+	dlog.log(level, fields, format, args...)
+}
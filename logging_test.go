@@ -0,0 +1,82 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogMessage(t *testing.T) {
+	for level, name := range map[LogLevel]string{LogDebug: "DEBUG", LogInfo: "INFO",
+		LogWarning: "WARNING", LogError: "ERROR", LogLevel(9): "LEVEL9"} {
+		if level.String() != name {
+			t.Errorf("LogLevel(%d).String()=%q, want %q", int(level), level.String(), name)
+		}
+	}
+	m := LogMessage{Level: "INFO", Message: "source stopped"}
+	if s := m.String(); s != "[INFO] source stopped" {
+		t.Errorf("LogMessage.String()=%q", s)
+	}
+	m.Fields = LogFields{"source": "SIMPULSE", "error": "bad"}
+	if s := m.String(); s != "[INFO] source stopped error=bad source=SIMPULSE" {
+		t.Errorf("LogMessage.String()=%q, want fields in sorted order", s)
+	}
+}
+
+func TestLogBroadcastAndRunFile(t *testing.T) {
+	// Use a private logger and channel: the client updater empties clientMessageChan.
+	clients := make(chan ClientUpdate, 4)
+	l := &dastardLogger{clientLevel: LogInfo, clients: clients}
+
+	l.log(LogDebug, nil, "debug messages are not broadcast")
+	select {
+	case u := <-clients:
+		t.Errorf("LogDebug message was broadcast: %v", u)
+	default:
+	}
+	l.log(LogWarning, LogFields{"channel": 3}, "warning messages are broadcast\n")
+	select {
+	case u := <-clients:
+		m, ok := u.state.(LogMessage)
+		if u.tag != "LOG" || !ok {
+			t.Fatalf("broadcast ClientUpdate tag=%q state=%v, want a LOG LogMessage", u.tag, u.state)
+		}
+		if m.Level != "WARNING" || m.Message != "warning messages are broadcast" || m.Fields["channel"] != 3 {
+			t.Errorf("broadcast LogMessage=%v", m)
+		}
+	default:
+		t.Errorf("LogWarning message was not broadcast")
+	}
+	// Logging must never block, even when no client updater empties the channel.
+	for i := 0; i < 2*cap(clients); i++ {
+		l.log(LogError, nil, "message %d", i)
+	}
+
+	dir, err := ioutil.TempDir("", "dastard_log_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dastard.log")
+	if err := l.setRunFile(filename); err != nil {
+		t.Fatalf("setRunFile failed: %v", err)
+	}
+	l.log(LogInfo, nil, "written to the run file")
+	if err := l.closeRunFile(); err != nil {
+		t.Errorf("closeRunFile failed: %v", err)
+	}
+	l.log(LogInfo, nil, "not written to the run file")
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "[INFO] written to the run file") ||
+		strings.Contains(string(contents), "not written") {
+		t.Errorf("run log file contains %q", string(contents))
+	}
+	if err := l.setRunFile(filepath.Join(dir, "nonexistent", "dastard.log")); err == nil {
+		t.Errorf("setRunFile should fail in a nonexistent directory")
+	}
+}
@@ -1,9 +1,12 @@
 package dastard
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // Pixel represents the physical location of a TES
@@ -13,9 +16,11 @@ type Pixel struct {
 }
 
 // Map represents an entire array of pixel locations
+// A map file may also define channel groups, one per line, as "group: name index index ...".
 type Map struct {
 	Spacing  int
 	Pixels   []Pixel
+	Groups   []ChannelGroup
 	Filename string
 }
 
@@ -30,24 +35,57 @@ func readMap(filename string) (*Map, error) {
 	}
 	defer file.Close()
 
-	if _, err := fmt.Fscanf(file, "spacing: %d\n", &m.Spacing); err != nil {
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, err := fmt.Sscanf(scanner.Text(), "spacing: %d", &m.Spacing); err != nil {
 		return nil, err
 	}
 
-	for {
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "group:") {
+			g, err := parseMapGroup(line)
+			if err != nil {
+				return m, err
+			}
+			m.Groups = append(m.Groups, g)
+			continue
+		}
 		var chnum int
 		var p Pixel
-		_, err := fmt.Fscanf(file, "%d %d %d %s", &chnum, &p.X, &p.Y, &p.Name)
-		if err == io.EOF {
-			return m, nil
-		}
-		if err != nil {
-			fmt.Println(m)
-			fmt.Println(chnum, p)
+		if _, err := fmt.Sscanf(line, "%d %d %d %s", &chnum, &p.X, &p.Y, &p.Name); err != nil {
+			logWarningf("error reading map file after %d pixels: chnum %v, pixel %v", len(m.Pixels), chnum, p)
 			return m, err
 		}
 		m.Pixels = append(m.Pixels, p)
 	}
+	return m, scanner.Err()
+}
+
+// parseMapGroup parses a map file line of the form "group: name index index ...".
+func parseMapGroup(line string) (ChannelGroup, error) {
+	var g ChannelGroup
+	fields := strings.Fields(strings.TrimPrefix(line, "group:"))
+	if len(fields) < 2 {
+		return g, fmt.Errorf("map file group line %q needs a name and at least one channel index", line)
+	}
+	g.Name = fields[0]
+	for _, f := range fields[1:] {
+		idx, err := strconv.Atoi(f)
+		if err != nil {
+			return g, fmt.Errorf("map file group %q has bad channel index %q", g.Name, f)
+		}
+		g.ChannelIndices = append(g.ChannelIndices, idx)
+	}
+	return g, nil
 }
 
 // MapServer is the RPC service that loads and broadcasts TES maps
@@ -69,6 +107,14 @@ func (ms *MapServer) Load(filename *string, reply *bool) error {
 	}
 	ms.m = m
 	ms.broadcastMap()
+	if len(m.Groups) > 0 {
+		for _, g := range m.Groups {
+			if err := channelGroups.define(g); err != nil {
+				return err
+			}
+		}
+		ms.clientUpdates <- ClientUpdate{"CHANNELGROUPS", channelGroups.list()}
+	}
 	return nil
 }
 
@@ -0,0 +1,341 @@
+package mover
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	in := frame{kind: frameData, seq: 12345678901, file: 7, offset: 1 << 40, data: []byte("some bytes")}
+	var buf bytes.Buffer
+	if err := in.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != frameHeaderSize+len(in.data) {
+		t.Errorf("frame is %d bytes, want %d", buf.Len(), frameHeaderSize+len(in.data))
+	}
+	out, err := readFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.kind != in.kind || out.seq != in.seq || out.file != in.file || out.offset != in.offset ||
+		!bytes.Equal(out.data, in.data) {
+		t.Errorf("readFrame returned %+v, want %+v", out, in)
+	}
+	buf.Reset()
+	bad := frame{kind: 99}
+	bad.write(&buf)
+	if _, err := readFrame(&buf); err == nil {
+		t.Error("readFrame accepted an unknown frame kind")
+	}
+}
+
+// testKey is the key shared by the tests' Senders and Receivers.
+var testKey = []byte("a key for the data mover tests")
+
+// startReceiver starts a Receiver writing under a temporary directory. Call the returned
+// function to stop it and remove the directory.
+func startReceiver(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "dastard_mover_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	// The Receiver's goroutines can outlive the test, so they must not use t.Logf.
+	r := &Receiver{Dir: dir, Key: testKey, Logf: func(string, ...interface{}) {}}
+	go r.Serve(l)
+	return l.Addr().String(), dir, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	addr, dir, stop := startReceiver(t)
+	defer stop()
+	s, err := NewSender(SenderConfig{Addr: addr, Key: testKey, Timeout: 5 * time.Second, Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Create("run0001/chan1.ljh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name() != "run0001/chan1.ljh" {
+		t.Errorf("Name()=%q", f.Name())
+	}
+	var want []byte
+	for i := 0; i < 100; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, 1000+i)
+		want = append(want, b...)
+		if _, err := f.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := bytes.Repeat([]byte("x"), maxFramePayload+100)
+	want = append(want, big...)
+	if n, err := f.Write(big); err != nil || n != len(big) {
+		t.Fatalf("Write of %d bytes returned %d, %v", len(big), n, err)
+	}
+	copy(want, "HEADER")
+	if _, err := f.WriteAt([]byte("HEADER"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("late")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "run0001", "chan1.ljh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("received file of %d bytes differs from the %d bytes sent", len(got), len(want))
+	}
+	if _, err := s.Create("after"); err == nil {
+		t.Error("Create after Sender.Close succeeded")
+	}
+}
+
+// cutter forwards connections to addr, and can break all of them at once.
+type cutter struct {
+	addr  string
+	l     net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newCutter(t *testing.T, addr string) *cutter {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &cutter{addr: addr, l: l}
+	go func() {
+		for {
+			in, err := l.Accept()
+			if err != nil {
+				return
+			}
+			out, err := net.Dial("tcp", addr)
+			if err != nil {
+				in.Close()
+				continue
+			}
+			c.mu.Lock()
+			c.conns = append(c.conns, in, out)
+			c.mu.Unlock()
+			go io.Copy(in, out)
+			go io.Copy(out, in)
+		}
+	}()
+	return c
+}
+
+func (c *cutter) cut() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+}
+
+// cutWhenConnected waits for s to be connected through c, then breaks the connection.
+func (c *cutter) cutWhenConnected(t *testing.T, s *Sender) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		n := len(c.conns)
+		c.mu.Unlock()
+		if n > 0 && s.Status().Connected {
+			break
+		}
+	}
+	c.cut()
+}
+
+func TestResumeAfterLostConnection(t *testing.T) {
+	addr, dir, stop := startReceiver(t)
+	defer stop()
+	c := newCutter(t, addr)
+	defer c.l.Close()
+	s, err := NewSender(SenderConfig{Addr: c.l.Addr().String(), Key: testKey, Timeout: 5 * time.Second, Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a.off", "sub/b.ljh"}
+	files := make([]*File, len(names))
+	for i, name := range names {
+		if files[i], err = s.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want [2][]byte
+	for i := 0; i < 200; i++ {
+		if i%50 == 25 {
+			c.cutWhenConnected(t, s)
+		}
+		if i == 120 {
+			files[0].Close()
+		}
+		for j, f := range files {
+			if j == 0 && i >= 120 {
+				continue
+			}
+			b := []byte(strings.Repeat(string(rune('a'+j)), 100) + string(rune('0'+i%10)))
+			want[j] = append(want[j], b...)
+			if _, err := f.Write(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := files[1].Sync(); err != nil {
+		t.Fatal(err)
+	}
+	files[1].Close()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.Reconnects == 0 || st.UnackedFrames != 0 {
+		t.Errorf("Status()=%+v, want Reconnects>0 and no unacknowledged frames", st)
+	}
+	for j, name := range names {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[j]) {
+			t.Errorf("received %s of %d bytes differs from the %d bytes sent", name, len(got), len(want[j]))
+		}
+	}
+}
+
+func TestReceiverRefusesPath(t *testing.T) {
+	addr, _, stop := startReceiver(t)
+	defer stop()
+	s, err := NewSender(SenderConfig{Addr: addr, Key: testKey, Timeout: 5 * time.Second, Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Create("../escaped.ljh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("Sync of a file outside the receiver's directory returned %v, want refusal", err)
+	}
+	if err := s.Close(); err == nil {
+		t.Error("Sender.Close returned nil after a refusal")
+	}
+}
+
+func TestReceiverRefusesKey(t *testing.T) {
+	addr, dir, stop := startReceiver(t)
+	defer stop()
+	s, err := NewSender(SenderConfig{Addr: addr, Key: []byte("not the key of the receiver"), Timeout: 5 * time.Second,
+		Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Create("intruder.ljh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err == nil || !strings.Contains(err.Error(), "shared key") {
+		t.Errorf("Sync by a sender with the wrong key returned %v, want refusal", err)
+	}
+	s.Close()
+	if _, err := os.Stat(filepath.Join(dir, "intruder.ljh")); !os.IsNotExist(err) {
+		t.Errorf("receiver made a file for a sender with the wrong key: %v", err)
+	}
+
+	// A client that doesn't answer the challenge with a HELLO is refused, too.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if f, err := readFrame(conn); err != nil || f.kind != frameChallenge || len(f.data) != challengeSize {
+		t.Fatalf("receiver began with %+v, %v, want a CHALLENGE", f, err)
+	}
+	open := frame{kind: frameOpen, seq: 1, file: 1, data: []byte("intruder.ljh")}
+	if err := open.write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := readFrame(conn); err != nil || f.kind != frameError {
+		t.Errorf("receiver answered OPEN without HELLO with %+v, %v, want ERROR", f, err)
+	}
+
+	if _, err := NewSender(SenderConfig{Addr: addr}); err == nil {
+		t.Error("NewSender accepted no key")
+	}
+	if err := (&Receiver{Dir: dir}).Serve(nil); err == nil {
+		t.Error("Receiver.Serve accepted no key")
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "dastard_mover_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("  " + string(testKey) + "\n")
+	f.Close()
+	if key, err := ReadKeyFile(f.Name()); err != nil || !bytes.Equal(key, testKey) {
+		t.Errorf("ReadKeyFile returned %q, %v, want %q", key, err, testKey)
+	}
+	ioutil.WriteFile(f.Name(), []byte("short\n"), 0600)
+	if _, err := ReadKeyFile(f.Name()); err == nil {
+		t.Error("ReadKeyFile accepted a short key")
+	}
+}
+
+func TestSenderTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() // nobody listens
+	s, err := NewSender(SenderConfig{Addr: addr, Key: testKey, MaxUnacked: 10, Timeout: 100 * time.Millisecond, Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Create("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 8)); err == nil {
+		t.Error("Write beyond MaxUnacked succeeded with no receiver")
+	}
+	if err := f.Sync(); err == nil {
+		t.Error("Sync succeeded with no receiver")
+	}
+	if err := s.Close(); err == nil {
+		t.Error("Sender.Close returned nil with unacknowledged frames")
+	}
+}
@@ -0,0 +1,136 @@
+// Package mover sends files over TCP to a Receiver on another host (such as a storage
+// server), so that Dastard can write its LJH and OFF files there instead of on a local
+// disk. Every frame is kept by the Sender until the Receiver acknowledges it; after a
+// lost connection, the Sender reconnects and sends the unacknowledged frames again.
+// The Sender proves that it knows the key shared with the Receiver; the connection may
+// also use TLS, which the Sender and Receiver set up (see SenderConfig.TLS).
+//
+// Each frame is a 25-byte header (little-endian) followed by its payload:
+//
+//	kind    uint8  (CHALLENGE, HELLO, OPEN, DATA, SYNC, CLOSE, ACK or ERROR)
+//	seq     uint64 (1, 2, 3... for the frames that need an ACK; 0 for the others)
+//	file    uint32 (ID of the file, chosen by the Sender)
+//	offset  int64  (where DATA goes in the file; the protocol version in HELLO)
+//	length  uint32 (bytes of payload)
+//
+// A connection starts with the Receiver's CHALLENGE, whose payload is 32 random bytes.
+// The Sender answers with HELLO, whose payload is HMAC-SHA256(key, challenge+session)
+// followed by the Sender's session ID. The Receiver checks the HMAC, refusing the
+// connection if it is wrong, and closes any older connection of the same session. The Sender then opens again (with
+// seq 0, which does not truncate) each file not yet closed, and sends each frame not
+// yet acknowledged. OPEN (payload: the file's name, relative to the Receiver's
+// directory) creates or truncates the file; DATA writes its payload at offset; SYNC
+// commits the file to stable storage; CLOSE closes it. The Receiver answers with ACK,
+// whose seq is that of the last frame applied. All frames can be applied twice, so
+// frames sent again after a lost ACK do no harm. If the Receiver cannot apply a frame,
+// it sends ERROR (payload: why) and closes the connection.
+package mover
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The kinds of frame.
+const (
+	frameHello uint8 = iota + 1
+	frameOpen
+	frameData
+	frameSync
+	frameClose
+	frameAck
+	frameError
+	frameChallenge
+)
+
+// protocolVersion is sent in the HELLO frame, so that a Receiver can refuse a Sender that
+// it does not understand.
+const protocolVersion = 2
+
+// challengeSize is the size in bytes of the CHALLENGE payload.
+const challengeSize = 32
+
+// minKeySize is the fewest bytes of a shared key.
+const minKeySize = 16
+
+// frameHeaderSize is the size in bytes of the header of each frame.
+const frameHeaderSize = 1 + 8 + 4 + 8 + 4
+
+// maxFramePayload is the largest payload of a frame. Longer writes are split.
+const maxFramePayload = 1 << 20
+
+type frame struct {
+	kind   uint8
+	seq    uint64
+	file   uint32
+	offset int64
+	data   []byte
+}
+
+// write writes the frame to w.
+func (f *frame) write(w io.Writer) error {
+	var h [frameHeaderSize]byte
+	h[0] = f.kind
+	binary.LittleEndian.PutUint64(h[1:], f.seq)
+	binary.LittleEndian.PutUint32(h[9:], f.file)
+	binary.LittleEndian.PutUint64(h[13:], uint64(f.offset))
+	binary.LittleEndian.PutUint32(h[21:], uint32(len(f.data)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.data)
+	return err
+}
+
+// readFrame reads the next frame from r.
+func readFrame(r io.Reader) (*frame, error) {
+	var h [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	f := &frame{
+		kind:   h[0],
+		seq:    binary.LittleEndian.Uint64(h[1:]),
+		file:   binary.LittleEndian.Uint32(h[9:]),
+		offset: int64(binary.LittleEndian.Uint64(h[13:])),
+	}
+	if f.kind < frameHello || f.kind > frameChallenge {
+		return nil, fmt.Errorf("unknown frame kind %d", f.kind)
+	}
+	n := binary.LittleEndian.Uint32(h[21:])
+	if n > maxFramePayload {
+		return nil, fmt.Errorf("frame payload of %d bytes, more than the limit %d", n, maxFramePayload)
+	}
+	f.data = make([]byte, n)
+	if _, err := io.ReadFull(r, f.data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// helloMAC returns the HMAC that proves a Sender of the session knows the key.
+func helloMAC(key, challenge []byte, session string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	mac.Write([]byte(session))
+	return mac.Sum(nil)
+}
+
+// ReadKeyFile reads the key shared by a Sender and Receiver from the named file. The key
+// is the file's contents, without leading and trailing white space.
+func ReadKeyFile(name string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(contents)
+	if len(key) < minKeySize {
+		return nil, fmt.Errorf("data mover key file %s holds %d bytes, need at least %d", name, len(key), minKeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,228 @@
+package mover
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// helloTimeout is how long the Receiver waits for the HELLO of a new connection.
+const helloTimeout = 10 * time.Second
+
+// Receiver writes the files sent by Senders under its directory.
+type Receiver struct {
+	Dir  string                                   // the files' names are relative to this
+	Key  []byte                                   // shared with the Senders; see ReadKeyFile
+	Logf func(format string, args ...interface{}) // reports refused frames; nil means log.Printf
+
+	mu       sync.Mutex
+	sessions map[string]*receiverConn // the current connection of each Sender session
+}
+
+type receiverConn struct {
+	conn net.Conn
+	done chan struct{} // closed when the connection's files are closed
+}
+
+// Serve accepts connections on l, and handles each one in its own goroutine, until
+// l fails.
+func (r *Receiver) Serve(l net.Listener) error {
+	if len(r.Key) < minKeySize {
+		return fmt.Errorf("data mover receiver needs a key of at least %d bytes", minKeySize)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *Receiver) logf(format string, args ...interface{}) {
+	if r.Logf == nil {
+		log.Printf(format, args...)
+		return
+	}
+	r.Logf(format, args...)
+}
+
+// handle applies the frames of one connection, and acknowledges them.
+func (r *Receiver) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		r.logf("Data mover could not make a challenge: %v", err)
+		return
+	}
+	ch := frame{kind: frameChallenge, data: challenge}
+	if ch.write(bw) != nil || bw.Flush() != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	hello, err := readFrame(br)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if hello.kind != frameHello || hello.offset != protocolVersion {
+		r.refuse(conn, bw, fmt.Errorf("need HELLO with protocol version %d first", protocolVersion))
+		return
+	}
+	session, err := r.authenticate(challenge, hello.data)
+	if err != nil {
+		r.refuse(conn, bw, err)
+		return
+	}
+
+	// Replace any older connection of the session, which may be half-dead.
+	me := &receiverConn{conn: conn, done: make(chan struct{})}
+	r.mu.Lock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]*receiverConn)
+	}
+	old := r.sessions[session]
+	r.sessions[session] = me
+	r.mu.Unlock()
+	if old != nil {
+		old.conn.Close()
+		<-old.done
+	}
+
+	files := make(map[uint32]*os.File)
+	defer func() {
+		for _, fp := range files {
+			fp.Close()
+		}
+		r.mu.Lock()
+		if r.sessions[session] == me {
+			delete(r.sessions, session)
+		}
+		r.mu.Unlock()
+		close(me.done)
+	}()
+
+	var applied uint64
+	for {
+		f, err := readFrame(br)
+		if err != nil {
+			if err != io.EOF && !isClosedConn(err) {
+				r.logf("Data mover connection from %s failed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := r.apply(f, files); err != nil {
+			r.refuse(conn, bw, err)
+			return
+		}
+		if f.seq > applied {
+			applied = f.seq
+		}
+		// Acknowledge once all frames received so far are applied.
+		if applied > 0 && br.Buffered() == 0 {
+			ack := frame{kind: frameAck, seq: applied}
+			if ack.write(bw) != nil || bw.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// authenticate checks the HMAC at the start of the HELLO payload, and returns the session
+// ID that follows it.
+func (r *Receiver) authenticate(challenge, payload []byte) (string, error) {
+	n := len(helloMAC(r.Key, challenge, ""))
+	if len(payload) < n {
+		return "", errors.New("HELLO is too short")
+	}
+	session := string(payload[n:])
+	if !hmac.Equal(payload[:n], helloMAC(r.Key, challenge, session)) {
+		return "", errors.New("HELLO does not prove the shared key")
+	}
+	return session, nil
+}
+
+// refuse tells the Sender why a frame was refused.
+func (r *Receiver) refuse(conn net.Conn, bw *bufio.Writer, err error) {
+	r.logf("Data mover refused a frame from %s: %v", conn.RemoteAddr(), err)
+	f := frame{kind: frameError, data: []byte(err.Error())}
+	if f.write(bw) == nil {
+		bw.Flush()
+	}
+}
+
+// apply applies one frame to the connection's open files.
+func (r *Receiver) apply(f *frame, files map[uint32]*os.File) error {
+	fp := files[f.file]
+	switch f.kind {
+	case frameOpen:
+		if fp != nil && f.seq == 0 {
+			return nil
+		}
+		path, err := r.path(string(f.data))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		flag := os.O_WRONLY | os.O_CREATE
+		if f.seq > 0 {
+			flag |= os.O_TRUNC
+		}
+		if fp != nil {
+			fp.Close()
+		}
+		if fp, err = os.OpenFile(path, flag, 0644); err != nil {
+			delete(files, f.file)
+			return err
+		}
+		files[f.file] = fp
+		return nil
+	case frameClose:
+		if fp == nil {
+			return nil // closed already, before the connection was lost
+		}
+		delete(files, f.file)
+		return fp.Close()
+	case frameData, frameSync:
+		if fp == nil {
+			return fmt.Errorf("file %d is not open", f.file)
+		}
+		if f.kind == frameSync {
+			return fp.Sync()
+		}
+		_, err := fp.WriteAt(f.data, f.offset)
+		return err
+	}
+	return fmt.Errorf("unexpected frame kind %d", f.kind)
+}
+
+// path returns where the named file goes, refusing names that would leave r.Dir.
+func (r *Receiver) path(name string) (string, error) {
+	local := filepath.Clean(filepath.FromSlash(name))
+	up := ".." + string(filepath.Separator)
+	if name == "" || local == "." || local == ".." || strings.HasPrefix(local, up) || filepath.IsAbs(local) ||
+		filepath.VolumeName(local) != "" {
+		return "", fmt.Errorf("file name %q is not a local relative path", name)
+	}
+	return filepath.Join(r.Dir, local), nil
+}
+
+// isClosedConn returns whether err comes from using a connection that was closed, as
+// when a newer connection of the session replaces it.
+func isClosedConn(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,482 @@
+package mover
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxUnacked is the default SenderConfig.MaxUnacked (64 MB).
+const DefaultMaxUnacked = 64 * 1024 * 1024
+
+// DefaultTimeout is the default SenderConfig.Timeout.
+const DefaultTimeout = 30 * time.Second
+
+// dialTimeout is how long the Sender waits for each attempt to connect.
+const dialTimeout = 5 * time.Second
+
+// The Sender waits minBackoff after its first failure to connect, doubling the wait
+// after each further failure up to maxBackoff.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// errSenderClosed is returned by writes after Sender.Close.
+var errSenderClosed = errors.New("data mover sender is closed")
+
+// SenderConfig configures a Sender.
+type SenderConfig struct {
+	Addr string // host:port of the Receiver
+	Key  []byte // shared with the Receiver; see ReadKeyFile
+
+	// If not nil, connect with TLS. It should set RootCAs to check the Receiver's
+	// certificate.
+	TLS *tls.Config
+
+	// The most payload bytes not yet acknowledged; writes wait for room. 0 means
+	// DefaultMaxUnacked.
+	MaxUnacked int
+
+	// How long writes wait for room, Sync for its ACK, and Close for all ACKs. 0 means
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	// Reports lost connections. nil means log.Printf.
+	Logf func(format string, args ...interface{})
+}
+
+// Sender sends files to a Receiver. Make one with NewSender.
+type Sender struct {
+	config  SenderConfig
+	session string
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	queue       []*frame          // frames not yet acknowledged, in seq order
+	queuedBytes int               // payload bytes in queue
+	nextSeq     uint64            // seq of the last frame queued
+	sentSeq     uint64            // seq of the last frame sent on the current connection
+	ackedSeq    uint64            // seq of the last frame acknowledged
+	nextFile    uint32            // ID of the last file created
+	files       map[uint32]string // name of each file whose CLOSE is not yet acknowledged
+	conn        net.Conn          // the current connection, if any
+	reconnects  int               // connections lost
+	err         error             // set if the Receiver refuses a frame; the Sender is then unusable
+	closed      bool              // Close was called
+	quit        chan struct{}     // closed when the Sender stops trying to send
+	done        chan struct{}     // closed when the connection goroutine ends
+}
+
+// Status describes a Sender's connection.
+type Status struct {
+	Addr          string
+	Connected     bool
+	Reconnects    int // connections lost
+	UnackedFrames int
+	UnackedBytes  int
+}
+
+// NewSender returns a Sender that connects to the Receiver at config.Addr, and keeps
+// reconnecting if the connection is lost, until Close.
+func NewSender(config SenderConfig) (*Sender, error) {
+	if len(config.Key) < minKeySize {
+		return nil, fmt.Errorf("data mover sender needs a key of at least %d bytes", minKeySize)
+	}
+	if config.MaxUnacked <= 0 {
+		config.MaxUnacked = DefaultMaxUnacked
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.Logf == nil {
+		config.Logf = log.Printf
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s := &Sender{
+		config:  config,
+		session: hex.EncodeToString(b),
+		files:   make(map[uint32]string),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s, nil
+}
+
+// Status returns the state of the Sender's connection.
+func (s *Sender) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Status{Addr: s.config.Addr, Connected: s.conn != nil, Reconnects: s.reconnects,
+		UnackedFrames: len(s.queue), UnackedBytes: s.queuedBytes}
+}
+
+// Create creates (or truncates) the named file on the Receiver. The name is relative to
+// the Receiver's directory.
+func (s *Sender) Create(name string) (*File, error) {
+	s.mu.Lock()
+	s.nextFile++
+	id := s.nextFile
+	s.files[id] = name
+	s.mu.Unlock()
+	if _, err := s.enqueue(&frame{kind: frameOpen, file: id, data: []byte(name)}); err != nil {
+		s.mu.Lock()
+		delete(s.files, id)
+		s.mu.Unlock()
+		return nil, err
+	}
+	return &File{s: s, id: id, name: name}, nil
+}
+
+// Close waits (up to the Timeout) for the Receiver to acknowledge every frame, then
+// stops the Sender. It returns an error if any frame was not acknowledged.
+func (s *Sender) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	deadline := time.Now().Add(s.config.Timeout)
+	var err error
+	for len(s.queue) > 0 && s.err == nil {
+		if !s.waitLocked(deadline) {
+			err = fmt.Errorf("data mover receiver at %s did not acknowledge %d frames (%d bytes) within %v",
+				s.config.Addr, len(s.queue), s.queuedBytes, s.config.Timeout)
+			break
+		}
+	}
+	if err == nil {
+		err = s.err
+	}
+	close(s.quit)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+	return err
+}
+
+// enqueue gives f the next seq and queues it to be sent, after waiting (up to the
+// Timeout) for room among the unacknowledged frames. It returns the seq.
+func (s *Sender) enqueue(f *frame) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline := time.Now().Add(s.config.Timeout)
+	for s.err == nil && !s.closed && len(s.queue) > 0 && s.queuedBytes+len(f.data) > s.config.MaxUnacked {
+		if !s.waitLocked(deadline) {
+			return 0, fmt.Errorf("data mover receiver at %s has not acknowledged %d bytes within %v",
+				s.config.Addr, s.queuedBytes, s.config.Timeout)
+		}
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.closed {
+		return 0, errSenderClosed
+	}
+	s.nextSeq++
+	f.seq = s.nextSeq
+	s.queue = append(s.queue, f)
+	s.queuedBytes += len(f.data)
+	s.cond.Broadcast()
+	return f.seq, nil
+}
+
+// waitAcked waits (up to the Timeout) for the Receiver to acknowledge frame seq.
+func (s *Sender) waitAcked(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline := time.Now().Add(s.config.Timeout)
+	for s.ackedSeq < seq && s.err == nil {
+		if !s.waitLocked(deadline) {
+			return fmt.Errorf("data mover receiver at %s did not acknowledge a sync within %v",
+				s.config.Addr, s.config.Timeout)
+		}
+	}
+	return s.err
+}
+
+// waitLocked waits on s.cond, holding s.mu, and returns false if the deadline passed.
+func (s *Sender) waitLocked(deadline time.Time) bool {
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+	t := time.AfterFunc(wait, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	s.cond.Wait()
+	t.Stop()
+	return time.Now().Before(deadline)
+}
+
+// acknowledge drops the frames up to seq from the queue.
+func (s *Sender) acknowledge(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for n < len(s.queue) && s.queue[n].seq <= seq {
+		f := s.queue[n]
+		s.queuedBytes -= len(f.data)
+		if f.kind == frameClose {
+			delete(s.files, f.file)
+		}
+		n++
+	}
+	s.queue = s.queue[n:]
+	if seq > s.ackedSeq {
+		s.ackedSeq = seq
+	}
+	s.cond.Broadcast()
+}
+
+// finishedLocked says whether the Sender should stop trying to send. Hold s.mu.
+func (s *Sender) finishedLocked() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+	}
+	return s.err != nil || (s.closed && len(s.queue) == 0)
+}
+
+// run connects to the Receiver, and reconnects after each lost connection, until finished.
+func (s *Sender) run() {
+	defer close(s.done)
+	backoff := minBackoff
+	for {
+		s.mu.Lock()
+		finished := s.finishedLocked()
+		s.mu.Unlock()
+		if finished {
+			return
+		}
+		conn, err := s.dial()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+		if err := s.serve(conn); err != nil {
+			s.config.Logf("Lost connection to data mover receiver at %s: %v", s.config.Addr, err)
+		}
+	}
+}
+
+// dial connects to the Receiver, with TLS if configured.
+func (s *Sender) dial() (net.Conn, error) {
+	if s.config.TLS != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", s.config.Addr, s.config.TLS)
+	}
+	return net.DialTimeout("tcp", s.config.Addr, dialTimeout)
+}
+
+// connState is shared by the two goroutines that use one connection.
+type connState struct {
+	broken bool // the ACK reader stopped
+	err    error
+}
+
+// serve sends frames on conn, and reads the ACKs, until the connection breaks or the
+// Sender is finished. It returns why the connection broke, if it did.
+func (s *Sender) serve(conn net.Conn) error {
+	s.mu.Lock()
+	if s.finishedLocked() {
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	// The Receiver's CHALLENGE comes first.
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	challenge, err := readFrame(r)
+	if err == nil && challenge.kind != frameChallenge {
+		err = fmt.Errorf("receiver sent frame kind %d, not CHALLENGE", challenge.kind)
+	}
+	c := new(connState)
+	if err == nil {
+		conn.SetReadDeadline(time.Time{})
+		readerDone := make(chan struct{})
+		go func() {
+			s.readAcks(r, conn, c)
+			close(readerDone)
+		}()
+		err = s.sendFrames(conn, challenge.data, c)
+		conn.Close()
+		<-readerDone
+	} else {
+		conn.Close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = nil
+	if s.finishedLocked() {
+		return nil
+	}
+	s.reconnects++
+	if err == nil {
+		err = c.err
+	}
+	return err
+}
+
+// sendFrames sends HELLO (answering the challenge), an OPEN of each file not yet closed,
+// and then each frame not yet acknowledged, as it is queued.
+func (s *Sender) sendFrames(conn net.Conn, challenge []byte, c *connState) error {
+	w := bufio.NewWriter(conn)
+	hello := append(helloMAC(s.config.Key, challenge, s.session), s.session...)
+	s.mu.Lock()
+	frames := []*frame{{kind: frameHello, offset: protocolVersion, data: hello}}
+	for id, name := range s.files {
+		frames = append(frames, &frame{kind: frameOpen, file: id, data: []byte(name)})
+	}
+	s.sentSeq = s.ackedSeq
+	for {
+		if len(s.queue) > 0 {
+			unsent := s.queue[s.sentSeq+1-s.queue[0].seq:]
+			frames = append(frames, unsent...)
+			s.sentSeq = s.nextSeq
+		}
+		s.mu.Unlock()
+		for _, f := range frames {
+			if err := f.write(w); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		frames = frames[:0]
+		s.mu.Lock()
+		for s.sentSeq == s.nextSeq && !c.broken && !s.finishedLocked() {
+			s.cond.Wait()
+		}
+		if c.broken || s.finishedLocked() {
+			s.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+// readAcks reads the Receiver's frames from r, which reads conn, until it fails.
+func (s *Sender) readAcks(r *bufio.Reader, conn net.Conn, c *connState) {
+	var err error
+	for err == nil {
+		var f *frame
+		if f, err = readFrame(r); err != nil {
+			break
+		}
+		switch f.kind {
+		case frameAck:
+			s.acknowledge(f.seq)
+		case frameError:
+			err = fmt.Errorf("data mover receiver at %s refused a frame: %s", s.config.Addr, f.data)
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		default:
+			err = fmt.Errorf("unexpected frame kind %d from the receiver", f.kind)
+		}
+	}
+	conn.Close()
+	s.mu.Lock()
+	c.broken = true
+	c.err = err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// File is a file on the Receiver, made by Sender.Create. Writes go to the Sender's
+// queue; Sync waits for the Receiver to commit the file.
+type File struct {
+	s      *Sender
+	id     uint32
+	name   string
+	offset int64 // where the next Write goes
+	closed bool
+}
+
+// Name returns the name of the file, relative to the Receiver's directory.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Write queues p to be written at the end of the file.
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt queues p to be written at offset off of the file.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errors.New("data mover file is closed")
+	}
+	n := 0
+	for n < len(p) {
+		size := len(p) - n
+		if size > maxFramePayload {
+			size = maxFramePayload
+		}
+		data := make([]byte, size)
+		copy(data, p[n:])
+		if _, err := f.s.enqueue(&frame{kind: frameData, file: f.id, offset: off + int64(n), data: data}); err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// Sync waits (up to the Sender's Timeout) for the Receiver to commit everything written
+// so far to stable storage.
+func (f *File) Sync() error {
+	if f.closed {
+		return errors.New("data mover file is closed")
+	}
+	seq, err := f.s.enqueue(&frame{kind: frameSync, file: f.id})
+	if err != nil {
+		return err
+	}
+	return f.s.waitAcked(seq)
+}
+
+// Close queues the closing of the file. Sender.Close waits until it is done.
+func (f *File) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	_, err := f.s.enqueue(&frame{kind: frameClose, file: f.id})
+	return err
+}
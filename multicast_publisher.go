@@ -0,0 +1,158 @@
+package dastard
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// MulticastConfig holds the configuration of the optional UDP multicast publisher. It is
+// read from the "multicast" key of the config file when a source starts. Each record
+// summary is sent as one datagram to the multicast Group, in the binary format of the
+// ZMQ summary messages. Multicast never blocks data processing: summaries beyond
+// MaxRate, or beyond what the sending goroutine keeps up with, are dropped and counted.
+type MulticastConfig struct {
+	Enabled   bool
+	Group     string  // multicast group address and port, like "239.1.2.3:5520"
+	Interface string  // name of the network interface to send from; empty means the system default
+	MaxRate   float64 // if > 0, send at most this many summaries per second
+}
+
+// MulticastRecordsChan is used to enable multiple different DataPublishers to publish
+// to the same multicast socket, in analogy to PubSummariesChan.
+var MulticastRecordsChan chan []*DataRecord
+
+// multicastActiveConfig is the configuration that MulticastRecordsChan was started with.
+var multicastActiveConfig MulticastConfig
+
+// multicastDropped counts summaries not multicast since Dastard started, because the
+// queue was full or MaxRate was exceeded. Use sync/atomic to access it.
+var multicastDropped int64
+
+// validate checks the config for errors, and returns the group address.
+func (config *MulticastConfig) validate() (*net.UDPAddr, error) {
+	if !config.Enabled {
+		return nil, fmt.Errorf("multicast publishing is not enabled")
+	}
+	group, err := net.ResolveUDPAddr("udp", config.Group)
+	if err != nil {
+		return nil, fmt.Errorf("multicast Group %q is invalid: %v", config.Group, err)
+	}
+	if !group.IP.IsMulticast() || group.Port == 0 {
+		return nil, fmt.Errorf("multicast Group %q needs a multicast address and a nonzero port", config.Group)
+	}
+	if config.MaxRate < 0 {
+		return nil, fmt.Errorf("multicast MaxRate=%v, need >= 0", config.MaxRate)
+	}
+	return group, nil
+}
+
+// configureMulticastPublisher starts the multicast goroutine if it's not already running
+// with the same configuration. A running publisher with a different configuration is
+// stopped and replaced.
+func configureMulticastPublisher(config MulticastConfig) error {
+	group, err := config.validate()
+	if err != nil {
+		return err
+	}
+	if MulticastRecordsChan != nil {
+		if config == multicastActiveConfig {
+			return nil
+		}
+		close(MulticastRecordsChan)
+		MulticastRecordsChan = nil
+	}
+	var local *net.UDPAddr
+	if config.Interface != "" {
+		if local, err = interfaceAddr(config.Interface); err != nil {
+			return err
+		}
+	}
+	conn, err := net.DialUDP("udp", local, group)
+	if err != nil {
+		return fmt.Errorf("could not open multicast socket to %s: %v", config.Group, err)
+	}
+	MulticastRecordsChan = startMulticastPublisher(conn, config.MaxRate)
+	multicastActiveConfig = config
+	return nil
+}
+
+// interfaceAddr returns a local UDP address on the named network interface, so that
+// datagrams sent from it leave through that interface.
+func interfaceAddr(name string) (*net.UDPAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("multicast Interface %q: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("multicast Interface %q: %v", name, err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipnet.IP}, nil
+		}
+	}
+	return nil, fmt.Errorf("multicast Interface %q has no IPv4 address", name)
+}
+
+// startMulticastPublisher starts a goroutine to send the summary of each record that
+// appears on a new channel as one datagram on conn. Returns the channel for other
+// routines to fill. Close that channel to close conn.
+func startMulticastPublisher(conn io.WriteCloser, maxRate float64) chan []*DataRecord {
+	const publishChannelDepth = 500
+	mcastchan := make(chan []*DataRecord, publishChannelDepth)
+	limiter := newRateLimiter(maxRate, time.Now())
+	go func() {
+		defer conn.Close()
+		for records := range mcastchan {
+			now := time.Now()
+			for _, record := range records {
+				if !limiter.allow(now) {
+					atomic.AddInt64(&multicastDropped, 1)
+					continue
+				}
+				if _, err := conn.Write(joinMessage(messageSummaries(record))); err != nil {
+					atomic.AddInt64(&multicastDropped, 1)
+				}
+			}
+		}
+	}()
+	return mcastchan
+}
+
+// rateLimiter is a token bucket that allows up to rate events per second on average,
+// in bursts of up to a tenth of a second's worth (at least 1).
+type rateLimiter struct {
+	rate   float64 // 0 means no limit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, now time.Time) *rateLimiter {
+	burst := rate / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// allow returns whether an event may happen at time now, and if so, uses up its token.
+func (rl *rateLimiter) allow(now time.Time) bool {
+	if rl.rate <= 0 {
+		return true
+	}
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	rl.last = now
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
@@ -0,0 +1,83 @@
+package dastard
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMulticastConfig(t *testing.T) {
+	bad := []MulticastConfig{
+		{Enabled: false, Group: "239.1.2.3:5520"},
+		{Enabled: true, Group: "127.0.0.1:5520"},
+		{Enabled: true, Group: "239.1.2.3:0"},
+		{Enabled: true, Group: "not an address"},
+		{Enabled: true, Group: "239.1.2.3:5520", MaxRate: -1},
+		{Enabled: true, Group: "239.1.2.3:5520", Interface: "no_such_interface"},
+	}
+	for _, mc := range bad {
+		if err := configureMulticastPublisher(mc); err == nil {
+			t.Errorf("configureMulticastPublisher(%+v) should fail", mc)
+		}
+	}
+	good := MulticastConfig{Enabled: true, Group: "239.1.2.3:5520"}
+	if _, err := good.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(100, now)
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if rl.allow(now) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("rateLimiter(100/s) allowed a burst of %d, want 10", allowed)
+	}
+	if !rl.allow(now.Add(10*time.Millisecond)) || rl.allow(now.Add(10*time.Millisecond)) {
+		t.Error("rateLimiter(100/s) should allow exactly 1 event after 10 ms")
+	}
+	unlimited := newRateLimiter(0, now)
+	for i := 0; i < 1000; i++ {
+		if !unlimited.allow(now) {
+			t.Fatal("rateLimiter(0) should allow every event")
+		}
+	}
+}
+
+func TestMulticastPublisher(t *testing.T) {
+	// Send to a local unicast listener; the datagrams are the same as for a multicast group.
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mcastchan := startMulticastPublisher(conn, 0)
+	defer close(mcastchan)
+
+	records := []*DataRecord{
+		{data: []RawType{1, 2, 3, 4}, presamples: 1, channelIndex: 3, peakValue: 3},
+		{data: []RawType{5, 6, 7, 8}, presamples: 1, channelIndex: 4, peakValue: 7},
+	}
+	mcastchan <- records
+	buf := make([]byte, 65536)
+	for _, rec := range records {
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := listener.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := joinMessage(messageSummaries(rec)); !bytes.Equal(buf[:n], want) {
+			t.Errorf("datagram for channel %d is %v, want %v", rec.channelIndex, buf[:n], want)
+		}
+	}
+}
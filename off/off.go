@@ -11,14 +11,44 @@
 // 28-31    float32   residualStdDev (in raw data space, not Mahalanobis distance)
 // 32-Z     float32   the NumberOfBases model coefficients of the pulse projected in to the model
 // Z = 31+4*NumberOfBases
+// If the header's DriftCorrection is true (added in version 0.2.0), a column is inserted
+// before the model coefficients, which then start at byte 36 (and Z = 35+4*NumberOfBases)
+// 32-35    float32   driftCorrection (multiply model coefficients by this to correct gain drift)
+// If the header's RecordFlags is true (added in version 0.3.0), the record continues with
+// Z+1-Z+4  uint32    flags, a bitwise OR of the Flag* values
+// If flags includes FlagRawSamples, the record continues with
+// Z+5-Z+8  int32     nRaw, the number of raw samples that follow
+// Z+9-     uint16    nRaw raw samples of the record
+// Raw samples are stored only for records whose residualStdDev exceeds the header's
+// RawSamplesThreshold (or is NaN).
+// If flags includes FlagExtensions (added in version 0.4.0), the record then continues with
+// an extension area of type-length-value fields
+// 0-1      uint16    nExt, the number of bytes of fields that follow
+// then for each field
+// 0-1      uint16    tag, as listed in the header's Extensions
+// 2-3      uint16    length, the number of bytes of the value
+// 4-       bytes     the value
+// Readers skip the whole area (or any field whose tag they do not know) by its length,
+// so new per-record quantities can be added without breaking them. Raw samples and
+// extensions need the flags word, so they set RecordFlags.
+// The version is the lowest that describes the file's records: 0.1.0 if none of these
+// optional parts is declared.
+// Files whose projectors may be replaced while they are written are version 0.5.0. Their
+// records carry a uint32 "modelVersion" extension field: 0 for the header's ModelInfo,
+// or i+1 for the header's ModelVersions[i]. The header is padded with spaces to leave
+// room for the models added later, and is rewritten in place as each is added.
 package off
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"time"
 
@@ -26,6 +56,20 @@ import (
 	"gonum.org/v1/gonum/mat"
 )
 
+// Bits of the per-record flags word
+const (
+	FlagPileup     uint32 = 1 << iota // residualStdDev suggests pileup or another misfit pulse
+	FlagRawSamples                    // the raw samples follow the record
+	FlagExtensions                    // an extension area follows the record (and any raw samples)
+)
+
+// MaxExtensionBytes is the largest size of a record's extension area, tags and lengths included.
+const MaxExtensionBytes = math.MaxUint16
+
+// DefaultBufferSize is the size in bytes of the write buffer of a Writer, unless its
+// BufferSize is set.
+const DefaultBufferSize = 32768
+
 // Writer writes OFF files
 type Writer struct {
 	ChannelIndex              int
@@ -34,25 +78,59 @@ type Writer struct {
 	MaxPresamples             int
 	MaxSamples                int
 	FramePeriodSeconds        float64
+	VoltsPerArb               float64 // volts = VoltsOffset + VoltsPerArb*raw; set before the first WriteRecord
+	VoltsOffset               float64
+	SignedSamples             bool `json:",omitempty"` // raw samples are int16 values, written as uint16
+	DriftCorrection           bool `json:",omitempty"` // records carry a driftCorrection column
+	RecordFlags               bool `json:",omitempty"` // records carry a flags word
 	FileFormat                string
 	FileFormatVersion         string
 	NumberOfBases             int
+	RawSamplesThreshold       float64         `json:",omitempty"` // if > 0, flagged records carry raw samples
+	Extensions                []ExtensionInfo `json:",omitempty"` // the fields that records may carry in an extension area
 	ModelInfo                 ModelInfo
+	ModelVersions             []ModelInfo `json:",omitempty"` // models that replaced ModelInfo, in order
 	CreationInfo              CreationInfo
 	ReadoutInfo               TimeDivisionMultiplexingInfo
+	BufferSize                int        `json:"-"` // bytes in the write buffer; 0 means DefaultBufferSize
+	Create                    CreateFunc `json:"-"` // creates the file; nil means os.Create
 
 	// items not serialized to JSON header
 	recordsWritten int
 	fileName       string
 	headerWritten  bool
-	file           *os.File
+	headerSize     int // bytes in the header, padding included, not the newline after it
+	modelSlots     int // how many models may be added to ModelVersions
+	modelSlotSize  int // bytes of header padding reserved for each model not yet added
+	file           File
 	writer         *bufio.Writer
 }
 
+// File is where a Writer writes: an *os.File, or a stand-in such as a file sent over
+// the network. WriteAt is used to rewrite the header.
+type File interface {
+	io.Writer
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// CreateFunc creates the named file for a Writer. If the Writer's Create is nil, it
+// uses os.Create.
+type CreateFunc func(name string) (File, error)
+
+// create creates the named file with f, or with os.Create if f is nil.
+func (f CreateFunc) create(name string) (File, error) {
+	if f == nil {
+		return os.Create(name)
+	}
+	return f(name)
+}
+
 // NewWriter creates a new OFF writer. No file is created until the first call to WriteRecord
 func NewWriter(fileName string, ChannelIndex int, ChannelName string, ChannelNumberMatchingName int,
 	MaxPresamples int, MaxSamples int, FramePeriodSeconds float64,
-	Projectors *mat.Dense, Basis *mat.Dense, ModelDescription string,
+	Projectors *mat.Dense, Basis *mat.Dense, ModelDescription string, NoiseWhitener *mat.Dense,
 	DastardVersion string, GitHash string, SourceName string,
 	ReadoutInfo TimeDivisionMultiplexingInfo) *Writer {
 	writer := new(Writer)
@@ -62,10 +140,11 @@ func NewWriter(fileName string, ChannelIndex int, ChannelName string, ChannelNum
 	writer.FileFormat = "OFF"
 	writer.FileFormatVersion = "0.1.0"
 	writer.MaxPresamples = MaxPresamples
+	writer.MaxSamples = MaxSamples
 	writer.FramePeriodSeconds = FramePeriodSeconds
 	writer.NumberOfBases, _ = Projectors.Dims()
 	writer.ModelInfo = ModelInfo{Projectors: *NewArrayJsoner(Projectors), Basis: *NewArrayJsoner(Basis),
-		Description: ModelDescription}
+		Description: ModelDescription, NoiseWhitener: *NewArrayJsoner(NoiseWhitener)}
 	writer.CreationInfo = CreationInfo{DastardVersion: DastardVersion, GitHash: GitHash,
 		SourceName: SourceName, CreationTime: time.Now()}
 	writer.ReadoutInfo = ReadoutInfo
@@ -75,9 +154,10 @@ func NewWriter(fileName string, ChannelIndex int, ChannelName string, ChannelNum
 
 // ModelInfo stores info related to the model (aka basis, aka projectors) for printing to the file header, aids with json formatting
 type ModelInfo struct {
-	Projectors  ArrayJsoner
-	Basis       ArrayJsoner
-	Description string
+	Projectors    ArrayJsoner
+	Basis         ArrayJsoner
+	Description   string
+	NoiseWhitener ArrayJsoner // 0x0 if no whitener was given
 }
 
 // ArrayJsoner aids in formatting arrays for writing to JSON
@@ -87,9 +167,12 @@ type ArrayJsoner struct {
 	Cols                        int
 }
 
-// NewArrayJsoner creates an ArrayJsoner from a mat.Dense
+// NewArrayJsoner creates an ArrayJsoner from a mat.Dense. A nil or empty array gives a 0x0 ArrayJsoner.
 func NewArrayJsoner(array *mat.Dense) *ArrayJsoner {
 	v := new(ArrayJsoner)
+	if array == nil || array.IsZero() {
+		return v
+	}
 	v.Rows, v.Cols = array.Dims()
 	v.RowMajorFloat64ValuesBase64 = base64.StdEncoding.EncodeToString(getbytes.FromSliceFloat64(array.RawMatrix().Data))
 	return v
@@ -112,6 +195,219 @@ type TimeDivisionMultiplexingInfo struct {
 	RowNum          int
 }
 
+// ExtensionInfo describes in the header one field of the record extension area.
+type ExtensionInfo struct {
+	Tag         uint16
+	Name        string
+	Type        string // how to read the value, e.g. "float32" or "uint32" (little endian)
+	Description string
+}
+
+// Extension is the value of one field in a record's extension area.
+type Extension struct {
+	Tag   uint16
+	Value []byte
+}
+
+// Float32Extension returns the extension field tag holding the float32 x.
+func Float32Extension(tag uint16, x float32) Extension {
+	return Extension{Tag: tag, Value: getbytes.FromFloat32(x)}
+}
+
+// Uint32Extension returns the extension field tag holding the uint32 x.
+func Uint32Extension(tag uint16, x uint32) Extension {
+	return Extension{Tag: tag, Value: getbytes.FromUint32(x)}
+}
+
+// RegisterExtension adds a field that records may carry in their extension area, and
+// returns its tag. Name must be unique in the file; valueType tells readers how to
+// interpret the value. Registering any extension sets RecordFlags and makes the file
+// version 0.4.0. It must be called before the header is written.
+func (w *Writer) RegisterExtension(name string, valueType string, description string) (uint16, error) {
+	if w.headerWritten {
+		return 0, errors.New("cannot register an extension after the header is written")
+	}
+	if name == "" {
+		return 0, errors.New("extension name must be non-empty")
+	}
+	for _, ext := range w.Extensions {
+		if ext.Name == name {
+			return 0, fmt.Errorf("extension %q is already registered", name)
+		}
+	}
+	if len(w.Extensions) >= math.MaxUint16 {
+		return 0, errors.New("too many extensions")
+	}
+	tag := uint16(len(w.Extensions) + 1)
+	w.Extensions = append(w.Extensions, ExtensionInfo{Tag: tag, Name: name, Type: valueType, Description: description})
+	w.RecordFlags = true
+	w.requireVersion("0.4.0")
+	return tag, nil
+}
+
+// ExtensionTag returns the tag of the named extension, and whether it is registered.
+func (w *Writer) ExtensionTag(name string) (uint16, bool) {
+	for _, ext := range w.Extensions {
+		if ext.Name == name {
+			return ext.Tag, true
+		}
+	}
+	return 0, false
+}
+
+// encodeExtensions returns the extension area holding fields, without its size.
+func (w *Writer) encodeExtensions(fields []Extension) ([]byte, error) {
+	var area []byte
+	for _, field := range fields {
+		if field.Tag == 0 || int(field.Tag) > len(w.Extensions) {
+			return nil, fmt.Errorf("extension tag %d is not registered", field.Tag)
+		}
+		if len(field.Value) > math.MaxUint16 {
+			return nil, fmt.Errorf("extension %q value has %d bytes, more than %d",
+				w.Extensions[field.Tag-1].Name, len(field.Value), math.MaxUint16)
+		}
+		area = append(area, getbytes.FromUint16(field.Tag)...)
+		area = append(area, getbytes.FromUint16(uint16(len(field.Value)))...)
+		area = append(area, field.Value...)
+	}
+	if len(area) > MaxExtensionBytes {
+		return nil, fmt.Errorf("extension area has %d bytes, more than %d", len(area), MaxExtensionBytes)
+	}
+	return area, nil
+}
+
+// ParseExtensions splits an extension area (without its size) into its fields.
+func ParseExtensions(area []byte) ([]Extension, error) {
+	var fields []Extension
+	for len(area) > 0 {
+		if len(area) < 4 {
+			return nil, errors.New("extension area ends within a field header")
+		}
+		tag := binary.LittleEndian.Uint16(area)
+		n := int(binary.LittleEndian.Uint16(area[2:]))
+		if len(area) < 4+n {
+			return nil, fmt.Errorf("extension tag %d needs %d bytes, area has %d", tag, n, len(area)-4)
+		}
+		fields = append(fields, Extension{Tag: tag, Value: area[4 : 4+n]})
+		area = area[4+n:]
+	}
+	return fields, nil
+}
+
+// modelVersionExtension is the name of the extension field holding a record's model version.
+const modelVersionExtension = "modelVersion"
+
+// modelSlotSlack is the header padding reserved for each added model beyond the size of
+// the first model, for a longer description or for rounding of the array sizes.
+const modelSlotSlack = 4096
+
+// ReserveModelVersions leaves room in the header for n models that may replace the
+// first one while the file is written, and registers the "modelVersion" extension that
+// tags each record with the model it was projected by. Each added model may be at most
+// a little larger in the header than the first one (so it may not add a large noise
+// whitener that the first lacked). Reserving any room makes the file version 0.5.0. It
+// must be called before the header is written.
+func (w *Writer) ReserveModelVersions(n int) error {
+	if w.headerWritten {
+		return errors.New("cannot reserve model versions after the header is written")
+	}
+	if n <= 0 {
+		return nil
+	}
+	if w.modelSlots == 0 {
+		if _, err := w.RegisterExtension(modelVersionExtension, "uint32",
+			"the model (0 for ModelInfo, i+1 for ModelVersions[i]) that projected the record"); err != nil {
+			return err
+		}
+	}
+	model, err := json.MarshalIndent(w.ModelInfo, "    ", "    ")
+	if err != nil {
+		return err
+	}
+	w.modelSlots = n
+	w.modelSlotSize = len(model) + modelSlotSlack
+	w.requireVersion("0.5.0")
+	return nil
+}
+
+// ModelVersionsFree returns how many more models AddModelVersion can add.
+func (w *Writer) ModelVersionsFree() int {
+	return w.modelSlots - len(w.ModelVersions)
+}
+
+// ModelVersionField returns the extension field that tags a record with the given model
+// version, and whether the file has such a field (see ReserveModelVersions).
+func (w *Writer) ModelVersionField(version int) (Extension, bool) {
+	tag, ok := w.ExtensionTag(modelVersionExtension)
+	if !ok {
+		return Extension{}, false
+	}
+	return Uint32Extension(tag, uint32(version)), true
+}
+
+// AddModelVersion adds a model to ModelVersions, and returns its version number, which
+// records projected by it must carry (see ModelVersionField). It must have as many bases
+// as the first model. If the header is already written, it is rewritten in place; that
+// fails if the new model doesn't fit in the padding, and then the file is unchanged.
+func (w *Writer) AddModelVersion(Projectors *mat.Dense, Basis *mat.Dense, ModelDescription string,
+	NoiseWhitener *mat.Dense) (int, error) {
+	if w.ModelVersionsFree() <= 0 {
+		return 0, fmt.Errorf("no room for another model, %d were reserved", w.modelSlots)
+	}
+	if nbases, _ := Projectors.Dims(); nbases != w.NumberOfBases {
+		return 0, fmt.Errorf("model has %d bases, the file has %d", nbases, w.NumberOfBases)
+	}
+	model := ModelInfo{Projectors: *NewArrayJsoner(Projectors), Basis: *NewArrayJsoner(Basis),
+		Description: ModelDescription, NoiseWhitener: *NewArrayJsoner(NoiseWhitener)}
+	w.ModelVersions = append(w.ModelVersions, model)
+	if w.headerWritten {
+		if err := w.rewriteHeader(); err != nil {
+			w.ModelVersions = w.ModelVersions[:len(w.ModelVersions)-1]
+			return 0, err
+		}
+	}
+	return len(w.ModelVersions), nil
+}
+
+// paddedHeader returns the JSON header, padded with spaces before its closing brace to
+// size bytes. A size of 0 means the header's own size plus the room for the models not
+// yet added.
+func (w *Writer) paddedHeader(size int) ([]byte, error) {
+	s, err := json.MarshalIndent(w, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		size = len(s) + w.ModelVersionsFree()*w.modelSlotSize
+	}
+	pad := size - len(s)
+	if pad < 0 {
+		return nil, fmt.Errorf("header needs %d bytes, has room for %d", len(s), size)
+	}
+	if pad == 0 {
+		return s, nil
+	}
+	// MarshalIndent ends with "\n}", so the padding is a line of spaces before the brace.
+	padded := make([]byte, 0, size)
+	padded = append(padded, s[:len(s)-1]...)
+	padded = append(padded, bytes.Repeat([]byte(" "), pad-1)...)
+	padded = append(padded, '\n', '}')
+	return padded, nil
+}
+
+// rewriteHeader writes the header again over the old one, which it must fit.
+func (w *Writer) rewriteHeader() error {
+	header, err := w.paddedHeader(w.headerSize)
+	if err != nil {
+		return err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	_, err = w.file.WriteAt(header, 0)
+	return err
+}
+
 // HeaderWritten returns true if header has been written.
 func (w *Writer) HeaderWritten() bool {
 	return w.headerWritten
@@ -122,12 +418,85 @@ func (w *Writer) RecordsWritten() int {
 	return w.recordsWritten
 }
 
+// RecordSize returns the size in bytes of a record without raw samples or extension area.
+func (w *Writer) RecordSize() int {
+	size := 32 + 4*w.NumberOfBases
+	if w.DriftCorrection {
+		size += 4
+	}
+	if w.RecordFlags {
+		size += 4
+	}
+	return size
+}
+
+// FileName returns the name of the file (whether or not it has been created yet).
+func (w *Writer) FileName() string {
+	return w.fileName
+}
+
+// SetRawSamplesThreshold makes records with a residualStdDev above threshold (or NaN)
+// carry their raw samples, so pathological pulses can be inspected. A threshold of 0 or
+// less stores no raw samples; a larger one sets RecordFlags. It must be called before the
+// header is written.
+func (w *Writer) SetRawSamplesThreshold(threshold float64) error {
+	if w.headerWritten {
+		return errors.New("cannot change RawSamplesThreshold after the header is written")
+	}
+	w.RawSamplesThreshold = math.Max(threshold, 0)
+	if w.RawSamplesThreshold > 0 {
+		return w.EnableRecordFlags()
+	}
+	return nil
+}
+
+// EnableRecordFlags adds the flags word to the records, so their Flag* bits are stored.
+// It makes the file version 0.3.0 (or later), and must be called before the header is
+// written.
+func (w *Writer) EnableRecordFlags() error {
+	if w.headerWritten {
+		return errors.New("cannot add the record flags after the header is written")
+	}
+	w.RecordFlags = true
+	w.requireVersion("0.3.0")
+	return nil
+}
+
+// requireVersion raises FileFormatVersion to version, if it is lower. Versions are all
+// 0.N.0 with one digit N, so they compare as strings.
+func (w *Writer) requireVersion(version string) {
+	if w.FileFormatVersion < version {
+		w.FileFormatVersion = version
+	}
+}
+
+// EnableDriftCorrection adds the driftCorrection column to the records, so the gain-drift
+// correction of each is stored. It makes the file version 0.2.0 (or later), and must be
+// called before the header is written.
+func (w *Writer) EnableDriftCorrection() error {
+	if w.headerWritten {
+		return errors.New("cannot add the driftCorrection column after the header is written")
+	}
+	w.DriftCorrection = true
+	w.requireVersion("0.2.0")
+	return nil
+}
+
+// WantsRawSamples returns whether a record with the given residualStdDev is flagged to
+// carry its raw samples.
+func (w *Writer) WantsRawSamples(residualStdDev float32) bool {
+	if w.RawSamplesThreshold <= 0 {
+		return false
+	}
+	return math.IsNaN(float64(residualStdDev)) || float64(residualStdDev) > w.RawSamplesThreshold
+}
+
 // WriteHeader writes a header to the file
 func (w *Writer) WriteHeader() error {
 	if w.headerWritten {
 		return errors.New("header already written")
 	}
-	s, err := json.MarshalIndent(w, "", "    ")
+	s, err := w.paddedHeader(0)
 	if err != nil {
 		return err
 	}
@@ -138,15 +507,46 @@ func (w *Writer) WriteHeader() error {
 		return err1
 	}
 	w.headerWritten = true
+	w.headerSize = len(s)
 	return nil
 }
 
-// WriteRecord writes a record to the file
+// WriteRecord writes a record to the file. The driftCorrection is stored only if the
+// header's DriftCorrection is true.
 func (w *Writer) WriteRecord(recordSamples int32, recordPreSamples int32, framecount int64,
-	timestamp int64, pretriggerMean float32, residualStdDev float32, data []float32) error {
+	timestamp int64, pretriggerMean float32, residualStdDev float32, driftCorrection float32, data []float32) error {
+	return w.WriteFlaggedRecord(recordSamples, recordPreSamples, framecount, timestamp, pretriggerMean,
+		residualStdDev, driftCorrection, data, 0, nil)
+}
+
+// WriteFlaggedRecord writes a record to the file with the given flags and, if raw is
+// not nil, its raw samples. FlagRawSamples is set or cleared to match raw. The flags are
+// stored only if the header's RecordFlags is true. The raw
+// samples can be stored only in a file with a RawSamplesThreshold; pass nil unless
+// WantsRawSamples(residualStdDev) is true.
+func (w *Writer) WriteFlaggedRecord(recordSamples int32, recordPreSamples int32, framecount int64,
+	timestamp int64, pretriggerMean float32, residualStdDev float32, driftCorrection float32, data []float32,
+	flags uint32, raw []uint16) error {
+	return w.WriteExtendedRecord(recordSamples, recordPreSamples, framecount, timestamp, pretriggerMean,
+		residualStdDev, driftCorrection, data, flags, raw, nil)
+}
+
+// WriteExtendedRecord writes a record as WriteFlaggedRecord does, followed by an
+// extension area holding fields, whose tags must have been registered by
+// RegisterExtension. FlagExtensions is set or cleared to match fields.
+func (w *Writer) WriteExtendedRecord(recordSamples int32, recordPreSamples int32, framecount int64,
+	timestamp int64, pretriggerMean float32, residualStdDev float32, driftCorrection float32, data []float32,
+	flags uint32, raw []uint16, fields []Extension) error {
 	if len(data) != w.NumberOfBases {
 		return fmt.Errorf("wrong number of bases, have %v, want %v", len(data), w.NumberOfBases)
 	}
+	if raw != nil && w.RawSamplesThreshold <= 0 {
+		return errors.New("cannot write raw samples without a RawSamplesThreshold")
+	}
+	area, err := w.encodeExtensions(fields)
+	if err != nil {
+		return err
+	}
 	if _, err := w.writer.Write(getbytes.FromInt32(int32(recordSamples))); err != nil {
 		return err
 	}
@@ -165,9 +565,42 @@ func (w *Writer) WriteRecord(recordSamples int32, recordPreSamples int32, framec
 	if _, err := w.writer.Write(getbytes.FromFloat32(residualStdDev)); err != nil {
 		return err
 	}
+	if w.DriftCorrection {
+		if _, err := w.writer.Write(getbytes.FromFloat32(driftCorrection)); err != nil {
+			return err
+		}
+	}
 	if _, err := w.writer.Write(getbytes.FromSliceFloat32(data)); err != nil {
 		return err
 	}
+	flags &^= FlagRawSamples | FlagExtensions
+	if raw != nil {
+		flags |= FlagRawSamples
+	}
+	if len(fields) > 0 {
+		flags |= FlagExtensions
+	}
+	if w.RecordFlags {
+		if _, err := w.writer.Write(getbytes.FromUint32(flags)); err != nil {
+			return err
+		}
+	}
+	if raw != nil {
+		if _, err := w.writer.Write(getbytes.FromInt32(int32(len(raw)))); err != nil {
+			return err
+		}
+		if _, err := w.writer.Write(getbytes.FromSliceUint16(raw)); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 0 {
+		if _, err := w.writer.Write(getbytes.FromUint16(uint16(len(area)))); err != nil {
+			return err
+		}
+		if _, err := w.writer.Write(area); err != nil {
+			return err
+		}
+	}
 	w.recordsWritten++
 	return nil
 }
@@ -179,17 +612,30 @@ func (w Writer) Flush() {
 	}
 }
 
+// Sync flushes the write buffer and commits the file to stable storage
+func (w Writer) Sync() error {
+	if w.writer == nil {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
 // Close closes the file, it flushes the bufio.Writer first
 func (w Writer) Close() {
 	w.Flush()
-	w.file.Close()
+	if w.file != nil {
+		w.file.Close()
+	}
 }
 
 // CreateFile creates a file at w.FileName
 // must be called before WriteHeader or WriteRecord
 func (w *Writer) CreateFile() error {
 	if w.file == nil {
-		file, err := os.Create(w.fileName)
+		file, err := w.Create.create(w.fileName)
 		if err != nil {
 			return err
 		}
@@ -197,6 +643,10 @@ func (w *Writer) CreateFile() error {
 	} else {
 		return errors.New("file already exists")
 	}
-	w.writer = bufio.NewWriterSize(w.file, 32768)
+	size := w.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	w.writer = bufio.NewWriterSize(w.file, size)
 	return nil
 }
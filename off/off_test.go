@@ -1,7 +1,12 @@
 package off
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 
@@ -29,8 +34,23 @@ func TestOff(t *testing.T) {
 			0, 0, 1,
 			0, 0, 0})
 
-	w := NewWriter("off_test.off", 0, "chan1", 1, 100, 200, 9.6e-6, projectors, basis, "dummy model for testing",
+	whitener := mat.NewDense(2, nsamples,
+		[]float64{1, 0, 0, 0,
+			0, 1, 0, 0})
+
+	w := NewWriter("off_test.off", 0, "chan1", 1, 100, 200, 9.6e-6, projectors, basis, "dummy model for testing", whitener,
 		"DastardVersion Placeholder", "GitHash Placeholder", "SourceName Placeholder", TimeDivisionMultiplexingInfo{})
+	if w.FileFormatVersion != "0.1.0" || w.RecordFlags || w.DriftCorrection {
+		t.Errorf("FileFormatVersion=%q, RecordFlags=%t, DriftCorrection=%t, want 0.1.0 with neither",
+			w.FileFormatVersion, w.RecordFlags, w.DriftCorrection)
+	}
+	if w.MaxSamples != 200 || w.MaxPresamples != 100 {
+		t.Errorf("MaxSamples, MaxPresamples = %v, %v, want 200, 100", w.MaxSamples, w.MaxPresamples)
+	}
+	if w.ModelInfo.NoiseWhitener.Rows != 2 || w.ModelInfo.NoiseWhitener.Cols != nsamples {
+		t.Errorf("NoiseWhitener has size %vx%v, want 2x%v", w.ModelInfo.NoiseWhitener.Rows,
+			w.ModelInfo.NoiseWhitener.Cols, nsamples)
+	}
 	if err := w.CreateFile(); err != nil {
 		t.Fatal(err)
 	}
@@ -49,7 +69,7 @@ func TestOff(t *testing.T) {
 	w.Flush()
 	stat, _ := os.Stat("off_test.off")
 	sizeHeader := stat.Size()
-	if err := w.WriteRecord(0, 0, 0, 0, 0, 0, make([]float32, 3)); err != nil {
+	if err := w.WriteRecord(0, 0, 0, 0, 0, 0, 1, make([]float32, 3)); err != nil {
 		t.Error(err)
 	}
 	w.Flush()
@@ -61,7 +81,7 @@ func TestOff(t *testing.T) {
 	if w.recordsWritten != 1 {
 		t.Error("wrong number of records written, want 1, have", w.recordsWritten)
 	}
-	if err := w.WriteRecord(0, 0, 0, 0, 0, 0, make([]float32, 10)); err == nil {
+	if err := w.WriteRecord(0, 0, 0, 0, 0, 0, 1, make([]float32, 10)); err == nil {
 		t.Error("should have complained about wrong number of bases")
 	}
 	w.Close()
@@ -72,3 +92,274 @@ func TestOff(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestOffDriftCorrection(t *testing.T) {
+	projectors := mat.NewDense(2, 4, []float64{1, 0, 0, 0, 0, 1, 0, 0})
+	basis := mat.NewDense(4, 2, []float64{1, 0, 0, 1, 0, 0, 0, 0})
+	w := NewWriter("off_drift_test.off", 0, "chan1", 1, 2, 4, 9.6e-6, projectors, basis, "drift test model", nil,
+		"DastardVersion Placeholder", "GitHash Placeholder", "SourceName Placeholder", TimeDivisionMultiplexingInfo{})
+	defer os.Remove("off_drift_test.off")
+	if w.RecordSize() != 32+4*2 {
+		t.Errorf("RecordSize()=%d without drift correction, want %d", w.RecordSize(), 32+4*2)
+	}
+	if err := w.EnableDriftCorrection(); err != nil {
+		t.Fatal(err)
+	}
+	if w.FileFormatVersion != "0.2.0" {
+		t.Errorf("FileFormatVersion=%q, want 0.2.0", w.FileFormatVersion)
+	}
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.EnableDriftCorrection(); err == nil {
+		t.Error("EnableDriftCorrection should fail after the header is written")
+	}
+	w.Flush()
+	stat, _ := os.Stat("off_drift_test.off")
+	sizeHeader := stat.Size()
+	if err := w.WriteRecord(4, 2, 0, 0, 0, 1, 0.75, []float32{3, 4}); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+	contents, err := ioutil.ReadFile("off_drift_test.off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(contents)) != sizeHeader+int64(w.RecordSize()) || w.RecordSize() != 36+4*2 {
+		t.Fatalf("file has %d bytes and RecordSize()=%d, want %d and %d", len(contents),
+			w.RecordSize(), sizeHeader+36+4*2, 36+4*2)
+	}
+	var header Writer
+	if err := json.Unmarshal(contents[:sizeHeader], &header); err != nil || !header.DriftCorrection {
+		t.Errorf("header DriftCorrection=%t (%v), want true", header.DriftCorrection, err)
+	}
+	record := contents[sizeHeader:]
+	drift := math.Float32frombits(binary.LittleEndian.Uint32(record[32:]))
+	coef := math.Float32frombits(binary.LittleEndian.Uint32(record[36:]))
+	if drift != 0.75 || coef != 3 {
+		t.Errorf("record has driftCorrection %v and first coefficient %v, want 0.75 and 3", drift, coef)
+	}
+}
+
+func TestOffRawSamples(t *testing.T) {
+	projectors := mat.NewDense(2, 4, []float64{1, 0, 0, 0, 0, 1, 0, 0})
+	basis := mat.NewDense(4, 2, []float64{1, 0, 0, 1, 0, 0, 0, 0})
+	w := NewWriter("off_raw_test.off", 0, "chan1", 1, 2, 4, 9.6e-6, projectors, basis, "raw test model", nil,
+		"DastardVersion Placeholder", "GitHash Placeholder", "SourceName Placeholder", TimeDivisionMultiplexingInfo{})
+	defer os.Remove("off_raw_test.off")
+	if w.WantsRawSamples(float32(math.NaN())) {
+		t.Error("WantsRawSamples should be false without a RawSamplesThreshold")
+	}
+	if err := w.SetRawSamplesThreshold(5); err != nil {
+		t.Fatal(err)
+	}
+	if w.FileFormatVersion != "0.3.0" || !w.RecordFlags {
+		t.Errorf("FileFormatVersion=%q with RecordFlags=%t, want 0.3.0 and true", w.FileFormatVersion, w.RecordFlags)
+	}
+	for _, test := range []struct {
+		residual float32
+		want     bool
+	}{{1, false}, {5, false}, {5.5, true}, {float32(math.NaN()), true}} {
+		if got := w.WantsRawSamples(test.residual); got != test.want {
+			t.Errorf("WantsRawSamples(%v)=%t, want %t", test.residual, got, test.want)
+		}
+	}
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetRawSamplesThreshold(0); err == nil {
+		t.Error("SetRawSamplesThreshold should fail after the header is written")
+	}
+	w.Flush()
+	stat, _ := os.Stat("off_raw_test.off")
+	sizeHeader := stat.Size()
+	coefs := make([]float32, 2)
+	if err := w.WriteRecord(4, 2, 0, 0, 0, 1, 1, coefs); err != nil {
+		t.Error(err)
+	}
+	if err := w.WriteFlaggedRecord(4, 2, 1, 1, 0, 9, 1, coefs, FlagPileup, []uint16{1, 2, 3, 4}); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+	contents, err := ioutil.ReadFile("off_raw_test.off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSize := int64(36 + 4*2)
+	if expectSize := sizeHeader + 2*recordSize + 4 + 2*4; int64(len(contents)) != expectSize {
+		t.Fatalf("wrong size, want %v, have %v", expectSize, len(contents))
+	}
+	records := contents[sizeHeader:]
+	flags1 := binary.LittleEndian.Uint32(records[recordSize-4:])
+	flags2 := binary.LittleEndian.Uint32(records[2*recordSize-4:])
+	nRaw := binary.LittleEndian.Uint32(records[2*recordSize:])
+	if flags1 != 0 || flags2 != FlagPileup|FlagRawSamples || nRaw != 4 {
+		t.Errorf("record flags %x and %x with %d raw samples, want 0 and %x with 4",
+			flags1, flags2, nRaw, FlagPileup|FlagRawSamples)
+	}
+
+	w2 := NewWriter("off_raw_test2.off", 0, "chan1", 1, 2, 4, 9.6e-6, projectors, basis, "raw test model", nil,
+		"DastardVersion Placeholder", "GitHash Placeholder", "SourceName Placeholder", TimeDivisionMultiplexingInfo{})
+	if err := w2.WriteFlaggedRecord(4, 2, 1, 1, 0, 9, 1, coefs, 0, []uint16{1, 2, 3, 4}); err == nil {
+		t.Error("WriteFlaggedRecord should fail without a RawSamplesThreshold")
+	}
+}
+
+func TestOffExtensions(t *testing.T) {
+	projectors := mat.NewDense(2, 4, []float64{1, 0, 0, 0, 0, 1, 0, 0})
+	basis := mat.NewDense(4, 2, []float64{1, 0, 0, 1, 0, 0, 0, 0})
+	w := NewWriter("off_ext_test.off", 0, "chan1", 1, 2, 4, 9.6e-6, projectors, basis, "extension test model", nil,
+		"DastardVersion Placeholder", "GitHash Placeholder", "SourceName Placeholder", TimeDivisionMultiplexingInfo{})
+	defer os.Remove("off_ext_test.off")
+	calTag, err := w.RegisterExtension("calibrationVersion", "uint32", "version of the energy calibration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	energyTag, _ := w.RegisterExtension("energy", "float32", "calibrated energy (eV)")
+	if calTag != 1 || energyTag != 2 || w.FileFormatVersion != "0.4.0" {
+		t.Errorf("tags %d and %d, version %q, want 1, 2, and 0.4.0", calTag, energyTag, w.FileFormatVersion)
+	}
+	if _, err := w.RegisterExtension("energy", "float32", ""); err == nil {
+		t.Error("RegisterExtension should fail for a name already registered")
+	}
+	if tag, ok := w.ExtensionTag("energy"); !ok || tag != energyTag {
+		t.Errorf("ExtensionTag(energy)=%d, %t, want %d, true", tag, ok, energyTag)
+	}
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.RegisterExtension("late", "uint32", ""); err == nil {
+		t.Error("RegisterExtension should fail after the header is written")
+	}
+	w.Flush()
+	stat, _ := os.Stat("off_ext_test.off")
+	sizeHeader := stat.Size()
+	coefs := make([]float32, 2)
+	fields := []Extension{Uint32Extension(calTag, 7), Float32Extension(energyTag, 5898.75)}
+	if err := w.WriteExtendedRecord(4, 2, 0, 0, 0, 1, 1, coefs, FlagExtensions, nil, nil); err != nil {
+		t.Error(err)
+	}
+	if err := w.WriteExtendedRecord(4, 2, 1, 1, 0, 1, 1, coefs, FlagPileup, nil, fields); err != nil {
+		t.Error(err)
+	}
+	if err := w.WriteExtendedRecord(4, 2, 2, 2, 0, 1, 1, coefs, 0, nil, []Extension{{Tag: 3}}); err == nil {
+		t.Error("WriteExtendedRecord should fail for an unregistered tag")
+	}
+	w.Close()
+	contents, err := ioutil.ReadFile("off_ext_test.off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSize := int64(36 + 4*2)
+	areaSize := 2*4 + 4 + 4
+	if expectSize := sizeHeader + 2*recordSize + 2 + int64(areaSize); int64(len(contents)) != expectSize {
+		t.Fatalf("wrong size, want %v, have %v", expectSize, len(contents))
+	}
+	records := contents[sizeHeader:]
+	flags1 := binary.LittleEndian.Uint32(records[recordSize-4:])
+	flags2 := binary.LittleEndian.Uint32(records[2*recordSize-4:])
+	if flags1 != 0 || flags2 != FlagPileup|FlagExtensions {
+		t.Errorf("record flags %x and %x, want 0 and %x", flags1, flags2, FlagPileup|FlagExtensions)
+	}
+	area := records[2*recordSize:]
+	if n := binary.LittleEndian.Uint16(area); int(n) != areaSize {
+		t.Errorf("extension area has size %d, want %d", n, areaSize)
+	}
+	got, err := ParseExtensions(area[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Tag != calTag || binary.LittleEndian.Uint32(got[0].Value) != 7 ||
+		got[1].Tag != energyTag || math.Float32frombits(binary.LittleEndian.Uint32(got[1].Value)) != 5898.75 {
+		t.Errorf("ParseExtensions gives %v", got)
+	}
+	if _, err := ParseExtensions(area[2:9]); err == nil {
+		t.Error("ParseExtensions should fail for a truncated area")
+	}
+}
+
+func TestOffModelVersions(t *testing.T) {
+	projectors := mat.NewDense(2, 4, []float64{1, 0, 0, 0, 0, 1, 0, 0})
+	basis := mat.NewDense(4, 2, []float64{1, 0, 0, 1, 0, 0, 0, 0})
+	projectors2 := mat.NewDense(2, 4, []float64{0.5, 0.5, 0, 0, 0, 0.5, 0.5, 0})
+	w := NewWriter("off_versions_test.off", 0, "chan1", 1, 2, 4, 9.6e-6, projectors, basis, "first model", nil,
+		"DastardVersion Placeholder", "GitHash Placeholder", "SourceName Placeholder", TimeDivisionMultiplexingInfo{})
+	defer os.Remove("off_versions_test.off")
+	if _, err := w.AddModelVersion(projectors2, basis, "no room", nil); err == nil {
+		t.Error("AddModelVersion should fail without ReserveModelVersions")
+	}
+	if _, ok := w.ModelVersionField(0); ok {
+		t.Error("ModelVersionField should fail without ReserveModelVersions")
+	}
+	if err := w.ReserveModelVersions(2); err != nil {
+		t.Fatal(err)
+	}
+	if w.FileFormatVersion != "0.5.0" || w.ModelVersionsFree() != 2 {
+		t.Errorf("version %q with %d free models, want 0.5.0 and 2", w.FileFormatVersion, w.ModelVersionsFree())
+	}
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	coefs := make([]float32, 2)
+	field, ok := w.ModelVersionField(0)
+	if !ok {
+		t.Fatal("ModelVersionField should succeed after ReserveModelVersions")
+	}
+	if err := w.WriteExtendedRecord(4, 2, 0, 0, 0, 1, 1, coefs, 0, nil, []Extension{field}); err != nil {
+		t.Error(err)
+	}
+	if _, err := w.AddModelVersion(mat.NewDense(1, 4, nil), mat.NewDense(4, 1, nil), "wrong size", nil); err == nil {
+		t.Error("AddModelVersion should fail for a model with the wrong number of bases")
+	}
+	big := mat.NewDense(400, 4, make([]float64, 1600))
+	if _, err := w.AddModelVersion(projectors2, basis, "model with a big whitener", big); err == nil {
+		t.Error("AddModelVersion should fail for a model that doesn't fit the header")
+	}
+	version, err := w.AddModelVersion(projectors2, basis, "second model", nil)
+	if err != nil || version != 1 {
+		t.Fatalf("AddModelVersion returns %d, %v, want 1, nil", version, err)
+	}
+	field, _ = w.ModelVersionField(version)
+	if err := w.WriteExtendedRecord(4, 2, 1, 1, 0, 1, 1, coefs, 0, nil, []Extension{field}); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+
+	contents, err := ioutil.ReadFile("off_versions_test.off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := bytes.Index(contents, []byte("\n}\n")) + 3
+	if n < 3 || n != w.headerSize+1 {
+		t.Fatalf("header ends at %d, want %d", n, w.headerSize+1)
+	}
+	var header Writer
+	if err := json.Unmarshal(contents[:n], &header); err != nil {
+		t.Fatalf("rewritten header is not valid JSON: %v", err)
+	}
+	if len(header.ModelVersions) != 1 || header.ModelVersions[0].Description != "second model" {
+		t.Errorf("header ModelVersions = %v, want the second model", header.ModelVersions)
+	}
+	recordSize := 36 + 4*2 + 2 + 4 + 4
+	if len(contents) != n+2*recordSize {
+		t.Fatalf("file has %d bytes, want %d", len(contents), n+2*recordSize)
+	}
+	for i := 0; i < 2; i++ {
+		fields, err := ParseExtensions(contents[n+i*recordSize+46 : n+(i+1)*recordSize])
+		if err != nil || len(fields) != 1 || binary.LittleEndian.Uint32(fields[0].Value) != uint32(i) {
+			t.Errorf("record %d has extension fields %v, %v, want model version %d", i, fields, err, i)
+		}
+	}
+}
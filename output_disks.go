@@ -0,0 +1,95 @@
+package dastard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ways to assign channels to the output disks of a run (WriteControlConfig.DiskAssignment).
+const (
+	diskByChannel = "channel" // round-robin by channel index (the default)
+	diskByColumn  = "column"  // round-robin by TDM readout column, so each column's channels share a disk
+	diskByBlock   = "block"   // contiguous, equal blocks of channel indices
+)
+
+// channelDisks returns the index of the output disk of each of nchan channels: channels[i]
+// if that is not empty, otherwise as set by assignment. Disk 0 is WriteControlConfig.Path;
+// disk k>0 is ExtraPaths[k-1].
+func channelDisks(assignment string, channels []int, ndisks, nchan int, rowColCodes []RowColCode) ([]int, error) {
+	disks := make([]int, nchan)
+	if len(channels) > 0 {
+		if len(channels) != nchan {
+			return nil, fmt.Errorf("ChannelDisks has %d entries, want one per channel (%d)", len(channels), nchan)
+		}
+		for i, d := range channels {
+			if d < 0 || d >= ndisks {
+				return nil, fmt.Errorf("ChannelDisks[%d]=%d, need [0,%d)", i, d, ndisks)
+			}
+		}
+		copy(disks, channels)
+		return disks, nil
+	}
+	switch strings.ToLower(assignment) {
+	case "", diskByChannel:
+		for i := range disks {
+			disks[i] = i % ndisks
+		}
+	case diskByColumn:
+		// Only a TDM source gives each channel a readout column. For any other source,
+		// each channel is a column of its own, as it is for diskByChannel.
+		for i := range disks {
+			if len(rowColCodes) == nchan && rowColCodes[i].cols() > 0 {
+				disks[i] = rowColCodes[i].col() % ndisks
+			} else {
+				disks[i] = i % ndisks
+			}
+		}
+	case diskByBlock:
+		for i := range disks {
+			disks[i] = i * ndisks / nchan
+		}
+	default:
+		return nil, fmt.Errorf("DiskAssignment=%q, need one of (%q, %q, %q)", assignment,
+			diskByChannel, diskByColumn, diskByBlock)
+	}
+	return disks, nil
+}
+
+// diskPatterns returns the filename pattern of a run on each output disk. The first is
+// pattern, the run's pattern in basepath; on each of extraPaths, the run gets a directory
+// of the same name, which must not exist already. If any cannot be made, those already
+// made on the other extra disks are removed.
+func diskPatterns(pattern, basepath string, extraPaths []string) ([]string, error) {
+	rel, err := filepath.Rel(basepath, pattern)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("run pattern %s is not in base path %s", pattern, basepath)
+	}
+	patterns := []string{pattern}
+	for _, extra := range extraPaths {
+		if err := makeExtraRunDirectory(extra, rel); err != nil {
+			for _, p := range patterns[1:] {
+				os.Remove(filepath.Dir(p))
+			}
+			return nil, err
+		}
+		patterns = append(patterns, filepath.Join(extra, rel))
+	}
+	return patterns, nil
+}
+
+// makeExtraRunDirectory makes the directory of the run pattern rel on the extra disk.
+func makeExtraRunDirectory(extra, rel string) error {
+	if len(extra) == 0 {
+		return fmt.Errorf("an ExtraPaths entry is the empty string")
+	}
+	runDir := filepath.Join(extra, filepath.Dir(rel))
+	if err := os.MkdirAll(filepath.Dir(runDir), 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(runDir, 0755); err != nil {
+		return fmt.Errorf("could not make run directory on an extra disk: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChannelDisks(t *testing.T) {
+	nchan := 6
+	codes := make([]RowColCode, nchan)
+	for i := range codes {
+		codes[i] = rcCode(i/3, i%3, 2, 3)
+	}
+	tests := []struct {
+		assignment string
+		channels   []int
+		ndisks     int
+		want       []int
+	}{
+		{"", nil, 1, []int{0, 0, 0, 0, 0, 0}},
+		{"channel", nil, 4, []int{0, 1, 2, 3, 0, 1}},
+		{"Column", nil, 2, []int{0, 1, 0, 0, 1, 0}},
+		{"block", nil, 2, []int{0, 0, 0, 1, 1, 1}},
+		{"column", []int{1, 1, 0, 0, 1, 0}, 2, []int{1, 1, 0, 0, 1, 0}},
+	}
+	for _, test := range tests {
+		disks, err := channelDisks(test.assignment, test.channels, test.ndisks, nchan, codes)
+		if err != nil {
+			t.Errorf("channelDisks(%q, %v, %d) failed: %v", test.assignment, test.channels, test.ndisks, err)
+			continue
+		}
+		for i, d := range disks {
+			if d != test.want[i] {
+				t.Errorf("channelDisks(%q, %v, %d) = %v, want %v", test.assignment, test.channels, test.ndisks,
+					disks, test.want)
+				break
+			}
+		}
+	}
+	// A source without TDM columns has its channels spread as for "channel".
+	for _, noCodes := range [][]RowColCode{nil, make([]RowColCode, nchan)} {
+		disks, err := channelDisks("column", nil, 2, nchan, noCodes)
+		if err != nil || disks[1] != 1 || disks[4] != 0 || disks[5] != 1 {
+			t.Errorf("channelDisks(\"column\") without TDM columns = %v, %v, want [0 1 0 1 0 1]", disks, err)
+		}
+	}
+	if _, err := channelDisks("diagonal", nil, 2, nchan, codes); err == nil {
+		t.Error("channelDisks with an unknown assignment should fail")
+	}
+	if _, err := channelDisks("", []int{0, 1}, 2, nchan, codes); err == nil {
+		t.Error("channelDisks with too few ChannelDisks should fail")
+	}
+	if _, err := channelDisks("", []int{0, 1, 2, 0, 1, 0}, 2, nchan, codes); err == nil {
+		t.Error("channelDisks with a ChannelDisks out of range should fail")
+	}
+}
+
+func TestWritingMultipleDisks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_disks_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	disks := []string{filepath.Join(tmp, "disk0"), filepath.Join(tmp, "disk1"), filepath.Join(tmp, "disk2")}
+
+	ds := AnySource{nchan: 4}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	config := &WriteControlConfig{Request: "Start", Path: disks[0], ExtraPaths: disks[1:], WriteLJH22: true}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl Start with ExtraPaths failed: %v", err)
+	}
+	if len(ds.writingState.DiskPatterns) != len(disks) {
+		t.Fatalf("WritingState.DiskPatterns = %v, want one per disk", ds.writingState.DiskPatterns)
+	}
+	for i, dsp := range ds.processors {
+		disk := disks[i%len(disks)]
+		if filename := dsp.DataPublisher.LJH22.FileName; !strings.HasPrefix(filename, disk+"/") {
+			t.Errorf("channel %d writes %s, want a file on %s", i, filename, disk)
+		}
+		if info, err := os.Stat(filepath.Dir(dsp.DataPublisher.LJH22.FileName)); err != nil || !info.IsDir() {
+			t.Errorf("channel %d run directory is missing: %v", i, err)
+		}
+	}
+	if md := ds.writingState.metadata; md == nil || len(md.DiskPatterns) != len(disks) || len(md.ChannelDisks) != ds.nchan {
+		t.Errorf("run metadata should list the disk patterns and each channel's disk")
+	}
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Errorf("WriteControl Stop failed: %v", err)
+	}
+	if ds.writingState.DiskPatterns != nil {
+		t.Errorf("WritingState.DiskPatterns = %v after Stop, want nil", ds.writingState.DiskPatterns)
+	}
+
+	// A run directory that cannot be made on a later disk leaves none behind on the others.
+	runDirs := func() []string {
+		var dirs []string
+		for _, disk := range disks[:2] {
+			d, _ := filepath.Glob(filepath.Join(disk, "*", "*"))
+			dirs = append(dirs, d...)
+		}
+		return dirs
+	}
+	blocked := filepath.Join(tmp, "blocked")
+	if err := ioutil.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := runDirs()
+	config = &WriteControlConfig{Request: "Start", Path: disks[0], ExtraPaths: []string{disks[1], blocked},
+		WriteLJH22: true}
+	if err := ds.WriteControl(config); err == nil {
+		t.Error("WriteControl Start with an extra disk that is a file should fail")
+	}
+	if after := runDirs(); len(after) != len(before) {
+		t.Errorf("a failed Start left run directories %v, want only %v", after, before)
+	}
+
+	config = &WriteControlConfig{Request: "Start", Path: disks[0], ExtraPaths: []string{""}, WriteLJH22: true}
+	if err := ds.WriteControl(config); err == nil {
+		t.Error("WriteControl Start with an empty ExtraPaths entry should fail")
+	}
+	config.ExtraPaths = disks[1:2]
+	config.DiskAssignment = "nosuch"
+	if err := ds.WriteControl(config); err == nil {
+		t.Error("WriteControl Start with an unknown DiskAssignment should fail")
+	}
+}
@@ -0,0 +1,43 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+)
+
+// PileupState sets when the DSP flags a record as likely pileup (or another pulse that
+// the projectors model poorly): its residualStdDev exceeds PileupThreshold. Flagged
+// records are still published and written, with the flag in their summary and OFF
+// record. Records without a residual (no projectors, or variable length) are never
+// flagged.
+type PileupState struct {
+	PileupThreshold float64 // flag records with a larger residualStdDev; 0 flags none
+}
+
+// PileupFlagConfig is the RPC-usable structure for ConfigurePileupFlag.
+type PileupFlagConfig struct {
+	ChannelIndices    []int
+	ChannelGroups     []string // named channel groups, added to the ChannelIndices
+	ResidualThreshold float64  // 0 turns off the flag
+}
+
+// validate checks the config for errors.
+func (config *PileupFlagConfig) validate() error {
+	if len(config.ChannelIndices) == 0 {
+		return fmt.Errorf("PileupFlagConfig has no ChannelIndices")
+	}
+	if config.ResidualThreshold < 0 || math.IsNaN(config.ResidualThreshold) {
+		return fmt.Errorf("pileup flag ResidualThreshold=%v, need >= 0", config.ResidualThreshold)
+	}
+	return nil
+}
+
+// ConfigurePileupFlag sets this stream's pileup threshold.
+func (dsp *DataStreamProcessor) ConfigurePileupFlag(config *PileupFlagConfig) {
+	dsp.PileupThreshold = config.ResidualThreshold
+}
+
+// isPileup returns whether a record with the given residualStdDev is flagged.
+func (ps *PileupState) isPileup(residualStdDev float64) bool {
+	return ps.PileupThreshold > 0 && residualStdDev > ps.PileupThreshold
+}
@@ -0,0 +1,60 @@
+package dastard
+
+import (
+	"math"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestPileupFlag(t *testing.T) {
+	dsp := &DataStreamProcessor{NPresamples: 1, NSamples: 4}
+	projectors := mat.NewDense(1, 4, []float64{1, 0, 0, 0})
+	basis := mat.NewDense(4, 1, []float64{1, 0, 0, 0})
+	if err := dsp.SetProjectorsBasis(*projectors, *basis, "test model"); err != nil {
+		t.Fatal(err)
+	}
+	clean := &DataRecord{data: []RawType{1, 1, 1, 1}, presamples: 1}
+	piled := &DataRecord{data: []RawType{1, 2, 3, 4}, presamples: 1} // residualStdDev 1.479
+	long := &DataRecord{data: []RawType{1, 2, 3, 4, 50, 60}, presamples: 1}
+	records := []*DataRecord{clean, piled, long}
+
+	dsp.AnalyzeData(records)
+	for i, rec := range records {
+		if rec.pileup {
+			t.Errorf("record %d flagged as pileup with no threshold", i)
+		}
+	}
+
+	config := PileupFlagConfig{ChannelIndices: []int{0}, ResidualThreshold: 1.0}
+	if err := config.validate(); err != nil {
+		t.Error(err)
+	}
+	dsp.ConfigurePileupFlag(&config)
+	dsp.AnalyzeData(records)
+	if clean.pileup || !piled.pileup {
+		t.Errorf("pileup flags are %t, %t with threshold %v (residuals %v, %v), want false, true",
+			clean.pileup, piled.pileup, config.ResidualThreshold, clean.residualStdDev, piled.residualStdDev)
+	}
+	if !math.IsNaN(long.residualStdDev) || long.pileup {
+		t.Errorf("variable-length record has residual %v and pileup=%t, want NaN and false",
+			long.residualStdDev, long.pileup)
+	}
+
+	config.ResidualThreshold = 2.0
+	dsp.ConfigurePileupFlag(&config)
+	dsp.AnalyzeData(records)
+	if piled.pileup {
+		t.Errorf("record with residual %v flagged as pileup with threshold 2", piled.residualStdDev)
+	}
+
+	for _, bad := range []PileupFlagConfig{
+		{ChannelIndices: []int{}, ResidualThreshold: 1},
+		{ChannelIndices: []int{0}, ResidualThreshold: -1},
+		{ChannelIndices: []int{0}, ResidualThreshold: math.NaN()},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("PileupFlagConfig %+v should fail validation", bad)
+		}
+	}
+}
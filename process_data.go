@@ -3,6 +3,7 @@ package dastard
 import (
 	"fmt"
 	"math"
+	"sort"
 	"time"
 
 	"gonum.org/v1/gonum/mat"
@@ -16,19 +17,55 @@ type DataStreamProcessor struct {
 	NSamples             int
 	NPresamples          int
 	SampleRate           float64
+	rowOffset            time.Duration // added to record times: when this channel's TDM row is sampled in its frame
 	LastTrigger          FrameIndex
 	LastEdgeMultiTrigger FrameIndex
+	manualTriggerPending bool                  // produce one record at the next opportunity
+	stateTriggerFrames   []FrameIndex          // experiment state transitions still waiting for their records
+	stimulus             stimulusTriggers      // forced records of a stimulus window still to be made
+	idleFillRate         float64               // smoothed rate of non-auto triggers (per second), for AutoIdleFill
+	idleFillSeen         int                   // stream.samplesSeen when idleFillRate was last updated
+	autoLevel            *autoLevelMeasurement // pending request to set trigger levels from noise
+	autoLevelDone        bool                  // trigger levels were just set from noise
+	disabled             bool                  // skip all processing (triggering, publishing, writing)
+	neverTrigger         bool                  // on the dead-channel list: find no primary triggers
+	quality              *qualityStats         // statistics of records for the run summary, while writing
+	deadTime             deadTimeStats         // live and dead time of primary triggering
+	gaps                 gapStats              // frames missing from the data, and how many were filled
+	storm                triggerStormBreaker   // turns off triggers whose rate stays too high
+	stormEvent           *TriggerStormEvent    // the storm breaker just tripped
+	deadDetect           deadChannelDetector   // flags the channel if its raw data RMS stays out of bounds
+	deadEvent            *DeadChannelEvent     // the dead-channel detector just flagged or cleared the channel
+	triggerKernel        []float64             // FIR filter applied to the trigger samples, or nil
+	autoStagger          bool                  // auto triggers fall on a grid offset by autoPhase
+	autoPhase            float64               // this channel's offset of auto triggers, as a fraction of the delay
+	filteredTriggerData  bool                  // the stream's filteredData came from its triggerData, not rawData
+	pendingSecondaries   []groupTrigger        // group triggers waiting for samples not yet received
+	conditionFired       []FrameIndex          // frame of each trigger condition's last firing in earlier segments
+	secondaryHistory     []RawType             // samples just before the stream, for group triggers with negative offsets
+	secondaryHistoryEnd  FrameIndex            // frame number just after the secondaryHistory
+	recentData           triggerHistory        // the last few seconds of samples, for PreviewTriggers and FetchRawSnapshot
+	undecimatedData      triggerHistory        // the same, before decimation, for FetchRawSnapshot; empty unless decimating
+	publishTime          time.Duration         // total time spent in PublishData, for RunBenchmark
 	stream               DataStream
 	projectors           mat.Dense
 	modelDescription     string
+	modelVersion         int // counts the models set by SetProjectorsBasis, so each record knows its model
 	// realtime analysis is disable if projectors .IsZero
 	// otherwise projectors must be size (nbases,NSamples)
 	// such that projectors*data (data as a column vector) = modelCoefs
 	basis mat.Dense
 	// if not projectors.IsZero basis must be size
 	// (NSamples, nbases) such that basis*modelCoefs = modeled_data
+	noiseWhitener mat.Dense
+	// noiseWhitener is optional; if not IsZero it must have NSamples columns,
+	// such that noiseWhitener*noise (noise as a column vector) is white
 	DecimateState
 	TriggerState
+	DriftTracker
+	EnergyCalibrator
+	VetoState
+	PileupState
 	DataPublisher
 }
 
@@ -37,6 +74,7 @@ type DataStreamProcessor struct {
 func (dsp *DataStreamProcessor) removeProjectorsBasis() {
 	dsp.projectors.Reset()
 	dsp.basis.Reset()
+	dsp.noiseWhitener.Reset()
 	var s string
 	dsp.modelDescription = s
 }
@@ -58,6 +96,22 @@ func (dsp *DataStreamProcessor) SetProjectorsBasis(projectors mat.Dense, basis m
 	dsp.projectors = projectors
 	dsp.basis = basis
 	dsp.modelDescription = modelDescription
+	dsp.modelVersion++
+	return nil
+}
+
+// SetNoiseWhitener sets .noiseWhitener, which is only stored in OFF file headers. An empty
+// whitener removes any existing one. Returns an error if the size is not right.
+func (dsp *DataStreamProcessor) SetNoiseWhitener(whitener mat.Dense) error {
+	if whitener.IsZero() {
+		dsp.noiseWhitener.Reset()
+		return nil
+	}
+	rows, cols := whitener.Dims()
+	if cols != dsp.NSamples {
+		return fmt.Errorf("noise whitener has wrong size, rows: %v, cols: %v, want cols: %v", rows, cols, dsp.NSamples)
+	}
+	dsp.noiseWhitener = whitener
 	return nil
 }
 
@@ -77,6 +131,7 @@ func NewDataStreamProcessor(channelIndex int, broker *TriggerBroker, NPresamples
 	dsp := DataStreamProcessor{channelIndex: channelIndex, Broker: broker,
 		stream: *stream, NSamples: NSamples, NPresamples: NPresamples,
 	}
+	dsp.stream.reserve(streamCapacity(NSamples))
 	dsp.LastTrigger = math.MinInt64 / 4 // far in the past, but not so far we can't subtract from it
 	dsp.projectors.Reset()              // dsp.projectors is set to zero value
 	dsp.basis.Reset()                   // dsp.basis is set to zero value
@@ -92,32 +147,155 @@ type DecimateState struct {
 }
 
 // ConfigurePulseLengths sets this stream's pulse length and # of presamples.
-// Also removes any existing projectors and basis.
+// Also removes any existing projectors and basis. Group triggers still waiting for
+// their samples are dropped, so no record is cut partly at the old lengths.
 func (dsp *DataStreamProcessor) ConfigurePulseLengths(nsamp, npre int) {
 	// if nsamp or npre is invalid, panic, do not silently ignore
 	if dsp.NSamples != nsamp || dsp.NPresamples != npre {
 		dsp.removeProjectorsBasis()
 		dsp.edgeMultiSetInitialState()
+		if n := len(dsp.pendingSecondaries); n > 0 {
+			logDebugf("channel %d drops %d pending group triggers on changing record lengths", dsp.channelIndex, n)
+			dsp.pendingSecondaries = nil
+		}
 	}
 	dsp.NSamples = nsamp
 	dsp.NPresamples = npre
+	dsp.stream.reserve(streamCapacity(nsamp))
+}
+
+// checkPulseLengths returns an error if this stream can't have records of nsamp samples,
+// npre of them before the trigger.
+func (dsp *DataStreamProcessor) checkPulseLengths(nsamp, npre int) error {
+	if !validPulseLengths(nsamp, npre) {
+		return fmt.Errorf("nsamp %v, npre %v are invalid", nsamp, npre)
+	}
+	if post := nsamp - npre; len(dsp.triggerKernel)/2 > post {
+		return fmt.Errorf("nsamp %v, npre %v leave %d samples after the trigger, too few for the %d-sample trigger filter",
+			nsamp, npre, post, len(dsp.triggerKernel))
+	}
+	return nil
+}
+
+// streamCapacity returns the number of samples to preallocate in the stream of a channel
+// with records of nsamp samples. The triggers keep up to 2 records' worth of samples
+// between segments (EdgeMulti does); twice that leaves room for segments to be appended.
+// The stream grows if segments are much longer than records.
+func streamCapacity(nsamp int) int {
+	return 4 * (nsamp + 1)
+}
+
+// decimatedSampleRate returns the rate (Hz) of samples in this stream's records.
+func (dsp *DataStreamProcessor) decimatedSampleRate() float64 {
+	if dsp.Decimate && dsp.DecimateLevel > 1 {
+		return dsp.SampleRate / float64(dsp.DecimateLevel)
+	}
+	return dsp.SampleRate
+}
+
+// samplesIn returns the number of record samples, to the nearest integer, that last ms milliseconds.
+func (dsp *DataStreamProcessor) samplesIn(ms float64) int {
+	return roundint(ms * 1e-3 * dsp.decimatedSampleRate())
 }
 
 // ConfigureTrigger sets this stream's trigger state.
 func (dsp *DataStreamProcessor) ConfigureTrigger(state TriggerState) {
 	dsp.TriggerState = state
 	dsp.edgeMultiSetInitialState()
+	dsp.conditionFired = nil
+	if !state.StateTrigger {
+		dsp.stateTriggerFrames = nil
+	}
 }
 
+// processSegment does all processing of one segment: decimating, triggering,
+// analysis, and publishing.
 func (dsp *DataStreamProcessor) processSegment(segment *DataSegment) {
+	records := dsp.processSegmentPrimary(segment)
+	dsp.processSegmentSecondary(records)
+	segment.processed = true
+}
+
+// processSegmentPrimary decimates the segment, appends it to the stream, and finds
+// the primary triggers. It returns without waiting for the group trigger broker.
+func (dsp *DataStreamProcessor) processSegmentPrimary(segment *DataSegment) []*DataRecord {
+	if !dsp.TriggerOnError {
+		segment.triggerData = nil
+	}
+	segment.signed = dsp.stream.signed // the source declares which channels are signed
+	dsp.keepUndecimatedData(segment)
 	dsp.DecimateData(segment)
+	dsp.checkDeadChannel(segment)
+	dsp.autoLevelCollect(segment)
+	dsp.recentData.add(segment, dsp.SampleRate)
 	dsp.stream.AppendSegment(segment)
-	records, _ := dsp.TriggerData()
-	dsp.AnalyzeData(records)                                       // add analysis results to records in-place
+	dsp.filterTriggerSamples()
+	return dsp.TriggerDataPrimary()
+}
+
+// processSegmentSecondary waits for the group trigger broker, then analyzes and
+// publishes the primary records. It must follow processSegmentPrimary.
+func (dsp *DataStreamProcessor) processSegmentSecondary(records []*DataRecord) {
+	if secondaries := dsp.TriggerDataSecondary(); len(secondaries) > 0 {
+		records = append(records, secondaries...)
+		sort.Sort(RecordSlice(records))
+	}
+	dsp.AnalyzeData(records) // add analysis results to records in-place
+	dsp.calibrateEnergies(records)
+	records = dsp.VetoRecords(records)
+	if dsp.quality != nil {
+		dsp.quality.add(records)
+	}
+	tPublish := time.Now()
 	if err := dsp.DataPublisher.PublishData(records); err != nil { // publish and save data, when enabled
 		panic(err)
 	}
-	segment.processed = true
+	dsp.publishTime += time.Since(tPublish)
+}
+
+// skipSegmentPrimary stands in for processSegmentPrimary in a disabled channel. The data
+// are ignored, but the group trigger broker still needs to hear from every channel.
+func (dsp *DataStreamProcessor) skipSegmentPrimary(segment *DataSegment) {
+	nframes := len(segment.rawData) * segment.framesPerSample
+	dsp.deadTime.skip(segment.firstFramenum + FrameIndex(nframes))
+	dsp.Broker.PrimaryTrigs <- triggerList{
+		channelIndex:                  dsp.channelIndex,
+		framePeriod:                   segment.framePeriod,
+		framesPerSample:               segment.framesPerSample,
+		keyFrame:                      segment.firstFramenum,
+		keyTime:                       segment.firstTime,
+		sampleRate:                    dsp.SampleRate,
+		lastFrameThatWillNeverTrigger: segment.firstFramenum + FrameIndex(nframes),
+	}
+}
+
+// skipSegmentSecondary stands in for processSegmentSecondary in a disabled channel,
+// discarding any secondary triggers.
+func (dsp *DataStreamProcessor) skipSegmentSecondary() {
+	<-dsp.Broker.SecondaryTrigs[dsp.channelIndex]
+	dsp.pendingSecondaries = nil
+}
+
+// setDisabled disables or re-enables all processing of this channel. The stream is
+// emptied either way, so triggering resumes cleanly at the next segment.
+func (dsp *DataStreamProcessor) setDisabled(disable bool) {
+	if dsp.disabled != disable {
+		dsp.resetStream()
+	}
+	dsp.disabled = disable
+}
+
+// keepUndecimatedData adds the segment's raw samples to the undecimatedData history, if
+// they are about to be decimated (which overwrites them). Otherwise the recentData hold
+// the same samples, so the undecimatedData are emptied.
+func (dsp *DataStreamProcessor) keepUndecimatedData(segment *DataSegment) {
+	if !dsp.Decimate || dsp.DecimateLevel <= 1 {
+		dsp.undecimatedData.rawData = nil
+		return
+	}
+	raw := *segment
+	raw.triggerData = nil
+	dsp.undecimatedData.add(&raw, dsp.SampleRate)
 }
 
 // DecimateData decimates data in-place.
@@ -125,13 +303,21 @@ func (dsp *DataStreamProcessor) DecimateData(segment *DataSegment) {
 	if !dsp.Decimate || dsp.DecimateLevel <= 1 {
 		return
 	}
-	data := segment.rawData
+	segment.rawData = dsp.decimate(segment.rawData, segment.signed)
+	if segment.triggerData != nil {
+		segment.triggerData = dsp.decimate(segment.triggerData, segment.triggerSigned)
+	}
+	segment.framesPerSample *= dsp.DecimateLevel
+}
+
+// decimate decimates data in-place, and returns the shortened slice.
+func (dsp *DataStreamProcessor) decimate(data []RawType, signed bool) []RawType {
 	Nin := len(data)
 	Nout := (Nin - 1 + dsp.DecimateLevel) / dsp.DecimateLevel
 	if dsp.DecimateAvgMode {
 		level := dsp.DecimateLevel
 		cdata := make([]float64, Nout)
-		if segment.signed {
+		if signed {
 			for i := 0; i < Nin; i++ {
 				j := i / level
 				cdata[j] += float64(int16(data[i]))
@@ -147,7 +333,7 @@ func (dsp *DataStreamProcessor) DecimateData(segment *DataSegment) {
 			cdata[Nout-1] *= float64(level) / float64(extra)
 		}
 
-		if segment.signed {
+		if signed {
 			for i := 0; i < Nout; i++ {
 				// Trick for rounding to int16: don't let any numbers be negative
 				// because float->int is a truncation operation. If we remove the
@@ -167,9 +353,7 @@ func (dsp *DataStreamProcessor) DecimateData(segment *DataSegment) {
 			data[i] = data[i*dsp.DecimateLevel]
 		}
 	}
-	segment.rawData = data[:Nout]
-	segment.framesPerSample *= dsp.DecimateLevel
-	return
+	return data[:Nout]
 }
 
 // AnalyzeData computes pulse-analysis values in-place for all elements of a
@@ -197,6 +381,21 @@ func (dsp *DataStreamProcessor) AnalyzeData(records []*DataRecord) {
 		ptm := val / float64(rec.presamples)
 		rec.pretrigMean = ptm
 
+		// Pretrigger rms about the mean, and least-squares slope (arbs per sample)
+		var ssq, sxy float64
+		xmean := 0.5 * float64(rec.presamples-1)
+		for i := 0; i < rec.presamples; i++ {
+			dy := dataVec.AtVec(i) - ptm
+			ssq += dy * dy
+			sxy += (float64(i) - xmean) * dy
+		}
+		rec.pretrigRMS = math.Sqrt(ssq / float64(rec.presamples))
+		if rec.presamples > 1 {
+			n := float64(rec.presamples)
+			sxx := n * (n*n - 1) / 12 // sum of (i-xmean)^2 for i in [0,n)
+			rec.pretrigSlope = sxy / sxx
+		}
+
 		max := ptm
 		var sum, sum2 float64
 		for i := rec.presamples; i < len(rec.data); i++ {
@@ -216,8 +415,14 @@ func (dsp *DataStreamProcessor) AnalyzeData(records []*DataRecord) {
 		if dsp.HasProjectors() {
 			rows, cols := dsp.projectors.Dims()
 			nbases := rows
+			rec.modelVersion = dsp.modelVersion
 			if cols != len(rec.data) {
-				panic("projections for variable length records not implemented")
+				// Variable-length records can't be projected; give them zero model
+				// coefficients and a NaN residual so they're easy to cut.
+				rec.modelCoefs = make([]float64, nbases)
+				rec.residualStdDev = math.NaN()
+				rec.driftCorrection = dsp.trackDrift(rec)
+				continue
 			}
 			projectors := &dsp.projectors
 			basis := &dsp.basis
@@ -234,7 +439,9 @@ func (dsp *DataStreamProcessor) AnalyzeData(records []*DataRecord) {
 			residualSlice := make([]float64, len(rec.data))
 			mat.Col(residualSlice, 0, &residual)
 			rec.residualStdDev = stdDev(residualSlice)
+			rec.pileup = dsp.isPileup(rec.residualStdDev)
 		}
+		rec.driftCorrection = dsp.trackDrift(rec)
 	}
 }
 
@@ -115,6 +115,16 @@ func TestAnalyzeRealtimeBases(t *testing.T) {
 		PTM:            1.0, Avg: 2.0, Max: 3.0, RMS: 2.1602468994692865}
 	testAnalyzeCheck(t, rec, expect, "Realtime B: 1 Bases, no Trunc")
 
+	if err := dsp.SetNoiseWhitener(*mat.NewDense(1, 3, []float64{1, 0, 0})); err == nil {
+		t.Error("SetNoiseWhitener should fail with the wrong number of columns")
+	}
+	if err := dsp.SetNoiseWhitener(*mat.NewDense(1, dsp.NSamples, []float64{1, 0, 0, 0})); err != nil {
+		t.Error(err)
+	}
+	if err := dsp.SetNoiseWhitener(mat.Dense{}); err != nil || !dsp.noiseWhitener.IsZero() {
+		t.Errorf("SetNoiseWhitener with an empty matrix should remove the whitener, err=%v", err)
+	}
+
 	d = []RawType{1, 2, 3}
 	rec = &DataRecord{data: d, presamples: 1}
 	records = []*DataRecord{rec}
@@ -0,0 +1,152 @@
+package dastard
+
+import (
+	"runtime"
+	"sync"
+)
+
+// processPool is a fixed-size pool of worker goroutines that share the work of
+// processing one data segment per channel. Spawning one goroutine per channel per
+// segment works well for a few hundred channels, but at 10,000+ channels the
+// scheduler overhead dominates. Instead, each call to run splits the channel indices
+// into batches (so that many small channels are handled together), deals the batches
+// out to per-worker queues, and lets any worker that runs out of work steal batches
+// from the other queues.
+type processPool struct {
+	nworkers int
+	queues   []workQueue
+	jobs     []chan *poolJob // one per worker, used to wake it for a new job
+	abort    chan struct{}
+
+	placement ThreadPlacement // where the workers run
+	pinOnce   sync.Once       // so that a failure to place the workers is reported once
+}
+
+// poolBatch is a half-open range [lo,hi) of channel indices.
+type poolBatch struct {
+	lo, hi int
+}
+
+// workQueue holds the batches assigned to one worker. The owner pops from the
+// back, thieves steal from the front.
+type workQueue struct {
+	batches []poolBatch
+	sync.Mutex
+}
+
+// poolJob describes one call to run: the function to apply and a WaitGroup
+// counting the workers that have not yet finished.
+type poolJob struct {
+	f  func(int)
+	wg sync.WaitGroup
+}
+
+// batchesPerWorker sets how finely to split each job. More batches help balance
+// the load when channels differ in cost, at the price of more queue operations.
+const batchesPerWorker = 4
+
+// newProcessPool creates and starts a pool of nworkers goroutines. If nworkers < 1,
+// then runtime.GOMAXPROCS workers are used. Each worker applies the placement to itself.
+func newProcessPool(nworkers int, placement ThreadPlacement) *processPool {
+	if nworkers < 1 {
+		nworkers = runtime.GOMAXPROCS(0)
+	}
+	pool := &processPool{nworkers: nworkers, abort: make(chan struct{}), placement: placement}
+	pool.queues = make([]workQueue, nworkers)
+	pool.jobs = make([]chan *poolJob, nworkers)
+	for i := 0; i < nworkers; i++ {
+		pool.jobs[i] = make(chan *poolJob)
+		go pool.worker(i)
+	}
+	return pool
+}
+
+// Size returns the number of workers in the pool.
+func (pool *processPool) Size() int {
+	return pool.nworkers
+}
+
+// run calls f(i) for every i in [0,n) using the pool's workers, and returns
+// only when all calls are complete.
+func (pool *processPool) run(n int, f func(int)) {
+	if n <= 0 {
+		return
+	}
+	batchSize := (n + pool.nworkers*batchesPerWorker - 1) / (pool.nworkers * batchesPerWorker)
+	w := 0
+	for lo := 0; lo < n; lo += batchSize {
+		hi := lo + batchSize
+		if hi > n {
+			hi = n
+		}
+		q := &pool.queues[w]
+		q.Lock()
+		q.batches = append(q.batches, poolBatch{lo, hi})
+		q.Unlock()
+		w = (w + 1) % pool.nworkers
+	}
+
+	job := &poolJob{f: f}
+	job.wg.Add(pool.nworkers)
+	for _, c := range pool.jobs {
+		c <- job
+	}
+	job.wg.Wait()
+}
+
+// worker is the long-running goroutine for worker number id.
+func (pool *processPool) worker(id int) {
+	if err := pool.placement.pin(); err != nil {
+		pool.pinOnce.Do(func() { logWarningf("Processing workers: %v", err) })
+	}
+	for {
+		select {
+		case <-pool.abort:
+			return
+		case job := <-pool.jobs[id]:
+			for {
+				b, ok := pool.next(id)
+				if !ok {
+					break
+				}
+				for i := b.lo; i < b.hi; i++ {
+					job.f(i)
+				}
+			}
+			job.wg.Done()
+		}
+	}
+}
+
+// next returns the next batch for worker id: from its own queue if possible,
+// otherwise stolen from another worker's queue. Returns ok=false when all queues
+// are empty.
+func (pool *processPool) next(id int) (b poolBatch, ok bool) {
+	q := &pool.queues[id]
+	q.Lock()
+	if n := len(q.batches); n > 0 {
+		b = q.batches[n-1]
+		q.batches = q.batches[:n-1]
+		q.Unlock()
+		return b, true
+	}
+	q.Unlock()
+
+	for k := 1; k < pool.nworkers; k++ {
+		victim := &pool.queues[(id+k)%pool.nworkers]
+		victim.Lock()
+		if len(victim.batches) > 0 {
+			b = victim.batches[0]
+			victim.batches = victim.batches[1:]
+			victim.Unlock()
+			return b, true
+		}
+		victim.Unlock()
+	}
+	return b, false
+}
+
+// Stop ends all worker goroutines. The pool cannot be used afterwards.
+func (pool *processPool) Stop() {
+	closeIfOpen(pool.abort)
+}
@@ -0,0 +1,36 @@
+package dastard
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestProcessPool(t *testing.T) {
+	for _, nworkers := range []int{0, 1, 3, 16} {
+		pool := newProcessPool(nworkers, ThreadPlacement{})
+		if nworkers > 0 && pool.Size() != nworkers {
+			t.Errorf("newProcessPool(%d).Size()=%d, want %d", nworkers, pool.Size(), nworkers)
+		}
+		if pool.Size() < 1 {
+			t.Errorf("newProcessPool(%d).Size()=%d, want >0", nworkers, pool.Size())
+		}
+		for _, n := range []int{0, 1, 5, 100, 10001} {
+			counts := make([]int32, n)
+			var total int32
+			pool.run(n, func(i int) {
+				atomic.AddInt32(&counts[i], 1)
+				atomic.AddInt32(&total, 1)
+			})
+			if int(total) != n {
+				t.Errorf("pool of %d workers ran %d calls, want %d", pool.Size(), total, n)
+			}
+			for i, c := range counts {
+				if c != 1 {
+					t.Errorf("pool of %d workers called f(%d) %d times, want 1", pool.Size(), i, c)
+					break
+				}
+			}
+		}
+		pool.Stop()
+	}
+}
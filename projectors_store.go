@@ -0,0 +1,132 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// SavedProjectors is the content of the file where Dastard stores the projectors and
+// bases loaded in a data source, so they can be reloaded when that source next starts.
+type SavedProjectors struct {
+	SourceName string
+	Channels   []SavedChannelProjectors
+}
+
+// SavedChannelProjectors holds the projectors and basis of one channel. On reloading,
+// they go to the channel of the same name, or to the same ChannelIndex if unnamed.
+type SavedChannelProjectors struct {
+	ChannelName string
+	Projectors  ProjectorsBasisObject
+}
+
+// projectorsFilename returns the name of the file that stores the projectors of the
+// named source, in the directory of the config file, or "" if there is no config file.
+func projectorsFilename(sourceName string) string {
+	configFile := viper.ConfigFileUsed()
+	if configFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configFile), fmt.Sprintf("projectors_%s.json", strings.ToLower(sourceName)))
+}
+
+// SaveProjectors writes the projectors and bases loaded in ds to the config directory,
+// to be restored when the source next starts. Call it only from the data-processing goroutine.
+func (ds *AnySource) SaveProjectors() error {
+	filename := projectorsFilename(ds.name)
+	if filename == "" {
+		return nil
+	}
+	saved := SavedProjectors{SourceName: ds.name, Channels: make([]SavedChannelProjectors, 0)}
+	for _, channelIndex := range ds.ChannelsWithProjectors() {
+		pbo, err := ds.ReportProjectorsBasis(channelIndex)
+		if err != nil {
+			return err
+		}
+		scp := SavedChannelProjectors{Projectors: *pbo}
+		if channelIndex < len(ds.chanNames) {
+			scp.ChannelName = ds.chanNames[channelIndex]
+		}
+		saved.Channels = append(saved.Channels, scp)
+	}
+	contents, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	// Write a temporary file first, so a crash cannot leave a partial file behind.
+	tmpname := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpname, contents, 0664); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, filename)
+}
+
+// restoreProjectors loads any projectors and bases saved by SaveProjectors into the
+// matching channels, and records which channels were restored. A channel that cannot be
+// restored (e.g., because the record length has changed) is skipped with a warning.
+// PrepareRun calls it before any data are processed.
+func (ds *AnySource) restoreProjectors() {
+	ds.projectorsRestored = make([]int, 0)
+	filename := projectorsFilename(ds.name)
+	if filename == "" {
+		return
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarningf("Could not read saved projectors: %v", err)
+		}
+		return
+	}
+	var saved SavedProjectors
+	if err := json.Unmarshal(contents, &saved); err != nil {
+		logWarningf("Could not parse saved projectors %s: %v", filename, err)
+		return
+	}
+
+	nameIndex := make(map[string]int)
+	for i, name := range ds.chanNames {
+		nameIndex[name] = i
+	}
+	for _, scp := range saved.Channels {
+		channelIndex := scp.Projectors.ChannelIndex
+		if scp.ChannelName != "" {
+			var ok bool
+			if channelIndex, ok = nameIndex[scp.ChannelName]; !ok {
+				logWarningf("Could not restore projectors: no channel named %s", scp.ChannelName)
+				continue
+			}
+		}
+		projectors, basis, whitener, err := scp.Projectors.decode()
+		if err == nil {
+			err = ds.ConfigureProjectorsBases(channelIndex, projectors, basis, scp.Projectors.ModelDescription, whitener)
+		}
+		if err != nil {
+			logWarningf("Could not restore projectors of channel %d: %v", channelIndex, err)
+			continue
+		}
+		ds.projectorsRestored = append(ds.projectorsRestored, channelIndex)
+	}
+	if len(ds.projectorsRestored) > 0 {
+		logInfof("Restored projectors of %d channels from %s", len(ds.projectorsRestored), filename)
+	}
+}
+
+// ProjectorsRestored returns the indices of the channels whose saved projectors were
+// restored when the source started.
+func (ds *AnySource) ProjectorsRestored() []int {
+	return ds.projectorsRestored
+}
+
+// saveProjectors stores the projectors and bases of the active source, logging any
+// failure. Call it only from the data-processing goroutine.
+func (s *SourceControl) saveProjectors() {
+	if err := s.ActiveSource.SaveProjectors(); err != nil {
+		logWarningf("Could not save projectors: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestSaveRestoreProjectors(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_projectors_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	oldConfig := viper.ConfigFileUsed()
+	viper.SetConfigFile(filepath.Join(tmp, "config.yaml"))
+	defer viper.SetConfigFile(oldConfig)
+
+	const nchan, nbases, npre, nsamp = 3, 2, 4, 16
+	ds := AnySource{nchan: nchan, name: "TestProjectors"}
+	if err := ds.PrepareRun(npre, nsamp); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+	if restored := ds.ProjectorsRestored(); len(restored) != 0 {
+		t.Errorf("ProjectorsRestored() = %v with nothing saved, want []", restored)
+	}
+	projectors := mat.NewDense(nbases, nsamp, nil)
+	basis := mat.NewDense(nsamp, nbases, nil)
+	for i := 0; i < nsamp; i++ {
+		projectors.Set(i%nbases, i, float64(i))
+		basis.Set(i, i%nbases, float64(i+1))
+	}
+	whitener := mat.NewDense(nbases, nsamp, nil)
+	whitener.Set(1, 3, 2.5)
+	if err := ds.ConfigureProjectorsBases(2, *projectors, *basis, "test model", *whitener); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.SaveProjectors(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "projectors_testprojectors.json")); err != nil {
+		t.Errorf("SaveProjectors did not write the expected file: %v", err)
+	}
+	want, err := ds.ReportProjectorsBasis(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same source restarts with its channels in a different order.
+	ds2 := AnySource{nchan: nchan, name: "TestProjectors", chanNames: []string{"chan2", "chan0", "chan1"}}
+	if err := ds2.PrepareRun(npre, nsamp); err != nil {
+		t.Fatal(err)
+	}
+	defer ds2.broker.Stop()
+	if restored := ds2.ProjectorsRestored(); len(restored) != 1 || restored[0] != 0 {
+		t.Errorf("ProjectorsRestored() = %v, want [0]", restored)
+	}
+	got, err := ds2.ReportProjectorsBasis(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ProjectorsBase64 != want.ProjectorsBase64 || got.BasisBase64 != want.BasisBase64 ||
+		got.WhitenerBase64 != want.WhitenerBase64 || got.ModelDescription != want.ModelDescription {
+		t.Error("restored projectors differ from the saved ones")
+	}
+
+	// Projectors of the wrong record length cannot be restored.
+	ds3 := AnySource{nchan: nchan, name: "TestProjectors"}
+	if err := ds3.PrepareRun(npre, nsamp+1); err != nil {
+		t.Fatal(err)
+	}
+	defer ds3.broker.Stop()
+	if restored := ds3.ProjectorsRestored(); len(restored) != 0 {
+		t.Errorf("ProjectorsRestored() = %v with the wrong record length, want []", restored)
+	}
+	if chans := ds3.ChannelsWithProjectors(); len(chans) != 0 {
+		t.Errorf("ChannelsWithProjectors() = %v with the wrong record length, want []", chans)
+	}
+}
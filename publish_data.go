@@ -3,16 +3,18 @@ package dastard
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"os"
 	"reflect"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/spf13/viper"
 	"github.com/usnistgov/dastard/getbytes"
 	"github.com/usnistgov/dastard/ljh"
 	"github.com/usnistgov/dastard/off"
 	"gonum.org/v1/gonum/mat"
-
-	czmq "github.com/zeromq/goczmq"
 )
 
 // DataPublisher contains many optional methods for publishing data, any methods that are non-nil will be used
@@ -20,11 +22,79 @@ import (
 type DataPublisher struct {
 	PubRecordsChan   chan []*DataRecord
 	PubSummariesChan chan []*DataRecord
+	PubEnergiesChan  chan []*DataRecord
+	KafkaChan        chan []*DataRecord
+	MulticastChan    chan []*DataRecord
 	LJH22            *ljh.Writer
 	LJH3             *ljh.Writer3
 	OFF              *off.Writer
 	WritingPaused    bool
-	numberWritten    int // integrates up the total number written, reset any time writing starts or stops
+	numberWritten    int           // integrates up the total number written, reset any time writing starts or stops
+	bytesWritten     int64         // integrates up the total bytes written to all files, reset like numberWritten
+	writeErrors      int           // counts failed record writes, reset like numberWritten
+	writeFailure     error         // the error that disabled writing of the files, reset like numberWritten
+	queue            *writeQueue   // if non-nil, a goroutine writes the files, fed by this queue
+	offModelVersions map[int]int   // the OFF file's model version for each processor model version
+	pubFilter        publishFilter // chooses which records go to PubRecordsChan
+	recordSeq        uint64        // sequence number of the next record published
+	summarySeq       uint64        // sequence number of the next summary published
+	thumbDecimation  int           // if >0, summaries carry every thumbDecimation'th sample of the record
+}
+
+// ChannelWritingStats describes what one channel has written since writing started.
+type ChannelWritingStats struct {
+	ChannelIndex   int
+	RecordsWritten int
+	BytesWritten   int64 // bytes of records passed to the writers (some may still be buffered)
+	WriteErrors    int
+	FileNames      []string
+	FileSizes      []int64 // current size on disk of each file in FileNames (0 if not yet created)
+	QueueDepth     int     // batches of records waiting in the write queue
+	QueueDropped   int64   // records not written because the write queue was full
+	WritingStopped bool    // the write queue overflowed with policy STOP, so writing has stopped
+	WriteFailure   string  // if not empty, a write failed with this error, so writing has stopped
+}
+
+// resetWritingStats zeros the counts of records, bytes, and errors written.
+func (dp *DataPublisher) resetWritingStats() {
+	dp.numberWritten = 0
+	dp.bytesWritten = 0
+	dp.writeErrors = 0
+	dp.writeFailure = nil
+}
+
+// WritingStats returns the writing statistics of this publisher.
+func (dp *DataPublisher) WritingStats(channelIndex int) ChannelWritingStats {
+	unlock := dp.lockWriters()
+	stats := ChannelWritingStats{ChannelIndex: channelIndex, RecordsWritten: dp.numberWritten,
+		BytesWritten: dp.bytesWritten, WriteErrors: dp.writeErrors,
+		FileNames: make([]string, 0), FileSizes: make([]int64, 0)}
+	if dp.writeFailure != nil {
+		stats.WriteFailure = dp.writeFailure.Error()
+	}
+	unlock()
+	if dp.queue != nil {
+		stats.QueueDepth = len(dp.queue.requests)
+		stats.QueueDropped = dp.queue.dropped
+		stats.WritingStopped = dp.queue.stopped
+	}
+	if dp.HasLJH22() {
+		stats.FileNames = append(stats.FileNames, dp.LJH22.FileName)
+	}
+	if dp.HasLJH3() {
+		stats.FileNames = append(stats.FileNames, dp.LJH3.FileName)
+	}
+	if dp.HasOFF() {
+		stats.FileNames = append(stats.FileNames, dp.OFF.FileName())
+	}
+	for _, name := range stats.FileNames {
+		var size int64
+		if info, err := os.Stat(name); err == nil {
+			size = info.Size()
+		}
+		stats.FileSizes = append(stats.FileSizes, size)
+	}
+	return stats
 }
 
 // SetPause changes the paused state to the given value of pause
@@ -33,8 +103,64 @@ func (dp *DataPublisher) SetPause(pause bool) {
 	dp.Flush()
 }
 
-// Flush calls Flush for each writer that has a Flush command (LJH22, LJH3, OFF)
+// Flush calls Flush for each writer that has a Flush command (LJH22, LJH3, OFF).
+// If dp has a write queue, its goroutine does the flush after the queued writes.
 func (dp *DataPublisher) Flush() {
+	if dp.queue != nil {
+		dp.queue.requestFlush(false)
+		return
+	}
+	dp.flushWriters()
+}
+
+// SyncFiles flushes each file writer and commits its file to stable storage.
+// If dp has a write queue, its goroutine does this after the queued writes.
+func (dp *DataPublisher) SyncFiles() {
+	if dp.queue != nil {
+		dp.queue.requestFlush(true)
+		return
+	}
+	dp.syncFiles()
+}
+
+// syncFiles flushes and commits each file writer's file now, unless writing has failed.
+func (dp *DataPublisher) syncFiles() {
+	if dp.writeFailure != nil {
+		return
+	}
+	var errs []error
+	if dp.HasLJH22() {
+		errs = append(errs, dp.LJH22.Sync())
+	}
+	if dp.HasLJH3() {
+		errs = append(errs, dp.LJH3.Sync())
+	}
+	if dp.HasOFF() {
+		errs = append(errs, dp.OFF.Sync())
+	}
+	for _, err := range errs {
+		if err != nil {
+			logWarningf("Could not sync a data file to disk: %v", err)
+		}
+	}
+}
+
+// SetBufferSize sets the size in bytes of each file writer's write buffer (0 means
+// the default). Call after SetLJH22, SetLJH3, and SetOFF, before any record is written.
+func (dp *DataPublisher) SetBufferSize(size int) {
+	if dp.LJH22 != nil {
+		dp.LJH22.BufferSize = size
+	}
+	if dp.LJH3 != nil {
+		dp.LJH3.BufferSize = size
+	}
+	if dp.OFF != nil {
+		dp.OFF.BufferSize = size
+	}
+}
+
+// flushWriters flushes each file writer now.
+func (dp *DataPublisher) flushWriters() {
 	if dp.HasLJH22() {
 		dp.LJH22.Flush()
 	}
@@ -47,19 +173,77 @@ func (dp *DataPublisher) Flush() {
 }
 
 // SetOFF adds an OFF writer to dp, the .file attribute is nil, and will be instantiated upon next call to dp.WriteRecord
+// The model arguments are embedded in the OFF header; NoiseWhitener may be nil.
 func (dp *DataPublisher) SetOFF(ChannelIndex int, Presamples int, Samples int, FramesPerSample int,
 	Timebase float64, TimestampOffset time.Time,
 	NumberOfRows, NumberOfColumns, NumberOfChans, rowNum, colNum int,
 	FileName, sourceName, chanName string, ChannelNumberMatchingName int,
-	Projectors *mat.Dense, Basis *mat.Dense, ModelDescription string) {
+	Projectors *mat.Dense, Basis *mat.Dense, ModelDescription string, NoiseWhitener *mat.Dense) {
 	ReadoutInfo := off.TimeDivisionMultiplexingInfo{NumberOfRows: NumberOfRows,
 		NumberOfColumns: NumberOfColumns,
 		NumberOfChans:   NumberOfChans,
 		ColumnNum:       colNum, RowNum: rowNum}
 	w := off.NewWriter(FileName, ChannelIndex, chanName, ChannelNumberMatchingName, Presamples, Samples, Timebase,
-		Projectors, Basis, ModelDescription, Build.Version, Build.Githash, sourceName, ReadoutInfo)
+		Projectors, Basis, ModelDescription, NoiseWhitener, Build.Version, Build.Githash, sourceName, ReadoutInfo)
 	dp.OFF = w
-	dp.numberWritten = 0
+	dp.offModelVersions = nil
+	dp.resetWritingStats()
+}
+
+// defaultOFFModelVersions is the room for replacement models in each OFF file header
+// when WriteControlConfig.OFFModelVersions is 0.
+const defaultOFFModelVersions = 4
+
+// maxOFFModelVersions is the most room for replacement models that WriteControl allows.
+// Each model's room is padding in every OFF header, so it limits the header size.
+const maxOFFModelVersions = 100
+
+// SetOFFModelVersions leaves room in the OFF file header for n models to replace the
+// current one, whose processor model version is modelVersion: defaultOFFModelVersions if
+// n is 0, and none if n is negative. Call after SetOFF, before any record is written.
+func (dp *DataPublisher) SetOFFModelVersions(n, modelVersion int) error {
+	if n == 0 {
+		n = defaultOFFModelVersions
+	}
+	if n < 0 {
+		return nil
+	}
+	if err := dp.OFF.ReserveModelVersions(n); err != nil {
+		return err
+	}
+	dp.offModelVersions = map[int]int{modelVersion: 0}
+	return nil
+}
+
+// checkOFFModel returns an error unless the OFF file has room for another model with
+// nbases bases.
+func (dp *DataPublisher) checkOFFModel(nbases int) error {
+	unlock := dp.lockWriters()
+	defer unlock()
+	if dp.OFF.ModelVersionsFree() <= 0 {
+		return fmt.Errorf("OFF file %s has no room for another model (see WriteControl OFFModelVersions)",
+			dp.OFF.FileName())
+	}
+	if nbases != dp.OFF.NumberOfBases {
+		return fmt.Errorf("OFF file %s needs models with %d bases, not %d", dp.OFF.FileName(),
+			dp.OFF.NumberOfBases, nbases)
+	}
+	return nil
+}
+
+// addOFFModel adds a model, whose processor model version is modelVersion, to the OFF
+// file header, so that records projected by it are tagged with its version in the file.
+func (dp *DataPublisher) addOFFModel(modelVersion int, Projectors *mat.Dense, Basis *mat.Dense,
+	ModelDescription string, NoiseWhitener *mat.Dense) error {
+	unlock := dp.lockWriters()
+	defer unlock()
+	version, err := dp.OFF.AddModelVersion(Projectors, Basis, ModelDescription, NoiseWhitener)
+	if err != nil {
+		return fmt.Errorf("%s: %v", dp.OFF.FileName(), err)
+	}
+	dp.offModelVersions[modelVersion] = version
+	logInfof("OFF file %s now has model version %d: %s", dp.OFF.FileName(), version, ModelDescription)
+	return nil
 }
 
 // HasOFF returns true if OFF is non-nil, eg if writing to OFF is occuring
@@ -67,13 +251,15 @@ func (dp *DataPublisher) HasOFF() bool {
 	return dp.OFF != nil
 }
 
-// RemoveOFF closes any existing OFF file and assign .OFF=nil
+// RemoveOFF finishes any queued writes, closes any existing OFF file and assign .OFF=nil
 func (dp *DataPublisher) RemoveOFF() {
+	dp.stopWriteQueue()
 	if dp.OFF != nil {
 		dp.OFF.Close()
 	}
 	dp.OFF = nil
-	dp.numberWritten = 0
+	dp.offModelVersions = nil
+	dp.resetWritingStats()
 
 }
 
@@ -87,7 +273,38 @@ func (dp *DataPublisher) SetLJH3(ChannelIndex int, Timebase float64,
 		FileName:        FileName}
 	dp.LJH3 = &w
 	dp.WritingPaused = false
-	dp.numberWritten = 0
+	dp.resetWritingStats()
+}
+
+// SetCalibration stores the channel's raw-to-volts conversion in the headers of
+// the files being written. Call after SetLJH22, SetLJH3, and SetOFF.
+func (dp *DataPublisher) SetCalibration(voltsPerArb, voltsOffset float32) {
+	if dp.LJH22 != nil {
+		dp.LJH22.VoltsPerArb = float64(voltsPerArb)
+		dp.LJH22.VoltsOffset = float64(voltsOffset)
+	}
+	if dp.LJH3 != nil {
+		dp.LJH3.VoltsPerArb = float64(voltsPerArb)
+		dp.LJH3.VoltsOffset = float64(voltsOffset)
+	}
+	if dp.OFF != nil {
+		dp.OFF.VoltsPerArb = float64(voltsPerArb)
+		dp.OFF.VoltsOffset = float64(voltsOffset)
+	}
+}
+
+// SetSigned marks the files being written as holding signed (int16) samples, or not.
+// Call after SetLJH22, SetLJH3, and SetOFF.
+func (dp *DataPublisher) SetSigned(signed bool) {
+	if dp.LJH22 != nil {
+		dp.LJH22.Signed = signed
+	}
+	if dp.LJH3 != nil {
+		dp.LJH3.Signed = signed
+	}
+	if dp.OFF != nil {
+		dp.OFF.SignedSamples = signed
+	}
 }
 
 // HasLJH3 returns true if LJH3 is non-nil, eg if writing to LJH3 is occuring
@@ -95,13 +312,14 @@ func (dp *DataPublisher) HasLJH3() bool {
 	return dp.LJH3 != nil
 }
 
-// RemoveLJH3 closes existing LJH3 file and assign .LJH3=nil
+// RemoveLJH3 finishes any queued writes, closes existing LJH3 file and assign .LJH3=nil
 func (dp *DataPublisher) RemoveLJH3() {
+	dp.stopWriteQueue()
 	if dp.LJH3 != nil {
 		dp.LJH3.Close()
 	}
 	dp.LJH3 = nil
-	dp.numberWritten = 0
+	dp.resetWritingStats()
 }
 
 // SetLJH22 adds an LJH22 writer to dp, the .file attribute is nil, and will be instantiated upon next call to dp.WriteRecord
@@ -129,7 +347,7 @@ func (dp *DataPublisher) SetLJH22(ChannelIndex int, Presamples int, Samples int,
 	}
 	dp.LJH22 = &w
 	dp.WritingPaused = false
-	dp.numberWritten = 0
+	dp.resetWritingStats()
 }
 
 // HasLJH22 returns true if LJH22 is non-nil, used to decide if writeint to LJH22 should occur
@@ -137,13 +355,14 @@ func (dp *DataPublisher) HasLJH22() bool {
 	return dp.LJH22 != nil
 }
 
-// RemoveLJH22 closes existing LJH22 file and assign .LJH22=nil
+// RemoveLJH22 finishes any queued writes, closes existing LJH22 file and assign .LJH22=nil
 func (dp *DataPublisher) RemoveLJH22() {
+	dp.stopWriteQueue()
 	if dp.LJH22 != nil {
 		dp.LJH22.Close()
 	}
 	dp.LJH22 = nil
-	dp.numberWritten = 0
+	dp.resetWritingStats()
 }
 
 // HasPubRecords return true if publishing records on PortTrigs Pub is occuring
@@ -186,16 +405,156 @@ func (dp *DataPublisher) RemovePubSummaries() {
 	dp.PubSummariesChan = nil
 }
 
-// PublishData looks at each member of DataPublisher, and if it is non-nil, publishes each record into that member
+// HasPubEnergies returns true if publishing calibrated energies is occuring
+func (dp *DataPublisher) HasPubEnergies() bool {
+	return dp.PubEnergiesChan != nil
+}
+
+// SetPubEnergies starts publishing calibrated energies with czmq over tcp at port=Ports.Energies
+func (dp *DataPublisher) SetPubEnergies() {
+	if PubEnergiesChan == nil {
+		configurePubEnergiesSocket()
+	}
+	if dp.PubEnergiesChan == nil {
+		dp.PubEnergiesChan = PubEnergiesChan
+	}
+}
+
+// RemovePubEnergies stops publishing energies on Ports.Energies
+func (dp *DataPublisher) RemovePubEnergies() {
+	dp.PubEnergiesChan = nil
+}
+
+// HasKafka return true if publishing to Kafka is occuring
+func (dp *DataPublisher) HasKafka() bool {
+	return dp.KafkaChan != nil
+}
+
+// SetKafka starts publishing summaries (and optionally records) to Kafka.
+// configureKafkaProducer must have been called first.
+func (dp *DataPublisher) SetKafka() {
+	dp.KafkaChan = kafkaRecordsChan()
+}
+
+// RemoveKafka stops publishing to Kafka
+func (dp *DataPublisher) RemoveKafka() {
+	dp.KafkaChan = nil
+}
+
+// HasMulticast return true if multicasting summaries is occuring
+func (dp *DataPublisher) HasMulticast() bool {
+	return dp.MulticastChan != nil
+}
+
+// SetMulticast starts multicasting summaries over UDP.
+// configureMulticastPublisher must have been called first.
+func (dp *DataPublisher) SetMulticast() {
+	dp.MulticastChan = MulticastRecordsChan
+}
+
+// RemoveMulticast stops multicasting summaries
+func (dp *DataPublisher) RemoveMulticast() {
+	dp.MulticastChan = nil
+}
+
+// PublishData looks at each member of DataPublisher, and if it is non-nil, publishes each record into that member.
+// Every record gets the channel's next summary sequence number, and each that passes the publish filter
+// the next record sequence number, so that subscribers can detect missed messages, whether dropped here
+// or by ZMQ. The numbers are assigned even when a queue is full and the record is dropped.
 func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 	var times []time.Duration
+	for _, record := range records {
+		record.summarySeq = dp.summarySeq
+		record.thumbDecimation = dp.thumbDecimation
+		dp.summarySeq++
+	}
+	published := records
+	if dp.pubFilter.active() {
+		published = dp.pubFilter.filter(records)
+	}
+	for _, record := range published {
+		record.recordSeq = dp.recordSeq
+		dp.recordSeq++
+	}
+	// Never block on a slow publisher: if its queue is full, drop and count the records.
 	if dp.HasPubRecords() {
-		dp.PubRecordsChan <- records
+		if len(published) > 0 {
+			select {
+			case dp.PubRecordsChan <- published:
+			default:
+				atomic.AddInt64(&pubRecordsQueueDropped, int64(len(published)))
+			}
+		}
 	}
 	if dp.HasPubSummaries() {
-		dp.PubSummariesChan <- records
+		select {
+		case dp.PubSummariesChan <- records:
+		default:
+			atomic.AddInt64(&pubSummariesQueueDropped, int64(len(records)))
+		}
+	}
+	if dp.HasPubEnergies() {
+		calibrated := make([]*DataRecord, 0, len(records))
+		for _, record := range records {
+			if !math.IsNaN(record.energy) {
+				calibrated = append(calibrated, record)
+			}
+		}
+		if len(calibrated) > 0 {
+			select {
+			case dp.PubEnergiesChan <- calibrated:
+			default:
+				atomic.AddInt64(&pubEnergiesQueueDropped, int64(len(calibrated)))
+			}
+		}
+	}
+	if dp.HasKafka() {
+		dp.KafkaChan <- records
+	}
+	if dp.HasMulticast() {
+		select {
+		case dp.MulticastChan <- records:
+		default:
+			atomic.AddInt64(&multicastDropped, int64(len(records)))
+		}
+	}
+	if (dp.HasLJH22() || dp.HasLJH3() || dp.HasOFF()) && !dp.WritingPaused {
+		if dp.queue != nil {
+			dp.queue.push(records)
+		} else {
+			dp.writeRecords(records)
+		}
+	}
+	var sum time.Duration
+	for _, t := range times {
+		sum += t
+	}
+	if dp.HasLJH22() && (sum > 40*time.Millisecond || dp.LJH22.ChannelIndex == -1) {
+		logDebugf("ChannelIndex %v, times %v", dp.LJH22.ChannelIndex, times)
+	}
+	return nil
+}
+
+// writeRecords writes records to each file writer of dp. It runs in PublishData, or in
+// the write queue's goroutine if dp has a queue. After any write fails (a disk error or
+// full quota), it writes nothing more until writing restarts, so one channel's failure
+// doesn't halt the processing of the others.
+func (dp *DataPublisher) writeRecords(records []*DataRecord) {
+	if dp.writeFailure != nil {
+		return
 	}
-	if dp.HasLJH22() && !dp.WritingPaused {
+	if err := dp.writeFiles(records); err != nil {
+		dp.writeErrors++
+		dp.writeFailure = err
+		logWarningf("Could not write a data file, so writing of its channel has stopped until the next WriteControl START: %v", err)
+	}
+}
+
+// writeFiles writes records to each file writer of dp, and returns the first error.
+func (dp *DataPublisher) writeFiles(records []*DataRecord) error {
+	before := dp.bytesWritten
+	defer func() { atomic.AddInt64(&bytesWrittenTotal, dp.bytesWritten-before) }()
+	if dp.HasLJH22() {
 		for _, record := range records {
 			if !dp.LJH22.HeaderWritten { // MATTER doesn't create ljh files until at least one record exists, let us do the same
 				// if the file doesn't exists yet, create it and write header
@@ -206,10 +565,13 @@ func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 				dp.LJH22.WriteHeader(record.trigTime)
 			}
 			nano := record.trigTime.UnixNano()
-			dp.LJH22.WriteRecord(int64(record.trigFrame), int64(nano)/1000, rawTypeToUint16(record.data))
+			if err := dp.LJH22.WriteRecord(int64(record.trigFrame), int64(nano)/1000, rawTypeToUint16(record.data)); err != nil {
+				return fmt.Errorf("%s: %v", dp.LJH22.FileName, err)
+			}
+			dp.bytesWritten += int64(16 + 2*len(record.data))
 		}
 	}
-	if dp.HasLJH3() && !dp.WritingPaused {
+	if dp.HasLJH3() {
 		for _, record := range records {
 			if !dp.LJH3.HeaderWritten { // MATTER doesn't create ljh files until at least one record exists, let us do the same
 				// if the file doesn't exists yet, create it and write header
@@ -220,10 +582,14 @@ func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 				dp.LJH3.WriteHeader()
 			}
 			nano := record.trigTime.UnixNano()
-			dp.LJH3.WriteRecord(int32(record.presamples+1), int64(record.trigFrame), int64(nano)/1000, rawTypeToUint16(record.data))
+			if err := dp.LJH3.WriteRecord(int32(record.presamples+1), int64(record.trigFrame), int64(nano)/1000,
+				rawTypeToUint16(record.data)); err != nil {
+				return fmt.Errorf("%s: %v", dp.LJH3.FileName, err)
+			}
+			dp.bytesWritten += int64(24 + 2*len(record.data))
 		}
 	}
-	if dp.HasOFF() && !dp.WritingPaused {
+	if dp.HasOFF() {
 		for _, record := range records {
 			if !dp.OFF.HeaderWritten() { // MATTER doesn't create ljh files until at least one record exists, let us do the same
 				// if the file doesn't exists yet, create it and write header
@@ -237,28 +603,42 @@ func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 			for i, v := range record.modelCoefs {
 				modelCoefs[i] = float32(v)
 			}
-			err := dp.OFF.WriteRecord(int32(len(record.data)), int32(record.presamples), int64(record.trigFrame), record.trigTime.UnixNano(),
-				float32(record.pretrigMean), float32(record.residualStdDev), modelCoefs)
+			var raw []uint16
+			if dp.OFF.WantsRawSamples(float32(record.residualStdDev)) {
+				raw = rawTypeToUint16(record.data)
+			}
+			var fields []off.Extension
+			if version, ok := dp.offModelVersions[record.modelVersion]; ok {
+				if field, ok := dp.OFF.ModelVersionField(version); ok {
+					fields = append(fields, field)
+				}
+			}
+			err := dp.OFF.WriteExtendedRecord(int32(len(record.data)), int32(record.presamples), int64(record.trigFrame), record.trigTime.UnixNano(),
+				float32(record.pretrigMean), float32(record.residualStdDev), float32(record.driftCorrection), modelCoefs,
+				record.flags(), raw, fields)
 			if err != nil {
-				return err
+				return fmt.Errorf("%s: %v", dp.OFF.FileName(), err)
+			}
+			dp.bytesWritten += int64(dp.OFF.RecordSize())
+			if raw != nil {
+				dp.bytesWritten += int64(4 + 2*len(raw))
+			}
+			if len(fields) > 0 {
+				dp.bytesWritten += 2
+			}
+			for _, field := range fields {
+				dp.bytesWritten += int64(4 + len(field.Value))
 			}
 		}
 	}
-	if (dp.HasLJH22() || dp.HasLJH3() || dp.HasOFF()) && !dp.WritingPaused {
-		dp.numberWritten += len(records)
-	}
-	var sum time.Duration
-	for _, t := range times {
-		sum += t
-	}
-	if dp.HasLJH22() && (sum > 40*time.Millisecond || dp.LJH22.ChannelIndex == -1) {
-		fmt.Printf("ChannelIndex %v, times %v\n", dp.LJH22.ChannelIndex, times)
-	}
+	dp.numberWritten += len(records)
 	return nil
 }
 
 // messageSummaries makes a message with the following format for publishing on portTrigs
 // Structure of the message header is defined in BINARY_FORMATS.md
+// Only records made by trigger conditions (TriggerTypeCondition) have the version 6
+// header, with the mask; all others have version 5.
 // uint16: channel number
 // uint8: header version number
 // uint32: bits: Presamples
@@ -270,10 +650,25 @@ func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 // float32: residualStdDev
 // uint64: UnixNano trigTime
 // uint64: trigFrame
+// float32: calibrated energy (NaN if not calibrated)
+// uint32: record flags (as in OFF records)
+// float32: filtered pulse height (NaN if no projectors)
+// uint64: summary sequence number of the channel
+// uint16: thumbnail decimation (0 for no thumbnail)
+// uint8: code for thumbnail data type (as in messageRecords)
+// uint32: mask of the trigger conditions that made the record (version 6 only)
 //  end of first message packet
 //  modelCoefs, each coef is float32, length can vary
+//  thumbnail (if decimation > 0), every decimation'th sample of the record
 func messageSummaries(rec *DataRecord) [][]byte {
-	const headerVersion = uint8(0)
+	headerVersion := uint8(5)
+	if rec.trigType == TriggerTypeCondition {
+		headerVersion = 6
+	}
+	dataType := uint8(3)
+	if rec.signed {
+		dataType--
+	}
 
 	header := new(bytes.Buffer)
 	header.Write(getbytes.FromUint16(uint16(rec.channelIndex)))
@@ -288,8 +683,54 @@ func messageSummaries(rec *DataRecord) [][]byte {
 	nano := rec.trigTime.UnixNano()
 	header.Write(getbytes.FromInt64(nano))
 	header.Write(getbytes.FromInt64(int64(rec.trigFrame)))
+	header.Write(getbytes.FromFloat32(float32(rec.energy)))
+	header.Write(getbytes.FromUint32(rec.flags()))
+	header.Write(getbytes.FromFloat32(float32(rec.filtValue)))
+	header.Write(getbytes.FromUint64(rec.summarySeq))
+	header.Write(getbytes.FromUint16(uint16(rec.thumbDecimation)))
+	header.Write(getbytes.FromUint8(dataType))
+	if headerVersion == 6 {
+		header.Write(getbytes.FromUint32(rec.conditions))
+	}
 
-	return [][]byte{header.Bytes(), getbytes.FromSliceFloat64(rec.modelCoefs)}
+	message := [][]byte{header.Bytes(), getbytes.FromSliceFloat64(rec.modelCoefs)}
+	if d := rec.thumbDecimation; d > 0 {
+		thumbnail := make([]RawType, 0, (len(rec.data)+d-1)/d)
+		for i := 0; i < len(rec.data); i += d {
+			thumbnail = append(thumbnail, rec.data[i])
+		}
+		message = append(message, rawTypeToBytes(thumbnail))
+	}
+	return message
+}
+
+// flags returns the record's quality flags, a bitwise OR of the off.Flag* values
+// that the DSP sets.
+func (rec *DataRecord) flags() uint32 {
+	var flags uint32
+	if rec.pileup {
+		flags |= off.FlagPileup
+	}
+	return flags
+}
+
+// messageEnergies makes a 1-frame message with the calibrated energy of a record,
+// for publishing on Ports.Energies. Structure is defined in BINARY_FORMATS.md
+// uint16: channel number
+// uint8: header version number
+// float32: energy
+// int64: UnixNano trigTime
+// int64: trigFrame
+func messageEnergies(rec *DataRecord) [][]byte {
+	const headerVersion = uint8(0)
+
+	header := new(bytes.Buffer)
+	header.Write(getbytes.FromUint16(uint16(rec.channelIndex)))
+	header.Write(getbytes.FromUint8(headerVersion))
+	header.Write(getbytes.FromFloat32(float32(rec.energy)))
+	header.Write(getbytes.FromInt64(rec.trigTime.UnixNano()))
+	header.Write(getbytes.FromInt64(int64(rec.trigFrame)))
+	return [][]byte{header.Bytes()}
 }
 
 // messageRecords makes a message with the following format for publishing on portTrigs
@@ -303,11 +744,12 @@ func messageSummaries(rec *DataRecord) [][]byte {
 // float32: volts per arb conversion (float)
 // uint64: trigger time, in ns since epoch 1970
 // uint64: trigger frame #
+// uint64: record sequence number of the channel
 // end of first message packet
 // data, each sample is uint16, length given above
 func messageRecords(rec *DataRecord) [][]byte {
 
-	const headerVersion = uint8(0)
+	const headerVersion = uint8(1)
 	dataType := uint8(3)
 	if rec.signed {
 		dataType--
@@ -323,11 +765,37 @@ func messageRecords(rec *DataRecord) [][]byte {
 	nano := rec.trigTime.UnixNano()
 	header.Write(getbytes.FromInt64(nano))
 	header.Write(getbytes.FromUint64(uint64(rec.trigFrame)))
+	header.Write(getbytes.FromUint64(rec.recordSeq))
 
 	data := rawTypeToBytes(rec.data)
 	return [][]byte{header.Bytes(), data}
 }
 
+// batchHeaderVersion is the header version number (byte 2) that marks a batch message
+// on the records port; single records have version 1.
+const batchHeaderVersion = uint8(128)
+
+// messageRecordBatch packs several records of one channel into one message for
+// publishing on portTrigs, if config key PubRecordsBatch is true. Structure is defined in
+// BINARY_FORMATS.md. The first frame is a batch header:
+// uint16: channel number
+// uint8: header version number (batchHeaderVersion)
+// uint32: number of records N
+// end of first message packet
+// then the 2 frames of each record, exactly as messageRecords makes them (2N frames)
+func messageRecordBatch(records []*DataRecord) [][]byte {
+	header := new(bytes.Buffer)
+	header.Write(getbytes.FromUint16(uint16(records[0].channelIndex)))
+	header.Write(getbytes.FromUint8(batchHeaderVersion))
+	header.Write(getbytes.FromUint32(uint32(len(records))))
+	message := make([][]byte, 1, 1+2*len(records))
+	message[0] = header.Bytes()
+	for _, rec := range records {
+		message = append(message, messageRecords(rec)...)
+	}
+	return message
+}
+
 // Two library-global variables to allow sharing of zmq publisher sockets
 // PubRecordsChan is used to enable multiple different DataPublishers to publish on the same zmq pub socket
 var PubRecordsChan chan []*DataRecord
@@ -335,6 +803,42 @@ var PubRecordsChan chan []*DataRecord
 // PubSummariesChan is used to enable multiple different DataPublishers to publish on the same zmq pub socket
 var PubSummariesChan chan []*DataRecord
 
+// PubEnergiesChan is used to enable multiple different DataPublishers to publish on the same zmq pub socket
+var PubEnergiesChan chan []*DataRecord
+
+// bytesWrittenTotal counts the bytes of records written to data files by all channels
+// since Dastard started. Use sync/atomic to access it.
+var bytesWrittenTotal int64
+
+// Counts of records dropped since Dastard started because the queue of PubRecordsChan,
+// PubSummariesChan, or PubEnergiesChan was full. Use sync/atomic to access them.
+var pubRecordsQueueDropped, pubSummariesQueueDropped, pubEnergiesQueueDropped int64
+
+// PubQueueDropCounts holds the numbers of records not published because the queue to a
+// publisher goroutine was full. Messages that ZMQ itself discards at a socket's send
+// high-water mark are not counted (ZMQ doesn't report them); subscribers find those by
+// the gaps in the sequence numbers.
+type PubQueueDropCounts struct {
+	Records   int64
+	Summaries int64
+	Energies  int64
+	Multicast int64 // also counts summaries beyond the multicast MaxRate
+}
+
+// currentPubQueueDropCounts returns the numbers of records dropped from full publisher
+// queues since Dastard started.
+func currentPubQueueDropCounts() PubQueueDropCounts {
+	return PubQueueDropCounts{Records: atomic.LoadInt64(&pubRecordsQueueDropped),
+		Summaries: atomic.LoadInt64(&pubSummariesQueueDropped),
+		Energies:  atomic.LoadInt64(&pubEnergiesQueueDropped),
+		Multicast: atomic.LoadInt64(&multicastDropped)}
+}
+
+// defaultPubSendHWM is the send high-water mark of the record and summary PUB sockets,
+// unless config key PubSendHWM is positive. At 8x30 TDM we have 480 channels, so the
+// zmq default of 1000 caches only about 2 messages per channel.
+const defaultPubSendHWM = 3000
+
 // configurePubRecordsSocket should be run exactly one time.
 // It initializes PubFeederChan and launches a goroutine
 // that reads from PubFeederChan and publishes records on a ZMQ PUB socket at port PortTrigs.
@@ -344,7 +848,11 @@ func configurePubRecordsSocket() (err error) {
 	if PubRecordsChan != nil {
 		return fmt.Errorf("run configurePubRecordsSocket only one time")
 	}
-	PubRecordsChan, err = startSocket(Ports.Trigs, messageRecords)
+	var batch func([]*DataRecord) [][]byte
+	if viper.GetBool("pubrecordsbatch") {
+		batch = messageRecordBatch
+	}
+	PubRecordsChan, err = startSocket(Ports.Trigs, messageRecords, batch)
 	return
 }
 
@@ -353,29 +861,40 @@ func configurePubSummariesSocket() (err error) {
 	if PubSummariesChan != nil {
 		return fmt.Errorf("run configurePubSummariesSocket only one time")
 	}
-	PubSummariesChan, err = startSocket(Ports.Summaries, messageSummaries)
+	PubSummariesChan, err = startSocket(Ports.Summaries, messageSummaries, nil)
+	return
+}
+
+// configurePubEnergiesSocket should be run exactly one time; analogue of configurePubRecordsSocket
+func configurePubEnergiesSocket() (err error) {
+	if PubEnergiesChan != nil {
+		return fmt.Errorf("run configurePubEnergiesSocket only one time")
+	}
+	PubEnergiesChan, err = startSocket(Ports.Energies, messageEnergies, nil)
 	return
 }
 
 // startSocket sets up a ZMQ publisher socket and starts a goroutine to publish
 // messages based on any records that appear on a new channel. Returns the
 // channel for other routines to fill. Close that channel to destroy the socket.
+// If batch is not nil, each slice of 2 or more records (all from one channel and
+// segment) is published as the single message that batch makes.
 //
 // *** This looks like it could be replaced by PubChanneler, but tests show terrible
 // performance with Channeler ***
-func startSocket(port int, converter func(*DataRecord) [][]byte) (chan []*DataRecord, error) {
+func startSocket(port int, converter func(*DataRecord) [][]byte,
+	batch func([]*DataRecord) [][]byte) (chan []*DataRecord, error) {
 	const publishChannelDepth = 500
 	pubchan := make(chan []*DataRecord, publishChannelDepth)
-	hostname := fmt.Sprintf("tcp://*:%d", port)
-	pubSocket, err := czmq.NewPub(hostname)
-	pubSocket.SetSndhwm(3000) // not really sure how to choose this
-	// but at 8x30 TDM we have 480 channels, so we can only cache
-	// about 2 messages per channel at the default of 1000
-	// I think I was missing packets when using easyClient set to autotrigger
-	// with 0 delay and 5000 sample records as 160ns row time
+	pubSocket, err := newPubSocket(port)
 	if err != nil {
 		return nil, err
 	}
+	hwm := viper.GetInt("pubsendhwm")
+	if hwm <= 0 {
+		hwm = defaultPubSendHWM
+	}
+	pubSocket.SetSndhwm(hwm)
 	go func() {
 		defer pubSocket.Destroy()
 		for {
@@ -383,6 +902,12 @@ func startSocket(port int, converter func(*DataRecord) [][]byte) (chan []*DataRe
 			if !ok { // Destroy socket when pubchan is closed and drained
 				return
 			}
+			if batch != nil && len(records) > 1 {
+				if err := pubSocket.SendMessage(batch(records)); err != nil {
+					panic("zmq send error")
+				}
+				continue
+			}
 			for _, record := range records {
 				message := converter(record)
 				err := pubSocket.SendMessage(message)
@@ -32,6 +32,25 @@ func TestPublishData(t *testing.T) {
 	if dp.numberWritten != 3 {
 		t.Errorf("expected PublishData to increment numberWritten with LJH22 enabled")
 	}
+	dp.Flush()
+	stats := dp.WritingStats(1)
+	if stats.ChannelIndex != 1 || stats.RecordsWritten != 3 || stats.WriteErrors != 0 {
+		t.Errorf("WritingStats()=%+v, want 3 records and 0 errors in channel 1", stats)
+	}
+	if want := int64(3 * (16 + 2*len(d))); stats.BytesWritten != want {
+		t.Errorf("WritingStats().BytesWritten=%d, want %d", stats.BytesWritten, want)
+	}
+	if len(stats.FileNames) != 1 || stats.FileNames[0] != "TestPublishData.ljh" ||
+		len(stats.FileSizes) != 1 || stats.FileSizes[0] <= stats.BytesWritten {
+		t.Errorf("WritingStats() has FileNames %v and FileSizes %v", stats.FileNames, stats.FileSizes)
+	}
+	shortRec := &DataRecord{data: d[:4], presamples: 2}
+	if err := dp.PublishData([]*DataRecord{shortRec}); err != nil {
+		t.Error(err)
+	}
+	if stats = dp.WritingStats(1); stats.WriteErrors != 1 {
+		t.Errorf("WritingStats().WriteErrors=%d after a wrong-length record, want 1", stats.WriteErrors)
+	}
 	if !dp.HasLJH22() {
 		t.Error("HasLJH22() false, want true")
 	}
@@ -42,6 +61,9 @@ func TestPublishData(t *testing.T) {
 	if dp.numberWritten != 0 {
 		t.Errorf("expected RemoveLJH22 to set numberWritten to 0")
 	}
+	if stats = dp.WritingStats(1); stats.BytesWritten != 0 || stats.WriteErrors != 0 || len(stats.FileNames) != 0 {
+		t.Errorf("WritingStats()=%+v after RemoveLJH22, want all zero", stats)
+	}
 
 	if dp.HasPubRecords() {
 		t.Error("HasPubRecords() true, want false")
@@ -77,6 +99,19 @@ func TestPublishData(t *testing.T) {
 		t.Error("HasPubSummaries() true, want false")
 	}
 
+	if dp.HasPubEnergies() {
+		t.Error("HasPubEnergies() true, want false")
+	}
+	dp.SetPubEnergies()
+	if !dp.HasPubEnergies() {
+		t.Error("HasPubEnergies() false, want true")
+	}
+	dp.PublishData(records)
+	dp.RemovePubEnergies()
+	if dp.HasPubEnergies() {
+		t.Error("HasPubEnergies() true, want false")
+	}
+
 	dp.SetLJH3(0, 0, 0, 0, "TestPublishData.ljh3")
 	if err := dp.PublishData(records); err != nil {
 		t.Error("failed to publish record")
@@ -103,7 +138,7 @@ func TestPublishData(t *testing.T) {
 	projectors := mat.NewDense(nbases, nsamples, make([]float64, nbases*nsamples))
 	basis := mat.NewDense(nsamples, nbases, make([]float64, nbases*nsamples))
 	dp.SetOFF(0, 0, 0, 1, 1, time.Now(), 1, 1, 1, 1, 1, "TestPublishData.off", "sourceName",
-		"chanName", 1, projectors, basis, "ModelDescription")
+		"chanName", 1, projectors, basis, "ModelDescription", nil)
 	if err := dp.PublishData(records); err != nil {
 		t.Error(err)
 	}
@@ -124,12 +159,30 @@ func TestPublishData(t *testing.T) {
 		t.Error("HasOFF() true, want false")
 	}
 
+	// A full publisher queue must drop and count records, not block.
+	before := currentPubQueueDropCounts()
+	dpSlow := DataPublisher{PubRecordsChan: make(chan []*DataRecord), PubSummariesChan: make(chan []*DataRecord),
+		PubEnergiesChan: make(chan []*DataRecord), MulticastChan: make(chan []*DataRecord)}
+	if err := dpSlow.PublishData(records); err != nil {
+		t.Error(err)
+	}
+	after := currentPubQueueDropCounts()
+	if after.Records-before.Records != int64(len(records)) || after.Summaries-before.Summaries != int64(len(records)) ||
+		after.Energies-before.Energies != int64(len(records)) || after.Multicast-before.Multicast != int64(len(records)) {
+		t.Errorf("PublishData to full queues dropped %+v records, want %d of each",
+			PubQueueDropCounts{after.Records - before.Records, after.Summaries - before.Summaries,
+				after.Energies - before.Energies, after.Multicast - before.Multicast}, len(records))
+	}
+
 	if err := configurePubRecordsSocket(); err == nil {
 		t.Error("it should be an error to configurePubRecordsSocket twice")
 	}
 	if err := configurePubSummariesSocket(); err == nil {
 		t.Error("it should be an error to configurePubSummariesSocket twice")
 	}
+	if err := configurePubEnergiesSocket(); err == nil {
+		t.Error("it should be an error to configurePubEnergiesSocket twice")
+	}
 
 	rec = &DataRecord{data: d, presamples: 4}
 	for i, signed := range []bool{false, true} {
@@ -260,3 +313,79 @@ func BenchmarkPublish(b *testing.B) {
 		}
 	})
 }
+
+func TestMessageRecordBatch(t *testing.T) {
+	records := make([]*DataRecord, 3)
+	for i := range records {
+		records[i] = &DataRecord{data: []RawType{1, 2, 3, RawType(i)}, presamples: 2, channelIndex: 7,
+			trigFrame: FrameIndex(100 * i), trigTime: time.Now()}
+	}
+	msg := messageRecordBatch(records)
+	if len(msg) != 1+2*len(records) {
+		t.Fatalf("messageRecordBatch gives %d frames, want %d", len(msg), 1+2*len(records))
+	}
+	header := msg[0]
+	if len(header) != 7 || binary.LittleEndian.Uint16(header) != 7 || header[2] != batchHeaderVersion ||
+		binary.LittleEndian.Uint32(header[3:]) != uint32(len(records)) {
+		t.Errorf("messageRecordBatch header is %v, want channel 7, version %d, %d records",
+			header, batchHeaderVersion, len(records))
+	}
+	for i, rec := range records {
+		single := messageRecords(rec)
+		for j := range single {
+			if !bytes.Equal(msg[1+2*i+j], single[j]) {
+				t.Errorf("messageRecordBatch frame %d differs from frame %d of record %d alone", 1+2*i+j, j, i)
+			}
+		}
+	}
+}
+
+func TestPublishSequenceNumbers(t *testing.T) {
+	dp := DataPublisher{PubRecordsChan: make(chan []*DataRecord, 1), PubSummariesChan: make(chan []*DataRecord, 1),
+		thumbDecimation: 8}
+	dp.pubFilter.configure(&PublishFilterConfig{ChannelIndices: []int{0}, Types: PublishAutoOnly})
+	makeRecords := func(trigTypes ...string) []*DataRecord {
+		records := make([]*DataRecord, len(trigTypes))
+		for i, tt := range trigTypes {
+			records[i] = &DataRecord{trigType: tt}
+		}
+		return records
+	}
+	first := makeRecords(TriggerTypeAuto, TriggerTypeEdge, TriggerTypeAuto)
+	second := makeRecords(TriggerTypeAuto, TriggerTypeAuto) // dropped: the queues are full
+	third := makeRecords(TriggerTypeAuto)
+	dp.PublishData(first)
+	dp.PublishData(second)
+	<-dp.PubRecordsChan
+	<-dp.PubSummariesChan
+	dp.PublishData(third)
+
+	var summarySeqs, recordSeqs []uint64
+	for _, records := range [][]*DataRecord{first, second, third} {
+		for _, rec := range records {
+			if rec.thumbDecimation != 8 {
+				t.Errorf("PublishData set record thumbDecimation=%d, want 8", rec.thumbDecimation)
+			}
+			summarySeqs = append(summarySeqs, rec.summarySeq)
+			if rec.trigType == TriggerTypeAuto {
+				recordSeqs = append(recordSeqs, rec.recordSeq)
+			}
+		}
+	}
+	for i, seq := range summarySeqs {
+		if seq != uint64(i) {
+			t.Errorf("summary sequence numbers %v, want 0, 1, 2...", summarySeqs)
+			break
+		}
+	}
+	for i, seq := range recordSeqs {
+		if seq != uint64(i) {
+			t.Errorf("record sequence numbers of the published records %v, want 0, 1, 2...", recordSeqs)
+			break
+		}
+	}
+	published := <-dp.PubRecordsChan
+	if len(published) != 1 || published[0].recordSeq != 4 {
+		t.Errorf("after 2 records were dropped, the next published has sequence number %d, want 4", published[0].recordSeq)
+	}
+}
@@ -0,0 +1,111 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Allowed values of PublishFilterConfig.Types
+const (
+	PublishAllTypes    = "ALL"     // publish records of every trigger type
+	PublishAutoOnly    = "AUTO"    // publish only auto (noise) trigger records
+	PublishPrimaryOnly = "PRIMARY" // publish only records of the channel's own triggers, not group triggers
+)
+
+// PublishFilterConfig is the RPC-usable structure for ConfigurePublishFilter. It limits
+// which records are published on the records port (BASE+2), e.g. so a GUI gets only a
+// trickle of records from a channel triggering at kHz rates. Summaries and files are
+// not affected.
+type PublishFilterConfig struct {
+	ChannelIndices []int
+	ChannelGroups  []string
+	MaxRate        float64 // records per second; 0 means no limit
+	Types          string  // ALL (the default), AUTO, or PRIMARY
+}
+
+// validate checks the config for errors and normalizes its Types.
+func (config *PublishFilterConfig) validate() error {
+	if len(config.ChannelIndices) == 0 {
+		return fmt.Errorf("PublishFilterConfig has no ChannelIndices")
+	}
+	if config.MaxRate < 0 || math.IsNaN(config.MaxRate) || math.IsInf(config.MaxRate, 0) {
+		return fmt.Errorf("PublishFilterConfig MaxRate=%v, need finite and >= 0", config.MaxRate)
+	}
+	config.Types = strings.ToUpper(config.Types)
+	switch config.Types {
+	case "":
+		config.Types = PublishAllTypes
+	case PublishAllTypes, PublishAutoOnly, PublishPrimaryOnly:
+	default:
+		return fmt.Errorf("PublishFilterConfig Types=%q, need one of (%s, %s, %s)", config.Types,
+			PublishAllTypes, PublishAutoOnly, PublishPrimaryOnly)
+	}
+	return nil
+}
+
+// publishFilter chooses the records of one channel to publish on the records port.
+type publishFilter struct {
+	types      string
+	minSpacing time.Duration // least trigger time between published records; 0 means any
+	lastTime   time.Time     // trigger time of the last published record
+}
+
+// configure sets the filter from a valid config, and forgets the last published record.
+func (pf *publishFilter) configure(config *PublishFilterConfig) {
+	pf.types = config.Types
+	pf.minSpacing = 0
+	if config.MaxRate > 0 {
+		pf.minSpacing = time.Duration(float64(time.Second) / config.MaxRate)
+	}
+	pf.lastTime = time.Time{}
+}
+
+// active returns whether the filter removes any records.
+func (pf *publishFilter) active() bool {
+	return pf.minSpacing > 0 || (pf.types != "" && pf.types != PublishAllTypes)
+}
+
+// filter returns the records that pass, in a new slice. Records of the wrong type are
+// removed, then records are subsampled so their trigger times are at least minSpacing apart.
+func (pf *publishFilter) filter(records []*DataRecord) []*DataRecord {
+	passed := make([]*DataRecord, 0, len(records))
+	for _, rec := range records {
+		switch pf.types {
+		case PublishAutoOnly:
+			if rec.trigType != TriggerTypeAuto {
+				continue
+			}
+		case PublishPrimaryOnly:
+			if rec.trigType == TriggerTypeSecondary {
+				continue
+			}
+		}
+		if pf.minSpacing > 0 && !pf.lastTime.IsZero() {
+			// A record earlier than the last one means the data were resynchronized; start over.
+			if dt := rec.trigTime.Sub(pf.lastTime); dt >= 0 && dt < pf.minSpacing {
+				continue
+			}
+		}
+		pf.lastTime = rec.trigTime
+		passed = append(passed, rec)
+	}
+	return passed
+}
+
+// ConfigurePublishFilter sets which records of 1 or more channels are published on the records port.
+func (ds *AnySource) ConfigurePublishFilter(config *PublishFilterConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].DataPublisher.pubFilter.configure(config)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishFilter(t *testing.T) {
+	t0 := time.Now()
+	var records []*DataRecord
+	for i := 0; i < 100; i++ {
+		trigType := TriggerTypeEdge
+		if i%10 == 0 {
+			trigType = TriggerTypeAuto
+		} else if i%10 == 5 {
+			trigType = TriggerTypeSecondary
+		}
+		records = append(records, &DataRecord{trigTime: t0.Add(time.Duration(i) * time.Millisecond),
+			trigType: trigType})
+	}
+
+	var pf publishFilter
+	if pf.active() {
+		t.Error("zero-value publishFilter should not be active")
+	}
+	config := &PublishFilterConfig{ChannelIndices: []int{0}, Types: "auto"}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	pf.configure(config)
+	if passed := pf.filter(records); len(passed) != 10 {
+		t.Errorf("AUTO filter passed %d records, want 10", len(passed))
+	}
+
+	config.Types = PublishPrimaryOnly
+	pf.configure(config)
+	if passed := pf.filter(records); len(passed) != 90 {
+		t.Errorf("PRIMARY filter passed %d records, want 90", len(passed))
+	}
+
+	// 1000 records/sec spread over 100 ms; a cap of 50/sec passes 1 per 20 ms.
+	config.Types = PublishAllTypes
+	config.MaxRate = 50
+	pf.configure(config)
+	passed := pf.filter(records[:50])
+	passed = append(passed, pf.filter(records[50:])...)
+	if len(passed) != 5 {
+		t.Errorf("MaxRate filter passed %d records, want 5", len(passed))
+	}
+	for i := 1; i < len(passed); i++ {
+		if dt := passed[i].trigTime.Sub(passed[i-1].trigTime); dt < 20*time.Millisecond {
+			t.Errorf("MaxRate filter passed records %v apart, want >= 20 ms", dt)
+		}
+	}
+	// Records from before the last one (after a resync) restart the subsampling.
+	if passed := pf.filter(records[:1]); len(passed) != 1 {
+		t.Errorf("MaxRate filter passed %d earlier records, want 1", len(passed))
+	}
+
+	config.MaxRate = 0
+	pf.configure(config)
+	if pf.active() {
+		t.Error("publishFilter with all types and no MaxRate should not be active")
+	}
+
+	bad := []PublishFilterConfig{
+		{MaxRate: 10},
+		{ChannelIndices: []int{0}, MaxRate: -1},
+		{ChannelIndices: []int{0}, Types: "edge"},
+	}
+	for i, config := range bad {
+		if err := config.validate(); err == nil {
+			t.Errorf("bad config %d %+v passed validate", i, config)
+		}
+	}
+
+	// Publishing applies the filter to records only, not to summaries.
+	dp := DataPublisher{PubRecordsChan: make(chan []*DataRecord, 1), PubSummariesChan: make(chan []*DataRecord, 1)}
+	config = &PublishFilterConfig{ChannelIndices: []int{0}, Types: PublishAutoOnly}
+	config.validate()
+	dp.pubFilter.configure(config)
+	if err := dp.PublishData(records); err != nil {
+		t.Fatal(err)
+	}
+	if published := <-dp.PubRecordsChan; len(published) != 10 {
+		t.Errorf("PublishData with AUTO filter published %d records, want 10", len(published))
+	}
+	if published := <-dp.PubSummariesChan; len(published) != len(records) {
+		t.Errorf("PublishData with AUTO filter published %d summaries, want %d", len(published), len(records))
+	}
+
+	ds := AnySource{nchan: 2}
+	ds.PrepareRun(256, 1024)
+	defer ds.broker.Stop()
+	if err := ds.ConfigurePublishFilter(&PublishFilterConfig{ChannelIndices: []int{2}}); err == nil {
+		t.Error("ConfigurePublishFilter should fail with an out-of-range channel")
+	}
+	if err := ds.ConfigurePublishFilter(&PublishFilterConfig{ChannelIndices: []int{1}, MaxRate: 4}); err != nil {
+		t.Error(err)
+	}
+	if pf := ds.processors[1].pubFilter; pf.minSpacing != 250*time.Millisecond || pf.types != PublishAllTypes {
+		t.Errorf("ConfigurePublishFilter set channel 1 filter to %+v", pf)
+	}
+	if ds.processors[0].pubFilter.active() {
+		t.Error("ConfigurePublishFilter changed channel 0")
+	}
+}
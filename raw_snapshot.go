@@ -0,0 +1,204 @@
+package dastard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rawSnapshotTTL is how long a snapshot waits to be fetched before it is discarded.
+const rawSnapshotTTL = time.Minute
+
+// maxRawSnapshots is the most snapshots that can wait to be fetched at once.
+const maxRawSnapshots = 4
+
+// RawSnapshotConfig is the RPC-usable structure for FetchRawSnapshot.
+type RawSnapshotConfig struct {
+	Channels []int   // channel indices; empty means all enabled channels
+	Seconds  float64 // how much of the most recent data to export
+}
+
+// RawSnapshotInfo describes a raw snapshot taken by FetchRawSnapshot. Its data are fetched
+// once by an HTTP GET of Path on the HTTP gateway, before Expires. The body is each
+// channel's samples in turn, as little-endian 16-bit integers: Samples[i] of them for
+// Channels[i], the first from frame FirstFrame[i]. All channels end at the same frame.
+// The samples are not decimated, even if the channel is, so FramesPerSample is 1 unless
+// the source itself packs several frames per sample.
+type RawSnapshotInfo struct {
+	Path            string
+	Expires         time.Time
+	Bytes           int
+	SampleRate      float64 // frames per second
+	Channels        []int
+	ChannelNames    []string
+	Samples         []int
+	FirstFrame      []FrameIndex
+	FirstTime       []time.Time
+	FramesPerSample []int
+	Signed          []bool
+	VoltsPerArb     []float32
+}
+
+// rawSnapshotStore holds snapshots until they are fetched or expire.
+type rawSnapshotStore struct {
+	byID       map[string]*rawSnapshot
+	sync.Mutex // protects byID
+}
+
+type rawSnapshot struct {
+	data    []byte
+	expires time.Time
+}
+
+var rawSnapshots = rawSnapshotStore{byID: make(map[string]*rawSnapshot)}
+
+// add stores data as a new snapshot and returns its ID and expiration time.
+func (s *rawSnapshotStore) add(data []byte) (string, time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for id, snap := range s.byID {
+		if now.After(snap.expires) {
+			delete(s.byID, id)
+		}
+	}
+	if len(s.byID) >= maxRawSnapshots {
+		return "", time.Time{}, fmt.Errorf("%d raw snapshots are waiting to be fetched already", len(s.byID))
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	id := hex.EncodeToString(b)
+	expires := now.Add(rawSnapshotTTL)
+	s.byID[id] = &rawSnapshot{data: data, expires: expires}
+	return id, expires, nil
+}
+
+// take removes and returns the data of an unexpired snapshot.
+func (s *rawSnapshotStore) take(id string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	snap, ok := s.byID[id]
+	if !ok {
+		return nil, false
+	}
+	delete(s.byID, id)
+	if time.Now().After(snap.expires) {
+		return nil, false
+	}
+	return snap.data, true
+}
+
+// rawHistory returns the channel's recent samples as they came from the source: the
+// undecimatedData while decimating, else the recentData.
+func (dsp *DataStreamProcessor) rawHistory() *triggerHistory {
+	if dsp.Decimate && dsp.DecimateLevel > 1 {
+		return &dsp.undecimatedData
+	}
+	return &dsp.recentData
+}
+
+// RawSnapshot copies the most recent config.Seconds of the chosen channels' raw data,
+// as kept for PreviewTriggers (config keys TriggerPreviewSeconds and RawSnapshotSeconds)
+// but before any decimation, to a snapshot that waits to be fetched on the HTTP gateway.
+// Every channel's data end at the last frame that all of them have. By default, all
+// enabled channels are chosen, as a disabled channel's recent data stop when it is disabled.
+func (ds *AnySource) RawSnapshot(config *RawSnapshotConfig) (*RawSnapshotInfo, error) {
+	if !(config.Seconds > 0) {
+		return nil, fmt.Errorf("RawSnapshotConfig.Seconds=%v, need >0", config.Seconds)
+	}
+	channels := config.Channels
+	if len(channels) == 0 {
+		for i, dsp := range ds.processors {
+			if !dsp.disabled {
+				channels = append(channels, i)
+			}
+		}
+		if len(channels) == 0 {
+			return nil, fmt.Errorf("all channels are disabled")
+		}
+	}
+	histories := make([]*triggerHistory, len(channels))
+	var endFrame FrameIndex
+	for i, channelIndex := range channels {
+		if channelIndex < 0 || channelIndex >= len(ds.processors) {
+			return nil, fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, len(ds.processors))
+		}
+		dsp := ds.processors[channelIndex]
+		if dsp.disabled {
+			return nil, fmt.Errorf("channel %d is disabled", channelIndex)
+		}
+		h := dsp.rawHistory()
+		if len(h.rawData) == 0 {
+			return nil, fmt.Errorf("channel %d has no recent data (see config key RawSnapshotSeconds)", channelIndex)
+		}
+		end := h.firstFramenum + FrameIndex(len(h.rawData)*h.framesPerSample)
+		if i == 0 || end < endFrame {
+			endFrame = end
+		}
+		histories[i] = h
+	}
+
+	info := &RawSnapshotInfo{SampleRate: ds.sampleRate, Channels: channels}
+	var data []byte
+	for i, channelIndex := range channels {
+		dsp := ds.processors[channelIndex]
+		h := histories[i]
+		last := 0 // the samples before last end by endFrame
+		if endFrame > h.firstFramenum {
+			last = int(endFrame-h.firstFramenum) / h.framesPerSample
+		}
+		if last == 0 || h.firstFramenum+FrameIndex(last*h.framesPerSample) != endFrame {
+			return nil, fmt.Errorf("channel %d has no recent data ending at frame %d, where the other channels' data end",
+				channelIndex, endFrame)
+		}
+		n := last
+		if want := int(math.Ceil(config.Seconds * dsp.SampleRate / float64(h.framesPerSample))); want < n {
+			n = want
+		}
+		skipFrames := (last - n) * h.framesPerSample
+		info.ChannelNames = append(info.ChannelNames, dsp.Name)
+		info.Samples = append(info.Samples, n)
+		info.FirstFrame = append(info.FirstFrame, h.firstFramenum+FrameIndex(skipFrames))
+		info.FirstTime = append(info.FirstTime, h.firstTime.Add(time.Duration(skipFrames)*h.framePeriod))
+		info.FramesPerSample = append(info.FramesPerSample, h.framesPerSample)
+		info.Signed = append(info.Signed, h.signed)
+		info.VoltsPerArb = append(info.VoltsPerArb, h.voltsPerArb)
+		data = append(data, rawTypeToBytes(h.rawData[last-n:last])...)
+	}
+	id, expires, err := rawSnapshots.add(data)
+	if err != nil {
+		return nil, err
+	}
+	info.Path = "/snapshot/" + id
+	info.Expires = expires
+	info.Bytes = len(data)
+	return info, nil
+}
+
+// rawSnapshotHandler serves each raw snapshot once, to a GET of /snapshot/<id>.
+type rawSnapshotHandler struct{}
+
+func (rawSnapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/snapshot/"), "/")
+	data, ok := rawSnapshots.take(id)
+	if !ok {
+		http.Error(w, "no such raw snapshot, or it was fetched already or expired", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
@@ -0,0 +1,174 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRawSnapshot(t *testing.T) {
+	ds := AnySource{nchan: 2, sampleRate: 1000}
+	t0 := time.Now()
+	for i := 0; i < 2; i++ {
+		dsp := NewDataStreamProcessor(i, nil, 10, 50)
+		dsp.SampleRate = 1000
+		dsp.recentData.seconds = 5
+		data := make([]RawType, 3000)
+		for j := range data {
+			data[j] = RawType(j + 10000*i)
+		}
+		dsp.recentData.add(NewDataSegment(data, 1, 100, t0, time.Millisecond), dsp.SampleRate)
+		ds.processors = append(ds.processors, dsp)
+	}
+
+	info, err := ds.RawSnapshot(&RawSnapshotConfig{Channels: []int{1, 0}, Seconds: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Bytes != 8000 || len(info.Samples) != 2 || info.Samples[0] != 2000 || info.Samples[1] != 2000 {
+		t.Fatalf("RawSnapshot has %d bytes and samples %v, want 8000 and [2000 2000]", info.Bytes, info.Samples)
+	}
+	if info.FirstFrame[0] != 1100 || !info.FirstTime[0].Equal(t0.Add(time.Second)) {
+		t.Errorf("RawSnapshot starts at frame %d time %v, want 1100 and %v", info.FirstFrame[0], info.FirstTime[0],
+			t0.Add(time.Second))
+	}
+
+	// Fetch the snapshot once through the HTTP handler.
+	server := httptest.NewServer(rawSnapshotHandler{})
+	defer server.Close()
+	resp, err := http.Get(server.URL + info.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(body) != info.Bytes {
+		t.Fatalf("GET %s returned status %d and %d bytes, want 200 and %d", info.Path, resp.StatusCode,
+			len(body), info.Bytes)
+	}
+	samples := bytesToRawType(body)
+	if samples[0] != 11000 || samples[1999] != 12999 || samples[2000] != 1000 || samples[3999] != 2999 {
+		t.Errorf("snapshot samples %d %d %d %d, want 11000 12999 1000 2999", samples[0], samples[1999],
+			samples[2000], samples[3999])
+	}
+	if resp, err = http.Get(server.URL + info.Path); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second GET of a snapshot returned status %d, want 404", resp.StatusCode)
+	}
+
+	// Asking for more than is kept returns all of it.
+	info, err = ds.RawSnapshot(&RawSnapshotConfig{Seconds: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Samples[0] != 3000 || info.FirstFrame[1] != 100 || len(info.Channels) != 2 {
+		t.Errorf("RawSnapshot of all channels has samples %v from frames %v", info.Samples, info.FirstFrame)
+	}
+	if _, ok := rawSnapshots.take(info.Path[len("/snapshot/"):]); !ok {
+		t.Error("rawSnapshots.take could not find a new snapshot")
+	}
+
+	// Data that not every channel has yet are left out.
+	ds.processors[1].recentData.add(NewDataSegment(make([]RawType, 500), 1, 3100, t0.Add(3*time.Second),
+		time.Millisecond), 1000)
+	info, err = ds.RawSnapshot(&RawSnapshotConfig{Channels: []int{1, 0}, Seconds: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Samples[0] != 3000 || info.Samples[1] != 3000 || info.FirstFrame[0] != 100 {
+		t.Errorf("RawSnapshot of channels ending at different frames has samples %v from frames %v, want 3000 from 100",
+			info.Samples, info.FirstFrame)
+	}
+	rawSnapshots.take(info.Path[len("/snapshot/"):])
+
+	ds.processors[1].setDisabled(true)
+	if info, err = ds.RawSnapshot(&RawSnapshotConfig{Seconds: 1}); err != nil || len(info.Channels) != 1 {
+		t.Errorf("RawSnapshot of all enabled channels returned %v, %v, want only channel 0", info, err)
+	} else {
+		rawSnapshots.take(info.Path[len("/snapshot/"):])
+	}
+	if _, err = ds.RawSnapshot(&RawSnapshotConfig{Channels: []int{1}, Seconds: 1}); err == nil {
+		t.Error("RawSnapshot of a disabled channel should fail")
+	}
+	ds.processors[1].setDisabled(false)
+
+	for _, config := range []RawSnapshotConfig{{Seconds: 0}, {Channels: []int{2}, Seconds: 1}} {
+		if _, err := ds.RawSnapshot(&config); err == nil {
+			t.Errorf("RawSnapshot(%v) should fail", config)
+		}
+	}
+	ds.processors[0].recentData = triggerHistory{}
+	if _, err := ds.RawSnapshot(&RawSnapshotConfig{Seconds: 1}); err == nil {
+		t.Error("RawSnapshot of a channel without recent data should fail")
+	}
+}
+
+// TestRawSnapshotDecimated checks that a raw snapshot of a decimated channel holds the
+// samples from before decimation.
+func TestRawSnapshotDecimated(t *testing.T) {
+	dsp := NewDataStreamProcessor(0, nil, 10, 50)
+	dsp.SampleRate = 1000
+	dsp.Decimate = true
+	dsp.DecimateLevel = 4
+	dsp.recentData.seconds = 5
+	dsp.undecimatedData.seconds = 5
+	data := make([]RawType, 1000)
+	for i := range data {
+		data[i] = RawType(i)
+	}
+	segment := NewDataSegment(data, 1, 0, time.Now(), time.Millisecond)
+	dsp.keepUndecimatedData(segment)
+	dsp.DecimateData(segment)
+	dsp.recentData.add(segment, dsp.SampleRate)
+	ds := AnySource{nchan: 1, sampleRate: 1000, processors: []*DataStreamProcessor{dsp}}
+
+	info, err := ds.RawSnapshot(&RawSnapshotConfig{Seconds: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _ := rawSnapshots.take(info.Path[len("/snapshot/"):])
+	samples := bytesToRawType(snapshot)
+	if info.Samples[0] != 1000 || info.FramesPerSample[0] != 1 || samples[1] != 1 || samples[999] != 999 {
+		t.Errorf("RawSnapshot of a decimated channel has %d samples of %d frames, samples[1,999]=%d,%d",
+			info.Samples[0], info.FramesPerSample[0], samples[1], samples[999])
+	}
+
+	dsp.Decimate = false
+	dsp.keepUndecimatedData(NewDataSegment(data, 1, 1000, time.Now(), time.Millisecond))
+	if dsp.undecimatedData.rawData != nil {
+		t.Error("keepUndecimatedData kept samples of a channel that is not decimating")
+	}
+}
+
+func TestRawSnapshotStore(t *testing.T) {
+	store := rawSnapshotStore{byID: make(map[string]*rawSnapshot)}
+	ids := make([]string, 0)
+	for i := 0; i < maxRawSnapshots; i++ {
+		id, _, err := store.add([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, _, err := store.add(nil); err == nil {
+		t.Errorf("rawSnapshotStore.add should fail with %d snapshots waiting", maxRawSnapshots)
+	}
+	store.byID[ids[0]].expires = time.Now().Add(-time.Second)
+	if _, ok := store.take(ids[0]); ok {
+		t.Error("rawSnapshotStore.take returned an expired snapshot")
+	}
+	if data, ok := store.take(ids[1]); !ok || data[0] != 1 {
+		t.Errorf("rawSnapshotStore.take returned %v, %v, want [1], true", data, ok)
+	}
+	if _, ok := store.take("nosuchid"); ok {
+		t.Error("rawSnapshotStore.take returned a snapshot for an unknown ID")
+	}
+}
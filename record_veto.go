@@ -0,0 +1,78 @@
+package dastard
+
+import (
+	"fmt"
+)
+
+// VetoState contains the cuts on pretrigger baseline quality for one channel.
+// Records that fail any cut are counted, then dropped before publishing or writing.
+// A cut of 0 is not applied.
+type VetoState struct {
+	VetoEnabled         bool
+	VetoMaxPretrigRMS   float64 // largest allowed rms of the pretrigger samples about their mean
+	VetoMaxPretrigSlope float64 // largest allowed |slope| of the pretrigger samples (arbs per sample)
+
+	vetoCount int // records vetoed since the cuts were configured
+}
+
+// RecordVetoConfig is the RPC-usable structure for ConfigureRecordVeto.
+type RecordVetoConfig struct {
+	ChannelIndices  []int
+	Enable          bool
+	MaxPretrigRMS   float64
+	MaxPretrigSlope float64
+}
+
+// validate checks the config for errors.
+func (config *RecordVetoConfig) validate() error {
+	if len(config.ChannelIndices) == 0 {
+		return fmt.Errorf("RecordVetoConfig has no ChannelIndices")
+	}
+	if config.MaxPretrigRMS < 0 {
+		return fmt.Errorf("record veto MaxPretrigRMS=%v, need >= 0", config.MaxPretrigRMS)
+	}
+	if config.MaxPretrigSlope < 0 {
+		return fmt.Errorf("record veto MaxPretrigSlope=%v, need >= 0", config.MaxPretrigSlope)
+	}
+	return nil
+}
+
+// ConfigureRecordVeto sets this stream's veto cuts and resets its veto count.
+func (dsp *DataStreamProcessor) ConfigureRecordVeto(config *RecordVetoConfig) {
+	dsp.VetoEnabled = config.Enable
+	dsp.VetoMaxPretrigRMS = config.MaxPretrigRMS
+	dsp.VetoMaxPretrigSlope = config.MaxPretrigSlope
+	dsp.vetoCount = 0
+}
+
+// vetoed returns whether an analyzed record fails the veto cuts.
+func (vs *VetoState) vetoed(rec *DataRecord) bool {
+	if !vs.VetoEnabled {
+		return false
+	}
+	if vs.VetoMaxPretrigRMS > 0 && rec.pretrigRMS > vs.VetoMaxPretrigRMS {
+		return true
+	}
+	if vs.VetoMaxPretrigSlope > 0 && (rec.pretrigSlope > vs.VetoMaxPretrigSlope ||
+		rec.pretrigSlope < -vs.VetoMaxPretrigSlope) {
+		return true
+	}
+	return false
+}
+
+// VetoRecords counts and removes the records that fail the veto cuts. The records
+// must already be analyzed. The filtering is done in place.
+func (dsp *DataStreamProcessor) VetoRecords(records []*DataRecord) []*DataRecord {
+	if !dsp.VetoEnabled {
+		return records
+	}
+	kept := records[:0]
+	for _, rec := range records {
+		if dsp.vetoed(rec) {
+			dsp.vetoCount++
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	return kept
+}
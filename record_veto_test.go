@@ -0,0 +1,55 @@
+package dastard
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRecordVeto(t *testing.T) {
+	dsp := NewDataStreamProcessor(0, nil, 4, 8)
+	flat := &DataRecord{data: []RawType{100, 100, 100, 100, 200, 300, 200, 100}, presamples: 4}
+	noisy := &DataRecord{data: []RawType{90, 110, 90, 110, 200, 300, 200, 100}, presamples: 4}
+	sloped := &DataRecord{data: []RawType{100, 102, 104, 106, 200, 300, 200, 100}, presamples: 4}
+	dsp.AnalyzeData([]*DataRecord{flat, noisy, sloped})
+	if flat.pretrigRMS != 0 || flat.pretrigSlope != 0 {
+		t.Errorf("flat record has pretrigRMS=%v, pretrigSlope=%v, want 0, 0", flat.pretrigRMS, flat.pretrigSlope)
+	}
+	if math.Abs(noisy.pretrigRMS-10) > 1e-9 {
+		t.Errorf("noisy record has pretrigRMS=%v, want 10", noisy.pretrigRMS)
+	}
+	if math.Abs(sloped.pretrigSlope-2) > 1e-9 {
+		t.Errorf("sloped record has pretrigSlope=%v, want 2", sloped.pretrigSlope)
+	}
+
+	records := []*DataRecord{flat, noisy, sloped}
+	if kept := dsp.VetoRecords(records); len(kept) != 3 || dsp.vetoCount != 0 {
+		t.Errorf("VetoRecords kept %d records and vetoed %d with veto disabled, want 3 and 0", len(kept), dsp.vetoCount)
+	}
+
+	config := RecordVetoConfig{ChannelIndices: []int{0}, Enable: true, MaxPretrigRMS: 5, MaxPretrigSlope: 1}
+	if err := config.validate(); err != nil {
+		t.Error(err)
+	}
+	dsp.ConfigureRecordVeto(&config)
+	kept := dsp.VetoRecords([]*DataRecord{flat, noisy, sloped})
+	if len(kept) != 1 || kept[0] != flat || dsp.vetoCount != 2 {
+		t.Errorf("VetoRecords kept %d records and vetoed %d, want 1 and 2", len(kept), dsp.vetoCount)
+	}
+
+	// A cut of 0 is not applied.
+	config.MaxPretrigSlope = 0
+	dsp.ConfigureRecordVeto(&config)
+	if kept := dsp.VetoRecords([]*DataRecord{flat, noisy, sloped}); len(kept) != 2 || dsp.vetoCount != 1 {
+		t.Errorf("VetoRecords kept %d records and vetoed %d with no slope cut, want 2 and 1", len(kept), dsp.vetoCount)
+	}
+
+	for _, bad := range []RecordVetoConfig{
+		{ChannelIndices: []int{}, Enable: true},
+		{ChannelIndices: []int{0}, Enable: true, MaxPretrigRMS: -1},
+		{ChannelIndices: []int{0}, Enable: true, MaxPretrigSlope: -1},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("RecordVetoConfig %+v should fail validation", bad)
+		}
+	}
+}
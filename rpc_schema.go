@@ -0,0 +1,175 @@
+package dastard
+
+import (
+	"encoding/json"
+	"go/token"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JSONSchema is a JSON Schema describing the JSON encoding of one Go type. Only the
+// keywords needed to describe Dastard's RPC arguments and replies are used.
+type JSONSchema struct {
+	Title                string                 `json:"title,omitempty"` // the Go type name, if any
+	Type                 string                 `json:"type,omitempty"`  // "" allows any value
+	Format               string                 `json:"format,omitempty"`
+	Nullable             bool                   `json:"nullable,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"` // the Title of a type being described
+}
+
+// MethodDescription describes one RPC method, as reported by ListMethods.
+type MethodDescription struct {
+	Name  string // e.g., "SourceControl.Start"
+	Args  *JSONSchema
+	Reply *JSONSchema
+}
+
+var (
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	marshalType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// ListMethods returns every method that the RPC server offers, with JSON schemas of
+// its argument and reply, so clients can check their calls and build controls for them.
+func (s *SourceControl) ListMethods(dummy *string, reply *[]MethodDescription) error {
+	*reply = append(rpcMethods(s), rpcMethods(&MapServer{})...)
+	*reply = append(*reply, rpcMethods(&StatusQuery{})...)
+	return nil
+}
+
+// rpcMethods describes the methods of rcvr that net/rpc would register, in name order.
+func rpcMethods(rcvr interface{}) []MethodDescription {
+	rtype := reflect.TypeOf(rcvr)
+	rname := reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name()
+	methods := make([]MethodDescription, 0)
+	for i := 0; i < rtype.NumMethod(); i++ {
+		m := rtype.Method(i)
+		mtype := m.Type
+		if m.PkgPath != "" || mtype.NumIn() != 3 || mtype.NumOut() != 1 || mtype.Out(0) != errorType {
+			continue
+		}
+		argType, replyType := mtype.In(1), mtype.In(2)
+		if replyType.Kind() != reflect.Ptr || !isExportedOrBuiltin(argType) || !isExportedOrBuiltin(replyType) {
+			continue
+		}
+		methods = append(methods, MethodDescription{Name: rname + "." + m.Name,
+			Args: schemaOf(argType, nil), Reply: schemaOf(replyType.Elem(), nil)})
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+	return methods
+}
+
+// isExportedOrBuiltin returns whether net/rpc accepts t as an argument or reply type.
+func isExportedOrBuiltin(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.PkgPath() == "" || token.IsExported(t.Name())
+}
+
+// schemaOf returns the schema of the JSON encoding of type t. The named struct types in
+// inProgress are already being described, so they appear as a $ref to end any recursion.
+func schemaOf(t reflect.Type, inProgress map[reflect.Type]bool) *JSONSchema {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t, nullable = t.Elem(), true
+	}
+	schema := &JSONSchema{Title: t.Name(), Nullable: nullable}
+	switch {
+	case t == timeType:
+		schema.Type, schema.Format = "string", "date-time"
+		return schema
+	case t == durationType:
+		schema.Type, schema.Format = "integer", "nanoseconds"
+		return schema
+	case t.Implements(marshalType) || reflect.PtrTo(t).Implements(marshalType):
+		return schema // custom encoding: any value
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		schema.Type = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema.Type = "integer"
+	case reflect.Float32, reflect.Float64:
+		schema.Type = "number"
+	case reflect.String:
+		schema.Type = "string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			schema.Type, schema.Format = "string", "base64"
+			break
+		}
+		schema.Type = "array"
+		schema.Nullable = schema.Nullable || t.Kind() == reflect.Slice
+		schema.Items = schemaOf(t.Elem(), inProgress)
+	case reflect.Map:
+		schema.Type = "object"
+		schema.Nullable = true
+		schema.AdditionalProperties = schemaOf(t.Elem(), inProgress)
+	case reflect.Struct:
+		if inProgress[t] {
+			return &JSONSchema{Ref: t.Name(), Nullable: nullable}
+		}
+		if t.Name() != "" {
+			if inProgress == nil {
+				inProgress = make(map[reflect.Type]bool)
+			}
+			inProgress[t] = true
+			defer delete(inProgress, t)
+		}
+		schema.Type = "object"
+		schema.Properties = make(map[string]*JSONSchema)
+		addProperties(schema, t, inProgress)
+	}
+	return schema
+}
+
+// addProperties adds the JSON-encoded fields of struct type t to schema's properties,
+// including the promoted fields of embedded structs, as encoding/json does.
+func addProperties(schema *JSONSchema, t reflect.Type, inProgress map[reflect.Type]bool) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			ftype := field.Type
+			for ftype.Kind() == reflect.Ptr {
+				ftype = ftype.Elem()
+			}
+			if ftype.Kind() == reflect.Struct {
+				embedded = append(embedded, ftype)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = schemaOf(field.Type, inProgress)
+	}
+	// Fields of embedded structs are hidden by fields of the same name at a shallower depth.
+	for _, etype := range embedded {
+		promoted := &JSONSchema{Properties: make(map[string]*JSONSchema)}
+		addProperties(promoted, etype, inProgress)
+		for name, p := range promoted.Properties {
+			if _, ok := schema.Properties[name]; !ok {
+				schema.Properties[name] = p
+			}
+		}
+	}
+}
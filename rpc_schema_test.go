@@ -0,0 +1,96 @@
+package dastard
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListMethods(t *testing.T) {
+	var s SourceControl
+	var methods []MethodDescription
+	if err := s.ListMethods(nil, &methods); err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]MethodDescription)
+	for _, m := range methods {
+		byName[m.Name] = m
+	}
+	for _, name := range []string{"SourceControl.Start", "SourceControl.ListMethods",
+		"SourceControl.ConfigurePulseLengths", "MapServer.Load"} {
+		if _, ok := byName[name]; !ok {
+			t.Errorf("ListMethods() does not list %s", name)
+		}
+	}
+	for _, name := range []string{"SourceControl.broadcastStatus", "SourceControl.runLaterIfActive",
+		"SourceControl.handlePossibleStoppedSource"} {
+		if _, ok := byName[name]; ok {
+			t.Errorf("ListMethods() lists %s, which is not an RPC method", name)
+		}
+	}
+
+	start := byName["SourceControl.Start"]
+	if start.Args.Type != "string" || !start.Args.Nullable || start.Reply.Type != "boolean" {
+		t.Errorf("Start has args %+v and reply %+v, want a string and a boolean", start.Args, start.Reply)
+	}
+	wc := byName["SourceControl.WriteControl"].Reply
+	if wc.Title != "WriteControlReply" || wc.Type != "object" || wc.Properties["RunDirectory"].Type != "string" {
+		t.Errorf("WriteControl reply schema is %+v", wc)
+	}
+	triggers := byName["SourceControl.ConfigureTriggers"].Args
+	if p := triggers.Properties["ChannelIndicies"]; p == nil || p.Type != "array" || p.Items.Type != "integer" {
+		t.Errorf("ConfigureTriggers ChannelIndicies schema is %+v", p)
+	}
+	if p := triggers.Properties["AutoDelay"]; p == nil || p.Type != "integer" || p.Format != "nanoseconds" {
+		t.Errorf("ConfigureTriggers argument lacks the embedded TriggerState field AutoDelay: %+v", p)
+	}
+	if _, ok := triggers.Properties["TriggerState"]; ok {
+		t.Error("ConfigureTriggers argument has a TriggerState property; embedded fields should be promoted")
+	}
+	if _, err := json.Marshal(methods); err != nil {
+		t.Errorf("ListMethods() reply cannot be encoded as JSON: %v", err)
+	}
+}
+
+func TestSchemaOf(t *testing.T) {
+	type inner struct {
+		Name  string
+		Count int
+	}
+	type node struct {
+		inner
+		Name     float64 // hides inner.Name
+		Tagged   bool    `json:"tagged,omitempty"`
+		Skipped  bool    `json:"-"`
+		hidden   bool
+		When     time.Time
+		Blob     []byte
+		Children []node
+		Labels   map[string]uint8
+		Next     *node
+	}
+	s := schemaOf(reflect.TypeOf(node{}), nil)
+	want := map[string]string{"Name": "number", "Count": "integer", "tagged": "boolean", "When": "string",
+		"Blob": "string", "Children": "array", "Labels": "object", "Next": ""}
+	if len(s.Properties) != len(want) {
+		t.Errorf("schema of node has %d properties, want %d", len(s.Properties), len(want))
+	}
+	for name, typ := range want {
+		if p, ok := s.Properties[name]; !ok || p.Type != typ {
+			t.Errorf("schema property %s is %+v, want type %q", name, p, typ)
+		}
+	}
+	if s.Properties["When"].Format != "date-time" || s.Properties["Blob"].Format != "base64" {
+		t.Error("time.Time and []byte properties should have formats date-time and base64")
+	}
+	if ref := s.Properties["Children"].Items.Ref; ref != "node" {
+		t.Errorf("recursive slice items have $ref %q, want node", ref)
+	}
+	if next := s.Properties["Next"]; next.Ref != "node" || !next.Nullable {
+		t.Errorf("recursive pointer has schema %+v, want a nullable $ref to node", next)
+	}
+	if p := s.Properties["Labels"].AdditionalProperties; p == nil || p.Type != "integer" {
+		t.Errorf("map values have schema %+v, want integer", p)
+	}
+}
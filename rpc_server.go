@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
 	"os"
@@ -13,6 +12,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -28,15 +29,29 @@ type SourceControl struct {
 	triangle  *TriangleSource
 	lancero   *LanceroSource
 	erroring  *ErroringSource
+	replay    *CaptureReplaySource
 	// TODO: Add sources for ROACH, Abaco
 	ActiveSource   DataSource
 	isSourceActive bool
 
+	// Start and RunBenchmark hold startLock while they check that the other isn't running,
+	// so a source and a benchmark never run together.
+	startLock    sync.Mutex
+	benchmarking bool // a benchmark is running; under startLock
+
 	status        ServerStatus
 	clientUpdates chan<- ClientUpdate
-	totalData     Heartbeat
 	heartbeats    chan Heartbeat
 
+	// The heartbeat loop runs on its own goroutine, so it must not read the active source
+	// while Start and Stop change it. It reads only lanceroRunning, and it keeps the totals
+	// for the next ALIVE message, all under heartbeatLock.
+	heartbeatLock  sync.Mutex
+	lanceroRunning bool // the Lancero source is active, so ALIVE messages carry its card status
+	totalData      Heartbeat
+	lastHeartbeat  time.Time // when the last ALIVE message was broadcast
+	lastWritten    int64     // bytesWrittenTotal at lastHeartbeat
+
 	// For queueing up RPC requests for later execution and getting the result
 	queuedRequests chan func()
 	queuedResults  chan error
@@ -53,16 +68,20 @@ func NewSourceControl() *SourceControl {
 	sc.simPulses = NewSimPulseSource()
 	sc.triangle = NewTriangleSource()
 	sc.erroring = NewErroringSource()
+	sc.replay = NewCaptureReplaySource()
 	lan, _ := NewLanceroSource()
 	sc.lancero = lan
 
 	sc.simPulses.heartbeats = sc.heartbeats
 	sc.triangle.heartbeats = sc.heartbeats
 	sc.erroring.heartbeats = sc.heartbeats
+	sc.replay.heartbeats = sc.heartbeats
 	sc.lancero.heartbeats = sc.heartbeats
 
 	sc.status.Ncol = make([]int, 0)
 	sc.status.Nrow = make([]int, 0)
+	sc.status.CardFrameRates = make([]float64, 0)
+	sc.status.CouplingStatus = NoCoupling
 	return sc
 }
 
@@ -73,17 +92,34 @@ type ServerStatus struct {
 	Nchannels              int
 	Nsamples               int
 	Npresamp               int
+	NsamplesMs             float64 // record length in ms, if set as a duration (else 0); converted again at each Start
+	NpresampMs             float64 // pre-trigger length in ms, if set as a duration (else 0)
 	Ncol                   []int
 	Nrow                   []int
-	ChannelsWithProjectors []int // move this to something than reports mix also? and experimentStateLabel
+	ChannelsWithProjectors []int          // move this to something than reports mix also? and experimentStateLabel
+	DisabledChannels       []int          // channels whose processing is turned off by EnableChannels
+	ProjectorsRestored     []int          // channels whose saved projectors were reloaded when the source started
+	CardFrameRates         []float64      // frames per second of each active Lancero card, measured when the source started
+	CouplingStatus         CouplingStatus // Lancero FB / error coupling, restored each time that source starts
+	DetectedDeadChannels   []int          // channels flagged by dead-channel detection while the source runs
 	// TODO: maybe bytes/sec data rate...?
 }
 
-// Heartbeat is the info sent in the regular heartbeat to clients
+// Heartbeat is the info sent in the regular heartbeat to clients. The sources send
+// Heartbeats for each block of data they read; the per-second rates and the writer
+// throughput are filled in only when the totals are broadcast.
 type Heartbeat struct {
-	Running bool
-	Time    float64
-	DataMB  float64
+	Running      bool
+	Time         float64 // seconds of data read since the last heartbeat
+	DataMB       float64
+	Frames       int                 // frames read since the last heartbeat
+	DataMBps     float64             // DataMB/Time, the rate at which the source delivers data
+	FramesPerSec float64             // Frames/Time
+	Backlog      int                 // blocks read but not yet processed (only Lancero reads ahead of processing)
+	WrittenMB    float64             // data written to files since the last heartbeat
+	WrittenMBps  float64             // WrittenMB per second of wall-clock time
+	QueueDropped PubQueueDropCounts  // records the publishers' queues had no room for, since Dastard started
+	Lancero      []LanceroCardStatus `json:",omitempty"` // card diagnostics, only when the Lancero source is running
 }
 
 // FactorArgs holds the arguments to a Multiply operation
@@ -99,31 +135,41 @@ func (s *SourceControl) Multiply(args *FactorArgs, reply *int) error {
 
 // ConfigureTriangleSource configures the source of simulated pulses.
 func (s *SourceControl) ConfigureTriangleSource(args *TriangleSourceConfig, reply *bool) error {
-	log.Printf("ConfigureTriangleSource: %d chan, rate=%.3f\n", args.Nchan, args.SampleRate)
+	logInfof("ConfigureTriangleSource: %d chan, rate=%.3f", args.Nchan, args.SampleRate)
 	err := s.triangle.Configure(args)
 	s.clientUpdates <- ClientUpdate{"TRIANGLE", args}
 	*reply = (err == nil)
-	log.Printf("Result is okay=%t and state={%d chan, rate=%.3f}\n", *reply, s.triangle.nchan, s.triangle.sampleRate)
+	logInfof("Result is okay=%t and state={%d chan, rate=%.3f}", *reply, s.triangle.nchan, s.triangle.sampleRate)
 	return err
 }
 
 // ConfigureSimPulseSource configures the source of simulated pulses.
 func (s *SourceControl) ConfigureSimPulseSource(args *SimPulseSourceConfig, reply *bool) error {
-	log.Printf("ConfigureSimPulseSource: %d chan, rate=%.3f\n", args.Nchan, args.SampleRate)
+	logInfof("ConfigureSimPulseSource: %d chan, rate=%.3f", args.Nchan, args.SampleRate)
 	err := s.simPulses.Configure(args)
 	s.clientUpdates <- ClientUpdate{"SIMPULSE", args}
 	*reply = (err == nil)
-	log.Printf("Result is okay=%t and state={%d chan, rate=%.3f}\n", *reply, s.simPulses.nchan, s.simPulses.sampleRate)
+	logInfof("Result is okay=%t and state={%d chan, rate=%.3f}", *reply, s.simPulses.nchan, s.simPulses.sampleRate)
+	return err
+}
+
+// ConfigureCaptureReplaySource configures the source that replays a capture file.
+func (s *SourceControl) ConfigureCaptureReplaySource(args *CaptureReplaySourceConfig, reply *bool) error {
+	logInfof("ConfigureCaptureReplaySource: file %s, realtime=%t", args.Filename, args.Realtime)
+	err := s.replay.Configure(args)
+	s.clientUpdates <- ClientUpdate{"CAPTUREREPLAY", args}
+	*reply = (err == nil)
+	logInfof("Result is okay=%t and state={%d chan, rate=%.3f}", *reply, s.replay.nchan, s.replay.sampleRate)
 	return err
 }
 
 // ConfigureLanceroSource configures the lancero cards.
 func (s *SourceControl) ConfigureLanceroSource(args *LanceroSourceConfig, reply *bool) error {
-	log.Printf("ConfigureLanceroSource: mask 0x%4.4x  active cards: %v\n", args.FiberMask, args.ActiveCards)
+	logInfof("ConfigureLanceroSource: mask 0x%4.4x  active cards: %v", args.FiberMask, args.ActiveCards)
 	err := s.lancero.Configure(args)
 	s.clientUpdates <- ClientUpdate{"LANCERO", args}
 	*reply = (err == nil)
-	log.Printf("Result is okay=%t and state={%d MHz clock, %d cards}\n", *reply, s.lancero.clockMhz, s.lancero.ncards)
+	logInfof("Result is okay=%t and state={%d MHz clock, %d cards}", *reply, s.lancero.clockMhz, s.lancero.ncards)
 	return err
 }
 
@@ -140,8 +186,10 @@ func (s *SourceControl) runLaterIfActive(f func()) error {
 
 // MixFractionObject is the RPC-usable structure for ConfigureMixFraction
 type MixFractionObject struct {
-	ChannelIndices []int
-	MixFractions   []float64
+	ChannelIndices   []int
+	MixFractions     []float64
+	ChannelGroups    []string // every channel in these groups gets GroupMixFraction
+	GroupMixFraction float64
 }
 
 // ConfigureMixFraction sets the MixFraction for the channel associated with ChannelIndex
@@ -156,6 +204,18 @@ type MixFractionObject struct {
 // But changes to the mix settings need to be kept separate from LanceroSource.distrubuteData,
 // which is part of the data-*production* step, not the data-processing step.
 func (s *SourceControl) ConfigureMixFraction(mfo *MixFractionObject, reply *bool) error {
+	if len(mfo.ChannelGroups) > 0 {
+		groupChannels, err := channelGroups.resolve([]int{}, mfo.ChannelGroups)
+		if err != nil {
+			*reply = false
+			return err
+		}
+		for _, channelIndex := range groupChannels {
+			mfo.ChannelIndices = append(mfo.ChannelIndices, channelIndex)
+			mfo.MixFractions = append(mfo.MixFractions, mfo.GroupMixFraction)
+		}
+		mfo.ChannelGroups = nil
+	}
 	currentMix, err := s.ActiveSource.ConfigureMixFraction(mfo)
 	*reply = (err == nil)
 	s.broadcastMixState(currentMix)
@@ -164,48 +224,464 @@ func (s *SourceControl) ConfigureMixFraction(mfo *MixFractionObject, reply *bool
 
 // ConfigureTriggers configures the trigger state for 1 or more channels.
 func (s *SourceControl) ConfigureTriggers(state *FullTriggerState, reply *bool) error {
-	log.Printf("Got ConfigureTriggers: %v", spew.Sdump(state))
+	logDebugf("Got ConfigureTriggers: %v", spew.Sdump(state))
+	var err error
+	if state.ChannelIndicies, err = channelGroups.resolve(state.ChannelIndicies, state.ChannelGroups); err != nil {
+		*reply = false
+		return err
+	}
 	f := func() {
 		err := s.ActiveSource.ChangeTriggerState(state)
 		s.broadcastTriggerState()
 		s.queuedResults <- err
 	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// BulkTriggerReply is the reply to ConfigureTriggersBulk.
+type BulkTriggerReply struct {
+	Applied bool           // whether the new trigger states were applied (to all channels)
+	OK      map[int]bool   // for each channel named in the request, whether its new state was applied
+	Errors  map[int]string // why each invalid channel's state could not be applied
+}
+
+// ConfigureTriggersBulk changes the trigger states of many channels at once. All entries
+// are validated first, and the states are applied together between two data blocks
+// only if all are valid. Invalid channels are reported in the reply, not as an error,
+// so that the client learns about every problem in one call.
+func (s *SourceControl) ConfigureTriggersBulk(states *[]FullTriggerState, reply *BulkTriggerReply) error {
+	for i := range *states {
+		state := &(*states)[i]
+		var err error
+		if state.ChannelIndicies, err = channelGroups.resolve(state.ChannelIndicies, state.ChannelGroups); err != nil {
+			return err
+		}
+	}
+	f := func() {
+		problems, err := s.ActiveSource.ChangeTriggerStates(*states)
+		reply.Applied = (err == nil)
+		reply.Errors = problems
+		reply.OK = make(map[int]bool)
+		for _, state := range *states {
+			for _, channelIndex := range state.ChannelIndicies {
+				reply.OK[channelIndex] = reply.Applied
+			}
+		}
+		if reply.Applied {
+			s.broadcastTriggerState()
+		}
+		if len(problems) > 0 {
+			err = nil
+		}
+		s.queuedResults <- err
+	}
+	return s.runLaterIfActive(f)
+}
+
+// ManualTrigger forces one trigger at the current frame in each listed channel (or
+// in all channels, if the list is empty). The records are published and written
+// exactly like any other triggered record.
+func (s *SourceControl) ManualTrigger(channelIndices *[]int, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.ManualTrigger(*channelIndices)
+	}
 	err := s.runLaterIfActive(f)
 	*reply = (err == nil)
 	return err
 }
 
+// ConfigureDriftCorrection enables, disables, or changes the gain-drift tracking for
+// 1 or more channels. Any change also resets the drift reference for those channels.
+// OFF files store the corrections of the channels whose tracking is on when writing starts.
+func (s *SourceControl) ConfigureDriftCorrection(config *DriftCorrectionConfig, reply *bool) error {
+	logDebugf("Got ConfigureDriftCorrection: %v", spew.Sdump(config))
+	f := func() {
+		err := s.ActiveSource.ConfigureDriftCorrection(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"DRIFTCORRECT", config}
+		}
+		s.queuedResults <- err
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// AutoSetTriggerLevels measures the baseline noise in 1 or more channels (or in all
+// channels, if none are listed) over a short window, then sets EdgeLevel and/or
+// LevelLevel to config.NSigma times the noise. The measurement takes some time, so
+// the resulting trigger state is broadcast as a TRIGGER message when it's done.
+func (s *SourceControl) AutoSetTriggerLevels(config *AutoTriggerLevelConfig, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.AutoSetTriggerLevels(config)
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// PreviewTriggers runs the trigger algorithms with a proposed trigger state over the
+// last few seconds of one channel's data, and replies with the triggers it would have
+// found and their rate. The channel's trigger state is not changed.
+func (s *SourceControl) PreviewTriggers(config *TriggerPreviewConfig, reply *TriggerPreview) error {
+	f := func() {
+		preview, err := s.ActiveSource.PreviewTriggers(config)
+		if err == nil {
+			*reply = *preview
+		}
+		s.queuedResults <- err
+	}
+	return s.runLaterIfActive(f)
+}
+
+// FetchRawSnapshot copies the most recent seconds of raw data of the chosen channels
+// to a snapshot, for ad-hoc analysis without writing. The reply says where on the HTTP
+// gateway to fetch the data (once, within a minute) and how they are laid out.
+func (s *SourceControl) FetchRawSnapshot(config *RawSnapshotConfig, reply *RawSnapshotInfo) error {
+	f := func() {
+		info, err := s.ActiveSource.RawSnapshot(config)
+		if err == nil {
+			*reply = *info
+		}
+		s.queuedResults <- err
+	}
+	return s.runLaterIfActive(f)
+}
+
+// ConfigureRecordVeto sets the cuts on pretrigger baseline quality for 1 or more
+// channels, and resets their counts of vetoed records.
+func (s *SourceControl) ConfigureRecordVeto(config *RecordVetoConfig, reply *bool) error {
+	logDebugf("Got ConfigureRecordVeto: %v", spew.Sdump(config))
+	f := func() {
+		err := s.ActiveSource.ConfigureRecordVeto(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"RECORDVETO", config}
+		}
+		s.queuedResults <- err
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ConfigureEnergyCalibration loads (or turns off) a curve converting the pulse height
+// of 1 or more channels to energy. The energies appear in the summaries and, if the
+// PublishEnergies config option is set, on the energy port.
+func (s *SourceControl) ConfigureEnergyCalibration(config *EnergyCalibrationConfig, reply *bool) error {
+	logDebugf("Got ConfigureEnergyCalibration: %v", spew.Sdump(config))
+	channelIndices, err := channelGroups.resolve(config.ChannelIndices, config.ChannelGroups)
+	if err != nil {
+		*reply = false
+		return err
+	}
+	config.ChannelIndices = channelIndices
+	f := func() {
+		err := s.ActiveSource.ConfigureEnergyCalibration(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"ENERGYCAL", config}
+		}
+		s.queuedResults <- err
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ConfigurePublishFilter limits the records of 1 or more channels that are published
+// on the records port, by trigger type and by a maximum rate.
+func (s *SourceControl) ConfigurePublishFilter(config *PublishFilterConfig, reply *bool) error {
+	logDebugf("Got ConfigurePublishFilter: %v", spew.Sdump(config))
+	channelIndices, err := channelGroups.resolve(config.ChannelIndices, config.ChannelGroups)
+	if err != nil {
+		*reply = false
+		return err
+	}
+	config.ChannelIndices = channelIndices
+	f := func() {
+		err := s.ActiveSource.ConfigurePublishFilter(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"PUBLISHFILTER", config}
+		}
+		s.queuedResults <- err
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ConfigurePileupFlag sets the residualStdDev threshold above which records of 1 or
+// more channels are flagged as pileup in their summaries and OFF records. OFF files store
+// the flags of the channels whose threshold is set when writing starts.
+func (s *SourceControl) ConfigurePileupFlag(config *PileupFlagConfig, reply *bool) error {
+	logDebugf("Got ConfigurePileupFlag: %v", spew.Sdump(config))
+	channelIndices, err := channelGroups.resolve(config.ChannelIndices, config.ChannelGroups)
+	if err != nil {
+		*reply = false
+		return err
+	}
+	config.ChannelIndices = channelIndices
+	f := func() {
+		err := s.ActiveSource.ConfigurePileupFlag(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"PILEUPFLAG", config}
+		}
+		s.queuedResults <- err
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ConfigureTriggerStorm sets (or turns off) the trigger storm breaker of 1 or more
+// channels, which turns off a channel's triggers if their rate stays above a limit.
+func (s *SourceControl) ConfigureTriggerStorm(config *TriggerStormConfig, reply *bool) error {
+	logDebugf("Got ConfigureTriggerStorm: %v", spew.Sdump(config))
+	channelIndices, err := channelGroups.resolve(config.ChannelIndices, config.ChannelGroups)
+	if err != nil {
+		*reply = false
+		return err
+	}
+	config.ChannelIndices = channelIndices
+	f := func() {
+		err := s.ActiveSource.ConfigureTriggerStorm(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"TRIGGERSTORMCONFIG", config}
+		}
+		s.queuedResults <- err
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ConfigureDeadChannelDetection sets (or turns off) dead-channel detection in 1 or more
+// channels, which flags a channel whose raw data RMS stays out of bounds.
+func (s *SourceControl) ConfigureDeadChannelDetection(config *DeadChannelDetectConfig, reply *bool) error {
+	logDebugf("Got ConfigureDeadChannelDetection: %v", spew.Sdump(config))
+	channelIndices, err := channelGroups.resolve(config.ChannelIndices, config.ChannelGroups)
+	if err != nil {
+		*reply = false
+		return err
+	}
+	config.ChannelIndices = channelIndices
+	f := func() {
+		err := s.ActiveSource.ConfigureDeadChannelDetection(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"DEADCHANNELDETECTCONFIG", config}
+		}
+		s.queuedResults <- err
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// BeginStimulus starts a stimulus window (such as a bias step or LED pulses) at the next
+// frame to be processed, so that external scripts can coordinate with the data stream.
+// While writing, it sets the experiment state label. It can also force records at the
+// same frames in the chosen channels during the window. The reply gives the exact frame
+// range of the window.
+func (s *SourceControl) BeginStimulus(config *StimulusConfig, reply *StimulusWindow) error {
+	logDebugf("Got BeginStimulus: %v", spew.Sdump(config))
+	timestamp := time.Now()
+	channelIndices, err := channelGroups.resolve(config.ChannelIndices, config.ChannelGroups)
+	if err != nil {
+		return err
+	}
+	config.ChannelIndices = channelIndices
+	f := func() {
+		window, err := s.ActiveSource.BeginStimulus(config, timestamp)
+		if err == nil {
+			*reply = *window
+			s.clientUpdates <- ClientUpdate{"STIMULUS", window}
+		}
+		s.queuedResults <- err
+	}
+	return s.runLaterIfActive(f)
+}
+
+// ConfigureClientWatchdog sets (or turns off) the client watchdog: if no control client
+// calls Ping for config.TimeoutSeconds while writing is active, it sets the experiment
+// state label config.StateLabel and, if config.PauseWriting, pauses writing. The config
+// is broadcast, so it is saved in the config file.
+func (s *SourceControl) ConfigureClientWatchdog(config *ClientWatchdogConfig, reply *bool) error {
+	logDebugf("Got ConfigureClientWatchdog: %v", spew.Sdump(config))
+	*reply = false
+	if err := config.validate(); err != nil {
+		return err
+	}
+	watchdog.configure(*config, time.Now())
+	s.clientUpdates <- ClientUpdate{"CLIENTWATCHDOG", config}
+	*reply = true
+	return nil
+}
+
+// Ping tells the client watchdog that a control client, named by client, is alive. The
+// reply is the watchdog's config, so the client knows how often it must ping.
+func (s *SourceControl) Ping(client *string, reply *ClientWatchdogConfig) error {
+	*reply = watchdog.ping(*client, time.Now())
+	return nil
+}
+
+// RunBenchmark starts pushing synthetic pulses through the whole processing pipeline
+// (triggering, analysis, publishing, and optionally writing files) at increasing rates, to
+// find the highest rate this computer can sustain and the stage that limits it. It takes
+// about config.Seconds per rate, so it runs in the background and reports its result in a
+// BENCHMARK message. It cannot run while a source is active, and no source can start
+// until it ends.
+func (s *SourceControl) RunBenchmark(config *BenchmarkConfig, reply *bool) error {
+	logDebugf("Got RunBenchmark: %v", spew.Sdump(config))
+	*reply = false
+	bs := NewBenchmarkSource()
+	if err := bs.Configure(config); err != nil {
+		return err
+	}
+	s.startLock.Lock()
+	defer s.startLock.Unlock()
+	if s.benchmarking {
+		return fmt.Errorf("a benchmark is already running")
+	}
+	if s.isSourceActive {
+		return fmt.Errorf("cannot run a benchmark while a source is active")
+	}
+	s.benchmarking = true
+	go func() {
+		result, err := bs.Run()
+		if err != nil {
+			logErrorf("Benchmark failed: %v", err)
+			result = &BenchmarkResult{Error: err.Error()}
+		}
+		s.startLock.Lock()
+		s.benchmarking = false
+		s.startLock.Unlock()
+		s.clientUpdates <- ClientUpdate{"BENCHMARK", result}
+	}()
+	*reply = true
+	return nil
+}
+
+// ConfigureTriggerFilter sets (or turns off) an FIR filter, either a boxcar or a given
+// kernel, applied to the samples that 1 or more channels inspect for edge and level
+// triggers. The records themselves are not filtered.
+func (s *SourceControl) ConfigureTriggerFilter(config *TriggerFilterConfig, reply *bool) error {
+	logDebugf("Got ConfigureTriggerFilter: %v", spew.Sdump(config))
+	channelIndices, err := channelGroups.resolve(config.ChannelIndices, config.ChannelGroups)
+	if err != nil {
+		*reply = false
+		return err
+	}
+	config.ChannelIndices = channelIndices
+	f := func() {
+		err := s.ActiveSource.ConfigureTriggerFilter(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"TRIGGERFILTER", config}
+		}
+		s.queuedResults <- err
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ResetDriftReference makes the listed channels (or all channels, if the list is
+// empty) take a new drift reference from their next suitable record.
+func (s *SourceControl) ResetDriftReference(channelIndices *[]int, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.ResetDriftReference(*channelIndices)
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ChannelEnableObject is the RPC-usable structure for EnableChannels
+type ChannelEnableObject struct {
+	ChannelIndices []int
+	ChannelGroups  []string
+	Enable         bool
+}
+
+// EnableChannels turns all processing (triggering, publishing, and writing) of the
+// listed channels off or back on, without stopping the source. The disabled channels
+// are reported in the STATUS message.
+func (s *SourceControl) EnableChannels(ceo *ChannelEnableObject, reply *bool) error {
+	channelIndices, err := channelGroups.resolve(ceo.ChannelIndices, ceo.ChannelGroups)
+	if err != nil {
+		*reply = false
+		return err
+	}
+	f := func() {
+		err := s.ActiveSource.EnableChannels(channelIndices, ceo.Enable)
+		s.status.DisabledChannels = s.ActiveSource.DisabledChannels()
+		s.clientUpdates <- ClientUpdate{"STATUS", s.status}
+		s.queuedResults <- err
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
 // ProjectorsBasisObject is the RPC-usable structure for ConfigureProjectorsBases
 type ProjectorsBasisObject struct {
 	ChannelIndex     int
 	ProjectorsBase64 string
 	BasisBase64      string
 	ModelDescription string
+	WhitenerBase64   string   // optional
+	ChannelGroups    []string // if not empty, load into all channels of these groups instead of ChannelIndex
 }
 
-// ConfigureProjectorsBasis takes ProjectorsBase64 which must a base64 encoded string with binary data matching that from mat.Dense.MarshalBinary
-func (s *SourceControl) ConfigureProjectorsBasis(pbo *ProjectorsBasisObject, reply *bool) error {
-	*reply = false
+// decode returns the projectors, basis, and whitener (empty if none) encoded in pbo.
+func (pbo *ProjectorsBasisObject) decode() (projectors, basis, whitener mat.Dense, err error) {
 	projectorsBytes, err := base64.StdEncoding.DecodeString(pbo.ProjectorsBase64)
 	if err != nil {
-		return err
+		return
 	}
 	basisBytes, err := base64.StdEncoding.DecodeString(pbo.BasisBase64)
 	if err != nil {
-		return err
+		return
 	}
-	var projectors, basis mat.Dense
 	if err = projectors.UnmarshalBinary(projectorsBytes); err != nil {
-		return err
+		return
 	}
 	if err = basis.UnmarshalBinary(basisBytes); err != nil {
+		return
+	}
+	if len(pbo.WhitenerBase64) > 0 {
+		var whitenerBytes []byte
+		if whitenerBytes, err = base64.StdEncoding.DecodeString(pbo.WhitenerBase64); err != nil {
+			return
+		}
+		err = whitener.UnmarshalBinary(whitenerBytes)
+	}
+	return
+}
+
+// ConfigureProjectorsBasis takes ProjectorsBase64 which must a base64 encoded string with binary data matching that from mat.Dense.MarshalBinary
+func (s *SourceControl) ConfigureProjectorsBasis(pbo *ProjectorsBasisObject, reply *bool) error {
+	*reply = false
+	projectors, basis, whitener, err := pbo.decode()
+	if err != nil {
 		return err
 	}
+	channelIndices := []int{pbo.ChannelIndex}
+	if len(pbo.ChannelGroups) > 0 {
+		if channelIndices, err = channelGroups.resolve([]int{}, pbo.ChannelGroups); err != nil {
+			return err
+		}
+	}
 	f := func() {
-		err := s.ActiveSource.ConfigureProjectorsBases(pbo.ChannelIndex, projectors, basis, pbo.ModelDescription)
-		if err == nil {
-			s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
+		var err error
+		for _, channelIndex := range channelIndices {
+			err = s.ActiveSource.ConfigureProjectorsBases(channelIndex, projectors, basis, pbo.ModelDescription, whitener)
+			if err != nil {
+				break
+			}
 		}
+		s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
+		s.saveProjectors()
 		s.queuedResults <- err
 	}
 	err = s.runLaterIfActive(f)
@@ -215,18 +691,47 @@ func (s *SourceControl) ConfigureProjectorsBasis(pbo *ProjectorsBasisObject, rep
 
 // SizeObject is the RPC-usable structure for ConfigurePulseLengths to change pulse record sizes.
 type SizeObject struct {
-	Nsamp int
-	Npre  int
+	Nsamp   int
+	Npre    int
+	NsampMs float64 // if NsampMs and NpreMs are > 0, they give the lengths in ms, and Nsamp and Npre are ignored
+	NpreMs  float64
+}
+
+// ReportProjectorsBasis returns the projectors, basis, model description, and noise
+// whitener (if any) currently loaded in one channel, encoded as for ConfigureProjectorsBasis.
+func (s *SourceControl) ReportProjectorsBasis(channelIndex *int, reply *ProjectorsBasisObject) error {
+	f := func() {
+		pbo, err := s.ActiveSource.ReportProjectorsBasis(*channelIndex)
+		if err == nil {
+			*reply = *pbo
+		}
+		s.queuedResults <- err
+	}
+	return s.runLaterIfActive(f)
 }
 
 // ConfigurePulseLengths is the RPC-callable service to change pulse record sizes.
+// The sizes are given either in samples or, if NsampMs and NpreMs are set, in ms.
+// All channels change together between two segments, and the call returns only
+// after they have changed (or none has, on error).
 func (s *SourceControl) ConfigurePulseLengths(sizes SizeObject, reply *bool) error {
 	*reply = false // handle the case that sizes fails the validation tests and we return early
-	log.Printf("ConfigurePulseLengths: %d samples (%d pre)\n", sizes.Nsamp, sizes.Npre)
+	byDuration := sizes.NsampMs > 0 || sizes.NpreMs > 0
+	if byDuration {
+		logInfof("ConfigurePulseLengths: %v ms (%v ms pre)", sizes.NsampMs, sizes.NpreMs)
+	} else {
+		logInfof("ConfigurePulseLengths: %d samples (%d pre)", sizes.Nsamp, sizes.Npre)
+	}
 	if !s.isSourceActive {
 		return fmt.Errorf("No source is active")
 	}
-	if s.status.Npresamp == sizes.Npre && s.status.Nsamples == sizes.Nsamp {
+	if byDuration && (sizes.NsampMs <= 0 || sizes.NpreMs <= 0) {
+		return fmt.Errorf("ConfigurePulseLengths needs both NsampMs and NpreMs, have %v and %v", sizes.NsampMs, sizes.NpreMs)
+	}
+	if byDuration && s.status.NsamplesMs == sizes.NsampMs && s.status.NpresampMs == sizes.NpreMs {
+		return nil // no change requested
+	}
+	if !byDuration && s.status.NsamplesMs == 0 && s.status.Npresamp == sizes.Npre && s.status.Nsamples == sizes.Nsamp {
 		return nil // no change requested
 	}
 	if s.ActiveSource.ComputeWritingState().Active {
@@ -234,10 +739,17 @@ func (s *SourceControl) ConfigurePulseLengths(sizes SizeObject, reply *bool) err
 	}
 
 	f := func() {
-		err := s.ActiveSource.ConfigurePulseLengths(sizes.Nsamp, sizes.Npre)
-		if err == nil {
+		var err error
+		if byDuration {
+			err = s.setPulseDurations(sizes.NsampMs, sizes.NpreMs)
+		} else if err = s.ActiveSource.ConfigurePulseLengths(sizes.Nsamp, sizes.Npre); err == nil {
 			s.status.Npresamp = sizes.Npre
 			s.status.Nsamples = sizes.Nsamp
+			s.status.NsamplesMs, s.status.NpresampMs = 0, 0
+		}
+		if err == nil {
+			s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
+			s.saveProjectors() // new lengths removed all projectors
 		}
 		s.broadcastStatus()
 		s.queuedResults <- err
@@ -247,12 +759,30 @@ func (s *SourceControl) ConfigurePulseLengths(sizes SizeObject, reply *bool) err
 	return err
 }
 
+// setPulseDurations sets the record lengths of the active source in ms, and stores
+// both the durations and the resulting lengths (of the first channel) in the status.
+// It must run in the source's core loop.
+func (s *SourceControl) setPulseDurations(nsampMs, npreMs float64) error {
+	nsamp, npre, err := s.ActiveSource.ConfigurePulseDurations(nsampMs, npreMs)
+	if err != nil {
+		return err
+	}
+	s.status.Nsamples, s.status.Npresamp = nsamp, npre
+	s.status.NsamplesMs, s.status.NpresampMs = nsampMs, npreMs
+	return nil
+}
+
 // Start will identify the source given by sourceName and Sample then Start it.
 func (s *SourceControl) Start(sourceName *string, reply *bool) error {
 	*reply = false
+	s.startLock.Lock()
+	defer s.startLock.Unlock()
 	if s.isSourceActive {
 		return fmt.Errorf("already have active source, do not start")
 	}
+	if s.benchmarking {
+		return fmt.Errorf("a benchmark is running, do not start")
+	}
 	name := strings.ToUpper(*sourceName)
 	switch name {
 	case "SIMPULSESOURCE":
@@ -271,31 +801,58 @@ func (s *SourceControl) Start(sourceName *string, reply *bool) error {
 		s.ActiveSource = DataSource(s.erroring)
 		s.status.SourceName = "Erroring"
 
+	case "CAPTUREREPLAYSOURCE":
+		s.ActiveSource = DataSource(s.replay)
+		s.status.SourceName = "CaptureReplay"
+
 	// TODO: Add cases here for ROACH, ABACO, etc.
 
 	default:
 		return fmt.Errorf("Data Source \"%s\" is not recognized", *sourceName)
 	}
 
-	log.Printf("Starting data source named %s\n", *sourceName)
+	logInfof("Starting data source named %s", *sourceName)
 	s.status.Running = true
 	if err := Start(s.ActiveSource, s.queuedRequests, s.status.Npresamp, s.status.Nsamples); err != nil {
 		s.status.Running = false
 		s.isSourceActive = false
+		logFieldsf(LogError, LogFields{"source": *sourceName, "error": err}, "could not start data source")
 		return err
 	}
 	s.isSourceActive = true
+	s.setLanceroRunning(s.ActiveSource == DataSource(s.lancero))
+	if s.status.NsamplesMs > 0 {
+		// The new source's sample rate might differ, so convert the record durations again.
+		f := func() {
+			s.queuedResults <- s.setPulseDurations(s.status.NsamplesMs, s.status.NpresampMs)
+		}
+		if err := s.runLaterIfActive(f); err != nil {
+			logWarningf("Could not set records of %v ms (%v ms pre): %v; keeping %d samples (%d pre)",
+				s.status.NsamplesMs, s.status.NpresampMs, err, s.status.Nsamples, s.status.Npresamp)
+			s.status.NsamplesMs, s.status.NpresampMs = 0, 0
+		}
+	}
 	s.status.Nchannels = s.ActiveSource.Nchan()
+	s.status.DisabledChannels = s.ActiveSource.DisabledChannels()
+	s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
+	s.status.ProjectorsRestored = s.ActiveSource.ProjectorsRestored()
 	if ls, ok := s.ActiveSource.(*LanceroSource); ok {
 		s.status.Ncol = make([]int, ls.ncards)
 		s.status.Nrow = make([]int, ls.ncards)
+		s.status.CardFrameRates = make([]float64, len(ls.active))
 		for i, device := range ls.active {
 			s.status.Ncol[i] = device.ncols
 			s.status.Nrow[i] = device.nrows
+			s.status.CardFrameRates[i] = device.frameRate
 		}
+	} else if sps, ok := s.ActiveSource.(*SimPulseSource); ok && sps.nrows > 0 {
+		s.status.Ncol = []int{sps.ncols}
+		s.status.Nrow = []int{sps.nrows}
+		s.status.CardFrameRates = make([]float64, 0)
 	} else {
 		s.status.Ncol = make([]int, 0)
 		s.status.Nrow = make([]int, 0)
+		s.status.CardFrameRates = make([]float64, 0)
 	}
 	s.broadcastStatus()
 	s.broadcastTriggerState()
@@ -309,7 +866,8 @@ func (s *SourceControl) Stop(dummy *string, reply *bool) error {
 	if !s.isSourceActive {
 		return fmt.Errorf("No source is active")
 	}
-	log.Printf("Stopping data source\n")
+	logInfof("Stopping data source")
+	s.setLanceroRunning(false)
 	s.ActiveSource.Stop()
 	s.handlePossibleStoppedSource()
 	s.broadcastStatus()
@@ -323,11 +881,14 @@ func (s *SourceControl) Stop(dummy *string, reply *bool) error {
 // know the source was stopped
 func (s *SourceControl) handlePossibleStoppedSource() {
 	if s.isSourceActive && !s.ActiveSource.Running() {
+		s.setLanceroRunning(false)
 		s.status.Running = false
 		s.isSourceActive = false
+		s.status.DetectedDeadChannels, _ = detectedDeadChannels.take() // the core loop has ended
+		logFieldsf(LogWarning, LogFields{"source": s.status.SourceName}, "data source has stopped")
 		s.clientUpdates <- ClientUpdate{"STATUS", s.status}
 		if s.ActiveSource.ShouldAutoRestart() {
-			log.Println("dastard is aware it should AutoRestart, but it's not implemented yet")
+			logWarningf("dastard is aware it should AutoRestart, but it's not implemented yet")
 		}
 	}
 }
@@ -350,22 +911,100 @@ type WriteControlConfig struct {
 	WriteLJH22 bool   // turn on one or more file formats
 	WriteOFF   bool
 	WriteLJH3  bool
+	Comment    string // operator's comment, stored in the run metadata file
+
+	// If > 0, OFF records whose residualStdDev exceeds this also store their raw samples.
+	OFFRawThreshold float64
+
+	// Room in each OFF file header for this many models to replace the first, so that
+	// ConfigureProjectorsBasis can change a channel's projectors while its file is written.
+	// If 0, there is room for 4; if negative, there is none, and such changes fail. At most 100.
+	OFFModelVersions int
+
+	// Also save the raw data blocks in a capture file, for a CaptureReplaySource.
+	WriteCapture bool
+
+	// At START, write only these channels (and those in these channel groups). Empty means all channels.
+	ChannelIndices []int
+	ChannelGroups  []string
+
+	// Spread the channels' LJH and OFF files over Path and these further base paths (e.g., one
+	// per physical disk), as set by ChannelDisks (the disk of each channel: 0 for Path, k for
+	// ExtraPaths[k-1]) or else by DiskAssignment: "channel" (round-robin by channel index, the
+	// default), "column" (round-robin by TDM readout column; by channel for other sources), or
+	// "block" (contiguous blocks). The run's other files are in Path.
+	ExtraPaths     []string
+	DiskAssignment string
+	ChannelDisks   []int
+
+	// Buffering of the LJH and OFF files: the size of each file's write buffer (0 means 32 kB);
+	// if > 0, how often to flush the buffers (otherwise each channel's, every 20 data blocks);
+	// and, if > 0, how often to commit the files to stable storage (fsync).
+	BufferKB        int
+	FlushIntervalMs int
+	SyncIntervalMs  int
+
+	// If not empty, the host:port of a data mover receiver (cmd/dastard-mover) on a storage
+	// server. The LJH and OFF files are sent there, named by their path relative to Path,
+	// instead of written locally; the run's other files are still written in Path. Not
+	// allowed with ExtraPaths.
+	MoverAddress string
 }
 
 // WriteControl requests start/stop/pause/unpause data writing
-func (s *SourceControl) WriteControl(config *WriteControlConfig, reply *bool) error {
+func (s *SourceControl) WriteControl(config *WriteControlConfig, reply *WriteControlReply) error {
+	var err error
+	if config.ChannelIndices, err = channelGroups.resolve(config.ChannelIndices, config.ChannelGroups); err != nil {
+		*reply = WriteControlReply{}
+		return err
+	}
 	f := func() {
 		err := s.ActiveSource.WriteControl(config)
+		s.broadcastWritingState() // even after an error, which may have changed the state
 		if err == nil {
-			s.broadcastWritingState()
+			ws := s.ActiveSource.ComputeWritingState()
+			reply.RunDirectory = ws.RunDirectory
+			reply.FilenamePattern = ws.FilenamePattern
+			if strings.EqualFold(config.Request, "start") {
+				// Remember the settings, so autoStart can resume writing.
+				s.clientUpdates <- ClientUpdate{"WRITECONTROL", *config}
+				s.broadcastWritingPath()
+			}
 		}
 		s.queuedResults <- err
 	}
-	err := s.runLaterIfActive(f)
-	*reply = (err == nil)
+	err = s.runLaterIfActive(f)
+	reply.OK = (err == nil)
 	return err
 }
 
+// SetWritingPath changes where and under what names the next runs are written: the base
+// path and the naming of each run's directory and files. Runs already being written are
+// not affected. A WriteControl START with a Path also changes the base path. The new
+// settings are broadcast, so they are saved in the config file.
+func (s *SourceControl) SetWritingPath(config *WritingPathConfig, reply *bool) error {
+	if err := writingPaths.set(*config); err != nil {
+		*reply = false
+		return err
+	}
+	s.broadcastWritingPath()
+	*reply = true
+	return nil
+}
+
+func (s *SourceControl) broadcastWritingPath() {
+	s.clientUpdates <- ClientUpdate{"WRITINGPATH", writingPaths.get()}
+}
+
+// WriteControlReply is the reply to WriteControl. While writing (e.g., after a START),
+// it gives the run's directory and the pattern of its file names, so scripts can
+// follow the files as they are written.
+type WriteControlReply struct {
+	OK              bool
+	RunDirectory    string
+	FilenamePattern string // fill in with fmt.Sprintf(FilenamePattern, channelName, extension)
+}
+
 // StateLabelConfig is the argument type of SetExperimentStateLabel
 type StateLabelConfig struct {
 	Label string
@@ -412,6 +1051,16 @@ func (s *SourceControl) WriteComment(comment *string, reply *bool) error {
 	return err
 }
 
+// ReportWritingStats reports the per-channel records and bytes written, file names,
+// current file sizes, and write error counts.
+func (s *SourceControl) ReportWritingStats(dummy *string, reply *[]ChannelWritingStats) error {
+	f := func() {
+		*reply = s.ActiveSource.ComputeWritingStats()
+		s.queuedResults <- nil
+	}
+	return s.runLaterIfActive(f)
+}
+
 // ReadComment reads the contents of comment.txt if it exists, otherwise returns err
 func (s *SourceControl) ReadComment(zero *int, reply *string) error {
 	if !s.isSourceActive {
@@ -442,31 +1091,193 @@ const (
 	ErrToFB                              // Error triggers cause secondary triggers in FB channels
 )
 
-// CoupleErrToFB turns on or off coupling of Error -> FB
-func (s *SourceControl) CoupleErrToFB(couple *bool, reply *bool) error {
+// setCoupling sets the FB / error coupling of the active source, and publishes it.
+func (s *SourceControl) setCoupling(c CouplingStatus, reply *bool) error {
 	f := func() {
-		c := NoCoupling
-		if *couple {
-			c = ErrToFB
-		}
 		err := s.ActiveSource.SetCoupling(c)
-		s.clientUpdates <- ClientUpdate{"TRIGCOUPLING", c}
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"TRIGCOUPLING", c}
+		}
 		s.queuedResults <- err
 	}
 	err := s.runLaterIfActive(f)
 	*reply = (err == nil)
+	if err == nil {
+		s.status.CouplingStatus = c
+		s.broadcastStatus()
+	}
 	return err
 }
 
+// CoupleErrToFB turns on or off coupling of Error -> FB
+func (s *SourceControl) CoupleErrToFB(couple *bool, reply *bool) error {
+	c := NoCoupling
+	if *couple {
+		c = ErrToFB
+	}
+	return s.setCoupling(c, reply)
+}
+
 // CoupleFBToErr turns on or off coupling of FB -> Error
 func (s *SourceControl) CoupleFBToErr(couple *bool, reply *bool) error {
+	c := NoCoupling
+	if *couple {
+		c = FBToErr
+	}
+	return s.setCoupling(c, reply)
+}
+
+// ConfigureGroupTrigger connects (or disconnects) source channels to receiver channels,
+// so that each primary trigger in a source causes a secondary trigger in its receivers,
+// shifted by the configured Offset (in frames) to allow for delays between channels.
+func (s *SourceControl) ConfigureGroupTrigger(config *GroupTriggerConfig, reply *bool) error {
+	logDebugf("Got ConfigureGroupTrigger: %v", spew.Sdump(config))
 	f := func() {
-		c := NoCoupling
-		if *couple {
-			c = FBToErr
+		err := s.ActiveSource.ConfigureGroupTrigger(config)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"GROUPTRIGGER", config}
+		}
+		s.queuedResults <- err
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// CoupleColumn connects (or disconnects) all channels in one TDM column to each other
+// with group triggers, so a client need not work out their channel indices. With
+// several Lancero cards, the channels in that column of every card are coupled.
+func (s *SourceControl) CoupleColumn(config *TDMLineCoupling, reply *bool) error {
+	return s.coupleTDMLine(config, true, reply)
+}
+
+// CoupleRow connects (or disconnects) all channels in one TDM row to each other with
+// group triggers. With several Lancero cards, the channels in that row of every card
+// are coupled.
+func (s *SourceControl) CoupleRow(config *TDMLineCoupling, reply *bool) error {
+	return s.coupleTDMLine(config, false, reply)
+}
+
+func (s *SourceControl) coupleTDMLine(config *TDMLineCoupling, column bool, reply *bool) error {
+	method := "CoupleRow"
+	if column {
+		method = "CoupleColumn"
+	}
+	logDebugf("Got %s: %v", method, spew.Sdump(config))
+	f := func() {
+		gtc, err := s.ActiveSource.CoupleTDMLine(config, column)
+		if err == nil {
+			s.clientUpdates <- ClientUpdate{"GROUPTRIGGER", gtc}
+		}
+		s.queuedResults <- err
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// LanceroStatus reports register-level diagnostics and error counters of all Lancero
+// cards. It does not require an active source.
+func (s *SourceControl) LanceroStatus(dummy *string, reply *[]LanceroCardStatus) error {
+	if s.lancero == nil {
+		return fmt.Errorf("No Lancero source exists")
+	}
+	*reply = s.lancero.CardStatus()
+	return nil
+}
+
+// ProbeLanceroFibers reads each fiber of the Lancero cards alone to find which ones carry
+// live data and their number of rows, and suggests a FiberMask for ConfigureLanceroSource.
+// The Lancero source must not be active.
+func (s *SourceControl) ProbeLanceroFibers(config *LanceroFiberProbeConfig, reply *LanceroFiberReport) error {
+	if s.lancero == nil {
+		return fmt.Errorf("No Lancero source exists")
+	}
+	if s.isSourceActive && s.ActiveSource == DataSource(s.lancero) {
+		return fmt.Errorf("cannot probe Lancero fibers while the Lancero source is active")
+	}
+	report, err := s.lancero.ProbeFibers(config)
+	if err != nil {
+		return err
+	}
+	*reply = *report
+	return nil
+}
+
+// CaptureLanceroRaw writes the unparsed stream of the active Lancero cards to files for
+// config.Seconds, with the frame-sync metadata, to debug firmware framing errors. The
+// Lancero source must be active. The reply is the names of the raw files; each is
+// complete when its JSON metadata file appears.
+func (s *SourceControl) CaptureLanceroRaw(config *LanceroRawCaptureConfig, reply *[]string) error {
+	if s.lancero == nil {
+		return fmt.Errorf("No Lancero source exists")
+	}
+	if !s.isSourceActive || s.ActiveSource != DataSource(s.lancero) {
+		return fmt.Errorf("cannot capture raw Lancero data unless the Lancero source is active")
+	}
+	filenames, err := s.lancero.CaptureRaw(config)
+	if err != nil {
+		return err
+	}
+	*reply = filenames
+	return nil
+}
+
+// DefineChannelGroup adds or replaces a named channel group, or deletes it if group has
+// no ChannelIndices. It does not require an active source. All groups are then broadcast.
+func (s *SourceControl) DefineChannelGroup(group *ChannelGroup, reply *bool) error {
+	err := channelGroups.define(*group)
+	*reply = (err == nil)
+	if err == nil {
+		s.broadcastChannelGroups()
+	}
+	return err
+}
+
+// CalibrationObject is the RPC-usable structure for SetCalibration
+type CalibrationObject struct {
+	ChannelIndices   []int
+	VoltsPerArb      []float32 // one per channel index
+	VoltsOffset      []float32 // one per channel index, or empty to mean all zero
+	ChannelGroups    []string  // every channel in these groups gets GroupVoltsPerArb and GroupVoltsOffset
+	GroupVoltsPerArb float32
+	GroupVoltsOffset float32
+}
+
+// SetCalibration sets the raw-to-volts conversion (volts = VoltsOffset + VoltsPerArb*raw)
+// of 1 or more channels of the active source. The calibrations are remembered by
+// channel name, so they are restored whenever a source has channels of those names.
+// The VoltsPerArb goes in the header of each published record; both values go in the
+// headers of files started later. All calibrations are then broadcast.
+func (s *SourceControl) SetCalibration(co *CalibrationObject, reply *bool) error {
+	*reply = false
+	channelIndices := append([]int{}, co.ChannelIndices...)
+	voltsPerArb := append([]float32{}, co.VoltsPerArb...)
+	voltsOffset := append([]float32{}, co.VoltsOffset...)
+	if len(voltsOffset) == 0 {
+		voltsOffset = make([]float32, len(voltsPerArb))
+	}
+	if len(co.ChannelGroups) > 0 {
+		groupChannels, err := channelGroups.resolve([]int{}, co.ChannelGroups)
+		if err != nil {
+			return err
+		}
+		for _, channelIndex := range groupChannels {
+			channelIndices = append(channelIndices, channelIndex)
+			voltsPerArb = append(voltsPerArb, co.GroupVoltsPerArb)
+			voltsOffset = append(voltsOffset, co.GroupVoltsOffset)
+		}
+	}
+	f := func() {
+		err := s.ActiveSource.SetCalibration(channelIndices, voltsPerArb, voltsOffset)
+		if err == nil {
+			names := s.ActiveSource.ChannelNames()
+			for i, channelIndex := range channelIndices {
+				channelCalibrations.set(ChannelCalibration{ChannelName: names[channelIndex],
+					VoltsPerArb: voltsPerArb[i], VoltsOffset: voltsOffset[i]})
+			}
+			s.broadcastCalibrations()
 		}
-		err := s.ActiveSource.SetCoupling(c)
-		s.clientUpdates <- ClientUpdate{"TRIGCOUPLING", c}
 		s.queuedResults <- err
 	}
 	err := s.runLaterIfActive(f)
@@ -474,10 +1285,138 @@ func (s *SourceControl) CoupleFBToErr(couple *bool, reply *bool) error {
 	return err
 }
 
+// DeadChannelsConfig is the RPC-usable structure for SetDeadChannels.
+type DeadChannelsConfig struct {
+	ChannelNames   []string // channels that never trigger, by name (e.g., "chan12")
+	ChannelIndices []int    // more channels, by index in the active source
+	ChannelGroups  []string // more channels, by channel group in the active source
+}
+
+// SetDeadChannels replaces the list of channels that never trigger (e.g., known-bad
+// pixels), whatever their trigger state. The list is kept by channel name and saved in
+// the config file, so it applies again whenever a source with those channels starts.
+// Channels can be named only by index or group while a source is active. The list is
+// then broadcast.
+func (s *SourceControl) SetDeadChannels(config *DeadChannelsConfig, reply *bool) error {
+	*reply = false
+	channelIndices, err := channelGroups.resolve(config.ChannelIndices, config.ChannelGroups)
+	if err != nil {
+		return err
+	}
+	names := append([]string{}, config.ChannelNames...)
+	if !s.isSourceActive {
+		if len(channelIndices) > 0 {
+			return fmt.Errorf("No source is active, so dead channels must be given by name")
+		}
+		if err := deadChannels.set(names); err != nil {
+			return err
+		}
+		s.broadcastDeadChannels()
+		*reply = true
+		return nil
+	}
+	f := func() {
+		chanNames := s.ActiveSource.ChannelNames()
+		for _, channelIndex := range channelIndices {
+			if channelIndex < 0 || channelIndex >= len(chanNames) {
+				s.queuedResults <- fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, len(chanNames))
+				return
+			}
+			names = append(names, chanNames[channelIndex])
+		}
+		err := deadChannels.set(names)
+		if err == nil {
+			s.ActiveSource.ApplyDeadChannels()
+			s.broadcastDeadChannels()
+		}
+		s.queuedResults <- err
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+func (s *SourceControl) broadcastDeadChannels() {
+	s.clientUpdates <- ClientUpdate{"DEADCHANNELS", deadChannels.list()}
+}
+
+func (s *SourceControl) broadcastCalibrations() {
+	s.clientUpdates <- ClientUpdate{"CALIBRATION", channelCalibrations.list()}
+}
+
+func (s *SourceControl) broadcastChannelGroups() {
+	s.clientUpdates <- ClientUpdate{"CHANNELGROUPS", channelGroups.list()}
+}
+
+// addHeartbeat adds the data read in one source heartbeat to the totals for the next ALIVE.
+func (s *SourceControl) addHeartbeat(h Heartbeat) {
+	s.heartbeatLock.Lock()
+	defer s.heartbeatLock.Unlock()
+	s.totalData.DataMB += h.DataMB
+	s.totalData.Time += h.Time
+	s.totalData.Frames += h.Frames
+	s.totalData.Backlog = h.Backlog
+	s.totalData.Running = h.Running
+}
+
+// setLanceroRunning tells the heartbeat loop whether the Lancero source is active. It
+// must be false before the Lancero source is stopped or reconfigured.
+func (s *SourceControl) setLanceroRunning(running bool) {
+	s.heartbeatLock.Lock()
+	defer s.heartbeatLock.Unlock()
+	s.lanceroRunning = running
+}
+
+// queueDeadChannels asks the core loop to put the channels flagged by dead-channel
+// detection into the status, if they changed. The heartbeat loop calls it, and must not
+// change the status itself. If the core loop is busy or gone, the next call tries again.
+func (s *SourceControl) queueDeadChannels() {
+	if !detectedDeadChannels.pending() {
+		return
+	}
+	select {
+	case s.queuedRequests <- s.applyDeadChannels:
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// applyDeadChannels puts the flagged dead channels into the status and broadcasts it,
+// if they changed. It runs on the core loop, like other requests that change the status.
+func (s *SourceControl) applyDeadChannels() {
+	if dead, changed := detectedDeadChannels.take(); changed {
+		s.status.DetectedDeadChannels = dead
+		s.clientUpdates <- ClientUpdate{"STATUS", s.status}
+	}
+}
+
+// broadcastHeartbeat sends the totals since the last ALIVE message, and resets them.
 func (s *SourceControl) broadcastHeartbeat() {
-	s.clientUpdates <- ClientUpdate{"ALIVE", s.totalData}
+	s.heartbeatLock.Lock()
+	s.totalData.DataMBps, s.totalData.FramesPerSec = 0, 0
+	if s.totalData.Time > 0 {
+		s.totalData.DataMBps = s.totalData.DataMB / s.totalData.Time
+		s.totalData.FramesPerSec = float64(s.totalData.Frames) / s.totalData.Time
+	}
+	now := time.Now()
+	written := atomic.LoadInt64(&bytesWrittenTotal)
+	s.totalData.WrittenMB = float64(written-s.lastWritten) / 1e6
+	s.totalData.WrittenMBps = 0
+	if !s.lastHeartbeat.IsZero() {
+		s.totalData.WrittenMBps = s.totalData.WrittenMB / now.Sub(s.lastHeartbeat).Seconds()
+	}
+	s.lastHeartbeat, s.lastWritten = now, written
+
+	s.totalData.QueueDropped = currentPubQueueDropCounts()
+	s.totalData.Lancero = nil
+	if s.lanceroRunning {
+		s.totalData.Lancero = s.lancero.CardStatus()
+	}
+	alive := s.totalData
 	s.totalData.DataMB = 0
 	s.totalData.Time = 0
+	s.totalData.Frames = 0
+	s.heartbeatLock.Unlock()
+	s.clientUpdates <- ClientUpdate{"ALIVE", alive}
 }
 
 func (s *SourceControl) broadcastStatus() {
@@ -519,6 +1458,28 @@ func (s *SourceControl) SendAllStatus(dummy *string, reply *bool) error {
 	return nil
 }
 
+// ReportUnsavedChanges reports which settings differ from the config file as last saved.
+// With config key AutoSave false, they stay unsaved until CommitConfig.
+func (s *SourceControl) ReportUnsavedChanges(dummy *string, reply *UnsavedChanges) error {
+	configChanges.Lock()
+	lastSaved := configChanges.lastSaved
+	configChanges.Unlock()
+	*reply = UnsavedChanges{AutoSave: viper.GetBool("autosave"), Tags: configChanges.unsaved(),
+		LastSaved: lastSaved}
+	return nil
+}
+
+// CommitConfig saves the current settings to the config file now, so that a good
+// configuration can be kept deliberately when AutoSave is false.
+func (s *SourceControl) CommitConfig(dummy *string, reply *bool) error {
+	err := commitConfig()
+	*reply = (err == nil)
+	if err == nil {
+		logInfof("Saved the configuration to %s", viper.ConfigFileUsed())
+	}
+	return err
+}
+
 // RunRPCServer sets up and run a permanent JSON-RPC server.
 // If block, it will block until Ctrl-C and gracefully shut down.
 // (The intention is that block=true in normal operation, but false for tests.)
@@ -539,7 +1500,7 @@ func RunRPCServer(portrpc int, block bool) {
 	// from Viper to relevant objects.
 	var okay bool
 	var spc SimPulseSourceConfig
-	log.Printf("Dastard is using config file %s\n", viper.ConfigFileUsed())
+	logInfof("Dastard is using config file %s", viper.ConfigFileUsed())
 	err := viper.UnmarshalKey("simpulse", &spc)
 	if err == nil {
 		sourceControl.ConfigureSimPulseSource(&spc, &okay)
@@ -554,6 +1515,11 @@ func RunRPCServer(portrpc int, block bool) {
 	if err == nil {
 		sourceControl.ConfigureLanceroSource(&lsc, &okay)
 	}
+	var crc CaptureReplaySourceConfig
+	err = viper.UnmarshalKey("capturereplay", &crc)
+	if err == nil && len(crc.Filename) > 0 {
+		sourceControl.ConfigureCaptureReplaySource(&crc, &okay)
+	}
 	err = viper.UnmarshalKey("status", &sourceControl.status)
 	sourceControl.status.Running = false
 	sourceControl.ActiveSource = sourceControl.triangle
@@ -563,11 +1529,96 @@ func RunRPCServer(portrpc int, block bool) {
 	}
 	var ws WritingState
 	err = viper.UnmarshalKey("writing", &ws)
+	resumeWriting := err == nil && ws.Active
 	if err == nil {
 		wsSend := WritingState{BasePath: ws.BasePath} // only send the BasePath to clients
 		// other info like Active: true could be wrong, and is not useful
 		sourceControl.clientUpdates <- ClientUpdate{"WRITING", wsSend}
 	}
+	var wpc WritingPathConfig
+	if err = viper.UnmarshalKey("writingpath", &wpc); err != nil || wpc.BasePath == "" {
+		wpc.BasePath = ws.BasePath
+	}
+	if err1 := writingPaths.set(wpc); err1 != nil {
+		logWarningf("Could not restore writing path: %v", err1)
+		wpc.BasePath = ""
+		writingPaths.set(wpc)
+	}
+	sourceControl.broadcastWritingPath()
+
+	var groups []ChannelGroup
+	err = viper.UnmarshalKey("channelgroups", &groups)
+	if err == nil && len(groups) > 0 {
+		for _, g := range groups {
+			if err1 := channelGroups.define(g); err1 != nil {
+				logWarningf("Could not restore channel group: %v", err1)
+			}
+		}
+		sourceControl.broadcastChannelGroups()
+	}
+
+	var cals []ChannelCalibration
+	err = viper.UnmarshalKey("calibration", &cals)
+	if err == nil && len(cals) > 0 {
+		for _, cal := range cals {
+			if err1 := channelCalibrations.set(cal); err1 != nil {
+				logWarningf("Could not restore channel calibration: %v", err1)
+			}
+		}
+		sourceControl.broadcastCalibrations()
+	}
+
+	// The Lancero coupling is saved as its TRIGCOUPLING message.
+	if c := CouplingStatus(viper.GetInt("trigcoupling")); c != 0 {
+		if err1 := sourceControl.lancero.validateCoupling(c); err1 != nil {
+			logWarningf("Could not restore the FB / error coupling: %v", err1)
+		} else {
+			sourceControl.lancero.coupling = c
+		}
+	}
+	sourceControl.status.CouplingStatus = sourceControl.lancero.coupling
+
+	var cwc ClientWatchdogConfig
+	if err = viper.UnmarshalKey("clientwatchdog", &cwc); err == nil && cwc.TimeoutSeconds > 0 {
+		if err1 := sourceControl.ConfigureClientWatchdog(&cwc, &okay); err1 != nil {
+			logWarningf("Could not restore the client watchdog: %v", err1)
+		}
+	}
+
+	var dead []string
+	err = viper.UnmarshalKey("deadchannels", &dead)
+	if err == nil && len(dead) > 0 {
+		if err1 := deadChannels.set(dead); err1 != nil {
+			logWarningf("Could not restore dead channels: %v", err1)
+		}
+		sourceControl.broadcastDeadChannels()
+	}
+
+	autostart := viper.GetBool("autostart")
+	sourceControl.clientUpdates <- ClientUpdate{"AUTOSTART", autostart}
+	sourceControl.clientUpdates <- ClientUpdate{"AUTOTRIGGERSTAGGER", viper.GetBool("autotriggerstagger")}
+	if autostart {
+		if err := sourceControl.autoStart(resumeWriting); err != nil {
+			logErrorf("Auto-start failed: %v", err)
+		}
+	}
+
+	var epicsConfig EPICSConfig
+	if err := viper.UnmarshalKey("epics", &epicsConfig); err == nil && epicsConfig.Enabled {
+		if _, err := startEPICSBridge(sourceControl, epicsConfig); err != nil {
+			logErrorf("Could not start EPICS server: %v", err)
+		}
+	}
+
+	sourceControl.watchConfigFile()
+
+	var auditUpdates chan<- ClientUpdate
+	if viper.GetBool("auditbroadcast") {
+		auditUpdates = clientMessageChan
+	}
+	if err := audit.open(os.ExpandEnv(viper.GetString("auditlogfile")), auditUpdates); err != nil {
+		logErrorf("Could not open the RPC audit log: %v", err)
+	}
 
 	// Regularly broadcast a "heartbeat" containing data rate to all clients
 	go func() {
@@ -576,10 +1627,9 @@ func RunRPCServer(portrpc int, block bool) {
 			select {
 			case <-ticker:
 				sourceControl.broadcastHeartbeat()
+				sourceControl.queueDeadChannels()
 			case h := <-sourceControl.heartbeats:
-				sourceControl.totalData.DataMB += h.DataMB
-				sourceControl.totalData.Time += h.Time
-				sourceControl.totalData.Running = h.Running
+				sourceControl.addHeartbeat(h)
 			}
 		}
 	}()
@@ -593,9 +1643,21 @@ func RunRPCServer(portrpc int, block bool) {
 		if err := server.Register(mapServer); err != nil {
 			log.Fatal(err)
 		}
+		if err := server.Register(new(StatusQuery)); err != nil {
+			log.Fatal(err)
+		}
 		server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-		port := fmt.Sprintf(":%d", portrpc)
-		listener, err := net.Listen("tcp", port)
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			panic(fmt.Sprint("TLS configuration error:", err))
+		}
+		if tlsConfig != nil {
+			logInfof("JSON-RPC and HTTP gateway listeners use TLS")
+		}
+		go runHTTPGateway(server, Ports.HTTP, tlsConfig)
+		go runStatusQueryServer(Ports.StatusRPC, tlsConfig)
+		go runStatusREPServer(Ports.StatusREP)
+		listener, err := listenTCP(portrpc, tlsConfig)
 		if err != nil {
 			panic(fmt.Sprint("listen error:", err))
 		}
@@ -603,16 +1665,16 @@ func RunRPCServer(portrpc int, block bool) {
 			if conn, err := listener.Accept(); err != nil {
 				panic("accept error: " + err.Error())
 			} else {
-				log.Printf("new connection established\n")
+				logInfof("new connection established")
 				go func() { // this is equivalent to ServeCodec, except all requests from a single connection
 					// are handled SYNCHRONOUSLY, so sourceControl doesn't need a lock
 					// requests from multiple connections are still asynchronous, but we could add slice of
 					// connections and loop over it instead of launch a goroutine per connection
-					codec := jsonrpc.NewServerCodec(conn)
+					codec := newAuditCodec(jsonrpc.NewServerCodec(conn), conn.RemoteAddr().String(), &audit)
 					for {
 						err := server.ServeRequest(codec)
 						if err != nil {
-							log.Printf("server stopped: %v", err)
+							logInfof("server stopped: %v", err)
 							break
 						}
 					}
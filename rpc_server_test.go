@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/rpc"
 	"net/rpc/jsonrpc"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -127,6 +130,23 @@ func TestServer(t *testing.T) {
 	if !okay {
 		t.Errorf("SourceControl.ConfigurePulseLengths(%v) returns !okay, want okay", sizes)
 	}
+	durations := SizeObject{NsampMs: 50, NpreMs: 10}
+	if err := client.Call("SourceControl.ConfigurePulseLengths", &durations, &okay); err != nil || !okay {
+		t.Errorf("SourceControl.ConfigurePulseLengths(%v) returns okay=%t, err=%v", durations, okay, err)
+	}
+	var status ServerStatus // the client updater publishes the new STATUS soon
+	for deadline := time.Now().Add(time.Second); status.NsamplesMs != 50 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		client.Call("StatusQuery.Status", &dummy, &status)
+	}
+	if status.Nsamples != 500 || status.Npresamp != 100 || status.NsamplesMs != 50 {
+		t.Errorf("STATUS after records of 50 ms (10 ms pre) at 10 kHz has %d samples (%d pre), %v ms",
+			status.Nsamples, status.Npresamp, status.NsamplesMs)
+	}
+	durations.NpreMs = 0
+	if err := client.Call("SourceControl.ConfigurePulseLengths", &durations, &okay); err == nil {
+		t.Errorf("Expected error calling SourceControl.ConfigurePulseLengths(%v) with no NpreMs", durations)
+	}
 	err = client.Call("SourceControl.Stop", sourceName, &okay)
 	if err != nil {
 		t.Logf(err.Error())
@@ -181,9 +201,15 @@ func TestServer(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	whitener := mat.NewDense(2, cols, make([]float64, 2*cols))
+	whitenerBytes, err := whitener.MarshalBinary()
+	if err != nil {
+		t.Error(err)
+	}
 	pbo := ProjectorsBasisObject{ChannelIndex: 0,
 		ProjectorsBase64: base64.StdEncoding.EncodeToString(projectorsBytes),
-		BasisBase64:      base64.StdEncoding.EncodeToString(basisBytes)}
+		BasisBase64:      base64.StdEncoding.EncodeToString(basisBytes),
+		WhitenerBase64:   base64.StdEncoding.EncodeToString(whitenerBytes)}
 
 	err = client.Call("SourceControl.ConfigureProjectorsBasis", &pbo, &okay)
 	if err != nil {
@@ -192,7 +218,20 @@ func TestServer(t *testing.T) {
 	if !okay {
 		t.Errorf("SourceControl.ConfigureProjectorsBasis(\"%s\") returns !okay, want okay", sourceName)
 	}
-	mfo := MixFractionObject{[]int{0}, []float64{1.0}}
+	var reported ProjectorsBasisObject
+	channelIndex := pbo.ChannelIndex
+	if err1 := client.Call("SourceControl.ReportProjectorsBasis", &channelIndex, &reported); err1 != nil {
+		t.Error("error on ReportProjectorsBasis:", err1)
+	}
+	if reported.ProjectorsBase64 != pbo.ProjectorsBase64 || reported.BasisBase64 != pbo.BasisBase64 ||
+		reported.WhitenerBase64 != pbo.WhitenerBase64 || reported.ModelDescription != pbo.ModelDescription {
+		t.Error("ReportProjectorsBasis did not return the projectors, basis, and whitener just loaded")
+	}
+	channelIndex = pbo.ChannelIndex + 1
+	if err1 := client.Call("SourceControl.ReportProjectorsBasis", &channelIndex, &reported); err1 == nil {
+		t.Error("expected error on ReportProjectorsBasis for a channel with no projectors")
+	}
+	mfo := MixFractionObject{ChannelIndices: []int{0}, MixFractions: []float64{1.0}}
 	if err1 := client.Call("SourceControl.ConfigureMixFraction", &mfo, &okay); err1 == nil {
 		t.Error("error on ConfigureMixFraction expected for non-mixable source")
 	}
@@ -200,6 +239,76 @@ func TestServer(t *testing.T) {
 	if err1 := client.Call("SourceControl.ConfigureTriggers", &tstate, &okay); err1 != nil {
 		t.Error("error on ConfigureTriggers:", err)
 	}
+	group := ChannelGroup{Name: "firsttwo", ChannelIndices: []int{0, 1}}
+	if err1 := client.Call("SourceControl.DefineChannelGroup", &group, &okay); err1 != nil {
+		t.Error("error on DefineChannelGroup:", err1)
+	}
+	tstate = FullTriggerState{ChannelGroups: []string{"firsttwo"}}
+	if err1 := client.Call("SourceControl.ConfigureTriggers", &tstate, &okay); err1 != nil {
+		t.Error("error on ConfigureTriggers with a channel group:", err1)
+	}
+	tstate = FullTriggerState{ChannelGroups: []string{"nosuchgroup"}}
+	if err1 := client.Call("SourceControl.ConfigureTriggers", &tstate, &okay); err1 == nil {
+		t.Error("expected error on ConfigureTriggers with an undefined channel group")
+	}
+	bulk := []FullTriggerState{{ChannelGroups: []string{"firsttwo"}},
+		{ChannelIndicies: []int{2}, TriggerState: TriggerState{AutoTrigger: true, AutoDelay: time.Second}}}
+	var bulkReply BulkTriggerReply
+	if err1 := client.Call("SourceControl.ConfigureTriggersBulk", &bulk, &bulkReply); err1 != nil {
+		t.Error("error on ConfigureTriggersBulk:", err1)
+	}
+	if !bulkReply.Applied || len(bulkReply.OK) != 3 || !bulkReply.OK[2] || len(bulkReply.Errors) != 0 {
+		t.Errorf("ConfigureTriggersBulk reply %+v, want 3 channels applied", bulkReply)
+	}
+	bulk[1].AutoDelay = 0
+	if err1 := client.Call("SourceControl.ConfigureTriggersBulk", &bulk, &bulkReply); err1 != nil {
+		t.Error("error on ConfigureTriggersBulk with an invalid state:", err1)
+	}
+	if bulkReply.Applied || bulkReply.OK[0] || len(bulkReply.Errors) != 1 || bulkReply.Errors[2] == "" {
+		t.Errorf("ConfigureTriggersBulk reply %+v, want nothing applied and an error for channel 2", bulkReply)
+	}
+	group.ChannelIndices = nil
+	if err1 := client.Call("SourceControl.DefineChannelGroup", &group, &okay); err1 != nil {
+		t.Error("error on DefineChannelGroup to delete a group:", err1)
+	}
+	manualChans := []int{0, 2}
+	if err1 := client.Call("SourceControl.ManualTrigger", &manualChans, &okay); err1 != nil {
+		t.Error("error on ManualTrigger:", err1)
+	}
+	badChans := []int{99}
+	if err1 := client.Call("SourceControl.ManualTrigger", &badChans, &okay); err1 == nil {
+		t.Error("expected error on ManualTrigger with channel out of range")
+	}
+	autoLevels := AutoTriggerLevelConfig{NSigma: 5, SetEdge: true}
+	if err1 := client.Call("SourceControl.AutoSetTriggerLevels", &autoLevels, &okay); err1 != nil {
+		t.Error("error on AutoSetTriggerLevels:", err1)
+	}
+	autoLevels.NSigma = -1
+	if err1 := client.Call("SourceControl.AutoSetTriggerLevels", &autoLevels, &okay); err1 == nil {
+		t.Error("expected error on AutoSetTriggerLevels with NSigma < 0")
+	}
+	veto := RecordVetoConfig{ChannelIndices: []int{0, 1}, Enable: true, MaxPretrigRMS: 50}
+	if err1 := client.Call("SourceControl.ConfigureRecordVeto", &veto, &okay); err1 != nil {
+		t.Error("error on ConfigureRecordVeto:", err1)
+	}
+	veto.ChannelIndices = []int{99}
+	if err1 := client.Call("SourceControl.ConfigureRecordVeto", &veto, &okay); err1 == nil {
+		t.Error("expected error on ConfigureRecordVeto with channel out of range")
+	}
+	var methods []MethodDescription
+	if err1 := client.Call("SourceControl.ListMethods", &dummy, &methods); err1 != nil {
+		t.Error("error on ListMethods:", err1)
+	} else if len(methods) == 0 || methods[0].Args == nil {
+		t.Errorf("ListMethods returned %d methods, first %+v", len(methods), methods)
+	}
+	pileup := PileupFlagConfig{ChannelIndices: []int{0, 1}, ResidualThreshold: 20}
+	if err1 := client.Call("SourceControl.ConfigurePileupFlag", &pileup, &okay); err1 != nil {
+		t.Error("error on ConfigurePileupFlag:", err1)
+	}
+	pileup.ResidualThreshold = -1
+	if err1 := client.Call("SourceControl.ConfigurePileupFlag", &pileup, &okay); err1 == nil {
+		t.Error("expected error on ConfigurePileupFlag with a negative threshold")
+	}
 	for _, state := range []bool{false, true} {
 		if err1 := client.Call("SourceControl.CoupleFBToErr", &state, &okay); err1 == nil {
 			t.Error("expected error on CoupleFBToErr when non-Lancero source is active")
@@ -214,9 +323,14 @@ func TestServer(t *testing.T) {
 	}
 	defer os.RemoveAll(path)
 	wconfig := WriteControlConfig{Request: "Start", Path: path, WriteLJH22: true}
-	if err1 := client.Call("SourceControl.WriteControl", &wconfig, &okay); err1 != nil {
+	var wreply WriteControlReply
+	if err1 := client.Call("SourceControl.WriteControl", &wconfig, &wreply); err1 != nil {
 		t.Error("SourceControl.WriteControl START error:", err1)
 	}
+	runDir := filepath.Join(path, time.Now().Format("20060102"), "0000")
+	if !wreply.OK || wreply.RunDirectory != runDir || filepath.Dir(wreply.FilenamePattern) != runDir {
+		t.Errorf("SourceControl.WriteControl START reply %+v, want run directory %s", wreply, runDir)
+	}
 	if err1 := client.Call("SourceControl.ConfigurePulseLengths", &sizes, &okay); err1 == nil {
 		t.Errorf("Expected error calling SourceControl.ConfigurePulseLengths(%v) when writing active, saw none", sizes)
 	}
@@ -235,14 +349,32 @@ func TestServer(t *testing.T) {
 			t.Errorf("want %q, have %q", "hello\n", *reply)
 		}
 	}
+	if true { // prevent variables from persisting
+		var dummy string
+		var stats []ChannelWritingStats
+		if err1 := client.Call("SourceControl.ReportWritingStats", &dummy, &stats); err1 != nil {
+			t.Error("SourceControl.ReportWritingStats error:", err1)
+		}
+		if len(stats) == 0 {
+			t.Error("SourceControl.ReportWritingStats returned no channels")
+		}
+		for i, s := range stats {
+			if s.ChannelIndex != i || len(s.FileNames) != 1 || len(s.FileSizes) != 1 {
+				t.Errorf("SourceControl.ReportWritingStats channel %d: %+v", i, s)
+			}
+		}
+	}
 	stateLabelArg := StateLabelConfig{Label: "testlabel"}
 	if err1 := client.Call("SourceControl.SetExperimentStateLabel", &stateLabelArg, &okay); err1 != nil {
 		t.Error(err1)
 	}
 	wconfig.Request = "Stop"
-	if err1 := client.Call("SourceControl.WriteControl", &wconfig, &okay); err1 != nil {
+	if err1 := client.Call("SourceControl.WriteControl", &wconfig, &wreply); err1 != nil {
 		t.Error("SourceControl.WriteControl STOP error:", err1)
 	}
+	if !wreply.OK || wreply.RunDirectory != "" || wreply.FilenamePattern != "" {
+		t.Errorf("SourceControl.WriteControl STOP reply %+v, want no run directory", wreply)
+	}
 	// Check that comment.txt file exists and has a newline appended
 	if true { // prevent variables from persisting
 		date := time.Now().Format("20060102")
@@ -310,6 +442,9 @@ func TestServer(t *testing.T) {
 	if err1 := client.Call("SourceControl.ConfigureTriggers", &tstate, &okay); err1 == nil {
 		t.Error("expected error on ConfigureTriggers when no source is active")
 	}
+	if err1 := client.Call("SourceControl.ManualTrigger", &manualChans, &okay); err1 == nil {
+		t.Error("expected error on ManualTrigger when no source is active")
+	}
 	for _, state := range []bool{false, true} {
 		if err1 := client.Call("SourceControl.CoupleFBToErr", &state, &okay); err1 == nil {
 			t.Error("expected error on CoupleFBToErr when no source is active")
@@ -419,6 +554,96 @@ func TestErroringSourceRPC(t *testing.T) {
 	}
 }
 
+func TestHeartbeatRates(t *testing.T) {
+	updates := make(chan ClientUpdate, 2)
+	sc := &SourceControl{clientUpdates: updates}
+	sc.addHeartbeat(Heartbeat{Running: true, Time: 0.5, DataMB: 1, Frames: 5000, Backlog: 3})
+	sc.addHeartbeat(Heartbeat{Running: true, Time: 0.5, DataMB: 1, Frames: 5000, Backlog: 2})
+	sc.broadcastHeartbeat()
+	h := (<-updates).state.(Heartbeat)
+	if h.DataMB != 2 || h.DataMBps != 2 || h.Frames != 10000 || h.FramesPerSec != 10000 || h.Backlog != 2 {
+		t.Errorf("ALIVE message %+v, want 2 MB, 2 MB/s, 10000 frames, 10000 frames/s, backlog 2", h)
+	}
+	if h.WrittenMBps != 0 {
+		t.Errorf("first ALIVE message has WrittenMBps=%v, want 0", h.WrittenMBps)
+	}
+	if sc.totalData.DataMB != 0 || sc.totalData.Time != 0 || sc.totalData.Frames != 0 {
+		t.Errorf("totals not reset after ALIVE: %+v", sc.totalData)
+	}
+
+	sc.lastHeartbeat = time.Now().Add(-time.Second)
+	atomic.AddInt64(&bytesWrittenTotal, 3000000)
+	sc.broadcastHeartbeat()
+	h = (<-updates).state.(Heartbeat)
+	if h.WrittenMB < 3 || h.WrittenMBps < 0.5*h.WrittenMB || h.WrittenMBps > h.WrittenMB {
+		t.Errorf("ALIVE message reports %v MB written at %v MB/s, want >= 3 MB in about 1 second",
+			h.WrittenMB, h.WrittenMBps)
+	}
+	if h.DataMBps != 0 || h.FramesPerSec != 0 {
+		t.Errorf("ALIVE message with no data read has DataMBps=%v, FramesPerSec=%v", h.DataMBps, h.FramesPerSec)
+	}
+
+	// Card status is sent only while Start says the Lancero source is running.
+	sc.lancero, _ = NewLanceroSource()
+	if sc.broadcastHeartbeat(); (<-updates).state.(Heartbeat).Lancero != nil {
+		t.Error("ALIVE message has Lancero card status, but the Lancero source is not running")
+	}
+	sc.setLanceroRunning(true)
+	if sc.broadcastHeartbeat(); (<-updates).state.(Heartbeat).Lancero == nil {
+		t.Error("ALIVE message lacks Lancero card status while the Lancero source is running")
+	}
+}
+
+func TestHTTPGateway(t *testing.T) {
+	post := func(name, body string) (int, string) {
+		url := fmt.Sprintf("http://localhost:%d/api/%s", Ports.HTTP, name)
+		var resp *http.Response
+		var err error
+		for tries := 0; tries < 5; tries++ {
+			if resp, err = http.Post(url, "application/json", strings.NewReader(body)); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond << uint(tries))
+		}
+		if err != nil {
+			t.Fatalf("HTTP gateway POST %s failed: %v", name, err)
+		}
+		defer resp.Body.Close()
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(reply))
+	}
+
+	if status, reply := post("SourceControl.Multiply", `{"A": 6, "B": 7}`); status != http.StatusOK || reply != "42" {
+		t.Errorf("HTTP gateway Multiply gave status %d, reply %s, want 200, 42", status, reply)
+	}
+	if status, reply := post("status", ""); status != http.StatusOK {
+		t.Errorf("HTTP gateway status gave status %d, reply %s, want 200", status, reply)
+	}
+	for _, bad := range []struct {
+		name, body string
+		status     int
+	}{
+		{"nosuchroute", "", http.StatusNotFound},
+		{"SourceControl.NoSuchMethod", "", http.StatusNotFound},
+		{"triggers", "{not json", http.StatusBadRequest},
+		{"SourceControl.Multiply", `"a string"`, http.StatusBadRequest},
+		{"channelgroup", `{"Name": "has space", "ChannelIndices": [0]}`, http.StatusBadRequest},
+	} {
+		status, reply := post(bad.name, bad.body)
+		if status != bad.status || !strings.Contains(reply, `"error"`) {
+			t.Errorf("HTTP gateway %s gave status %d, reply %s, want %d and an error", bad.name, status, reply, bad.status)
+		}
+	}
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/status", Ports.HTTP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("HTTP gateway GET gave status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
 func TestMain(m *testing.M) {
 	// set log to write to a file
 	f, err := os.Create("dastardtestlogfile")
@@ -449,6 +674,9 @@ func TestMain(m *testing.M) {
 	if PubSummariesChan != nil {
 		close(PubSummariesChan)
 	}
+	if PubEnergiesChan != nil {
+		close(PubEnergiesChan)
+	}
 	close(abort)
 	os.Exit(result)
 }
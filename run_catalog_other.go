@@ -0,0 +1,12 @@
+//go:build !sqlite
+// +build !sqlite
+
+package dastard
+
+import "fmt"
+
+// catalogRunEvent fails: this Dastard was built without the SQLite run catalog, which
+// needs cgo. Build with -tags sqlite to use config key RunCatalog.
+func catalogRunEvent(filename string, body []byte) error {
+	return fmt.Errorf("this Dastard was built without SQLite support (build with -tags sqlite to use RunCatalog)")
+}
@@ -0,0 +1,85 @@
+//go:build sqlite
+// +build sqlite
+
+package dastard
+
+// The SQLite run catalog needs cgo, so it is built only with the sqlite build tag
+// (go build -tags sqlite).
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // registers the "sqlite3" database/sql driver
+)
+
+// runCatalogSchema creates the table of runs in an SQLite run catalog. There is one
+// row per run directory, added at START and completed at STOP.
+const runCatalogSchema = `CREATE TABLE IF NOT EXISTS runs (
+	run_directory    TEXT PRIMARY KEY,
+	filename_pattern TEXT,
+	source_name      TEXT,
+	source_config    TEXT,
+	nchannels        INTEGER,
+	comment          TEXT,
+	start_time       TEXT,
+	end_time         TEXT,
+	records_written  INTEGER,
+	metadata         TEXT
+)`
+
+// catalogRunEvent records the JSON-encoded event in the SQLite run catalog in filename,
+// creating the catalog if needed.
+func catalogRunEvent(filename string, body []byte) error {
+	var event RunEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return err
+	}
+	if event.RunMetadata == nil {
+		return fmt.Errorf("run event has no metadata")
+	}
+	md := event.RunMetadata
+	sourceConfig, err := json.Marshal(md.SourceConfig)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(runCatalogSchema); err != nil {
+		return err
+	}
+
+	switch strings.ToUpper(event.Event) {
+	case "START":
+		_, err = db.Exec(`INSERT OR REPLACE INTO runs (run_directory, filename_pattern, source_name,
+			source_config, nchannels, comment, start_time, metadata) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			event.RunDirectory, md.FilenamePattern, md.SourceName, string(sourceConfig), md.Nchannels,
+			md.Comment, md.StartTime.Format(time.RFC3339Nano), string(body))
+	case "STOP":
+		var endTime string
+		if md.EndTime != nil {
+			endTime = md.EndTime.Format(time.RFC3339Nano)
+		}
+		records := 0
+		for _, n := range md.RecordsWritten {
+			records += n
+		}
+		var result sql.Result
+		result, err = db.Exec(`UPDATE runs SET end_time=?, records_written=?, metadata=? WHERE run_directory=?`,
+			endTime, records, string(body), event.RunDirectory)
+		if err == nil {
+			if n, _ := result.RowsAffected(); n == 0 {
+				err = fmt.Errorf("no run %s to update at STOP", event.RunDirectory)
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown run event %q", event.Event)
+	}
+	return err
+}
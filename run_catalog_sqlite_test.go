@@ -0,0 +1,66 @@
+//go:build sqlite
+// +build sqlite
+
+package dastard
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunCatalog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_runcatalog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	start := time.Now()
+	md := &RunMetadata{SourceName: "SimPulse", Nchannels: 2, Comment: "calibration run",
+		FilenamePattern: filepath.Join(tmp, "run0001_%s.%s"), StartTime: start,
+		SourceConfig: SimPulseSourceConfig{Nchan: 2, SampleRate: 1000}}
+	encode := func(name string) []byte {
+		body, err := json.Marshal(RunEvent{Event: name, RunDirectory: filepath.Dir(md.FilenamePattern), RunMetadata: md})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	catalog := filepath.Join(tmp, "runs.sqlite")
+
+	if err := catalogRunEvent(catalog, encode("START")); err != nil {
+		t.Fatal(err)
+	}
+	end := start.Add(time.Minute)
+	md.EndTime = &end
+	md.RecordsWritten = []int{10, 15}
+	if err := catalogRunEvent(catalog, encode("STOP")); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var source, comment, endTime string
+	var records int
+	row := db.QueryRow("SELECT source_name, comment, end_time, records_written FROM runs WHERE run_directory=?", tmp)
+	if err := row.Scan(&source, &comment, &endTime, &records); err != nil {
+		t.Fatalf("run catalog has no complete row for the run: %v", err)
+	}
+	if source != md.SourceName || comment != md.Comment || records != 25 ||
+		endTime != end.Format(time.RFC3339Nano) {
+		t.Errorf("run catalog row has source=%q comment=%q end=%q records=%d", source, comment, endTime, records)
+	}
+
+	md.FilenamePattern = filepath.Join(tmp, "other", "run0002_%s.%s")
+	if err := catalogRunEvent(catalog, encode("STOP")); err == nil {
+		t.Error("catalogRunEvent should fail to STOP a run that never started")
+	}
+}
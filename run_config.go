@@ -0,0 +1,44 @@
+package dastard
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RunProjectors summarizes the projectors loaded in one channel when a run starts. The
+// projectors themselves are stored in the channel's OFF file, if one is written.
+type RunProjectors struct {
+	ChannelIndex     int
+	ChannelName      string
+	Nbases           int
+	ModelDescription string
+}
+
+// writeRunConfig writes a copy of the active Dastard configuration to the run directory,
+// so the data files are accompanied by the settings used to acquire them. The live
+// trigger, mix, and projector state replace the saved versions, which can lag behind.
+func (ds *AnySource) writeRunConfig(filename string) error {
+	v := viper.New()
+	if err := v.MergeConfigMap(viper.AllSettings()); err != nil {
+		return err
+	}
+	v.Set("currenttime", time.Now().Format(time.UnixDate))
+	v.Set("runsource", ds.name)
+	v.Set("trigger", ds.ComputeFullTriggerState())
+	if mix := ds.currentMixFractions(); mix != nil {
+		v.Set("mix", mix)
+	}
+	projectors := make([]RunProjectors, 0)
+	for _, channelIndex := range ds.ChannelsWithProjectors() {
+		dsp := ds.processors[channelIndex]
+		rp := RunProjectors{ChannelIndex: channelIndex, ModelDescription: dsp.modelDescription}
+		rp.Nbases, _ = dsp.projectors.Dims()
+		if channelIndex < len(ds.chanNames) {
+			rp.ChannelName = ds.chanNames[channelIndex]
+		}
+		projectors = append(projectors, rp)
+	}
+	v.Set("projectors", projectors)
+	return v.WriteConfigAs(filename)
+}
@@ -0,0 +1,175 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunCoordination lets several Dastard instances that write into one base path (e.g.,
+// the arrays of one instrument) share run numbers. The instances coordinate through a
+// small file in each day's directory, guarded by a lock file. An instance starting to
+// write joins the run most recently started by another instance, if that run is no
+// older than JoinSeconds and this instance has not already written it; otherwise it
+// starts the next run. So runs started together by all instances get one run number,
+// and each instance writes its files into the one run directory. The file names carry
+// the instance name (e.g., 20060102_run0001_A_chan1.ljh), so that instances naming their
+// channels alike don't overwrite each other's files.
+type RunCoordination struct {
+	Enabled     bool
+	Instance    string  // this instance's name, distinct among the coordinated instances
+	JoinSeconds float64 // how long after a run starts others may join it; 0 means 10
+}
+
+// Names of the coordination files in each day's directory.
+const (
+	runCoordinationFile = ".dastard_run"
+	runCoordinationLock = ".dastard_run.lock"
+)
+
+// How old a lock must be to be taken as left behind by a crashed instance, and how long
+// makeDirectory waits for the lock. An instance holds the lock only while it reads and
+// writes the coordination file, so a live lock is never stale, and the wait is long
+// enough to remove a stale one.
+const (
+	runLockStale   = 10 * time.Second
+	runLockTimeout = runLockStale + 5*time.Second
+)
+
+// validate checks the coordination config.
+func (rc *RunCoordination) validate() error {
+	if !(rc.JoinSeconds >= 0) || math.IsInf(rc.JoinSeconds, 1) {
+		return fmt.Errorf("RunCoordination JoinSeconds=%v, need >= 0", rc.JoinSeconds)
+	}
+	if rc.Enabled && rc.Instance == "" {
+		return fmt.Errorf("RunCoordination needs an Instance name")
+	}
+	if !validNamingPrefix.MatchString(rc.Instance) {
+		return fmt.Errorf("RunCoordination Instance=%q may use only letters, digits, '.', '_', and '-'", rc.Instance)
+	}
+	return nil
+}
+
+func (rc *RunCoordination) joinTime() time.Duration {
+	if rc.JoinSeconds == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(rc.JoinSeconds * float64(time.Second))
+}
+
+// coordinatedRun is the content of the coordination file: the run most recently started
+// in the day's directory, and the instances writing it.
+type coordinatedRun struct {
+	Run       int
+	Started   time.Time
+	Instances []string
+}
+
+// makeDirectory is like DirectoryNaming.makeDirectory, but joins the current run of the
+// coordinated instances if it may, and starts the next run otherwise.
+func (rc *RunCoordination) makeDirectory(n *DirectoryNaming, basepath string, now time.Time) (string, error) {
+	todayDir, today, err := n.makeTodayDirectory(basepath, now)
+	if err != nil {
+		return "", err
+	}
+	unlock, err := lockRunCoordination(filepath.Join(todayDir, runCoordinationLock))
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	statePath := filepath.Join(todayDir, runCoordinationFile)
+	state := coordinatedRun{Run: -1}
+	if contents, err := ioutil.ReadFile(statePath); err == nil {
+		if err = json.Unmarshal(contents, &state); err != nil {
+			return "", fmt.Errorf("run coordination file %s: %v", statePath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if state.Run >= 0 && now.Sub(state.Started) < rc.joinTime() && !containsString(state.Instances, rc.Instance) {
+		if _, err := os.Stat(n.runDirectory(todayDir, state.Run)); err == nil {
+			state.Instances = append(state.Instances, rc.Instance)
+			if err := writeCoordinatedRun(statePath, &state); err != nil {
+				return "", err
+			}
+			logInfof("Joining run %d started at %v by %v", state.Run, state.Started, state.Instances[0])
+			return rc.runPattern(n, todayDir, today, state.Run), nil
+		}
+	}
+
+	// Start the next run, after any made by this or other instances.
+	for i := state.Run + 1; i < n.maxRuns(); i++ {
+		_, err := n.makeRunDirectory(todayDir, today, i)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		state = coordinatedRun{Run: i, Started: now, Instances: []string{rc.Instance}}
+		if err := writeCoordinatedRun(statePath, &state); err != nil {
+			return "", err
+		}
+		return rc.runPattern(n, todayDir, today, i), nil
+	}
+	return "", fmt.Errorf("out of %d-digit ID numbers for today in %s", n.runDigits(), todayDir)
+}
+
+// runPattern returns the pattern of this instance's file names in the given run.
+func (rc *RunCoordination) runPattern(n *DirectoryNaming, todayDir, today string, run int) string {
+	return fmt.Sprintf("%s/%s_run%0*d_%s_%%s.%%s", n.runDirectory(todayDir, run), today, n.runDigits(), run,
+		rc.Instance)
+}
+
+// lockRunCoordination creates the lock file, waiting for another instance to remove it,
+// and returns a function that removes it. A lock older than runLockStale is removed.
+func lockRunCoordination(lockPath string) (func(), error) {
+	deadline := time.Now().Add(runLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > runLockStale {
+			logWarningf("Removing stale run coordination lock %s from %v", lockPath, info.ModTime())
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("run coordination lock %s is held by another instance", lockPath)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeCoordinatedRun replaces the coordination file, so that no instance reads half of it.
+func writeCoordinatedRun(statePath string, state *coordinatedRun) error {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
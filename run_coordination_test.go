@@ -0,0 +1,131 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCoordination(t *testing.T) {
+	for _, bad := range []RunCoordination{{Enabled: true}, {JoinSeconds: -1}, {Instance: "a", JoinSeconds: math.NaN()},
+		{Enabled: true, Instance: "a/b"}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("RunCoordination%+v.validate() should fail", bad)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "dastard_coordination_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	var naming DirectoryNaming
+	a := RunCoordination{Enabled: true, Instance: "A"}
+	b := RunCoordination{Enabled: true, Instance: "B"}
+	now := time.Date(2019, 3, 14, 15, 9, 26, 0, time.Local)
+	at := func(s float64) time.Time { return now.Add(time.Duration(s * float64(time.Second))) }
+
+	// An uncoordinated run already in the day's directory is skipped.
+	if _, err := naming.makeDirectory(tmp, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		rc   RunCoordination
+		when float64
+		run  string
+	}{
+		{a, 0, "0001"},
+		{b, 1, "0001"},  // B joins A's run
+		{a, 2, "0002"},  // A has written run 0001, so it starts the next
+		{b, 20, "0003"}, // run 0002 is too old to join
+		{a, 21, "0003"},
+		{a, 22, "0004"},
+		{b, 22, "0004"},
+	} {
+		pattern, err := test.rc.makeDirectory(&naming, tmp, at(test.when))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := filepath.Join(tmp, "20190314", test.run, "20190314_run"+test.run+"_"+test.rc.Instance+"_%s.%s")
+		if pattern != want {
+			t.Errorf("instance %s at %v s: makeDirectory gives %q, want %q", test.rc.Instance, test.when, pattern, want)
+		}
+	}
+
+	// A lock left behind by a crashed instance is removed.
+	lock := filepath.Join(tmp, "20190314", runCoordinationLock)
+	if err := ioutil.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.makeDirectory(&naming, tmp, at(40)); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("lock file %s remains after makeDirectory", lock)
+	}
+}
+
+func TestCoordinatedWriting(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_coordination_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	saved := writingPaths
+	defer func() { writingPaths = saved }()
+	writingPaths = &writingPathRegistry{}
+
+	// Two instances, with channels named alike, START together and write one run.
+	var sources [2]*AnySource
+	var dirs [2]string
+	for i, instance := range []string{"A", "B"} {
+		config := WritingPathConfig{BasePath: tmp, Coordination: RunCoordination{Enabled: true, Instance: instance}}
+		if err := writingPaths.set(config); err != nil {
+			t.Fatal(err)
+		}
+		ds := &AnySource{nchan: 2}
+		ds.rowColCodes = make([]RowColCode, ds.nchan)
+		if err := ds.PrepareRun(256, 1024); err != nil {
+			t.Fatal(err)
+		}
+		defer ds.Stop()
+		if err := ds.WriteControl(&WriteControlConfig{Request: "Start", WriteLJH22: true}); err != nil {
+			t.Fatal(err)
+		}
+		sources[i], dirs[i] = ds, ds.writingState.RunDirectory
+	}
+	if dirs[0] != dirs[1] {
+		t.Errorf("coordinated instances write runs %s and %s, want one run", dirs[0], dirs[1])
+	}
+	for _, ds := range sources {
+		if err := ds.WriteControl(&WriteControlConfig{Request: "Stop"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each instance keeps its own files. (LJH files are made at the first record, but
+	// they are named by the same pattern.)
+	files, err := ioutil.ReadDir(dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, instance := range []string{"A", "B"} {
+		for _, name := range []string{"experiment_state.txt", "metadata.json", "dastard_config.yaml", "dastard.log"} {
+			found := false
+			for _, f := range files {
+				found = found || (strings.HasSuffix(f.Name(), "_"+instance+"_"+name) && f.Size() > 0)
+			}
+			if !found {
+				t.Errorf("instance %s did not write its %s in %s", instance, name, dirs[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package dastard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RunEvent is reported to the run hooks when writing starts (Event "START") or stops
+// ("STOP"). It carries the run's metadata: at STOP, that includes the end time and the
+// number of records written.
+type RunEvent struct {
+	Event        string
+	RunDirectory string
+	*RunMetadata
+}
+
+// runHookRequest is one run event, encoded as JSON, and where to deliver it.
+type runHookRequest struct {
+	body    []byte
+	url     string // POST the event here, if not ""
+	catalog string // record the event in this SQLite file, if not "" (needs build tag sqlite)
+}
+
+// runHookTimeout limits how long the HTTP run hook may take to accept one event.
+const runHookTimeout = 10 * time.Second
+
+// Run events are delivered in order on one goroutine, so a slow or failing hook
+// never delays the data processing.
+var (
+	runHookRequests = make(chan runHookRequest, 16)
+	runHookOnce     sync.Once
+)
+
+// sendRunEvent queues a run event for the hooks set in the config file, if any:
+// RunHookURL is an HTTP endpoint to POST the event to as JSON, and RunCatalog is an
+// SQLite file with a table of runs (only if Dastard is built with the sqlite tag). The
+// metadata is encoded before sendRunEvent returns, so the caller may change it afterwards.
+func (ds *AnySource) sendRunEvent(event string) {
+	md := ds.writingState.metadata
+	req := runHookRequest{url: viper.GetString("runhookurl"), catalog: viper.GetString("runcatalog")}
+	if md == nil || (req.url == "" && req.catalog == "") {
+		return
+	}
+	var err error
+	req.body, err = json.Marshal(RunEvent{Event: event, RunDirectory: filepath.Dir(md.FilenamePattern), RunMetadata: md})
+	if err != nil {
+		logWarningf("Could not encode run %s event: %v", event, err)
+		return
+	}
+	runHookOnce.Do(func() {
+		go func() {
+			for req := range runHookRequests {
+				req.deliver()
+			}
+		}()
+	})
+	select {
+	case runHookRequests <- req:
+	default:
+		logWarningf("Run hooks are too slow; dropped the run %s event", event)
+	}
+}
+
+// deliver sends the event to each hook, logging any failures.
+func (req runHookRequest) deliver() {
+	if req.url != "" {
+		if err := postRunEvent(req.url, req.body); err != nil {
+			logWarningf("Run hook %s failed: %v", req.url, err)
+		}
+	}
+	if req.catalog != "" {
+		if err := catalogRunEvent(req.catalog, req.body); err != nil {
+			logWarningf("Could not update run catalog %s: %v", req.catalog, err)
+		}
+	}
+}
+
+// postRunEvent POSTs the JSON-encoded event to url.
+func postRunEvent(url string, body []byte) error {
+	client := http.Client{Timeout: runHookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
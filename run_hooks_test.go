@@ -0,0 +1,63 @@
+package dastard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunHooks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_runhooks_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	events := make(chan RunEvent, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RunEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	md := &RunMetadata{SourceName: "SimPulse", Nchannels: 2, Comment: "calibration run",
+		FilenamePattern: filepath.Join(tmp, "run0001_%s.%s"), StartTime: start,
+		SourceConfig: SimPulseSourceConfig{Nchan: 2, SampleRate: 1000}}
+	encode := func(name string) []byte {
+		body, err := json.Marshal(RunEvent{Event: name, RunDirectory: filepath.Dir(md.FilenamePattern), RunMetadata: md})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	runHookRequest{body: encode("START"), url: server.URL}.deliver()
+	end := start.Add(time.Minute)
+	md.EndTime = &end
+	md.RecordsWritten = []int{10, 15}
+	runHookRequest{body: encode("STOP"), url: server.URL}.deliver()
+
+	for _, want := range []string{"START", "STOP"} {
+		select {
+		case event := <-events:
+			if event.Event != want || event.RunDirectory != tmp || event.RunMetadata == nil ||
+				event.Comment != md.Comment || event.SourceName != md.SourceName {
+				t.Errorf("HTTP run hook received %+v, want the %s event", event, want)
+			}
+		default:
+			t.Errorf("HTTP run hook did not receive the %s event", want)
+		}
+	}
+	if err := postRunEvent(server.URL, []byte("not JSON")); err == nil {
+		t.Error("postRunEvent should fail when the server returns an error status")
+	}
+}
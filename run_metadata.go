@@ -0,0 +1,147 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// RunMetadata is the machine-readable context of one data-writing run. It is written
+// as JSON to the run directory when writing starts, and rewritten when writing stops
+// to add the end time and the number of records written.
+type RunMetadata struct {
+	DastardVersion  string
+	GitHash         string
+	BuildDate       string
+	SourceName      string
+	SourceConfig    interface{} `json:",omitempty"`
+	Nchannels       int
+	SampleRate      float64 // samples per second
+	NPresamples     int
+	NSamples        int
+	Channels        []ChannelGeometry
+	TriggerStates   []FullTriggerState
+	MixFractions    []float64 `json:",omitempty"`
+	FilenamePattern string
+	DiskPatterns    []string `json:",omitempty"` // FilenamePattern on each output disk, if several
+	ChannelDisks    []int    `json:",omitempty"` // index in DiskPatterns of each channel's disk
+	WriteLJH22      bool
+	WriteOFF        bool
+	WriteLJH3       bool
+	Comment         string
+	StartTime       time.Time
+	EndTime         *time.Time          `json:",omitempty"`
+	RecordsWritten  []int               `json:",omitempty"`
+	Pauses          []PauseInterval     `json:",omitempty"` // intervals during which writing was paused
+	TriggerStorms   []TriggerStormEvent `json:",omitempty"` // trips of the trigger storm breaker
+	// Host clock synchronization at the start, every clockSyncPeriod, and at the end
+	ClockSync []ClockSyncStatus
+}
+
+// ChannelGeometry gives the name and the TDM row/column location of one channel.
+type ChannelGeometry struct {
+	Name   string
+	Number int
+	Row    int
+	Col    int
+	Nrows  int
+	Ncols  int
+	// Added to the times of this channel's records, for when its TDM row is sampled in the frame
+	RowOffsetNs int64 `json:",omitempty"`
+}
+
+// startRunMetadata collects the metadata for a run that is starting to write files
+// with the given filenamePattern, and writes it to a new metadata file.
+func (ds *AnySource) startRunMetadata(config *WriteControlConfig, filenamePattern string) error {
+	md := &RunMetadata{
+		DastardVersion:  Build.Version,
+		GitHash:         Build.Githash,
+		BuildDate:       Build.Date,
+		SourceName:      ds.name,
+		SourceConfig:    ds.sourceConfig,
+		Nchannels:       ds.nchan,
+		SampleRate:      ds.sampleRate,
+		TriggerStates:   ds.ComputeFullTriggerState(),
+		MixFractions:    ds.currentMixFractions(),
+		FilenamePattern: filenamePattern,
+		DiskPatterns:    ds.writingState.DiskPatterns,
+		ChannelDisks:    ds.writingState.channelDisks,
+		WriteLJH22:      config.WriteLJH22,
+		WriteOFF:        config.WriteOFF,
+		WriteLJH3:       config.WriteLJH3,
+		Comment:         config.Comment,
+		StartTime:       time.Now(),
+	}
+	if len(ds.processors) > 0 {
+		md.NPresamples = ds.processors[0].NPresamples
+		md.NSamples = ds.processors[0].NSamples
+	}
+	md.Channels = make([]ChannelGeometry, ds.nchan)
+	for i := range md.Channels {
+		cg := &md.Channels[i]
+		if i < len(ds.chanNames) {
+			cg.Name = ds.chanNames[i]
+		}
+		if i < len(ds.chanNumbers) {
+			cg.Number = ds.chanNumbers[i]
+		}
+		if i < len(ds.rowColCodes) {
+			rccode := ds.rowColCodes[i]
+			cg.Row, cg.Col = rccode.row(), rccode.col()
+			cg.Nrows, cg.Ncols = rccode.rows(), rccode.cols()
+		}
+		if i < len(ds.processors) {
+			cg.RowOffsetNs = ds.processors[i].rowOffset.Nanoseconds()
+		}
+	}
+	ds.writingState.metadata = md
+	ds.writingState.MetadataFilename = fmt.Sprintf(filenamePattern, "metadata", "json")
+	ds.recordClockSync()
+	ds.sendRunEvent("START")
+	return ds.writingState.writeMetadata()
+}
+
+// stopRunMetadata adds the end time and the number of records written per channel
+// to the run's metadata, and rewrites the metadata file.
+func (ds *AnySource) stopRunMetadata(recordsWritten []int) error {
+	if ds.writingState.metadata == nil {
+		return nil
+	}
+	now := time.Now()
+	ds.writingState.metadata.EndTime = &now
+	ds.writingState.metadata.RecordsWritten = recordsWritten
+	ds.recordClockSync()
+	err := ds.writingState.writeMetadata()
+	ds.sendRunEvent("STOP")
+	ds.writingState.metadata = nil
+	ds.writingState.MetadataFilename = ""
+	return err
+}
+
+// currentMixFractions returns a copy of the mix fractions last reported by the source,
+// or nil for sources that don't mix.
+func (ds *AnySource) currentMixFractions() []float64 {
+	ds.mixLock.Lock()
+	defer ds.mixLock.Unlock()
+	if ds.mixFractions == nil {
+		return nil
+	}
+	return append([]float64{}, ds.mixFractions...)
+}
+
+// setMixFractions stores the source's current mix fractions for currentMixFractions.
+func (ds *AnySource) setMixFractions(mix []float64) {
+	ds.mixLock.Lock()
+	defer ds.mixLock.Unlock()
+	ds.mixFractions = append([]float64{}, mix...)
+}
+
+// writeMetadata (over)writes the metadata file.
+func (ws *WritingState) writeMetadata() error {
+	contents, err := json.MarshalIndent(ws.metadata, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ws.MetadataFilename, contents, 0644)
+}
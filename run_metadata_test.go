@@ -0,0 +1,148 @@
+package dastard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestRunMetadata(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_metadata_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := AnySource{nchan: 4, name: "TestSource", sampleRate: 1000}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	for i := range ds.rowColCodes {
+		ds.rowColCodes[i] = rcCode(i/2, i%2, 2, 2)
+	}
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	ds.setMixFractions([]float64{0, 1.5, 0, 2.5})
+
+	config := &WriteControlConfig{Request: "Start", Path: tmp, WriteLJH22: true, Comment: "test run"}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl START failed: %v", err)
+	}
+	filename := ds.writingState.MetadataFilename
+	var md RunMetadata
+	readMetadata := func() {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("could not read metadata file: %v", err)
+		}
+		if err := json.Unmarshal(contents, &md); err != nil {
+			t.Fatalf("could not parse metadata file: %v", err)
+		}
+	}
+	readMetadata()
+	if md.SourceName != "TestSource" || md.Nchannels != 4 || md.SampleRate != 1000 ||
+		md.NPresamples != 256 || md.NSamples != 1024 || md.Comment != "test run" || !md.WriteLJH22 {
+		t.Errorf("metadata at START is %+v", md)
+	}
+	if md.DastardVersion != Build.Version || md.GitHash != Build.Githash {
+		t.Errorf("metadata has version %s hash %s, want %s %s", md.DastardVersion, md.GitHash,
+			Build.Version, Build.Githash)
+	}
+	if len(md.Channels) != 4 || md.Channels[3].Row != 1 || md.Channels[3].Col != 1 ||
+		md.Channels[3].Nrows != 2 || md.Channels[3].Ncols != 2 {
+		t.Errorf("metadata channel geometry is %+v", md.Channels)
+	}
+	if len(md.MixFractions) != 4 || md.MixFractions[3] != 2.5 {
+		t.Errorf("metadata MixFractions=%v", md.MixFractions)
+	}
+	if len(md.TriggerStates) == 0 {
+		t.Errorf("metadata has no TriggerStates")
+	}
+	if len(md.ClockSync) != 1 || md.ClockSync[0].Time.IsZero() {
+		t.Errorf("metadata at START has ClockSync=%+v, want 1 status", md.ClockSync)
+	}
+	if md.EndTime != nil || md.RecordsWritten != nil {
+		t.Errorf("metadata at START should have no EndTime or RecordsWritten")
+	}
+
+	ds.processors[2].numberWritten = 17
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl STOP failed: %v", err)
+	}
+	readMetadata()
+	if md.EndTime == nil || md.EndTime.Before(md.StartTime) {
+		t.Errorf("metadata at STOP has EndTime %v, StartTime %v", md.EndTime, md.StartTime)
+	}
+	if len(md.RecordsWritten) != 4 || md.RecordsWritten[2] != 17 {
+		t.Errorf("metadata at STOP has RecordsWritten=%v", md.RecordsWritten)
+	}
+	if len(md.ClockSync) != 2 {
+		t.Errorf("metadata at STOP has %d ClockSync statuses, want 2", len(md.ClockSync))
+	}
+	if ds.writingState.MetadataFilename != "" {
+		t.Errorf("MetadataFilename=%q after STOP, want empty", ds.writingState.MetadataFilename)
+	}
+}
+
+func TestRunConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_runconfig_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := AnySource{nchan: 2, name: "TestSource", sampleRate: 1000}
+	ds.rowColCodes = []RowColCode{rcCode(0, 0, 2, 1), rcCode(1, 0, 2, 1)}
+	ds.PrepareRun(20, 100)
+	defer ds.Stop()
+	ds.setMixFractions([]float64{0, 1.5})
+	ds.chanNames = []string{"chan1", "chan2"}
+	projectors := mat.NewDense(3, 100, nil)
+	basis := mat.NewDense(100, 3, nil)
+	if err := ds.processors[1].SetProjectorsBasis(*projectors, *basis, "test model"); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("testrunconfig", 17)
+	defer viper.Set("testrunconfig", nil)
+
+	config := &WriteControlConfig{Request: "Start", Path: tmp, WriteLJH22: true}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl START failed: %v", err)
+	}
+	filename := ds.writingState.ConfigFilename
+	if !strings.HasSuffix(filename, "_dastard_config.yaml") {
+		t.Errorf("ConfigFilename=%q, want a name ending _dastard_config.yaml", filename)
+	}
+	v := viper.New()
+	v.SetConfigFile(filename)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatalf("could not read run config file: %v", err)
+	}
+	if v.GetInt("testrunconfig") != 17 || v.GetString("runsource") != "TestSource" {
+		t.Errorf("run config has testrunconfig=%v runsource=%v, want 17 and TestSource",
+			v.Get("testrunconfig"), v.Get("runsource"))
+	}
+	if mix := v.GetStringSlice("mix"); len(mix) != 2 || mix[1] != "1.5" {
+		t.Errorf("run config has mix=%v, want [0 1.5]", v.Get("mix"))
+	}
+	if triggers, ok := v.Get("trigger").([]interface{}); !ok || len(triggers) == 0 {
+		t.Errorf("run config has trigger=%v, want the trigger states", v.Get("trigger"))
+	}
+	var rp []RunProjectors
+	if err := v.UnmarshalKey("projectors", &rp); err != nil || len(rp) != 1 ||
+		rp[0] != (RunProjectors{ChannelIndex: 1, ChannelName: "chan2", Nbases: 3, ModelDescription: "test model"}) {
+		t.Errorf("run config has projectors=%+v (err %v)", rp, err)
+	}
+
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl STOP failed: %v", err)
+	}
+	if ds.writingState.ConfigFilename != "" {
+		t.Errorf("ConfigFilename=%q after STOP, want empty", ds.writingState.ConfigFilename)
+	}
+}
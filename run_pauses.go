@@ -0,0 +1,65 @@
+package dastard
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// PauseInterval is one interval of a run during which writing was paused, so that
+// analysis can correct the exposure time.
+type PauseInterval struct {
+	StartFrame FrameIndex // the first frame not written
+	StartTime  time.Time
+	EndFrame   FrameIndex // the first frame written again (or not written, if the run stopped while paused)
+	EndTime    time.Time  // zero while still paused
+}
+
+// startRunPauses starts a run with no pauses. The pauses file is created only when
+// writing is first paused.
+func (ds *AnySource) startRunPauses(filenamePattern string) {
+	ds.writingState.PausesFilename = fmt.Sprintf(filenamePattern, "pauses", "txt")
+	ds.writingState.PauseCount = 0
+	ds.writingState.PausedSeconds = 0
+	ds.writingState.pauses = make([]PauseInterval, 0)
+}
+
+// markPause records that writing pauses (request "PAUSE") or resumes ("UNPAUSE" or
+// "STOP") at the next frame to be processed. Requests that don't change whether writing
+// is paused are ignored. It must be called before the writingState changes.
+func (ds *AnySource) markPause(request string) error {
+	ws := &ds.writingState
+	if !ws.Active || ws.PausesFilename == "" || (request == "PAUSE") == ws.Paused {
+		return nil
+	}
+	now := time.Now()
+	frame := ds.frameSync.nextFrame
+	if request == "PAUSE" {
+		ws.pauses = append(ws.pauses, PauseInterval{StartFrame: frame, StartTime: now})
+		ws.PauseCount++
+	} else if n := len(ws.pauses); n > 0 {
+		p := &ws.pauses[n-1]
+		p.EndFrame = frame
+		p.EndTime = now
+		ws.PausedSeconds += now.Sub(p.StartTime).Seconds()
+	}
+	if ws.metadata != nil {
+		ws.metadata.Pauses = ws.pauses
+	}
+
+	fp, err := os.OpenFile(ws.PausesFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if ws.PauseCount == 1 && request == "PAUSE" {
+		if _, err := fp.WriteString("# unix time in nanoseconds, frame number, PAUSE or UNPAUSE (or STOP while paused)\n"); err != nil {
+			fp.Close()
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(fp, "%v, %v, %v\n", now.UnixNano(), frame, request); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
@@ -0,0 +1,78 @@
+package dastard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunPauses(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_pauses_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := AnySource{nchan: 2, name: "TestSource", sampleRate: 1000}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+
+	config := &WriteControlConfig{Request: "Start", Path: tmp, WriteLJH22: true}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl START failed: %v", err)
+	}
+	ws := ds.ComputeWritingState()
+	if ws.PausesFilename == "" || ws.PauseCount != 0 {
+		t.Errorf("WritingState has PausesFilename %q and PauseCount %d at start", ws.PausesFilename, ws.PauseCount)
+	}
+	if _, err := os.Stat(ws.PausesFilename); !os.IsNotExist(err) {
+		t.Error("pauses file should not exist before the first pause")
+	}
+	pausesFilename := ws.PausesFilename
+	metadataFilename := ws.MetadataFilename
+	for _, step := range []struct {
+		request string
+		frame   FrameIndex
+	}{{"Pause", 1000}, {"Pause", 1500}, {"Unpause", 2000}, {"Unpause", 2500}, {"Pause", 3000}, {"Stop", 4000}} {
+		ds.frameSync.nextFrame = step.frame
+		config.Request = step.request
+		if err := ds.WriteControl(config); err != nil {
+			t.Fatalf("WriteControl %s failed: %v", step.request, err)
+		}
+	}
+	if ws := ds.ComputeWritingState(); ws.PauseCount != 2 || ws.PausedSeconds <= 0 || ws.PausesFilename != "" {
+		t.Errorf("WritingState has PauseCount %d, PausedSeconds %v, PausesFilename %q after stop, want 2, > 0, and empty",
+			ws.PauseCount, ws.PausedSeconds, ws.PausesFilename)
+	}
+
+	contents, err := ioutil.ReadFile(pausesFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	want := []string{"1000, PAUSE", "2000, UNPAUSE", "3000, PAUSE", "4000, STOP"}
+	if len(lines) != 1+len(want) || !strings.HasPrefix(lines[0], "#") {
+		t.Fatalf("pauses file is %q, want a header and %d lines", contents, len(want))
+	}
+	for i, w := range want {
+		if !strings.HasSuffix(lines[i+1], w) {
+			t.Errorf("pauses file line %d is %q, want it to end %q", i+1, lines[i+1], w)
+		}
+	}
+
+	contents, err = ioutil.ReadFile(metadataFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md RunMetadata
+	if err := json.Unmarshal(contents, &md); err != nil {
+		t.Fatal(err)
+	}
+	if len(md.Pauses) != 2 || md.Pauses[0].StartFrame != 1000 || md.Pauses[0].EndFrame != 2000 ||
+		md.Pauses[1].StartFrame != 3000 || md.Pauses[1].EndFrame != 4000 || md.Pauses[1].EndTime.Before(md.Pauses[1].StartTime) {
+		t.Errorf("metadata has Pauses %+v", md.Pauses)
+	}
+}
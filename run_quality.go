@@ -0,0 +1,210 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// qualityRateInterval is the width of the time bins of the trigger rates in a RunQuality.
+var qualityRateInterval = 10 * time.Second
+
+// RunQuality is a data-quality summary of one data-writing run, written as JSON to the
+// run directory when writing stops, for a quick sanity check of the run.
+type RunQuality struct {
+	SourceName   string
+	StartTime    time.Time
+	EndTime      time.Time
+	RateInterval float64 // width of the TriggerRates bins, in seconds
+	Channels     []ChannelQuality
+	ResyncEvents []ResyncEvent // frame gaps and other discontinuities (except counter rollovers)
+}
+
+// ChannelQuality summarizes the records of one channel during a run.
+type ChannelQuality struct {
+	ChannelIndex   int
+	Name           string
+	Records        int       // records triggered while writing, including when paused
+	RecordsWritten int       // records written to files
+	PileupRecords  int       // records flagged as pileup
+	PretrigMean    float64   // mean over records of the pretrigger mean
+	PretrigMeanStd float64   // standard deviation over records of the pretrigger mean
+	PretrigRMS     float64   // mean over records of the pretrigger RMS
+	TriggerRates   []float64 // triggers per second in each interval since the run started
+	LiveTime       float64   // seconds of data in which the channel could trigger
+	DeadTime       float64   // seconds of data in the record-length holdoff after each trigger
+}
+
+// RunQualityDigest is the short form of a RunQuality, broadcast to clients as a
+// RUNSUMMARY message when writing stops.
+type RunQualityDigest struct {
+	Filename       string
+	Duration       float64 // seconds
+	Records        int
+	RecordsWritten int
+	PileupRecords  int
+	MeanRate       float64 // triggers per second per channel
+	MinRate        float64 // the lowest channel's mean triggers per second
+	MaxRate        float64 // the highest channel's mean triggers per second
+	SilentChannels []int   // channels with no records at all
+	ResyncEvents   int
+	DeadFraction   float64 // dead time of all channels over their live plus dead time
+}
+
+// qualityStats accumulates the ChannelQuality of one channel. Only the channel's
+// processing goroutine may use it.
+type qualityStats struct {
+	start      time.Time
+	records    int
+	pileup     int
+	sumMean    float64
+	sumMeanSq  float64
+	sumRMS     float64
+	rateCounts []int
+	deadTime   deadTimeStats // the channel's dead-time accounting when the run started
+}
+
+// add includes records in the statistics.
+func (qs *qualityStats) add(records []*DataRecord) {
+	for _, rec := range records {
+		qs.records++
+		if rec.pileup {
+			qs.pileup++
+		}
+		qs.sumMean += rec.pretrigMean
+		qs.sumMeanSq += rec.pretrigMean * rec.pretrigMean
+		qs.sumRMS += rec.pretrigRMS
+		bin := 0
+		if dt := rec.trigTime.Sub(qs.start); dt > 0 {
+			bin = int(dt / qualityRateInterval)
+		}
+		for len(qs.rateCounts) <= bin {
+			qs.rateCounts = append(qs.rateCounts, 0)
+		}
+		qs.rateCounts[bin]++
+	}
+}
+
+// summarize returns the statistics as of time end.
+func (qs *qualityStats) summarize(end time.Time) ChannelQuality {
+	var cq ChannelQuality
+	cq.Records = qs.records
+	cq.PileupRecords = qs.pileup
+	if qs.records > 0 {
+		n := float64(qs.records)
+		cq.PretrigMean = qs.sumMean / n
+		cq.PretrigMeanStd = math.Sqrt(math.Max(0, qs.sumMeanSq/n-cq.PretrigMean*cq.PretrigMean))
+		cq.PretrigRMS = qs.sumRMS / n
+	}
+	nbins := int(end.Sub(qs.start)/qualityRateInterval) + 1
+	if nbins < len(qs.rateCounts) {
+		nbins = len(qs.rateCounts)
+	}
+	cq.TriggerRates = make([]float64, nbins)
+	for i := range cq.TriggerRates {
+		// The last bin is only partly over.
+		binStart := qs.start.Add(time.Duration(i) * qualityRateInterval)
+		width := qualityRateInterval
+		if binEnd := binStart.Add(width); binEnd.After(end) {
+			width = end.Sub(binStart)
+		}
+		if i < len(qs.rateCounts) && width > 0 {
+			cq.TriggerRates[i] = float64(qs.rateCounts[i]) / width.Seconds()
+		}
+	}
+	return cq
+}
+
+// startRunQuality starts collecting the quality statistics of every channel.
+func (ds *AnySource) startRunQuality() {
+	now := time.Now()
+	for _, dsp := range ds.processors {
+		dsp.quality = &qualityStats{start: now, deadTime: dsp.deadTime}
+	}
+	ds.writingState.qualityStart = now
+	ds.writingState.resyncsBefore = len(ds.frameSync.events)
+}
+
+// stopRunQuality stops collecting quality statistics, writes the run's RunQuality to
+// the run directory, and broadcasts its digest. It must be called before the
+// writingState forgets the run's FilenamePattern.
+func (ds *AnySource) stopRunQuality(recordsWritten []int) error {
+	if len(ds.processors) == 0 || ds.processors[0].quality == nil {
+		return nil
+	}
+	end := time.Now()
+	rq := RunQuality{SourceName: ds.name, StartTime: ds.writingState.qualityStart, EndTime: end,
+		RateInterval: qualityRateInterval.Seconds(), ResyncEvents: make([]ResyncEvent, 0)}
+	for i, dsp := range ds.processors {
+		cq := dsp.quality.summarize(end)
+		if dsp.SampleRate > 0 {
+			live, dead := dsp.deadTime.since(dsp.quality.deadTime)
+			cq.LiveTime = float64(live) / dsp.SampleRate
+			cq.DeadTime = float64(dead) / dsp.SampleRate
+		}
+		dsp.quality = nil
+		cq.ChannelIndex = i
+		if i < len(ds.chanNames) {
+			cq.Name = ds.chanNames[i]
+		}
+		if i < len(recordsWritten) {
+			cq.RecordsWritten = recordsWritten[i]
+		}
+		rq.Channels = append(rq.Channels, cq)
+	}
+	if ds.writingState.resyncsBefore <= len(ds.frameSync.events) {
+		for _, event := range ds.frameSync.events[ds.writingState.resyncsBefore:] {
+			if event.Kind != ResyncWrap {
+				rq.ResyncEvents = append(rq.ResyncEvents, event)
+			}
+		}
+	}
+
+	filename := fmt.Sprintf(ds.writingState.FilenamePattern, "run_summary", "json")
+	digest := rq.digest(filename)
+	select { // never stall data processing to report the digest
+	case clientMessageChan <- ClientUpdate{"RUNSUMMARY", digest}:
+	default:
+	}
+	contents, err := json.MarshalIndent(rq, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, contents, 0644)
+}
+
+// digest returns the RunQualityDigest of rq, which is saved in filename.
+func (rq *RunQuality) digest(filename string) RunQualityDigest {
+	d := RunQualityDigest{Filename: filename, Duration: rq.EndTime.Sub(rq.StartTime).Seconds(),
+		ResyncEvents: len(rq.ResyncEvents), SilentChannels: make([]int, 0)}
+	var liveTime, deadTime float64
+	for i, cq := range rq.Channels {
+		liveTime += cq.LiveTime
+		deadTime += cq.DeadTime
+		d.Records += cq.Records
+		d.RecordsWritten += cq.RecordsWritten
+		d.PileupRecords += cq.PileupRecords
+		if cq.Records == 0 {
+			d.SilentChannels = append(d.SilentChannels, cq.ChannelIndex)
+		}
+		if d.Duration <= 0 {
+			continue
+		}
+		rate := float64(cq.Records) / d.Duration
+		if i == 0 || rate < d.MinRate {
+			d.MinRate = rate
+		}
+		if i == 0 || rate > d.MaxRate {
+			d.MaxRate = rate
+		}
+	}
+	if liveTime+deadTime > 0 {
+		d.DeadFraction = deadTime / (liveTime + deadTime)
+	}
+	if d.Duration > 0 && len(rq.Channels) > 0 {
+		d.MeanRate = float64(d.Records) / d.Duration / float64(len(rq.Channels))
+	}
+	return d
+}
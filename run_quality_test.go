@@ -0,0 +1,100 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQualityStats(t *testing.T) {
+	start := time.Now()
+	qs := &qualityStats{start: start}
+	qs.add([]*DataRecord{
+		{trigTime: start.Add(time.Second), pretrigMean: 100, pretrigRMS: 2},
+		{trigTime: start.Add(2 * time.Second), pretrigMean: 104, pretrigRMS: 4, pileup: true},
+		{trigTime: start.Add(qualityRateInterval + time.Second), pretrigMean: 102, pretrigRMS: 6},
+	})
+	end := start.Add(qualityRateInterval + qualityRateInterval/2)
+	cq := qs.summarize(end)
+	if cq.Records != 3 || cq.PileupRecords != 1 || cq.PretrigMean != 102 || cq.PretrigRMS != 4 {
+		t.Errorf("summarize() = %+v, want 3 records, 1 pileup, PretrigMean 102, PretrigRMS 4", cq)
+	}
+	if want := math.Sqrt(8.0 / 3); math.Abs(cq.PretrigMeanStd-want) > 1e-9 {
+		t.Errorf("summarize().PretrigMeanStd=%v, want %v", cq.PretrigMeanStd, want)
+	}
+	wantRates := []float64{2 / qualityRateInterval.Seconds(), 1 / (qualityRateInterval / 2).Seconds()}
+	if len(cq.TriggerRates) != 2 || math.Abs(cq.TriggerRates[0]-wantRates[0]) > 1e-9 ||
+		math.Abs(cq.TriggerRates[1]-wantRates[1]) > 1e-9 {
+		t.Errorf("summarize().TriggerRates=%v, want %v", cq.TriggerRates, wantRates)
+	}
+
+	rq := RunQuality{StartTime: start, EndTime: start.Add(10 * time.Second),
+		Channels: []ChannelQuality{{ChannelIndex: 0, Records: 50, LiveTime: 9, DeadTime: 1}, {ChannelIndex: 1, Records: 0, LiveTime: 10},
+			{ChannelIndex: 2, Records: 100, RecordsWritten: 90, PileupRecords: 7, LiveTime: 8, DeadTime: 2}},
+		ResyncEvents: []ResyncEvent{{Kind: ResyncGap}}}
+	d := rq.digest("x.json")
+	if d.Filename != "x.json" || d.Duration != 10 || d.Records != 150 || d.RecordsWritten != 90 || d.PileupRecords != 7 ||
+		d.MeanRate != 5 || d.MinRate != 0 || d.MaxRate != 10 || d.ResyncEvents != 1 ||
+		len(d.SilentChannels) != 1 || d.SilentChannels[0] != 1 || d.DeadFraction != 0.1 {
+		t.Errorf("digest() = %+v", d)
+	}
+}
+
+func TestRunQuality(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_quality_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := AnySource{nchan: 2, name: "TestSource", sampleRate: 1000}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	for i := range ds.rowColCodes {
+		ds.rowColCodes[i] = rcCode(i, 0, 2, 1)
+	}
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+
+	config := &WriteControlConfig{Request: "Start", Path: tmp, WriteLJH22: true}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl START failed: %v", err)
+	}
+	pattern := ds.writingState.FilenamePattern
+	ds.frameSync.events = append(ds.frameSync.events, ResyncEvent{Kind: ResyncWrap},
+		ResyncEvent{Kind: ResyncGap, Expected: 100, Observed: 200, Corrected: 200})
+	ds.processors[1].quality.add([]*DataRecord{{trigTime: time.Now(), pretrigMean: 1000, pretrigRMS: 3}})
+	ds.processors[1].numberWritten = 1
+
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl STOP failed: %v", err)
+	}
+	if ds.processors[0].quality != nil {
+		t.Error("quality statistics should stop with writing")
+	}
+	contents, err := ioutil.ReadFile(fmt.Sprintf(pattern, "run_summary", "json"))
+	if err != nil {
+		t.Fatalf("could not read run summary: %v", err)
+	}
+	var rq RunQuality
+	if err := json.Unmarshal(contents, &rq); err != nil {
+		t.Fatalf("could not parse run summary: %v", err)
+	}
+	if rq.SourceName != "TestSource" || len(rq.Channels) != 2 || rq.EndTime.Before(rq.StartTime) {
+		t.Errorf("run summary is %+v", rq)
+	}
+	if cq := rq.Channels[1]; cq.Records != 1 || cq.RecordsWritten != 1 || cq.PretrigMean != 1000 ||
+		cq.PretrigRMS != 3 || cq.Name != "chan1" {
+		t.Errorf("run summary channel 1 is %+v", cq)
+	}
+	if rq.Channels[0].Records != 0 {
+		t.Errorf("run summary channel 0 is %+v", rq.Channels[0])
+	}
+	if len(rq.ResyncEvents) != 1 || rq.ResyncEvents[0].Kind != ResyncGap {
+		t.Errorf("run summary has ResyncEvents %+v, want one GAP", rq.ResyncEvents)
+	}
+}
@@ -133,6 +133,78 @@ func TestStreamGap(t *testing.T) {
 	}
 }
 
+// TestStreamBufferReuse checks that appending to and trimming a stream allocate a new
+// buffer only when the window reaches the end of the old one while records refer to it.
+func TestStreamBufferReuse(t *testing.T) {
+	const seglen, keep = 100, 50
+	stream := NewDataStream(make([]RawType, 0), 1, 0, time.Now(), time.Millisecond)
+	stream.reserve(10 * seglen)
+	segment := NewDataSegment(make([]RawType, seglen), 1, 0, time.Now(), time.Millisecond)
+	for _, shared := range []bool{false, true} {
+		allocs := testing.AllocsPerRun(100, func() {
+			stream.AppendSegment(segment)
+			stream.shared = shared // as if a record referred to the samples
+			stream.TrimKeepingN(keep)
+		})
+		limit := 0.0
+		if shared {
+			limit = 0.2 // a buffer of 1000 samples fills after 8 or more segments
+		}
+		if allocs > limit {
+			t.Errorf("shared=%t stream allocated %.2f times per segment, want at most %.2f", shared, allocs, limit)
+		}
+		if len(stream.rawData) != keep || stream.capacity != 10*seglen {
+			t.Errorf("shared=%t stream has %d samples in a buffer of %d, want %d in %d", shared,
+				len(stream.rawData), stream.capacity, keep, 10*seglen)
+		}
+	}
+}
+
+// TestRecordsShareStream checks that records refer to the stream's samples without
+// copying them, and that later trimming and appending don't change the records.
+func TestRecordsShareStream(t *testing.T) {
+	broker := NewTriggerBroker(1)
+	go broker.Run()
+	defer broker.Stop()
+	dsp := NewDataStreamProcessor(0, broker, 10, 50)
+	dsp.SampleRate = 1000.0
+	dsp.AutoTrigger = true
+	dsp.AutoDelay = 100 * time.Millisecond
+
+	const seglen = 500
+	sampleValue := func(frame int) RawType { return RawType(1000*(frame/seglen) + frame%seglen) }
+	var records []*DataRecord
+	for seg := 0; seg < 3; seg++ {
+		raw := make([]RawType, seglen)
+		for i := range raw {
+			raw[i] = sampleValue(seg*seglen + i)
+		}
+		dsp.stream.AppendSegment(NewDataSegment(raw, 1, FrameIndex(seg*seglen), time.Now(), time.Millisecond))
+		primaries := dsp.TriggerDataPrimary()
+		if len(primaries) == 0 {
+			t.Fatalf("segment %d made no records", seg)
+		}
+		rec := primaries[0]
+		first := int(rec.trigFrame-dsp.stream.firstFramenum) - rec.presamples
+		if &rec.data[0] != &dsp.stream.rawData[first] {
+			t.Errorf("segment %d record holds a copy of the data, want it to refer to the stream", seg)
+		}
+		dsp.TriggerDataSecondary()
+		records = append(records, primaries...)
+	}
+	for _, rec := range records {
+		if cap(rec.data) != len(rec.data) {
+			t.Errorf("record has cap(data)=%d, want len(data)=%d", cap(rec.data), len(rec.data))
+		}
+		for j, v := range rec.data {
+			if want := sampleValue(int(rec.trigFrame) - rec.presamples + j); v != want {
+				t.Errorf("record at frame %d has data[%d]=%d, want %d", rec.trigFrame, j, v, want)
+				break
+			}
+		}
+	}
+}
+
 func TestStreamDecimated(t *testing.T) {
 	ftime := time.Second
 	dA := []RawType{6, 4, 2, 5, 1, 0}
@@ -2,7 +2,9 @@ package dastard
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
+	"strings"
 	"time"
 )
 
@@ -13,6 +15,8 @@ type TriangleSource struct {
 	timeperbuf time.Duration
 	onecycle   []RawType
 	cycleLen   int
+	channels   []TriangleChannelConfig // per-channel waveforms, if any
+	impair     SimImpairments
 	AnySource
 }
 
@@ -28,6 +32,193 @@ type TriangleSourceConfig struct {
 	Nchan      int
 	SampleRate float64
 	Min, Max   RawType
+	Channels   []TriangleChannelConfig // optional; channels not listed get the Min-to-Max triangle
+	Naming     ChannelNaming
+	Impair     SimImpairments
+}
+
+// Allowed values of TriangleChannelConfig.Shape
+const (
+	WaveTriangle = "TRIANGLE"
+	WaveSawtooth = "SAWTOOTH"
+	WaveSquare   = "SQUARE"
+	WaveSine     = "SINE"
+)
+
+// TriangleChannelConfig describes the waveform of one channel of a TriangleSource.
+// The value is Offset + Amplitude*shape(t/Period + Phase), where every shape runs from
+// -1 at the start of a cycle to +1 (at mid-cycle for the triangle and square waves).
+// Values are clipped to the range of RawType.
+type TriangleChannelConfig struct {
+	Shape     string  // TRIANGLE (the default), SAWTOOTH, SQUARE, or SINE
+	Amplitude float64 // half the peak-to-peak value, in raw units
+	Offset    float64 // DC level, in raw units
+	Period    float64 // seconds; 0 means the period of the Min-to-Max triangle
+	Phase     float64 // fraction of a cycle to advance the wave
+}
+
+// waveShape returns the value in [-1,1] of the named shape at phase p in [0,1).
+func waveShape(shape string, p float64) float64 {
+	switch shape {
+	case WaveSawtooth:
+		return -1 + 2*p
+	case WaveSquare:
+		if p < 0.5 {
+			return -1
+		}
+		return 1
+	case WaveSine:
+		return -math.Cos(2 * math.Pi * p)
+	}
+	if p < 0.5 {
+		return -1 + 4*p
+	}
+	return 3 - 4*p
+}
+
+// validate checks one channel's waveform and normalizes its Shape.
+func (cc *TriangleChannelConfig) validate(sampleRate float64) error {
+	cc.Shape = strings.ToUpper(cc.Shape)
+	switch cc.Shape {
+	case "":
+		cc.Shape = WaveTriangle
+	case WaveTriangle, WaveSawtooth, WaveSquare, WaveSine:
+	default:
+		return fmt.Errorf("Shape=%q, need one of (%s, %s, %s, %s)", cc.Shape,
+			WaveTriangle, WaveSawtooth, WaveSquare, WaveSine)
+	}
+	for _, v := range []float64{cc.Amplitude, cc.Offset, cc.Period, cc.Phase} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("waveform %+v has a non-finite value", *cc)
+		}
+	}
+	if cc.Period < 0 || (cc.Period > 0 && cc.Period*sampleRate < 2) {
+		return fmt.Errorf("Period=%v s, need 0 or at least 2 samples", cc.Period)
+	}
+	return nil
+}
+
+// SimImpairments makes a simulated source misbehave like real hardware, so that the
+// handling of late data and lost frames (by Dastard and its clients) can be tested in
+// software. The zero value is a perfect source.
+type SimImpairments struct {
+	Jitter    time.Duration // send each block late by a random time up to Jitter
+	DelayProb float64       // probability that a block is held back an extra Delay
+	Delay     time.Duration
+	DropProb  float64 // probability that frames are lost before a block
+	// DropFrames is how many frames are lost. They leave a gap in the frame numbers
+	// without any gap in time. 0 means that a whole block is lost, time and all.
+	DropFrames int
+	Seed       int64 // seeds the random impairments, so they can be repeated; 0 means a random seed
+
+	rng *rand.Rand // made at the first apply
+}
+
+// validate checks that the impairments make sense.
+func (si *SimImpairments) validate() error {
+	if si.Jitter < 0 || si.Delay < 0 {
+		return fmt.Errorf("SimImpairments Jitter=%v and Delay=%v, must not be negative", si.Jitter, si.Delay)
+	}
+	if si.DelayProb < 0 || si.DelayProb > 1 || si.DropProb < 0 || si.DropProb > 1 {
+		return fmt.Errorf("SimImpairments DelayProb=%v and DropProb=%v, must be in [0,1]", si.DelayProb, si.DropProb)
+	}
+	if si.DropFrames < 0 {
+		return fmt.Errorf("SimImpairments DropFrames=%d, must not be negative", si.DropFrames)
+	}
+	return nil
+}
+
+// SimCorrelation makes a fraction of a SimPulseSource's pulses coincident on a set of
+// channels, for testing coincidence and group triggering. Each pulse of a correlated
+// channel appears either on all the Channels at once (with probability Fraction), scaled
+// for each channel, or else on just one of them, chosen at random. Other channels see
+// every pulse, as usual.
+type SimCorrelation struct {
+	Channels []int     // channel indices that share pulses; empty means no correlation
+	Fraction float64   // the fraction of pulses that are coincident on all Channels, in [0,1]
+	Scales   []float64 // amplitude of each channel's coincident pulses relative to the usual; empty means all 1
+}
+
+// validate checks that the correlation makes sense for a source of nchan channels.
+func (sc *SimCorrelation) validate(nchan int) error {
+	if len(sc.Channels) == 0 {
+		return nil
+	}
+	if sc.Fraction < 0 || sc.Fraction > 1 {
+		return fmt.Errorf("SimCorrelation Fraction=%v, must be in [0,1]", sc.Fraction)
+	}
+	if len(sc.Scales) > 0 && len(sc.Scales) != len(sc.Channels) {
+		return fmt.Errorf("SimCorrelation has %d Scales for %d Channels", len(sc.Scales), len(sc.Channels))
+	}
+	seen := make(map[int]bool)
+	for i, c := range sc.Channels {
+		if c < 0 || c >= nchan {
+			return fmt.Errorf("SimCorrelation channel %d is out of range [0,%d)", c, nchan)
+		}
+		if seen[c] {
+			return fmt.Errorf("SimCorrelation channel %d is listed twice", c)
+		}
+		seen[c] = true
+		if len(sc.Scales) > 0 && (sc.Scales[i] < 0 || math.IsNaN(sc.Scales[i]) || math.IsInf(sc.Scales[i], 0)) {
+			return fmt.Errorf("SimCorrelation Scales[%d]=%v, must be finite and not negative", i, sc.Scales[i])
+		}
+	}
+	return nil
+}
+
+// scale returns the amplitude scale of coincident pulses on the k-th of the Channels.
+func (sc *SimCorrelation) scale(k int) float64 {
+	if len(sc.Scales) == 0 {
+		return 1
+	}
+	return sc.Scales[k]
+}
+
+// apply holds back the next block by any jitter and delay, then returns how many
+// frames are lost before it (cycleLen if the whole block is lost). It returns ok=false
+// if abort is closed while waiting.
+func (si *SimImpairments) apply(abort <-chan struct{}, cycleLen int) (lost int, ok bool) {
+	if si.rng == nil {
+		seed := si.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		si.rng = rand.New(rand.NewSource(seed))
+	}
+	var late time.Duration
+	if si.Jitter > 0 {
+		late += time.Duration(si.rng.Int63n(int64(si.Jitter) + 1))
+	}
+	if si.DelayProb > 0 && si.rng.Float64() < si.DelayProb {
+		late += si.Delay
+	}
+	if late > 0 {
+		select {
+		case <-abort:
+			return 0, false
+		case <-time.After(late):
+		}
+	}
+	if si.DropProb > 0 && si.rng.Float64() < si.DropProb {
+		if si.DropFrames == 0 {
+			return cycleLen, true
+		}
+		return si.DropFrames, true
+	}
+	return 0, true
+}
+
+// fill sets data to the channel's waveform, starting at sample number firstSample.
+func (cc *TriangleChannelConfig) fill(data []RawType, firstSample FrameIndex, sampleRate float64) {
+	periodSamples := cc.Period * sampleRate
+	for i := range data {
+		_, p := math.Modf(float64(firstSample+FrameIndex(i))/periodSamples + cc.Phase)
+		if p < 0 {
+			p++
+		}
+		v := cc.Offset + cc.Amplitude*waveShape(cc.Shape, p)
+		data[i] = RawType(roundint(math.Max(0, math.Min(math.MaxUint16, v))))
+	}
 }
 
 // Configure sets up the internal buffers with given size, speed, and min/max.
@@ -39,6 +230,21 @@ func (ts *TriangleSource) Configure(config *TriangleSourceConfig) error {
 	if config.Min > config.Max {
 		return fmt.Errorf("have config.Min=%v > config.Max=%v, want Min<Max", config.Min, config.Max)
 	}
+	if len(config.Channels) > config.Nchan {
+		return fmt.Errorf("TriangleSource.Configure() has %d Channels waveforms for %d channels",
+			len(config.Channels), config.Nchan)
+	}
+	for i := range config.Channels {
+		if err := config.Channels[i].validate(config.SampleRate); err != nil {
+			return fmt.Errorf("TriangleSource channel %d: %v", i, err)
+		}
+	}
+	if err := config.Naming.validate(); err != nil {
+		return err
+	}
+	if err := config.Impair.validate(); err != nil {
+		return err
+	}
 
 	ts.sourceStateLock.Lock()
 	defer ts.sourceStateLock.Unlock()
@@ -46,6 +252,8 @@ func (ts *TriangleSource) Configure(config *TriangleSourceConfig) error {
 		return fmt.Errorf("cannot Configure a TriangleSource if it's not Inactive")
 	}
 	ts.nchan = config.Nchan
+	ts.naming = config.Naming
+	ts.impair = config.Impair
 	ts.sampleRate = config.SampleRate
 	ts.samplePeriod = time.Duration(roundint(1e9 / ts.sampleRate))
 	nrise := config.Max - config.Min
@@ -68,10 +276,18 @@ func (ts *TriangleSource) Configure(config *TriangleSourceConfig) error {
 	ts.minval = config.Min
 	ts.maxval = config.Max
 	cycleTime := float64(ts.cycleLen) / ts.sampleRate
+	ts.channels = make([]TriangleChannelConfig, len(config.Channels))
+	copy(ts.channels, config.Channels)
+	for i := range ts.channels {
+		if ts.channels[i].Period == 0 {
+			ts.channels[i].Period = cycleTime
+		}
+	}
 	ts.timeperbuf = time.Duration(float64(time.Second) * cycleTime)
 	if ts.timeperbuf > 4*time.Second {
 		return fmt.Errorf("timeperbuf is %v, should be less than 4 seconds", ts.timeperbuf)
 	}
+	ts.sourceConfig = *config
 	return nil
 }
 
@@ -83,8 +299,8 @@ func (ts *TriangleSource) Sample() error {
 	ts.signed = make([]bool, ts.nchan)
 	ts.rowColCodes = make([]RowColCode, ts.nchan)
 	for i := 0; i < ts.nchan; i++ {
-		ts.chanNames[i] = fmt.Sprintf("chan%d", i+1)
-		ts.chanNumbers[i] = i + 1
+		ts.chanNumbers[i] = ts.naming.firstNumber(0, 1) + i
+		ts.chanNames[i] = ts.naming.name(ts.chanNumbers[i], false)
 		ts.rowColCodes[i] = rcCode(0, i, 1, ts.nchan)
 	}
 	return nil
@@ -93,6 +309,7 @@ func (ts *TriangleSource) Sample() error {
 // StartRun launches the repeated loop that generates Triangle data.
 func (ts *TriangleSource) StartRun() error {
 	go func() {
+		ts.pinReader()
 		for {
 			nextread := ts.lastread.Add(ts.timeperbuf)
 			waittime := time.Until(nextread)
@@ -106,10 +323,20 @@ func (ts *TriangleSource) StartRun() error {
 				if ts.heartbeats != nil {
 					dt := now.Sub(ts.lastread).Seconds()
 					mb := float64(ts.cycleLen*2*ts.nchan) / 1e6
-					ts.heartbeats <- Heartbeat{Running: true, Time: dt, DataMB: mb}
+					ts.heartbeats <- Heartbeat{Running: true, Time: dt, DataMB: mb, Frames: ts.cycleLen}
 				}
 				ts.lastread = nextread // ensure average cycle time is correct, using now would allow error to build up
 			}
+			lost, ok := ts.impair.apply(ts.abortSelf, ts.cycleLen)
+			if !ok {
+				close(ts.nextBlock)
+				return
+			}
+			ts.nextFrameNum += FrameIndex(lost)
+			if lost >= ts.cycleLen {
+				continue // the whole block was lost
+			}
+			now = time.Now()
 
 			// Backtrack to find the time associated with the first sample.
 			firstTime := now.Add(-ts.timeperbuf) // use now here; should correspond to the time the data was read
@@ -117,7 +344,11 @@ func (ts *TriangleSource) StartRun() error {
 			block.segments = make([]DataSegment, ts.nchan)
 			for channelIndex := 0; channelIndex < ts.nchan; channelIndex++ {
 				datacopy := make([]RawType, ts.cycleLen)
-				copy(datacopy, ts.onecycle)
+				if channelIndex < len(ts.channels) {
+					ts.channels[channelIndex].fill(datacopy, ts.nextFrameNum, ts.sampleRate)
+				} else {
+					copy(datacopy, ts.onecycle)
+				}
 				seg := DataSegment{
 					rawData:         datacopy,
 					framesPerSample: 1,
@@ -139,6 +370,14 @@ type SimPulseSource struct {
 	timeperbuf time.Duration
 	onecycle   []RawType
 	cycleLen   int
+	nrows      int // simulated TDM geometry, or 0 for one row of nchan columns
+	ncols      int
+	impair     SimImpairments
+	correlate  SimCorrelation
+	pedestal   float64
+	amplitudes []float64 // one pulse of each amplitude per cycle, every nsamp samples
+	nsamp      int
+	signedData bool // all channels produce signed (int16) samples
 	AnySource
 
 	// regular bool // whether pulses are regular or Poisson-distributed
@@ -158,13 +397,54 @@ type SimPulseSourceConfig struct {
 	Pedestal   float64
 	Amplitudes []float64
 	Nsamp      int
+	// Simulated TDM geometry: if Nrows and Ncols are set, the channels are numbered like a
+	// Lancero source, rows first within each column, and SampleRate is the frame rate.
+	// Nchan must be Nrows*Ncols, or 0 to use that.
+	Nrows  int
+	Ncols  int
+	Naming ChannelNaming
+	Impair SimImpairments
+	// Correlated makes some pulses coincident on a set of channels (and the rest not).
+	Correlated SimCorrelation
+	// Signed makes all channels signed (int16) data, so Pedestal and the pulses may
+	// go negative, as with Lancero error signals.
+	Signed bool
 }
 
 // Configure sets up the internal buffers with given size, speed, and pedestal and amplitude.
 func (sps *SimPulseSource) Configure(config *SimPulseSourceConfig) error {
+	if config.Nrows != 0 || config.Ncols != 0 {
+		if config.Nrows < 1 || config.Ncols < 1 {
+			return fmt.Errorf("SimPulseSource.Configure() asked for %d rows and %d columns, should both be > 0",
+				config.Nrows, config.Ncols)
+		}
+		if config.Nchan == 0 {
+			config.Nchan = config.Nrows * config.Ncols
+		} else if config.Nchan != config.Nrows*config.Ncols {
+			return fmt.Errorf("SimPulseSource.Configure() asked for %d channels in %d rows and %d columns",
+				config.Nchan, config.Nrows, config.Ncols)
+		}
+	}
 	if config.Nchan < 1 {
 		return fmt.Errorf("SimPulseSource.Configure() asked for %d channels, should be > 0", config.Nchan)
 	}
+	if err := config.Naming.validate(); err != nil {
+		return err
+	}
+	if err := config.Impair.validate(); err != nil {
+		return err
+	}
+	if err := config.Correlated.validate(config.Nchan); err != nil {
+		return err
+	}
+	lo, hi := 0.0, float64(math.MaxUint16)
+	if config.Signed {
+		lo, hi = math.MinInt16, math.MaxInt16
+	}
+	if !(config.Pedestal >= lo && config.Pedestal <= hi) {
+		return fmt.Errorf("SimPulseSource.Configure() asked for Pedestal=%v, should be in [%v, %v]",
+			config.Pedestal, lo, hi)
+	}
 
 	sps.sourceStateLock.Lock()
 	defer sps.sourceStateLock.Unlock()
@@ -172,28 +452,27 @@ func (sps *SimPulseSource) Configure(config *SimPulseSourceConfig) error {
 		return fmt.Errorf("cannot Configure a SimPulseSource if it's not Inactive")
 	}
 	sps.nchan = config.Nchan
+	sps.nrows = config.Nrows
+	sps.ncols = config.Ncols
+	sps.naming = config.Naming
+	sps.impair = config.Impair
+	sps.correlate = config.Correlated
+	sps.pedestal = config.Pedestal
+	sps.amplitudes = append([]float64{}, config.Amplitudes...)
+	sps.nsamp = config.Nsamp
+	sps.signedData = config.Signed
 	sps.sampleRate = config.SampleRate
 	sps.samplePeriod = time.Duration(roundint(1e9 / sps.sampleRate))
 
 	nsizes := len(config.Amplitudes)
 	sps.cycleLen = nsizes * config.Nsamp
-	firstIdx := 5
 	sps.onecycle = make([]RawType, sps.cycleLen)
 
-	ampl := []float64{0, 0}
-	exprate := []float64{.99, .96}
-	var value float64
-	for i := 0; i < sps.cycleLen; i++ {
-		if i%config.Nsamp == firstIdx {
-			j := i / config.Nsamp
-			ampl[0] = config.Amplitudes[j]
-			ampl[1] = -config.Amplitudes[j]
-		}
-		value = config.Pedestal + ampl[0] + ampl[1]
-		ampl[0] *= exprate[0]
-		ampl[1] *= exprate[1]
-		sps.onecycle[i] = RawType(value + 0.5)
+	pulses := make([]float64, nsizes)
+	for i := range pulses {
+		pulses[i] = 1
 	}
+	sps.fillCycle(sps.onecycle, pulses)
 
 	cycleTime := float64(sps.cycleLen) / sps.sampleRate
 	sps.timeperbuf = time.Duration(float64(time.Second) * cycleTime)
@@ -201,9 +480,61 @@ func (sps *SimPulseSource) Configure(config *SimPulseSourceConfig) error {
 	if sps.timeperbuf > 4*time.Second {
 		return fmt.Errorf("timeperbuf is %v, should be less than 4 seconds", sps.timeperbuf)
 	}
+	sps.sourceConfig = *config
 	return nil
 }
 
+// fillCycle fills data (one cycle) with the pedestal and the pulses, each one's
+// amplitude multiplied by scales[j] (0 for no pulse). A pulse's tail lasts until the
+// next pulse or the end of the cycle.
+func (sps *SimPulseSource) fillCycle(data []RawType, scales []float64) {
+	const firstIdx = 5
+	ampl := []float64{0, 0}
+	exprate := []float64{.99, .96}
+	var value float64
+	for i := range data {
+		if i%sps.nsamp == firstIdx {
+			if j := i / sps.nsamp; scales[j] != 0 {
+				ampl[0] = sps.amplitudes[j] * scales[j]
+				ampl[1] = -ampl[0]
+			}
+		}
+		value = sps.pedestal + ampl[0] + ampl[1]
+		ampl[0] *= exprate[0]
+		ampl[1] *= exprate[1]
+		if sps.signedData {
+			data[i] = RawType(int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(value)))))
+		} else {
+			data[i] = RawType(value + 0.5)
+		}
+	}
+}
+
+// correlatedCycles returns one cycle of data for each of the correlated channels: each
+// pulse appears on all of them (scaled), or on one chosen at random.
+func (sps *SimPulseSource) correlatedCycles() [][]RawType {
+	nc := len(sps.correlate.Channels)
+	scales := make([][]float64, nc)
+	for k := range scales {
+		scales[k] = make([]float64, len(sps.amplitudes))
+	}
+	for j := range sps.amplitudes {
+		if rand.Float64() < sps.correlate.Fraction {
+			for k := range scales {
+				scales[k][j] = sps.correlate.scale(k)
+			}
+		} else {
+			scales[rand.Intn(nc)][j] = 1
+		}
+	}
+	cycles := make([][]RawType, nc)
+	for k := range cycles {
+		cycles[k] = make([]RawType, sps.cycleLen)
+		sps.fillCycle(cycles[k], scales[k])
+	}
+	return cycles
+}
+
 // Sample determines key data facts by sampling some initial data.
 // It's a no-op for simulated (software) sources
 func (sps *SimPulseSource) Sample() error {
@@ -212,9 +543,14 @@ func (sps *SimPulseSource) Sample() error {
 	sps.signed = make([]bool, sps.nchan)
 	sps.rowColCodes = make([]RowColCode, sps.nchan)
 	for i := 0; i < sps.nchan; i++ {
-		sps.chanNames[i] = fmt.Sprintf("chan%d", i+1)
-		sps.chanNumbers[i] = i + 1
-		sps.rowColCodes[i] = rcCode(0, i, 1, sps.nchan)
+		sps.signed[i] = sps.signedData
+		sps.chanNumbers[i] = sps.naming.firstNumber(0, 1) + i
+		sps.chanNames[i] = sps.naming.name(sps.chanNumbers[i], false)
+		if sps.nrows > 0 {
+			sps.rowColCodes[i] = rcCode(i%sps.nrows, i/sps.nrows, sps.nrows, sps.ncols)
+		} else {
+			sps.rowColCodes[i] = rcCode(0, i, 1, sps.nchan)
+		}
 	}
 	return nil
 }
@@ -222,6 +558,7 @@ func (sps *SimPulseSource) Sample() error {
 // StartRun launches the repeated loop that generates Triangle data.
 func (sps *SimPulseSource) StartRun() error {
 	go func() {
+		sps.pinReader()
 		defer close(sps.nextBlock)
 		for {
 			nextread := sps.lastread.Add(sps.timeperbuf)
@@ -235,18 +572,36 @@ func (sps *SimPulseSource) StartRun() error {
 				if sps.heartbeats != nil {
 					dt := now.Sub(sps.lastread).Seconds()
 					mb := float64(sps.cycleLen*2*sps.nchan) / 1e6
-					sps.heartbeats <- Heartbeat{Running: true, Time: dt, DataMB: mb}
+					sps.heartbeats <- Heartbeat{Running: true, Time: dt, DataMB: mb, Frames: sps.cycleLen}
 				}
 				sps.lastread = nextread // ensure average cycle time is correct, using now would allow error to build up
 			}
+			lost, ok := sps.impair.apply(sps.abortSelf, sps.cycleLen)
+			if !ok {
+				return
+			}
+			sps.nextFrameNum += FrameIndex(lost)
+			if lost >= sps.cycleLen {
+				continue // the whole block was lost
+			}
+			now = time.Now()
 
 			// Backtrack to find the time associated with the first sample.
 			firstTime := now.Add(-sps.timeperbuf) // use now for accurate sample time
 			block := new(dataBlock)
 			block.segments = make([]DataSegment, sps.nchan)
+			cycles := make(map[int][]RawType)
+			if len(sps.correlate.Channels) > 0 {
+				for k, cycle := range sps.correlatedCycles() {
+					cycles[sps.correlate.Channels[k]] = cycle
+				}
+			}
 			for channelIndex := 0; channelIndex < sps.nchan; channelIndex++ {
-				datacopy := make([]RawType, sps.cycleLen)
-				copy(datacopy, sps.onecycle)
+				datacopy := cycles[channelIndex]
+				if datacopy == nil {
+					datacopy = make([]RawType, sps.cycleLen)
+					copy(datacopy, sps.onecycle)
+				}
 				for i := 0; i < sps.cycleLen; i++ {
 					datacopy[i] += RawType(rand.Intn(21) - 10)
 				}
@@ -1,10 +1,16 @@
 package dastard
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/usnistgov/dastard/ljh"
 	"gonum.org/v1/gonum/mat"
 )
 
@@ -123,7 +129,7 @@ func TestTriangle(t *testing.T) {
 	if err := dsp.SetProjectorsBasis(*projectors, *basis, "test model"); err != nil {
 		t.Error(err)
 	}
-	if err := ts.ConfigureProjectorsBases(1, *projectors, *basis, "test model"); err != nil {
+	if err := ts.ConfigureProjectorsBases(1, *projectors, *basis, "test model", mat.Dense{}); err != nil {
 		t.Error(err)
 	}
 	ds.Stop()
@@ -268,6 +274,167 @@ func TestSimPulse(t *testing.T) {
 	}
 }
 
+// TestSimPulseSigned runs a signed simulated source, whose pulses cross zero, through
+// triggering, decimation, and LJH writing.
+func TestSimPulseSigned(t *testing.T) {
+	const pedestal = -1900 // the pulse crosses zero between samples 12 and 13 of each cycle
+	ps := NewSimPulseSource()
+	config := SimPulseSourceConfig{Nchan: 2, SampleRate: 100000.0, Pedestal: pedestal, Amplitudes: []float64{10000},
+		Nsamp: 1000}
+	if err := ps.Configure(&config); err == nil {
+		t.Error("SimPulseSource.Configure should fail with a negative Pedestal for unsigned data")
+	}
+	config.Signed = true
+	if err := ps.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if v := int16(ps.onecycle[0]); v != pedestal {
+		t.Errorf("signed SimPulseSource pedestal is %d, want %d", v, pedestal)
+	}
+	if err := ps.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.PrepareRun(100, 400); err != nil {
+		t.Fatal(err)
+	}
+	defer ps.broker.Stop()
+	level := int16(-1000)
+	for i, dsp := range ps.processors {
+		if !dsp.stream.signed {
+			t.Errorf("channel %d of a signed SimPulseSource is not signed", i)
+		}
+		dsp.LevelTrigger = true
+		dsp.LevelRising = true
+		dsp.LevelLevel = RawType(level)
+	}
+	// Average pairs of samples in channel 1, including pairs on each side of zero.
+	dsp1 := ps.processors[1]
+	dsp1.Decimate = true
+	dsp1.DecimateLevel = 2
+	dsp1.DecimateAvgMode = true
+
+	tmp, err := ioutil.TempDir("", "dastard_signed_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	config2 := &WriteControlConfig{Request: "Start", Path: tmp, WriteLJH22: true, WriteLJH3: true}
+	if err := ps.WriteControl(config2); err != nil {
+		t.Fatal(err)
+	}
+	ljh22Name := ps.processors[0].DataPublisher.LJH22.FileName
+	ljh3Name := ps.processors[1].DataPublisher.LJH3.FileName
+	start := time.Now()
+	for b := 0; b < 4; b++ {
+		// All channels' segments must start at the same time, or the trigger broker's rate
+		// counters fall out of step.
+		firstTime := start.Add(time.Duration(b*ps.cycleLen) * ps.samplePeriod)
+		block := &dataBlock{segments: make([]DataSegment, ps.nchan)}
+		for i := range block.segments {
+			data := append([]RawType{}, ps.onecycle...)
+			block.segments[i] = *NewDataSegment(data, 1, FrameIndex(b*ps.cycleLen), firstTime, ps.samplePeriod)
+		}
+		if err := ps.ProcessSegments(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer ps.pool.Stop()
+	for i, dsp := range ps.processors {
+		if n := dsp.DataPublisher.numberWritten; n < 2 {
+			t.Errorf("channel %d wrote %d records, want at least 2", i, n)
+		}
+	}
+	config2.Request = "Stop"
+	if err := ps.WriteControl(config2); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ljh.OpenReader(ljh22Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if !r.Signed {
+		t.Errorf("LJH file %s is not marked as signed", ljh22Name)
+	}
+	pulse, err := r.NextPulse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max := int16(math.MaxInt16), int16(math.MinInt16)
+	for _, v := range pulse.Pulse {
+		if int16(v) < min {
+			min = int16(v)
+		}
+		if int16(v) > max {
+			max = int16(v)
+		}
+	}
+	if first := int16(pulse.Pulse[0]); first > pedestal+10 || min < pedestal || max < 2000 {
+		t.Errorf("LJH record has first sample %d, range [%d, %d], want about %d, [%d, > 2000]", first, min, max,
+			pedestal, pedestal)
+	}
+
+	contents, err := ioutil.ReadFile(ljh3Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), `"Signed samples": true`) {
+		t.Errorf("LJH3 file %s is not marked as signed", ljh3Name)
+	}
+	// The decimated channel's first record never dips below the pedestal. (Averaging
+	// samples on each side of zero as unsigned values would make a huge negative glitch.)
+	record := contents[strings.Index(string(contents), "}\n")+2:]
+	nsamples := int(binary.LittleEndian.Uint32(record))
+	for j := 0; j < nsamples; j++ {
+		if v := int16(binary.LittleEndian.Uint16(record[24+2*j:])); v < pedestal {
+			t.Errorf("decimated LJH3 record sample %d is %d, below the pedestal", j, v)
+			break
+		}
+	}
+}
+
+func TestSimPulseGeometry(t *testing.T) {
+	ps := NewSimPulseSource()
+	config := SimPulseSourceConfig{SampleRate: 10000.0, Pedestal: 1000.0, Amplitudes: []float64{1000.0},
+		Nsamp: 1000, Nrows: 3, Ncols: 2}
+	if err := ps.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Nchan != 6 || ps.nchan != 6 {
+		t.Errorf("SimPulseSource with 3 rows and 2 columns has Nchan=%d, nchan=%d, want 6", config.Nchan, ps.nchan)
+	}
+	if err := ps.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	for i, rccode := range ps.rowColCodes {
+		if rccode.row() != i%3 || rccode.col() != i/3 || rccode.rows() != 3 || rccode.cols() != 2 {
+			t.Errorf("channel %d has row %d/%d, column %d/%d, want %d/3, %d/2", i, rccode.row(), rccode.rows(),
+				rccode.col(), rccode.cols(), i%3, i/3)
+		}
+	}
+
+	for _, bad := range [][3]int{{5, 3, 2}, {0, 3, 0}, {6, -1, 2}} {
+		config.Nchan, config.Nrows, config.Ncols = bad[0], bad[1], bad[2]
+		if err := ps.Configure(&config); err == nil {
+			t.Errorf("SimPulseSource.Configure with Nchan, Nrows, Ncols = %v should fail", bad)
+		}
+	}
+
+	// Without a geometry, the channels are one row.
+	config.Nchan, config.Nrows, config.Ncols = 4, 0, 0
+	if err := ps.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if rccode := ps.rowColCodes[3]; rccode.row() != 0 || rccode.col() != 3 || rccode.rows() != 1 || rccode.cols() != 4 {
+		t.Errorf("channel 3 without a geometry has row %d/%d, column %d/%d, want 0/1, 3/4", rccode.row(), rccode.rows(),
+			rccode.col(), rccode.cols())
+	}
+}
+
 func TestErroringSource(t *testing.T) {
 	es := NewErroringSource()
 	ds := DataSource(es)
@@ -285,3 +452,197 @@ func TestErroringSource(t *testing.T) {
 		}
 	}
 }
+
+// TestTriangleChannels checks the per-channel waveforms of a TriangleSource.
+func TestTriangleChannels(t *testing.T) {
+	ts := NewTriangleSource()
+	config := TriangleSourceConfig{
+		Nchan:      5,
+		SampleRate: 1000.0,
+		Min:        100,
+		Max:        200,
+		Channels: []TriangleChannelConfig{
+			{Amplitude: 50, Offset: 1000},
+			{Shape: "sawtooth", Amplitude: 100, Offset: 500, Period: 0.1},
+			{Shape: "Square", Amplitude: 10, Offset: 20, Period: 0.02, Phase: 0.5},
+			{Shape: "sine", Amplitude: 1000, Offset: 0, Period: 0.04},
+		},
+	}
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.channels) != 4 || ts.channels[0].Shape != WaveTriangle || ts.channels[0].Period != 0.2 {
+		t.Errorf("TriangleSource channels are %+v", ts.channels)
+	}
+	data := make([]RawType, 200)
+	ts.channels[0].fill(data, 0, ts.sampleRate)
+	if data[0] != 950 || data[50] != 1000 || data[100] != 1050 || data[150] != 1000 {
+		t.Errorf("triangle channel has data[0,50,100,150]=%v,%v,%v,%v, want 950,1000,1050,1000",
+			data[0], data[50], data[100], data[150])
+	}
+	ts.channels[1].fill(data, 0, ts.sampleRate)
+	if data[0] != 400 || data[50] != 500 || data[99] != 598 || data[100] != 400 {
+		t.Errorf("sawtooth channel has data[0,50,99,100]=%v,%v,%v,%v, want 400,500,598,400",
+			data[0], data[50], data[99], data[100])
+	}
+	ts.channels[2].fill(data, 0, ts.sampleRate)
+	if data[0] != 30 || data[9] != 30 || data[10] != 10 || data[20] != 30 {
+		t.Errorf("square channel with phase 0.5 has data[0,9,10,20]=%v,%v,%v,%v, want 30,30,10,30",
+			data[0], data[9], data[10], data[20])
+	}
+	// The sine is clipped at 0, and it continues smoothly from one block to the next.
+	ts.channels[3].fill(data, 0, ts.sampleRate)
+	if data[0] != 0 || data[20] != 1000 || data[10] != 0 {
+		t.Errorf("sine channel has data[0,10,20]=%v,%v,%v, want 0,0,1000", data[0], data[10], data[20])
+	}
+	ts.channels[3].fill(data[:10], 20, ts.sampleRate)
+	if data[0] != 1000 {
+		t.Errorf("sine channel starting at sample 20 has data[0]=%v, want 1000", data[0])
+	}
+
+	bad := []TriangleChannelConfig{{Shape: "pulse"}, {Period: -1}, {Period: 0.001}, {Amplitude: math.Inf(1)}}
+	for i, cc := range bad {
+		config.Channels = []TriangleChannelConfig{cc}
+		if err := ts.Configure(&config); err == nil {
+			t.Errorf("TriangleSource configured with bad channel waveform %d %+v, want error", i, cc)
+		}
+	}
+	config.Channels = make([]TriangleChannelConfig, 6)
+	if err := ts.Configure(&config); err == nil {
+		t.Error("TriangleSource configured with more waveforms than channels, want error")
+	}
+}
+
+// TestSimImpairments checks that simulated sources can deliver data late and lose frames.
+func TestSimImpairments(t *testing.T) {
+	for _, bad := range []SimImpairments{{Jitter: -1}, {Delay: -time.Second}, {DelayProb: 1.5},
+		{DropProb: -0.1}, {DropFrames: -3}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("SimImpairments%+v.validate() should fail", bad)
+		}
+	}
+	abort := make(chan struct{})
+	var perfect SimImpairments
+	if lost, ok := perfect.apply(abort, 100); lost != 0 || !ok {
+		t.Errorf("zero-value SimImpairments.apply() = %d, %t, want 0, true", lost, ok)
+	}
+	si := SimImpairments{DelayProb: 1, Delay: 20 * time.Millisecond, DropProb: 1}
+	tstart := time.Now()
+	if lost, ok := si.apply(abort, 100); lost != 100 || !ok {
+		t.Errorf("SimImpairments.apply() = %d, %t, want a lost block", lost, ok)
+	}
+	if elapsed := time.Since(tstart); elapsed < si.Delay {
+		t.Errorf("SimImpairments.apply() returned after %v, want at least %v", elapsed, si.Delay)
+	}
+	si.DropFrames = 7
+	if lost, _ := si.apply(abort, 100); lost != 7 {
+		t.Errorf("SimImpairments.apply() loses %d frames, want %d", lost, si.DropFrames)
+	}
+	// A seeded source loses blocks at random, but the same ones each time.
+	seeded := func() []int {
+		si := SimImpairments{DropProb: 0.5, Seed: 12345}
+		lost := make([]int, 1000)
+		for i := range lost {
+			lost[i], _ = si.apply(abort, 1)
+		}
+		return lost
+	}
+	lost1, lost2 := seeded(), seeded()
+	nlost := 0
+	for i := range lost1 {
+		if lost1[i] != lost2[i] {
+			t.Fatalf("SimImpairments with one Seed lost different blocks")
+		}
+		nlost += lost1[i]
+	}
+	if nlost < 400 || nlost > 600 {
+		t.Errorf("SimImpairments with DropProb 0.5 lost %d of 1000 blocks", nlost)
+	}
+	close(abort)
+	si.Delay = time.Hour
+	if _, ok := si.apply(abort, 100); ok {
+		t.Error("SimImpairments.apply() should return ok=false when aborted")
+	}
+
+	// Lost frames leave gaps that the frame synchronizer finds.
+	ts := NewTriangleSource()
+	config := TriangleSourceConfig{Nchan: 2, SampleRate: 10000.0, Min: 100, Max: 200,
+		Impair: SimImpairments{Jitter: time.Millisecond, DropProb: 0.5, DropFrames: 13, Seed: 1}}
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(ts, nil, 50, 100); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	ts.Stop()
+	ngaps := 0
+	for _, event := range ts.frameSync.events {
+		if event.Kind == ResyncGap && event.Corrected-event.Expected == 13 {
+			ngaps++
+		}
+	}
+	if ngaps == 0 {
+		t.Errorf("TriangleSource with lost frames had resync events %v, want gaps of 13 frames", ts.frameSync.events)
+	}
+	config.Impair.DropProb = 2
+	if err := ts.Configure(&config); err == nil {
+		t.Error("TriangleSource.Configure should fail with bad SimImpairments")
+	}
+}
+
+func TestSimCorrelation(t *testing.T) {
+	for _, bad := range []SimCorrelation{{Channels: []int{0, 3}}, {Channels: []int{1, 1}}, {Channels: []int{-1}},
+		{Channels: []int{0}, Fraction: 1.5}, {Channels: []int{0, 1}, Scales: []float64{1}},
+		{Channels: []int{0}, Scales: []float64{-1}}} {
+		if err := bad.validate(3); err == nil {
+			t.Errorf("SimCorrelation%+v.validate(3) should fail", bad)
+		}
+	}
+
+	const nsamp, npulses, pedestal = 2000, 20, 1000
+	ps := NewSimPulseSource()
+	config := SimPulseSourceConfig{Nchan: 3, SampleRate: 100000.0, Pedestal: pedestal, Nsamp: nsamp,
+		Correlated: SimCorrelation{Channels: []int{2, 0}, Fraction: 1, Scales: []float64{0.5, 1}}}
+	for i := 0; i < npulses; i++ {
+		config.Amplitudes = append(config.Amplitudes, 1000)
+	}
+	if err := ps.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	// height returns the pulse height of pulse j in one cycle, near its peak.
+	height := func(cycle []RawType, j int) float64 {
+		return float64(cycle[j*nsamp+50]) - pedestal
+	}
+	cycles := ps.correlatedCycles()
+	for j := 0; j < npulses; j++ {
+		h2, h0 := height(cycles[0], j), height(cycles[1], j)
+		if h0 < 400 || math.Abs(h2-h0/2) > 1 {
+			t.Errorf("coincident pulse %d has heights %v in channel 0 and %v in channel 2, want > 400 and half that", j, h0, h2)
+		}
+	}
+
+	for _, fraction := range []float64{0, 0.5} {
+		ps.correlate.Fraction = fraction
+		cycles = ps.correlatedCycles()
+		coincident := 0
+		for j := 0; j < npulses; j++ {
+			on0, on2 := height(cycles[1], j) > 100, height(cycles[0], j) > 100
+			if on0 && on2 {
+				coincident++
+			} else if !on0 && !on2 {
+				t.Errorf("Fraction %v: pulse %d is on neither correlated channel", fraction, j)
+			}
+		}
+		if (fraction == 0 && coincident != 0) || (fraction > 0 && (coincident == 0 || coincident == npulses)) {
+			t.Errorf("Fraction %v gives %d coincident pulses of %d", fraction, coincident, npulses)
+		}
+	}
+
+	// Channels that are not correlated see every pulse.
+	for j := 0; j < npulses; j++ {
+		if h := height(ps.onecycle, j); h < 400 {
+			t.Errorf("uncorrelated channels have pulse %d height %v, want > 400", j, h)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package dastard
+
+// Encode status messages as CBOR (RFC 8949) and MessagePack. Only encoding is needed, and
+// only of the types that status messages use, so it is done here with reflection rather
+// than with a library. Values are laid out as encoding/json would: structs become maps
+// keyed by field name (honoring `json` tags, "-", and omitempty, and flattening embedded
+// structs), except that []byte is a byte string rather than base64 text. Types with their
+// own MarshalJSON method (such as time.Time) are encoded as the JSON value they marshal to.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// statusWriter writes the items of one binary serialization.
+type statusWriter interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(n int64)
+	writeUint(n uint64)
+	writeFloat32(x float32)
+	writeFloat64(x float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArrayHeader(n int)
+	writeMapHeader(n int)
+	bytes() []byte
+}
+
+// marshalCBOR returns the CBOR encoding of v.
+func marshalCBOR(v interface{}) ([]byte, error) {
+	return marshalStatus(new(cborWriter), v)
+}
+
+// marshalMsgPack returns the MessagePack encoding of v.
+func marshalMsgPack(v interface{}) ([]byte, error) {
+	return marshalStatus(new(msgpackWriter), v)
+}
+
+func marshalStatus(w statusWriter, v interface{}) ([]byte, error) {
+	if err := encodeStatusValue(w, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return w.bytes(), nil
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// encodeStatusValue writes v with w.
+func encodeStatusValue(w statusWriter, v reflect.Value) error {
+	if !v.IsValid() {
+		w.writeNil()
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		message, err := v.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(message, &generic); err != nil {
+			return err
+		}
+		return encodeStatusValue(w, reflect.ValueOf(generic))
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		w.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.writeUint(v.Uint())
+	case reflect.Float32:
+		w.writeFloat32(float32(v.Float()))
+	case reflect.Float64:
+		w.writeFloat64(v.Float())
+	case reflect.String:
+		w.writeString(v.String())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return encodeStatusValue(w, v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			w.writeBytes(b)
+			return nil
+		}
+		w.writeArrayHeader(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeStatusValue(w, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		// Sort the keys, as encoding/json does, so that equal maps are encoded alike.
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		w.writeMapHeader(len(keys))
+		for _, k := range keys {
+			if err := encodeStatusValue(w, k); err != nil {
+				return err
+			}
+			if err := encodeStatusValue(w, v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := statusFields(v, nil)
+		w.writeMapHeader(len(fields))
+		for _, f := range fields {
+			w.writeString(f.name)
+			if err := encodeStatusValue(w, f.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode a value of type %v", v.Type())
+	}
+	return nil
+}
+
+type statusField struct {
+	name  string
+	value reflect.Value
+}
+
+// statusFields appends to fields the exported fields of struct v that encoding/json
+// would marshal, flattening embedded structs.
+func statusFields(v reflect.Value, fields []statusField) []statusField {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+		fv := v.Field(i)
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = statusFields(fv, fields)
+				continue
+			}
+		}
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+		if strings.Contains(options, "omitempty") && isEmptyStatusValue(fv) {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, statusField{name: name, value: fv})
+	}
+	return fields
+}
+
+// isEmptyStatusValue says whether omitempty drops v, as in encoding/json.
+func isEmptyStatusValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// cborWriter writes CBOR (RFC 8949).
+type cborWriter struct {
+	buf []byte
+}
+
+// The CBOR major types.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+)
+
+// head writes the initial byte of an item of the given major type, and its argument n.
+func (c *cborWriter) head(major byte, n uint64) {
+	m := major << 5
+	switch {
+	case n < 24:
+		c.buf = append(c.buf, m|byte(n))
+	case n <= math.MaxUint8:
+		c.buf = append(c.buf, m|24, byte(n))
+	case n <= math.MaxUint16:
+		c.buf = append(c.buf, m|25, 0, 0)
+		binary.BigEndian.PutUint16(c.buf[len(c.buf)-2:], uint16(n))
+	case n <= math.MaxUint32:
+		c.buf = append(c.buf, m|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(c.buf[len(c.buf)-4:], uint32(n))
+	default:
+		c.buf = append(c.buf, m|27, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(c.buf[len(c.buf)-8:], n)
+	}
+}
+
+func (c *cborWriter) writeNil() { c.buf = append(c.buf, 0xf6) }
+
+func (c *cborWriter) writeBool(b bool) {
+	if b {
+		c.buf = append(c.buf, 0xf5)
+	} else {
+		c.buf = append(c.buf, 0xf4)
+	}
+}
+
+func (c *cborWriter) writeInt(n int64) {
+	if n < 0 {
+		c.head(cborNegInt, uint64(-1-n))
+		return
+	}
+	c.head(cborUint, uint64(n))
+}
+
+func (c *cborWriter) writeUint(n uint64) { c.head(cborUint, n) }
+
+func (c *cborWriter) writeFloat32(x float32) {
+	c.buf = append(c.buf, 0xfa, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(c.buf[len(c.buf)-4:], math.Float32bits(x))
+}
+
+func (c *cborWriter) writeFloat64(x float64) {
+	c.buf = append(c.buf, 0xfb, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(c.buf[len(c.buf)-8:], math.Float64bits(x))
+}
+
+func (c *cborWriter) writeString(s string) {
+	c.head(cborText, uint64(len(s)))
+	c.buf = append(c.buf, s...)
+}
+
+func (c *cborWriter) writeBytes(b []byte) {
+	c.head(cborBytes, uint64(len(b)))
+	c.buf = append(c.buf, b...)
+}
+
+func (c *cborWriter) writeArrayHeader(n int) { c.head(cborArray, uint64(n)) }
+func (c *cborWriter) writeMapHeader(n int)   { c.head(cborMap, uint64(n)) }
+func (c *cborWriter) bytes() []byte          { return c.buf }
+
+// msgpackWriter writes MessagePack.
+type msgpackWriter struct {
+	buf []byte
+}
+
+// sized writes one of the three forms of a length (8, 16, or 32 bits) that follow the
+// given first bytes.
+func (m *msgpackWriter) sized(n int, b8, b16, b32 byte) {
+	switch {
+	case b8 != 0 && n <= math.MaxUint8:
+		m.buf = append(m.buf, b8, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, b16, 0, 0)
+		binary.BigEndian.PutUint16(m.buf[len(m.buf)-2:], uint16(n))
+	default:
+		m.buf = append(m.buf, b32, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(m.buf[len(m.buf)-4:], uint32(n))
+	}
+}
+
+func (m *msgpackWriter) writeNil() { m.buf = append(m.buf, 0xc0) }
+
+func (m *msgpackWriter) writeBool(b bool) {
+	if b {
+		m.buf = append(m.buf, 0xc3)
+	} else {
+		m.buf = append(m.buf, 0xc2)
+	}
+}
+
+func (m *msgpackWriter) writeInt(n int64) {
+	switch {
+	case n >= 0:
+		m.writeUint(uint64(n))
+	case n >= -32:
+		m.buf = append(m.buf, byte(n))
+	case n >= math.MinInt8:
+		m.buf = append(m.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		m.buf = append(m.buf, 0xd1, 0, 0)
+		binary.BigEndian.PutUint16(m.buf[len(m.buf)-2:], uint16(n))
+	case n >= math.MinInt32:
+		m.buf = append(m.buf, 0xd2, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(m.buf[len(m.buf)-4:], uint32(n))
+	default:
+		m.buf = append(m.buf, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(m.buf[len(m.buf)-8:], uint64(n))
+	}
+}
+
+func (m *msgpackWriter) writeUint(n uint64) {
+	switch {
+	case n < 128:
+		m.buf = append(m.buf, byte(n))
+	case n <= math.MaxUint8:
+		m.buf = append(m.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, 0xcd, 0, 0)
+		binary.BigEndian.PutUint16(m.buf[len(m.buf)-2:], uint16(n))
+	case n <= math.MaxUint32:
+		m.buf = append(m.buf, 0xce, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(m.buf[len(m.buf)-4:], uint32(n))
+	default:
+		m.buf = append(m.buf, 0xcf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(m.buf[len(m.buf)-8:], n)
+	}
+}
+
+func (m *msgpackWriter) writeFloat32(x float32) {
+	m.buf = append(m.buf, 0xca, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(m.buf[len(m.buf)-4:], math.Float32bits(x))
+}
+
+func (m *msgpackWriter) writeFloat64(x float64) {
+	m.buf = append(m.buf, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(m.buf[len(m.buf)-8:], math.Float64bits(x))
+}
+
+func (m *msgpackWriter) writeString(s string) {
+	if len(s) < 32 {
+		m.buf = append(m.buf, 0xa0|byte(len(s)))
+	} else {
+		m.sized(len(s), 0xd9, 0xda, 0xdb)
+	}
+	m.buf = append(m.buf, s...)
+}
+
+func (m *msgpackWriter) writeBytes(b []byte) {
+	m.sized(len(b), 0xc4, 0xc5, 0xc6)
+	m.buf = append(m.buf, b...)
+}
+
+func (m *msgpackWriter) writeArrayHeader(n int) {
+	if n < 16 {
+		m.buf = append(m.buf, 0x90|byte(n))
+		return
+	}
+	m.sized(n, 0, 0xdc, 0xdd)
+}
+
+func (m *msgpackWriter) writeMapHeader(n int) {
+	if n < 16 {
+		m.buf = append(m.buf, 0x80|byte(n))
+		return
+	}
+	m.sized(n, 0, 0xde, 0xdf)
+}
+
+func (m *msgpackWriter) bytes() []byte { return m.buf }
@@ -0,0 +1,91 @@
+package dastard
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestStatusEncodings(t *testing.T) {
+	type inner struct {
+		A int
+	}
+	type histogram struct {
+		inner
+		Name    string
+		Counts  []byte
+		Skip    int     `json:"-"`
+		Opt     float64 `json:",omitempty"`
+		Renamed bool    `json:"r"`
+		hidden  int
+	}
+	hist := histogram{inner: inner{A: -2}, Name: "ph", Counts: []byte{0, 1, 2, 255}, Skip: 3, hidden: 4}
+
+	// Expected encodings, from the examples of RFC 8949 appendix A and the MessagePack spec.
+	tests := []struct {
+		value   interface{}
+		cbor    string
+		msgpack string
+	}{
+		{0, "00", "00"},
+		{23, "17", "17"},
+		{24, "1818", "18"},
+		{100, "1864", "64"},
+		{200, "18c8", "ccc8"},
+		{1000, "1903e8", "cd03e8"},
+		{1000000, "1a000f4240", "ce000f4240"},
+		{uint64(1000000000000), "1b000000e8d4a51000", "cf000000e8d4a51000"},
+		{-1, "20", "ff"},
+		{-100, "3863", "d09c"},
+		{-1000, "3903e7", "d1fc18"},
+		{-100000, "3a0001869f", "d2fffe7960"},
+		{1.1, "fb3ff199999999999a", "cb3ff199999999999a"},
+		{float32(100000), "fa47c35000", "ca47c35000"},
+		{false, "f4", "c2"},
+		{true, "f5", "c3"},
+		{nil, "f6", "c0"},
+		{(*int)(nil), "f6", "c0"},
+		{"", "60", "a0"},
+		{"IETF", "6449455446", "a449455446"},
+		{[]byte{1, 2, 3, 4}, "4401020304", "c40401020304"},
+		{[]int{1, 2, 3}, "83010203", "93010203"},
+		{[]int(nil), "f6", "c0"},
+		{map[string]int{"b": 2, "a": 1}, "a2616101616202", "82a16101a16202"},
+		{hist, "a4614121644e616d65627068" + "66436f756e747344000102ff" + "6172f4",
+			"84a141fea44e616d65a27068" + "a6436f756e7473c404000102ff" + "a172c2"},
+		{time.Date(2018, 12, 7, 0, 0, 0, 0, time.UTC), "74323031382d31322d30375430303a30303a30305a",
+			"b4323031382d31322d30375430303a30303a30305a"},
+	}
+	for _, test := range tests {
+		for _, enc := range []struct {
+			name    string
+			marshal func(interface{}) ([]byte, error)
+			want    string
+		}{{"CBOR", marshalCBOR, test.cbor}, {"MessagePack", marshalMsgPack, test.msgpack}} {
+			got, err := enc.marshal(test.value)
+			if err != nil {
+				t.Errorf("%s of %#v failed: %v", enc.name, test.value, err)
+				continue
+			}
+			if hex.EncodeToString(got) != enc.want {
+				t.Errorf("%s of %#v is %x, want %s", enc.name, test.value, got, enc.want)
+			}
+		}
+	}
+
+	// Long strings, arrays, and maps need longer headers.
+	long := bytes.Repeat([]byte("x"), 300)
+	if got, _ := marshalCBOR(string(long)); !bytes.Equal(got[:3], []byte{0x79, 0x01, 0x2c}) {
+		t.Errorf("CBOR of a 300-byte string begins %x", got[:3])
+	}
+	if got, _ := marshalMsgPack(string(long)); !bytes.Equal(got[:3], []byte{0xda, 0x01, 0x2c}) {
+		t.Errorf("MessagePack of a 300-byte string begins %x", got[:3])
+	}
+	if got, _ := marshalMsgPack(make([]int, 20)); !bytes.Equal(got[:3], []byte{0xdc, 0x00, 0x14}) {
+		t.Errorf("MessagePack of a 20-element array begins %x", got[:3])
+	}
+	if _, err := marshalCBOR(make(chan int)); err == nil {
+		t.Error("CBOR of a channel succeeded")
+	}
+}
@@ -0,0 +1,108 @@
+package dastard
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusCache holds the JSON encoding of the latest status message of each tag, as
+// published on the status port. The client updater fills it; StatusQuery reads it.
+type statusCache struct {
+	sync.RWMutex
+	messages map[string]json.RawMessage
+	updated  map[string]time.Time
+}
+
+var latestStatus = statusCache{messages: make(map[string]json.RawMessage),
+	updated: make(map[string]time.Time)}
+
+// set stores the JSON message of the given tag.
+func (sc *statusCache) set(tag string, message []byte) {
+	sc.Lock()
+	defer sc.Unlock()
+	sc.messages[tag] = json.RawMessage(message)
+	sc.updated[tag] = time.Now()
+}
+
+// get returns the latest JSON message of the given tag, if any.
+func (sc *statusCache) get(tag string) (json.RawMessage, time.Time, bool) {
+	sc.RLock()
+	defer sc.RUnlock()
+	message, ok := sc.messages[tag]
+	return message, sc.updated[tag], ok
+}
+
+// StatusQuery is the sub-server that answers pure status queries. It never touches
+// the data source or waits for SourceControl: it only reads the latest published status
+// messages, so it answers at once even during a long control call. It is served on
+// the read-only status RPC port (with no control methods) and on the control port.
+type StatusQuery struct{}
+
+// StatusMessage is one status message, as most recently published on the status port.
+type StatusMessage struct {
+	Tag     string
+	Updated time.Time
+	State   json.RawMessage // the message body, as published
+}
+
+// Status returns the latest ServerStatus (the STATUS message).
+func (sq *StatusQuery) Status(dummy *string, reply *ServerStatus) error {
+	message, _, ok := latestStatus.get("STATUS")
+	if !ok {
+		return fmt.Errorf("no STATUS message has been published")
+	}
+	return json.Unmarshal(message, reply)
+}
+
+// Latest returns the latest status message with the given tag (e.g., "WRITING").
+func (sq *StatusQuery) Latest(tag *string, reply *StatusMessage) error {
+	name := strings.ToUpper(*tag)
+	message, updated, ok := latestStatus.get(name)
+	if !ok {
+		return fmt.Errorf("no %s message has been published", name)
+	}
+	*reply = StatusMessage{Tag: name, Updated: updated, State: message}
+	return nil
+}
+
+// All returns the latest status message of every tag, in tag order.
+func (sq *StatusQuery) All(dummy *string, reply *[]StatusMessage) error {
+	latestStatus.RLock()
+	defer latestStatus.RUnlock()
+	*reply = make([]StatusMessage, 0, len(latestStatus.messages))
+	for tag, message := range latestStatus.messages {
+		*reply = append(*reply, StatusMessage{Tag: tag, Updated: latestStatus.updated[tag], State: message})
+	}
+	sort.Slice(*reply, func(i, j int) bool { return (*reply)[i].Tag < (*reply)[j].Tag })
+	return nil
+}
+
+// runStatusQueryServer serves StatusQuery, and nothing else, on the read-only status
+// RPC port. Unlike the control port, requests are handled concurrently, even from one
+// connection, and there is no limit on the number of connections.
+func runStatusQueryServer(port int, tlsConfig *tls.Config) {
+	server := rpc.NewServer()
+	if err := server.Register(new(StatusQuery)); err != nil {
+		panic(err)
+	}
+	listener, err := listenTCP(port, tlsConfig)
+	if err != nil {
+		logErrorf("Could not listen on the status RPC port %d: %v", port, err)
+		return
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logErrorf("Status RPC port stopped accepting connections: %v", err)
+			return
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
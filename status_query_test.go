@@ -0,0 +1,160 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusQuery(t *testing.T) {
+	status := ServerStatus{Running: true, SourceName: "SimPulses", Nchannels: 4, Ncol: []int{}, Nrow: []int{}}
+	message, err := json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latestStatus.set("STATUS", message)
+	latestStatus.set("WRITING", []byte(`{"Active":false}`))
+
+	var sq StatusQuery
+	var reply ServerStatus
+	if err := sq.Status(nil, &reply); err != nil || reply.SourceName != status.SourceName ||
+		reply.Nchannels != status.Nchannels || !reply.Running {
+		t.Errorf("StatusQuery.Status() = %+v, %v, want %+v", reply, err, status)
+	}
+	tag := "writing"
+	var latest StatusMessage
+	if err := sq.Latest(&tag, &latest); err != nil || latest.Tag != "WRITING" ||
+		string(latest.State) != `{"Active":false}` || latest.Updated.IsZero() {
+		t.Errorf("StatusQuery.Latest(%q) = %+v, %v", tag, latest, err)
+	}
+	tag = "NOSUCHTAG"
+	if err := sq.Latest(&tag, &latest); err == nil {
+		t.Errorf("StatusQuery.Latest(%q) should fail", tag)
+	}
+	var all []StatusMessage
+	if err := sq.All(nil, &all); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Tag >= all[i].Tag {
+			t.Errorf("StatusQuery.All() tags are not in order: %s, %s", all[i-1].Tag, all[i].Tag)
+		}
+	}
+}
+
+func TestStatusQueryPort(t *testing.T) {
+	// Many clients can query the read-only port at once.
+	address := fmt.Sprintf("localhost:%d", Ports.StatusRPC)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var client *rpc.Client
+			var err error
+			for tries := 0; tries < 20; tries++ {
+				if client, err = jsonrpc.Dial("tcp", address); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+			var all []StatusMessage
+			if err := client.Call("StatusQuery.All", "", &all); err != nil {
+				errs <- err
+			}
+			var okay bool
+			if err := client.Call("SourceControl.Stop", "", &okay); err == nil {
+				errs <- fmt.Errorf("the status RPC port accepted a control call")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStatusSubscription(t *testing.T) {
+	var sq StatusQuery
+	var all, writing, throttled int
+	if err := sq.Subscribe(&StatusSubscription{}, &all); err != nil {
+		t.Fatal(err)
+	}
+	if err := sq.Subscribe(&StatusSubscription{Tags: []string{"testb", "TESTC"}}, &writing); err != nil {
+		t.Fatal(err)
+	}
+	if err := sq.Subscribe(&StatusSubscription{Tags: []string{"TESTA", "TESTB"}, IntervalMs: 100}, &throttled); err != nil {
+		t.Fatal(err)
+	}
+	if err := sq.Subscribe(&StatusSubscription{IntervalMs: -1}, new(int)); err == nil {
+		t.Error("StatusQuery.Subscribe should fail with negative IntervalMs")
+	}
+
+	for i := 0; i < 3; i++ {
+		statusSubscribers.deliver("TESTA", []byte(fmt.Sprintf(`{"Count":%d}`, i)))
+		statusSubscribers.deliver("TESTB", []byte(fmt.Sprintf(`{"Count":%d}`, i)))
+	}
+	var msgs []StatusMessage
+	if err := sq.Next(&StatusPoll{ID: all}, &msgs); err != nil {
+		t.Error(err)
+	}
+	ntest := 0 // other tests may also publish messages
+	for _, msg := range msgs {
+		if strings.HasPrefix(msg.Tag, "TEST") {
+			ntest++
+		}
+	}
+	if ntest != 6 {
+		t.Errorf("StatusQuery.Next(all) returned %d test messages, want 6", ntest)
+	}
+	if err := sq.Next(&StatusPoll{ID: writing}, &msgs); err != nil || len(msgs) != 3 || msgs[0].Tag != "TESTB" {
+		t.Errorf("StatusQuery.Next(TESTB, TESTC) returned %v, %v, want 3 TESTB messages", msgs, err)
+	}
+	// A throttled subscription gets only the latest message of each tag, then waits.
+	if err := sq.Next(&StatusPoll{ID: throttled}, &msgs); err != nil || len(msgs) != 2 ||
+		string(msgs[0].State) != `{"Count":2}` {
+		t.Errorf("StatusQuery.Next(throttled) returned %v, %v, want latest TESTA and TESTB", msgs, err)
+	}
+	statusSubscribers.deliver("TESTA", []byte(`{"Count":3}`))
+	start := time.Now()
+	if err := sq.Next(&StatusPoll{ID: throttled, WaitMs: 1000}, &msgs); err != nil || len(msgs) != 1 {
+		t.Errorf("StatusQuery.Next(throttled) returned %v, %v, want 1 message", msgs, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("StatusQuery.Next(throttled) took %v, want about 100 ms", elapsed)
+	}
+
+	// A waiting Next returns when a message arrives.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		statusSubscribers.deliver("TESTC", []byte(`{}`))
+	}()
+	if err := sq.Next(&StatusPoll{ID: writing, WaitMs: 5000}, &msgs); err != nil || len(msgs) != 1 || msgs[0].Tag != "TESTC" {
+		t.Errorf("StatusQuery.Next(WaitMs) returned %v, %v, want 1 TESTC message", msgs, err)
+	}
+	if err := sq.Next(&StatusPoll{ID: writing}, &msgs); err != nil || len(msgs) != 0 {
+		t.Errorf("StatusQuery.Next with nothing new returned %v, %v, want no messages", msgs, err)
+	}
+
+	var ok bool
+	for _, id := range []int{all, writing, throttled} {
+		if err := sq.Unsubscribe(&id, &ok); err != nil || !ok {
+			t.Errorf("StatusQuery.Unsubscribe(%d) = %t, %v", id, ok, err)
+		}
+	}
+	if err := sq.Next(&StatusPoll{ID: all}, &msgs); err == nil {
+		t.Error("StatusQuery.Next should fail after Unsubscribe")
+	}
+}
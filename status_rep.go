@@ -0,0 +1,71 @@
+package dastard
+
+import (
+	"fmt"
+	"strings"
+
+	czmq "github.com/zeromq/goczmq"
+)
+
+// statusREPDefaultTags are the messages sent in reply to an empty status request: those
+// a late-joining client needs before it can show anything.
+var statusREPDefaultTags = []string{"STATUS", "TRIGGER", "WRITING", "CHANNELNAMES"}
+
+// statusREPReply returns the reply to one request on the status REP port. Each frame of
+// the request is a message tag (any case); a request with only empty frames asks for
+// statusREPDefaultTags. The reply has two frames per tag, as on the status port: the tag
+// and the latest JSON message of that tag, or "null" if none has been published.
+func statusREPReply(request [][]byte) [][]byte {
+	var tags []string
+	for _, frame := range request {
+		if tag := strings.ToUpper(strings.TrimSpace(string(frame))); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		tags = statusREPDefaultTags
+	}
+	reply := make([][]byte, 0, 2*len(tags))
+	for _, tag := range tags {
+		message, _, ok := latestStatus.get(tag)
+		if !ok {
+			message = []byte("null")
+		}
+		reply = append(reply, []byte(tag), []byte(message))
+	}
+	return reply
+}
+
+// newRepSocket binds a ZMQ REP socket to the given port on all interfaces, with the same
+// CURVE settings as the publishers.
+func newRepSocket(port int) (*czmq.Sock, error) {
+	zmqCurve.once.Do(setupZMQCurve)
+	if zmqCurve.err != nil {
+		return nil, zmqCurve.err
+	}
+	return czmq.NewRep(fmt.Sprintf("tcp://*:%d", port), zmqCurve.options...)
+}
+
+// runStatusREPServer answers status requests on a ZMQ REP socket at the given port, from
+// the latest messages published on the status port, so that a ZMQ client that joins late
+// need not wait for the next broadcast or make JSON-RPC calls. Like StatusQuery, it never
+// touches the data source.
+func runStatusREPServer(port int) {
+	socket, err := newRepSocket(port)
+	if err != nil {
+		logErrorf("Could not open the status REP port %d: %v", port, err)
+		return
+	}
+	defer socket.Destroy()
+	for {
+		request, err := socket.RecvMessage()
+		if err != nil {
+			logErrorf("Status REP port %d stopped: %v", port, err)
+			return
+		}
+		if err := socket.SendMessage(statusREPReply(request)); err != nil {
+			logErrorf("Status REP port %d stopped: %v", port, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package dastard
+
+import "testing"
+
+func TestStatusREPReply(t *testing.T) {
+	latestStatus.set("STATUS", []byte(`{"Running":true}`))
+	latestStatus.set("TRIGGER", []byte(`[]`))
+	latestStatus.set("WRITING", []byte(`{"Active":false}`))
+	latestStatus.set("CHANNELNAMES", []byte(`["chan1"]`))
+
+	reply := statusREPReply([][]byte{[]byte("writing"), []byte(" NeverPublished ")})
+	want := []string{"WRITING", `{"Active":false}`, "NEVERPUBLISHED", "null"}
+	if len(reply) != len(want) {
+		t.Fatalf("statusREPReply() has %d frames, want %d", len(reply), len(want))
+	}
+	for i, frame := range reply {
+		if string(frame) != want[i] {
+			t.Errorf("statusREPReply() frame %d = %q, want %q", i, frame, want[i])
+		}
+	}
+
+	for _, request := range [][][]byte{nil, {[]byte("")}} {
+		reply = statusREPReply(request)
+		if len(reply) != 2*len(statusREPDefaultTags) {
+			t.Fatalf("statusREPReply(%q) has %d frames, want %d", request, len(reply), 2*len(statusREPDefaultTags))
+		}
+		for i, tag := range statusREPDefaultTags {
+			if string(reply[2*i]) != tag || string(reply[2*i+1]) == "null" {
+				t.Errorf("statusREPReply(%q) frames %d,%d = %q, %q, want tag %s with its message",
+					request, 2*i, 2*i+1, reply[2*i], reply[2*i+1], tag)
+			}
+		}
+	}
+}
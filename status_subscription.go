@@ -0,0 +1,201 @@
+package dastard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusSubscriptionTimeout is how long a subscription lasts without being polled.
+const statusSubscriptionTimeout = time.Minute
+
+// maxStatusPollWait is the longest that StatusQuery.Next waits for a message.
+const maxStatusPollWait = 30 * time.Second
+
+// maxStatusPending is the most messages a subscription holds between polls. The oldest
+// are dropped beyond this.
+const maxStatusPending = 1000
+
+// StatusSubscription is the RPC-usable structure for StatusQuery.Subscribe. It chooses
+// which status messages a client receives, and how often.
+type StatusSubscription struct {
+	Tags       []string // the message tags to receive (e.g., "WRITING"); empty means all
+	IntervalMs int      // if > 0, send each tag at most this often, only its latest message
+}
+
+// StatusPoll is the RPC-usable structure for StatusQuery.Next.
+type StatusPoll struct {
+	ID     int // as returned by StatusQuery.Subscribe
+	WaitMs int // if no message is ready, wait up to this long for one
+}
+
+// statusSubscriber holds the messages of one subscription until the client polls for them.
+type statusSubscriber struct {
+	tags     map[string]bool // nil means all tags
+	interval time.Duration
+	pending  []StatusMessage
+	lastSent map[string]time.Time
+	lastPoll time.Time
+	ready    chan struct{} // signaled when a message is added
+}
+
+// statusSubscriberList holds all subscriptions. The client updater delivers each
+// published message to it; StatusQuery.Next takes them out.
+type statusSubscriberList struct {
+	sync.Mutex
+	subscribers map[int]*statusSubscriber
+	nextID      int
+}
+
+var statusSubscribers = statusSubscriberList{subscribers: make(map[int]*statusSubscriber), nextID: 1}
+
+// add starts a new subscription and returns its ID.
+func (sl *statusSubscriberList) add(config *StatusSubscription) (int, error) {
+	if config.IntervalMs < 0 {
+		return 0, fmt.Errorf("StatusSubscription IntervalMs=%d, need >= 0", config.IntervalMs)
+	}
+	sub := &statusSubscriber{interval: time.Duration(config.IntervalMs) * time.Millisecond,
+		lastSent: make(map[string]time.Time), lastPoll: time.Now(), ready: make(chan struct{}, 1)}
+	if len(config.Tags) > 0 {
+		sub.tags = make(map[string]bool)
+		for _, tag := range config.Tags {
+			sub.tags[strings.ToUpper(tag)] = true
+		}
+	}
+	sl.Lock()
+	defer sl.Unlock()
+	id := sl.nextID
+	sl.nextID++
+	sl.subscribers[id] = sub
+	return id, nil
+}
+
+// remove ends a subscription, and returns whether it existed.
+func (sl *statusSubscriberList) remove(id int) bool {
+	sl.Lock()
+	defer sl.Unlock()
+	_, ok := sl.subscribers[id]
+	delete(sl.subscribers, id)
+	return ok
+}
+
+// deliver adds a published message to each subscription that wants its tag. Any
+// subscription not polled recently is ended.
+func (sl *statusSubscriberList) deliver(tag string, message []byte) {
+	sl.Lock()
+	defer sl.Unlock()
+	now := time.Now()
+	for id, sub := range sl.subscribers {
+		if now.Sub(sub.lastPoll) > statusSubscriptionTimeout {
+			delete(sl.subscribers, id)
+			continue
+		}
+		if sub.tags != nil && !sub.tags[tag] {
+			continue
+		}
+		msg := StatusMessage{Tag: tag, Updated: now, State: append([]byte{}, message...)}
+		replaced := false
+		if sub.interval > 0 {
+			// A throttled subscription needs only the latest message of each tag.
+			for i := range sub.pending {
+				if sub.pending[i].Tag == tag {
+					sub.pending[i] = msg
+					replaced = true
+					break
+				}
+			}
+		}
+		if !replaced {
+			if len(sub.pending) >= maxStatusPending {
+				sub.pending = sub.pending[1:]
+			}
+			sub.pending = append(sub.pending, msg)
+		}
+		select {
+		case sub.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes and returns the messages of a subscription that are ready to send. It
+// also returns the channel that signals new messages, and how long until a held
+// (throttled) message is ready, or 0 if none is held.
+func (sl *statusSubscriberList) take(id int) ([]StatusMessage, chan struct{}, time.Duration, error) {
+	sl.Lock()
+	defer sl.Unlock()
+	sub, ok := sl.subscribers[id]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("no status subscription with ID %d", id)
+	}
+	now := time.Now()
+	sub.lastPoll = now
+	messages := make([]StatusMessage, 0, len(sub.pending))
+	held := sub.pending[:0]
+	var untilReady time.Duration
+	for _, msg := range sub.pending {
+		if wait := sub.interval - now.Sub(sub.lastSent[msg.Tag]); wait > 0 {
+			held = append(held, msg)
+			if untilReady == 0 || wait < untilReady {
+				untilReady = wait
+			}
+			continue
+		}
+		messages = append(messages, msg)
+		if sub.interval > 0 {
+			sub.lastSent[msg.Tag] = now
+		}
+	}
+	sub.pending = held
+	return messages, sub.ready, untilReady, nil
+}
+
+// Subscribe starts a subscription to the status messages with the chosen tags, at
+// most one per tag per interval if one is given. Poll it with Next. A subscription
+// ends when it is not polled for a minute.
+func (sq *StatusQuery) Subscribe(config *StatusSubscription, reply *int) error {
+	id, err := statusSubscribers.add(config)
+	*reply = id
+	return err
+}
+
+// Unsubscribe ends a subscription started by Subscribe.
+func (sq *StatusQuery) Unsubscribe(id *int, reply *bool) error {
+	*reply = statusSubscribers.remove(*id)
+	if !*reply {
+		return fmt.Errorf("no status subscription with ID %d", *id)
+	}
+	return nil
+}
+
+// Next returns the messages of a subscription published since the last call, oldest
+// first. If there are none, it waits up to WaitMs for one. Only the read-only status
+// RPC port answers other requests meanwhile, so wait only there.
+func (sq *StatusQuery) Next(poll *StatusPoll, reply *[]StatusMessage) error {
+	wait := time.Duration(poll.WaitMs) * time.Millisecond
+	if wait > maxStatusPollWait {
+		wait = maxStatusPollWait
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		messages, ready, untilReady, err := statusSubscribers.take(poll.ID)
+		if err != nil {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if len(messages) > 0 || remaining <= 0 {
+			sort.SliceStable(messages, func(i, j int) bool { return messages[i].Updated.Before(messages[j].Updated) })
+			*reply = messages
+			return nil
+		}
+		if untilReady > 0 && untilReady < remaining {
+			remaining = untilReady
+		}
+		select {
+		case <-ready:
+		case <-time.After(remaining):
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// StimulusConfig is the RPC-usable structure for BeginStimulus.
+type StimulusConfig struct {
+	Label           string  // experiment state label at the start of the window ("" for none)
+	EndLabel        string  // experiment state label once the window has been processed ("" for none)
+	DurationMs      float64 // length of the window
+	TriggerPeriodMs float64 // if > 0, force records at the same frames in every channel, this often during the window
+	ChannelIndices  []int   // channels of the forced records; empty means all
+	ChannelGroups   []string
+}
+
+// StimulusWindow is the reply of BeginStimulus. It is also sent to clients as a
+// "STIMULUS" message when the window begins.
+type StimulusWindow struct {
+	Label         string
+	FirstFrame    FrameIndex // the first frame of the window: the next frame to be processed
+	EndFrame      FrameIndex // the frame just after the window
+	SampleRate    float64    // frames per second
+	StateSet      bool       // Label was written to the experiment state file (only while writing)
+	StateTime     time.Time  // the time stamp of Label in the experiment state file, if StateSet
+	TriggerPeriod FrameIndex // frames between forced records, or 0 for none
+	TriggerFrames int        // forced records in each of the Channels
+	Channels      []int      // channels of the forced records
+}
+
+// stimulusState is a stimulus window in progress.
+type stimulusState struct {
+	window   StimulusWindow
+	endLabel string
+}
+
+// stimulusTriggers are the forced records of a stimulus window still to be made in one
+// channel: at frames next, next+period, ..., up to end.
+type stimulusTriggers struct {
+	next   FrameIndex
+	end    FrameIndex
+	period FrameIndex
+}
+
+// BeginStimulus starts a stimulus window of config.DurationMs at the next frame to be
+// processed. While writing, it sets the experiment state label (stamped with timestamp).
+// If config.TriggerPeriodMs > 0, it forces records of type TriggerTypeStimulus at the
+// same frames in the chosen channels. It replaces any window in progress.
+func (ds *AnySource) BeginStimulus(config *StimulusConfig, timestamp time.Time) (*StimulusWindow, error) {
+	if !(config.DurationMs > 0) || math.IsInf(config.DurationMs, 1) {
+		return nil, fmt.Errorf("StimulusConfig.DurationMs=%v, need > 0", config.DurationMs)
+	}
+	if !(config.TriggerPeriodMs >= 0) || math.IsInf(config.TriggerPeriodMs, 1) {
+		return nil, fmt.Errorf("StimulusConfig.TriggerPeriodMs=%v, need >= 0", config.TriggerPeriodMs)
+	}
+	channels := config.ChannelIndices
+	if len(channels) == 0 {
+		channels = make([]int, len(ds.processors))
+		for i := range channels {
+			channels[i] = i
+		}
+	}
+	for _, channelIndex := range channels {
+		if channelIndex < 0 || channelIndex >= len(ds.processors) {
+			return nil, fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, len(ds.processors))
+		}
+	}
+
+	first := ds.frameSync.nextFrame
+	frames := FrameIndex(math.Round(config.DurationMs * 1e-3 * ds.sampleRate))
+	if frames < 1 {
+		frames = 1
+	}
+	w := StimulusWindow{Label: config.Label, FirstFrame: first, EndFrame: first + frames,
+		SampleRate: ds.sampleRate, Channels: channels}
+	if config.TriggerPeriodMs > 0 {
+		w.TriggerPeriod = FrameIndex(math.Round(config.TriggerPeriodMs * 1e-3 * ds.sampleRate))
+		if w.TriggerPeriod < 1 {
+			w.TriggerPeriod = 1
+		}
+		w.TriggerFrames = int((frames + w.TriggerPeriod - 1) / w.TriggerPeriod)
+	}
+	if config.Label != "" && ds.writingState.Active {
+		if err := ds.SetExperimentStateLabel(timestamp, config.Label); err != nil {
+			return nil, err
+		}
+		w.StateSet = true
+		w.StateTime = timestamp
+	}
+	for _, dsp := range ds.processors {
+		dsp.stimulus = stimulusTriggers{}
+	}
+	if w.TriggerPeriod > 0 {
+		for _, channelIndex := range channels {
+			ds.processors[channelIndex].stimulus = stimulusTriggers{next: w.FirstFrame,
+				end: w.EndFrame, period: w.TriggerPeriod}
+		}
+	}
+	ds.stimulus = &stimulusState{window: w, endLabel: config.EndLabel}
+	return &w, nil
+}
+
+// finishStimulus ends the stimulus window in progress once all of its frames have been
+// processed, setting its end label (while writing).
+func (ds *AnySource) finishStimulus() {
+	st := ds.stimulus
+	if st == nil || ds.frameSync.nextFrame < st.window.EndFrame {
+		return
+	}
+	ds.stimulus = nil
+	if st.endLabel != "" && ds.writingState.Active {
+		if err := ds.SetExperimentStateLabel(time.Now(), st.endLabel); err != nil {
+			logWarningf("Could not set the experiment state at the end of stimulus %q: %v", st.window.Label, err)
+		}
+	}
+}
+
+// stimulusTriggerComputeAppend adds the forced records of a stimulus window. Records
+// whose samples have not all arrived stay pending; those whose samples are gone are dropped.
+func (dsp *DataStreamProcessor) stimulusTriggerComputeAppend(records []*DataRecord) []*DataRecord {
+	st := &dsp.stimulus
+	if st.period <= 0 {
+		return records
+	}
+	segment := &dsp.stream.DataSegment
+	fps := segment.framesPerSample
+	if fps < 1 {
+		fps = 1
+	}
+	added := false
+	for ; st.next < st.end; st.next += st.period {
+		i := int(st.next-segment.firstFramenum) / fps
+		if i+dsp.NSamples-dsp.NPresamples > len(segment.rawData) {
+			break
+		}
+		if i < dsp.NPresamples {
+			logDebugf("channel %d dropped a stimulus trigger at frame %d: its samples are gone", dsp.channelIndex, st.next)
+			continue
+		}
+		record := dsp.triggerAt(segment, i)
+		record.trigType = TriggerTypeStimulus
+		records = append(records, record)
+		added = true
+	}
+	if st.next >= st.end {
+		*st = stimulusTriggers{}
+	}
+	if added {
+		sort.Sort(RecordSlice(records))
+	}
+	return records
+}
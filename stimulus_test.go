@@ -0,0 +1,126 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBeginStimulus checks the frame range of a stimulus window, its forced records at
+// the same frames in the chosen channels, and its experiment state labels.
+func TestBeginStimulus(t *testing.T) {
+	ds := AnySource{nchan: 3}
+	if err := ds.PrepareRun(20, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+	ds.sampleRate = 1000
+	ds.writingState.Active = true
+	tmp, err := ioutil.TempDir("", "dastard_stimulus_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds.writingState.ExperimentStateFilename = filepath.Join(tmp, "experiment_state.txt")
+	defer func() {
+		if ds.writingState.experimentStateFile != nil {
+			ds.writingState.experimentStateFile.Close()
+		}
+	}()
+
+	for _, bad := range []StimulusConfig{{}, {DurationMs: -5}, {DurationMs: 10, TriggerPeriodMs: -1},
+		{DurationMs: 10, ChannelIndices: []int{3}}} {
+		if _, err := ds.BeginStimulus(&bad, time.Now()); err == nil {
+			t.Errorf("BeginStimulus(%+v) should fail", bad)
+		}
+	}
+
+	process := func(first FrameIndex, n int) [][]*DataRecord {
+		records := make([][]*DataRecord, ds.nchan)
+		for _, dsp := range ds.processors {
+			dsp.stream.AppendSegment(NewDataSegment(make([]RawType, n), 1, first, time.Now(), time.Millisecond))
+		}
+		for i, dsp := range ds.processors {
+			records[i] = dsp.TriggerDataPrimary()
+		}
+		for _, dsp := range ds.processors {
+			dsp.TriggerDataSecondary()
+		}
+		ds.frameSync.nextFrame = first + FrameIndex(n)
+		ds.finishStimulus()
+		return records
+	}
+	process(0, 200)
+
+	timestamp := time.Now()
+	config := StimulusConfig{Label: "BIASSTEP", EndLabel: "IDLE", DurationMs: 300, TriggerPeriodMs: 100,
+		ChannelIndices: []int{0, 2}}
+	w, err := ds.BeginStimulus(&config, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.FirstFrame != 200 || w.EndFrame != 500 || w.TriggerPeriod != 100 || w.TriggerFrames != 3 ||
+		!w.StateSet || !w.StateTime.Equal(timestamp) {
+		t.Errorf("stimulus window is %+v, want frames [200,500), period 100, 3 triggers, state set", w)
+	}
+	if ds.writingState.ExperimentStateLabel != "BIASSTEP" {
+		t.Errorf("experiment state is %q, want BIASSTEP", ds.writingState.ExperimentStateLabel)
+	}
+
+	// The forced records come when their samples have arrived, at the same frames in
+	// the chosen channels only.
+	var frames [3][]FrameIndex
+	for _, step := range []struct {
+		first FrameIndex
+		n     int
+	}{{200, 50}, {250, 200}, {450, 200}, {650, 200}} {
+		for i, recs := range process(step.first, step.n) {
+			for _, rec := range recs {
+				if rec.trigType != TriggerTypeStimulus {
+					t.Errorf("channel %d record at frame %d has type %q, want %q", i, rec.trigFrame, rec.trigType, TriggerTypeStimulus)
+				}
+				frames[i] = append(frames[i], rec.trigFrame)
+			}
+		}
+		if step.first == 250 && ds.stimulus == nil {
+			t.Error("stimulus window finished before its end frame was processed")
+		}
+	}
+	want := []FrameIndex{200, 300, 400}
+	if !reflect.DeepEqual(frames[0], want) || !reflect.DeepEqual(frames[2], want) || len(frames[1]) != 0 {
+		t.Errorf("stimulus records at frames %v, want %v in channels 0 and 2 only", frames, want)
+	}
+
+	// The end label is set once the window has been processed.
+	if ds.stimulus != nil || ds.writingState.ExperimentStateLabel != "IDLE" {
+		t.Errorf("after the window, stimulus is %+v and experiment state %q, want nil and IDLE",
+			ds.stimulus, ds.writingState.ExperimentStateLabel)
+	}
+	ds.writingState.experimentStateFile.Sync()
+	contents, err := ioutil.ReadFile(ds.writingState.ExperimentStateFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), ", BIASSTEP\n") || !strings.Contains(string(contents), ", IDLE\n") {
+		t.Errorf("experiment state file is %q, want BIASSTEP and IDLE", contents)
+	}
+
+	// Without writing, no label is set, and no period means no forced records.
+	ds.writingState.Active = false
+	w, err = ds.BeginStimulus(&StimulusConfig{Label: "LED", DurationMs: 50}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.StateSet || w.TriggerPeriod != 0 || len(w.Channels) != 3 || w.EndFrame-w.FirstFrame != 50 {
+		t.Errorf("stimulus window without writing is %+v", w)
+	}
+	for i, recs := range process(850, 200) {
+		if len(recs) != 0 {
+			t.Errorf("channel %d made %d records in a stimulus window with no TriggerPeriodMs", i, len(recs))
+		}
+	}
+}
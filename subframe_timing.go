@@ -0,0 +1,30 @@
+package dastard
+
+import (
+	"time"
+)
+
+// rowTimeOffset returns how long after the start of its frame the TDM row of code is
+// sampled, at sampleRate frames per second: each of the frame's rows takes an equal
+// share of the frame period. It is 0 for sources with 1 row per frame, or if the
+// sampleRate is not known.
+func rowTimeOffset(code RowColCode, sampleRate float64) time.Duration {
+	rows := code.rows()
+	if rows <= 1 || code.row() >= rows || !(sampleRate > 0) {
+		return 0
+	}
+	framePeriod := float64(time.Second) / sampleRate
+	return time.Duration(framePeriod * float64(code.row()) / float64(rows))
+}
+
+// setRowTimeOffsets sets the amount added to the time of each channel's records, so
+// that records in different TDM rows of the same frame get their own times. If the
+// "subframetiming" setting is false, all channels of a frame share its time.
+func (ds *AnySource) setRowTimeOffsets(enable bool) {
+	for channelIndex, dsp := range ds.processors {
+		dsp.rowOffset = 0
+		if enable && channelIndex < len(ds.rowColCodes) {
+			dsp.rowOffset = rowTimeOffset(ds.rowColCodes[channelIndex], ds.sampleRate)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRowTimeOffset(t *testing.T) {
+	for _, test := range []struct {
+		code       RowColCode
+		sampleRate float64
+		want       time.Duration
+	}{
+		{rcCode(0, 0, 8, 2), 100000, 0},
+		{rcCode(1, 0, 8, 2), 100000, 1250 * time.Nanosecond},
+		{rcCode(7, 1, 8, 2), 100000, 8750 * time.Nanosecond},
+		{rcCode(0, 3, 1, 4), 100000, 0},
+		{rcCode(3, 0, 8, 1), 0, 0},
+		{rcCode(9, 0, 8, 1), 100000, 0},
+	} {
+		if got := rowTimeOffset(test.code, test.sampleRate); got != test.want {
+			t.Errorf("rowTimeOffset(row %d of %d, %v) = %v, want %v", test.code.row(), test.code.rows(),
+				test.sampleRate, got, test.want)
+		}
+	}
+}
+
+func TestSubframeRecordTimes(t *testing.T) {
+	ds := AnySource{nchan: 4, sampleRate: 50000}
+	if err := ds.PrepareRun(20, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+	// 4 rows, 1 column: rows are sampled 5 µs apart.
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	for i := range ds.rowColCodes {
+		ds.rowColCodes[i] = rcCode(i, 0, 4, 1)
+	}
+	start := time.Unix(1700000000, 0)
+	recordTimes := func() []time.Time {
+		times := make([]time.Time, ds.nchan)
+		for i, dsp := range ds.processors {
+			seg := NewDataSegment(make([]RawType, 200), 1, 0, start, 20*time.Microsecond)
+			times[i] = dsp.triggerAt(seg, 50).trigTime
+		}
+		return times
+	}
+	ds.setRowTimeOffsets(true)
+	frameTime := start.Add(50 * 20 * time.Microsecond)
+	for i, tt := range recordTimes() {
+		if want := frameTime.Add(time.Duration(i) * 5 * time.Microsecond); !tt.Equal(want) {
+			t.Errorf("channel %d record time is %v after the frame, want %v", i, tt.Sub(frameTime), want.Sub(frameTime))
+		}
+	}
+	ds.setRowTimeOffsets(false)
+	for i, tt := range recordTimes() {
+		if !tt.Equal(frameTime) {
+			t.Errorf("channel %d record time is %v after the frame without subframe timing, want 0", i, tt.Sub(frameTime))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package dastard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/spf13/viper"
+)
+
+// serverTLSConfig returns the TLS configuration of the JSON-RPC and HTTP listeners,
+// or nil if the config file doesn't ask for TLS. Set TLSCertFile and TLSKeyFile (PEM
+// files) to use TLS. Also set TLSClientCAFile to require that clients present a
+// certificate signed by one of the CAs in that file.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile := viper.GetString("tlscertfile")
+	keyFile := viper.GetString("tlskeyfile")
+	caFile := viper.GetString("tlsclientcafile")
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS needs both TLSCertFile and TLSKeyFile, have %q and %q", certFile, keyFile)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read TLSClientCAFile: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLSClientCAFile %s has no PEM certificates", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// listenTCP listens on the given port, with TLS if tlsConfig is not nil.
+func listenTCP(port int, tlsConfig *tls.Config) (net.Listener, error) {
+	addr := fmt.Sprintf(":%d", port)
+	if tlsConfig != nil {
+		return tls.Listen("tcp", addr, tlsConfig)
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,136 @@
+package dastard
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// writeTestCertificate writes a self-signed certificate for localhost and its key as
+// PEM files in dir, and returns their names and the certificate.
+func writeTestCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	certFile, keyFile, cert := writeTestCertificate(t, tmp)
+	setTLS := func(cert, key, ca string) {
+		viper.Set("tlscertfile", cert)
+		viper.Set("tlskeyfile", key)
+		viper.Set("tlsclientcafile", ca)
+	}
+	defer setTLS("", "", "")
+
+	setTLS("", "", "")
+	if config, err := serverTLSConfig(); config != nil || err != nil {
+		t.Errorf("serverTLSConfig() with no files = %v, %v, want nil, nil", config, err)
+	}
+	for _, files := range [][]string{{certFile, "", ""}, {"", keyFile, ""}, {"", "", certFile},
+		{certFile, certFile, ""}, {certFile, keyFile, keyFile}, {certFile, keyFile, filepath.Join(tmp, "missing")}} {
+		setTLS(files[0], files[1], files[2])
+		if _, err := serverTLSConfig(); err == nil {
+			t.Errorf("serverTLSConfig() with files %v should fail", files)
+		}
+	}
+
+	// Serve TLS, requiring client certificates, and connect with the same certificate.
+	setTLS(certFile, keyFile, certFile)
+	config, err := serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listenTCP(0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost",
+		Certificates: []tls.Certificate{clientCert}})
+	if err != nil {
+		t.Fatalf("TLS connection failed: %v", err)
+	}
+	reply, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(reply) != "ok" {
+		t.Errorf("TLS connection read %q, %v, want \"ok\"", reply, err)
+	}
+
+	// Without a client certificate, the server must refuse the connection.
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err == nil {
+		_, err = ioutil.ReadAll(conn)
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("TLS connection without a client certificate should fail")
+	}
+}
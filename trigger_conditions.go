@@ -0,0 +1,243 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Ways to combine a channel's trigger conditions (TriggerState.ConditionCombine)
+const (
+	ConditionCombineOR  = "OR"  // a record wherever any condition fires
+	ConditionCombineAND = "AND" // a record only where all conditions fire close together
+)
+
+// maxTriggerConditions is the most conditions a channel can have: records carry a
+// 32-bit mask of the conditions that fired.
+const maxTriggerConditions = 32
+
+// TriggerCondition is one of a channel's list of trigger conditions (see
+// TriggerState.Conditions). Each is an edge, derivative, or level trigger with settings
+// of its own, which work like the TriggerState fields of the same names.
+type TriggerCondition struct {
+	Name    string  // identifies the condition to clients; optional
+	Type    string  // TriggerTypeEdge, TriggerTypeDeriv, or TriggerTypeLevel
+	Rising  bool    // fire on rising signals
+	Falling bool    // fire on falling signals (edge and deriv only: a level condition is falling if !Rising)
+	Level   float64 // EdgeLevel, DerivLevel, or LevelLevel (a signed value in signed channels)
+	Length  int     // DerivLength (deriv only)
+}
+
+// validate checks the condition for errors, given the channel's pretrigger length.
+func (c *TriggerCondition) validate(npresamples int) error {
+	if math.IsNaN(c.Level) || math.IsInf(c.Level, 0) {
+		return fmt.Errorf("Level=%v is not finite", c.Level)
+	}
+	switch c.Type {
+	case TriggerTypeEdge, TriggerTypeDeriv:
+		if !c.Rising && !c.Falling {
+			return fmt.Errorf("a %s condition needs Rising or Falling", c.Type)
+		}
+		if !(c.Level > 0) {
+			return fmt.Errorf("a %s condition needs Level > 0, not %v", c.Type, c.Level)
+		}
+		if c.Type == TriggerTypeDeriv {
+			if c.Length < 2 || c.Length > maxDerivLength {
+				return fmt.Errorf("Length=%d, need [2,%d]", c.Length, maxDerivLength)
+			}
+			if c.Length > npresamples {
+				return fmt.Errorf("Length=%d is longer than the %d pretrigger samples", c.Length, npresamples)
+			}
+		}
+	case TriggerTypeLevel:
+		if c.Falling {
+			return fmt.Errorf("a %s condition is falling if it is not Rising; don't set Falling", c.Type)
+		}
+	default:
+		return fmt.Errorf("Type=%q, need one of (%s, %s, %s)", c.Type, TriggerTypeEdge, TriggerTypeDeriv,
+			TriggerTypeLevel)
+	}
+	return nil
+}
+
+// validateTriggerConditions returns an error if the trigger conditions of state cannot
+// work in this channel.
+func (dsp *DataStreamProcessor) validateTriggerConditions(state *TriggerState) error {
+	if len(state.Conditions) > maxTriggerConditions {
+		return fmt.Errorf("%d trigger conditions, the maximum is %d", len(state.Conditions), maxTriggerConditions)
+	}
+	for i := range state.Conditions {
+		if err := state.Conditions[i].validate(dsp.NPresamples); err != nil {
+			return fmt.Errorf("trigger condition %d: %v", i, err)
+		}
+	}
+	switch strings.ToUpper(state.ConditionCombine) {
+	case "", ConditionCombineOR, ConditionCombineAND:
+	default:
+		return fmt.Errorf("ConditionCombine=%q, need %s or %s", state.ConditionCombine, ConditionCombineOR,
+			ConditionCombineAND)
+	}
+	if state.ConditionWindow < 0 {
+		return fmt.Errorf("ConditionWindow=%d, must not be negative", state.ConditionWindow)
+	}
+	if state.ConditionTrigger && (state.EdgeTrigger || state.DerivTrigger || state.LevelTrigger || state.EdgeMulti) {
+		return fmt.Errorf("use either ConditionTrigger or the EdgeTrigger, DerivTrigger, LevelTrigger, and EdgeMulti triggers, not both")
+	}
+	return nil
+}
+
+// conditionFirings returns the samples in [first, end) where condition c fires, in order.
+func conditionFirings(c *TriggerCondition, raw []RawType, signed bool, first, end int) []int {
+	value := func(i int) int64 {
+		if signed {
+			return int64(int16(raw[i]))
+		}
+		return int64(raw[i])
+	}
+	var firings []int
+	switch c.Type {
+	case TriggerTypeEdge:
+		if first < 3 {
+			first = 3
+		}
+		for i := first; i < end; i++ {
+			diff := float64(value(i) + value(i-1) - value(i-2) - value(i-3))
+			if (c.Rising && diff >= c.Level) || (c.Falling && diff <= -c.Level) {
+				firings = append(firings, i)
+			}
+		}
+
+	case TriggerTypeLevel:
+		if first < 1 {
+			first = 1
+		}
+		for i := first; i < end; i++ {
+			x, xprev := float64(value(i)), float64(value(i-1))
+			if (c.Rising && x >= c.Level && xprev < c.Level) || (!c.Rising && x <= c.Level && xprev > c.Level) {
+				firings = append(firings, i)
+			}
+		}
+
+	case TriggerTypeDeriv:
+		// As in derivTriggerComputeAppend, the slope of the window raw[i-L+1:i+1] is
+		// (S1-c*S0)/denom, with running sums S0 and S1.
+		L := c.Length
+		if first < L-1 {
+			first = L - 1
+		}
+		if first >= end {
+			return nil
+		}
+		center := float64(L-1) / 2
+		denom := float64(L*(L*L-1)) / 12
+		var S0, S1 int64
+		for j := 0; j < L; j++ {
+			x := value(first - L + 1 + j)
+			S0 += x
+			S1 += int64(j) * x
+		}
+		for i := first; i < end; i++ {
+			if i > first {
+				x, xOld := value(i), value(i-L)
+				S1 += xOld - S0 + int64(L-1)*x
+				S0 += x - xOld
+			}
+			slope := (float64(S1) - center*float64(S0)) / denom
+			if (c.Rising && slope >= c.Level) || (c.Falling && slope <= -c.Level) {
+				firings = append(firings, i)
+			}
+		}
+	}
+	return firings
+}
+
+// conditionTriggerComputeAppend finds the triggers of the channel's list of trigger
+// conditions. With ConditionCombine OR, a record is made at each sample where any
+// condition fires; with AND, at each sample where the last of the conditions fires
+// within ConditionWindow samples of all the others, which may have fired in an earlier
+// segment. As with edge triggers, records are separated by at least one record length.
+// Each record carries a mask of the conditions that fired to make it (bit i for
+// Conditions[i]).
+func (dsp *DataStreamProcessor) conditionTriggerComputeAppend(records []*DataRecord) []*DataRecord {
+	if !dsp.ConditionTrigger || len(dsp.Conditions) == 0 {
+		return records
+	}
+	segment := &dsp.stream.DataSegment
+	raw, signed := segment.triggerSamples()
+	first := dsp.NPresamples
+	end := len(raw) + dsp.NPresamples - dsp.NSamples
+	if first >= end {
+		return records
+	}
+	firings := make([][]int, len(dsp.Conditions))
+	var candidates []int
+	for k := range dsp.Conditions {
+		firings[k] = conditionFirings(&dsp.Conditions[k], raw, signed, first, end)
+		candidates = append(candidates, firings[k]...)
+	}
+	sort.Ints(candidates)
+	and := strings.ToUpper(dsp.ConditionCombine) == ConditionCombineAND
+	fps := segment.framesPerSample
+	if fps < 1 {
+		fps = 1
+	}
+	frameOf := func(i int) FrameIndex {
+		return segment.firstFramenum + FrameIndex(i*fps)
+	}
+	if len(dsp.conditionFired) != len(dsp.Conditions) {
+		dsp.conditionFired = make([]FrameIndex, len(dsp.Conditions))
+		for k := range dsp.conditionFired {
+			dsp.conditionFired[k] = math.MinInt64 / 4 // never
+		}
+	}
+
+	// firedAt returns the mask of conditions that fired in [i-window, i], including the
+	// firings of earlier segments.
+	next := make([]int, len(dsp.Conditions)) // index into each firings list
+	firedAt := func(i, window int) uint32 {
+		var mask uint32
+		for k, f := range firings {
+			for next[k] < len(f) && f[next[k]] < i-window {
+				next[k]++
+			}
+			if next[k] < len(f) && f[next[k]] <= i {
+				mask |= 1 << uint(k)
+			} else if dsp.conditionFired[k] >= frameOf(i-window) {
+				mask |= 1 << uint(k)
+			}
+		}
+		return mask
+	}
+	all := uint32(1)<<uint(len(dsp.Conditions)) - 1
+	nextAllowed := first
+	found := false
+	for _, i := range candidates {
+		if i < nextAllowed {
+			continue
+		}
+		var mask uint32
+		if and {
+			if mask = firedAt(i, dsp.ConditionWindow); mask != all {
+				continue
+			}
+		} else {
+			mask = firedAt(i, 0)
+		}
+		record := dsp.triggerAt(segment, i)
+		record.trigType = TriggerTypeCondition
+		record.conditions = mask
+		records = append(records, record)
+		found = true
+		nextAllowed = i + dsp.NSamples + 1
+	}
+	for k, f := range firings {
+		if len(f) > 0 {
+			dsp.conditionFired[k] = frameOf(f[len(f)-1])
+		}
+	}
+	if found {
+		sort.Sort(RecordSlice(records))
+	}
+	return records
+}
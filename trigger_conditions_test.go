@@ -0,0 +1,199 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTriggerConditionValidate(t *testing.T) {
+	dsp := NewDataStreamProcessor(0, nil, 20, 100)
+	edge := TriggerCondition{Type: TriggerTypeEdge, Rising: true, Level: 100}
+	good := []TriggerState{
+		{ConditionTrigger: true, Conditions: []TriggerCondition{edge}},
+		{ConditionTrigger: true, ConditionCombine: "and", ConditionWindow: 5, Conditions: []TriggerCondition{edge,
+			{Type: TriggerTypeLevel, Level: -30}, {Type: TriggerTypeDeriv, Falling: true, Level: 2, Length: 8}}},
+		{AutoTrigger: true, AutoDelay: 1000, ConditionTrigger: true, Conditions: []TriggerCondition{edge}},
+	}
+	for _, state := range good {
+		if err := dsp.validateTriggerState(&state); err != nil {
+			t.Errorf("validateTriggerState(%+v) fails: %v", state, err)
+		}
+	}
+
+	bad := []TriggerCondition{
+		{Type: "KINK", Rising: true, Level: 100},
+		{Type: TriggerTypeEdge, Level: 100},
+		{Type: TriggerTypeEdge, Rising: true, Level: -100},
+		{Type: TriggerTypeDeriv, Rising: true, Level: 1, Length: 1},
+		{Type: TriggerTypeDeriv, Rising: true, Level: 1, Length: 21},
+		{Type: TriggerTypeLevel, Falling: true, Level: 100},
+	}
+	for _, c := range bad {
+		state := TriggerState{ConditionTrigger: true, Conditions: []TriggerCondition{c}}
+		if err := dsp.validateTriggerState(&state); err == nil {
+			t.Errorf("validateTriggerState should fail with condition %+v", c)
+		}
+	}
+	badStates := []TriggerState{
+		{ConditionTrigger: true, EdgeTrigger: true, Conditions: []TriggerCondition{edge}},
+		{ConditionTrigger: true, ConditionCombine: "XOR", Conditions: []TriggerCondition{edge}},
+		{ConditionTrigger: true, ConditionWindow: -1, Conditions: []TriggerCondition{edge}},
+		{ConditionTrigger: true, Conditions: make([]TriggerCondition, maxTriggerConditions+1)},
+	}
+	for _, state := range badStates {
+		if err := dsp.validateTriggerState(&state); err == nil {
+			t.Errorf("validateTriggerState(%+v) should fail", state)
+		}
+	}
+}
+
+func TestConditionTriggers(t *testing.T) {
+	broker := NewTriggerBroker(1)
+	go broker.Run()
+	defer broker.Stop()
+
+	// A small step at 200, a big step at 400, and a small step at 700 followed by a ramp too
+	// slow to fire the edge condition, which crosses 4000 at 730.
+	raw := make([]RawType, 1000)
+	for i := range raw {
+		raw[i] = 1000
+	}
+	for i := 200; i < 250; i++ {
+		raw[i] = 1500
+	}
+	for i := 400; i < 450; i++ {
+		raw[i] = 6000
+	}
+	for i := 700; i < 780; i++ {
+		raw[i] = 1500
+		if i > 702 {
+			raw[i] += RawType(90 * (i - 702))
+		}
+	}
+	conditions := []TriggerCondition{
+		{Name: "edge", Type: TriggerTypeEdge, Rising: true, Level: 400},
+		{Name: "high", Type: TriggerTypeLevel, Rising: true, Level: 4000},
+	}
+
+	tests := []struct {
+		combine string
+		window  int
+		frames  []FrameIndex
+		masks   []uint32
+	}{
+		{"", 0, []FrameIndex{200, 400, 700}, []uint32{1, 3, 1}},
+		{ConditionCombineOR, 10, []FrameIndex{200, 400, 700}, []uint32{1, 3, 1}},
+		{ConditionCombineAND, 0, []FrameIndex{400}, []uint32{3}},
+		{ConditionCombineAND, 5, []FrameIndex{400}, []uint32{3}},
+		{ConditionCombineAND, 30, []FrameIndex{400, 730}, []uint32{3, 3}},
+	}
+	for _, test := range tests {
+		dsp := NewDataStreamProcessor(0, broker, 50, 100)
+		dsp.SampleRate = 1000
+		state := TriggerState{ConditionTrigger: true, Conditions: conditions, ConditionCombine: test.combine,
+			ConditionWindow: test.window}
+		if err := dsp.validateTriggerState(&state); err != nil {
+			t.Fatal(err)
+		}
+		dsp.ConfigureTrigger(state)
+		name := "conditions " + test.combine
+		primaries, _ := testTriggerSubroutine(t, raw, 1, dsp, name, test.frames)
+		for i, rec := range primaries {
+			if i < len(test.masks) && (rec.trigType != TriggerTypeCondition || rec.conditions != test.masks[i]) {
+				t.Errorf("%s window %d: record %d has type %s, conditions %b, want %s, %b", name, test.window, i,
+					rec.trigType, rec.conditions, TriggerTypeCondition, test.masks[i])
+			}
+		}
+	}
+
+	// Turned off, the conditions make no records.
+	dsp := NewDataStreamProcessor(0, broker, 50, 100)
+	dsp.ConfigureTrigger(TriggerState{Conditions: conditions})
+	testTriggerSubroutine(t, raw, 1, dsp, "conditions off", []FrameIndex{})
+}
+
+func TestConditionTriggerStates(t *testing.T) {
+	ds := AnySource{nchan: 3}
+	if err := ds.PrepareRun(20, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+	state := TriggerState{ConditionTrigger: true,
+		Conditions: []TriggerCondition{{Type: TriggerTypeEdge, Rising: true, Level: 100}}}
+	if err := ds.ChangeTriggerState(&FullTriggerState{ChannelIndicies: []int{0, 2}, TriggerState: state}); err != nil {
+		t.Fatal(err)
+	}
+	bad := state
+	bad.Conditions = []TriggerCondition{{Type: TriggerTypeEdge, Level: 100}}
+	if err := ds.ChangeTriggerState(&FullTriggerState{ChannelIndicies: []int{1}, TriggerState: bad}); err == nil {
+		t.Error("ChangeTriggerState should fail with an invalid trigger condition")
+	}
+
+	// Channels with equal conditions are grouped together.
+	fts := ds.ComputeFullTriggerState()
+	if len(fts) != 2 {
+		t.Fatalf("ComputeFullTriggerState returns %d states, want 2", len(fts))
+	}
+	for _, s := range fts {
+		want := []int{1}
+		if s.ConditionTrigger {
+			want = []int{0, 2}
+		}
+		if len(s.ChannelIndicies) != len(want) || s.ChannelIndicies[0] != want[0] {
+			t.Errorf("trigger state %+v has channels %v, want %v", s.TriggerState, s.ChannelIndicies, want)
+		}
+	}
+}
+
+// TestConditionTriggersAcrossSegments checks that an AND of conditions can combine a
+// firing near the end of one segment with one early in the next.
+func TestConditionTriggersAcrossSegments(t *testing.T) {
+	broker := NewTriggerBroker(1)
+	go broker.Run()
+	defer broker.Stop()
+
+	// A small step at 940, just before the end of the first segment's trigger search, then a
+	// ramp too slow to fire the edge condition, which crosses 4000 at 973.
+	raw := make([]RawType, 2000)
+	for i := range raw {
+		raw[i] = 1000
+		if i >= 940 {
+			raw[i] = 1500
+		}
+		if i > 945 && i < 1100 {
+			raw[i] += RawType(90 * (i - 945))
+		} else if i >= 1100 {
+			raw[i] += 90 * 155
+		}
+	}
+	conditions := []TriggerCondition{
+		{Name: "edge", Type: TriggerTypeEdge, Rising: true, Level: 400},
+		{Name: "high", Type: TriggerTypeLevel, Rising: true, Level: 4000},
+	}
+	for _, test := range []struct {
+		window int
+		frames []FrameIndex
+	}{{40, []FrameIndex{973}}, {20, nil}} {
+		dsp := NewDataStreamProcessor(0, broker, 50, 100)
+		dsp.SampleRate = 1000
+		dsp.ConfigureTrigger(TriggerState{ConditionTrigger: true, Conditions: conditions,
+			ConditionCombine: ConditionCombineAND, ConditionWindow: test.window})
+		var primaries []*DataRecord
+		for first := 0; first < len(raw); first += 1000 {
+			dsp.stream.AppendSegment(NewDataSegment(raw[first:first+1000], 1, FrameIndex(first), time.Now(),
+				time.Millisecond))
+			p, _ := dsp.TriggerData()
+			primaries = append(primaries, p...)
+		}
+		if len(primaries) != len(test.frames) {
+			t.Errorf("window %d: found %d records, want %d", test.window, len(primaries), len(test.frames))
+			continue
+		}
+		for i, rec := range primaries {
+			if rec.trigFrame != test.frames[i] || rec.conditions != 3 {
+				t.Errorf("window %d: record at frame %d with conditions %b, want frame %d with 11", test.window,
+					rec.trigFrame, rec.conditions, test.frames[i])
+			}
+		}
+	}
+}
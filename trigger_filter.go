@@ -0,0 +1,127 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+)
+
+// maxTriggerFilterLength is the longest allowed trigger filter kernel.
+const maxTriggerFilterLength = 1024
+
+// TriggerFilterConfig is the RPC-usable structure for ConfigureTriggerFilter. The
+// filter is applied only to the samples that the edge and level triggers inspect;
+// records are still cut from the unfiltered data. Trigger levels apply to the
+// filtered signal.
+type TriggerFilterConfig struct {
+	ChannelIndices []int
+	ChannelGroups  []string  // named channel groups, added to the ChannelIndices
+	Boxcar         int       // if > 1, filter with a moving average of this many samples
+	Kernel         []float64 // otherwise, filter with this FIR kernel; neither turns the filter off
+}
+
+// validate checks the config for errors.
+func (config *TriggerFilterConfig) validate() error {
+	if len(config.ChannelIndices) == 0 {
+		return fmt.Errorf("TriggerFilterConfig has no ChannelIndices")
+	}
+	if config.Boxcar > 1 && len(config.Kernel) > 0 {
+		return fmt.Errorf("TriggerFilterConfig has both Boxcar=%d and a Kernel; use one", config.Boxcar)
+	}
+	if config.Boxcar < 0 {
+		return fmt.Errorf("trigger filter Boxcar=%d, need >= 0", config.Boxcar)
+	}
+	if n := len(config.kernel()); n > maxTriggerFilterLength {
+		return fmt.Errorf("trigger filter has %d samples, the maximum is %d", n, maxTriggerFilterLength)
+	}
+	for i, k := range config.Kernel {
+		if math.IsNaN(k) || math.IsInf(k, 0) {
+			return fmt.Errorf("trigger filter Kernel[%d]=%v is not finite", i, k)
+		}
+	}
+	return nil
+}
+
+// kernel returns the FIR filter kernel, or nil if the filter is off.
+func (config *TriggerFilterConfig) kernel() []float64 {
+	if config.Boxcar > 1 {
+		kernel := make([]float64, config.Boxcar)
+		for i := range kernel {
+			kernel[i] = 1.0 / float64(config.Boxcar)
+		}
+		return kernel
+	}
+	if len(config.Kernel) == 0 {
+		return nil
+	}
+	return append([]float64{}, config.Kernel...)
+}
+
+// ConfigureTriggerFilter sets the FIR filter applied to this stream's trigger samples,
+// or turns it off if kernel is nil. The filter output at each sample is centered on it,
+// so it needs the samples up to half a kernel later; those must fit in the part of the
+// records after the trigger, which the triggers never inspect.
+func (dsp *DataStreamProcessor) ConfigureTriggerFilter(kernel []float64) error {
+	if post := dsp.NSamples - dsp.NPresamples; len(kernel)/2 > post {
+		return fmt.Errorf("trigger filter has %d samples, but records have only %d samples after the trigger (need at least half the filter)",
+			len(kernel), post)
+	}
+	dsp.triggerKernel = kernel
+	dsp.stream.filteredData = nil
+	return nil
+}
+
+// filterTriggerSamples brings the stream's filteredData up to date with its trigger
+// samples, after new samples were appended. Only the samples that had to be filtered
+// before all of their neighbors were known are filtered again.
+func (dsp *DataStreamProcessor) filterTriggerSamples() {
+	stream := &dsp.stream
+	kernel := dsp.triggerKernel
+	if kernel == nil {
+		stream.filteredData = nil
+		return
+	}
+	input, signed := stream.unfilteredTriggerSamples()
+	n := len(input)
+	center := (len(kernel) - 1) / 2
+	start := len(stream.filteredData) - (len(kernel) - 1 - center)
+	fromTriggerData := stream.triggerData != nil
+	if start < 0 || len(stream.filteredData) > n || fromTriggerData != dsp.filteredTriggerData {
+		start = 0 // filter everything again
+	}
+	dsp.filteredTriggerData = fromTriggerData
+	if n == 0 {
+		stream.filteredData = stream.filteredData[:0]
+		return
+	}
+
+	value := func(i int) float64 {
+		// Extend the data at both ends by repeating the first or last sample.
+		if i < 0 {
+			i = 0
+		} else if i >= n {
+			i = n - 1
+		}
+		if signed {
+			return float64(int16(input[i]))
+		}
+		return float64(input[i])
+	}
+	lo, hi := 0.0, float64(math.MaxUint16)
+	if signed {
+		lo, hi = math.MinInt16, math.MaxInt16
+	}
+	filtered := stream.filteredData[:start]
+	for i := start; i < n; i++ {
+		var y float64
+		for j, k := range kernel {
+			y += k * value(i+center-j)
+		}
+		y = math.Max(lo, math.Min(hi, math.Floor(y+0.5)))
+		if signed {
+			filtered = append(filtered, RawType(int16(y)))
+		} else {
+			filtered = append(filtered, RawType(y))
+		}
+	}
+	stream.filteredData = filtered
+}
@@ -0,0 +1,118 @@
+package dastard
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTriggerFilterConfig(t *testing.T) {
+	config := TriggerFilterConfig{ChannelIndices: []int{0}, Boxcar: 4}
+	if err := config.validate(); err != nil {
+		t.Error(err)
+	}
+	if k := config.kernel(); len(k) != 4 || k[0] != 0.25 {
+		t.Errorf("Boxcar 4 kernel is %v, want 4 values of 0.25", k)
+	}
+	if k := (&TriggerFilterConfig{Boxcar: 1}).kernel(); k != nil {
+		t.Errorf("Boxcar 1 kernel is %v, want nil (no filter)", k)
+	}
+	for _, bad := range []TriggerFilterConfig{
+		{Boxcar: 4},
+		{ChannelIndices: []int{0}, Boxcar: -1},
+		{ChannelIndices: []int{0}, Boxcar: 4, Kernel: []float64{1}},
+		{ChannelIndices: []int{0}, Kernel: []float64{1, math.NaN()}},
+		{ChannelIndices: []int{0}, Boxcar: maxTriggerFilterLength + 1},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("TriggerFilterConfig %+v should fail validation", bad)
+		}
+	}
+
+	dsp := NewDataStreamProcessor(0, nil, 10, 20)
+	if err := dsp.ConfigureTriggerFilter(make([]float64, 22)); err == nil {
+		t.Error("ConfigureTriggerFilter should fail for a filter longer than twice the post-trigger samples")
+	}
+}
+
+func TestFilterTriggerSamples(t *testing.T) {
+	const NPresamples, NSamples = 50, 200
+	dsp := NewDataStreamProcessor(0, nil, NPresamples, NSamples)
+	dsp.SampleRate = 1000
+	kernel := []float64{0.1, 0.2, 0.4, 0.2, 0.1}
+	if err := dsp.ConfigureTriggerFilter(kernel); err != nil {
+		t.Fatal(err)
+	}
+
+	// Slow pulse: a step of 4000 rising over 8 samples, buried in noise of +-300.
+	rng := rand.New(rand.NewSource(1))
+	data := make([]RawType, 3000)
+	for i := range data {
+		v := 10000 + rng.Intn(601) - 300
+		if i >= 1507 {
+			v += 4000
+		} else if i >= 1500 {
+			v += 500 * (i - 1499)
+		}
+		data[i] = RawType(v)
+	}
+	// The same samples filtered all at once, for comparison.
+	want := make([]RawType, len(data))
+	for i := range data {
+		var y float64
+		for j, k := range kernel {
+			idx := i + 2 - j
+			if idx < 0 {
+				idx = 0
+			} else if idx >= len(data) {
+				idx = len(data) - 1
+			}
+			y += k * float64(data[idx])
+		}
+		want[i] = RawType(math.Floor(y + 0.5))
+	}
+
+	// Append the data in uneven segments, trimming as the triggers do.
+	first := FrameIndex(0)
+	for _, n := range []int{700, 333, 967, 1000} {
+		seg := NewDataSegment(data[first:int(first)+n], 1, first, time.Now(), time.Millisecond)
+		dsp.stream.AppendSegment(seg)
+		dsp.filterTriggerSamples()
+		stream := &dsp.stream
+		if len(stream.filteredData) != len(stream.rawData) {
+			t.Fatalf("after %d samples, filteredData has %d samples, rawData %d", int(first)+n,
+				len(stream.filteredData), len(stream.rawData))
+		}
+		offset := int(stream.firstFramenum)
+		for i := 0; i < len(stream.filteredData)-2; i++ { // the last 2 await later samples
+			if offset+i >= 2 && stream.filteredData[i] != want[offset+i] {
+				t.Fatalf("after %d samples, filteredData[%d]=%d, want %d", int(first)+n, i,
+					stream.filteredData[i], want[offset+i])
+			}
+		}
+		first += FrameIndex(n)
+		stream.TrimKeepingN(NSamples)
+	}
+
+	// Edge triggers on the filtered samples see only the pulse; on the raw samples,
+	// the noise also triggers.
+	countEdgeTriggers := func(kernel []float64) int {
+		dsp := NewDataStreamProcessor(0, nil, NPresamples, NSamples)
+		dsp.SampleRate = 1000
+		dsp.EdgeTrigger, dsp.EdgeRising, dsp.EdgeLevel = true, true, 500
+		if err := dsp.ConfigureTriggerFilter(kernel); err != nil {
+			t.Fatal(err)
+		}
+		dsp.stream.AppendSegment(NewDataSegment(data, 1, 0, time.Now(), time.Millisecond))
+		dsp.filterTriggerSamples()
+		return len(dsp.edgeTriggerComputeAppend(nil))
+	}
+	boxcar := (&TriggerFilterConfig{Boxcar: 16}).kernel()
+	if n := countEdgeTriggers(boxcar); n != 1 {
+		t.Errorf("edge trigger on filtered samples found %d triggers, want 1", n)
+	}
+	if n := countEdgeTriggers(nil); n < 2 {
+		t.Errorf("edge trigger on unfiltered samples found %d triggers, want noise triggers too", n)
+	}
+}
@@ -0,0 +1,141 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// maxTriggerPreviewSamples caps the samples kept per channel for trigger previews.
+const maxTriggerPreviewSamples = 1 << 21
+
+// triggerHistory keeps the last few seconds of a channel's (decimated) samples, so that
+// PreviewTriggers can try a trigger state on data already seen, and FetchRawSnapshot can
+// export them.
+type triggerHistory struct {
+	DataSegment         // the kept samples; triggerData too, if the stream has them
+	seconds     float64 // how much data to keep; 0 means keep none
+}
+
+// add appends a segment's samples, keeping no more than seconds of data. A gap in the
+// frame numbers, or a change in the kind of samples, starts the history over.
+func (h *triggerHistory) add(seg *DataSegment, sampleRate float64) {
+	if !(h.seconds > 0 && sampleRate > 0) || seg.framesPerSample < 1 {
+		return
+	}
+	n := len(h.rawData)
+	if n > 0 {
+		next := h.firstFramenum + FrameIndex(n*h.framesPerSample)
+		if seg.firstFramenum != next || seg.framesPerSample != h.framesPerSample || seg.signed != h.signed ||
+			(seg.triggerData == nil) != (h.triggerData == nil) {
+			n = 0
+		}
+	}
+	if n == 0 {
+		h.rawData = h.rawData[:0]
+		h.triggerData = nil
+		h.firstFramenum = seg.firstFramenum
+		h.firstTime = seg.firstTime
+		h.framesPerSample = seg.framesPerSample
+		h.framePeriod = seg.framePeriod
+		h.signed = seg.signed
+		h.voltsPerArb = seg.voltsPerArb
+	}
+	h.rawData = append(h.rawData, seg.rawData...)
+	if seg.triggerData != nil {
+		h.triggerData = append(h.triggerData, seg.triggerData...)
+		h.triggerSigned = seg.triggerSigned
+	}
+
+	// Trim only after the history grows 50% too long, so that trimming is rare.
+	keep := int(math.Min(h.seconds*sampleRate/float64(h.framesPerSample), maxTriggerPreviewSamples))
+	if L := len(h.rawData); L > keep+keep/2 {
+		copy(h.rawData, h.rawData[L-keep:])
+		h.rawData = h.rawData[:keep]
+		if h.triggerData != nil {
+			copy(h.triggerData, h.triggerData[L-keep:])
+			h.triggerData = h.triggerData[:keep]
+		}
+		deltaFrames := (L - keep) * h.framesPerSample
+		h.firstFramenum += FrameIndex(deltaFrames)
+		h.firstTime = h.firstTime.Add(time.Duration(deltaFrames) * h.framePeriod)
+	}
+}
+
+// TriggerPreviewConfig is the RPC-usable structure for PreviewTriggers: a channel and
+// a trigger state to try on its recent data.
+type TriggerPreviewConfig struct {
+	ChannelIndex int
+	TriggerState
+}
+
+// TriggerPreview is the result of PreviewTriggers: the triggers that the proposed state
+// would have found in the channel's recent data.
+type TriggerPreview struct {
+	ChannelIndex int
+	Seconds      float64      // duration of the data searched
+	FirstFrame   FrameIndex   // frame number of the first sample searched
+	Frames       []FrameIndex // frame number of each trigger
+	Types        []string     // type of each trigger (one of the TriggerType* values)
+	Rate         float64      // triggers per second
+}
+
+// previewTriggers runs the primary trigger algorithms with the given state over the
+// channel's history, without changing the channel. Manual and state triggers are
+// not previewed.
+func (dsp *DataStreamProcessor) previewTriggers(state TriggerState) (*TriggerPreview, error) {
+	if err := dsp.validateTriggerState(&state); err != nil {
+		return nil, err
+	}
+	h := &dsp.recentData
+	if len(h.rawData) <= dsp.NSamples {
+		return nil, fmt.Errorf("channel %d has too little recent data to preview triggers (see config key TriggerPreviewSeconds)",
+			dsp.channelIndex)
+	}
+
+	// A scratch processor searches a copy of the history, so the live stream is untouched.
+	scratch := NewDataStreamProcessor(dsp.channelIndex, nil, dsp.NPresamples, dsp.NSamples)
+	scratch.SampleRate = dsp.SampleRate
+	scratch.triggerKernel = dsp.triggerKernel
+	scratch.autoStagger = dsp.autoStagger
+	scratch.autoPhase = dsp.autoPhase
+	scratch.ConfigureTrigger(state)
+	segment := h.DataSegment
+	segment.rawData = append([]RawType{}, h.rawData...)
+	if h.triggerData != nil {
+		segment.triggerData = append([]RawType{}, h.triggerData...)
+	}
+	scratch.stream.AppendSegment(&segment)
+	scratch.filterTriggerSamples()
+
+	preview := &TriggerPreview{ChannelIndex: dsp.channelIndex, FirstFrame: segment.firstFramenum,
+		Seconds: float64(len(segment.rawData)*segment.framesPerSample) / dsp.SampleRate}
+	var records []*DataRecord
+	if scratch.EdgeMulti {
+		records = scratch.edgeMultiTriggerComputeAppend(records)
+	} else {
+		records = scratch.edgeTriggerComputeAppend(records)
+		records = scratch.derivTriggerComputeAppend(records)
+		records = scratch.levelTriggerComputeAppend(records)
+		records = scratch.autoTriggerComputeAppend(records)
+	}
+	preview.Frames = make([]FrameIndex, len(records))
+	preview.Types = make([]string, len(records))
+	for i, rec := range records {
+		preview.Frames[i] = rec.trigFrame
+		preview.Types[i] = rec.trigType
+	}
+	if preview.Seconds > 0 {
+		preview.Rate = float64(len(records)) / preview.Seconds
+	}
+	return preview, nil
+}
+
+// PreviewTriggers returns the triggers that config's trigger state would have found in
+// the last few seconds of the channel's data, without changing its trigger state.
+func (ds *AnySource) PreviewTriggers(config *TriggerPreviewConfig) (*TriggerPreview, error) {
+	if config.ChannelIndex < 0 || config.ChannelIndex >= len(ds.processors) {
+		return nil, fmt.Errorf("channelIndex %v is out of range [0,%v)", config.ChannelIndex, len(ds.processors))
+	}
+	return ds.processors[config.ChannelIndex].previewTriggers(config.TriggerState)
+}
@@ -0,0 +1,106 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTriggerHistory(t *testing.T) {
+	h := triggerHistory{seconds: 1}
+	const rate = 1000.0
+	t0 := time.Now()
+	for i := 0; i < 5; i++ {
+		seg := NewDataSegment(make([]RawType, 400), 1, FrameIndex(400*i), t0.Add(time.Duration(400*i)*time.Millisecond), time.Millisecond)
+		h.add(seg, rate)
+	}
+	n := len(h.rawData)
+	if n < 1000 || n > 1500 {
+		t.Errorf("triggerHistory of 1 s at %v Hz has %d samples, want [1000,1500]", rate, n)
+	}
+	if last := h.firstFramenum + FrameIndex(n); last != 2000 {
+		t.Errorf("triggerHistory ends at frame %d, want 2000", last)
+	}
+	if want := t0.Add(time.Duration(h.firstFramenum) * time.Millisecond); !h.firstTime.Equal(want) {
+		t.Errorf("triggerHistory firstTime %v, want %v", h.firstTime, want)
+	}
+
+	// A gap in the frame numbers starts over.
+	h.add(NewDataSegment(make([]RawType, 100), 1, 5000, t0, time.Millisecond), rate)
+	if len(h.rawData) != 100 || h.firstFramenum != 5000 {
+		t.Errorf("after a gap, triggerHistory has %d samples from frame %d, want 100 from 5000",
+			len(h.rawData), h.firstFramenum)
+	}
+
+	off := triggerHistory{}
+	off.add(NewDataSegment(make([]RawType, 100), 1, 0, t0, time.Millisecond), rate)
+	if len(off.rawData) != 0 {
+		t.Errorf("triggerHistory with seconds=0 kept %d samples", len(off.rawData))
+	}
+}
+
+func TestPreviewTriggers(t *testing.T) {
+	const nsamp = 10000
+	data := make([]RawType, nsamp)
+	pulses := []int{1000, 4000, 7500}
+	for i := range data {
+		data[i] = 1000
+	}
+	for _, p := range pulses {
+		for j := 0; j < 50; j++ {
+			data[p+j] += 500
+		}
+	}
+	ds := AnySource{nchan: 1}
+	ds.processors = []*DataStreamProcessor{NewDataStreamProcessor(0, nil, 20, 100)}
+	dsp := ds.processors[0]
+	dsp.SampleRate = 1000
+	dsp.recentData.seconds = 20
+	for i := 0; i < 4; i++ {
+		seg := NewDataSegment(data[i*nsamp/4:(i+1)*nsamp/4], 1, FrameIndex(i*nsamp/4), time.Now(), time.Millisecond)
+		dsp.recentData.add(seg, dsp.SampleRate)
+	}
+
+	config := TriggerPreviewConfig{ChannelIndex: 0,
+		TriggerState: TriggerState{EdgeTrigger: true, EdgeRising: true, EdgeLevel: 400}}
+	preview, err := ds.PreviewTriggers(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Frames) != len(pulses) || len(preview.Types) != len(pulses) {
+		t.Fatalf("PreviewTriggers found frames %v, want one trigger per pulse at %v", preview.Frames, pulses)
+	}
+	for i, f := range preview.Frames {
+		if f != FrameIndex(pulses[i]) || preview.Types[i] != TriggerTypeEdge {
+			t.Errorf("PreviewTriggers trigger %d at frame %d (%s), want %d (%s)", i, f, preview.Types[i],
+				pulses[i], TriggerTypeEdge)
+		}
+	}
+	if preview.Seconds != 10 || preview.Rate != 0.3 {
+		t.Errorf("PreviewTriggers searched %v s at rate %v, want 10 s and 0.3/s", preview.Seconds, preview.Rate)
+	}
+	if dsp.EdgeTrigger || dsp.EdgeLevel != 0 {
+		t.Error("PreviewTriggers changed the live trigger state")
+	}
+
+	config.TriggerState = TriggerState{AutoTrigger: true, AutoDelay: time.Second}
+	if preview, err = ds.PreviewTriggers(&config); err != nil {
+		t.Error(err)
+	} else if n := len(preview.Frames); n < 9 || n > 10 {
+		t.Errorf("PreviewTriggers with 1 s auto triggers in 10 s found %d, want 9 or 10", n)
+	}
+
+	config.TriggerState = TriggerState{AutoTrigger: true}
+	if _, err := ds.PreviewTriggers(&config); err == nil {
+		t.Error("PreviewTriggers with an invalid trigger state should fail")
+	}
+	config.ChannelIndex = 1
+	if _, err := ds.PreviewTriggers(&config); err == nil {
+		t.Error("PreviewTriggers with a channel out of range should fail")
+	}
+	dsp.recentData = triggerHistory{}
+	config.ChannelIndex = 0
+	config.TriggerState = TriggerState{EdgeTrigger: true, EdgeRising: true, EdgeLevel: 400}
+	if _, err := ds.PreviewTriggers(&config); err == nil {
+		t.Error("PreviewTriggers with no history should fail")
+	}
+}
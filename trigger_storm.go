@@ -0,0 +1,229 @@
+package dastard
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TriggerStormConfig is the RPC-usable structure for ConfigureTriggerStorm. It sets the
+// trigger storm breaker of 1 or more channels: if a channel's rate of primary triggers
+// exceeds MaxRate for more than Seconds, the trigger types that made them are turned
+// off in that channel, so that a noisy channel cannot fill the disk. The "triggerstorm"
+// section of the config file (MaxRate and Seconds only) sets all channels when a
+// source starts.
+type TriggerStormConfig struct {
+	ChannelIndices []int
+	ChannelGroups  []string // named channel groups, added to the ChannelIndices
+	MaxRate        float64  // primary triggers per second; 0 turns off the breaker
+	Seconds        float64  // how long the rate may exceed MaxRate; 0 means defaultTriggerStormSeconds
+}
+
+// defaultTriggerStormSeconds is how long the trigger rate may exceed MaxRate, if
+// Seconds is 0.
+const defaultTriggerStormSeconds = 10.0
+
+// validate checks the config for errors and fills in the default Seconds.
+func (config *TriggerStormConfig) validate() error {
+	if !(config.MaxRate >= 0) || math.IsInf(config.MaxRate, 1) {
+		return fmt.Errorf("trigger storm MaxRate=%v, need >= 0", config.MaxRate)
+	}
+	if !(config.Seconds >= 0) || math.IsInf(config.Seconds, 1) {
+		return fmt.Errorf("trigger storm Seconds=%v, need >= 0", config.Seconds)
+	}
+	if config.Seconds == 0 {
+		config.Seconds = defaultTriggerStormSeconds
+	}
+	return nil
+}
+
+// loadTriggerStormConfig returns the trigger storm breaker of the config file, or none
+// if there is none or it is invalid.
+func loadTriggerStormConfig() TriggerStormConfig {
+	var config TriggerStormConfig
+	err := viper.UnmarshalKey("triggerstorm", &config)
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		logWarningf("Invalid triggerstorm config, so the trigger storm breaker is off: %v", err)
+		config = TriggerStormConfig{}
+		config.validate()
+	}
+	return config
+}
+
+// TriggerStormEvent describes one trip of a channel's trigger storm breaker. It is sent
+// to clients as a "TRIGGERSTORM" message, and added to the run's metadata if writing.
+type TriggerStormEvent struct {
+	ChannelIndex int
+	ChannelName  string
+	Time         time.Time  // when the breaker tripped
+	Frame        FrameIndex // the data were examined for triggers up to this frame
+	Rate         float64    // the mean rate (per second) while over the limit
+	MaxRate      float64
+	Seconds      float64  // how long the rate exceeded MaxRate
+	Disabled     []string // the trigger types turned off (TriggerTypeEdge, etc.)
+}
+
+// triggerStormBreaker watches one channel's rate of primary triggers over windows of
+// about 1 second of data. Only the channel's processing goroutine may use it, except
+// between segments.
+type triggerStormBreaker struct {
+	maxRate      float64
+	seconds      float64
+	started      bool
+	windowStart  FrameIndex     // the first frame of the current window
+	windowCounts map[string]int // triggers of each type in the current window
+	overCounts   map[string]int // triggers of each type in the windows over the limit
+	overFrames   FrameIndex     // length of the consecutive windows over the limit
+}
+
+// configure sets the limit and restarts the measurement.
+func (b *triggerStormBreaker) configure(config *TriggerStormConfig) {
+	*b = triggerStormBreaker{maxRate: config.MaxRate, seconds: config.Seconds}
+}
+
+// observe counts the primary trigger records found in data examined from frame first up
+// to frame through. If the breaker trips, it returns the types of the triggers counted
+// while over the limit, and their mean rate.
+func (b *triggerStormBreaker) observe(records []*DataRecord, first, through FrameIndex,
+	sampleRate float64) (types []string, rate float64) {
+	if b.maxRate <= 0 || sampleRate <= 0 {
+		return nil, 0
+	}
+	if !b.started {
+		b.started = true
+		b.windowStart = first
+		b.windowCounts = make(map[string]int)
+	}
+	for _, r := range records {
+		b.windowCounts[r.trigType]++
+	}
+	window := through - b.windowStart
+	if through < b.windowStart || float64(window) < sampleRate {
+		return nil, 0
+	}
+	n := 0
+	for _, count := range b.windowCounts {
+		n += count
+	}
+	if float64(n) > b.maxRate*float64(window)/sampleRate {
+		if b.overCounts == nil {
+			b.overCounts = make(map[string]int)
+		}
+		for trigType, count := range b.windowCounts {
+			b.overCounts[trigType] += count
+		}
+		b.overFrames += window
+	} else {
+		b.overCounts = nil
+		b.overFrames = 0
+	}
+	b.windowStart = through
+	b.windowCounts = make(map[string]int)
+	if float64(b.overFrames) <= b.seconds*sampleRate {
+		return nil, 0
+	}
+	n = 0
+	for trigType, count := range b.overCounts {
+		types = append(types, trigType)
+		n += count
+	}
+	sort.Strings(types)
+	rate = float64(n) * sampleRate / float64(b.overFrames)
+	b.overCounts = nil
+	b.overFrames = 0
+	return types, rate
+}
+
+// ConfigureTriggerStorm sets this stream's trigger storm breaker.
+func (dsp *DataStreamProcessor) ConfigureTriggerStorm(config *TriggerStormConfig) {
+	dsp.storm.configure(config)
+}
+
+// checkTriggerStorm counts the primary trigger records for the storm breaker. If it
+// trips, the offending trigger types are turned off, and dsp.stormEvent is set so the
+// source knows to report the event and broadcast the new trigger state.
+func (dsp *DataStreamProcessor) checkTriggerStorm(records []*DataRecord, first, through FrameIndex) {
+	types, rate := dsp.storm.observe(records, first, through, dsp.SampleRate)
+	if len(types) == 0 {
+		return
+	}
+	var disabled []string
+	for _, trigType := range types {
+		var enabled *bool
+		switch trigType {
+		case TriggerTypeEdge:
+			enabled = &dsp.EdgeTrigger
+		case TriggerTypeDeriv:
+			enabled = &dsp.DerivTrigger
+		case TriggerTypeLevel:
+			enabled = &dsp.LevelTrigger
+		case TriggerTypeAuto:
+			enabled = &dsp.AutoTrigger
+		case TriggerTypeEdgeMulti:
+			enabled = &dsp.EdgeMulti
+		case TriggerTypeCondition:
+			enabled = &dsp.ConditionTrigger
+		}
+		if enabled != nil && *enabled {
+			*enabled = false
+			disabled = append(disabled, trigType)
+		}
+	}
+	if len(disabled) == 0 {
+		return
+	}
+	dsp.stormEvent = &TriggerStormEvent{ChannelIndex: dsp.channelIndex, ChannelName: dsp.Name,
+		Time: time.Now(), Frame: through, Rate: rate, MaxRate: dsp.storm.maxRate,
+		Seconds: dsp.storm.seconds, Disabled: disabled}
+}
+
+// ConfigureTriggerStorm sets the trigger storm breaker of 1 or more channels.
+func (ds *AnySource) ConfigureTriggerStorm(config *TriggerStormConfig) error {
+	if len(config.ChannelIndices) == 0 {
+		return fmt.Errorf("TriggerStormConfig has no ChannelIndices")
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= ds.nchan {
+			return fmt.Errorf("channelIndex %v is out of range [0,%v)", channelIndex, ds.nchan)
+		}
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].ConfigureTriggerStorm(config)
+	}
+	return nil
+}
+
+// reportTriggerStorms alerts clients to each channel whose trigger storm breaker tripped
+// in the last segment, and records the events in the metadata of the run being written.
+// It returns whether any breaker tripped (so the trigger state has changed).
+func (ds *AnySource) reportTriggerStorms() bool {
+	var events []TriggerStormEvent
+	for _, dsp := range ds.processors {
+		if dsp.stormEvent != nil {
+			events = append(events, *dsp.stormEvent)
+			dsp.stormEvent = nil
+		}
+	}
+	for _, e := range events {
+		logWarningf("Trigger storm in channel %s: %.1f triggers/s for %.0f s (limit %.1f/s), so %v triggers are off",
+			e.ChannelName, e.Rate, e.Seconds, e.MaxRate, e.Disabled)
+		clientMessageChan <- ClientUpdate{"TRIGGERSTORM", e}
+	}
+	ws := &ds.writingState
+	if len(events) > 0 && ws.Active && ws.metadata != nil {
+		ws.metadata.TriggerStorms = append(ws.metadata.TriggerStorms, events...)
+		if err := ws.writeMetadata(); err != nil {
+			logWarningf("Could not update metadata file %s: %v", ws.MetadataFilename, err)
+		}
+	}
+	return len(events) > 0
+}
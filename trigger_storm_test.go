@@ -0,0 +1,120 @@
+package dastard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTriggerStorm(t *testing.T) {
+	for _, bad := range []TriggerStormConfig{{MaxRate: -1}, {MaxRate: math.NaN()}, {MaxRate: 1, Seconds: -1},
+		{MaxRate: math.Inf(1)}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("TriggerStormConfig%+v.validate() should fail", bad)
+		}
+	}
+	config := TriggerStormConfig{MaxRate: 10, Seconds: 2}
+	if err := config.validate(); err != nil {
+		t.Error(err)
+	}
+
+	// Windows of 1 second (1000 frames) with 20 edge triggers and 1 auto trigger.
+	records := func(n int, trigType string) []*DataRecord {
+		r := make([]*DataRecord, n)
+		for i := range r {
+			r[i] = &DataRecord{trigType: trigType}
+		}
+		return r
+	}
+	storm := append(records(20, TriggerTypeEdge), records(1, TriggerTypeAuto)...)
+	var b triggerStormBreaker
+	b.configure(&config)
+	var frame FrameIndex
+	observe := func(recs []*DataRecord) ([]string, float64) {
+		frame += 1000
+		return b.observe(recs, frame-1000, frame, 1000)
+	}
+	// A quiet second restarts the count.
+	for i, recs := range [][]*DataRecord{storm, storm, records(5, TriggerTypeEdge), storm, storm} {
+		if types, _ := observe(recs); types != nil {
+			t.Errorf("breaker tripped in second %d: %v", i, types)
+		}
+	}
+	types, rate := observe(storm)
+	if !reflect.DeepEqual(types, []string{TriggerTypeAuto, TriggerTypeEdge}) || rate != 21 {
+		t.Errorf("breaker gives types %v, rate %v after 3 seconds of storm, want [AUTO EDGE], 21", types, rate)
+	}
+
+	// The stream turns off the offending trigger types.
+	dsp := &DataStreamProcessor{channelIndex: 1, Name: "chan2", SampleRate: 1000}
+	dsp.EdgeTrigger = true
+	dsp.AutoTrigger = true
+	dsp.LevelTrigger = true
+	dsp.ConfigureTriggerStorm(&config)
+	frame = 0
+	for i := 0; i < 3; i++ {
+		frame += 1000
+		dsp.checkTriggerStorm(storm, frame-1000, frame)
+	}
+	if dsp.EdgeTrigger || dsp.AutoTrigger || !dsp.LevelTrigger {
+		t.Errorf("storm left triggers edge %t, auto %t, level %t, want false, false, true",
+			dsp.EdgeTrigger, dsp.AutoTrigger, dsp.LevelTrigger)
+	}
+	e := dsp.stormEvent
+	if e == nil || e.ChannelIndex != 1 || e.Frame != 3000 || !reflect.DeepEqual(e.Disabled, types) {
+		t.Errorf("storm event is %+v", e)
+	}
+
+	// The source reports the event, and records it in the run's metadata.
+	tmp, err := ioutil.TempDir("", "dastard_storm_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds := AnySource{nchan: 2}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	for _, bad := range []TriggerStormConfig{{MaxRate: 10}, {ChannelIndices: []int{2}, MaxRate: 10},
+		{ChannelIndices: []int{0}, MaxRate: -1}} {
+		if err := ds.ConfigureTriggerStorm(&bad); err == nil {
+			t.Errorf("ConfigureTriggerStorm(%+v) should fail", bad)
+		}
+	}
+	if err := ds.ConfigureTriggerStorm(&TriggerStormConfig{ChannelIndices: []int{0, 1}, MaxRate: 5}); err != nil {
+		t.Error(err)
+	}
+	if b := ds.processors[1].storm; b.maxRate != 5 || b.seconds != defaultTriggerStormSeconds {
+		t.Errorf("storm breaker has maxRate %v, seconds %v, want 5, %v", b.maxRate, b.seconds, defaultTriggerStormSeconds)
+	}
+	wc := &WriteControlConfig{Request: "Start", Path: tmp, WriteLJH22: true}
+	if err := ds.WriteControl(wc); err != nil {
+		t.Fatal(err)
+	}
+	metadataFilename := ds.writingState.MetadataFilename
+	if ds.reportTriggerStorms() {
+		t.Error("reportTriggerStorms reports a storm before any")
+	}
+	ds.processors[1].stormEvent = e
+	if !ds.reportTriggerStorms() || ds.processors[1].stormEvent != nil {
+		t.Error("reportTriggerStorms did not report the storm")
+	}
+	contents, err := ioutil.ReadFile(metadataFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md RunMetadata
+	if err := json.Unmarshal(contents, &md); err != nil {
+		t.Fatal(err)
+	}
+	if len(md.TriggerStorms) != 1 || md.TriggerStorms[0].ChannelName != "chan2" {
+		t.Errorf("metadata has TriggerStorms %+v", md.TriggerStorms)
+	}
+	wc.Request = "Stop"
+	if err := ds.WriteControl(wc); err != nil {
+		t.Error(err)
+	}
+}
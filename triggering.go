@@ -2,7 +2,6 @@ package dastard
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"sort"
 	"time"
@@ -10,9 +9,16 @@ import (
 	"gonum.org/v1/gonum/mat"
 )
 
+// triggerList is one channel's primary triggers from one segment, sent to the group
+// trigger broker. Besides the frame of each trigger, it carries the trigger's absolute
+// time and the channel's frame period and decimation, so that a receiver can place its
+// secondary records even if it decimates differently (or, some day, is another source).
 type triggerList struct {
 	channelIndex                  int
 	frames                        []FrameIndex
+	times                         []time.Time // absolute time of each trigger in frames
+	framePeriod                   time.Duration
+	framesPerSample               int
 	keyFrame                      FrameIndex
 	keyTime                       time.Time
 	sampleRate                    float64
@@ -27,10 +33,28 @@ const (
 	initial
 )
 
+// Values of DataRecord.trigType, the kind of trigger that made a record
+const (
+	TriggerTypeEdge      = "EDGE"
+	TriggerTypeDeriv     = "DERIV"
+	TriggerTypeLevel     = "LEVEL"
+	TriggerTypeAuto      = "AUTO"
+	TriggerTypeEdgeMulti = "EDGEMULTI"
+	TriggerTypeCondition = "CONDITION" // one or more of TriggerState.Conditions
+	TriggerTypeManual    = "MANUAL"
+	TriggerTypeState     = "STATE"     // at an experiment state transition
+	TriggerTypeStimulus  = "STIMULUS"  // forced during a stimulus window
+	TriggerTypeSecondary = "SECONDARY" // a group trigger caused by another channel
+)
+
 // TriggerState contains all the state that controls trigger logic
 type TriggerState struct {
 	AutoTrigger bool
 	AutoDelay   time.Duration
+	// AutoIdleFill makes auto triggers fill only idle time: none within AutoDelay before or
+	// after another trigger, and AutoDelay grows with the rate of other triggers, so noise
+	// records take little bandwidth when pulses are plentiful.
+	AutoIdleFill bool
 
 	LevelTrigger bool
 	LevelRising  bool
@@ -41,10 +65,41 @@ type TriggerState struct {
 	EdgeFalling bool
 	EdgeLevel   int32
 
+	// DerivTrigger is a smoother edge trigger: it triggers where the rate of change of the
+	// trigger samples (the least-squares slope of the last DerivLength of them, in arbs
+	// per sample) reaches DerivLevel, rising or falling. A longer kernel averages more
+	// noise away, so slow-rising pulses can trigger at a lower, better-timed level.
+	DerivTrigger bool
+	DerivRising  bool
+	DerivFalling bool
+	DerivLevel   float64
+	DerivLength  int
+
+	// ConditionTrigger turns on a list of trigger Conditions, such as two edge thresholds
+	// and a level, each with its own settings. ConditionCombine says how they combine:
+	// OR (the default) triggers wherever any condition fires, and AND only where all of
+	// them fire within ConditionWindow samples. Each record they make carries a mask of
+	// the conditions that fired. It can't be used with the edge, deriv, level, or
+	// EdgeMulti triggers above and below.
+	ConditionTrigger bool
+	Conditions       []TriggerCondition
+	ConditionCombine string
+	ConditionWindow  int
+
+	// TriggerOnError makes a Lancero feedback channel look for edge and level triggers in
+	// its error signal, instead of the mixed signal that it records. Other sources ignore it.
+	TriggerOnError bool
+
+	// StateTrigger makes one record at each experiment state transition (each new label
+	// of SetExperimentStateLabel, including a run's START but not its STOP). All channels
+	// with StateTrigger make their records at the same frame.
+	StateTrigger bool
+
 	EdgeMulti                        bool
 	EdgeMultiNoise                   bool
 	EdgeMultiMakeShortRecords        bool
 	EdgeMultiMakeContaminatedRecords bool
+	EdgeMultiMakeTrainRecords        bool
 	EdgeMultiVerifyNMonotone         int
 	edgeMultiInternalSearchState     edgeMultiInternalSearchStateType
 	edgeMultiIPotential              FrameIndex
@@ -53,6 +108,44 @@ type TriggerState struct {
 	// TODO: group source/rx info.
 }
 
+// validateTriggerState returns an error if state cannot work in this channel, such as
+// an auto trigger with no delay or an EdgeMulti check longer than the post-trigger record.
+func (dsp *DataStreamProcessor) validateTriggerState(state *TriggerState) error {
+	if err := dsp.validateTriggerConditions(state); err != nil {
+		return err
+	}
+	if state.AutoDelay < 0 {
+		return fmt.Errorf("AutoDelay=%v, must not be negative", state.AutoDelay)
+	}
+	if (state.AutoTrigger || state.EdgeMultiNoise) && state.AutoDelay == 0 {
+		return fmt.Errorf("auto triggers need AutoDelay > 0")
+	}
+	if state.DerivTrigger {
+		if state.EdgeTrigger {
+			return fmt.Errorf("use either EdgeTrigger or DerivTrigger, not both")
+		}
+		if state.DerivLength < 2 || state.DerivLength > maxDerivLength {
+			return fmt.Errorf("DerivLength=%d, need [2,%d]", state.DerivLength, maxDerivLength)
+		}
+		if state.DerivLength > dsp.NPresamples {
+			return fmt.Errorf("DerivLength=%d is longer than the %d pretrigger samples", state.DerivLength, dsp.NPresamples)
+		}
+		if !(state.DerivLevel > 0) {
+			return fmt.Errorf("DerivLevel=%v, need > 0", state.DerivLevel)
+		}
+	}
+	if state.EdgeMulti {
+		if state.EdgeMultiVerifyNMonotone < 1 {
+			return fmt.Errorf("EdgeMultiVerifyNMonotone=%d, must be at least 1", state.EdgeMultiVerifyNMonotone)
+		}
+		if state.EdgeMultiVerifyNMonotone+3 > dsp.NSamples-dsp.NPresamples {
+			return fmt.Errorf("EdgeMultiVerifyNMonotone=%d is too long for records with %d samples after the trigger",
+				state.EdgeMultiVerifyNMonotone, dsp.NSamples-dsp.NPresamples)
+		}
+	}
+	return nil
+}
+
 // modify dsp to have it start looking for triggers at sample 6
 // can't be sample 0 because we look back in time by up to 6 samples
 // for kink fit
@@ -72,11 +165,14 @@ func (dsp *DataStreamProcessor) triggerAt(segment *DataSegment, i int) *DataReco
 
 // create a record with NPresamples and NSamples passed as arguments
 func (dsp *DataStreamProcessor) triggerAtSpecificSamples(segment *DataSegment, i int, NPresamples int, NSamples int) *DataRecord {
-	data := make([]RawType, NSamples)
 	// fmt.Printf("triggerAtSpecificSamples i %v, NPresamples %v, NSamples %v, len(rawData) %v\n", i, NPresamples, NSamples, len(segment.rawData))
-	copy(data, segment.rawData[i-NPresamples:i+NSamples-NPresamples])
+	// The record refers to the stream's samples instead of copying them. The stream is
+	// marked as shared, so it copies on its next trim rather than overwrite them.
+	end := i + NSamples - NPresamples
+	data := segment.rawData[i-NPresamples : end : end]
+	dsp.stream.shared = true
 	tf := segment.firstFramenum + FrameIndex(i)
-	tt := segment.TimeOf(i)
+	tt := segment.TimeOf(i).Add(dsp.rowOffset)
 	sampPeriod := float32(1.0 / dsp.SampleRate)
 	record := &DataRecord{data: data, trigFrame: tf, trigTime: tt,
 		channelIndex: dsp.channelIndex, signed: segment.signed,
@@ -186,6 +282,7 @@ func kinkModelFit(xdata []float64, ydata []float64, ks []float64) (float64, floa
 // records are generated according to
 // EdgeMultiMakeShortRecords  -> variable length records
 // EdgeMultiMakeContaminatedRecords -> records that may have another pulse in them
+// EdgeMultiMakeTrainRecords -> variable length records, each holding a whole train of overlapping pulses
 // Neither -> Fixed length records without any other pulses in them (as if you already did postpeak deriv cut)
 // 2. EdgeMultiNoise: requires: EdgeMulti, EdgeMulitNoise, EdgeLevel, EdgeMultiVerifyNMonotone, AutoDelay
 // will not produce pulse containing records, just the autotrigger that fit in around them
@@ -195,6 +292,15 @@ func (dsp *DataStreamProcessor) edgeMultiTriggerComputeAppend(records []*DataRec
 	raw := segment.rawData
 	ndata := len(raw)
 
+	// Solve the problem of signed data by shifting all values up by 2^15
+	if segment.signed {
+		shifted := make([]RawType, ndata)
+		for i := 0; i < ndata; i++ {
+			shifted[i] = raw[i] + 32768
+		}
+		raw = shifted
+	}
+
 	var triggerInds []int
 	var iPotential, iLast, iFirst int
 	iPotential = int(dsp.edgeMultiIPotential - segment.firstFramenum)
@@ -203,7 +309,7 @@ func (dsp *DataStreamProcessor) edgeMultiTriggerComputeAppend(records []*DataRec
 		if dsp.edgeMultiInternalSearchState != initial {
 			dsp.edgeMultiInternalSearchState = initial
 			for i := 0; i < 10; i++ {
-				fmt.Printf("channelIndex %v needed edgeMultiInternalSearchState reset to initial\n", dsp.channelIndex)
+				logDebugf("channelIndex %v needed edgeMultiInternalSearchState reset to initial", dsp.channelIndex)
 			}
 		}
 		// I havent' figure out why this is neccesary but maybe it helps because of race conditions?
@@ -293,6 +399,7 @@ func (dsp *DataStreamProcessor) edgeMultiTriggerComputeAppend(records []*DataRec
 		lastIThatCantEdgeTrigger = iPotential - 1
 	}
 
+	var lastTrainTrigger FrameIndex // last trigger inside a train record, if any
 	if !dsp.EdgeMultiNoise {
 		var t, u, v, tFirst int
 		// t index of previous trigger
@@ -322,21 +429,43 @@ func (dsp *DataStreamProcessor) edgeMultiTriggerComputeAppend(records []*DataRec
 			npost := min(dsp.NSamples-dsp.NPresamples, int(v-u))
 			// fmt.Println("ch", dsp.channelIndex, "i", i, "npre", npre, "npost", npost, "t", t,
 			// 	"u", u, "v", v, "lastNPost", lastNPost, "firstFramenum", segment.firstFramenum, "iLast", iLast)
-			if dsp.EdgeMultiMakeShortRecords {
+			if dsp.EdgeMultiMakeTrainRecords {
+				// Extend the record through each following trigger that comes before this
+				// record's post-trigger samples end. Trains can't extend past iLast.
+				j := i
+				for j+1 < len(triggerInds) && triggerInds[j+1]-triggerInds[j] < dsp.NSamples-dsp.NPresamples {
+					j++
+				}
+				if j > i {
+					w := iLast
+					if j+1 < len(triggerInds) {
+						w = triggerInds[j+1]
+					}
+					npost = triggerInds[j] - u + min(dsp.NSamples-dsp.NPresamples, w-triggerInds[j])
+					i = j
+				}
+				newRecord := dsp.triggerAtSpecificSamples(segment, u, npre, npre+npost)
+				newRecord.trigType = TriggerTypeEdgeMulti
+				records = append(records, newRecord)
+				lastTrainTrigger = segment.firstFramenum + FrameIndex(triggerInds[j])
+			} else if dsp.EdgeMultiMakeShortRecords {
 				// fmt.Printf("short trigger at u %v\n", u)
 				// fmt.Println("ch", dsp.channelIndex, "i", i, "npre", npre, "npost", npost, "t", t,
 				// 	"u", u, "v", v, "lastNPost", lastNPost, "firstFramenum", segment.firstFramenum, "iLast", iLast)
 				newRecord := dsp.triggerAtSpecificSamples(segment, u, npre, npre+npost)
+				newRecord.trigType = TriggerTypeEdgeMulti
 				records = append(records, newRecord)
 			} else if dsp.EdgeMultiMakeContaminatedRecords {
 				newRecord := dsp.triggerAtSpecificSamples(segment, u, dsp.NPresamples, dsp.NSamples)
+				newRecord.trigType = TriggerTypeEdgeMulti
 				records = append(records, newRecord)
 				if len(records) >= (len(raw)/dsp.NSamples)/2+1 {
-					log.Println("limiting recordization rate of EdgeMultiMakeContaminatedRecords")
+					logWarningf("limiting recordization rate of EdgeMultiMakeContaminatedRecords")
 					break
 				}
 			} else if npre >= dsp.NPresamples && npre+npost >= dsp.NSamples {
 				newRecord := dsp.triggerAtSpecificSamples(segment, u, dsp.NPresamples, dsp.NSamples)
+				newRecord.trigType = TriggerTypeEdgeMulti
 				records = append(records, newRecord)
 			}
 		}
@@ -391,6 +520,7 @@ func (dsp *DataStreamProcessor) edgeMultiTriggerComputeAppend(records []*DataRec
 				if nextPotentialTrig+dsp.NSamples <= nextFoundTrig {
 					// auto trigger is allowed: no conflict with previously found non-auto triggers
 					newRecord := dsp.triggerAt(segment, nextPotentialTrig)
+					newRecord.trigType = TriggerTypeAuto
 					records = append(records, newRecord)
 					// fmt.Println("trigger accepted")
 					// fmt.Printf("trigger at %v, i=%v-%v, FrameIndex=%v-%v\n", nextPotentialTrig,
@@ -421,6 +551,9 @@ func (dsp *DataStreamProcessor) edgeMultiTriggerComputeAppend(records []*DataRec
 	}
 	if len(records) > 0 {
 		dsp.LastEdgeMultiTrigger = records[len(records)-1].trigFrame
+		if lastTrainTrigger > dsp.LastEdgeMultiTrigger {
+			dsp.LastEdgeMultiTrigger = lastTrainTrigger
+		}
 	}
 	// fmt.Printf("return %v of %v possible record. len(dsp.stream.rawData) %v\n", len(records), len(triggerInds), len(dsp.stream.rawData))
 	return records
@@ -431,16 +564,16 @@ func (dsp *DataStreamProcessor) edgeTriggerComputeAppend(records []*DataRecord)
 		return records
 	}
 	segment := &dsp.stream.DataSegment
-	raw := segment.rawData
+	raw, signed := segment.triggerSamples()
 	ndata := len(raw)
 
 	// Solve the problem of signed data by shifting all values up by 2^15
-	if dsp.stream.signed {
-		raw = make([]RawType, ndata)
-		copy(raw, segment.rawData)
+	if signed {
+		shifted := make([]RawType, ndata)
 		for i := 0; i < ndata; i++ {
-			raw[i] += 32768
+			shifted[i] = raw[i] + 32768
 		}
+		raw = shifted
 	}
 
 	for i := dsp.NPresamples; i < ndata+dsp.NPresamples-dsp.NSamples; i++ {
@@ -448,6 +581,7 @@ func (dsp *DataStreamProcessor) edgeTriggerComputeAppend(records []*DataRecord)
 		if (dsp.EdgeRising && diff >= dsp.EdgeLevel) ||
 			(dsp.EdgeFalling && diff <= -dsp.EdgeLevel) {
 			newRecord := dsp.triggerAt(segment, i)
+			newRecord.trigType = TriggerTypeEdge
 			records = append(records, newRecord)
 			i += dsp.NSamples
 		}
@@ -455,12 +589,77 @@ func (dsp *DataStreamProcessor) edgeTriggerComputeAppend(records []*DataRecord)
 	return records
 }
 
+// maxDerivLength is the longest allowed DerivLength.
+const maxDerivLength = 256
+
+// derivTriggerComputeAppend finds the derivative triggers. The slope of each window of
+// DerivLength samples is kept up to date with running sums as the window slides.
+func (dsp *DataStreamProcessor) derivTriggerComputeAppend(records []*DataRecord) []*DataRecord {
+	if !dsp.DerivTrigger {
+		return records
+	}
+	segment := &dsp.stream.DataSegment
+	raw, signed := segment.triggerSamples()
+	ndata := len(raw)
+	value := func(i int) int64 {
+		if signed {
+			return int64(int16(raw[i]))
+		}
+		return int64(raw[i])
+	}
+
+	// For the window raw[i-L+1:i+1], S0 is the sum of the samples, and S1 the sum of each
+	// sample times its place in the window (0 to L-1). The slope is (S1-c*S0)/denom.
+	L := dsp.DerivLength
+	c := float64(L-1) / 2
+	denom := float64(L*(L*L-1)) / 12
+	var S0, S1 int64
+	start := func(i int) {
+		S0, S1 = 0, 0
+		for j := 0; j < L; j++ {
+			x := value(i - L + 1 + j)
+			S0 += x
+			S1 += int64(j) * x
+		}
+	}
+
+	first := dsp.NPresamples
+	if first < L-1 {
+		first = L - 1
+	}
+	end := ndata + dsp.NPresamples - dsp.NSamples
+	if first < end {
+		start(first)
+	}
+	for i := first; i < end; i++ {
+		if i > first {
+			x := value(i)
+			xOld := value(i - L)
+			S1 += xOld - S0 + int64(L-1)*x
+			S0 += x - xOld
+		}
+		slope := (float64(S1) - c*float64(S0)) / denom
+		if (dsp.DerivRising && slope >= dsp.DerivLevel) ||
+			(dsp.DerivFalling && slope <= -dsp.DerivLevel) {
+			newRecord := dsp.triggerAt(segment, i)
+			newRecord.trigType = TriggerTypeDeriv
+			records = append(records, newRecord)
+			i += dsp.NSamples
+			if i+1 < end {
+				start(i + 1)
+				first = i + 1
+			}
+		}
+	}
+	return records
+}
+
 func (dsp *DataStreamProcessor) levelTriggerComputeAppend(records []*DataRecord) []*DataRecord {
 	if !dsp.LevelTrigger {
 		return records
 	}
 	segment := &dsp.stream.DataSegment
-	raw := segment.rawData
+	raw, signed := segment.triggerSamples()
 	ndata := len(raw)
 	nsamp := FrameIndex(dsp.NSamples)
 
@@ -473,13 +672,13 @@ func (dsp *DataStreamProcessor) levelTriggerComputeAppend(records []*DataRecord)
 
 	// Solve the problem of signed data by shifting all values up by 2^15
 	threshold := dsp.LevelLevel
-	if dsp.stream.signed {
+	if signed {
 		threshold += 32768
-		raw = make([]RawType, ndata)
-		copy(raw, segment.rawData)
+		shifted := make([]RawType, ndata)
 		for i := 0; i < ndata; i++ {
-			raw[i] += 32768
+			shifted[i] = raw[i] + 32768
 		}
+		raw = shifted
 	}
 
 	// Normal loop through all samples in triggerable range
@@ -503,6 +702,7 @@ func (dsp *DataStreamProcessor) levelTriggerComputeAppend(records []*DataRecord)
 		if (dsp.LevelRising && raw[i] >= threshold && raw[i-1] < threshold) ||
 			(!dsp.LevelRising && raw[i] <= threshold && raw[i-1] > threshold) {
 			newRecord := dsp.triggerAt(segment, i)
+			newRecord.trigType = TriggerTypeLevel
 			records = append(records, newRecord)
 		}
 	}
@@ -524,6 +724,15 @@ func (dsp *DataStreamProcessor) autoTriggerComputeAppend(records []*DataRecord)
 	if delaySamples < nsamp {
 		delaySamples = nsamp
 	}
+	// With staggering, auto triggers fall only on this channel's grid of frames.
+	period := delaySamples
+	first := segment.firstFramenum
+	// An auto trigger needs this many samples free of other triggers after it.
+	clearAfter := nsamp
+	if dsp.AutoIdleFill {
+		delaySamples = dsp.idleFillDelay(delaySamples, len(records))
+		clearAfter = delaySamples
+	}
 	idxNextTrig := 0
 	nFoundTrigs := len(records)
 	nextFoundTrig := FrameIndex(math.MaxInt64)
@@ -536,18 +745,20 @@ func (dsp *DataStreamProcessor) autoTriggerComputeAppend(records []*DataRecord)
 	if nextPotentialTrig < npre {
 		nextPotentialTrig = npre
 	}
+	nextPotentialTrig = dsp.autoTriggerGrid(nextPotentialTrig, first, period)
 
 	// Loop through all potential trigger times.
 	for nextPotentialTrig+nsamp-npre < FrameIndex(ndata) {
-		if nextPotentialTrig+nsamp <= nextFoundTrig {
+		if nextPotentialTrig+clearAfter <= nextFoundTrig {
 			// auto trigger is allowed: no conflict with previously found non-auto triggers
 			newRecord := dsp.triggerAt(segment, int(nextPotentialTrig))
+			newRecord.trigType = TriggerTypeAuto
 			records = append(records, newRecord)
-			nextPotentialTrig += delaySamples
+			nextPotentialTrig = dsp.autoTriggerGrid(nextPotentialTrig+delaySamples, first, period)
 
 		} else {
 			// auto trigger not allowed: conflict with previously found non-auto triggers
-			nextPotentialTrig = nextFoundTrig + delaySamples
+			nextPotentialTrig = dsp.autoTriggerGrid(nextFoundTrig+delaySamples, first, period)
 			idxNextTrig++
 			if nFoundTrigs > idxNextTrig {
 				nextFoundTrig = records[idxNextTrig].trigFrame - segment.firstFramenum
@@ -560,36 +771,113 @@ func (dsp *DataStreamProcessor) autoTriggerComputeAppend(records []*DataRecord)
 	return records
 }
 
+// idleFillRateTau is the time constant for smoothing the rate of other triggers, which
+// sets how far the AutoIdleFill mode lengthens the auto-trigger delay.
+const idleFillRateTau = 10 * time.Second
+
+// idleFillDelay updates the smoothed rate of non-auto triggers, given the number found in
+// the newest data, and returns the auto-trigger delay for the AutoIdleFill mode: the
+// usual delaySamples, lengthened by a factor (1 + rate*AutoDelay).
+func (dsp *DataStreamProcessor) idleFillDelay(delaySamples FrameIndex, nOther int) FrameIndex {
+	newSamples := dsp.stream.samplesSeen - dsp.idleFillSeen
+	dsp.idleFillSeen = dsp.stream.samplesSeen
+	if dt := float64(newSamples) / dsp.SampleRate; dt > 0 {
+		alpha := 1 - math.Exp(-dt/idleFillRateTau.Seconds())
+		dsp.idleFillRate += alpha * (float64(nOther)/dt - dsp.idleFillRate)
+	}
+	scale := 1 + dsp.idleFillRate*dsp.AutoDelay.Seconds()
+	return FrameIndex(float64(delaySamples)*scale + 0.5)
+}
+
+// manualTriggerComputeAppend adds one record at the latest triggerable sample in the
+// stream, if a manual trigger was requested. If the stream is too short to hold a
+// full record, the request stays pending until it can be fulfilled.
+func (dsp *DataStreamProcessor) manualTriggerComputeAppend(records []*DataRecord) []*DataRecord {
+	if !dsp.manualTriggerPending {
+		return records
+	}
+	segment := &dsp.stream.DataSegment
+	i := len(segment.rawData) + dsp.NPresamples - dsp.NSamples
+	if i < dsp.NPresamples {
+		return records
+	}
+	record := dsp.triggerAt(segment, i)
+	record.trigType = TriggerTypeManual
+	records = append(records, record)
+	dsp.manualTriggerPending = false
+	sort.Sort(RecordSlice(records))
+	return records
+}
+
+// stateTriggerComputeAppend adds one record at the frame of each pending experiment
+// state transition. If the stream is too short to hold a full record, the request stays
+// pending until it can be fulfilled; if the record's samples are already gone, it's dropped.
+func (dsp *DataStreamProcessor) stateTriggerComputeAppend(records []*DataRecord) []*DataRecord {
+	if len(dsp.stateTriggerFrames) == 0 {
+		return records
+	}
+	segment := &dsp.stream.DataSegment
+	fps := segment.framesPerSample
+	if fps < 1 {
+		fps = 1
+	}
+	pending := dsp.stateTriggerFrames[:0]
+	added := false
+	for _, frame := range dsp.stateTriggerFrames {
+		i := int(frame-segment.firstFramenum) / fps
+		if i+dsp.NSamples-dsp.NPresamples > len(segment.rawData) {
+			pending = append(pending, frame)
+			continue
+		}
+		if i < dsp.NPresamples {
+			logDebugf("channel %d dropped a state trigger at frame %d: its samples are gone", dsp.channelIndex, frame)
+			continue
+		}
+		record := dsp.triggerAt(segment, i)
+		record.trigType = TriggerTypeState
+		records = append(records, record)
+		added = true
+	}
+	dsp.stateTriggerFrames = pending
+	if added {
+		sort.Sort(RecordSlice(records))
+	}
+	return records
+}
+
 // TriggerData analyzes a DataSegment to find and generate triggered records.
 // All edge triggers are found, then level triggers, then auto and noise triggers.
+// It is the combination of TriggerDataPrimary and TriggerDataSecondary, and so it
+// blocks until the group trigger broker has heard from all channels.
 func (dsp *DataStreamProcessor) TriggerData() (records []*DataRecord, secondaries []*DataRecord) {
+	records = dsp.TriggerDataPrimary()
+	secondaries = dsp.TriggerDataSecondary()
+	return
+}
+
+// TriggerDataPrimary finds the primary triggers and generates their records, then
+// sends the list of primary trigger frames to the group trigger broker. It does not
+// wait for the broker's answer; call TriggerDataSecondary for that.
+func (dsp *DataStreamProcessor) TriggerDataPrimary() (records []*DataRecord) {
+	if dsp.neverTrigger || dsp.deadDetect.triggersOff() {
+		dsp.sendPrimaryTriggerList(nil)
+		return
+	}
 	if dsp.EdgeMulti {
 		// EdgeMulti does not play nice with other triggers!!
 		records = dsp.edgeMultiTriggerComputeAppend(records)
-		trigList := triggerList{channelIndex: dsp.channelIndex}
-		trigList.frames = make([]FrameIndex, len(records))
-		for i, r := range records {
-			trigList.frames[i] = r.trigFrame
-		}
-		trigList.keyFrame = dsp.stream.DataSegment.firstFramenum
-		trigList.keyTime = dsp.stream.DataSegment.firstTime
-		trigList.sampleRate = dsp.SampleRate
-		trigList.lastFrameThatWillNeverTrigger = dsp.stream.DataSegment.firstFramenum +
-			FrameIndex(len(dsp.stream.rawData)) - FrameIndex(dsp.NSamples-dsp.NPresamples)
-
-		// Step 2b: send the primary list to the group trigger broker; receive the secondary list.
-		dsp.Broker.PrimaryTrigs <- trigList
-		secondaryTrigList := <-dsp.Broker.SecondaryTrigs[dsp.channelIndex]
-		segment := &dsp.stream.DataSegment
-		for _, st := range secondaryTrigList {
-			secondaries = append(secondaries, dsp.triggerAt(segment, int(st-segment.firstFramenum)))
-		}
+		records = dsp.manualTriggerComputeAppend(records)
+		records = dsp.stateTriggerComputeAppend(records)
+		records = dsp.stimulusTriggerComputeAppend(records)
+		dsp.sendPrimaryTriggerList(records)
 		return
 	}
 
 	// Step 1: compute where the primary triggers are, one pass per trigger type.
-	// Step 1a: compute all edge triggers on a first pass. Separated by at least 1 record length
+	// Step 1a: compute all edge (or derivative) triggers on a first pass. Separated by at least 1 record length
 	records = dsp.edgeTriggerComputeAppend(records)
+	records = dsp.derivTriggerComputeAppend(records)
+	records = dsp.conditionTriggerComputeAppend(records)
 	// Step 1b: compute all level triggers on a second pass. Only insert them
 	// in the list of triggers if they are properly separated from the edge triggers.
 	records = dsp.levelTriggerComputeAppend(records)
@@ -597,44 +885,164 @@ func (dsp *DataStreamProcessor) TriggerData() (records []*DataRecord, secondarie
 	// Step 1c: compute all auto triggers, wherever they fit in between edge+level.
 	records = dsp.autoTriggerComputeAppend(records)
 
+	// Step 1d: add a manual trigger, if one was requested by RPC.
+	records = dsp.manualTriggerComputeAppend(records)
+
+	// Step 1e: add a trigger at each experiment state transition, if requested.
+	records = dsp.stateTriggerComputeAppend(records)
+
+	// Step 1f: add the forced triggers of a stimulus window, if any.
+	records = dsp.stimulusTriggerComputeAppend(records)
+
 	// Step 1.5: note the last trigger for the next invocation of TriggerData
 	if len(records) > 0 {
 		dsp.LastTrigger = records[len(records)-1].trigFrame
 	}
 
-	// TODO Step 1d: compute all noise triggers, wherever they fit in between edge+level.
+	// TODO Step 1g: compute all noise triggers, wherever they fit in between edge+level.
 	//
 
-	// Step 2: send the primary trigger list to the group trigger broker and await its
-	// answer about when the secondary triggers are.
+	// Step 2: send the primary trigger list to the group trigger broker. Its
+	// answer about when the secondary triggers are is handled in TriggerDataSecondary.
+	dsp.sendPrimaryTriggerList(records)
+	return
+}
 
-	// Step 2a: prepare the primary trigger list from the DataRecord list
-	trigList := triggerList{channelIndex: dsp.channelIndex}
+// sendPrimaryTriggerList prepares the primary trigger list from the DataRecord list
+// and sends it to the group trigger broker.
+func (dsp *DataStreamProcessor) sendPrimaryTriggerList(records []*DataRecord) {
+	fps := dsp.stream.framesPerSample
+	if fps < 1 {
+		fps = 1
+	}
+	trigList := triggerList{channelIndex: dsp.channelIndex, framePeriod: dsp.stream.framePeriod,
+		framesPerSample: fps}
 	trigList.frames = make([]FrameIndex, len(records))
+	trigList.times = make([]time.Time, len(records))
 	for i, r := range records {
 		trigList.frames[i] = r.trigFrame
+		trigList.times[i] = r.trigTime
 	}
 	trigList.keyFrame = dsp.stream.DataSegment.firstFramenum
 	trigList.keyTime = dsp.stream.DataSegment.firstTime
 	trigList.sampleRate = dsp.SampleRate
 	trigList.lastFrameThatWillNeverTrigger = dsp.stream.DataSegment.firstFramenum +
-		FrameIndex(len(dsp.stream.rawData)) - FrameIndex(dsp.NSamples-dsp.NPresamples)
-
-	// Step 2b: send the primary list to the group trigger broker; receive the secondary list.
+		FrameIndex((len(dsp.stream.rawData)-(dsp.NSamples-dsp.NPresamples))*fps)
+	dsp.deadTime.observe(trigList.frames, dsp.stream.firstFramenum+FrameIndex(dsp.NPresamples*fps),
+		trigList.lastFrameThatWillNeverTrigger, dsp.NSamples*fps)
+	dsp.checkTriggerStorm(records, dsp.stream.firstFramenum+FrameIndex(dsp.NPresamples*fps),
+		trigList.lastFrameThatWillNeverTrigger)
 	dsp.Broker.PrimaryTrigs <- trigList
+}
+
+// TriggerDataSecondary receives the secondary (group) trigger list from the broker
+// and generates the secondary records. It must follow a call to TriggerDataPrimary.
+// It blocks until the broker has heard from all channels.
+func (dsp *DataStreamProcessor) TriggerDataSecondary() (secondaries []*DataRecord) {
 	secondaryTrigList := <-dsp.Broker.SecondaryTrigs[dsp.channelIndex]
+	if dsp.neverTrigger || dsp.deadDetect.triggersOff() {
+		dsp.pendingSecondaries = nil
+		return
+	}
+	if len(dsp.pendingSecondaries) > 0 {
+		secondaryTrigList = append(dsp.pendingSecondaries, secondaryTrigList...)
+		sort.Sort(groupTriggerSlice(secondaryTrigList))
+		dsp.pendingSecondaries = nil
+	}
 	segment := &dsp.stream.DataSegment
 	for _, st := range secondaryTrigList {
-		secondaries = append(secondaries, dsp.triggerAt(segment, int(st-segment.firstFramenum)))
+		i := dsp.groupTriggerSample(segment, st)
+		if i+dsp.NSamples-dsp.NPresamples > len(segment.rawData) {
+			// A positive group trigger offset can put a record past the end of the data.
+			dsp.pendingSecondaries = append(dsp.pendingSecondaries, st)
+			continue
+		}
+		var record *DataRecord
+		if i >= dsp.NPresamples {
+			record = dsp.triggerAt(segment, i)
+		} else if record = dsp.triggerAtHistory(segment, i); record == nil {
+			logDebugf("channel %d dropped a secondary trigger at frame %d: its samples are gone", dsp.channelIndex, st.frame)
+			continue
+		}
+		record.trigType = TriggerTypeSecondary
+		secondaries = append(secondaries, record)
+	}
+	if dsp.EdgeMulti {
+		// edgeMultiTriggerComputeAppend trims the stream on its own.
+		return
 	}
 
 	// leave one full possible trigger in the stream
 	// trigger algorithms should not inspect the last NSamples samples
-	// fmt.Printf("Trimmed. %7d samples remain (requested %7d)\n", dsp.stream.TrimKeepingN(dsp.NSamples), dsp.NSamples)
+	dsp.saveSecondaryHistory(dsp.NSamples)
 	dsp.stream.TrimKeepingN(dsp.NSamples)
 	return
 }
 
+// groupTriggerSample returns the sample of segment at which to place the secondary record
+// of gt. Frame numbers count samples after decimation, so they agree only between
+// channels that decimate alike. Triggers from a channel that decimates differently are
+// placed by their absolute time instead.
+func (dsp *DataStreamProcessor) groupTriggerSample(segment *DataSegment, gt groupTrigger) int {
+	fps := segment.framesPerSample
+	if fps < 1 {
+		fps = 1
+	}
+	if gt.framesPerSample == 0 || gt.framesPerSample == fps || gt.time.IsZero() || segment.framePeriod <= 0 {
+		return int(gt.frame - segment.firstFramenum)
+	}
+	dt := gt.time.Sub(segment.firstTime) - dsp.rowOffset
+	return int(math.Round(float64(dt) / float64(time.Duration(fps)*segment.framePeriod)))
+}
+
+// saveSecondaryHistory saves the samples that trimming the stream to its last N samples
+// would discard, as far back as a negative group trigger offset can reach, so that
+// secondary records can start before the stream does.
+func (dsp *DataStreamProcessor) saveSecondaryHistory(N int) {
+	need := dsp.Broker.earliestOffset(dsp.channelIndex)
+	if need == 0 {
+		dsp.secondaryHistory = nil
+		return
+	}
+	raw := dsp.stream.rawData
+	if len(raw) <= N {
+		return
+	}
+	history := dsp.secondaryHistory
+	if dsp.secondaryHistoryEnd != dsp.stream.firstFramenum {
+		history = history[:0] // the saved samples don't adjoin the stream
+	}
+	history = append(history, raw[:len(raw)-N]...)
+	if len(history) > need {
+		history = append(history[:0], history[len(history)-need:]...)
+	}
+	dsp.secondaryHistory = history
+	dsp.secondaryHistoryEnd = dsp.stream.firstFramenum +
+		FrameIndex((len(raw)-N)*dsp.stream.framesPerSample)
+}
+
+// triggerAtHistory creates a record at sample i of the segment, when i is too early for
+// the record to fit in the segment, from the saved samples that preceded the segment.
+// It returns nil if those samples weren't saved.
+func (dsp *DataStreamProcessor) triggerAtHistory(segment *DataSegment, i int) *DataRecord {
+	history := dsp.secondaryHistory
+	first := len(history) + i - dsp.NPresamples // index of the first sample in history
+	if first < 0 || dsp.secondaryHistoryEnd != segment.firstFramenum {
+		return nil
+	}
+	data := make([]RawType, 0, dsp.NSamples)
+	if end := first + dsp.NSamples; end <= len(history) {
+		data = append(data, history[first:end]...)
+	} else {
+		data = append(data, history[first:]...)
+		data = append(data, segment.rawData[:end-len(history)]...)
+	}
+	return &DataRecord{data: data, trigFrame: segment.firstFramenum + FrameIndex(i),
+		trigTime: segment.TimeOf(i).Add(dsp.rowOffset), channelIndex: dsp.channelIndex, signed: segment.signed,
+		voltsPerArb: segment.voltsPerArb, presamples: dsp.NPresamples,
+		sampPeriod: float32(1.0 / dsp.SampleRate)}
+}
+
 // RecordSlice attaches the methods of sort.Interface to slices, sorting in increasing order.
 type RecordSlice []*DataRecord
 
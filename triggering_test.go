@@ -2,7 +2,11 @@ package dastard
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -136,6 +140,33 @@ func TestBrokerConnections(t *testing.T) {
 			}
 		}
 	}
+
+	// Invalid couplings are rejected, and leave the coupling as it was.
+	if err := ls.SetCoupling(CouplingStatus(0)); err == nil {
+		t.Error("SetCoupling(0) should fail")
+	}
+	ls.rowColCodes = make([]RowColCode, N)
+	for i := range ls.rowColCodes {
+		ls.rowColCodes[i] = rcCode(i/2, 0, N/2, 1)
+	}
+	if err := ls.SetCoupling(ErrToFB); err != nil {
+		t.Errorf("SetCoupling(ErrToFB) failed with err/FB pairs: %v", err)
+	}
+	ls.rowColCodes[1] = rcCode(1, 0, N/2, 1)
+	if err := ls.SetCoupling(FBToErr); err == nil {
+		t.Error("SetCoupling(FBToErr) should fail when channels 0,1 are not one pixel")
+	}
+	if err := ls.SetCoupling(NoCoupling); err != nil {
+		t.Errorf("SetCoupling(NoCoupling) should always work, got %v", err)
+	}
+	ls.rowColCodes = nil
+	ls.nchan = N - 1
+	if err := ls.SetCoupling(ErrToFB); err == nil {
+		t.Error("SetCoupling(ErrToFB) should fail with an odd number of channels")
+	}
+	if ls.coupling != NoCoupling {
+		t.Errorf("LanceroSource.coupling=%d after failed SetCoupling, want %d", ls.coupling, NoCoupling)
+	}
 }
 
 // TestBrokering checks the group trigger brokering operations.
@@ -157,7 +188,7 @@ func TestBrokering(t *testing.T) {
 		t1 := <-broker.SecondaryTrigs[1]
 		t2 := <-broker.SecondaryTrigs[2]
 		t3 := <-broker.SecondaryTrigs[3]
-		for i, tn := range [][]FrameIndex{t0, t1, t2} {
+		for i, tn := range [][]groupTrigger{t0, t1, t2} {
 			if len(tn) > 0 {
 				t.Errorf("TriggerBroker chan %d received %d secondary triggers, want 0", i, len(tn))
 			}
@@ -167,8 +198,8 @@ func TestBrokering(t *testing.T) {
 			t.Errorf("TriggerBroker chan %d received %d secondary triggers, want %d", 3, len(t3), len(expected))
 		}
 		for i := 0; i < len(expected); i++ {
-			if t3[i] != expected[i] {
-				t.Errorf("TriggerBroker chan %d secondary trig[%d]=%d, want %d", 3, i, t2[i], expected[i])
+			if t3[i].frame != expected[i] {
+				t.Errorf("TriggerBroker chan %d secondary trig[%d]=%d, want %d", 3, i, t3[i].frame, expected[i])
 			}
 		}
 		if iter == 2 {
@@ -177,6 +208,145 @@ func TestBrokering(t *testing.T) {
 	}
 }
 
+// TestGroupTriggerOffsets checks that secondary records are shifted by the offset of
+// their group trigger connection, whether that puts them later than the data received
+// so far or earlier than the stream's first sample.
+func TestGroupTriggerOffsets(t *testing.T) {
+	broker := NewTriggerBroker(2)
+	if err := broker.AddConnectionWithOffset(0, 1, maxGroupTriggerOffset+1); err == nil {
+		t.Error("AddConnectionWithOffset should fail for a too-large offset")
+	}
+	broker.AddConnectionWithOffset(0, 1, -30)
+	if offset := broker.ConnectionOffset(0, 1); offset != -30 {
+		t.Errorf("ConnectionOffset(0,1)=%d, want -30", offset)
+	}
+	if early := broker.earliestOffset(1); early != 30 {
+		t.Errorf("earliestOffset(1)=%d, want 30", early)
+	}
+	broker.AddConnection(0, 1)
+	if offset, early := broker.ConnectionOffset(0, 1), broker.earliestOffset(1); offset != 0 || early != 0 {
+		t.Errorf("AddConnection left offset %d, earliestOffset %d, want 0, 0", offset, early)
+	}
+
+	const NPresamples, NSamples, chunk = 100, 400, 500
+	const step = 2000 // channel 0 triggers here; channel 1 holds the frame number
+	for _, offset := range []int{0, 700, -300, -1000} {
+		broker := NewTriggerBroker(2)
+		go broker.Run()
+		if err := broker.AddConnectionWithOffset(0, 1, offset); err != nil {
+			t.Fatal(err)
+		}
+		dsps := []*DataStreamProcessor{
+			NewDataStreamProcessor(0, broker, NPresamples, NSamples),
+			NewDataStreamProcessor(1, broker, NPresamples, NSamples),
+		}
+		dsps[0].EdgeTrigger, dsps[0].EdgeRising, dsps[0].EdgeLevel = true, true, 100
+		for _, dsp := range dsps {
+			dsp.SampleRate = 1000
+		}
+
+		var primaries, secondaries []*DataRecord
+		for first := 0; first < 5000; first += chunk {
+			for i, dsp := range dsps {
+				data := make([]RawType, chunk)
+				for j := range data {
+					if i == 1 {
+						data[j] = RawType(first + j)
+					} else if first+j >= step {
+						data[j] = 5000
+					}
+				}
+				dsp.stream.AppendSegment(NewDataSegment(data, 1, FrameIndex(first), time.Now(), time.Millisecond))
+			}
+			primaries = append(primaries, dsps[0].TriggerDataPrimary()...)
+			dsps[1].TriggerDataPrimary()
+			dsps[0].TriggerDataSecondary()
+			secondaries = append(secondaries, dsps[1].TriggerDataSecondary()...)
+		}
+		broker.Stop()
+
+		if len(primaries) != 1 || len(secondaries) != 1 {
+			t.Errorf("offset %d: found %d primary and %d secondary triggers, want 1 each",
+				offset, len(primaries), len(secondaries))
+			continue
+		}
+		want := primaries[0].trigFrame + FrameIndex(offset)
+		rec := secondaries[0]
+		if rec.trigFrame != want || rec.trigType != TriggerTypeSecondary {
+			t.Errorf("offset %d: secondary %s trigger at frame %d, want %s at %d",
+				offset, rec.trigType, rec.trigFrame, TriggerTypeSecondary, want)
+		}
+		if len(rec.data) != NSamples || rec.data[0] != RawType(want-NPresamples) ||
+			rec.data[NSamples-1] != RawType(want-NPresamples+NSamples-1) {
+			t.Errorf("offset %d: secondary record has %d samples from %d to %d, want %d from %d",
+				offset, len(rec.data), rec.data[0], rec.data[len(rec.data)-1], NSamples, want-NPresamples)
+		}
+	}
+}
+
+// TestGroupTriggerTimes checks that the broker passes on the time of each primary
+// trigger, and that a receiver that decimates differently from its source places the
+// secondary record by that time.
+func TestGroupTriggerTimes(t *testing.T) {
+	t0 := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tlist := triggerList{frames: []FrameIndex{100, 300}, times: []time.Time{t0, t0.Add(time.Second)},
+		framePeriod: time.Millisecond, framesPerSample: 2}
+	trigs := tlist.appendGroupTriggers(nil, 10)
+	want := []groupTrigger{
+		{frame: 110, time: t0.Add(20 * time.Millisecond), framePeriod: time.Millisecond, framesPerSample: 2},
+		{frame: 310, time: t0.Add(1020 * time.Millisecond), framePeriod: time.Millisecond, framesPerSample: 2},
+	}
+	if !reflect.DeepEqual(trigs, want) {
+		t.Errorf("appendGroupTriggers gives %+v, want %+v", trigs, want)
+	}
+
+	// Channel 0 decimates by 2, channel 1 not at all; each chunk is 1000 frames.
+	const NPresamples, NSamples, chunk = 100, 200, 1000
+	const step = 1300 // channel 0 triggers at this decimated sample, at 2600 ms
+	broker := NewTriggerBroker(2)
+	go broker.Run()
+	defer broker.Stop()
+	broker.AddConnection(0, 1)
+	dsps := []*DataStreamProcessor{
+		NewDataStreamProcessor(0, broker, NPresamples, NSamples),
+		NewDataStreamProcessor(1, broker, NPresamples, NSamples),
+	}
+	dsps[0].EdgeTrigger, dsps[0].EdgeRising, dsps[0].EdgeLevel = true, true, 100
+	dsps[0].SampleRate, dsps[1].SampleRate = 1000, 1000
+
+	var primaries, secondaries []*DataRecord
+	for first := 0; first < 5*chunk; first += chunk {
+		firstTime := t0.Add(time.Duration(first) * time.Millisecond)
+		decimated := make([]RawType, chunk/2)
+		for j := range decimated {
+			if first/2+j >= step {
+				decimated[j] = 5000
+			}
+		}
+		ramp := make([]RawType, chunk)
+		for j := range ramp {
+			ramp[j] = RawType(first + j)
+		}
+		dsps[0].stream.AppendSegment(NewDataSegment(decimated, 2, FrameIndex(first), firstTime, time.Millisecond))
+		dsps[1].stream.AppendSegment(NewDataSegment(ramp, 1, FrameIndex(first), firstTime, time.Millisecond))
+		primaries = append(primaries, dsps[0].TriggerDataPrimary()...)
+		dsps[1].TriggerDataPrimary()
+		dsps[0].TriggerDataSecondary()
+		secondaries = append(secondaries, dsps[1].TriggerDataSecondary()...)
+	}
+	if len(primaries) != 1 || len(secondaries) != 1 {
+		t.Fatalf("found %d primary and %d secondary triggers, want 1 each", len(primaries), len(secondaries))
+	}
+	if tt := primaries[0].trigTime; !tt.Equal(t0.Add(2600 * time.Millisecond)) {
+		t.Errorf("primary trigger at %v, want 2600 ms after %v", tt, t0)
+	}
+	rec := secondaries[0]
+	if !rec.trigTime.Equal(primaries[0].trigTime) || rec.trigFrame != 2600 || rec.data[NPresamples] != 2600 {
+		t.Errorf("secondary trigger at frame %d, time %v, sample %d, want frame 2600 at the primary's time %v",
+			rec.trigFrame, rec.trigTime, rec.data[NPresamples], primaries[0].trigTime)
+	}
+}
+
 // TestLongRecords ensures that we can generate triggers longer than 1 unit of
 // data supply.
 func TestLongRecords(t *testing.T) {
@@ -539,6 +709,31 @@ func TestEdgeMulti(t *testing.T) {
 		}
 	}
 
+	dsp.EdgeMultiMakeShortRecords = false
+	dsp.EdgeMultiMakeTrainRecords = true
+	dsp.edgeMultiSetInitialState() // call this between each edgeMulti test
+	// here the overlapping pulses at 460, 500 and 540 become one variable-length record
+	primaries, _ = testTriggerSubroutine(t, raw, nRepeat, dsp, "EdgeMulti D2: MakeTrainRecords", []FrameIndex{100, 200, 301, 401, 460, 700})
+	expectLengths = []int{100, 100, 100, 100, 139, 100}
+	for i, record := range primaries {
+		if i < len(expectLengths) && len(record.data) != expectLengths[i] {
+			t.Errorf("EdgeMulti D2 record %v: expect len %v, have len %v, presamples %v, trigFrame %v", i, expectLengths[i],
+				len(record.data), record.presamples, record.trigFrame)
+		}
+	}
+	if len(primaries) > 4 {
+		train := primaries[4]
+		first := int(train.trigFrame) - train.presamples
+		for j, v := range train.data {
+			if v != raw[first+j] {
+				t.Errorf("EdgeMulti D2 train record sample %v is %v, want %v", j, v, raw[first+j])
+				break
+			}
+		}
+	}
+	dsp.EdgeMultiMakeTrainRecords = false
+	dsp.EdgeMultiMakeShortRecords = true
+
 	// edgeMulti searches within a given segment from dsp.NPresamples to ndata + dsp.NPresamples - dsp.NSamples
 	// for these values that is from 50 to 950
 	// so we want to test triggering on an event that starts before 950, and continues rising past 950
@@ -649,6 +844,35 @@ func TestEdgeMulti(t *testing.T) {
 	testTriggerSubroutine(t, rawK, nRepeatK, dsp, "EdgeMulti L: negative trigger level", []FrameIndex{100, 200, 301, 401, 460, 500})
 }
 
+func TestEdgeMultiSigned(t *testing.T) {
+	broker := NewTriggerBroker(1)
+	go broker.Run()
+	defer broker.Stop()
+	dsp := NewDataStreamProcessor(0, broker, 50, 100)
+	dsp.stream.signed = true
+	dsp.EdgeMulti = true
+	dsp.EdgeLevel = 1
+	dsp.EdgeMultiVerifyNMonotone = 5
+
+	// Kinks as in TestEdgeMulti, but on a baseline of -25, so each rise crosses zero
+	// (from 65511 to small values, if read as unsigned) after 3 samples.
+	raw := make([]RawType, 1000)
+	for _, k := range []float64{100, 200.1, 300.5, 400.9, 700} {
+		kint := int(math.Ceil(k))
+		for j := kint - 6; j < kint+20; j++ {
+			raw[j] = RawType(math.Ceil(kinkModel(k, float64(j), 0, 0, 10)))
+			if j == kint+19 {
+				raw[j] = RawType(kint)
+			}
+		}
+	}
+	for i := range raw {
+		raw[i] = RawType(int16(raw[i]) - 25)
+	}
+	dsp.edgeMultiSetInitialState()
+	testTriggerSubroutine(t, raw, 1, dsp, "EdgeMulti on signed data", []FrameIndex{100, 200, 301, 401, 700})
+}
+
 // TestEdgeVetosLevel tests that an edge trigger vetoes a level trigger as needed.
 func TestEdgeVetosLevel(t *testing.T) {
 	const nchan = 1
@@ -693,6 +917,399 @@ func TestEdgeVetosLevel(t *testing.T) {
 	}
 }
 
+func TestManualTrigger(t *testing.T) {
+	const nchan = 1
+
+	broker := NewTriggerBroker(nchan)
+	go broker.Run()
+	defer broker.Stop()
+	dsp := NewDataStreamProcessor(0, broker, 20, 100)
+	dsp.SampleRate = 10000.0
+	dsp.manualTriggerPending = true
+
+	raw := make([]RawType, 50)
+	segment := NewDataSegment(raw, 1, 0, time.Now(), time.Millisecond)
+	dsp.stream.AppendSegment(segment)
+	primaries, _ := dsp.TriggerData()
+	if len(primaries) != 0 {
+		t.Errorf("ManualTrigger with too little data saw %d triggers, want 0", len(primaries))
+	}
+	if !dsp.manualTriggerPending {
+		t.Error("ManualTrigger with too little data should remain pending")
+	}
+
+	raw = make([]RawType, 100)
+	segment = NewDataSegment(raw, 1, 50, time.Now(), time.Millisecond)
+	dsp.stream.AppendSegment(segment)
+	primaries, _ = dsp.TriggerData()
+	if len(primaries) != 1 {
+		t.Fatalf("ManualTrigger saw %d triggers, want 1", len(primaries))
+	}
+	if primaries[0].trigFrame != 70 {
+		t.Errorf("ManualTrigger at frame %d, want 70", primaries[0].trigFrame)
+	}
+	if len(primaries[0].data) != dsp.NSamples {
+		t.Errorf("ManualTrigger record has %d samples, want %d", len(primaries[0].data), dsp.NSamples)
+	}
+	if primaries[0].trigType != TriggerTypeManual {
+		t.Errorf("ManualTrigger record has trigType %q, want %q", primaries[0].trigType, TriggerTypeManual)
+	}
+	if dsp.manualTriggerPending {
+		t.Error("ManualTrigger should not remain pending after it triggers")
+	}
+	primaries, _ = dsp.TriggerData()
+	if len(primaries) != 0 {
+		t.Errorf("ManualTrigger repeated: saw %d triggers, want 0", len(primaries))
+	}
+}
+
+// TestStateTrigger checks that an experiment state transition makes records at the same
+// frame in each channel with the StateTrigger option, and only in those channels.
+func TestStateTrigger(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_state_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := AnySource{nchan: 3}
+	if err := ds.PrepareRun(20, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+	ds.processors[0].ConfigureTrigger(TriggerState{StateTrigger: true})
+	ds.processors[2].ConfigureTrigger(TriggerState{StateTrigger: true})
+	ds.writingState.ExperimentStateFilename = filepath.Join(tmp, "experiment_state.txt")
+	defer func() {
+		if ds.writingState.experimentStateFile != nil {
+			ds.writingState.experimentStateFile.Close()
+		}
+	}()
+
+	process := func(first FrameIndex, n int) [][]*DataRecord {
+		records := make([][]*DataRecord, ds.nchan)
+		for _, dsp := range ds.processors {
+			dsp.stream.AppendSegment(NewDataSegment(make([]RawType, n), 1, first, time.Now(), time.Millisecond))
+		}
+		for i, dsp := range ds.processors {
+			records[i] = dsp.TriggerDataPrimary()
+		}
+		for _, dsp := range ds.processors {
+			dsp.TriggerDataSecondary()
+		}
+		return records
+	}
+	process(0, 200)
+	ds.frameSync.nextFrame = 200
+	if err := ds.SetExperimentStateLabel(time.Now(), "CALIBRATION"); err != nil {
+		t.Fatal(err)
+	}
+	// The first segment after the transition is too short to hold the records.
+	for i, recs := range process(200, 50) {
+		if len(recs) != 0 {
+			t.Errorf("channel %d made %d records before the state trigger fit in the stream, want 0", i, len(recs))
+		}
+	}
+	for i, recs := range process(250, 200) {
+		want := 1
+		if i == 1 {
+			want = 0
+		}
+		if len(recs) != want {
+			t.Fatalf("channel %d made %d records at the state transition, want %d", i, len(recs), want)
+		}
+		if want > 0 && (recs[0].trigFrame != 200 || recs[0].trigType != TriggerTypeState) {
+			t.Errorf("channel %d state trigger record at frame %d of type %q, want 200 and %q",
+				i, recs[0].trigFrame, recs[0].trigType, TriggerTypeState)
+		}
+	}
+
+	ds.frameSync.nextFrame = 450
+	if err := ds.SetExperimentStateLabel(time.Now(), "STOP"); err != nil {
+		t.Fatal(err)
+	}
+	for i, recs := range process(450, 200) {
+		if len(recs) != 0 {
+			t.Errorf("channel %d made %d records at STOP, want 0", i, len(recs))
+		}
+	}
+}
+
+// TestChangeTriggerStates checks that bulk trigger changes are all applied, or none
+// are if any channel's new state is invalid.
+func TestChangeTriggerStates(t *testing.T) {
+	ds := AnySource{nchan: 4}
+	if err := ds.PrepareRun(20, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.broker.Stop()
+
+	// Compare only the configured, not the internal, parts of trigger states.
+	configured := func(ts TriggerState) TriggerState {
+		ts.edgeMultiInternalSearchState = 0
+		ts.edgeMultiIPotential = 0
+		ts.edgeMultiILastInspected = 0
+		return ts
+	}
+	edge := TriggerState{EdgeTrigger: true, EdgeRising: true, EdgeLevel: 100}
+	auto := TriggerState{AutoTrigger: true, AutoDelay: time.Second}
+	unchanged := configured(ds.processors[2].TriggerState)
+	states := []FullTriggerState{
+		{ChannelIndicies: []int{0, 1}, TriggerState: edge},
+		{ChannelIndicies: []int{3}, TriggerState: auto},
+	}
+	problems, err := ds.ChangeTriggerStates(states)
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("ChangeTriggerStates(valid states) returns %v, %v", problems, err)
+	}
+	for i, want := range []TriggerState{edge, edge, unchanged, auto} {
+		if got := configured(ds.processors[i].TriggerState); !reflect.DeepEqual(got, want) {
+			t.Errorf("channel %d has trigger state %+v, want %+v", i, got, want)
+		}
+	}
+
+	badMulti := TriggerState{EdgeMulti: true, EdgeMultiVerifyNMonotone: 79}
+	states = []FullTriggerState{
+		{ChannelIndicies: []int{0, 1}, TriggerState: TriggerState{LevelTrigger: true, LevelLevel: 50}},
+		{ChannelIndicies: []int{1, 2}, TriggerState: badMulti},
+		{ChannelIndicies: []int{3, 4}, TriggerState: TriggerState{AutoTrigger: true}},
+	}
+	problems, err = ds.ChangeTriggerStates(states)
+	if err == nil {
+		t.Error("ChangeTriggerStates(invalid states) should fail")
+	}
+	for _, channelIndex := range []int{1, 2, 3, 4} {
+		if _, ok := problems[channelIndex]; !ok {
+			t.Errorf("ChangeTriggerStates problems %v lack channel %d", problems, channelIndex)
+		}
+	}
+	if _, ok := problems[0]; ok || len(problems) != 4 {
+		t.Errorf("ChangeTriggerStates problems %v, want channels 1-4", problems)
+	}
+	if got := configured(ds.processors[0].TriggerState); !reflect.DeepEqual(got, edge) {
+		t.Errorf("channel 0 trigger state changed to %+v although the bulk change failed", got)
+	}
+	for _, bad := range [][]FullTriggerState{{}, {{ChannelIndicies: []int{}}}} {
+		if _, err := ds.ChangeTriggerStates(bad); err == nil {
+			t.Errorf("ChangeTriggerStates(%v) should fail", bad)
+		}
+	}
+}
+
+// TestTriggerOnError checks that a channel can look for triggers in a second signal
+// (as Lancero feedback channels do in their error signal) but record its own data.
+func TestTriggerOnError(t *testing.T) {
+	const nchan = 1
+	broker := NewTriggerBroker(nchan)
+	go broker.Run()
+	defer broker.Stop()
+
+	const ndata, stepAt = 1000, 300
+	makeSegment := func() *DataSegment {
+		raw := make([]RawType, ndata)
+		errData := make([]RawType, ndata)
+		for i := range raw {
+			raw[i] = 5000
+			v := int16(-50)
+			if i >= stepAt {
+				v = 1000
+			}
+			errData[i] = RawType(v)
+		}
+		segment := NewDataSegment(raw, 1, 0, time.Now(), time.Millisecond)
+		segment.triggerData = errData
+		segment.triggerSigned = true
+		return segment
+	}
+
+	for _, onError := range []bool{false, true} {
+		dsp := NewDataStreamProcessor(0, broker, 20, 100)
+		dsp.SampleRate = 1000.0
+		dsp.LevelTrigger = true
+		dsp.LevelRising = true
+		dsp.LevelLevel = 500
+		dsp.TriggerOnError = onError
+		primaries := dsp.processSegmentPrimary(makeSegment())
+		dsp.TriggerDataSecondary()
+		if len(dsp.stream.triggerData) > 0 && len(dsp.stream.triggerData) != len(dsp.stream.rawData) {
+			t.Errorf("TriggerOnError=%v: stream has %d trigger samples and %d raw samples", onError,
+				len(dsp.stream.triggerData), len(dsp.stream.rawData))
+		}
+		if !onError {
+			if len(primaries) != 0 {
+				t.Errorf("TriggerOnError=false: saw %d triggers, want 0", len(primaries))
+			}
+			continue
+		}
+		if len(primaries) != 1 {
+			t.Fatalf("TriggerOnError=true: saw %d triggers, want 1", len(primaries))
+		}
+		if primaries[0].trigFrame != stepAt {
+			t.Errorf("TriggerOnError=true: trigger at frame %d, want %d", primaries[0].trigFrame, stepAt)
+		}
+		for _, v := range primaries[0].data {
+			if v != 5000 {
+				t.Errorf("TriggerOnError=true: record holds %d, want the recorded signal 5000", v)
+				break
+			}
+		}
+	}
+}
+
+// TestDerivTrigger checks that derivative triggers find slow-rising (or falling) pulses
+// where the slope of the last DerivLength samples first reaches the level.
+func TestDerivTrigger(t *testing.T) {
+	const nchan = 1
+	broker := NewTriggerBroker(nchan)
+	go broker.Run()
+	defer broker.Stop()
+
+	const ndata, ramp, hold = 3000, 50, 300
+	pulseStarts := []int{300, 1200, 2100}
+	makeSegment := func(baseline int16, signed bool) *DataSegment {
+		raw := make([]RawType, ndata)
+		for i := range raw {
+			v := baseline
+			for _, p := range pulseStarts {
+				if i >= p && i < p+ramp {
+					v = baseline + int16(3*(i-p)) + int16(i%2) // a slow rise, with a little noise
+				} else if i >= p+ramp && i < p+hold {
+					v = baseline + 3*ramp
+				}
+			}
+			raw[i] = RawType(v)
+		}
+		segment := NewDataSegment(raw, 1, 0, time.Now(), time.Millisecond)
+		segment.signed = signed
+		return segment
+	}
+	// slope computes the least-squares slope of the L samples ending at i, directly.
+	slope := func(raw []RawType, signed bool, i, L int) float64 {
+		var sxy, sxx float64
+		c := float64(L-1) / 2
+		for j := 0; j < L; j++ {
+			x := float64(raw[i-L+1+j])
+			if signed {
+				x = float64(int16(raw[i-L+1+j]))
+			}
+			sxy += (float64(j) - c) * x
+			sxx += (float64(j) - c) * (float64(j) - c)
+		}
+		return sxy / sxx
+	}
+
+	for _, signed := range []bool{false, true} {
+		for _, rising := range []bool{true, false} {
+			baseline := int16(1000)
+			if signed {
+				baseline = -100
+			}
+			segment := makeSegment(baseline, signed)
+			raw := append([]RawType{}, segment.rawData...)
+			dsp := NewDataStreamProcessor(0, broker, 20, 100)
+			dsp.SampleRate = 1000.0
+			dsp.stream.signed = signed
+			state := TriggerState{DerivTrigger: true, DerivRising: rising, DerivFalling: !rising,
+				DerivLevel: 2, DerivLength: 8}
+			if err := dsp.validateTriggerState(&state); err != nil {
+				t.Fatal(err)
+			}
+			dsp.TriggerState = state
+			primaries := dsp.processSegmentPrimary(segment)
+			dsp.TriggerDataSecondary()
+			if len(primaries) != len(pulseStarts) {
+				t.Fatalf("DerivTrigger signed=%v rising=%v: saw %d triggers, want %d", signed, rising,
+					len(primaries), len(pulseStarts))
+			}
+			for k, p := range pulseStarts {
+				want := p + hold // falling edge
+				if rising {
+					want = p
+				}
+				for i := want; i < ndata; i++ {
+					s := slope(raw, signed, i, state.DerivLength)
+					if (rising && s >= state.DerivLevel) || (!rising && s <= -state.DerivLevel) {
+						want = i
+						break
+					}
+				}
+				rec := primaries[k]
+				if int(rec.trigFrame) != want || rec.trigType != TriggerTypeDeriv {
+					t.Errorf("DerivTrigger signed=%v rising=%v: trigger %d at frame %d (%s), want %d (%s)", signed,
+						rising, k, rec.trigFrame, rec.trigType, want, TriggerTypeDeriv)
+				}
+			}
+		}
+	}
+
+	dsp := NewDataStreamProcessor(0, broker, 20, 100)
+	for _, bad := range []TriggerState{
+		{DerivTrigger: true, DerivRising: true, DerivLevel: 2, DerivLength: 1},
+		{DerivTrigger: true, DerivRising: true, DerivLevel: 2, DerivLength: 21},
+		{DerivTrigger: true, DerivRising: true, DerivLevel: 0, DerivLength: 8},
+		{DerivTrigger: true, DerivRising: true, DerivLevel: 2, DerivLength: 8, EdgeTrigger: true},
+	} {
+		if err := dsp.validateTriggerState(&bad); err == nil {
+			t.Errorf("validateTriggerState(%+v) should fail", bad)
+		}
+	}
+}
+
+func TestAutoIdleFill(t *testing.T) {
+	const nchan = 1
+	broker := NewTriggerBroker(nchan)
+	go broker.Run()
+	defer broker.Stop()
+
+	const ndata, pulseAt, delay = 10000, 5000, 1000
+	autoTriggers := func(idleFill bool) (autos []FrameIndex, dsp *DataStreamProcessor) {
+		dsp = NewDataStreamProcessor(0, broker, 20, 100)
+		dsp.SampleRate = 1000.0
+		dsp.AutoTrigger = true
+		dsp.AutoDelay = delay * time.Millisecond
+		dsp.AutoIdleFill = idleFill
+		dsp.EdgeTrigger = true
+		dsp.EdgeRising = true
+		dsp.EdgeLevel = 100
+		raw := make([]RawType, ndata)
+		for i := pulseAt; i < ndata; i++ {
+			raw[i] = 1000
+		}
+		segment := NewDataSegment(raw, 1, 0, time.Now(), time.Millisecond)
+		dsp.stream.AppendSegment(segment)
+		primaries, _ := dsp.TriggerData()
+		for _, rec := range primaries {
+			if rec.trigType == TriggerTypeAuto {
+				autos = append(autos, rec.trigFrame)
+			}
+		}
+		return
+	}
+
+	normal, _ := autoTriggers(false)
+	idle, dsp := autoTriggers(true)
+	if len(idle) == 0 || len(idle) >= len(normal) {
+		t.Errorf("AutoIdleFill made %d auto triggers, want fewer than the normal %d but not 0", len(idle), len(normal))
+	}
+	for _, f := range idle {
+		if f > pulseAt-delay && f < pulseAt+delay {
+			t.Errorf("AutoIdleFill made an auto trigger at %d, within %d of the pulse at %d", f, delay, pulseAt)
+		}
+	}
+	if dsp.idleFillRate <= 0 {
+		t.Errorf("AutoIdleFill rate of other triggers is %v, want > 0", dsp.idleFillRate)
+	}
+
+	// At a high rate of other triggers, the delay should grow.
+	dsp = NewDataStreamProcessor(0, broker, 20, 100)
+	dsp.SampleRate = 1000.0
+	dsp.AutoDelay = delay * time.Millisecond
+	dsp.stream.samplesSeen = ndata
+	if d := dsp.idleFillDelay(delay, 100); d < 5*delay {
+		t.Errorf("idleFillDelay with 10 triggers per second = %d, want > %d", d, 5*delay)
+	}
+}
+
 func BenchmarkAutoTriggerOpsAre100SampleTriggers(b *testing.B) {
 	const nchan = 1
 	broker := NewTriggerBroker(nchan)
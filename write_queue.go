@@ -0,0 +1,179 @@
+package dastard
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Allowed values of the WriteQueuePolicy config option, which says what to do when a
+// channel's write queue is full.
+const (
+	WriteQueueBlock      = "BLOCK"      // wait for room, stalling the channel's processing
+	WriteQueueDropOldest = "DROPOLDEST" // discard the oldest queued records to make room
+	WriteQueueStop       = "STOP"       // stop writing the channel's files, and warn the clients
+)
+
+// validateWriteQueuePolicy returns the normalized policy, or an error if it's not allowed.
+func validateWriteQueuePolicy(policy string) (string, error) {
+	policy = strings.ToUpper(policy)
+	switch policy {
+	case "":
+		return WriteQueueBlock, nil
+	case WriteQueueBlock, WriteQueueDropOldest, WriteQueueStop:
+		return policy, nil
+	}
+	return "", fmt.Errorf("WriteQueuePolicy=%q, need one of (%s, %s, %s)", policy,
+		WriteQueueBlock, WriteQueueDropOldest, WriteQueueStop)
+}
+
+// writeRequest is one item in a writeQueue: records to write, or a request to flush
+// (and maybe also to fsync).
+type writeRequest struct {
+	records []*DataRecord
+	flush   bool
+	fsync   bool
+}
+
+// writeQueue is a bounded queue of records between a DataPublisher and its file
+// writers. One goroutine serves the queue, so a slow disk delays only the writing,
+// not the processing of the channel. The queue's mutex guards the writers and the
+// publisher's write counts while the goroutine runs.
+type writeQueue struct {
+	requests     chan writeRequest
+	policy       string
+	channelIndex int
+	pending      sync.WaitGroup // requests sent but not yet handled
+	done         chan struct{}  // closed when the goroutine returns
+	dropped      int64          // records discarded because the queue was full
+	stopped      bool           // the queue overflowed with policy STOP
+	sync.Mutex
+}
+
+// push adds records to the queue, following the queue's policy if it's full.
+// Only the processing goroutine may call push.
+func (q *writeQueue) push(records []*DataRecord) {
+	if q.stopped {
+		q.dropped += int64(len(records))
+		return
+	}
+	request := writeRequest{records: records}
+	q.pending.Add(1)
+	if q.policy == WriteQueueBlock {
+		q.requests <- request
+		return
+	}
+	for {
+		select {
+		case q.requests <- request:
+			return
+		default:
+		}
+		if q.policy == WriteQueueStop {
+			q.pending.Done()
+			q.stopped = true
+			q.dropped += int64(len(records))
+			logFieldsf(LogWarning, LogFields{"channelIndex": q.channelIndex},
+				"write queue is full, so writing of channel %d has stopped until the next WriteControl START",
+				q.channelIndex)
+			return
+		}
+		select {
+		case old := <-q.requests:
+			q.dropped += int64(len(old.records))
+			q.pending.Done()
+		default:
+		}
+	}
+}
+
+// requestFlush asks the goroutine to flush the writers, and to commit their files to
+// stable storage if fsync is true, unless the queue is full.
+func (q *writeQueue) requestFlush(fsync bool) {
+	q.pending.Add(1)
+	select {
+	case q.requests <- writeRequest{flush: true, fsync: fsync}:
+	default:
+		q.pending.Done()
+	}
+}
+
+// startWriteQueue makes a goroutine write dp's files, fed by a queue of up to length
+// batches of records. The policy says what to do when the queue is full. With
+// length 0, PublishData writes the files itself.
+func (dp *DataPublisher) startWriteQueue(channelIndex, length int, policy string) error {
+	dp.stopWriteQueue()
+	if length <= 0 {
+		return nil
+	}
+	policy, err := validateWriteQueuePolicy(policy)
+	if err != nil {
+		return err
+	}
+	q := &writeQueue{requests: make(chan writeRequest, length), policy: policy,
+		channelIndex: channelIndex, done: make(chan struct{})}
+	dp.queue = q
+	go dp.serveWriteQueue(q)
+	return nil
+}
+
+// serveWriteQueue writes the records in q until q is closed.
+func (dp *DataPublisher) serveWriteQueue(q *writeQueue) {
+	defer close(q.done)
+	for request := range q.requests {
+		q.Lock()
+		if request.fsync {
+			dp.syncFiles()
+		} else if request.flush {
+			dp.flushWriters()
+		} else {
+			dp.writeRecords(request.records)
+		}
+		q.Unlock()
+		q.pending.Done()
+	}
+}
+
+// syncWrites waits until all queued records are written.
+func (dp *DataPublisher) syncWrites() {
+	if dp.queue != nil {
+		dp.queue.pending.Wait()
+	}
+}
+
+// stopWriteQueue writes all queued records, then stops the queue's goroutine.
+// Afterwards, PublishData writes the files itself.
+func (dp *DataPublisher) stopWriteQueue() {
+	if dp.queue == nil {
+		return
+	}
+	close(dp.queue.requests)
+	<-dp.queue.done
+	dp.queue = nil
+}
+
+// lockWriters excludes the write queue's goroutine (if any) from the file writers and
+// write counts. Call the returned function to unlock.
+func (dp *DataPublisher) lockWriters() func() {
+	q := dp.queue
+	if q == nil {
+		return func() {}
+	}
+	q.Lock()
+	return q.Unlock
+}
+
+// countWritten returns the number of records written since writing started.
+func (dp *DataPublisher) countWritten() int {
+	unlock := dp.lockWriters()
+	defer unlock()
+	return dp.numberWritten
+}
+
+// writingFailure returns the error of the failed write that stopped writing of the
+// files, if any.
+func (dp *DataPublisher) writingFailure() error {
+	unlock := dp.lockWriters()
+	defer unlock()
+	return dp.writeFailure
+}
@@ -0,0 +1,171 @@
+package dastard
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_queue_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := []RawType{10, 10, 10, 10, 15, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10}
+	rec := &DataRecord{data: d, presamples: 4, modelCoefs: make([]float64, 3)}
+	records := []*DataRecord{rec, rec, rec}
+
+	dp := DataPublisher{}
+	dp.SetLJH22(1, 4, len(d), 1, 1, time.Now(), 8, 1, 16, 3, 0,
+		filepath.Join(tmp, "queued.ljh"), "testSource", "chanX", 1)
+	dp.SetBufferSize(1 << 20)
+	if err := dp.startWriteQueue(1, 4, "bad policy"); err == nil {
+		t.Error("startWriteQueue with an invalid policy should fail")
+	}
+	if err := dp.startWriteQueue(1, 4, "block"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := dp.PublishData(records); err != nil {
+			t.Error(err)
+		}
+	}
+	dp.syncWrites()
+	// Nothing reaches the file until the big buffer is flushed.
+	if stat, err := os.Stat(filepath.Join(tmp, "queued.ljh")); err != nil || stat.Size() != 0 {
+		t.Errorf("file with a 1 MB buffer has %v bytes (err %v) before a flush, want 0", stat.Size(), err)
+	}
+	dp.SyncFiles()
+	dp.syncWrites()
+	if stat, err := os.Stat(filepath.Join(tmp, "queued.ljh")); err != nil || stat.Size() < int64(30*(16+2*len(d))) {
+		t.Errorf("file has %v bytes (err %v) after SyncFiles, want all 30 records", stat.Size(), err)
+	}
+	if n := dp.countWritten(); n != 30 {
+		t.Errorf("queued writer wrote %d records, want 30", n)
+	}
+	stats := dp.WritingStats(1)
+	if stats.RecordsWritten != 30 || stats.QueueDepth != 0 || stats.QueueDropped != 0 || stats.WritingStopped {
+		t.Errorf("WritingStats()=%+v, want 30 records and an empty queue", stats)
+	}
+	if want := int64(30 * (16 + 2*len(d))); stats.BytesWritten != want {
+		t.Errorf("WritingStats().BytesWritten=%d, want %d", stats.BytesWritten, want)
+	}
+	dp.RemoveLJH22()
+	if dp.queue != nil {
+		t.Error("RemoveLJH22 should stop the write queue")
+	}
+
+	// A queue with no goroutine behaves like one stuck on a slow disk.
+	stuck := func(policy string) *writeQueue {
+		return &writeQueue{requests: make(chan writeRequest, 2), policy: policy, done: make(chan struct{})}
+	}
+	q := stuck(WriteQueueDropOldest)
+	for i := 0; i < 5; i++ {
+		q.push(records)
+	}
+	if q.dropped != 9 || len(q.requests) != 2 || q.stopped {
+		t.Errorf("DROPOLDEST queue has dropped=%d, depth=%d, stopped=%v, want 9, 2, false",
+			q.dropped, len(q.requests), q.stopped)
+	}
+	q.requestFlush(false)
+	if len(q.requests) != 2 {
+		t.Errorf("requestFlush on a full queue should not wait or add to it")
+	}
+
+	q = stuck(WriteQueueStop)
+	for i := 0; i < 5; i++ {
+		q.push(records)
+	}
+	if q.dropped != 9 || len(q.requests) != 2 || !q.stopped {
+		t.Errorf("STOP queue has dropped=%d, depth=%d, stopped=%v, want 9, 2, true",
+			q.dropped, len(q.requests), q.stopped)
+	}
+	// Once stopped, the queue drops everything, even when there's room.
+	<-q.requests
+	q.push(records)
+	if q.dropped != 12 || len(q.requests) != 1 {
+		t.Errorf("stopped queue has dropped=%d, depth=%d, want 12, 1", q.dropped, len(q.requests))
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_failure_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := []RawType{10, 10, 10, 10, 15, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10}
+	rec := &DataRecord{data: d, presamples: 4, modelCoefs: make([]float64, 3)}
+	records := []*DataRecord{rec, rec, rec}
+
+	// A file that can't be created stops writing, but not publishing, of its channel.
+	for _, queueLength := range []int{0, 4} {
+		var bad, good DataPublisher
+		bad.SetLJH22(1, 4, len(d), 1, 1, time.Now(), 8, 1, 16, 3, 0,
+			filepath.Join(tmp, "missing", "bad.ljh"), "testSource", "chanX", 1)
+		good.SetLJH22(2, 4, len(d), 1, 1, time.Now(), 8, 1, 16, 3, 0,
+			filepath.Join(tmp, "good.ljh"), "testSource", "chanY", 2)
+		for _, dp := range []*DataPublisher{&bad, &good} {
+			if err := dp.startWriteQueue(1, queueLength, "block"); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				if err := dp.PublishData(records); err != nil {
+					t.Errorf("PublishData returned %v, want nil even after a write error", err)
+				}
+			}
+			dp.syncWrites()
+		}
+		stats := bad.WritingStats(1)
+		if stats.WriteErrors != 1 || stats.RecordsWritten != 0 || !strings.Contains(stats.WriteFailure, "bad.ljh") {
+			t.Errorf("failed channel has WritingStats %+v, want 1 error, 0 records, and a WriteFailure", stats)
+		}
+		stats = good.WritingStats(2)
+		if stats.WriteErrors != 0 || stats.RecordsWritten != 15 || stats.WriteFailure != "" {
+			t.Errorf("other channel has WritingStats %+v, want 0 errors and 15 records", stats)
+		}
+		good.RemoveLJH22()
+
+		// Writing can restart after a failure.
+		bad.RemoveLJH22()
+		bad.SetLJH22(1, 4, len(d), 1, 1, time.Now(), 8, 1, 16, 3, 0,
+			filepath.Join(tmp, "retry.ljh"), "testSource", "chanX", 1)
+		if err := bad.PublishData(records); err != nil {
+			t.Error(err)
+		}
+		if stats := bad.WritingStats(1); stats.WriteErrors != 0 || stats.RecordsWritten != 3 || stats.WriteFailure != "" {
+			t.Errorf("restarted channel has WritingStats %+v, want 0 errors and 3 records", stats)
+		}
+		bad.RemoveLJH22()
+	}
+}
+
+func TestReportWriteFailures(t *testing.T) {
+	ds := AnySource{nchan: 3}
+	for i := 0; i < ds.nchan; i++ {
+		ds.processors = append(ds.processors, NewDataStreamProcessor(i, nil, 4, 16))
+	}
+	ds.writingState.Active = true
+	ds.reportWriteFailures()
+	if ds.writingState.FailedChannels != nil {
+		t.Errorf("WritingState.FailedChannels = %v with no failures", ds.writingState.FailedChannels)
+	}
+
+	// Each failed channel is added to the writing state once.
+	ds.processors[2].DataPublisher.writeFailure = errors.New("disk full")
+	ds.reportWriteFailures()
+	ds.reportWriteFailures()
+	ws := ds.ComputeWritingState()
+	if len(ws.FailedChannels) != 1 || ws.FailedChannels[0] != 2 || len(ws.WriteFailures) != 1 ||
+		ws.WriteFailures[0] != "disk full" {
+		t.Errorf("WritingState has FailedChannels %v and WriteFailures %v, want [2] and [disk full]",
+			ws.FailedChannels, ws.WriteFailures)
+	}
+}
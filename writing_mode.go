@@ -0,0 +1,138 @@
+package dastard
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WritingMode is the state of data writing, changed only by the requests of
+// WriteControl along the transitions in writingTransitions.
+type WritingMode string
+
+// The writing modes
+const (
+	WritingIdle   WritingMode = "IDLE"   // no run is being written
+	WritingActive WritingMode = "ACTIVE" // a run's files are open and records are written
+	WritingPaused WritingMode = "PAUSED" // a run's files are open, but records are not written
+	WritingError  WritingMode = "ERROR"  // a STOP failed part way; only another STOP is allowed
+)
+
+// The WriteControl requests
+const (
+	writeStart   = "START"
+	writeStop    = "STOP"
+	writePause   = "PAUSE"
+	writeUnpause = "UNPAUSE"
+)
+
+// writingTransitions gives the mode after each request allowed in each mode. PAUSE and
+// UNPAUSE are allowed when they change nothing (as clients have long sent them while
+// idle), and STOP always is, so that a client can always return to WritingIdle.
+var writingTransitions = map[WritingMode]map[string]WritingMode{
+	WritingIdle:   {writeStart: WritingActive, writeStop: WritingIdle, writePause: WritingIdle, writeUnpause: WritingIdle},
+	WritingActive: {writePause: WritingPaused, writeUnpause: WritingActive, writeStop: WritingIdle},
+	WritingPaused: {writePause: WritingPaused, writeUnpause: WritingActive, writeStop: WritingIdle},
+	WritingError:  {writeStop: WritingIdle},
+}
+
+// WriteRequestError is returned by WriteControl for a request it cannot parse.
+type WriteRequestError struct {
+	Request string
+}
+
+func (e *WriteRequestError) Error() string {
+	return fmt.Sprintf("WriteControl config.Request=%q, need one of (START,STOP,PAUSE,UNPAUSE). Not case sensitive. \"UNPAUSE label\" is also ok",
+		e.Request)
+}
+
+// WriteTransitionError is returned by WriteControl for a request not allowed in the
+// current writing mode.
+type WriteTransitionError struct {
+	Request string
+	Mode    WritingMode
+}
+
+func (e *WriteTransitionError) Error() string {
+	return fmt.Sprintf("WriteControl request %s is not allowed while writing is %s", e.Request, e.Mode)
+}
+
+// writeControlRequest is a parsed WriteControlConfig.Request.
+type writeControlRequest struct {
+	command string // one of writeStart, writeStop, writePause, writeUnpause
+	label   string // experiment state label of "UNPAUSE label", or ""
+}
+
+// parseWriteControlRequest parses a request: START, STOP, PAUSE, UNPAUSE, in any case, or
+// "UNPAUSE label". Anything else, such as "STOPGAP" or "START now", is an error.
+func parseWriteControlRequest(request string) (writeControlRequest, error) {
+	command, label, hasLabel := request, "", false
+	if i := strings.IndexByte(request, ' '); i >= 0 {
+		command, label, hasLabel = request[:i], request[i+1:], true
+	}
+	req := writeControlRequest{command: strings.ToUpper(command), label: label}
+	switch req.command {
+	case writeStart, writeStop, writePause:
+		if !hasLabel {
+			return req, nil
+		}
+	case writeUnpause:
+		if !hasLabel || label != "" {
+			return req, nil
+		}
+	}
+	return writeControlRequest{}, &WriteRequestError{Request: request}
+}
+
+// mode returns the writing mode (the zero WritingState is idle).
+func (ws *WritingState) mode() WritingMode {
+	if ws.Mode == "" {
+		return WritingIdle
+	}
+	return ws.Mode
+}
+
+// nextWritingMode returns the mode after req, or an error if req is not allowed.
+func (ws *WritingState) nextWritingMode(req writeControlRequest) (WritingMode, error) {
+	from := ws.mode()
+	to, ok := writingTransitions[from][req.command]
+	if !ok {
+		return from, &WriteTransitionError{Request: req.command, Mode: from}
+	}
+	return to, nil
+}
+
+// WritingTransition reports a change of writing mode. It is sent to clients as a
+// "WRITINGTRANSITION" message.
+type WritingTransition struct {
+	From    WritingMode
+	To      WritingMode
+	Request string
+	Time    time.Time
+	Error   string // why the request failed, e.g. leaving writing in WritingError
+}
+
+// setWritingMode puts writing in mode to after request, with err the reason if the
+// request failed (as when to is WritingError). Clients are alerted if the mode changed
+// or the request failed.
+func (ds *AnySource) setWritingMode(to WritingMode, request string, err error) {
+	ws := &ds.writingState
+	from := ws.mode()
+	ws.Mode = to
+	ws.Active = to == WritingActive || to == WritingPaused
+	ws.Paused = to == WritingPaused
+	ws.ModeError = ""
+	var errText string
+	if err != nil {
+		errText = err.Error()
+		logErrorf("Writing is in the %s state after request %s: %v", to, request, err)
+	}
+	if to == WritingError {
+		ws.ModeError = errText
+	}
+	if from == to && err == nil {
+		return
+	}
+	clientMessageChan <- ClientUpdate{"WRITINGTRANSITION", WritingTransition{From: from, To: to,
+		Request: request, Time: time.Now(), Error: errText}}
+}
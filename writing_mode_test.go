@@ -0,0 +1,95 @@
+package dastard
+
+import (
+	"testing"
+)
+
+func TestParseWriteControlRequest(t *testing.T) {
+	for _, good := range []struct {
+		request, command, label string
+	}{
+		{"START", writeStart, ""},
+		{"stop", writeStop, ""},
+		{"Pause", writePause, ""},
+		{"UnPause", writeUnpause, ""},
+		{"UNPAUSE AQ7", writeUnpause, "AQ7"},
+		{"unpause two words", writeUnpause, "two words"},
+	} {
+		req, err := parseWriteControlRequest(good.request)
+		if err != nil || req.command != good.command || req.label != good.label {
+			t.Errorf("parseWriteControlRequest(%q) returns %+v, %v, want %s with label %q", good.request,
+				req, err, good.command, good.label)
+		}
+	}
+	for _, bad := range []string{"", "STOPGAP", "STARTING", "START now", "PAUSE label", "UNPAUSE ",
+		"UNPAUSEZZZZ", " STOP", "RESTART"} {
+		if _, err := parseWriteControlRequest(bad); err == nil {
+			t.Errorf("parseWriteControlRequest(%q) should fail", bad)
+		} else if _, ok := err.(*WriteRequestError); !ok {
+			t.Errorf("parseWriteControlRequest(%q) returns %T, want *WriteRequestError", bad, err)
+		}
+	}
+}
+
+func TestWritingTransitions(t *testing.T) {
+	var ds AnySource
+	if m := ds.writingState.mode(); m != WritingIdle {
+		t.Errorf("zero WritingState has mode %s, want %s", m, WritingIdle)
+	}
+	steps := []struct {
+		command string
+		from    WritingMode
+		to      WritingMode // "" means not allowed
+	}{
+		{writePause, WritingIdle, WritingIdle},
+		{writeUnpause, WritingIdle, WritingIdle},
+		{writeStop, WritingIdle, WritingIdle},
+		{writeStart, WritingIdle, WritingActive},
+		{writeStart, WritingActive, ""},
+		{writeUnpause, WritingActive, WritingActive},
+		{writePause, WritingActive, WritingPaused},
+		{writePause, WritingPaused, WritingPaused},
+		{writeStart, WritingPaused, ""},
+		{writeUnpause, WritingPaused, WritingActive},
+		{writePause, WritingActive, WritingPaused},
+		{writeStop, WritingPaused, WritingIdle},
+	}
+	for _, step := range steps {
+		if m := ds.writingState.mode(); m != step.from {
+			t.Fatalf("mode is %s before %s, want %s", m, step.command, step.from)
+		}
+		to, err := ds.writingState.nextWritingMode(writeControlRequest{command: step.command})
+		if step.to == "" {
+			if e, ok := err.(*WriteTransitionError); !ok || e.Mode != step.from || e.Request != step.command {
+				t.Errorf("request %s in mode %s returns %v, want a WriteTransitionError", step.command, step.from, err)
+			}
+			continue
+		}
+		if err != nil || to != step.to {
+			t.Errorf("request %s in mode %s returns %s, %v, want %s", step.command, step.from, to, err, step.to)
+		}
+		ds.setWritingMode(to, step.command, nil)
+		ws := ds.writingState
+		if ws.Active != (to == WritingActive || to == WritingPaused) || ws.Paused != (to == WritingPaused) {
+			t.Errorf("mode %s has Active=%t, Paused=%t", to, ws.Active, ws.Paused)
+		}
+	}
+
+	// Only STOP leaves the error state.
+	ds.setWritingMode(WritingError, writeStop, &WriteRequestError{Request: "test"})
+	if ds.writingState.Active || ds.writingState.ModeError == "" {
+		t.Errorf("error state has Active=%t, ModeError=%q", ds.writingState.Active, ds.writingState.ModeError)
+	}
+	for _, command := range []string{writeStart, writePause, writeUnpause} {
+		if _, err := ds.writingState.nextWritingMode(writeControlRequest{command: command}); err == nil {
+			t.Errorf("request %s is allowed in mode %s", command, WritingError)
+		}
+	}
+	if to, err := ds.writingState.nextWritingMode(writeControlRequest{command: writeStop}); err != nil || to != WritingIdle {
+		t.Errorf("request STOP in mode %s returns %s, %v, want %s", WritingError, to, err, WritingIdle)
+	}
+	ds.setWritingMode(WritingIdle, writeStop, nil)
+	if ds.writingState.ModeError != "" {
+		t.Errorf("ModeError=%q after returning to %s", ds.writingState.ModeError, WritingIdle)
+	}
+}
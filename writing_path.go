@@ -0,0 +1,179 @@
+package dastard
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirectoryNaming sets how each run's directory and files are named. With the default
+// (zero) value, they are basepath/20060102/0000/20060102_run0000_%s.%s.
+type DirectoryNaming struct {
+	DateFormat string // Go time layout of the date in the names (e.g., "2006-01-02"); empty means "20060102"
+	RunDigits  int    // digits of the run number, 1 to 6; 0 means 4
+	Prefix     string // if not empty, the date directory and file names start with Prefix and "_"
+}
+
+// validNamingPrefix matches a Prefix that is safe in file names.
+var validNamingPrefix = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+// validate checks that the naming gives one valid directory name per day.
+func (n *DirectoryNaming) validate() error {
+	if n.RunDigits < 0 || n.RunDigits > 6 {
+		return fmt.Errorf("DirectoryNaming RunDigits=%d, must be in [1,6] (or 0 for the default)", n.RunDigits)
+	}
+	if !validNamingPrefix.MatchString(n.Prefix) {
+		return fmt.Errorf("DirectoryNaming Prefix=%q may use only letters, digits, '.', '_', and '-'", n.Prefix)
+	}
+	day1 := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	date := day1.Format(n.dateFormat())
+	if date == "" || strings.ContainsAny(date, `/\%`) || strings.HasPrefix(date, ".") {
+		return fmt.Errorf("DateFormat %q gives %q, which is not a valid directory name", n.DateFormat, date)
+	}
+	// Each day needs its own directory, but one directory per minute would be silly.
+	if date == day1.AddDate(0, 0, 1).Format(n.dateFormat()) {
+		return fmt.Errorf("DateFormat %q gives the same name on different days", n.DateFormat)
+	}
+	if date != day1.Add(time.Hour).Format(n.dateFormat()) {
+		return fmt.Errorf("DateFormat %q gives different names within one day", n.DateFormat)
+	}
+	return nil
+}
+
+func (n *DirectoryNaming) dateFormat() string {
+	if n.DateFormat == "" {
+		return "20060102"
+	}
+	return n.DateFormat
+}
+
+func (n *DirectoryNaming) runDigits() int {
+	if n.RunDigits == 0 {
+		return 4
+	}
+	return n.RunDigits
+}
+
+// makeDirectory creates the next run directory in basepath, named for today. It returns
+// the pattern of the run's file names for use in an Sprintf call with the file's
+// name and extension, such as basepath/20060102/0000/20060102_run0000_%s.%s.
+func (n *DirectoryNaming) makeDirectory(basepath string, now time.Time) (string, error) {
+	todayDir, today, err := n.makeTodayDirectory(basepath, now)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < n.maxRuns(); i++ {
+		if pattern, err := n.makeRunDirectory(todayDir, today, i); err == nil || !os.IsExist(err) {
+			return pattern, err
+		}
+	}
+	return "", fmt.Errorf("out of %d-digit ID numbers for today in %s", n.runDigits(), todayDir)
+}
+
+// makeTodayDirectory creates (if needed) the directory of today's runs in basepath. It
+// returns the directory and today's name.
+func (n *DirectoryNaming) makeTodayDirectory(basepath string, now time.Time) (string, string, error) {
+	if len(basepath) == 0 {
+		return "", "", fmt.Errorf("BasePath is the empty string")
+	}
+	today := now.Format(n.dateFormat())
+	if n.Prefix != "" {
+		today = n.Prefix + "_" + today
+	}
+	todayDir := fmt.Sprintf("%s/%s", basepath, today)
+	if err := os.MkdirAll(todayDir, 0755); err != nil {
+		return "", "", err
+	}
+	return todayDir, today, nil
+}
+
+// maxRuns is the number of run numbers available each day.
+func (n *DirectoryNaming) maxRuns() int {
+	maxRuns := 1
+	for i := 0; i < n.runDigits(); i++ {
+		maxRuns *= 10
+	}
+	return maxRuns
+}
+
+// runDirectory returns the directory of the given run in todayDir.
+func (n *DirectoryNaming) runDirectory(todayDir string, run int) string {
+	return fmt.Sprintf("%s/%0*d", todayDir, n.runDigits(), run)
+}
+
+// makeRunDirectory creates the directory of the given run, and returns the pattern of
+// its file names. If the directory already exists, the error satisfies os.IsExist.
+func (n *DirectoryNaming) makeRunDirectory(todayDir, today string, run int) (string, error) {
+	thisDir := n.runDirectory(todayDir, run)
+	if err := os.Mkdir(thisDir, 0755); err != nil {
+		return "", err
+	}
+	return n.runPattern(todayDir, today, run), nil
+}
+
+// runPattern returns the pattern of the file names of the given run.
+func (n *DirectoryNaming) runPattern(todayDir, today string, run int) string {
+	return fmt.Sprintf("%s/%s_run%0*d_%%s.%%s", n.runDirectory(todayDir, run), today, n.runDigits(), run)
+}
+
+// WritingPathConfig is the RPC-usable structure for SetWritingPath, and the state of
+// where runs are written.
+type WritingPathConfig struct {
+	BasePath     string // where each day's directory is made; empty means keep the current one
+	Naming       DirectoryNaming
+	Coordination RunCoordination // share run numbers with other instances writing to BasePath
+}
+
+// writingPathRegistry holds the base path and directory naming of the next run. It is
+// set by RPC SetWritingPath (or read from the config file), and the base path also by
+// a WriteControl START with a Path.
+type writingPathRegistry struct {
+	config WritingPathConfig
+	sync.Mutex
+}
+
+// writingPaths is the one registry shared by the SourceControl and all sources.
+var writingPaths = &writingPathRegistry{}
+
+// set validates and stores config. An empty BasePath keeps the current one.
+func (r *writingPathRegistry) set(config WritingPathConfig) error {
+	if err := config.Naming.validate(); err != nil {
+		return err
+	}
+	if err := config.Coordination.validate(); err != nil {
+		return err
+	}
+	if config.BasePath != "" {
+		info, err := os.Stat(config.BasePath)
+		if err != nil {
+			return fmt.Errorf("BasePath %q: %v", config.BasePath, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("BasePath %q is not a directory", config.BasePath)
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	if config.BasePath == "" {
+		config.BasePath = r.config.BasePath
+	}
+	r.config = config
+	return nil
+}
+
+// setBasePath changes only the base path.
+func (r *writingPathRegistry) setBasePath(path string) {
+	r.Lock()
+	defer r.Unlock()
+	r.config.BasePath = path
+}
+
+// get returns the current base path and naming.
+func (r *writingPathRegistry) get() WritingPathConfig {
+	r.Lock()
+	defer r.Unlock()
+	return r.config
+}
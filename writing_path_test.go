@@ -0,0 +1,98 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirectoryNaming(t *testing.T) {
+	for _, bad := range []DirectoryNaming{{RunDigits: -1}, {RunDigits: 7}, {Prefix: "a/b"}, {Prefix: "my run"},
+		{DateFormat: "2006/01/02"}, {DateFormat: "run"}, {DateFormat: "2006-01"}, {DateFormat: "20060102-1504"},
+		{DateFormat: "100%-02"}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("DirectoryNaming%+v.validate() should fail", bad)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "dastard_naming_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	now := time.Date(2019, 3, 14, 15, 9, 26, 0, time.Local)
+	for _, test := range []struct {
+		naming DirectoryNaming
+		want   string
+	}{
+		{DirectoryNaming{}, "20190314/0000/20190314_run0000_%s.%s"},
+		{DirectoryNaming{}, "20190314/0001/20190314_run0001_%s.%s"},
+		{DirectoryNaming{DateFormat: "2006-01-02", RunDigits: 2, Prefix: "cal"}, "cal_2019-03-14/00/cal_2019-03-14_run00_%s.%s"},
+		{DirectoryNaming{DateFormat: "2006-01-02", RunDigits: 2, Prefix: "cal"}, "cal_2019-03-14/01/cal_2019-03-14_run01_%s.%s"},
+	} {
+		if err := test.naming.validate(); err != nil {
+			t.Error(err)
+		}
+		pattern, err := test.naming.makeDirectory(tmp, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(tmp, test.want); pattern != want {
+			t.Errorf("makeDirectory gives %q, want %q", pattern, want)
+		}
+		if info, err := os.Stat(filepath.Dir(pattern)); err != nil || !info.IsDir() {
+			t.Errorf("makeDirectory did not create %s", filepath.Dir(pattern))
+		}
+	}
+	short := DirectoryNaming{RunDigits: 1}
+	for i := 0; i < 10; i++ {
+		if _, err := short.makeDirectory(tmp, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := short.makeDirectory(tmp, now); err == nil {
+		t.Error("makeDirectory should fail after 10 runs with RunDigits=1")
+	}
+
+	// The registry keeps the base path unless a new one is given.
+	saved := writingPaths
+	defer func() { writingPaths = saved }()
+	writingPaths = &writingPathRegistry{}
+	if err := writingPaths.set(WritingPathConfig{BasePath: tmp}); err != nil {
+		t.Error(err)
+	}
+	if err := writingPaths.set(WritingPathConfig{Naming: DirectoryNaming{Prefix: "x"}}); err != nil {
+		t.Error(err)
+	}
+	if wpc := writingPaths.get(); wpc.BasePath != tmp || wpc.Naming.Prefix != "x" {
+		t.Errorf("writing path is %+v, want BasePath %s and Prefix x", wpc, tmp)
+	}
+	for _, bad := range []WritingPathConfig{{BasePath: filepath.Join(tmp, "missing")},
+		{BasePath: tmp, Naming: DirectoryNaming{RunDigits: 9}}} {
+		if err := writingPaths.set(bad); err == nil {
+			t.Errorf("set(%+v) should fail", bad)
+		}
+	}
+	if wpc := writingPaths.get(); wpc.BasePath != tmp || wpc.Naming.Prefix != "x" {
+		t.Errorf("failed set changed the writing path to %+v", wpc)
+	}
+
+	// WriteControl START uses the registry's base path and naming.
+	ds := AnySource{nchan: 2}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	config := &WriteControlConfig{Request: "Start", WriteLJH22: true}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatal(err)
+	}
+	if dir, want := ds.writingState.RunDirectory, filepath.Join(tmp, "x_"+time.Now().Format("20060102"), "0000"); dir != want {
+		t.Errorf("run directory is %s, want %s", dir, want)
+	}
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,112 @@
+package dastard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	czmq "github.com/zeromq/goczmq"
+)
+
+// z85Chars are the characters of the Z85 encoding that ZMQ uses for CURVE keys.
+const z85Chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+// isZ85Key returns whether key is a 32-byte CURVE key in Z85 (40 characters).
+func isZ85Key(key string) bool {
+	if len(key) != 40 {
+		return false
+	}
+	for _, c := range key {
+		if !strings.ContainsRune(z85Chars, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// certSecretKey finds the secret key in a CZMQ certificate file.
+var certSecretKey = regexp.MustCompile(`(?m)^\s*secret-key\s*=\s*"([^"]*)"`)
+
+// zmqCurveSecretKey returns the CURVE secret key of the ZMQ publishers, or "" if the
+// config file doesn't ask for CURVE. Set ZMQCurveSecretKey (in Z85), or, to keep the key
+// out of the config file, ZMQCurveCertFile (a CZMQ secret certificate file, as made by
+// zcert_save_secret or zmq's curve_keygen).
+func zmqCurveSecretKey() (string, error) {
+	key := viper.GetString("zmqcurvesecretkey")
+	certFile := viper.GetString("zmqcurvecertfile")
+	if key != "" && certFile != "" {
+		return "", fmt.Errorf("set only one of ZMQCurveSecretKey and ZMQCurveCertFile")
+	}
+	if certFile != "" {
+		contents, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read ZMQCurveCertFile: %v", err)
+		}
+		m := certSecretKey.FindSubmatch(contents)
+		if m == nil {
+			return "", fmt.Errorf("ZMQCurveCertFile %s has no secret-key", certFile)
+		}
+		key = string(m[1])
+	}
+	if key != "" && !isZ85Key(key) {
+		return "", fmt.Errorf("the CURVE secret key is not 40 characters of Z85")
+	}
+	if key == "" && viper.GetString("zmqcurveclientcertsdir") != "" {
+		return "", fmt.Errorf("ZMQCurveClientCertsDir needs ZMQCurveSecretKey or ZMQCurveCertFile")
+	}
+	return key, nil
+}
+
+// zmqCurve holds the socket options of the ZMQ publishers, set up once from the config
+// file, and the ZAP handler that checks the clients' certificates, if any.
+var zmqCurve struct {
+	once    sync.Once
+	options []czmq.SockOption
+	auth    *czmq.Auth
+	err     error
+}
+
+// setupZMQCurve finds the socket options of the ZMQ publishers. With a CURVE secret key,
+// the publishers are CURVE servers: their messages are encrypted, and a client must know
+// the server's public key to subscribe. If ZMQCurveClientCertsDir is also set, only
+// clients whose public certificates are in that directory may subscribe.
+func setupZMQCurve() {
+	key, err := zmqCurveSecretKey()
+	if err != nil {
+		zmqCurve.err = fmt.Errorf("ZMQ CURVE configuration error: %v", err)
+		logErrorf("%v; ZMQ publishers will not start", zmqCurve.err)
+		return
+	}
+	if key == "" {
+		return
+	}
+	if dir := viper.GetString("zmqcurveclientcertsdir"); dir != "" {
+		// The ZAP handler must run before any socket binds.
+		zmqCurve.auth = czmq.NewAuth()
+		if err := zmqCurve.auth.Curve(dir); err != nil {
+			zmqCurve.auth.Destroy()
+			zmqCurve.auth = nil
+			zmqCurve.err = fmt.Errorf("could not authenticate ZMQ clients with certificates in %s: %v", dir, err)
+			logErrorf("%v; ZMQ publishers will not start", zmqCurve.err)
+			return
+		}
+		logInfof("ZMQ publishers use CURVE, for clients with certificates in %s", dir)
+	} else {
+		logInfof("ZMQ publishers use CURVE, for any client with the server's public key")
+	}
+	zmqCurve.options = []czmq.SockOption{czmq.SockSetCurveServer(1), czmq.SockSetCurveSecretkey(key)}
+}
+
+// newPubSocket binds a ZMQ PUB socket to the given port on all interfaces, as a CURVE
+// server if the config file asks for one. If the CURVE configuration is invalid, no
+// socket is made, rather than publish without encryption.
+func newPubSocket(port int) (*czmq.Sock, error) {
+	zmqCurve.once.Do(setupZMQCurve)
+	if zmqCurve.err != nil {
+		return nil, zmqCurve.err
+	}
+	return czmq.NewPub(fmt.Sprintf("tcp://*:%d", port), zmqCurve.options...)
+}
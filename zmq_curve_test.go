@@ -0,0 +1,142 @@
+package dastard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	czmq "github.com/zeromq/goczmq"
+)
+
+func TestZMQCurveSecretKey(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_curve_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const key = "D:)Q[IlAW!ahhC2ac:9*A}h:p?([4%wOTJ%JR%cs"
+	certFile := filepath.Join(tmp, "server.key_secret")
+	cert := "metadata\ncurve\n    public-key = \"Yne@$w-vo<fVvi]a<NY6T1ed:M$fCG*[IaLV{hID\"\n    secret-key = \"" + key + "\"\n"
+	if err := ioutil.WriteFile(certFile, []byte(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setCurve := func(key, certFile, clientsDir string) {
+		viper.Set("zmqcurvesecretkey", key)
+		viper.Set("zmqcurvecertfile", certFile)
+		viper.Set("zmqcurveclientcertsdir", clientsDir)
+	}
+	defer setCurve("", "", "")
+
+	if !isZ85Key(key) {
+		t.Errorf("isZ85Key(%q) = false, want true", key)
+	}
+	for _, bad := range []string{"", key[:39], key + "0", strings.Replace(key, "D", "~", 1)} {
+		if isZ85Key(bad) {
+			t.Errorf("isZ85Key(%q) = true, want false", bad)
+		}
+	}
+
+	setCurve("", "", "")
+	if k, err := zmqCurveSecretKey(); k != "" || err != nil {
+		t.Errorf("zmqCurveSecretKey() with no settings = %q, %v, want \"\", nil", k, err)
+	}
+	setCurve(key, "", tmp)
+	if k, err := zmqCurveSecretKey(); k != key || err != nil {
+		t.Errorf("zmqCurveSecretKey() from config = %q, %v, want %q, nil", k, err, key)
+	}
+	setCurve("", certFile, "")
+	if k, err := zmqCurveSecretKey(); k != key || err != nil {
+		t.Errorf("zmqCurveSecretKey() from certificate = %q, %v, want %q, nil", k, err, key)
+	}
+	for _, settings := range [][]string{{key, certFile, ""}, {"short", "", ""}, {"", "", tmp},
+		{"", filepath.Join(tmp, "missing"), ""}, {"", filepath.Join(tmp), ""}} {
+		setCurve(settings[0], settings[1], settings[2])
+		if _, err := zmqCurveSecretKey(); err == nil {
+			t.Errorf("zmqCurveSecretKey() with settings %v should fail", settings)
+		}
+	}
+}
+
+// TestZMQCurveClients checks that a CURVE publisher with ZMQCurveClientCertsDir sends to
+// a client with a known certificate, but not to a client without CURVE or with an
+// unknown certificate.
+func TestZMQCurveClients(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastard_curve_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	server, known, unknown := czmq.NewCert(), czmq.NewCert(), czmq.NewCert()
+	defer server.Destroy()
+	defer known.Destroy()
+	defer unknown.Destroy()
+	if err := known.SavePublic(filepath.Join(tmp, "known.key")); err != nil {
+		t.Fatal(err)
+	}
+
+	resetCurve := func(key, clientsDir string) {
+		viper.Set("zmqcurvesecretkey", key)
+		viper.Set("zmqcurveclientcertsdir", clientsDir)
+		if zmqCurve.auth != nil {
+			zmqCurve.auth.Destroy()
+		}
+		zmqCurve.once = sync.Once{}
+		zmqCurve.options, zmqCurve.auth, zmqCurve.err = nil, nil, nil
+	}
+	resetCurve(server.SecretText(), tmp)
+	defer resetCurve("", "")
+
+	const port = 33390
+	pub, err := newPubSocket(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Destroy()
+	subscribe := func(cert *czmq.Cert) *czmq.Sock {
+		options := []czmq.SockOption{czmq.SockSetRcvtimeo(100)}
+		if cert != nil {
+			options = append(options, czmq.SockSetCurveServerkey(server.PublicText()),
+				czmq.SockSetCurvePublickey(cert.PublicText()), czmq.SockSetCurveSecretkey(cert.SecretText()))
+		}
+		sub, err := czmq.NewSub(fmt.Sprintf("tcp://127.0.0.1:%d", port), "", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sub
+	}
+	good := subscribe(known)
+	defer good.Destroy()
+	plain := subscribe(nil)
+	defer plain.Destroy()
+	stranger := subscribe(unknown)
+	defer stranger.Destroy()
+
+	// Publish until the known client hears, as subscriptions take a moment to arrive.
+	heard := false
+	for i := 0; i < 50 && !heard; i++ {
+		if err := pub.SendFrame([]byte("status"), czmq.FlagNone); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := good.RecvFrame()
+		heard = err == nil
+	}
+	if !heard {
+		t.Fatal("a client with a known certificate received nothing")
+	}
+	for i := 0; i < 5; i++ {
+		pub.SendFrame([]byte("status"), czmq.FlagNone)
+	}
+	for _, sub := range []struct {
+		name string
+		sock *czmq.Sock
+	}{{"without CURVE", plain}, {"with an unknown certificate", stranger}} {
+		if frame, _, err := sub.sock.RecvFrame(); err == nil {
+			t.Errorf("a client %s received %q", sub.name, frame)
+		}
+	}
+}